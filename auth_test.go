@@ -0,0 +1,752 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stevemcghee/go-to-production/internal/app"
+)
+
+// TestAuthMiddlewareAPIKeys tests authentication and scope enforcement for API keys
+func TestAuthMiddlewareAPIKeys(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalMode := app.AuthMode
+	srv := app.NewServer(mockDB, mockDB)
+	srv.APIKeys.SetBootstrapKey("bootstrap-secret")
+	defer func() {
+		app.AuthMode = originalMode
+	}()
+
+	mock.ExpectQuery("SELECT id, scopes, tenant_id FROM api_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scopes", "tenant_id"}))
+	mock.ExpectQuery("SELECT id, scopes, tenant_id FROM api_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scopes", "tenant_id"}).AddRow(7, "{read}", nil))
+
+	handler := srv.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		mode           string
+		method         string
+		path           string
+		key            string
+		expectedStatus int
+	}{
+		{"public path without key", "required", http.MethodGet, "/healthz", "", http.StatusOK},
+		{"anonymous allowed when disabled", "disabled", http.MethodGet, "/todos", "", http.StatusOK},
+		{"anonymous rejected when required", "required", http.MethodGet, "/todos", "", http.StatusUnauthorized},
+		{"admin requires key even when disabled", "disabled", http.MethodGet, "/admin/apikeys", "", http.StatusUnauthorized},
+		{"bootstrap key grants admin", "required", http.MethodGet, "/admin/apikeys", "bootstrap-secret", http.StatusOK},
+		{"unknown key rejected", "optional", http.MethodGet, "/todos", "tdk_unknown", http.StatusUnauthorized},
+		{"read key can read", "required", http.MethodGet, "/todos", "tdk_reader", http.StatusOK},
+		{"read key cannot write (cached)", "required", http.MethodPost, "/todos", "tdk_reader", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.AuthMode = tt.mode
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set(app.APIKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// jwksServer serves OIDC discovery and a JWKS containing the given RSA keys.
+func jwksServer(t *testing.T, mu *sync.Mutex, keys map[string]*rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/jwks"})
+		case "/jwks":
+			mu.Lock()
+			defer mu.Unlock()
+			var jwks []map[string]string
+			for kid, k := range keys {
+				jwks = append(jwks, map[string]string{
+					"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+					"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+					"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"keys": jwks})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := enc(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// TestAuthMiddlewareOIDC tests bearer JWT validation, including signing key rotation
+func TestAuthMiddlewareOIDC(t *testing.T) {
+	srv := app.NewServer(nil, nil)
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mu sync.Mutex
+	keys := map[string]*rsa.PrivateKey{"k1": key1}
+	ts := jwksServer(t, &mu, keys)
+	defer ts.Close()
+
+	originalOIDC, originalMode := app.OIDC, app.AuthMode
+	app.OIDC = app.NewOIDCVerifier(ts.URL, "todo-app", "")
+	app.AuthMode = "required"
+	defer func() { app.OIDC, app.AuthMode = originalOIDC, originalMode }()
+
+	var gotUser string
+	handler := srv.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := app.PrincipalFromContext(r.Context()); ok {
+			gotUser = p.UserID
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	claims := func(aud string, exp time.Duration) map[string]any {
+		return map[string]any{"iss": ts.URL, "sub": "alice", "aud": aud, "exp": time.Now().Add(exp).Unix()}
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"valid token", http.MethodGet, "/todos", signJWT(t, key1, "k1", claims("todo-app", time.Hour)), http.StatusOK},
+		{"valid token can write", http.MethodPost, "/todos", signJWT(t, key1, "k1", claims("todo-app", time.Hour)), http.StatusOK},
+		{"wrong audience", http.MethodGet, "/todos", signJWT(t, key1, "k1", claims("other", time.Hour)), http.StatusUnauthorized},
+		{"expired", http.MethodGet, "/todos", signJWT(t, key1, "k1", claims("todo-app", -time.Hour)), http.StatusUnauthorized},
+		{"forged signature", http.MethodGet, "/todos", signJWT(t, key2, "k1", claims("todo-app", time.Hour)), http.StatusUnauthorized},
+		{"malformed", http.MethodGet, "/todos", "not-a-jwt", http.StatusUnauthorized},
+		{"no admin via jwt", http.MethodGet, "/admin/apikeys", signJWT(t, key1, "k1", claims("todo-app", time.Hour)), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUser = ""
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if w.Code == http.StatusOK && gotUser != "alice" {
+				t.Errorf("expected user alice in context, got %q", gotUser)
+			}
+		})
+	}
+
+	// Key rotation: a token signed with a newly published key is accepted after a refetch.
+	mu.Lock()
+	keys["k2"] = key2
+	mu.Unlock()
+	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, key2, "k2", claims("todo-app", time.Hour)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected rotated key to be accepted, got %d", w.Code)
+	}
+}
+
+// TestCSRFMiddleware tests double-submit-cookie CSRF protection for browser requests
+func TestCSRFMiddleware(t *testing.T) {
+	handler := app.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		method         string
+		cookie         string
+		token          string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{"safe method", http.MethodGet, "abc", "", nil, http.StatusOK},
+		{"matching token", http.MethodPost, "abc", "abc", nil, http.StatusOK},
+		{"missing token", http.MethodPost, "abc", "", nil, http.StatusForbidden},
+		{"mismatched token", http.MethodDelete, "abc", "xyz", nil, http.StatusForbidden},
+		{"cookie-less API client", http.MethodPost, "", "", nil, http.StatusOK},
+		{"api key exempt", http.MethodPost, "abc", "", map[string]string{app.APIKeyHeader: "tdk_x"}, http.StatusOK},
+		{"bearer exempt", http.MethodPut, "abc", "", map[string]string{"Authorization": "Bearer x"}, http.StatusOK},
+		{"cross-site fetch", http.MethodPost, "", "", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"foreign origin", http.MethodPost, "abc", "abc", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"same origin", http.MethodPost, "abc", "abc", map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/todos", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: app.CSRFCookieName, Value: tt.cookie})
+			}
+			if tt.token != "" {
+				req.Header.Set(app.CSRFHeader, tt.token)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+// TestSessionLifecycle tests login via bearer credentials, cookie-based authentication and logout
+func TestSessionLifecycle(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalMode := app.AuthMode
+	srv := app.NewServer(mockDB, nil)
+	app.AuthMode = "required"
+	srv.APIKeys.SetBootstrapKey("bootstrap-secret")
+	defer func() {
+		app.AuthMode = originalMode
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/login", srv.HandleLogin)
+	mux.HandleFunc("/auth/logout", srv.HandleLogout)
+	mux.HandleFunc("/auth/session", app.HandleSession)
+	handler := srv.AuthMiddleware(mux)
+
+	// Login exchanges the API key for an HttpOnly session cookie
+	mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	req.Header.Set(app.APIKeyHeader, "bootstrap-secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", w.Code)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == app.SessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected HttpOnly SameSite=Lax session cookie, got %+v", cookie)
+	}
+
+	// The cookie alone authenticates subsequent requests
+	mock.ExpectQuery("SELECT subject, user_id, email, scopes, last_seen_at FROM sessions").
+		WillReturnRows(sqlmock.NewRows([]string{"subject", "user_id", "email", "scopes", "last_seen_at"}).
+			AddRow("apikey:bootstrap", "", "", "{admin}", time.Now()))
+	req = httptest.NewRequest(http.MethodGet, "/auth/session", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected session to authenticate, got %d", w.Code)
+	}
+
+	// Expired or unknown sessions count as no credentials
+	mock.ExpectQuery("FROM sessions").WillReturnError(sql.ErrNoRows)
+	req = httptest.NewRequest(http.MethodGet, "/auth/session", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected expired session to be rejected, got %d", w.Code)
+	}
+
+	// Logout deletes the session and clears the cookie, even when the session has expired
+	mock.ExpectExec("DELETE FROM sessions WHERE token_hash").WillReturnResult(sqlmock.NewResult(0, 1))
+	req = httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected logout to succeed, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestGoogleLoginFlow tests the authorization code + PKCE flow against a fake Google
+func TestGoogleLoginFlow(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	originalGoogle := app.Google
+	srv := app.NewServer(mockDB, nil)
+	defer func() { app.Google = originalGoogle }()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mu sync.Mutex
+	idp := jwksServer(t, &mu, map[string]*rsa.PrivateKey{"g1": key})
+	defer idp.Close()
+
+	var challenge, nonce string
+	token := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "auth-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idToken := signJWT(t, key, "g1", map[string]any{
+			"iss": idp.URL, "sub": "1234", "aud": "client-id", "email": "alice@example.com",
+			"nonce": nonce, "exp": time.Now().Add(time.Hour).Unix(),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	}))
+	defer token.Close()
+
+	app.Google = app.NewGoogleLogin("client-id", "client-secret", "")
+	app.Google.AuthURL = idp.URL + "/auth"
+	app.Google.TokenURL = token.URL
+	app.Google.Verifier = app.NewOIDCVerifier(idp.URL, "client-id", "")
+
+	// Step 1: redirect to the identity provider with PKCE and a state cookie
+	w := httptest.NewRecorder()
+	app.HandleGoogleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/google", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	challenge, nonce = loc.Query().Get("code_challenge"), loc.Query().Get("nonce")
+	if loc.Query().Get("code_challenge_method") != "S256" || challenge == "" {
+		t.Fatalf("expected S256 PKCE challenge in %s", loc)
+	}
+	stateCookie := w.Result().Cookies()[0]
+
+	// A callback with a forged state is rejected
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/auth/google/callback?state=forged&code=auth-code", nil)
+	req.AddCookie(stateCookie)
+	srv.HandleGoogleCallback(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected forged state to be rejected, got %d", w.Code)
+	}
+
+	// Step 2: the callback creates the user and a session
+	mock.ExpectExec("INSERT INTO users").
+		WithArgs("google", "1234", "user:1234", "alice@example.com", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/auth/google/callback?state="+loc.Query().Get("state")+"&code=auth-code", nil)
+	req.AddCookie(stateCookie)
+	srv.HandleGoogleCallback(w, req)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect home after sign-in, got %d: %s", w.Code, w.Body.String())
+	}
+	hasSession := false
+	for _, c := range w.Result().Cookies() {
+		hasSession = hasSession || (c.Name == app.SessionCookieName && c.Value != "")
+	}
+	if !hasSession {
+		t.Error("expected a session cookie after sign-in")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// issueCert creates a certificate signed by parent (self-signed when parent is nil).
+func issueCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// TestMTLSAuthentication tests client certificate authentication against a SPIFFE ID allowlist
+func TestMTLSAuthentication(t *testing.T) {
+	srv := app.NewServer(nil, nil)
+	dir := t.TempDir()
+	ca, caKey, caPEM := issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, serverKey, serverPEM := issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2), DNSNames: []string{"localhost"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientCert := func(id string) tls.Certificate {
+		u, _ := url.Parse(id)
+		c, key, _ := issueCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()), URIs: []*url.URL{u},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+		return tls.Certificate{Certificate: [][]byte{c.Raw}, PrivateKey: key}
+	}
+
+	keyDER, _ := x509.MarshalECPrivateKey(serverKey)
+	os.WriteFile(dir+"/ca.pem", caPEM, 0o600)
+	os.WriteFile(dir+"/server.pem", serverPEM, 0o600)
+	os.WriteFile(dir+"/server-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	tlsConfig, err := app.NewServerTLSConfig(dir+"/server.pem", dir+"/server-key.pem", dir+"/ca.pem")
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %v", err)
+	}
+	originalMTLS, originalMode := app.MTLS, app.AuthMode
+	app.MTLS, err = app.NewMTLSAllowlist([]string{"spiffe://example.org/ns/batch/*", "spiffe://example.org/billing"}, []string{app.ScopeRead})
+	if err != nil {
+		t.Fatalf("failed to build allowlist: %v", err)
+	}
+	app.AuthMode = "required"
+	defer func() { app.MTLS, app.AuthMode = originalMTLS, originalMode }()
+
+	ts := httptest.NewUnstartedServer(srv.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := app.PrincipalFromContext(r.Context())
+		w.Write([]byte(p.Subject))
+	})))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tests := []struct {
+		name           string
+		id             string
+		method         string
+		expectedStatus int
+	}{
+		{"allowed by prefix", "spiffe://example.org/ns/batch/worker", http.MethodGet, http.StatusOK},
+		{"allowed exactly", "spiffe://example.org/billing", http.MethodGet, http.StatusOK},
+		{"scope still enforced", "spiffe://example.org/billing", http.MethodPost, http.StatusForbidden},
+		{"not on allowlist", "spiffe://example.org/ns/web/frontend", http.MethodGet, http.StatusUnauthorized},
+		{"no client certificate", "", http.MethodGet, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := &tls.Config{RootCAs: roots}
+			if tt.id != "" {
+				clientTLS.Certificates = []tls.Certificate{clientCert(tt.id)}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			req, _ := http.NewRequest(tt.method, ts.URL+"/todos", nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestAbuseProtection tests temporary bans after repeated auth failures and their escalation
+func TestAbuseProtection(t *testing.T) {
+	store := app.NewMemoryAbuseStore()
+	oldAbuse := app.Abuse
+	app.Abuse.Store = store
+	app.Abuse.Config.AuthFailureLimit = 3
+	app.Abuse.Config.MalformedLimit = 2
+	defer func() { app.Abuse = oldAbuse }()
+
+	handler := app.AbuseMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bad":
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		case "/login":
+			if r.Header.Get(app.APIKeyHeader) != "tdk_good" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	do := func(path, ip, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if key != "" {
+			req.Header.Set(app.APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := do("/login", "10.0.0.1", "tdk_guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	w := do("/", "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After for banned IP, got %d", w.Code)
+	}
+	// The guessed key is banned from every IP.
+	if w := do("/login", "10.0.0.2", "tdk_guess"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for banned credential, got %d", w.Code)
+	}
+	if w := do("/login", "10.0.0.2", "tdk_good"); w.Code != http.StatusOK {
+		t.Errorf("expected other credentials to be unaffected, got %d", w.Code)
+	}
+
+	// Malformed request floods ban the IP.
+	do("/bad", "10.0.0.3", "")
+	do("/bad", "10.0.0.3", "")
+	if w := do("/", "10.0.0.3", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after malformed flood, got %d", w.Code)
+	}
+
+	// Repeat offences double the ban, up to the maximum.
+	ctx := context.Background()
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		d, err := store.Ban(ctx, "ip:10.0.0.9", time.Minute, 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, d)
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ban %d: expected %v, got %v", i+1, want[i], got[i])
+		}
+	}
+}
+
+// TestTenancy tests that requests are bound to the tenant of their credentials, scoped
+// by qualified subjects, and rate-limited per tenant
+func TestTenancy(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalMode, originalTenancy := app.AuthMode, app.Tenancy
+	srv := app.NewServer(mockDB, mockDB)
+	app.AuthMode = "disabled"
+	app.Tenancy = app.TenancyConfig{Enabled: true, BaseDomain: "todo.example.com", RequestsPerMinute: 3, Store: app.NewMemoryAbuseStore()}
+	srv.APIKeys.SetBootstrapKey("bootstrap-secret")
+	defer func() {
+		app.AuthMode, app.Tenancy = originalMode, originalTenancy
+	}()
+
+	var got *app.Principal
+	handler := srv.AuthMiddleware(srv.TenantRateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = app.PrincipalFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})))
+	do := func(path, host, tenant, key string) *httptest.ResponseRecorder {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		if tenant != "" {
+			req.Header.Set(app.TenantHeader, tenant)
+		}
+		if key != "" {
+			req.Header.Set(app.APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	keyColumns := []string{"id", "scopes", "tenant_id"}
+	tenantColumns := []string{"id", "name", "max_todos", "max_open_todos", "max_lists", "max_attachment_bytes", "requests_per_minute", "features", "created_at", "updated_at"}
+	// New keys each run: validated keys are cached for the process.
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	acmeKey, adminKey, goneKey := "tdk_acme_"+suffix, "tdk_acme_admin_"+suffix, "tdk_gone_"+suffix
+
+	// A key bound to acme works on acme's subdomain, as acme's subject.
+	mock.ExpectQuery("SELECT id, scopes, tenant_id FROM api_keys").
+		WillReturnRows(sqlmock.NewRows(keyColumns).AddRow(7, "{read,write}", "acme"))
+	mock.ExpectQuery("FROM tenants WHERE id").WithArgs("acme").
+		WillReturnRows(sqlmock.NewRows(tenantColumns).AddRow("acme", "Acme", nil, nil, nil, nil, nil, []byte(`{"beta": true}`), time.Now(), time.Now()))
+	if w := do("/todos", "acme.todo.example.com", "", acmeKey); w.Code != http.StatusOK || got == nil || got.Subject != "acme/apikey:7" || got.Tenant != "acme" {
+		t.Fatalf("expected acme's subject on its subdomain, got %d %+v", w.Code, got)
+	}
+	if w := do("/todos", "todo.example.com", "", acmeKey); w.Code != http.StatusOK || got.Tenant != "acme" {
+		t.Errorf("expected the key's own tenant without one named, got %d %+v", w.Code, got)
+	}
+	if w := do("/todos", "todo.example.com", "other", acmeKey); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for acme's key in another tenant, got %d", w.Code)
+	}
+
+	// Unbound credentials and anonymous callers stay in the default tenant.
+	if w := do("/todos", "todo.example.com", "acme", "bootstrap-secret"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unbound key in acme, got %d", w.Code)
+	}
+	if w := do("/todos", "acme.todo.example.com", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an anonymous caller in acme, got %d", w.Code)
+	}
+	if w := do("/todos", "todo.example.com", "", ""); w.Code != http.StatusOK || got != nil {
+		t.Errorf("expected anonymous callers in the default tenant, got %d %+v", w.Code, got)
+	}
+	mock.ExpectQuery("FROM tenants WHERE id").WithArgs("default").
+		WillReturnRows(sqlmock.NewRows(tenantColumns).AddRow("default", "Default", nil, nil, nil, nil, nil, []byte("{}"), time.Now(), time.Now()))
+	if w := do("/todos", "todo.example.com", "", "bootstrap-secret"); w.Code != http.StatusOK || got.Subject != "apikey:bootstrap" || got.Tenant != app.DefaultTenant {
+		t.Errorf("expected an unqualified subject in the default tenant, got %d %+v", w.Code, got)
+	}
+
+	// Administration stays with the default tenant; unknown tenants are refused.
+	mock.ExpectQuery("SELECT id, scopes, tenant_id FROM api_keys").
+		WillReturnRows(sqlmock.NewRows(keyColumns).AddRow(8, "{admin}", "acme"))
+	if w := do("/admin/apikeys", "todo.example.com", "", adminKey); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for admin from acme, got %d", w.Code)
+	}
+	mock.ExpectQuery("SELECT id, scopes, tenant_id FROM api_keys").
+		WillReturnRows(sqlmock.NewRows(keyColumns).AddRow(9, "{read}", "gone"))
+	mock.ExpectQuery("FROM tenants WHERE id").WithArgs("gone").WillReturnRows(sqlmock.NewRows(tenantColumns))
+	if w := do("/todos", "todo.example.com", "", goneKey); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a key of a deleted tenant, got %d", w.Code)
+	}
+
+	// The tenant's flags win over the global ones.
+	ctx := app.WithPrincipal(context.Background(), &app.Principal{Subject: "acme/user:1", Tenant: "acme"})
+	if !srv.TenantFeatureEnabled(ctx, "beta") || srv.TenantFeatureEnabled(context.Background(), "beta") {
+		t.Error("expected beta to be on for acme only")
+	}
+
+	// acme made two requests of its three a minute; the fourth is limited.
+	if w := do("/todos", "todo.example.com", "", acmeKey); w.Code != http.StatusOK {
+		t.Errorf("expected the third request to pass, got %d", w.Code)
+	}
+	if w := do("/todos", "todo.example.com", "", acmeKey); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After over the tenant's limit, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// TestTenantResources tests managing tenants through /admin/resources/tenants
+func TestTenantResources(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	srv := app.NewServer(mockDB, mockDB)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.HandleAdminResources(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPut, "/admin/resources/tenants/Acme", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid tenant id, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/admin/resources/tenants/acme", `{"requests_per_minute": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative limit, got %d", w.Code)
+	}
+
+	mock.ExpectQuery("INSERT INTO tenants").
+		WithArgs("acme", "Acme", 500, nil, 10, nil, nil, []byte(`{"beta":true}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at", "created"}).AddRow(time.Now(), time.Now(), true))
+	w := do(http.MethodPut, "/admin/resources/tenants/acme", `{"name": "Acme", "max_todos": 500, "max_lists": 10, "features": {"beta": true}}`)
+	var tenant app.Tenant
+	if err := json.Unmarshal(w.Body.Bytes(), &tenant); w.Code != http.StatusCreated || err != nil ||
+		tenant.ID != "acme" || *tenant.MaxTodos != 500 || *tenant.MaxLists != 10 || tenant.MaxOpenTodos != nil || tenant.RequestsPerMinute != nil || !tenant.Features["beta"] {
+		t.Errorf("expected the created tenant, got %d %s", w.Code, w.Body.String())
+	}
+
+	mock.ExpectQuery("FROM tenants WHERE id").WithArgs("nope").WillReturnError(sql.ErrNoRows)
+	if w := do(http.MethodGet, "/admin/resources/tenants/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown tenant, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/admin/resources/tenants/default", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for the default tenant, got %d", w.Code)
+	}
+	mock.ExpectExec("DELETE FROM tenants").WithArgs("acme").WillReturnError(&pq.Error{Code: "23503"})
+	if w := do(http.MethodDelete, "/admin/resources/tenants/acme", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 with keys still bound, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
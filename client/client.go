@@ -0,0 +1,294 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Package client is a typed Go client for the todo app's REST API (docs/API.md).
+//
+//	c, err := client.New("https://todo.example.com", client.WithAPIKey(os.Getenv("TODO_API_KEY")))
+//	todo, err := c.CreateTodo(ctx, client.NewTodo{Task: "buy milk"})
+//	for d, err := range c.Deliveries(ctx, webhookID, client.DeliveryFilter{Status: "dead"}) { ... }
+//
+// Requests that can safely run twice are retried on network errors, 429 and
+// 502/503/504, honouring Retry-After. POSTs are retried too: each call sends an
+// Idempotency-Key, which the server uses to answer a repeat with the first
+// response instead of running it again.
+package client
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	requestIDHeader      = "X-Request-ID"
+)
+
+// Client calls the API of one todo app deployment. It is safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	httpClient *http.Client
+	auth       func(*http.Request)
+	userAgent  string
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey authenticates with an API key (sent as X-API-Key).
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.auth = func(req *http.Request) { req.Header.Set("X-API-Key", key) }
+	}
+}
+
+// WithBearerToken authenticates with an OIDC ID token or other bearer token.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+}
+
+// WithHTTPClient sends requests through hc instead of http.DefaultClient, e.g.
+// one with a client certificate for mTLS.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often a failed request is retried (3 by default, 0 to turn
+// retries off) and the backoff before the first retry, which doubles up to 30s.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.minBackoff = n, backoff }
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the deployment at baseURL, e.g. "https://todo.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: parse base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("client: base URL %q must be an absolute http or https URL", baseURL)
+	}
+	u.Path, u.RawPath = strings.TrimSuffix(u.Path, "/"), ""
+	u.RawQuery, u.Fragment = "", ""
+	c := &Client{
+		base:       u,
+		httpClient: http.DefaultClient,
+		auth:       func(*http.Request) {},
+		userAgent:  "todo-app-go-client",
+		retries:    3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// APIError is a response with a 4xx or 5xx status.
+type APIError struct {
+	StatusCode int
+	Message    string // the response body, trimmed
+	RequestID  string // X-Request-ID of the response, for finding it in the logs
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("todo API: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// IsNotFound reports whether err is an APIError with status 404.
+func IsNotFound(err error) bool { return hasStatus(err, http.StatusNotFound) }
+
+// IsUnauthorized reports whether err is an APIError with status 401 or 403.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized) || hasStatus(err, http.StatusForbidden)
+}
+
+// IsConflict reports whether err is an APIError with status 409, e.g. a list member
+// that already exists.
+func IsConflict(err error) bool { return hasStatus(err, http.StatusConflict) }
+
+func hasStatus(err error, code int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == code
+}
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey makes the POST made with ctx use key instead of a generated
+// one. Pass the same key to repeat an operation safely across restarts of the
+// caller, e.g. one derived from a message ID the caller is processing.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// do sends a request with in as its JSON body (when not nil) and decodes the JSON
+// response into out (when not nil).
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	resp, err := c.send(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// send runs the request with retries and returns a response with a 2xx status,
+// whose body the caller closes. path must already be escaped.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, in any) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("client: encode %s %s request: %w", method, path, err)
+		}
+	}
+	target := c.base.String() + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var idemKey string
+	if method == http.MethodPost {
+		idemKey, _ = ctx.Value(idempotencyKeyCtx{}).(string)
+		if idemKey == "" {
+			idemKey = newIdempotencyKey()
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("User-Agent", c.userAgent)
+		if idemKey != "" {
+			req.Header.Set(idempotencyKeyHeader, idemKey)
+		}
+		c.auth(req)
+
+		resp, err := c.httpClient.Do(req)
+		var retryAfter time.Duration
+		if err == nil {
+			if resp.StatusCode < 400 {
+				return resp, nil
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = readAPIError(resp)
+			if !retryable(resp.StatusCode, retryAfter > 0) {
+				return nil, err
+			}
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.retries {
+			return nil, err
+		}
+
+		wait := c.backoff(attempt)
+		if retryAfter > wait {
+			wait = min(retryAfter, c.maxBackoff)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a response with status code is worth retrying. A 409
+// with Retry-After means an earlier attempt with the same Idempotency-Key is still
+// running; other conflicts are final.
+func retryable(code int, hasRetryAfter bool) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		return hasRetryAfter
+	}
+	return false
+}
+
+// backoff is the exponential backoff before retry attempt+1, jittered between half
+// and all of it.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << attempt
+	if d <= 0 || d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func readAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(msg)),
+		RequestID:  resp.Header.Get(requestIDHeader),
+	}
+}
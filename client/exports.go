@@ -0,0 +1,96 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Export is an export of the caller's todos.
+type Export struct {
+	ID          int64      `json:"id"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"` // "pending", "ready" or "failed"
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"` // signed, valid for a limited time
+}
+
+// ErrExportNotReady is returned by DownloadExport for an export that is still
+// pending or that failed.
+var ErrExportNotReady = errors.New("client: export is not ready")
+
+// StartExport starts an export in "json" or "csv" and returns it while pending.
+// Poll Export until its Status is "ready", or use WaitExport.
+func (c *Client) StartExport(ctx context.Context, format string) (*Export, error) {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	var e Export
+	if err := c.do(ctx, http.MethodPost, "/exports", q, nil, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Exports returns the caller's exports.
+func (c *Client) Exports(ctx context.Context) ([]Export, error) {
+	var exports []Export
+	return exports, c.do(ctx, http.MethodGet, "/exports", nil, nil, &exports)
+}
+
+// Export returns an export, with a fresh DownloadURL once it is ready.
+func (c *Client) Export(ctx context.Context, id int64) (*Export, error) {
+	var e Export
+	if err := c.do(ctx, http.MethodGet, "/exports/"+strconv.FormatInt(id, 10), nil, nil, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// WaitExport polls an export every interval until it is no longer pending, or ctx
+// is done.
+func (c *Client) WaitExport(ctx context.Context, id int64, interval time.Duration) (*Export, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e, err := c.Export(ctx, id)
+		if err != nil || e.Status != "pending" {
+			return e, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// DownloadExport fetches the file of a ready export, as returned by Export. The
+// caller closes the reader.
+func (c *Client) DownloadExport(ctx context.Context, e *Export) (io.ReadCloser, error) {
+	if e.Status != "ready" || e.DownloadURL == "" {
+		return nil, fmt.Errorf("%w: status %q", ErrExportNotReady, e.Status)
+	}
+	u, err := url.Parse(e.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: parse download URL: %w", err)
+	}
+	resp, err := c.send(ctx, http.MethodGet, u.EscapedPath(), u.Query(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,79 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pageFunc fetches the page after cursor ("" for the first) and returns its items
+// and the cursor of the next page, "" after the last.
+type pageFunc[T any] func(ctx context.Context, cursor string) ([]T, string, error)
+
+// paginate yields every item of every page, fetching pages as the loop reaches
+// them. An error ends the sequence after it is yielded.
+func paginate[T any](ctx context.Context, fetch pageFunc[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		cursor := ""
+		for {
+			items, next, err := fetch(ctx, cursor)
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			for _, item := range items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			if next == "" {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+// getPage GETs the page of path after cursor ("" for the first), decodes it into out
+// and returns the cursor of the next page, from the Link header with rel="next", or ""
+// after the last. query holds the other parameters, such as the limit.
+func (c *Client) getPage(ctx context.Context, path string, query url.Values, cursor string, out any) (string, error) {
+	if cursor != "" {
+		q := url.Values{"cursor": {cursor}}
+		for k, v := range query {
+			if k != "cursor" {
+				q[k] = v
+			}
+		}
+		query = q
+	}
+	resp, err := c.send(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return "", fmt.Errorf("client: decode GET %s response: %w", path, err)
+	}
+	for _, link := range strings.Split(resp.Header.Get("Link"), ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return "", fmt.Errorf("client: parse next page link: %w", err)
+		}
+		return u.Query().Get("cursor"), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,151 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Session is who the server takes the caller to be.
+type Session struct {
+	Subject string   `json:"subject"`
+	Email   string   `json:"email"`
+	Scopes  []string `json:"scopes"`
+	Method  string   `json:"method"` // "apikey", "jwt", "mtls", "session", ...
+}
+
+// Version is the build of the server and the fingerprint of its configuration.
+type Version struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified"`
+	Config    struct {
+		Fingerprint    string    `json:"fingerprint"`
+		Since          time.Time `json:"since"`
+		RestartPending bool      `json:"restart_pending"`
+	} `json:"config"`
+}
+
+// APIKey is an API key. Key is only set in the result of CreateAPIKey.
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+// UsageRow is the usage of one subject on one day.
+type UsageRow struct {
+	Subject  string `json:"subject"`
+	Day      string `json:"day"` // YYYY-MM-DD
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	DBTimeMS int64  `json:"db_time_ms"`
+}
+
+// UsageFilter selects the usage report. Zero times default to the last 30 days.
+type UsageFilter struct {
+	From, To time.Time
+	Subject  string
+}
+
+// Session returns who the caller is.
+func (c *Client) Session(ctx context.Context) (*Session, error) {
+	var s Session
+	if err := c.do(ctx, http.MethodGet, "/auth/session", nil, nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Version returns the build metadata of the replica that answered.
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	var v Version
+	if err := c.do(ctx, http.MethodGet, "/version", nil, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Healthz returns nil when the server is up and reaches its database.
+func (c *Client) Healthz(ctx context.Context) error {
+	resp, err := c.send(ctx, http.MethodGet, "/healthz", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// APIKeys returns all API keys, revoked ones included. It needs the admin scope.
+func (c *Client) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	return keys, c.do(ctx, http.MethodGet, "/admin/apikeys", nil, nil, &keys)
+}
+
+// CreateAPIKey creates an API key with scopes ("read", "write", "admin"). The
+// returned Key is not shown again. It needs the admin scope.
+func (c *Client) CreateAPIKey(ctx context.Context, name string, scopes ...string) (*APIKey, error) {
+	body := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{name, scopes}
+	var key APIKey
+	if err := c.do(ctx, http.MethodPost, "/admin/apikeys", nil, body, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey revokes an API key. It needs the admin scope.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/admin/apikeys/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// Usage returns usage per subject and day. It needs the admin scope.
+func (c *Client) Usage(ctx context.Context, f UsageFilter) ([]UsageRow, error) {
+	q := url.Values{}
+	if !f.From.IsZero() {
+		q.Set("from", f.From.Format(time.DateOnly))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", f.To.Format(time.DateOnly))
+	}
+	if f.Subject != "" {
+		q.Set("subject", f.Subject)
+	}
+	var rows []UsageRow
+	return rows, c.do(ctx, http.MethodGet, "/admin/usage", q, nil, &rows)
+}
+
+// AdminConfig is the running configuration of the replica that answered.
+type AdminConfig struct {
+	Profile     string            `json:"profile"`
+	File        string            `json:"file"`
+	Fingerprint string            `json:"fingerprint"`
+	Settings    map[string]any    `json:"settings"` // by section; secrets show as "[REDACTED]"
+	Sources     map[string]string `json:"sources"`  // where each non-default setting came from
+}
+
+// AdminConfig returns the running configuration. It needs the admin scope.
+func (c *Client) AdminConfig(ctx context.Context) (*AdminConfig, error) {
+	var cfg AdminConfig
+	if err := c.do(ctx, http.MethodGet, "/admin/config", nil, nil, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
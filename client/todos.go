@@ -0,0 +1,137 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package client
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Todo is one todo item.
+type Todo struct {
+	ID        int    `json:"id"`
+	Task      string `json:"task"`
+	Completed bool   `json:"completed"`
+	ListID    *int64 `json:"list_id,omitempty"` // nil for personal todos
+}
+
+// NewTodo is a todo to create. ListID puts it on a shared list the caller may edit.
+type NewTodo struct {
+	Task   string `json:"task"`
+	ListID *int64 `json:"list_id,omitempty"`
+}
+
+// TodoList is a shared list, with the caller's role on it.
+type TodoList struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Role      string    `json:"role"` // "owner", "editor" or "viewer"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListMember is one collaborator on a list.
+type ListMember struct {
+	UserID  string    `json:"user_id"`
+	Role    string    `json:"role"`
+	AddedBy string    `json:"added_by"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// todoPageSize is how many todos Todos fetches at a time.
+const todoPageSize = 500
+
+// Todos yields every todo the caller can see: their own and those on their lists.
+func (c *Client) Todos(ctx context.Context) iter.Seq2[Todo, error] {
+	query := url.Values{"limit": {strconv.Itoa(todoPageSize)}}
+	return paginate(ctx, func(ctx context.Context, cursor string) ([]Todo, string, error) {
+		var todos []Todo
+		next, err := c.getPage(ctx, "/todos", query, cursor, &todos)
+		return todos, next, err
+	})
+}
+
+// CreateTodo creates a todo and returns it with its ID.
+func (c *Client) CreateTodo(ctx context.Context, t NewTodo) (*Todo, error) {
+	var created Todo
+	if err := c.do(ctx, http.MethodPost, "/todos", nil, t, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Todo returns the todo with id.
+func (c *Client) Todo(ctx context.Context, id int) (*Todo, error) {
+	var t Todo
+	if err := c.do(ctx, http.MethodGet, "/todos/"+strconv.Itoa(id), nil, nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetCompleted marks a todo completed or not.
+func (c *Client) SetCompleted(ctx context.Context, id int, completed bool) error {
+	body := struct {
+		Completed bool `json:"completed"`
+	}{completed}
+	return c.do(ctx, http.MethodPut, "/todos/"+strconv.Itoa(id), nil, body, nil)
+}
+
+// DeleteTodo deletes a todo.
+func (c *Client) DeleteTodo(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/todos/"+strconv.Itoa(id), nil, nil, nil)
+}
+
+// Lists returns the caller's shared lists.
+func (c *Client) Lists(ctx context.Context) ([]TodoList, error) {
+	var lists []TodoList
+	return lists, c.do(ctx, http.MethodGet, "/lists", nil, nil, &lists)
+}
+
+// CreateList creates a shared list owned by the caller.
+func (c *Client) CreateList(ctx context.Context, name string) (*TodoList, error) {
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+	var list TodoList
+	if err := c.do(ctx, http.MethodPost, "/lists", nil, body, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// DeleteList deletes a list and its todos. Only its owner may.
+func (c *Client) DeleteList(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/lists/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// ListMembers returns the members of a list.
+func (c *Client) ListMembers(ctx context.Context, listID int64) ([]ListMember, error) {
+	var members []ListMember
+	return members, c.do(ctx, http.MethodGet, "/lists/"+strconv.FormatInt(listID, 10)+"/members", nil, nil, &members)
+}
+
+// AddListMember invites a user to a list as "editor" or "viewer", or changes their
+// role. Only the owner may.
+func (c *Client) AddListMember(ctx context.Context, listID int64, userID, role string) (*ListMember, error) {
+	body := struct {
+		UserID string `json:"user_id"`
+		Role   string `json:"role,omitempty"`
+	}{userID, role}
+	var member ListMember
+	if err := c.do(ctx, http.MethodPost, "/lists/"+strconv.FormatInt(listID, 10)+"/members", nil, body, &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// RemoveListMember removes a member from a list (owner), or the caller themselves.
+func (c *Client) RemoveListMember(ctx context.Context, listID int64, userID string) error {
+	return c.do(ctx, http.MethodDelete, "/lists/"+strconv.FormatInt(listID, 10)+"/members/"+url.PathEscape(userID), nil, nil, nil)
+}
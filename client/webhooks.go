@@ -0,0 +1,132 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package client
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Webhook is a subscription to todo events.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	Secret    string    `json:"secret,omitempty"` // only when created, or when a new one was set
+}
+
+// WebhookSpec is a webhook to register or replace. Empty Events subscribes to all
+// events; a nil Active means active. An empty Secret has one generated on create
+// and keeps the current one on update.
+type WebhookSpec struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+	Secret string   `json:"secret"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	EventSeq       int64      `json:"event_seq"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"` // "pending", "delivered" or "dead"
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int       `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// DeliveryFilter narrows Deliveries down.
+type DeliveryFilter struct {
+	Status   string // "pending", "delivered" or "dead"; empty for all
+	PageSize int    // deliveries per request, 50 by default, at most 200
+}
+
+// Webhooks returns the caller's webhooks.
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	var hooks []Webhook
+	return hooks, c.do(ctx, http.MethodGet, "/webhooks", nil, nil, &hooks)
+}
+
+// Webhook returns one webhook.
+func (c *Client) Webhook(ctx context.Context, id int64) (*Webhook, error) {
+	var h Webhook
+	if err := c.do(ctx, http.MethodGet, webhookPath(id), nil, nil, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// CreateWebhook registers a webhook. The returned Secret signs its deliveries and
+// is not shown again.
+func (c *Client) CreateWebhook(ctx context.Context, spec WebhookSpec) (*Webhook, error) {
+	var h Webhook
+	if err := c.do(ctx, http.MethodPost, "/webhooks", nil, spec, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// UpdateWebhook replaces a webhook.
+func (c *Client) UpdateWebhook(ctx context.Context, id int64, spec WebhookSpec) (*Webhook, error) {
+	var h Webhook
+	if err := c.do(ctx, http.MethodPut, webhookPath(id), nil, spec, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// DeleteWebhook deletes a webhook and its delivery log.
+func (c *Client) DeleteWebhook(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, webhookPath(id), nil, nil, nil)
+}
+
+// Deliveries yields the delivery log of a webhook, newest first, fetching it a page
+// at a time.
+func (c *Client) Deliveries(ctx context.Context, webhookID int64, f DeliveryFilter) iter.Seq2[WebhookDelivery, error] {
+	limit := f.PageSize
+	if limit <= 0 {
+		limit = 50
+	}
+	return paginate(ctx, func(ctx context.Context, before string) ([]WebhookDelivery, string, error) {
+		q := url.Values{"limit": {strconv.Itoa(limit)}}
+		if f.Status != "" {
+			q.Set("status", f.Status)
+		}
+		if before != "" {
+			q.Set("before", before)
+		}
+		var page []WebhookDelivery
+		if err := c.do(ctx, http.MethodGet, webhookPath(webhookID)+"/deliveries", q, nil, &page); err != nil {
+			return nil, "", err
+		}
+		if len(page) < limit {
+			return page, "", nil
+		}
+		return page, strconv.FormatInt(page[len(page)-1].ID, 10), nil
+	})
+}
+
+// RetryDelivery queues a finished delivery again, with a fresh round of attempts,
+// and returns it while pending.
+func (c *Client) RetryDelivery(ctx context.Context, webhookID, deliveryID int64) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	path := webhookPath(webhookID) + "/deliveries/" + strconv.FormatInt(deliveryID, 10) + "/retry"
+	if err := c.do(ctx, http.MethodPost, path, nil, nil, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func webhookPath(id int64) string { return "/webhooks/" + strconv.FormatInt(id, 10) }
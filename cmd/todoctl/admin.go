@@ -0,0 +1,244 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+func healthCmd(g *globals) *cobra.Command {
+	return &cobra.Command{
+		Use:   "health",
+		Short: "Check that the server is up and reaches its database, and show its version",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			if err := c.Healthz(ctx); err != nil {
+				return err
+			}
+			v, err := c.Version(ctx)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), v, func(w io.Writer) {
+				fmt.Fprintf(w, "OK\t%s (%s, built %s)\n", v.Version, v.GitCommit, v.BuildTime)
+				fmt.Fprintf(w, "config\t%s\n", v.Config.Fingerprint)
+				if v.Config.RestartPending {
+					fmt.Fprintln(w, "\tchanges pending a restart")
+				}
+			})
+		},
+	}
+}
+
+func adminCmd(g *globals) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Administer the server; needs a key with the admin scope",
+	}
+	cmd.AddCommand(apiKeysCmd(g), usageCmd(g), configCmd(g), featuresCmd(g))
+	return cmd
+}
+
+func apiKeysCmd(g *globals) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "apikeys",
+		Aliases: []string{"apikey"},
+		Short:   "List, create and revoke API keys",
+	}
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List API keys, revoked ones included",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			keys, err := c.APIKeys(ctx)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), keys, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tCREATED\tREVOKED")
+				for _, k := range keys {
+					revoked := "-"
+					if k.RevokedAt != nil {
+						revoked = k.RevokedAt.Format(time.DateTime)
+					}
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","), k.CreatedAt.Format(time.DateTime), revoked)
+				}
+			})
+		},
+	}
+	var scopes []string
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an API key and print it; it is not shown again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			key, err := c.CreateAPIKey(ctx, args[0], scopes...)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), key, func(w io.Writer) {
+				fmt.Fprintln(w, key.Key)
+			})
+		},
+	}
+	create.Flags().StringSliceVar(&scopes, "scope", []string{"read", "write"}, "scopes of the key: read, write, admin")
+	revoke := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an API key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid API key id %q", args[0])
+			}
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			return c.RevokeAPIKey(ctx, id)
+		},
+	}
+	cmd.AddCommand(list, create, revoke)
+	return cmd
+}
+
+func usageCmd(g *globals) *cobra.Command {
+	var from, to, subject string
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Show usage per subject and day, the last 30 days by default",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var f client.UsageFilter
+			var err error
+			if from != "" {
+				if f.From, err = time.Parse(time.DateOnly, from); err != nil {
+					return fmt.Errorf("--from: %w", err)
+				}
+			}
+			if to != "" {
+				if f.To, err = time.Parse(time.DateOnly, to); err != nil {
+					return fmt.Errorf("--to: %w", err)
+				}
+			}
+			f.Subject = subject
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			rows, err := c.Usage(ctx, f)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), rows, func(w io.Writer) {
+				fmt.Fprintln(w, "DAY\tSUBJECT\tREQUESTS\tBYTES IN\tBYTES OUT\tDB MS")
+				for _, r := range rows {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", r.Day, r.Subject, r.Requests, r.BytesIn, r.BytesOut, r.DBTimeMS)
+				}
+			})
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "first day, YYYY-MM-DD")
+	cmd.Flags().StringVar(&to, "to", "", "last day, YYYY-MM-DD")
+	cmd.Flags().StringVar(&subject, "subject", "", "only this subject, e.g. apikey:3")
+	return cmd
+}
+
+func configCmd(g *globals) *cobra.Command {
+	return &cobra.Command{
+		Use:   "config",
+		Short: "Show the settings that differ from the defaults, and where each came from",
+		Long: `Show the running configuration of the replica that answered. The table lists
+the settings that differ from the defaults; --output=json prints all of them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			cfg, err := c.AdminConfig(ctx)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), cfg, func(w io.Writer) {
+				fmt.Fprintf(w, "profile\t%s\nfile\t%s\nfingerprint\t%s\n\n", cfg.Profile, cfg.File, cfg.Fingerprint)
+				fmt.Fprintln(w, "SETTING\tSOURCE")
+				for _, name := range slices.Sorted(maps.Keys(cfg.Sources)) {
+					fmt.Fprintf(w, "%s\t%s\n", name, cfg.Sources[name])
+				}
+			})
+		},
+	}
+}
+
+func featuresCmd(g *globals) *cobra.Command {
+	return &cobra.Command{
+		Use:   "features",
+		Short: "Show the feature switches of the replica that answered",
+		Long: `Show the feature switches (the features setting) of the replica that answered.
+
+Switches are configuration, so each replica reads them from its own config file
+and reloads it on change. To flip one, edit the file (the ConfigMap on GKE), e.g.
+
+  features:
+    beta: true
+
+and check with this command, or GET /version, that every replica picked it up.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			cfg, err := c.AdminConfig(ctx)
+			if err != nil {
+				return err
+			}
+			features := map[string]bool{}
+			if m, ok := cfg.Settings["features"].(map[string]any); ok {
+				for name, v := range m {
+					features[name], _ = v.(bool)
+				}
+			}
+			return g.print(cmd.OutOrStdout(), features, func(w io.Writer) {
+				fmt.Fprintln(w, "FEATURE\tON")
+				for _, name := range slices.Sorted(maps.Keys(features)) {
+					fmt.Fprintf(w, "%s\t%t\n", name, features[name])
+				}
+				if source := cfg.Sources["features"]; source != "" {
+					fmt.Fprintf(w, "\n(set by %s)\n", source)
+				}
+			})
+		},
+	}
+}
@@ -0,0 +1,296 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+// loadOps are the operations loadgen sends, in report order.
+var loadOps = []string{"list", "create", "complete", "delete"}
+
+func loadgenCmd(g *globals) *cobra.Command {
+	var rps, concurrency int
+	var duration time.Duration
+	var mixFlag string
+	var keep bool
+	cmd := &cobra.Command{
+		Use:   "loadgen",
+		Short: "Send a mix of reads and writes at a fixed rate and report latency percentiles",
+		Long: `Send requests at --rps for --duration, each one an operation drawn from --mix,
+and report the latency percentiles of each operation. Requests are started on
+schedule whether or not earlier ones have answered, up to --concurrency in flight;
+a request that would exceed it is counted as dropped rather than sent late.
+
+complete and delete act on todos created by this run (a create is sent while there
+are none), which are deleted at the end unless --keep is given. --timeout bounds
+each request. Failed requests are not retried, so that errors show.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rps <= 0 || concurrency <= 0 || duration <= 0 {
+				return fmt.Errorf("--rps, --concurrency and --duration must be positive")
+			}
+			mix, err := parseMix(mixFlag)
+			if err != nil {
+				return fmt.Errorf("--mix: %w", err)
+			}
+			hc := &http.Client{Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: concurrency,
+			}}
+			c, _, cancel, err := g.client(cmd, client.WithRetries(0, 0), client.WithHTTPClient(hc))
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			l := &loadRun{c: c, timeout: g.timeout, latencies: map[string][]time.Duration{}, errors: map[string]int{}, lastErr: map[string]string{}}
+			start := time.Now()
+			l.run(cmd.Context(), rps, concurrency, duration, mix)
+			report := l.report(rps, time.Since(start))
+			if !keep {
+				if n := l.cleanup(); n > 0 {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Could not delete %d of the todos created\n", n)
+				}
+			}
+			return g.print(cmd.OutOrStdout(), report, func(w io.Writer) {
+				fmt.Fprintf(w, "Sent %d requests in %s (%.1f/s, target %d/s, %d dropped)\n\n",
+					report.Requests, time.Duration(report.Seconds*float64(time.Second)).Round(time.Millisecond), report.RPS, rps, report.Dropped)
+				fmt.Fprintln(w, "OP\tREQUESTS\tERRORS\tP50\tP90\tP99\tMAX")
+				for _, s := range report.Ops {
+					fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", s.Op, s.Requests, s.Errors, ms(s.P50), ms(s.P90), ms(s.P99), ms(s.Max))
+				}
+				for _, s := range report.Ops {
+					if s.LastError != "" {
+						fmt.Fprintf(w, "\nlast %s error: %s", s.Op, s.LastError)
+					}
+				}
+			})
+		},
+	}
+	cmd.Flags().IntVar(&rps, "rps", 50, "requests started per second")
+	cmd.Flags().DurationVar(&duration, "duration", 30*time.Second, "how long to send requests")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 100, "most requests in flight at once")
+	cmd.Flags().StringVar(&mixFlag, "mix", "list=70,create=15,complete=10,delete=5", "relative weights of the operations: "+strings.Join(loadOps, ", "))
+	cmd.Flags().BoolVar(&keep, "keep", false, "keep the todos created instead of deleting them at the end")
+	return cmd
+}
+
+// ms formats a latency in milliseconds for the table.
+func ms(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64) + "ms"
+}
+
+// parseMix parses operation weights like "list=70,create=30" into cumulative
+// weights in the order of loadOps.
+func parseMix(s string) ([]int, error) {
+	weights := make([]int, len(loadOps))
+	for _, part := range strings.Split(s, ",") {
+		op, w, ok := strings.Cut(strings.TrimSpace(part), "=")
+		i := slices.Index(loadOps, op)
+		n, err := strconv.Atoi(w)
+		if !ok || i < 0 || err != nil || n < 0 {
+			return nil, fmt.Errorf("want op=weight with op one of %s, got %q", strings.Join(loadOps, ", "), part)
+		}
+		weights[i] = n
+	}
+	for i := 1; i < len(weights); i++ {
+		weights[i] += weights[i-1]
+	}
+	if weights[len(weights)-1] == 0 {
+		return nil, fmt.Errorf("no operation has a weight")
+	}
+	return weights, nil
+}
+
+// loadRun sends the requests of one loadgen run and records their latencies.
+type loadRun struct {
+	c       *client.Client
+	timeout time.Duration
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration // by op, of the requests that succeeded
+	errors    map[string]int
+	lastErr   map[string]string
+	dropped   int
+	ids       []int // todos created and not deleted yet
+}
+
+// run starts a request every 1/rps until duration has passed or ctx is done, and
+// waits for those in flight.
+func (l *loadRun) run(ctx context.Context, rps, concurrency int, duration time.Duration, mix []int) {
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+	end := time.NewTimer(duration)
+	defer end.Stop()
+	inFlight := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for {
+		select {
+		case <-ctx.Done():
+		case <-end.C:
+		case <-ticker.C:
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				l.mu.Lock()
+				l.dropped++
+				l.mu.Unlock()
+				continue
+			}
+			r := rand.IntN(mix[len(mix)-1])
+			op := loadOps[slices.IndexFunc(mix, func(w int) bool { return r < w })]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Requests in flight when the run is interrupted still count.
+				l.send(context.WithoutCancel(ctx), op)
+				<-inFlight
+			}()
+			continue
+		}
+		break
+	}
+	wg.Wait()
+}
+
+// send runs one op and records its latency or error.
+func (l *loadRun) send(ctx context.Context, op string) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	id := 0
+	if op == "complete" || op == "delete" {
+		l.mu.Lock()
+		switch {
+		case len(l.ids) == 0:
+			op = "create"
+		case op == "delete":
+			id, l.ids = l.ids[len(l.ids)-1], l.ids[:len(l.ids)-1]
+		default:
+			id = l.ids[rand.IntN(len(l.ids))]
+		}
+		l.mu.Unlock()
+	}
+
+	start := time.Now()
+	var err error
+	switch op {
+	case "list":
+		for _, err = range l.c.Todos(ctx) {
+			if err != nil {
+				break
+			}
+		}
+	case "create":
+		var t *client.Todo
+		if t, err = l.c.CreateTodo(ctx, client.NewTodo{Task: "loadgen " + strconv.FormatInt(start.UnixNano(), 36)}); err == nil {
+			id = t.ID
+		}
+	case "complete":
+		err = l.c.SetCompleted(ctx, id, rand.IntN(2) == 0)
+	case "delete":
+		err = l.c.DeleteTodo(ctx, id)
+	}
+	elapsed := time.Since(start)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case err != nil:
+		l.errors[op]++
+		l.lastErr[op] = err.Error()
+		if op == "delete" {
+			l.ids = append(l.ids, id) // for the cleanup to try again
+		}
+	case op == "create":
+		l.ids = append(l.ids, id)
+		fallthrough
+	default:
+		l.latencies[op] = append(l.latencies[op], elapsed)
+	}
+}
+
+// cleanup deletes the todos created by the run and returns how many it could not.
+func (l *loadRun) cleanup() int {
+	failed := 0
+	for _, id := range l.ids {
+		ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+		if err := l.c.DeleteTodo(ctx, id); err != nil && !client.IsNotFound(err) {
+			failed++
+		}
+		cancel()
+	}
+	return failed
+}
+
+// loadReport is the result of a loadgen run. Latencies are in milliseconds, over
+// the requests that succeeded.
+type loadReport struct {
+	Seconds  float64     `json:"seconds"`
+	Requests int         `json:"requests"`
+	RPS      float64     `json:"rps"`
+	Dropped  int         `json:"dropped"`
+	Ops      []loadStats `json:"ops"` // per op sent, then "total"
+}
+
+type loadStats struct {
+	Op        string  `json:"op"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+	Max       float64 `json:"max_ms"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+func (l *loadRun) report(rps int, elapsed time.Duration) loadReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := loadReport{Seconds: elapsed.Seconds(), Dropped: l.dropped}
+	var all []time.Duration
+	totalErrors := 0
+	for _, op := range loadOps {
+		if len(l.latencies[op]) == 0 && l.errors[op] == 0 {
+			continue
+		}
+		r.Ops = append(r.Ops, stats(op, l.latencies[op], l.errors[op]))
+		r.Ops[len(r.Ops)-1].LastError = l.lastErr[op]
+		all = append(all, l.latencies[op]...)
+		totalErrors += l.errors[op]
+	}
+	r.Ops = append(r.Ops, stats("total", all, totalErrors))
+	r.Requests = r.Ops[len(r.Ops)-1].Requests
+	r.RPS = float64(r.Requests) / r.Seconds
+	return r
+}
+
+// stats returns the percentiles of latencies, by nearest rank.
+func stats(op string, latencies []time.Duration, errors int) loadStats {
+	s := loadStats{Op: op, Requests: len(latencies) + errors, Errors: errors}
+	if len(latencies) == 0 {
+		return s
+	}
+	slices.Sort(latencies)
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		return float64(latencies[max(i, 0)]) / float64(time.Millisecond)
+	}
+	s.P50, s.P90, s.P99, s.Max = at(0.50), at(0.90), at(0.99), at(1)
+	return s
+}
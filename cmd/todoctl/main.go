@@ -0,0 +1,135 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Command todoctl talks to a todo app deployment from the command line, for ops
+// scripts and demos. See docs/TODOCTL.md.
+//
+//	export TODOCTL_SERVER=https://todo.example.com TODO_API_KEY=...
+//	todoctl add "Ship it"
+//	todoctl list --pending
+//	todoctl admin apikeys create ci --scope read
+//	todoctl loadgen --rps 200 --duration 1m
+//	todoctl smoketest --base-url https://todo.example.com
+//	todoctl --offline todos.json add "Try it without a server"
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := newRootCmd(os.Getenv).ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "todoctl:", err)
+		if client.IsUnauthorized(err) {
+			os.Exit(3)
+		}
+		os.Exit(1)
+	}
+}
+
+// globals are the flags every command shares.
+type globals struct {
+	server  string
+	offline string
+	apiKey  string
+	token   string
+	output  string
+	timeout time.Duration
+}
+
+// newRootCmd builds the command tree. getenv supplies the defaults of the global
+// flags.
+func newRootCmd(getenv func(string) string) *cobra.Command {
+	g := &globals{}
+	root := &cobra.Command{
+		Use:           "todoctl",
+		Short:         "Manage todos and the todo app from the command line",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if g.output != "table" && g.output != "json" {
+				return fmt.Errorf("--output must be table or json, got %q", g.output)
+			}
+			return nil
+		},
+	}
+	server := getenv("TODOCTL_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	pf := root.PersistentFlags()
+	pf.StringVar(&g.server, "server", server, "base URL of the todo app (TODOCTL_SERVER)")
+	pf.StringVar(&g.offline, "offline", getenv("TODOCTL_OFFLINE"), "work on the todos in this JSON file instead of a server (TODOCTL_OFFLINE)")
+	pf.StringVar(&g.apiKey, "api-key", getenv("TODO_API_KEY"), "API key (TODO_API_KEY)")
+	pf.StringVar(&g.token, "token", getenv("TODOCTL_TOKEN"), "OIDC ID token, instead of an API key (TODOCTL_TOKEN)")
+	pf.StringVarP(&g.output, "output", "o", "table", "output format: table or json")
+	pf.DurationVar(&g.timeout, "timeout", 30*time.Second, "timeout of each command")
+
+	root.AddCommand(
+		listCmd(g), addCmd(g), completeCmd(g), deleteCmd(g),
+		importCmd(g), exportCmd(g),
+		healthCmd(g), smoketestCmd(g), adminCmd(g), loadgenCmd(g),
+	)
+	return root
+}
+
+// client returns an API client for the global flags and extra options, and a
+// context bounded by --timeout.
+func (g *globals) client(cmd *cobra.Command, extra ...client.Option) (*client.Client, context.Context, context.CancelFunc, error) {
+	if g.offline != "" {
+		return nil, nil, nil, fmt.Errorf("%s needs a server and does not work with --offline", cmd.CommandPath())
+	}
+	opts := []client.Option{client.WithUserAgent("todoctl")}
+	switch {
+	case g.apiKey != "":
+		opts = append(opts, client.WithAPIKey(g.apiKey))
+	case g.token != "":
+		opts = append(opts, client.WithBearerToken(g.token))
+	}
+	c, err := client.New(g.server, append(opts, extra...)...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), g.timeout)
+	return c, ctx, cancel, nil
+}
+
+// todos returns what the todo commands work on: the file of --offline, or else an
+// API client as for client.
+func (g *globals) todos(cmd *cobra.Command) (todoStore, context.Context, context.CancelFunc, error) {
+	if g.offline == "" {
+		return g.client(cmd)
+	}
+	s, err := openOffline(g.offline)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), g.timeout)
+	return s, ctx, cancel, nil
+}
+
+// print writes v as indented JSON with --output=json, or else calls table with a
+// tabwriter.
+func (g *globals) print(w io.Writer, v any, table func(w io.Writer)) error {
+	if g.output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
@@ -0,0 +1,266 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+// fakeServer is just enough of the todo API for the commands.
+type fakeServer struct {
+	mu     sync.Mutex
+	todos  []client.Todo
+	keys   map[string]client.Todo // Idempotency-Key -> created todo
+	nextID int
+	fail   string // a method answered with a 500
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("X-API-Key") != "k" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == s.fail {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case r.URL.Path == "/healthz":
+		w.Write([]byte("OK"))
+	case r.Method == http.MethodGet && r.URL.Path == "/todos":
+		json.NewEncoder(w).Encode(s.todos)
+	case r.Method == http.MethodPost && r.URL.Path == "/todos":
+		if t, ok := s.keys[r.Header.Get("Idempotency-Key")]; ok {
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(t)
+			return
+		}
+		var in client.NewTodo
+		json.NewDecoder(r.Body).Decode(&in)
+		s.nextID++
+		t := client.Todo{ID: s.nextID, Task: in.Task}
+		s.todos = append(s.todos, t)
+		s.keys[r.Header.Get("Idempotency-Key")] = t
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/todos/"):
+		for _, t := range s.todos {
+			if "/todos/"+strconv.Itoa(t.ID) == r.URL.Path {
+				json.NewEncoder(w).Encode(t)
+				return
+			}
+		}
+		http.Error(w, "Todo not found", http.StatusNotFound)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/todos/"):
+		var in struct{ Completed bool }
+		json.NewDecoder(r.Body).Decode(&in)
+		for i := range s.todos {
+			if "/todos/"+strconv.Itoa(s.todos[i].ID) == r.URL.Path {
+				s.todos[i].Completed = in.Completed
+				return
+			}
+		}
+		http.Error(w, "Todo not found", http.StatusNotFound)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/todos/"):
+		for i := range s.todos {
+			if "/todos/"+strconv.Itoa(s.todos[i].ID) == r.URL.Path {
+				s.todos = append(s.todos[:i], s.todos[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "Todo not found", http.StatusNotFound)
+	case r.URL.Path == "/admin/config":
+		json.NewEncoder(w).Encode(map[string]any{
+			"fingerprint": "abc",
+			"settings":    map[string]any{"features": map[string]bool{"beta": true}},
+			"sources":     map[string]string{"features": "env TODO_FEATURES"},
+		})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func run(t *testing.T, srv *httptest.Server, args ...string) (string, error) {
+	t.Helper()
+	env := map[string]string{"TODOCTL_SERVER": srv.URL, "TODO_API_KEY": "k"}
+	cmd := newRootCmd(func(k string) string { return env[k] })
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestTodoctl(t *testing.T) {
+	fake := &fakeServer{keys: map[string]client.Todo{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	if out, err := run(t, srv, "add", "Ship", "it"); err != nil || !strings.Contains(out, "Added todo 1") {
+		t.Fatalf("add: %q, %v", out, err)
+	}
+	if _, err := run(t, srv, "complete", "1"); err != nil || !fake.todos[0].Completed {
+		t.Fatalf("complete: %v, %+v", err, fake.todos)
+	}
+
+	// Importing the same file twice creates its todos once.
+	file := filepath.Join(t.TempDir(), "todos.csv")
+	os.WriteFile(file, []byte("id,task,completed,list_id\n7,Buy milk,false,\n8,\"Call, Bob\",true,\n"), 0o600)
+	for range 2 {
+		if _, err := run(t, srv, "import", file); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+	}
+	if len(fake.todos) != 3 || fake.todos[2].Task != "Call, Bob" || !fake.todos[2].Completed {
+		t.Errorf("expected two todos imported once, got %+v", fake.todos)
+	}
+
+	out, err := run(t, srv, "list", "--pending", "-o", "json")
+	var pending []client.Todo
+	if err != nil || json.Unmarshal([]byte(out), &pending) != nil || len(pending) != 1 || pending[0].Task != "Buy milk" {
+		t.Errorf("list --pending: %q, %v", out, err)
+	}
+
+	if out, err := run(t, srv, "admin", "features"); err != nil || !strings.Contains(out, "beta") || !strings.Contains(out, "env TODO_FEATURES") {
+		t.Errorf("admin features: %q, %v", out, err)
+	}
+
+	_, err = run(t, srv, "--api-key", "wrong", "list")
+	if !client.IsUnauthorized(err) {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+	if _, err := run(t, srv, "list", "-o", "yaml"); err == nil {
+		t.Error("expected an unknown output format to be rejected")
+	}
+}
+
+// TestTodoctlOffline tests that the todo commands work on a file with --offline, and
+// that the commands that need a server refuse to run
+func TestTodoctlOffline(t *testing.T) {
+	// No server: a request would fail to connect.
+	unreachable := &httptest.Server{URL: "http://127.0.0.1:1"}
+	file := filepath.Join(t.TempDir(), "todos.json")
+
+	for _, task := range []string{"Ship it", "Buy milk", "Water plants"} {
+		if _, err := run(t, unreachable, "--offline", file, "add", task); err != nil {
+			t.Fatalf("add %q: %v", task, err)
+		}
+	}
+	if _, err := run(t, unreachable, "--offline", file, "complete", "1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if _, err := run(t, unreachable, "--offline", file, "delete", "3"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// Each command starts from what the one before wrote.
+	out, err := run(t, unreachable, "--offline", file, "list", "-o", "json")
+	var todos []client.Todo
+	if err != nil || json.Unmarshal([]byte(out), &todos) != nil {
+		t.Fatalf("list: %q, %v", out, err)
+	}
+	if len(todos) != 2 || todos[0].Task != "Ship it" || !todos[0].Completed || todos[1].Task != "Buy milk" || todos[1].Completed {
+		t.Errorf("expected todo 1 completed and 2 open, got %+v", todos)
+	}
+
+	// An export imports into the file as new todos.
+	export := filepath.Join(t.TempDir(), "export.json")
+	os.WriteFile(export, []byte(`[{"id": 9, "task": "Call Bob", "completed": true}]`), 0o600)
+	if _, err := run(t, unreachable, "--offline", file, "import", export); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	out, err = run(t, unreachable, "--offline", file, "list", "--pending")
+	if err != nil || !strings.Contains(out, "Buy milk") || strings.Contains(out, "Call Bob") {
+		t.Errorf("list --pending: %q, %v", out, err)
+	}
+	out, err = run(t, unreachable, "--offline", file, "list", "--completed")
+	if err != nil || !strings.Contains(out, "Ship it") || !strings.Contains(out, "Call Bob") {
+		t.Errorf("list --completed: %q, %v", out, err)
+	}
+
+	if _, err := run(t, unreachable, "--offline", file, "export"); err == nil || !strings.Contains(err.Error(), "does not work with --offline") {
+		t.Errorf("expected export to need a server, got %v", err)
+	}
+	os.WriteFile(file, []byte("not json"), 0o600)
+	if _, err := run(t, unreachable, "--offline", file, "list"); err == nil {
+		t.Error("expected a file that is not JSON to be rejected")
+	}
+}
+
+func TestLoadgen(t *testing.T) {
+	fake := &fakeServer{keys: map[string]client.Todo{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	out, err := run(t, srv, "loadgen", "--rps", "200", "--duration", "300ms", "--mix", "list=2,create=2,complete=1,delete=1", "-o", "json")
+	var report loadReport
+	if err != nil || json.Unmarshal([]byte(out), &report) != nil {
+		t.Fatalf("loadgen: %q, %v", out, err)
+	}
+	total := report.Ops[len(report.Ops)-1]
+	if total.Op != "total" || total.Requests < 20 || total.Errors != 0 || total.P50 <= 0 || total.P99 < total.P50 || total.Max < total.P99 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.todos) != 0 {
+		t.Errorf("expected the todos created to be deleted, got %+v", fake.todos)
+	}
+
+	if _, err := run(t, srv, "loadgen", "--mix", "list=1,update=1"); err == nil {
+		t.Error("expected an unknown operation to be rejected")
+	}
+}
+
+func TestSmoketest(t *testing.T) {
+	fake := &fakeServer{keys: map[string]client.Todo{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	out, err := run(t, srv, "smoketest", "--base-url", srv.URL, "-o", "json")
+	var steps []smokeStep
+	if err != nil || json.Unmarshal([]byte(out), &steps) != nil || len(steps) != 7 {
+		t.Fatalf("smoketest: %q, %v", out, err)
+	}
+	for _, s := range steps {
+		if !s.OK {
+			t.Errorf("expected step %s to pass, got %+v", s.Step, s)
+		}
+	}
+
+	// A failed step fails the command, and the todo it created is deleted.
+	fake.fail = http.MethodPut
+	out, err = run(t, srv, "smoketest")
+	if err == nil || !strings.Contains(err.Error(), "at update") {
+		t.Errorf("expected the smoke test to fail at update, got %v", err)
+	}
+	if !strings.Contains(out, "update   FAILED") || !strings.Contains(out, "cleanup  ok") {
+		t.Errorf("unexpected report:\n%s", out)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.todos) != 0 {
+		t.Errorf("expected the todos created to be deleted, got %+v", fake.todos)
+	}
+
+	if _, err := run(t, &httptest.Server{URL: "http://127.0.0.1:1"}, "smoketest", "--timeout", "200ms"); err == nil || !strings.Contains(err.Error(), "at health") {
+		t.Errorf("expected the smoke test to fail at health, got %v", err)
+	}
+}
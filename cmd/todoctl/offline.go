@@ -0,0 +1,132 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+
+	"github.com/stevemcghee/go-to-production/client"
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// todoStore is what the todo commands need: the server's API, or with --offline the
+// todos of a file.
+type todoStore interface {
+	Todos(ctx context.Context) iter.Seq2[client.Todo, error]
+	CreateTodo(ctx context.Context, t client.NewTodo) (*client.Todo, error)
+	SetCompleted(ctx context.Context, id int, completed bool) error
+	DeleteTodo(ctx context.Context, id int) error
+}
+
+// offlineOwner owns the todos of an offline file.
+const offlineOwner = "offline"
+
+// offlineStore keeps the todos in a JSON file, through the in-memory repository, so
+// the todo commands work without a server: for demos, and for trying todoctl out.
+// The file is a JSON array of todos, as "todoctl export" writes and "todoctl import"
+// reads; it is created on the first change and written back after each.
+type offlineStore struct {
+	path string
+	repo *repository.Memory
+}
+
+// openOffline loads the todos of the file at path, which need not exist yet.
+func openOffline(path string) (*offlineStore, error) {
+	s := &offlineStore{path: path, repo: repository.NewMemory()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var todos []repository.Todo
+	if data = bytes.TrimSpace(data); len(data) > 0 {
+		if err := json.Unmarshal(data, &todos); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, t := range todos {
+		s.repo.Add(offlineOwner, t)
+	}
+	return s, nil
+}
+
+// save writes the todos back, replacing the file at once so that an interrupted
+// command leaves the old one.
+func (s *offlineStore) save(ctx context.Context) error {
+	todos, err := s.repo.List(ctx, offlineOwner, repository.Filter{IncludeArchived: true})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(todos, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".todoctl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *offlineStore) Todos(ctx context.Context) iter.Seq2[client.Todo, error] {
+	return func(yield func(client.Todo, error) bool) {
+		todos, err := s.repo.List(ctx, offlineOwner, repository.Filter{})
+		if err != nil {
+			yield(client.Todo{}, err)
+			return
+		}
+		for _, t := range todos {
+			if !yield(clientTodo(t), nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *offlineStore) CreateTodo(ctx context.Context, nt client.NewTodo) (*client.Todo, error) {
+	t, err := s.repo.Create(ctx, offlineOwner, nt.Task, nt.ListID)
+	if err != nil {
+		return nil, err
+	}
+	created := clientTodo(t)
+	return &created, s.save(ctx)
+}
+
+func (s *offlineStore) SetCompleted(ctx context.Context, id int, completed bool) error {
+	// Like the server, a todo that does not exist is not an error.
+	if _, err := s.repo.SetCompleted(ctx, offlineOwner, id, completed); err != nil {
+		return err
+	}
+	return s.save(ctx)
+}
+
+func (s *offlineStore) DeleteTodo(ctx context.Context, id int) error {
+	if _, err := s.repo.Delete(ctx, offlineOwner, id); err != nil {
+		return err
+	}
+	return s.save(ctx)
+}
+
+func clientTodo(t repository.Todo) client.Todo {
+	return client.Todo{ID: t.ID, Task: t.Task, Completed: t.Completed, ListID: t.ListID}
+}
@@ -0,0 +1,144 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+// smokeStep is the outcome of one step of the smoke test.
+type smokeStep struct {
+	Step     string `json:"step"`
+	OK       bool   `json:"ok"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// smokeCleanupTimeout bounds the deletion of the todo left by a failed smoke test,
+// which runs even when --timeout has run out.
+const smokeCleanupTimeout = 10 * time.Second
+
+func smoketestCmd(g *globals) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "smoketest",
+		Short: "Create, read, update and delete a todo, to verify a deployment",
+		Long: `Check /healthz, then create a todo, read it back, mark it completed, read it
+again, delete it and check that it is gone, stopping at the first step that fails.
+If the todo was created and not deleted, it is deleted before exiting. The command
+exits non-zero if any step failed, so that it can gate a deploy:
+
+  todoctl smoketest --base-url https://todo.example.com
+
+--base-url is the same as --server. Use a key with the read and write scopes.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			steps, failed := smokeTest(ctx, c)
+			err = g.print(cmd.OutOrStdout(), steps, func(w io.Writer) {
+				fmt.Fprintln(w, "STEP\tRESULT\tDURATION\tERROR")
+				for _, s := range steps {
+					result := "ok"
+					if !s.OK {
+						result = "FAILED"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Step, result, s.Duration, s.Error)
+				}
+			})
+			return errors.Join(failed, err)
+		},
+	}
+	cmd.Flags().StringVar(&g.server, "base-url", g.server, "base URL of the deployment to test; the same as --server")
+	return cmd
+}
+
+// smokeTest runs the steps of the smoke test against c and returns them, with an
+// error naming the step that failed, if one did.
+func smokeTest(ctx context.Context, c *client.Client) ([]smokeStep, error) {
+	var steps []smokeStep
+	var failed error
+	step := func(name string, fn func(ctx context.Context) error) bool {
+		if failed != nil {
+			return false
+		}
+		start := time.Now()
+		err := fn(ctx)
+		s := smokeStep{Step: name, OK: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			s.Error = err.Error()
+			failed = fmt.Errorf("smoke test failed at %s: %w", name, err)
+		}
+		steps = append(steps, s)
+		return err == nil
+	}
+
+	task := "todoctl smoketest " + time.Now().UTC().Format(time.RFC3339)
+	var created *client.Todo
+	deleted := false
+	step("health", func(ctx context.Context) error { return c.Healthz(ctx) })
+	step("create", func(ctx context.Context) (err error) {
+		created, err = c.CreateTodo(ctx, client.NewTodo{Task: task})
+		return err
+	})
+	step("read", func(ctx context.Context) error {
+		t, err := c.Todo(ctx, created.ID)
+		switch {
+		case err != nil:
+			return err
+		case t.Task != task || t.Completed:
+			return fmt.Errorf("got %+v, want task %q not completed", *t, task)
+		}
+		return nil
+	})
+	step("update", func(ctx context.Context) error { return c.SetCompleted(ctx, created.ID, true) })
+	step("read updated", func(ctx context.Context) error {
+		t, err := c.Todo(ctx, created.ID)
+		switch {
+		case err != nil:
+			return err
+		case !t.Completed:
+			return fmt.Errorf("todo %d is not completed", t.ID)
+		}
+		return nil
+	})
+	step("delete", func(ctx context.Context) error {
+		err := c.DeleteTodo(ctx, created.ID)
+		deleted = err == nil
+		return err
+	})
+	step("read deleted", func(ctx context.Context) error {
+		_, err := c.Todo(ctx, created.ID)
+		switch {
+		case client.IsNotFound(err):
+			return nil
+		case err != nil:
+			return err
+		}
+		return fmt.Errorf("todo %d is still there", created.ID)
+	})
+
+	if created != nil && !deleted {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), smokeCleanupTimeout)
+		defer cancel()
+		start := time.Now()
+		s := smokeStep{Step: "cleanup", OK: true}
+		if err := c.DeleteTodo(ctx, created.ID); err != nil && !client.IsNotFound(err) {
+			s.OK, s.Error = false, fmt.Sprintf("todo %d was left behind: %v", created.ID, err)
+		}
+		s.Duration = time.Since(start).Round(time.Millisecond).String()
+		steps = append(steps, s)
+	}
+	return steps, failed
+}
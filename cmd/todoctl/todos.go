@@ -0,0 +1,305 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stevemcghee/go-to-production/client"
+)
+
+func listCmd(g *globals) *cobra.Command {
+	var pending, completed bool
+	var listID int64
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the todos you can see",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.todos(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			todos := []client.Todo{}
+			for t, err := range c.Todos(ctx) {
+				if err != nil {
+					return err
+				}
+				if pending && t.Completed || completed && !t.Completed || listID != 0 && (t.ListID == nil || *t.ListID != listID) {
+					continue
+				}
+				todos = append(todos, t)
+			}
+			return g.print(cmd.OutOrStdout(), todos, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tDONE\tLIST\tTASK")
+				for _, t := range todos {
+					done, list := " ", "-"
+					if t.Completed {
+						done = "x"
+					}
+					if t.ListID != nil {
+						list = strconv.FormatInt(*t.ListID, 10)
+					}
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", t.ID, done, list, t.Task)
+				}
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&pending, "pending", false, "only todos that are not completed")
+	cmd.Flags().BoolVar(&completed, "completed", false, "only completed todos")
+	cmd.Flags().Int64Var(&listID, "list", 0, "only todos on this shared list")
+	cmd.MarkFlagsMutuallyExclusive("pending", "completed")
+	return cmd
+}
+
+func addCmd(g *globals) *cobra.Command {
+	var listID int64
+	cmd := &cobra.Command{
+		Use:   "add <task>...",
+		Short: "Add a todo; the arguments are joined into its task",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.todos(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			t := client.NewTodo{Task: strings.Join(args, " ")}
+			if listID != 0 {
+				t.ListID = &listID
+			}
+			created, err := c.CreateTodo(ctx, t)
+			if err != nil {
+				return err
+			}
+			return g.print(cmd.OutOrStdout(), created, func(w io.Writer) {
+				fmt.Fprintf(w, "Added todo %d\n", created.ID)
+			})
+		},
+	}
+	cmd.Flags().Int64Var(&listID, "list", 0, "add it to this shared list")
+	return cmd
+}
+
+func completeCmd(g *globals) *cobra.Command {
+	var undo bool
+	cmd := &cobra.Command{
+		Use:   "complete <id>...",
+		Short: "Mark todos completed",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return eachTodo(g, cmd, args, func(ctx context.Context, c todoStore, id int) error {
+				return c.SetCompleted(ctx, id, !undo)
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&undo, "undo", false, "mark them not completed instead")
+	return cmd
+}
+
+func deleteCmd(g *globals) *cobra.Command {
+	return &cobra.Command{
+		Use:     "delete <id>...",
+		Aliases: []string{"rm"},
+		Short:   "Delete todos",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return eachTodo(g, cmd, args, func(ctx context.Context, c todoStore, id int) error {
+				return c.DeleteTodo(ctx, id)
+			})
+		},
+	}
+}
+
+// eachTodo parses the todo ids in args and calls fn for each, stopping at the
+// first error.
+func eachTodo(g *globals, cmd *cobra.Command, args []string, fn func(context.Context, todoStore, int) error) error {
+	ids := make([]int, len(args))
+	for i, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid todo id %q", arg)
+		}
+		ids[i] = id
+	}
+	c, ctx, cancel, err := g.todos(cmd)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for _, id := range ids {
+		if err := fn(ctx, c, id); err != nil {
+			return fmt.Errorf("todo %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func importCmd(g *globals) *cobra.Command {
+	var keepLists bool
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Create todos from a JSON or CSV export, or from a text file with one task per line",
+		Long: `Create todos from a file: a JSON array or CSV as written by "todoctl export",
+or plain text with one task per line ("-" reads stdin). Completed todos are created
+and then marked completed.
+
+Each todo is created with an Idempotency-Key derived from the file, so running
+the same import again within 24 hours does not create duplicates.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			if args[0] == "-" {
+				data, err = io.ReadAll(cmd.InOrStdin())
+			} else {
+				data, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				return err
+			}
+			todos, err := parseImport(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+			c, ctx, cancel, err := g.todos(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			sum := sha256.Sum256(data)
+			prefix := "todoctl-import-" + hex.EncodeToString(sum[:12])
+			for i, t := range todos {
+				nt := client.NewTodo{Task: t.Task}
+				if keepLists {
+					nt.ListID = t.ListID
+				}
+				created, err := c.CreateTodo(client.WithIdempotencyKey(ctx, fmt.Sprintf("%s-%d", prefix, i)), nt)
+				if err != nil {
+					return fmt.Errorf("todo %d of %d: %w", i+1, len(todos), err)
+				}
+				if t.Completed && !created.Completed {
+					if err := c.SetCompleted(ctx, created.ID, true); err != nil {
+						return fmt.Errorf("todo %d of %d: %w", i+1, len(todos), err)
+					}
+				}
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Imported %d todos\n", len(todos))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&keepLists, "keep-lists", false, "put todos back on their shared lists, which must exist and be writable")
+	return cmd
+}
+
+// parseImport reads todos from a JSON array, a CSV export or plain text.
+func parseImport(data []byte) ([]client.Todo, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var todos []client.Todo
+		if err := json.Unmarshal(trimmed, &todos); err != nil {
+			return nil, err
+		}
+		return todos, nil
+	case bytes.HasPrefix(trimmed, []byte("id,task,")):
+		rows, err := csv.NewReader(bytes.NewReader(trimmed)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		todos := make([]client.Todo, 0, len(rows)-1)
+		for i, row := range rows[1:] {
+			if len(row) < 3 {
+				return nil, fmt.Errorf("line %d: want id,task,completed[,list_id]", i+2)
+			}
+			t := client.Todo{Task: row[1]}
+			t.Completed, _ = strconv.ParseBool(row[2])
+			if len(row) > 3 && row[3] != "" {
+				id, err := strconv.ParseInt(row[3], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid list_id %q", i+2, row[3])
+				}
+				t.ListID = &id
+			}
+			todos = append(todos, t)
+		}
+		return todos, nil
+	}
+	var todos []client.Todo
+	sc := bufio.NewScanner(bytes.NewReader(trimmed))
+	for sc.Scan() {
+		if task := strings.TrimSpace(sc.Text()); task != "" {
+			todos = append(todos, client.Todo{Task: task})
+		}
+	}
+	return todos, sc.Err()
+}
+
+func exportCmd(g *globals) *cobra.Command {
+	var format, out string
+	var poll time.Duration
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export your todos as JSON or CSV",
+		Long: `Start a server-side export, wait for it, and download it to --file (stdout by
+default). The file can be fed back to "todoctl import".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, ctx, cancel, err := g.client(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			e, err := c.StartExport(ctx, format)
+			if err != nil {
+				return err
+			}
+			if e, err = c.WaitExport(ctx, e.ID, poll); err != nil {
+				return err
+			}
+			if e.Status != "ready" {
+				return fmt.Errorf("export %d %s: %s", e.ID, e.Status, e.Error)
+			}
+			body, err := c.DownloadExport(ctx, e)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+
+			if out == "" || out == "-" {
+				_, err = io.Copy(cmd.OutOrStdout(), body)
+				return err
+			}
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, body); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "json", "json or csv")
+	cmd.Flags().StringVarP(&out, "file", "f", "", "write to this file instead of stdout")
+	cmd.Flags().DurationVar(&poll, "poll", time.Second, "how often to check whether the export is ready")
+	return cmd
+}
@@ -0,0 +1,388 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	AbuseBans = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abuse_bans_total",
+			Help: "Total number of temporary bans issued by abuse protection",
+		},
+		[]string{"kind", "reason"}, // kind: "ip" or "credential"; reason: "auth_failures" or "malformed"
+	)
+	AbuseRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abuse_rejected_requests_total",
+			Help: "Total number of requests rejected because the client is banned",
+		},
+		[]string{"kind"},
+	)
+)
+
+// AbuseStore keeps failure counters and bans. The in-memory store is per replica;
+// the Redis store shares state so a client can't spread attempts across pods.
+type AbuseStore interface {
+	// Hit records one event for key and returns the count within the current window.
+	Hit(ctx context.Context, key string, window time.Duration) (int64, error)
+	// Ban bans key for base * 2^(previous bans), capped at max, and returns the duration.
+	Ban(ctx context.Context, key string, base, max time.Duration) (time.Duration, error)
+	// BannedFor returns the remaining ban for key, or 0.
+	BannedFor(ctx context.Context, key string) (time.Duration, error)
+}
+
+// AbuseConfig sets the thresholds for temporary bans.
+type AbuseConfig struct {
+	AuthFailureLimit  int64 // failed authentications per AuthFailureWindow
+	AuthFailureWindow time.Duration
+	MalformedLimit    int64 // malformed requests (400, 413, 431) per MalformedWindow
+	MalformedWindow   time.Duration
+	BanBase           time.Duration // first ban; doubles with every repeat offence
+	BanMax            time.Duration
+	// StrikeMemory is how long previous bans count towards the next one.
+	StrikeMemory time.Duration
+}
+
+// DefaultAbuseConfig returns conservative thresholds.
+func DefaultAbuseConfig() AbuseConfig {
+	return AbuseConfig{
+		AuthFailureLimit:  10,
+		AuthFailureWindow: 5 * time.Minute,
+		MalformedLimit:    50,
+		MalformedWindow:   time.Minute,
+		BanBase:           time.Minute,
+		BanMax:            24 * time.Hour,
+		StrikeMemory:      24 * time.Hour,
+	}
+}
+
+// Abuse protection settings; a nil Abuse.Store disables the middleware.
+var Abuse = struct {
+	Store  AbuseStore
+	Config AbuseConfig
+}{Config: DefaultAbuseConfig()}
+
+// TrustedProxyHops is the number of proxies in front of the app that append to
+// X-Forwarded-For (2 behind a Google Cloud external load balancer). With 0 the
+// connection's remote address is used, so clients can't spoof their IP.
+var TrustedProxyHops = 0
+
+// ClientIP returns the caller's IP address, honouring TrustedProxyHops.
+func ClientIP(r *http.Request) string {
+	if TrustedProxyHops > 0 {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if i := len(hops) - TrustedProxyHops; i >= 0 && i < len(hops) {
+			if ip := strings.TrimSpace(hops[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// credentialKey identifies the presented credential without storing it.
+func credentialKey(r *http.Request) string {
+	cred := r.Header.Get(APIKeyHeader)
+	if cred == "" {
+		cred = r.Header.Get("Authorization")
+	}
+	if cred == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(cred))
+	return "cred:" + hex.EncodeToString(h[:8])
+}
+
+// AbuseMiddleware bans clients that repeatedly fail authentication or send malformed
+// requests. Banned IPs get 429, banned credentials 403, both with Retry-After.
+// Store errors fail open: abuse protection must never take the service down.
+func AbuseMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store := Abuse.Store
+		if store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		ipKey, credKey := "ip:"+ClientIP(r), credentialKey(r)
+
+		if d := bannedFor(ctx, store, ipKey); d > 0 {
+			AbuseRejected.WithLabelValues("ip").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		if credKey != "" {
+			if d := bannedFor(ctx, store, credKey); d > 0 {
+				AbuseRejected.WithLabelValues("credential").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+				http.Error(w, "Forbidden: credential temporarily blocked", http.StatusForbidden)
+				return
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		cfg := abuseConfig()
+		switch sw.status {
+		case http.StatusUnauthorized:
+			recordAbuse(r, store, ipKey, "ip", "auth_failures", cfg.AuthFailureLimit, cfg.AuthFailureWindow)
+			if credKey != "" {
+				recordAbuse(r, store, credKey, "credential", "auth_failures", cfg.AuthFailureLimit, cfg.AuthFailureWindow)
+			}
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusRequestHeaderFieldsTooLarge:
+			recordAbuse(r, store, ipKey, "ip", "malformed", cfg.MalformedLimit, cfg.MalformedWindow)
+		}
+	})
+}
+
+func bannedFor(ctx context.Context, store AbuseStore, key string) time.Duration {
+	d, err := store.BannedFor(ctx, key)
+	if err != nil {
+		slog.Warn("Abuse store unavailable, allowing request", "error", err)
+		return 0
+	}
+	return d
+}
+
+// recordAbuse counts a failure and bans key once it reaches limit within window.
+// Bans are written to the log as audit entries.
+func recordAbuse(r *http.Request, store AbuseStore, key, kind, reason string, limit int64, window time.Duration) {
+	ctx := context.WithoutCancel(r.Context())
+	n, err := store.Hit(ctx, reason+":"+key, window)
+	if err != nil {
+		slog.Warn("Abuse store unavailable", "error", err)
+		return
+	}
+	if n < limit {
+		return
+	}
+	cfg := abuseConfig()
+	d, err := store.Ban(ctx, key, cfg.BanBase, cfg.BanMax)
+	if err != nil {
+		slog.Warn("Abuse store unavailable", "error", err)
+		return
+	}
+	AbuseBans.WithLabelValues(kind, reason).Inc()
+	slog.Warn("Temporarily banned client",
+		"audit", true,
+		"event", "abuse_ban",
+		"kind", kind,
+		"key", key,
+		"reason", reason,
+		"count", n,
+		"duration", d.String(),
+		"path", r.URL.Path,
+		"request_id", RequestIDFromContext(r.Context()),
+	)
+}
+
+// statusWriter records the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// MemoryAbuseStore is an in-process AbuseStore.
+type MemoryAbuseStore struct {
+	mu           sync.Mutex
+	counters     map[string]*abuseCounter
+	bans         map[string]time.Time
+	strikes      map[string]*abuseCounter
+	strikeMemory time.Duration
+	now          func() time.Time
+}
+
+type abuseCounter struct {
+	n       int64
+	expires time.Time
+}
+
+// NewMemoryAbuseStore returns an empty in-memory store.
+func NewMemoryAbuseStore() *MemoryAbuseStore {
+	return &MemoryAbuseStore{
+		counters:     make(map[string]*abuseCounter),
+		bans:         make(map[string]time.Time),
+		strikes:      make(map[string]*abuseCounter),
+		strikeMemory: DefaultAbuseConfig().StrikeMemory,
+		now:          time.Now,
+	}
+}
+
+func (s *MemoryAbuseStore) Hit(ctx context.Context, key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.gcLocked(now)
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &abuseCounter{expires: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.n++
+	return c.n, nil
+}
+
+func (s *MemoryAbuseStore) Ban(ctx context.Context, key string, base, max time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	st, ok := s.strikes[key]
+	if !ok || now.After(st.expires) {
+		st = &abuseCounter{}
+		s.strikes[key] = st
+	}
+	st.n++
+	st.expires = now.Add(s.strikeMemory)
+	d := banDuration(st.n, base, max)
+	s.bans[key] = now.Add(d)
+	// A ban resets the failure counters, so the next ban needs fresh evidence.
+	for k := range s.counters {
+		if strings.HasSuffix(k, ":"+key) {
+			delete(s.counters, k)
+		}
+	}
+	return d, nil
+}
+
+func (s *MemoryAbuseStore) BannedFor(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[key]
+	if !ok {
+		return 0, nil
+	}
+	d := until.Sub(s.now())
+	if d <= 0 {
+		delete(s.bans, key)
+		return 0, nil
+	}
+	return d, nil
+}
+
+// gcLocked drops expired entries once the maps get large, bounding memory under floods.
+func (s *MemoryAbuseStore) gcLocked(now time.Time) {
+	if len(s.counters) < 10000 {
+		return
+	}
+	for k, c := range s.counters {
+		if now.After(c.expires) {
+			delete(s.counters, k)
+		}
+	}
+	for k, until := range s.bans {
+		if now.After(until) {
+			delete(s.bans, k)
+		}
+	}
+	for k, c := range s.strikes {
+		if now.After(c.expires) {
+			delete(s.strikes, k)
+		}
+	}
+}
+
+// banDuration is base * 2^(strike-1), capped at max.
+func banDuration(strike int64, base, max time.Duration) time.Duration {
+	d := base
+	for i := int64(1); i < strike && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// RedisAbuseStore shares abuse state between replicas through Redis.
+type RedisAbuseStore struct {
+	client       *redis.Client
+	prefix       string
+	strikeMemory time.Duration
+}
+
+// NewRedisAbuseStore connects to Redis at url (redis://[:password@]host:port/db).
+func NewRedisAbuseStore(url string) (*RedisAbuseStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisAbuseStore{
+		client:       redis.NewClient(opts),
+		prefix:       "todo-app:abuse:",
+		strikeMemory: DefaultAbuseConfig().StrikeMemory,
+	}, nil
+}
+
+func (s *RedisAbuseStore) Hit(ctx context.Context, key string, window time.Duration) (int64, error) {
+	k := s.prefix + "hits:" + key
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, k)
+	pipe.ExpireNX(ctx, k, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s *RedisAbuseStore) Ban(ctx context.Context, key string, base, max time.Duration) (time.Duration, error) {
+	sk := s.prefix + "strikes:" + key
+	pipe := s.client.TxPipeline()
+	strikes := pipe.Incr(ctx, sk)
+	pipe.Expire(ctx, sk, s.strikeMemory)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	d := banDuration(strikes.Val(), base, max)
+	pipe = s.client.TxPipeline()
+	pipe.Set(ctx, s.prefix+"ban:"+key, 1, d)
+	pipe.Del(ctx, s.prefix+"hits:auth_failures:"+key, s.prefix+"hits:malformed:"+key)
+	_, err := pipe.Exec(ctx)
+	return d, err
+}
+
+func (s *RedisAbuseStore) BannedFor(ctx context.Context, key string) (time.Duration, error) {
+	d, err := s.client.PTTL(ctx, s.prefix+"ban:"+key).Result()
+	if err != nil || d < 0 {
+		return 0, err
+	}
+	return d, nil
+}
@@ -0,0 +1,97 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Activity is one entry of the activity feed, GET /activity: something that happened
+// to a todo the caller can see, from the activity log of migration 0029.
+type Activity struct {
+	ID        int64      `json:"id"`
+	Kind      string     `json:"kind"` // "created", "completed", "commented" or "due_changed"
+	TodoID    int        `json:"todo_id"`
+	Task      string     `json:"task"`            // the todo's current task text
+	Actor     string     `json:"actor,omitempty"` // who did it, where known
+	At        time.Time  `json:"at"`
+	CommentID *int64     `json:"comment_id,omitempty"` // "commented": the new comment
+	DueFrom   *time.Time `json:"due_from,omitempty"`   // "due_changed": nil if there was no due date
+	DueTo     *time.Time `json:"due_to,omitempty"`     // "due_changed": nil if it was cleared
+}
+
+const activityQuery = `SELECT a.id, a.kind, a.todo_id, todos.task, COALESCE(a.actor, ''), a.created_at,
+	(a.detail->>'comment_id')::bigint, (a.detail->>'from')::timestamptz, (a.detail->>'to')::timestamptz
+FROM todo_activity a JOIN todos ON todos.id = a.todo_id
+WHERE ` + todoVisibleTo + ` AND ($2 = 0 OR a.id < $2)
+ORDER BY a.id DESC LIMIT $3`
+
+// HandleActivity serves GET /activity: up to ?limit (default 50, at most 200) entries
+// of activity on the todos the caller can see, newest first. ?before=<id> pages on
+// from the last entry of the previous page.
+func (s *Server) HandleActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		var err error
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 1 {
+			http.Error(w, "Invalid before activity ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var feed []Activity
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "list_activity", activityQuery, owner, before, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		feed = make([]Activity, 0, limit) // Reset on retry
+		for rows.Next() {
+			var a Activity
+			if err := rows.Scan(&a.ID, &a.Kind, &a.TodoID, &a.Task, &a.Actor, &a.At, &a.CommentID, &a.DueFrom, &a.DueTo); err != nil {
+				return err
+			}
+			feed = append(feed, a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	for i := range feed {
+		if feed[i].Task, err = s.decryptTask(ctx, feed[i].Task); err != nil {
+			slog.Error("Failed to decrypt task", "id", feed[i].TodoID, "error", err)
+			writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(feed); err != nil {
+		slog.Error("Failed to encode activity", "error", err)
+	}
+}
@@ -0,0 +1,611 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Admin resources for declarative tools such as Terraform. Each resource has a name
+// chosen by the caller and is written with PUT, which creates it or brings it to the
+// state in the body, so applying the same configuration twice changes nothing:
+//
+//	GET /admin/resources                                every named resource, to import or diff
+//	GET, PUT, DELETE /admin/resources/apikeys/{name}    {"scopes": ["read"], "tenant": "acme"}
+//	GET, PUT, DELETE /admin/resources/webhooks/{name}   {"owner": "user:alice", "url": "https://...", "events": [...], "active": true}
+//	GET, PUT, DELETE /admin/resources/quotas/{subject}  {"max_todos": 1000, "max_open_todos": 100, "max_lists": 20, "max_attachment_bytes": 1073741824}
+//	GET, PUT, DELETE /admin/resources/tenants/{id}      {"name": "Acme", "max_todos": 500, "requests_per_minute": 600, "features": {...}}
+//
+// PUT answers 201 when it created the resource and 200 when it updated it. Updates keep
+// the key or webhook, so ids are stable; secrets are only returned when generated.
+
+// resourceNamePattern is what API key and webhook names may look like.
+var resourceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+
+// ManagedWebhook is a webhook managed by name, registered for the todos Owner can see.
+type ManagedWebhook struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	Webhook
+}
+
+// Quota limits a subject (see TodoOwner). Todos are counted across all lists. Limits
+// it leaves out fall back to the subject's tenant.
+type Quota struct {
+	Subject string `json:"subject"`
+	QuotaLimits
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AdminResources is every named resource, as returned by GET /admin/resources.
+type AdminResources struct {
+	APIKeys  []APIKey         `json:"api_keys"`
+	Webhooks []ManagedWebhook `json:"webhooks"`
+	Quotas   []Quota          `json:"quotas"`
+	Tenants  []Tenant         `json:"tenants"`
+}
+
+// HandleAdminResources serves /admin/resources and /admin/resources/{kind}/{name}.
+func (s *Server) HandleAdminResources(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/resources"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.exportAdminResources(w, r)
+		return
+	}
+	kind, name, _ := strings.Cut(rest, "/")
+	handlers, ok := map[string][3]func(http.ResponseWriter, *http.Request, string){
+		"apikeys":  {s.getManagedAPIKey, s.putManagedAPIKey, s.deleteManagedAPIKey},
+		"webhooks": {s.getManagedWebhook, s.putManagedWebhook, s.deleteManagedWebhook},
+		"quotas":   {s.getQuota, s.putQuota, s.deleteQuota},
+		"tenants":  {s.getTenant, s.putTenant, s.deleteTenant},
+	}[kind]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if kind == "quotas" {
+		if name == "" || len(name) > 255 {
+			http.Error(w, "Invalid subject", http.StatusBadRequest)
+			return
+		}
+	} else if kind == "tenants" {
+		if !tenantIDPattern.MatchString(name) {
+			http.Error(w, "Invalid tenant ID: use up to 63 lowercase letters, digits and '-'", http.StatusBadRequest)
+			return
+		}
+	} else if !resourceNamePattern.MatchString(name) {
+		http.Error(w, "Invalid name: use up to 128 letters, digits, '_', '.' and '-'", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		handlers[0](w, r, name)
+	case http.MethodPut:
+		handlers[1](w, r, name)
+	case http.MethodDelete:
+		handlers[2](w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeResource writes v with 201 for a created resource and 200 otherwise.
+func writeResource(w http.ResponseWriter, created bool, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode admin resource", "error", err)
+	}
+}
+
+const selectManagedAPIKeyColumns = "SELECT id, resource_name, key_prefix, scopes, COALESCE(tenant_id, ''), created_at FROM api_keys"
+
+func scanManagedAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.Tenant, &k.CreatedAt)
+	return k, err
+}
+
+func (s *Server) getManagedAPIKey(w http.ResponseWriter, r *http.Request, name string) {
+	var key APIKey
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		key, err = scanManagedAPIKey(dbQueryRow(r.Context(), s.DBRead, "get_managed_api_key",
+			selectManagedAPIKeyColumns+" WHERE resource_name = $1 AND revoked_at IS NULL", name))
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeResource(w, false, key)
+}
+
+// putManagedAPIKey sets the scopes and tenant of the named key, creating it if needed.
+// The key itself is only returned on creation.
+func (s *Server) putManagedAPIKey(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validScopes(req.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plaintext, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+
+	var key APIKey
+	var created, unknownTenant bool
+	err = s.ExecuteWithRobustness(func() error {
+		var err error
+		key, err = scanManagedAPIKey(dbQueryRow(r.Context(), s.DB, "update_managed_api_key",
+			`UPDATE api_keys SET scopes = $2, tenant_id = NULLIF($3, '') WHERE resource_name = $1 AND revoked_at IS NULL
+			RETURNING id, resource_name, key_prefix, scopes, COALESCE(tenant_id, ''), created_at`,
+			name, pq.Array(req.Scopes), req.Tenant))
+		created = errors.Is(err, sql.ErrNoRows)
+		if created {
+			// A concurrent PUT may win the unique index; the retry then updates its key.
+			key = APIKey{Name: name, Prefix: plaintext[:8], Scopes: req.Scopes, Tenant: req.Tenant, Key: plaintext}
+			err = dbQueryRow(r.Context(), s.DB, "insert_managed_api_key",
+				"INSERT INTO api_keys (name, resource_name, key_prefix, key_hash, scopes, tenant_id) VALUES ($1, $1, $2, $3, $4, NULLIF($5, '')) RETURNING id, created_at",
+				name, key.Prefix, hashAPIKey(plaintext), pq.Array(key.Scopes), key.Tenant).Scan(&key.ID, &key.CreatedAt)
+		}
+		// A tenant that does not exist is an answer, not a database failure.
+		unknownTenant = isUnknownTenant(err)
+		if unknownTenant {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if unknownTenant {
+		http.Error(w, "Unknown tenant", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Cached validations carry the old scopes and tenant.
+	s.APIKeys.invalidate()
+	slog.Info("Applied managed API key", "name", name, "id", key.ID, "created", created, "scopes", key.Scopes, "tenant", key.Tenant, "by", principalSubject(r.Context()))
+	writeResource(w, created, key)
+}
+
+func (s *Server) deleteManagedAPIKey(w http.ResponseWriter, r *http.Request, name string) {
+	var revoked bool
+	err := s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "revoke_managed_api_key",
+			"UPDATE api_keys SET revoked_at = now() WHERE resource_name = $1 AND revoked_at IS NULL", name)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		revoked = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	s.APIKeys.invalidate()
+	slog.Info("Revoked managed API key", "name", name, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const selectManagedWebhookColumns = "SELECT id, resource_name, owner_id, url, events, active, created_at FROM webhooks"
+
+func scanManagedWebhook(row interface{ Scan(...any) error }) (ManagedWebhook, error) {
+	var wh ManagedWebhook
+	err := row.Scan(&wh.ID, &wh.Name, &wh.Owner, &wh.URL, pq.Array(&wh.Events), &wh.Active, &wh.CreatedAt)
+	return wh, err
+}
+
+func (s *Server) getManagedWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	var wh ManagedWebhook
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		wh, err = scanManagedWebhook(dbQueryRow(r.Context(), s.DBRead, "get_managed_webhook",
+			selectManagedWebhookColumns+" WHERE resource_name = $1", name))
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeResource(w, false, wh)
+}
+
+// putManagedWebhook registers the named webhook for owner or updates it. Without a
+// secret, a new webhook gets a generated one (returned once) and an existing one
+// keeps its own.
+func (s *Server) putManagedWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Owner string `json:"owner"`
+		webhookRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Owner == "" {
+		http.Error(w, "owner is required", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setSecret := req.Secret != ""
+	if !setSecret {
+		req.Secret = newWebhookSecret()
+	}
+	sealed, err := s.encryptTask(r.Context(), req.Secret)
+	if err != nil {
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+
+	wh := ManagedWebhook{Name: name, Owner: req.Owner, Webhook: Webhook{URL: req.URL, Events: req.Events, Active: *req.Active}}
+	var created bool
+	err = s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(r.Context(), s.DB, "update_managed_webhook",
+			`UPDATE webhooks SET owner_id = $2, url = $3, events = $4, active = $5, secret = CASE WHEN $6 THEN $7 ELSE secret END
+			WHERE resource_name = $1 RETURNING id, created_at`,
+			name, wh.Owner, wh.URL, pq.Array(wh.Events), wh.Active, setSecret, sealed).Scan(&wh.ID, &wh.CreatedAt)
+		created = errors.Is(err, sql.ErrNoRows)
+		if !created {
+			return err
+		}
+		return dbQueryRow(r.Context(), s.DB, "insert_managed_webhook",
+			"INSERT INTO webhooks (resource_name, owner_id, url, secret, events, active) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+			name, wh.Owner, wh.URL, sealed, pq.Array(wh.Events), wh.Active).Scan(&wh.ID, &wh.CreatedAt)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if created && !setSecret {
+		wh.Secret = req.Secret
+	}
+	slog.Info("Applied managed webhook", "name", name, "id", wh.ID, "created", created, "owner", wh.Owner, "by", principalSubject(r.Context()))
+	writeResource(w, created, wh)
+}
+
+func (s *Server) deleteManagedWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	var deleted bool
+	err := s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "delete_managed_webhook", "DELETE FROM webhooks WHERE resource_name = $1", name)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		deleted = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Deleted managed webhook", "name", name, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const selectQuotaColumns = "SELECT subject, max_todos, max_open_todos, max_lists, max_attachment_bytes, created_at, updated_at FROM quotas"
+
+func scanQuota(row interface{ Scan(...any) error }) (Quota, error) {
+	var q Quota
+	err := row.Scan(&q.Subject, &q.MaxTodos, &q.MaxOpenTodos, &q.MaxLists, &q.MaxAttachmentBytes, &q.CreatedAt, &q.UpdatedAt)
+	return q, err
+}
+
+func (s *Server) getQuota(w http.ResponseWriter, r *http.Request, subject string) {
+	var q Quota
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		q, err = scanQuota(dbQueryRow(r.Context(), s.DBRead, "get_quota", selectQuotaColumns+" WHERE subject = $1", subject))
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeResource(w, false, q)
+}
+
+// putQuota sets the limits of subject; those left out fall back to its tenant. What is
+// already beyond a lowered limit stays; only new writes are refused.
+func (s *Server) putQuota(w http.ResponseWriter, r *http.Request, subject string) {
+	var req QuotaLimits
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.empty() {
+		http.Error(w, "set at least one of max_todos, max_open_todos, max_lists and max_attachment_bytes", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := Quota{Subject: subject, QuotaLimits: req}
+	var created bool
+	err := s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(r.Context(), s.DB, "put_quota",
+			`INSERT INTO quotas (subject, max_todos, max_open_todos, max_lists, max_attachment_bytes) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (subject) DO UPDATE SET max_todos = EXCLUDED.max_todos, max_open_todos = EXCLUDED.max_open_todos,
+				max_lists = EXCLUDED.max_lists, max_attachment_bytes = EXCLUDED.max_attachment_bytes, updated_at = now()
+			RETURNING created_at, updated_at, xmax = 0`,
+			subject, req.MaxTodos, req.MaxOpenTodos, req.MaxLists, req.MaxAttachmentBytes).Scan(&q.CreatedAt, &q.UpdatedAt, &created)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Applied quota", "subject", subject, "created", created, "by", principalSubject(r.Context()))
+	writeResource(w, created, q)
+}
+
+func (s *Server) deleteQuota(w http.ResponseWriter, r *http.Request, subject string) {
+	var deleted bool
+	err := s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "delete_quota", "DELETE FROM quotas WHERE subject = $1", subject)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		deleted = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Quota not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Deleted quota", "subject", subject, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getTenant(w http.ResponseWriter, r *http.Request, id string) {
+	var t Tenant
+	found := false
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		t, err = scanTenant(dbQueryRow(r.Context(), s.DBRead, "get_tenant", selectTenantColumns+" WHERE id = $1", id))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	writeResource(w, false, t)
+}
+
+// putTenant sets the name and overrides of tenant id, creating it if needed. Limits
+// left out fall back to the configuration.
+func (s *Server) putTenant(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Name string `json:"name"`
+		QuotaLimits
+		RequestsPerMinute *int            `json:"requests_per_minute"`
+		Features          map[string]bool `json:"features"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RequestsPerMinute != nil && *req.RequestsPerMinute < 0 {
+		http.Error(w, "requests_per_minute must not be negative", http.StatusBadRequest)
+		return
+	}
+	for name := range req.Features {
+		if name == "" || strings.ContainsAny(name, ",= ") {
+			http.Error(w, fmt.Sprintf("invalid feature name %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Features == nil {
+		req.Features = map[string]bool{}
+	}
+	features, err := json.Marshal(req.Features)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := Tenant{ID: id, Name: req.Name, QuotaLimits: req.QuotaLimits, RequestsPerMinute: req.RequestsPerMinute, Features: req.Features}
+	var created bool
+	err = s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(r.Context(), s.DB, "put_tenant",
+			`INSERT INTO tenants (id, name, max_todos, max_open_todos, max_lists, max_attachment_bytes, requests_per_minute, features)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, max_todos = EXCLUDED.max_todos,
+				max_open_todos = EXCLUDED.max_open_todos, max_lists = EXCLUDED.max_lists,
+				max_attachment_bytes = EXCLUDED.max_attachment_bytes,
+				requests_per_minute = EXCLUDED.requests_per_minute, features = EXCLUDED.features, updated_at = now()
+			RETURNING created_at, updated_at, xmax = 0`,
+			id, t.Name, t.MaxTodos, t.MaxOpenTodos, t.MaxLists, t.MaxAttachmentBytes, t.RequestsPerMinute, features).Scan(&t.CreatedAt, &t.UpdatedAt, &created)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	invalidateTenants()
+	slog.Info("Applied tenant", "id", id, "created", created, "by", principalSubject(r.Context()))
+	writeResource(w, created, t)
+}
+
+// deleteTenant deletes tenant id, which leaves its data in place but stops its
+// credentials from working. The default tenant, and tenants that API keys are still
+// bound to, cannot be deleted.
+func (s *Server) deleteTenant(w http.ResponseWriter, r *http.Request, id string) {
+	if id == DefaultTenant {
+		http.Error(w, "The default tenant cannot be deleted", http.StatusConflict)
+		return
+	}
+	var deleted, bound bool
+	err := s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "delete_tenant", "DELETE FROM tenants WHERE id = $1", id)
+		// Keys still bound to the tenant are an answer, not a database failure.
+		bound = isUnknownTenant(err)
+		if bound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		deleted = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if bound {
+		http.Error(w, "API keys are still bound to the tenant", http.StatusConflict)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	invalidateTenants()
+	slog.Info("Deleted tenant", "id", id, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exportAdminResources serves GET /admin/resources: every named API key, named webhook,
+// quota and tenant, without secrets, sorted by name.
+func (s *Server) exportAdminResources(w http.ResponseWriter, r *http.Request) {
+	var state AdminResources
+	err := s.ExecuteWithRobustness(func() error {
+		state = AdminResources{APIKeys: []APIKey{}, Webhooks: []ManagedWebhook{}, Quotas: []Quota{}, Tenants: []Tenant{}} // Reset on retry
+		ctx := r.Context()
+		rows, err := dbQuery(ctx, s.DBRead, "export_api_keys",
+			selectManagedAPIKeyColumns+" WHERE resource_name IS NOT NULL AND revoked_at IS NULL ORDER BY resource_name")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			k, err := scanManagedAPIKey(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			state.APIKeys = append(state.APIKeys, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = dbQuery(ctx, s.DBRead, "export_webhooks",
+			selectManagedWebhookColumns+" WHERE resource_name IS NOT NULL ORDER BY resource_name")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			wh, err := scanManagedWebhook(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			state.Webhooks = append(state.Webhooks, wh)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = dbQuery(ctx, s.DBRead, "export_quotas", selectQuotaColumns+" ORDER BY subject")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			q, err := scanQuota(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			state.Quotas = append(state.Quotas, q)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = dbQuery(ctx, s.DBRead, "export_tenants", selectTenantColumns+" ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			t, err := scanTenant(rows)
+			if err != nil {
+				return err
+			}
+			state.Tenants = append(state.Tenants, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeResource(w, false, state)
+}
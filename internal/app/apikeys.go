@@ -0,0 +1,309 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// apiKeyCacheTTL bounds how long a validated (or rejected) key is trusted without
+// hitting the database. Revocations on other replicas take effect within this window.
+const apiKeyCacheTTL = 30 * time.Second
+
+// APIKey is an API key's metadata. The plaintext key is only returned at creation.
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant,omitempty"` // the tenant the key is bound to, if any
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+type cachedKey struct {
+	principal *Principal // nil for a known-invalid key
+	expires   time.Time
+}
+
+// APIKeyStore validates API keys against hashed keys in the server's database, plus an
+// optional bootstrap admin key (from Secret Manager) that works before any key exists.
+type APIKeyStore struct {
+	server        *Server
+	mu            sync.Mutex
+	bootstrapHash []byte
+	cache         map[string]cachedKey
+}
+
+// SetBootstrapKey installs the bootstrap admin key. An empty key disables it.
+func (s *APIKeyStore) SetBootstrapKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "" {
+		s.bootstrapHash = nil
+		return
+	}
+	h := sha256.Sum256([]byte(key))
+	s.bootstrapHash = h[:]
+}
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Validate resolves key to a principal, returning ErrInvalidCredentials for unknown
+// or revoked keys.
+func (s *APIKeyStore) Validate(ctx context.Context, key string) (*Principal, error) {
+	h := sha256.Sum256([]byte(key))
+
+	s.mu.Lock()
+	bootstrap := s.bootstrapHash
+	s.mu.Unlock()
+	if bootstrap != nil && subtle.ConstantTimeCompare(h[:], bootstrap) == 1 {
+		return &Principal{Subject: "apikey:bootstrap", KeyID: "bootstrap", Scopes: []string{ScopeAdmin}, Method: "bootstrap"}, nil
+	}
+
+	hash := hex.EncodeToString(h[:])
+	s.mu.Lock()
+	c, ok := s.cache[hash]
+	s.mu.Unlock()
+	if ok && s.server.Clock.Now().Before(c.expires) {
+		if c.principal == nil {
+			return nil, ErrInvalidCredentials
+		}
+		return c.principal, nil
+	}
+
+	// An unknown key is a normal outcome, not a database failure: it must not be
+	// retried or counted by the circuit breaker (or bad keys could trip it).
+	var id int64
+	var scopes []string
+	var tenant sql.NullString
+	found := false
+	err := s.server.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(ctx, s.server.DBRead, "validate_api_key", "SELECT id, scopes, tenant_id FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", hash).
+			Scan(&id, pq.Array(&scopes), &tenant)
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		s.store(hash, nil)
+		return nil, ErrInvalidCredentials
+	}
+
+	keyID := strconv.FormatInt(id, 10)
+	p := &Principal{Subject: "apikey:" + keyID, KeyID: keyID, Scopes: scopes, Method: "api_key", Tenant: tenant.String}
+	s.store(hash, p)
+	return p, nil
+}
+
+func (s *APIKeyStore) store(hash string, p *Principal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Drop expired entries opportunistically so forged keys can't grow the cache forever.
+	if len(s.cache) > 10000 {
+		now := s.server.Clock.Now()
+		for k, v := range s.cache {
+			if now.After(v.expires) {
+				delete(s.cache, k)
+			}
+		}
+	}
+	s.cache[hash] = cachedKey{principal: p, expires: s.server.Clock.Now().Add(apiKeyCacheTTL)}
+}
+
+// invalidate forgets every cached validation, used after a revocation.
+func (s *APIKeyStore) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = make(map[string]cachedKey)
+}
+
+// generateAPIKey returns a new random key of the form "tdk_<43 url-safe chars>".
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "tdk_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, s := range scopes {
+		switch s {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope %q (valid: read, write, admin)", s)
+		}
+	}
+	return nil
+}
+
+// HandleAPIKeys serves /admin/apikeys: GET lists keys, POST creates one.
+func (s *Server) HandleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listAPIKeys(w, r)
+	case http.MethodPost:
+		s.createAPIKey(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleAPIKey serves /admin/apikeys/{id}: DELETE revokes the key.
+func (s *Server) HandleAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/admin/apikeys/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var revoked bool
+	err = s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "revoke_api_key", "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		revoked = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	s.APIKeys.invalidate()
+	slog.Info("Revoked API key", "id", id, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := validScopes(req.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plaintext, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+	key := APIKey{Name: req.Name, Prefix: plaintext[:8], Scopes: req.Scopes, Tenant: req.Tenant, Key: plaintext}
+
+	var unknownTenant bool
+	err = s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(r.Context(), s.DB, "insert_api_key",
+			"INSERT INTO api_keys (name, key_prefix, key_hash, scopes, tenant_id) VALUES ($1, $2, $3, $4, NULLIF($5, '')) RETURNING id, created_at",
+			key.Name, key.Prefix, hashAPIKey(plaintext), pq.Array(key.Scopes), key.Tenant).Scan(&key.ID, &key.CreatedAt)
+		unknownTenant = isUnknownTenant(err)
+		if unknownTenant {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if unknownTenant {
+		http.Error(w, "Unknown tenant", http.StatusUnprocessableEntity)
+		return
+	}
+
+	slog.Info("Created API key", "id", key.ID, "name", key.Name, "scopes", key.Scopes, "tenant", key.Tenant, "by", principalSubject(r.Context()))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(key); err != nil {
+		slog.Error("Failed to encode API key", "error", err)
+	}
+}
+
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys := []APIKey{}
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(r.Context(), s.DBRead, "list_api_keys", "SELECT id, name, key_prefix, scopes, COALESCE(tenant_id, ''), created_at, revoked_at FROM api_keys ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys = keys[:0]
+		for rows.Next() {
+			var k APIKey
+			if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.Tenant, &k.CreatedAt, &k.RevokedAt); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		slog.Error("Failed to encode API keys", "error", err)
+	}
+}
+
+// principalSubject returns the caller's subject for audit logs.
+func principalSubject(ctx context.Context) string {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return p.Subject
+	}
+	return "anonymous"
+}
@@ -7,19 +7,22 @@ package app
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/cenkalti/backoff/v4"
-	_ "github.com/lib/pq"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/lib/pq"
+	"github.com/stevemcghee/go-to-production/internal/repository"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	// Removed unused import: "github.com/prometheus/client_golang/prometheus/promhttp"
@@ -72,11 +75,7 @@ var (
 )
 
 // Todo represents a single todo item.
-type Todo struct {
-	ID        int    `json:"id"`
-	Task      string `json:"task"`
-	Completed bool   `json:"completed"`
-}
+type Todo = repository.Todo
 
 // DBConfig holds database connection parameters.
 // For robustness, we support separate read and write endpoints:
@@ -90,28 +89,100 @@ type DBConfig struct {
 	DBPort     string `json:"db_port"`      // Primary database port (5432)
 	DBReadHost string `json:"db_read_host"` // Read replica host (via Cloud SQL Proxy: 127.0.0.1)
 	DBReadPort string `json:"db_read_port"` // Read replica port (5433)
+	DBPassword string `json:"db_password,omitempty"` // Only for password auth; IAM auth through the proxy needs none
 }
 
-// Database connection pools:
-// - DB: Primary connection for writes (INSERT, UPDATE, DELETE) and failover reads
-// - DBRead: Read replica connection for SELECT queries (improves performance and availability)
-var (
-	DB     *sql.DB // Primary database connection
-	DBRead *sql.DB // Read replica connection (or falls back to primary if replica unavailable)
+// dsn returns the connection string for host:port.
+func (c DBConfig) dsn(host, port string) string {
+	password := c.DBPassword
+	if password == "" {
+		password = "dummy-password" // ignored by the Cloud SQL Auth Proxy with IAM authentication
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.DBUser, password),
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/" + c.DBName,
+		RawQuery: "sslmode=disable",
+	}
+	return u.String()
+}
 
-	BackoffStrategy backoff.BackOff // Global variable to allow injecting a custom backoff for testing
-)
+// BackoffStrategy replaces the backoff of RetryOperation, for tests.
+var BackoffStrategy backoff.BackOff
 
-// Circuit Breaker provides fault tolerance by preventing requests to a failing service.
-// This protects the application from cascading failures when the database is consistently unavailable.
+// Server is the todo service. Its HTTP handlers, the gRPC, GraphQL and MCP adapters
+// and the background work are methods of Server, and reach the database through the
+// dependencies it holds rather than package variables, so that a test can build one
+// around fakes:
 //
-// States:
-// - Closed (normal): All requests pass through
-// - Open (failing): Requests fail immediately with ErrOpenState (returns HTTP 503)
-// - Half-Open (testing): After timeout, allows limited requests to test recovery
-var CB *gobreaker.CircuitBreaker
+//	db, mock, _ := sqlmock.New()
+//	s := app.NewServer(db, db)
+//	s.HandleTodos(w, r)
+type Server struct {
+	// Database connection pools:
+	// - DB: Primary connection for writes (INSERT, UPDATE, DELETE) and failover reads
+	// - DBRead: Read replica connection for SELECT queries (improves performance and availability)
+	DB     *sql.DB
+	DBRead *sql.DB // the replica, or DB without one
+
+	// CB provides fault tolerance by preventing requests to a failing database.
+	// This protects the application from cascading failures when the database is consistently unavailable.
+	//
+	// States:
+	// - Closed (normal): All requests pass through
+	// - Open (failing): Requests fail immediately with ErrOpenState (returns HTTP 503)
+	// - Half-Open (testing): After timeout, allows limited requests to test recovery
+	CB *gobreaker.CircuitBreaker
+
+	// Robustness is the Resilience of the database operations: CB around
+	// RetryOperation. Tests replace it with a ChaosResilience to fail operations by script.
+	Robustness Resilience
+
+	// Todos is what the todo handlers, adapters and workers read and write todos
+	// through: the todos table on DB and DBRead, unless a test hands it another
+	// repository.TodoRepository.
+	Todos repository.TodoRepository
+
+	Jobs       JobQueue     // an InProcessQueue unless jobs.queue says otherwise
+	APIKeys    *APIKeyStore // the key store used by AuthMiddleware
+	TaskCipher *FieldCipher // encrypts task text at rest; nil (the default) stores plaintext
+
+	// Clock is the time the server goes by: when sessions and caches expire, when
+	// reminders are due, what retention purges, when failed jobs, webhook deliveries
+	// and emails are retried, and how long requests and jobs take. What is timed by
+	// the world outside keeps to the real time: connection deadlines and ages, signed
+	// GCS URLs, the JWKS and TLS file refreshes, and the preflight clock check.
+	//
+	// IDs makes request ids, attachment object names, email Message-IDs and erasure
+	// pseudonyms; secrets (API keys, tokens, webhook secrets) always come from
+	// crypto/rand. NewServer sets both, to the system clock and crypto/rand unless a
+	// ServerOption says otherwise.
+	Clock Clock
+	IDs   IDGenerator
+
+	graphqlOnce sync.Once
+	graphql     *graphql.Schema
+}
+
+// NewServer returns a Server on the primary pool db and the replica pool dbRead, which
+// is db itself without a replica. It keeps todos in the todos table of those pools and
+// has a closed circuit breaker, an InProcessQueue of 4 workers and no task encryption;
+// main replaces those the configuration changes. opts may replace its Clock and IDs.
+func NewServer(db, dbRead *sql.DB, opts ...ServerOption) *Server {
+	s := &Server{DB: db, DBRead: dbRead, CB: NewDatabaseBreaker(), Clock: systemClock{}, IDs: randomIDs{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Robustness = breakerRetry{s}
+	s.Todos = postgresTodos{s}
+	s.Jobs = NewInProcessQueue(s, 4)
+	s.APIKeys = &APIKeyStore{server: s, cache: make(map[string]cachedKey)}
+	return s
+}
 
-func init() {
+// NewDatabaseBreaker returns the circuit breaker for database operations, closed.
+func NewDatabaseBreaker() *gobreaker.CircuitBreaker {
 	// Configure the circuit breaker for database operations
 	var st gobreaker.Settings
 	st.Name = "DatabaseCB"
@@ -120,18 +191,26 @@ func init() {
 	st.Timeout = 30 * time.Second // Duration circuit stays open before attempting recovery
 
 	// ReadyToTrip determines when to open the circuit (stop accepting requests)
-	// Opens when: at least 3 requests AND 60% failure rate
+	// Opens when: at least 3 requests AND 60% failure rate (breaker.min_requests, breaker.failure_ratio)
 	st.ReadyToTrip = func(counts gobreaker.Counts) bool {
+		minRequests, ratio := breakerThresholds()
 		failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
-		return counts.Requests >= 3 && failureRatio >= 0.6
+		return counts.Requests >= minRequests && failureRatio >= ratio
+	}
+
+	// Data the database refuses says nothing about its health
+	st.IsSuccessful = func(err error) bool {
+		return err == nil || isDataError(err)
 	}
 
 	// Log circuit breaker state changes for observability
 	st.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
 		slog.Warn("Circuit Breaker state changed", "name", name, "from", from, "to", to)
+		observeBreakerStateChange(name, from, to)
 	}
 
-	CB = gobreaker.NewCircuitBreaker(st)
+	CircuitBreakerState.WithLabelValues(st.Name).Set(breakerStateValue(gobreaker.StateClosed))
+	return gobreaker.NewCircuitBreaker(st)
 }
 
 // ExecuteWithRobustness wraps database operations with both retry logic and circuit breaking.
@@ -143,10 +222,26 @@ func init() {
 // - nil on success
 // - gobreaker.ErrOpenState if circuit is open (HTTP handlers should return 503)
 // - underlying error if retries exhausted
-func ExecuteWithRobustness(op func() error) error {
-	_, err := CB.Execute(func() (interface{}, error) {
+func (s *Server) ExecuteWithRobustness(op func() error) error {
+	return s.Robustness.Execute(op)
+}
+
+// Resilience runs database operations through the circuit breaker and retries.
+// ExecuteWithRobustness goes through Robustness, which tests replace with a
+// ChaosResilience to fail operations by script.
+type Resilience interface {
+	Execute(op func() error) error
+}
+
+// breakerRetry is the Resilience of NewServer: the server's CB around RetryOperation.
+type breakerRetry struct{ server *Server }
+
+func (b breakerRetry) Execute(op func() error) error {
+	cb := b.server.CB
+	_, err := cb.Execute(func() (interface{}, error) {
 		return nil, RetryOperation(op)
 	})
+	observeBreakerResult(cb, err)
 	return err
 }
 
@@ -160,6 +255,8 @@ func ExecuteWithRobustness(op func() error) error {
 // - Starts at 100ms delay
 // - Doubles delay up to 2s max
 // - Gives up after 5s total (fail fast for user experience)
+//
+// Data the database refuses (isDataError) is refused again on retry, so it is permanent.
 func RetryOperation(op func() error) error {
 	var b backoff.BackOff
 	if BackoffStrategy != nil {
@@ -173,9 +270,32 @@ func RetryOperation(op func() error) error {
 	}
 
 	// RetryNotify executes the operation with retries and logs each attempt
-	return backoff.RetryNotify(op, b, func(err error, d time.Duration) {
+	permanent := false
+	err := backoff.RetryNotify(func() error {
+		err := op()
+		if isDataError(err) {
+			err = backoff.Permanent(err)
+		}
+		permanent = isPermanent(err)
+		return err
+	}, b, func(err error, d time.Duration) {
+		DBRetryAttempts.Inc()
 		slog.Warn("Database operation failed, retrying...", "error", err, "duration", d)
 	})
+	observeRetryResult(err, permanent)
+	return err
+}
+
+// isDataError reports whether err is Postgres refusing the data of a statement rather
+// than failing to run it: SQLSTATE class 22 (data exception, such as invalid text) or
+// 23 (integrity constraint violation).
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
 }
 
 // InitTracer initializes Cloud Trace exporter and returns a shutdown function
@@ -190,7 +310,7 @@ func InitTracer(projectID string) (func(), error) {
 	res, err := resource.New(ctx,
 		resource.WithAttributes(
 			semconv.ServiceNameKey.String("todo-app-go"),
-			semconv.ServiceVersionKey.String("1.0.0"),
+			semconv.ServiceVersionKey.String(GetBuildInfo().Version),
 		),
 	)
 	if err != nil {
@@ -213,29 +333,127 @@ func InitTracer(projectID string) (func(), error) {
 	}, nil
 }
 
-func SecurityHeadersMiddleware(next http.Handler) http.Handler {
+// RequireHTTPS (server.require_https) redirects requests that reached the load balancer
+// over plain HTTP and enables HSTS. Requests without X-Forwarded-Proto, such as kubelet
+// probes to the pod, are served as they are.
+var RequireHTTPS = false
+
+// securityHeaders are set on every response. The values are shared and assigned to the
+// header map, under canonical keys, rather than Set, which allocates one per header and
+// request; a handler that changes one of them replaces the slice.
+var securityHeaders = http.Header{
+	// More permissive CSP that allows fonts and necessary resources
+	"Content-Security-Policy": {"default-src 'self'; font-src 'self' data: https:; style-src 'self' 'unsafe-inline' https:; script-src 'self'; img-src 'self' data: https:"},
+	"X-Content-Type-Options":  {"nosniff"},
+	"X-Frame-Options":         {"DENY"},
+	"X-Xss-Protection":        {"1; mode=block"},
+}
+
+var hstsHeader = []string{"max-age=31536000; includeSubDomains"}
+
+func (s *Server) SecurityHeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// More permissive CSP that allows fonts and necessary resources
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; font-src 'self' data: https:; style-src 'self' 'unsafe-inline' https:; script-src 'self'; img-src 'self' data: https:")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
+		h := w.Header()
+		if RequireHTTPS {
+			if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") == "http" {
+				http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+				return
+			}
+			h["Strict-Transport-Security"] = hstsHeader
+		}
+		for k, v := range securityHeaders {
+			h[k] = v
+		}
 
-		start := time.Now()
+		start := s.Clock.Now()
 		rw := NewResponseWriter(w)
 		next.ServeHTTP(rw, r)
-		duration := time.Since(start).Seconds()
+		duration := s.Clock.Now().Sub(start).Seconds()
 
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/todos/") && len(path) > 7 {
-			path = "/todos/:id"
-		}
+		path := metricsPath(r.URL.Path)
 
 		HTTPRequestsTotal.WithLabelValues(path, r.Method, strconv.Itoa(rw.StatusCode)).Inc()
-		HTTPRequestDuration.WithLabelValues(path, r.Method).Observe(duration)
+		ObserveWithTraceExemplar(r.Context(), HTTPRequestDuration.WithLabelValues(path, r.Method), duration)
 	})
 }
 
+// metricsPath collapses ids in the path so the request metrics stay low-cardinality.
+func metricsPath(path string) string {
+	switch {
+	case path == "/todos/events", path == "/todos/overdue", path == "/todos/today":
+		return path
+	case isCalendarPath(path):
+		return calendarMetricsPath(path)
+	case strings.HasPrefix(path, "/static/"):
+		return "/static/:file"
+	case strings.HasPrefix(path, "/admin/resources/") && len(path) > 17:
+		switch kind, _, _ := strings.Cut(path[len("/admin/resources/"):], "/"); kind {
+		case "apikeys", "webhooks":
+			return "/admin/resources/" + kind + "/:name"
+		case "quotas":
+			return "/admin/resources/quotas/:subject"
+		case "tenants":
+			return "/admin/resources/tenants/:id"
+		default:
+			return "/admin/resources/:unknown"
+		}
+	case strings.HasPrefix(path, "/jobs/") && len(path) > 6:
+		return "/jobs/:id"
+	case strings.HasPrefix(path, "/todos/") && len(path) > 7:
+		if strings.HasSuffix(path, ":clone") && !strings.Contains(path[len("/todos/"):], "/") {
+			return "/todos/:id:clone"
+		}
+		if _, sub, ok := strings.Cut(path[len("/todos/"):], "/"); ok {
+			switch sub {
+			case "due", "parent", "subtree", "recurrence", "comments", "attachments", "reminder", "snooze", "archive", "star", "suggest-subtasks", "dependencies":
+				return "/todos/:id/" + sub
+			}
+			switch {
+			case strings.HasPrefix(sub, "comments/"):
+				return "/todos/:id/comments/:comment"
+			case strings.HasPrefix(sub, "dependencies/"):
+				return "/todos/:id/dependencies/:other"
+			case strings.HasPrefix(sub, "attachments/") && strings.HasSuffix(sub, "/complete"):
+				return "/todos/:id/attachments/:attachment/complete"
+			case strings.HasPrefix(sub, "attachments/"):
+				return "/todos/:id/attachments/:attachment"
+			}
+			return "/todos/:id/:unknown"
+		}
+		return "/todos/:id"
+	case strings.HasPrefix(path, "/v1/todos/") && len(path) > 10:
+		return "/v1/todos/:id"
+	case strings.HasPrefix(path, "/exports/") && len(path) > 9:
+		if isExportDownload(path) {
+			return "/exports/:id/download"
+		}
+		return "/exports/:id"
+	case strings.HasPrefix(path, "/webhooks/") && len(path) > 10:
+		switch rest := strings.Split(path[len("/webhooks/"):], "/"); {
+		case len(rest) == 1:
+			return "/webhooks/:id"
+		case len(rest) == 2 && rest[1] == "deliveries":
+			return "/webhooks/:id/deliveries"
+		case len(rest) == 4 && rest[1] == "deliveries" && rest[3] == "retry":
+			return "/webhooks/:id/deliveries/:id/retry"
+		default:
+			return "/webhooks/:id/:unknown"
+		}
+	case strings.HasPrefix(path, "/lists/") && len(path) > 7:
+		switch rest := strings.SplitN(path[len("/lists/"):], "/", 3); {
+		case len(rest) == 1:
+			return "/lists/:id"
+		case rest[1] != "members":
+			return "/lists/:id/:unknown"
+		case len(rest) == 2:
+			return "/lists/:id/members"
+		default:
+			return "/lists/:id/members/:member"
+		}
+	}
+	return path
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	StatusCode int // Exported
@@ -250,7 +468,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// InitDB establishes connections to both primary and read replica databases.
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. to hijack
+// the connection for WebSockets).
+func (rw *responseWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// ConnectDB opens the pools of the primary and read replica databases, for NewServer.
 // This dual-connection architecture provides:
 // - Write scaling: All writes go to primary
 // - Read scaling: Reads distributed to replica, reducing primary load
@@ -260,29 +482,26 @@ func (rw *responseWriter) WriteHeader(code int) {
 // - IAM authentication (no passwords needed)
 // - TLS encryption
 // - Connection pooling
-func InitDB(config DBConfig) {
+func ConnectDB(config DBConfig) (db, dbRead *sql.DB) {
 	var err error
 
-	dbUser := config.DBUser
 	dbName := config.DBName
 	dbHost := config.DBHost
 	dbPort := config.DBPort
 
 	// ===== PRIMARY DATABASE CONNECTION =====
-	// The primary database handles all writes and serves as fallback for reads
-	connStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbHost, dbPort, dbName)
-	slog.Info("Connecting to PRIMARY database", "url", connStr)
+	// The primary database handles all writes and serves as fallback for reads.
+	// Pools dial through a rotatingConnector so credentials can change at runtime.
+	primaryConnector = newRotatingConnector(config.dsn(dbHost, dbPort))
+	db = openPool(primaryConnector)
+	slog.Info("Connecting to PRIMARY database", "host", dbHost, "port", dbPort, "database", dbName)
 
 	// Use longer retry timeout for initial connection (allows Cloud SQL Proxy to start)
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = 2 * time.Minute
 
 	op := func() error {
-		DB, err = sql.Open("postgres", connStr)
-		if err != nil {
-			return err
-		}
-		return DB.Ping()
+		return db.Ping()
 	}
 
 	err = backoff.RetryNotify(op, b, func(err error, d time.Duration) {
@@ -305,15 +524,12 @@ func InitDB(config DBConfig) {
 			dbReadPort = dbPort
 		}
 
-		readConnStr := fmt.Sprintf("postgres://%s:dummy-password@%s:%s/%s?sslmode=disable", dbUser, dbReadHost, dbReadPort, dbName)
-		slog.Info("Connecting to READ REPLICA", "url", readConnStr)
+		readConnector = newRotatingConnector(config.dsn(dbReadHost, dbReadPort))
+		dbRead = openPool(readConnector)
+		slog.Info("Connecting to READ REPLICA", "host", dbReadHost, "port", dbReadPort, "database", dbName)
 
 		opRead := func() error {
-			DBRead, err = sql.Open("postgres", readConnStr)
-			if err != nil {
-				return err
-			}
-			return DBRead.Ping()
+			return dbRead.Ping()
 		}
 
 		// We can be more lenient with Read Replica connection failure
@@ -325,29 +541,30 @@ func InitDB(config DBConfig) {
 		if err != nil {
 			// Read replica unavailable - not fatal, fall back to primary
 			slog.Error("Could not connect to READ REPLICA, falling back to PRIMARY", "error", err)
-			DBRead = DB // Fallback to primary for reads
+			dbRead = db // Fallback to primary for reads
 		} else {
 			slog.Info("Successfully connected to READ REPLICA")
 		}
 	} else {
 		// No read replica configured in secrets
 		slog.Info("No Read Replica configured, using PRIMARY for reads")
-		DBRead = DB
+		dbRead = db
 	}
+	return db, dbRead
 }
 
-func HealthzHandler(w http.ResponseWriter, r *http.Request) {
-	if DB == nil {
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if s.DB == nil {
 		http.Error(w, "Database connection not initialized", http.StatusInternalServerError)
 		return
 	}
-	if err := DB.Ping(); err != nil {
+	if err := s.DB.Ping(); err != nil {
 		http.Error(w, "Database connection failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// Check Read Replica too if distinct
-	if DBRead != DB && DBRead != nil {
-		if err := DBRead.Ping(); err != nil {
+	if s.DBRead != s.DB && s.DBRead != nil {
+		if err := s.DBRead.Ping(); err != nil {
 			slog.Warn("Read Replica ping failed", "error", err)
 			// Don't fail health check if only read replica is down?
 			// Or maybe we should? For now, let's just log it.
@@ -359,39 +576,116 @@ func HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ServeIndex(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Serving index.html", "path", r.URL.Path)
-	http.ServeFile(w, r, "templates/index.html")
-}
-
-func HandleTodos(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleTodos(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		GetTodos(w, r)
+		s.GetTodos(w, r)
 	case http.MethodPost:
-		AddTodo(w, r)
+		s.AddTodo(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func HandleTodo(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.URL.Path[len("/todos/"):])
+func (s *Server) HandleTodo(w http.ResponseWriter, r *http.Request) {
+	rest, sub, _ := strings.Cut(r.URL.Path[len("/todos/"):], "/")
+	rest, verb, _ := strings.Cut(rest, ":")
+	id, err := strconv.Atoi(rest)
 	if err != nil {
 		http.Error(w, "Invalid todo ID", http.StatusBadRequest)
 		return
 	}
+	// Custom methods act on the todo as a whole: /todos/{id}:verb.
+	if verb != "" {
+		if verb == "clone" && sub == "" {
+			s.HandleTodoClone(w, r, id)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if name, item, ok := strings.Cut(sub, "/"); ok {
+		switch name {
+		case "comments":
+			s.HandleTodoComment(w, r, id, item)
+		case "attachments":
+			s.HandleTodoAttachment(w, r, id, item)
+		case "dependencies":
+			s.HandleTodoDependency(w, r, id, item)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	switch sub {
+	case "":
+	case "due":
+		s.HandleTodoDue(w, r, id)
+		return
+	case "parent":
+		s.HandleTodoParent(w, r, id)
+		return
+	case "subtree":
+		s.HandleTodoSubtree(w, r, id)
+		return
+	case "recurrence":
+		s.HandleTodoRecurrence(w, r, id)
+		return
+	case "comments":
+		s.HandleTodoComments(w, r, id)
+		return
+	case "attachments":
+		s.HandleTodoAttachments(w, r, id)
+		return
+	case "reminder":
+		s.HandleTodoReminder(w, r, id)
+		return
+	case "snooze":
+		s.HandleTodoSnooze(w, r, id)
+		return
+	case "archive":
+		s.HandleTodoArchive(w, r, id)
+		return
+	case "star":
+		s.HandleTodoStar(w, r, id)
+		return
+	case "suggest-subtasks":
+		s.HandleTodoSuggestSubtasks(w, r, id)
+		return
+	case "dependencies":
+		s.HandleTodoDependencies(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
 
 	switch r.Method {
+	case http.MethodGet:
+		s.GetTodo(w, r, id)
 	case http.MethodPut:
-		UpdateTodo(w, r, id)
+		s.UpdateTodo(w, r, id)
 	case http.MethodDelete:
-		DeleteTodo(w, r, id)
+		s.DeleteTodo(w, r, id)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// Todo visibility: personal todos (no list) are visible only to their owner, list
+// todos to every member of the list. Only owners and editors may change list todos.
+const (
+	// todoColumns are the columns of a Todo, in the order scanTodo reads them.
+	todoColumns = `id, task, completed, list_id, due_at, priority,
+	ARRAY(SELECT g.name FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE tt.todo_id = todos.id ORDER BY g.name),
+	parent_id, COALESCE(rrule, ''), remind_at, created_at, updated_at, completed_at, archived, starred`
+	todoVisibleTo = `((list_id IS NULL AND user_id = $1)
+	OR list_id IN (SELECT list_id FROM list_members WHERE user_id = $1))`
+	listTodosQuery = `SELECT ` + todoColumns + ` FROM todos WHERE ` + todoVisibleTo + ` ORDER BY id`
+	todoWritableBy = `((list_id IS NULL AND user_id = $%[1]d)
+	OR list_id IN (SELECT list_id FROM list_members WHERE user_id = $%[1]d AND role IN ('owner', 'editor')))`
+)
+
 // GetTodos retrieves all todo items from the database.
 // Uses DBRead (read replica) to offload SELECT queries from the primary database.
 // This improves performance and allows the primary to focus on writes.
@@ -400,146 +694,152 @@ func HandleTodo(w http.ResponseWriter, r *http.Request) {
 // - Automatic retries on transient errors (network blips, etc.)
 // - Circuit breaker prevents cascading failures
 // - Falls back to primary if read replica is unavailable
-func GetTodos(w http.ResponseWriter, r *http.Request) {
-	var todos []Todo
-
-	err := ExecuteWithRobustness(func() error {
-		// Try read replica first
-		rows, err := DBRead.Query("SELECT id, task, completed FROM todos ORDER BY id")
-		if err != nil {
-			slog.Warn("Read replica failed, falling back to primary", "error", err)
-			// If read replica fails, fall back to primary
-			if DBRead != DB {
-				rows, err = DB.Query("SELECT id, task, completed FROM todos ORDER BY id")
-			}
-		}
-
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-
-		todos = []Todo{} // Reset slice on retry to avoid duplicates
-		for rows.Next() {
-			var t Todo
-			if err := rows.Scan(&t.ID, &t.Task, &t.Completed); err != nil {
-				return err
-			}
-			todos = append(todos, t)
-		}
-		return rows.Err()
-	})
-
+func (s *Server) GetTodos(w http.ResponseWriter, r *http.Request) {
+	f, err := parseTodoFilter(r.URL.Query())
 	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	todos, err := s.Todos.List(r.Context(), TodoOwner(r.Context()), f)
+	if err != nil {
+		writeTodoError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(todos); err != nil {
-		slog.Error("Failed to encode todos", "error", err)
+	writeTodoResponse(w, r, http.StatusOK, page(f, w, r, todos))
+	putTodoSlice(todos)
+}
+
+// GetTodo returns one todo the caller can see. Like GetTodos it reads from the replica,
+// through the read cache when there is one.
+func (s *Server) GetTodo(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := s.Todos.Get(r.Context(), TodoOwner(r.Context()), id, false)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
 	}
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
 }
 
-func AddTodo(w http.ResponseWriter, r *http.Request) {
+func (s *Server) AddTodo(w http.ResponseWriter, r *http.Request) {
 	slog.Info("addTodo called", "method", r.Method, "path", r.URL.Path)
 
-	var t Todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+	t, err := decodeTodo(w, r)
+	if err != nil {
 		slog.Error("Failed to decode request body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	slog.Info("Decoded todo", "task", t.Task)
-
-	err := ExecuteWithRobustness(func() error {
-		return DB.QueryRow("INSERT INTO todos (task) VALUES ($1) RETURNING id, completed", t.Task).Scan(&t.ID, &t.Completed)
-	})
+	slog.Info("Decoded todo", "task_length", len(t.Task))
+	if t.Tags, err = checkLabels(t.Priority, t.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priority, tags := t.Priority, t.Tags
 
+	owner := TodoOwner(r.Context())
+	t, err = s.Todos.Create(r.Context(), owner, t.Task, t.ListID)
 	if err != nil {
-		slog.Error("Failed to insert todo", "error", err, "task", t.Task)
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		writeTodoError(w, err)
 		return
 	}
-
-	slog.Info("Successfully added todo", "id", t.ID, "task", t.Task)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(t); err != nil {
-		slog.Error("Failed to encode todo", "error", err)
+	if priority != "" || len(tags) > 0 {
+		if _, err := s.setTodoLabels(r.Context(), owner, t.ID, priority, tags); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if priority != "" {
+			t.Priority = priority
+		}
+		t.Tags = tags
 	}
-	TodosAdded.Inc()
+
+	writeTodoResponse(w, r, http.StatusCreated, t)
 }
 
-func UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
-	var t Todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+func (s *Server) UpdateTodo(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := decodeTodo(w, r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("UPDATE todos SET completed = $1 WHERE id = $2", t.Completed, id)
-		return err
-	})
+	if t.Tags, err = checkLabels(t.Priority, t.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	owner := TodoOwner(r.Context())
+	if _, err := s.Todos.SetCompleted(r.Context(), owner, id, t.Completed); err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	if t.Priority != "" || t.Tags != nil {
+		if _, err := s.setTodoLabels(r.Context(), owner, id, t.Priority, t.Tags); err != nil {
+			writeDBError(w, err)
+			return
+		}
+	}
+	if isHTMX(r) {
+		// HTMX swaps the todo's item for the updated one.
+		t, err := s.Todos.Get(r.Context(), owner, id, true)
+		if err != nil {
+			writeTodoError(w, err)
+			return
 		}
+		writeTodoResponse(w, r, http.StatusOK, t)
 		return
 	}
-
 	w.WriteHeader(http.StatusOK)
-	TodosUpdated.Inc()
 }
 
-func DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
-	err := ExecuteWithRobustness(func() error {
-		_, err := DB.Exec("DELETE FROM todos WHERE id = $1", id)
-		return err
-	})
-
-	if err != nil {
-		if err == gobreaker.ErrOpenState {
-			http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+func (s *Server) DeleteTodo(w http.ResponseWriter, r *http.Request, id int) {
+	if _, err := s.Todos.Delete(r.Context(), TodoOwner(r.Context()), id); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if isHTMX(r) {
+		// HTMX does not swap 204 responses; an empty 200 removes the item.
+		w.WriteHeader(http.StatusOK)
 		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
-	TodosDeleted.Inc()
 }
 
-func AccessSecretVersion(name string) (string, error) {
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to create secretmanager client: %w", err)
-	}
-	defer client.Close()
-
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: name,
+// writeTodoError maps an error from the todo store to an HTTP response.
+func writeTodoError(w http.ResponseWriter, err error) {
+	var qe *quotaError
+	switch {
+	case errors.Is(err, errTaskCipher):
+		http.Error(w, "Encryption service unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, errTodoForbidden):
+		http.Error(w, "You cannot add todos to this list", http.StatusForbidden)
+	case errors.As(err, &qe):
+		writeQuotaError(w, qe, 0)
+	case errors.Is(err, errTodoBlocked):
+		http.Error(w, "This todo is blocked by open todos: complete them or remove the dependencies first", http.StatusConflict)
+	case errors.Is(err, errInvalidTask):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeDBError(w, err)
 	}
+}
 
-	result, err := client.AccessSecretVersion(ctx, req)
-	if err != nil {
-		return "", fmt.Errorf("failed to access secret version: %w", err)
+// writeDBError maps an error from ExecuteWithRobustness to an HTTP response:
+// 503 when the circuit breaker is open, 500 otherwise. Database errors can quote
+// queries and values, so clients only get a generic message; the (redacted) detail
+// goes to logs and error reporting.
+func writeDBError(w http.ResponseWriter, err error) {
+	if err == gobreaker.ErrOpenState {
+		http.Error(w, "Service Unavailable (Circuit Breaker Open)", http.StatusServiceUnavailable)
+		return
 	}
-
-	return string(result.Payload.Data), nil
-}
\ No newline at end of file
+	slog.Error("Database operation failed", "error", err)
+	setErrorDetail(w, Redaction.String(err.Error()))
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
@@ -0,0 +1,80 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Archiving hides a todo without deleting it, e.g. once it is done:
+//
+//	PUT    /todos/{id}/archive  archives the todo and its subtasks
+//	DELETE /todos/{id}/archive  unarchives them
+//
+// Archived todos are left out of the todo lists (unless ?include=archived), the
+// overdue and today views and the stats, but can still be read, changed and commented
+// on by id.
+
+// setTodoArchivedQuery archives ($1) or unarchives todo $2, with its subtasks, if $3
+// may change it, and says whether they could.
+var setTodoArchivedQuery = `WITH RECURSIVE target AS (
+	SELECT id FROM todos WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 3) + `
+), tree AS (
+	SELECT id FROM target
+	UNION ALL
+	SELECT c.id FROM todos c JOIN tree ON c.parent_id = tree.id
+), archived AS (
+	UPDATE todos SET archived = $1 WHERE id IN (SELECT id FROM tree)
+)
+SELECT EXISTS (SELECT 1 FROM target)`
+
+// setTodoArchived archives or unarchives todo id and its subtasks and reports whether
+// owner could change it.
+func (s *Server) setTodoArchived(ctx context.Context, owner string, id int, archived bool) (bool, error) {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "set_todo_archived", setTodoArchivedQuery, archived, id, owner).Scan(&found)
+		})
+	})
+	return found, err
+}
+
+// HandleTodoArchive serves PUT and DELETE /todos/{id}/archive and answers with the
+// todo.
+func (s *Server) HandleTodoArchive(w http.ResponseWriter, r *http.Request, id int) {
+	var archived bool
+	switch r.Method {
+	case http.MethodPut:
+		archived = true
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	found, err := s.setTodoArchived(ctx, owner, id, archived)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Set todo archived", "id", id, "archived", archived)
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
@@ -0,0 +1,151 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// WebAssets is the browser UI, bundled into the binary by main. ServeIndex and
+// ServeStatic answer 404 while it is nil.
+var WebAssets *Assets
+
+// Assets holds the files of static/ and the page templates/index.html in memory.
+// Each static file is served under its own name and under a name with a hash of its
+// content (app.3f9c2b1e.js). Pages link to the hashed names, which browsers may
+// cache for good: a deploy that changes a file changes its name too.
+type Assets struct {
+	files  map[string]*asset // by plain and hashed name
+	hashed map[string]string // plain name -> hashed name
+	index  *asset
+	ui     *template.Template // htmx.html and its fragments, see ServerRenderedUI
+}
+
+type asset struct {
+	content   []byte
+	etag      string
+	immutable bool // served under its hashed name
+}
+
+func newAsset(content []byte, immutable bool) *asset {
+	sum := sha256.Sum256(content)
+	return &asset{content: content, etag: `"` + hex.EncodeToString(sum[:8]) + `"`, immutable: immutable}
+}
+
+// NewAssets loads static/, renders templates/index.html and parses the templates of
+// the server-rendered UI from files. Pages link to static files with
+// {{asset "styles.css"}}, which gives the hashed path.
+func NewAssets(files fs.FS) (*Assets, error) {
+	a := &Assets{files: map[string]*asset{}, hashed: map[string]string{}}
+	err := fs.WalkDir(files, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		plain := strings.TrimPrefix(name, "static/")
+		sum := sha256.Sum256(content)
+		ext := path.Ext(plain)
+		hashed := strings.TrimSuffix(plain, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+		a.files[plain] = newAsset(content, false)
+		a.files[hashed] = newAsset(content, true)
+		a.hashed[plain] = hashed
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading static assets: %w", err)
+	}
+
+	tmpl, err := template.New("index.html").Funcs(template.FuncMap{"asset": a.Path}).ParseFS(files, "templates/index.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing index.html: %w", err)
+	}
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, nil); err != nil {
+		return nil, fmt.Errorf("rendering index.html: %w", err)
+	}
+	a.index = newAsset(page.Bytes(), false)
+
+	a.ui, err = template.New("htmx.html").Funcs(template.FuncMap{"asset": a.Path}).ParseFS(files, "templates/htmx.html", "templates/todos.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing htmx.html: %w", err)
+	}
+	return a, nil
+}
+
+// Path returns the URL of a static file under its hashed name, or under its plain
+// name if there is no such file.
+func (a *Assets) Path(name string) string {
+	if hashed, ok := a.hashed[name]; ok {
+		return "/static/" + hashed
+	}
+	return "/static/" + name
+}
+
+// assetPath is Path of WebAssets, for pages rendered outside index.html.
+func assetPath(name string) string {
+	if WebAssets == nil {
+		return "/static/" + name
+	}
+	return WebAssets.Path(name)
+}
+
+// serve writes a with its cache headers; http.ServeContent answers If-None-Match
+// and Range requests and sets the Content-Type from the name.
+func (a *asset) serve(w http.ResponseWriter, r *http.Request, name string) {
+	if a.immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// Revalidated on every use, so a deploy is picked up at once.
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", a.etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.content))
+}
+
+// ServeStatic serves /static/{name}.
+func ServeStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	var f *asset
+	if WebAssets != nil {
+		f = WebAssets.files[name]
+	}
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	f.serve(w, r, name)
+}
+
+// ServeIndex serves the UI page for every path no other route claims. The UI routes
+// on the client, so deep links without a file extension get the page; anything else
+// (a missing /favicon.ico, say) is a plain 404.
+func (s *Server) ServeIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if WebAssets == nil || path.Ext(r.URL.Path) != "" {
+		http.NotFound(w, r)
+		return
+	}
+	if ServerRenderedUI {
+		s.serveRenderedUI(WebAssets, w, r)
+		return
+	}
+	EnsureCSRFCookie(w, r)
+	WebAssets.index.serve(w, r, "index.html")
+}
@@ -0,0 +1,565 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// Files are attached to todos without passing through the service: it hands out a
+// signed URL, the client uploads to the bucket directly and then asks for the upload
+// to be checked.
+//
+//	POST   /todos/{id}/attachments  {"name": "scan.pdf", "content_type": "application/pdf", "size": 48213}
+//	       answers with upload_url; PUT the file there with upload_headers
+//	POST   /todos/{id}/attachments/{attachment}/complete  checks the upload, making it ready
+//	GET    /todos/{id}/attachments  ready attachments, each with a download_url
+//	GET    /todos/{id}/attachments/{attachment}
+//	DELETE /todos/{id}/attachments/{attachment}
+//
+// Adding and deleting attachments needs the same access as changing the todo. The
+// objects of deleted attachments, and of uploads never completed, are deleted from the
+// bucket by CleanUpAttachments.
+
+// AttachmentStore is the bucket attachments are kept in.
+type AttachmentStore interface {
+	// SignURL returns a URL that allows req until req.TTL has passed.
+	SignURL(ctx context.Context, req SignedRequest) (string, error)
+	// Stat returns the size and content type of object, or ErrObjectNotFound.
+	Stat(ctx context.Context, object string) (ObjectInfo, error)
+	// Delete deletes object; one that does not exist is not an error.
+	Delete(ctx context.Context, object string) error
+}
+
+// SignedRequest is a request on an object that a signed URL allows.
+type SignedRequest struct {
+	Method  string
+	Object  string
+	Headers map[string]string // the request must carry these
+	Query   url.Values        // e.g. response-content-disposition
+	TTL     time.Duration
+}
+
+// ObjectInfo is what the store says about an uploaded object.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+}
+
+// ErrObjectNotFound is returned by AttachmentStore.Stat for an object that does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Attachment settings (attachments.*). A nil Attachments disables attachments.
+var (
+	Attachments            AttachmentStore
+	AttachmentMaxBytes     int64 = 25 << 20
+	AttachmentContentTypes       = []string{"image/*", "application/pdf", "text/plain", "text/csv"}
+	AttachmentURLTTL             = 15 * time.Minute
+)
+
+const (
+	maxAttachmentName = 255
+	// abandonedUploadAge is how long an upload URL can go unused before the
+	// attachment is given up on.
+	abandonedUploadAge     = 24 * time.Hour
+	attachmentCleanupBatch = 100
+)
+
+// Attachment is a file attached to a todo.
+type Attachment struct {
+	ID            int64             `json:"id"`
+	TodoID        int               `json:"todo_id"`
+	Name          string            `json:"name"`
+	ContentType   string            `json:"content_type"`
+	Size          int64             `json:"size"`
+	Status        string            `json:"status"` // pending until the upload is completed, then ready
+	Uploader      string            `json:"uploader"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UploadURL     string            `json:"upload_url,omitempty"`     // pending: PUT the file here
+	UploadHeaders map[string]string `json:"upload_headers,omitempty"` // with these headers
+	DownloadURL   string            `json:"download_url,omitempty"`   // ready
+
+	object   string
+	writable bool // by the caller
+}
+
+// allowedContentType reports whether the media type ct matches AttachmentContentTypes,
+// and returns it without parameters.
+func allowedContentType(ct string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", false
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, allowed := range AttachmentContentTypes {
+		if allowed == mediaType || allowed == major+"/*" {
+			return mediaType, true
+		}
+	}
+	return mediaType, false
+}
+
+func validateAttachmentName(name string) error {
+	if name == "" || len(name) > maxAttachmentName {
+		return fmt.Errorf("name must be 1 to %d bytes", maxAttachmentName)
+	}
+	if strings.ContainsFunc(name, func(r rune) bool { return unicode.IsControl(r) || r == '/' || r == '\\' }) {
+		return errors.New("name must not contain slashes or control characters")
+	}
+	return nil
+}
+
+var (
+	insertAttachmentQuery = `INSERT INTO todo_attachments (todo_id, uploader, object, name, content_type, size)
+SELECT id, $1, $3, $4, $5, $6 FROM todos WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 1) + `
+RETURNING id, created_at`
+	selectAttachmentColumns = `SELECT a.id, a.todo_id, a.name, a.content_type, a.size, a.status, a.uploader, a.created_at, a.object,
+	` + fmt.Sprintf(todoWritableBy, 1) + `
+FROM todo_attachments a JOIN todos ON todos.id = a.todo_id
+WHERE ` + todoVisibleTo
+)
+
+func scanAttachment(row interface{ Scan(...any) error }, a *Attachment) error {
+	return row.Scan(&a.ID, &a.TodoID, &a.Name, &a.ContentType, &a.Size, &a.Status, &a.Uploader, &a.CreatedAt, &a.object, &a.writable)
+}
+
+// HandleTodoAttachments serves GET and POST /todos/{id}/attachments.
+func (s *Server) HandleTodoAttachments(w http.ResponseWriter, r *http.Request, id int) {
+	if Attachments == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.listAttachments(w, r, id)
+	case http.MethodPost:
+		s.createAttachment(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTodoAttachment serves /todos/{id}/attachments/{attachment}, where rest is
+// what follows attachments/.
+func (s *Server) HandleTodoAttachment(w http.ResponseWriter, r *http.Request, id int, rest string) {
+	if Attachments == nil {
+		http.NotFound(w, r)
+		return
+	}
+	idPart, action, _ := strings.Cut(rest, "/")
+	attachmentID, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case action == "complete" && r.Method == http.MethodPost:
+		s.completeAttachment(w, r, id, attachmentID)
+	case action == "complete":
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		a, ok := s.loadAttachment(w, r, id, attachmentID)
+		if ok {
+			writeAttachment(w, r, http.StatusOK, a)
+		}
+	case r.Method == http.MethodDelete:
+		s.deleteAttachment(w, r, id, attachmentID)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) createAttachment(w http.ResponseWriter, r *http.Request, id int) {
+	var req struct {
+		Name        string `json:"name"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAttachmentName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Size < 1 || req.Size > AttachmentMaxBytes {
+		http.Error(w, fmt.Sprintf("size must be 1 to %d bytes", AttachmentMaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType, ok := allowedContentType(req.ContentType)
+	if !ok {
+		http.Error(w, fmt.Sprintf("content_type must be one of %s", strings.Join(AttachmentContentTypes, ", ")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	a := Attachment{
+		TodoID: id, Name: req.Name, ContentType: contentType, Size: req.Size, Status: "pending", Uploader: owner,
+		object: fmt.Sprintf("todos/%d/%s", id, s.IDs.NewID(16)),
+	}
+	storedName, err := s.encryptTask(ctx, req.Name)
+	if err != nil {
+		slog.Error("Failed to encrypt attachment name", "error", err)
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+	var found bool
+	var overQuota *quotaError
+	err = s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "insert_attachment", insertAttachmentQuery,
+				owner, id, a.object, storedName, a.ContentType, a.Size).Scan(&a.ID, &a.CreatedAt)
+		})
+		if overQuota = asQuotaError(err); overQuota != nil {
+			return nil
+		}
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if overQuota != nil {
+		writeQuotaError(w, overQuota, a.Size)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+
+	// GCS enforces the declared type and the size limit on the upload itself.
+	a.UploadHeaders = map[string]string{
+		"Content-Type":                a.ContentType,
+		"X-Goog-Content-Length-Range": fmt.Sprintf("0,%d", a.Size),
+	}
+	a.UploadURL, err = Attachments.SignURL(ctx, SignedRequest{Method: http.MethodPut, Object: a.object, Headers: a.UploadHeaders, TTL: AttachmentURLTTL})
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	slog.Info("Created attachment", "id", a.ID, "todo_id", id)
+	writeAttachment(w, r, http.StatusCreated, a)
+}
+
+// loadAttachment returns attachment attachmentID of todo id if the caller can see it,
+// answering the request if not.
+func (s *Server) loadAttachment(w http.ResponseWriter, r *http.Request, id int, attachmentID int64) (Attachment, bool) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var a Attachment
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		return scanAttachment(dbQueryRow(ctx, q, "get_attachment",
+			selectAttachmentColumns+` AND a.id = $3 AND a.todo_id = $2`, owner, id, attachmentID), &a)
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return a, false
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return a, false
+	}
+	if a.Name, err = s.decryptTask(ctx, a.Name); err != nil {
+		slog.Error("Failed to decrypt attachment name", "id", a.ID, "error", err)
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return a, false
+	}
+	return a, true
+}
+
+func (s *Server) listAttachments(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var found bool
+	var attachments []Attachment
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		var err error
+		if found, err = queries(q).TodoExists(ctx, store.TodoExistsParams{Owner: owner, ID: int64(id)}); err != nil || !found {
+			return err
+		}
+		rows, err := dbQuery(ctx, q, "list_attachments",
+			selectAttachmentColumns+` AND a.todo_id = $2 AND a.status = 'ready' ORDER BY a.id`, owner, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		attachments = []Attachment{} // Reset on retry
+		for rows.Next() {
+			var a Attachment
+			if err := scanAttachment(rows, &a); err != nil {
+				return err
+			}
+			attachments = append(attachments, a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	for i := range attachments {
+		if attachments[i].Name, err = s.decryptTask(ctx, attachments[i].Name); err != nil {
+			slog.Error("Failed to decrypt attachment name", "id", attachments[i].ID, "error", err)
+			writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+			return
+		}
+		if attachments[i].DownloadURL, err = signDownload(ctx, attachments[i]); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(attachments); err != nil {
+		slog.Error("Failed to encode attachments", "error", err)
+	}
+}
+
+// completeAttachment checks an upload against what was declared and makes the
+// attachment ready. Completing a ready attachment again is a no-op.
+func (s *Server) completeAttachment(w http.ResponseWriter, r *http.Request, id int, attachmentID int64) {
+	a, ok := s.loadAttachment(w, r, id, attachmentID)
+	if !ok {
+		return
+	}
+	if !a.writable {
+		http.Error(w, "You cannot change this todo", http.StatusForbidden)
+		return
+	}
+	if a.Status == "pending" {
+		ctx := r.Context()
+		info, err := Attachments.Stat(ctx, a.object)
+		if errors.Is(err, ErrObjectNotFound) {
+			http.Error(w, "The file has not been uploaded", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if ct, _ := allowedContentType(info.ContentType); ct != a.ContentType || info.Size > a.Size {
+			// Not what was declared: GCS should have refused it, so drop it.
+			if err := Attachments.Delete(ctx, a.object); err != nil {
+				slog.Warn("Failed to delete a mismatched upload", "id", a.ID, "error", err)
+			}
+			http.Error(w, "The uploaded file does not match the declared type and size", http.StatusUnprocessableEntity)
+			return
+		}
+		err = s.ExecuteWithRobustness(func() error {
+			_, err := dbExec(ctx, s.DB, "complete_attachment",
+				"UPDATE todo_attachments SET status = 'ready', size = $2 WHERE id = $1 AND status = 'pending'", a.ID, info.Size)
+			return err
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		a.Status, a.Size = "ready", info.Size
+		slog.Info("Completed attachment", "id", a.ID, "todo_id", id, "size", info.Size)
+	}
+	writeAttachment(w, r, http.StatusOK, a)
+}
+
+func (s *Server) deleteAttachment(w http.ResponseWriter, r *http.Request, id int, attachmentID int64) {
+	a, ok := s.loadAttachment(w, r, id, attachmentID)
+	if !ok {
+		return
+	}
+	if !a.writable {
+		http.Error(w, "You cannot change this todo", http.StatusForbidden)
+		return
+	}
+	// The object is deleted from the bucket by the cleanup (see attachment_orphans).
+	err := s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(r.Context(), s.DB, "delete_attachment", "DELETE FROM todo_attachments WHERE id = $1", a.ID)
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Deleted attachment", "id", a.ID, "todo_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// signDownload returns a download URL of a ready attachment that saves it under its
+// name.
+func signDownload(ctx context.Context, a Attachment) (string, error) {
+	if a.Status != "ready" {
+		return "", nil
+	}
+	disposition := "attachment; filename*=UTF-8''" + url.PathEscape(a.Name)
+	return Attachments.SignURL(ctx, SignedRequest{
+		Method: http.MethodGet,
+		Object: a.object,
+		Query:  url.Values{"response-content-disposition": {disposition}},
+		TTL:    AttachmentURLTTL,
+	})
+}
+
+func writeAttachment(w http.ResponseWriter, r *http.Request, status int, a Attachment) {
+	var err error
+	if a.DownloadURL, err = signDownload(r.Context(), a); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		slog.Error("Failed to encode attachment", "error", err)
+	}
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	slog.Error("Attachment storage failed", "error", err)
+	http.Error(w, "Attachment storage unavailable", http.StatusServiceUnavailable)
+}
+
+func init() {
+	registerJob("attachment_cleanup", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute, Timeout: 10 * time.Minute},
+		run:    (*Server).runAttachmentCleanup,
+		admin:  true,
+	})
+}
+
+func (s *Server) runAttachmentCleanup(ctx context.Context, job *Job) (any, error) {
+	if Attachments == nil {
+		return nil, permanentJobError(errors.New("attachments.bucket is not set"))
+	}
+	abandoned, deleted, err := s.CleanUpAttachments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"abandoned": abandoned, "deleted": deleted}, nil
+}
+
+// CleanUpAttachments gives up on uploads not completed within abandonedUploadAge and
+// deletes the objects of attachments that are gone from the bucket. It returns how
+// many attachments it gave up on and how many objects it deleted. An object is only
+// forgotten once it is deleted, so a failure leaves it for the next run.
+func (s *Server) CleanUpAttachments(ctx context.Context) (abandoned, deleted int, err error) {
+	err = s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(ctx, s.DB, "abandon_attachments",
+			"DELETE FROM todo_attachments WHERE status = 'pending' AND created_at < $1", s.Clock.Now().Add(-abandonedUploadAge))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		abandoned = int(n)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		var ids []int64
+		var objects []string
+		err := s.ExecuteWithRobustness(func() error {
+			rows, err := dbQuery(ctx, s.DB, "list_attachment_orphans",
+				"SELECT id, object FROM attachment_orphans ORDER BY id LIMIT $1", attachmentCleanupBatch)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			ids, objects = nil, nil // Reset on retry
+			for rows.Next() {
+				var id int64
+				var object string
+				if err := rows.Scan(&id, &object); err != nil {
+					return err
+				}
+				ids, objects = append(ids, id), append(objects, object)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return abandoned, deleted, err
+		}
+		var deleteErr error
+		for i, object := range objects {
+			if deleteErr = Attachments.Delete(ctx, object); deleteErr != nil {
+				deleteErr = fmt.Errorf("failed to delete %s: %w", object, deleteErr)
+				ids = ids[:i]
+				break
+			}
+		}
+		if len(ids) > 0 {
+			err = s.ExecuteWithRobustness(func() error {
+				_, err := dbExec(ctx, s.DB, "forget_attachment_orphans", "DELETE FROM attachment_orphans WHERE id = ANY($1)", pq.Array(ids))
+				return err
+			})
+			if err != nil {
+				return abandoned, deleted, err
+			}
+			deleted += len(ids)
+		}
+		if deleteErr != nil {
+			return abandoned, deleted, deleteErr
+		}
+		if len(ids) < attachmentCleanupBatch {
+			return abandoned, deleted, nil
+		}
+	}
+}
+
+// StartAttachmentJanitor runs CleanUpAttachments every interval until ctx is
+// cancelled.
+func (s *Server) StartAttachmentJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "attachment_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			abandoned, deleted, err := s.CleanUpAttachments(ctx)
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to clean up attachments", "error", err)
+				}
+				continue
+			}
+			if abandoned > 0 || deleted > 0 {
+				slog.Debug("Cleaned up attachments", "abandoned", abandoned, "deleted", deleted)
+			}
+		}
+	})
+}
@@ -0,0 +1,249 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Scopes granted to principals. Admin implies read and write.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string   // stable identity, e.g. "apikey:42", "user:<oidc sub>" or "spiffe:<trust domain>/<path>"
+	UserID  string   // end-user id, when the caller is a person (e.g. OIDC subject)
+	Email   string   // end-user email, when known
+	KeyID   string   // API key id, when authenticated by key
+	Scopes  []string // granted scopes
+	Method  string   // how the caller authenticated: "api_key", "bootstrap", "jwt", "google", "session", "mtls"
+	Tenant  string   // tenant of the request with tenancy enabled (see tenants.go); before that, the credentials' own
+}
+
+// HasScope reports whether the principal was granted scope (admin grants everything).
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the authenticated principal, if any.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// ErrInvalidCredentials is returned by authenticators for credentials that are
+// present but wrong (as opposed to the auth backend being unavailable).
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authentication modes (AUTH_MODE):
+//   - "disabled": credentials are optional and unauthenticated callers have full access
+//     to the todo API (the original behavior); /admin always requires the admin scope.
+//   - "optional": like disabled, but any presented credentials must be valid.
+//   - "required": every non-public endpoint requires valid credentials.
+var AuthMode = "disabled"
+
+var AuthFailures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Total number of rejected requests by reason",
+	},
+	[]string{"reason"}, // "missing", "invalid", "forbidden", "unavailable"
+)
+
+// APIKeyHeader carries API keys.
+const APIKeyHeader = "X-API-Key"
+
+// isPublicPath reports paths that never require authentication: probes, metrics,
+// build info, the API description, and the static UI shell.
+func isPublicPath(path string) bool {
+	switch {
+	case path == "/", path == "/healthz", path == "/readyz", path == "/metrics", path == "/version":
+		return true
+	case path == "/openapi.json", path == "/docs":
+		return true
+	case path == "/auth/logout": // must work with an expired session
+		return true
+	case path == "/auth/google", path == "/auth/google/callback":
+		return true
+	case strings.HasPrefix(path, "/static/"):
+		return true
+	case isExportDownload(path): // authorized by its URL signature
+		return true
+	case path == "/integrations/slack/command": // authorized by its Slack signature
+		return true
+	case isCalendarPath(path): // authorized by the feed token in the URL
+		return true
+	case path == "/internal/jobs/run": // authorized by its job signature
+		return true
+	}
+	return false
+}
+
+// requiredScope maps a request to the scope it needs.
+func requiredScope(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return ScopeAdmin
+	}
+	if (r.URL.Path == "/exports" || r.URL.Path == "/me/export") && r.Method == http.MethodPost {
+		return ScopeRead // starting an export only reads todos
+	}
+	if r.URL.Path == "/graphql" || r.URL.Path == "/mcp" {
+		return ScopeRead // mutations and write tools check for the write scope themselves
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	default:
+		return ScopeWrite
+	}
+}
+
+// authenticate resolves the credentials on r, returning (nil, nil) when none are present.
+// With tenancy enabled, the principal is bound to the request's tenant.
+func (s *Server) authenticate(r *http.Request) (*Principal, error) {
+	p, err := s.authenticateCredentials(r)
+	if err != nil || !Tenancy.Enabled {
+		return p, err
+	}
+	return s.bindTenant(r, p)
+}
+
+func (s *Server) authenticateCredentials(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return s.APIKeys.Validate(r.Context(), key)
+	}
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		token, ok := strings.CutPrefix(authz, "Bearer ")
+		if !ok || OIDC == nil {
+			return nil, ErrInvalidCredentials
+		}
+		claims, err := OIDC.Verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			return nil, err
+		}
+		// End users get the todo API; administration stays with API keys.
+		return &Principal{
+			Subject: "user:" + claims.Subject,
+			UserID:  claims.Subject,
+			Email:   claims.Email,
+			Scopes:  []string{ScopeRead, ScopeWrite},
+			Method:  "jwt",
+			Tenant:  claims.Tenant,
+		}, nil
+	}
+	if p, err := mtlsPrincipal(r); p != nil || err != nil {
+		return p, err
+	}
+	if c, err := r.Cookie(SessionCookieName); err == nil && c.Value != "" {
+		return s.sessionPrincipal(r.Context(), c.Value)
+	}
+	return nil, nil
+}
+
+// authorizeRequest authenticates r and checks scope like AuthMiddleware, for transports
+// that report failures their own way (gRPC, GraphQL over WebSocket). It returns the
+// principal, or nil for a caller allowed in anonymously; on failure, the AuthFailures
+// reason: "invalid", "unavailable", "missing" or "forbidden".
+func (s *Server) authorizeRequest(r *http.Request, scope string) (*Principal, string, error) {
+	p, err := s.authenticate(r)
+	switch {
+	case errors.Is(err, ErrTenantDenied):
+		AuthFailures.WithLabelValues("forbidden").Inc()
+		return nil, "forbidden", err
+	case errors.Is(err, ErrInvalidCredentials):
+		AuthFailures.WithLabelValues("invalid").Inc()
+		return nil, "invalid", err
+	case err != nil:
+		AuthFailures.WithLabelValues("unavailable").Inc()
+		return nil, "unavailable", err
+	}
+	if p == nil {
+		if AuthMode == "required" || scope == ScopeAdmin {
+			AuthFailures.WithLabelValues("missing").Inc()
+			return nil, "missing", errors.New("credentials required")
+		}
+		return nil, "", nil
+	}
+	if !p.HasScope(scope) {
+		AuthFailures.WithLabelValues("forbidden").Inc()
+		return nil, "forbidden", errors.New("missing scope " + scope)
+	}
+	return p, "", nil
+}
+
+// AuthMiddleware authenticates the request and enforces per-scope authorization.
+func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/graphql" && websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r) // authenticated by connection_init (serveGraphQLWS)
+			return
+		}
+
+		p, err := s.authenticate(r)
+		switch {
+		case errors.Is(err, ErrTenantDenied):
+			AuthFailures.WithLabelValues("forbidden").Inc()
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrInvalidCredentials):
+			AuthFailures.WithLabelValues("invalid").Inc()
+			slog.Warn("Rejected invalid credentials", "path", r.URL.Path, "request_id", RequestIDFromContext(r.Context()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case err != nil:
+			AuthFailures.WithLabelValues("unavailable").Inc()
+			slog.Error("Authentication backend unavailable", "error", err)
+			http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		scope := requiredScope(r)
+		if p == nil {
+			if AuthMode == "required" || scope == ScopeAdmin {
+				AuthFailures.WithLabelValues("missing").Inc()
+				w.Header().Set("WWW-Authenticate", `Bearer, ApiKey header="`+APIKeyHeader+`"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !p.HasScope(scope) {
+			AuthFailures.WithLabelValues("forbidden").Inc()
+			http.Error(w, "Forbidden: missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
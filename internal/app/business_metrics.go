@@ -0,0 +1,131 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Domain metrics for product dashboards.
+// Counters are updated incrementally on every write; per-minute rates are derived
+// in PromQL (e.g. rate(todos_completed_total[1m]) * 60). The open-todo gauge is
+// also adjusted on writes, and periodically reconciled against the database so that
+// drift (other replicas, manual SQL, restarts) never accumulates.
+var (
+	TodosCompleted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todos_completed_total",
+			Help: "Total number of todos transitioned to completed",
+		},
+	)
+	TodosOpen = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "todos_open",
+			Help: "Current number of open (not completed) todos",
+		},
+	)
+	TodoTimeToCompletion = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "todo_time_to_completion_seconds",
+			Help: "Time between a todo being created and being completed",
+			// 1 minute up to ~4 weeks
+			Buckets: prometheus.ExponentialBuckets(60, 4, 9),
+		},
+	)
+	TodoMedianTimeToCompletion = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "todos_median_time_to_completion_seconds",
+			Help: "Median time-to-completion of todos completed in the last 7 days (from reconciliation)",
+		},
+	)
+	BusinessMetricsReconciledAt = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "todos_metrics_reconciled_timestamp_seconds",
+			Help: "Unix time of the last successful business metrics reconciliation",
+		},
+	)
+)
+
+// reconcileQuery computes the authoritative values for the gauges.
+const reconcileQuery = `SELECT
+	COUNT(*) FILTER (WHERE NOT completed),
+	COALESCE(
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM completed_at - created_at))
+			FILTER (WHERE completed AND completed_at > now() - interval '7 days'),
+		0)
+FROM todos`
+
+// recordTodoAdded updates business metrics after a successful insert.
+// New todos are always created open.
+func recordTodoAdded() {
+	TodosAdded.Inc()
+	TodosOpen.Inc()
+}
+
+// recordTodoUpdated updates business metrics after a successful update.
+// wasCompleted is the state before the update; secondsOpen is the age of the todo
+// at completion time and is only meaningful when the todo transitioned to completed.
+func recordTodoUpdated(wasCompleted, completed bool, secondsOpen float64) {
+	TodosUpdated.Inc()
+	switch {
+	case !wasCompleted && completed:
+		TodosCompleted.Inc()
+		TodosOpen.Dec()
+		TodoTimeToCompletion.Observe(secondsOpen)
+	case wasCompleted && !completed:
+		TodosOpen.Inc()
+	}
+}
+
+// recordTodoDeleted updates business metrics after a successful delete.
+func recordTodoDeleted(wasCompleted bool) {
+	TodosDeleted.Inc()
+	if !wasCompleted {
+		TodosOpen.Dec()
+	}
+}
+
+// ReconcileBusinessMetrics recomputes the gauges from the database.
+// It reads from the replica, since a few seconds of lag is irrelevant for dashboards.
+func (s *Server) ReconcileBusinessMetrics(ctx context.Context) error {
+	var open int64
+	var median float64
+	err := withTenant(ctx, s.DBRead, systemTenant, func(q dbtx) error {
+		return dbQueryRow(ctx, q, "reconcile_business_metrics", reconcileQuery).Scan(&open, &median)
+	})
+	if err != nil {
+		return err
+	}
+	TodosOpen.Set(float64(open))
+	TodoMedianTimeToCompletion.Set(median)
+	BusinessMetricsReconciledAt.SetToCurrentTime()
+	return nil
+}
+
+// StartBusinessMetricsReconciler reconciles immediately and then every interval
+// until ctx is cancelled.
+func (s *Server) StartBusinessMetricsReconciler(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "business_metrics_reconciler", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := s.ReconcileBusinessMetrics(ctx)
+			w.Checkpoint(err)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to reconcile business metrics", "error", err)
+			}
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
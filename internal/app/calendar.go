@@ -0,0 +1,531 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var CalendarRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "calendar_requests_total",
+		Help: "Total number of calendar feed and CalDAV requests, by kind and result",
+	},
+	[]string{"kind", "result"}, // kind "ics", "caldav"; result "ok", "not_found", "error"
+)
+
+// Calendar settings, set from the config at startup.
+var (
+	CalDAVEnabled  = false
+	calendarProdID = "-//go-to-production//Todo App//EN"
+)
+
+// CalendarFeed is a user's secret calendar URL. The paths hold a bearer token, so they
+// are only returned when the feed is created.
+type CalendarFeed struct {
+	Enabled    bool       `json:"enabled"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	FeedPath   string     `json:"feed_path,omitempty"`
+	CalDAVPath string     `json:"caldav_path,omitempty"`
+}
+
+// calendarTodo is a todo as it appears in the calendar.
+type calendarTodo struct {
+	Todo
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+}
+
+// generateCalendarToken returns a new random token of the form "tdc_<43 url-safe chars>".
+func generateCalendarToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "tdc_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HandleCalendarFeed manages the caller's calendar URL:
+//
+//	GET    /me/calendar  whether a feed exists
+//	POST   /me/calendar  create it, or replace it so the old URL stops working
+//	DELETE /me/calendar  turn it off
+func (s *Server) HandleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	owner := TodoOwner(r.Context())
+	if owner == anonymousOwner {
+		http.Error(w, "Sign in to use a calendar feed", http.StatusUnauthorized)
+		return
+	}
+	var feed CalendarFeed
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		err := s.ExecuteWithRobustness(func() error {
+			err := dbQueryRow(r.Context(), s.DBRead, "get_calendar_feed", "SELECT created_at FROM calendar_feeds WHERE subject = $1", owner).Scan(&feed.CreatedAt)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		feed.Enabled = feed.CreatedAt != nil
+	case http.MethodPost:
+		token, err := generateCalendarToken()
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		err = s.ExecuteWithRobustness(func() error {
+			return dbQueryRow(r.Context(), s.DB, "put_calendar_feed",
+				`INSERT INTO calendar_feeds (subject, token_hash) VALUES ($1, $2)
+				ON CONFLICT (subject) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = now()
+				RETURNING created_at`, owner, hashAPIKey(token)).Scan(&feed.CreatedAt)
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		feed.Enabled = true
+		feed.FeedPath = "/calendar/" + token + ".ics"
+		if CalDAVEnabled {
+			feed.CalDAVPath = "/caldav/" + token + "/"
+		}
+		status = http.StatusCreated
+		slog.Info("Created calendar feed", "owner", owner)
+	case http.MethodDelete:
+		err := s.ExecuteWithRobustness(func() error {
+			_, err := dbExec(r.Context(), s.DB, "delete_calendar_feed", "DELETE FROM calendar_feeds WHERE subject = $1", owner)
+			return err
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		slog.Info("Deleted calendar feed", "owner", owner)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(feed); err != nil {
+		slog.Error("Failed to encode calendar feed", "error", err)
+	}
+}
+
+// isCalendarPath reports whether path is a calendar feed or CalDAV URL, which is
+// authorized by the token in it instead of credentials.
+func isCalendarPath(path string) bool {
+	return strings.HasPrefix(path, "/calendar/tdc_") || strings.HasPrefix(path, "/caldav/tdc_")
+}
+
+// calendarOwner returns the subject whose feed token is token, or "" if none is.
+func (s *Server) calendarOwner(r *http.Request, token string) (string, error) {
+	if !strings.HasPrefix(token, "tdc_") {
+		return "", nil
+	}
+	var owner string
+	err := s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(r.Context(), s.DBRead, "calendar_owner", "SELECT subject FROM calendar_feeds WHERE token_hash = $1", hashAPIKey(token)).Scan(&owner)
+		if err == sql.ErrNoRows {
+			owner = ""
+			return nil
+		}
+		return err
+	})
+	return owner, err
+}
+
+const calendarTodosQuery = `SELECT id, task, completed, list_id, due_at, created_at, completed_at FROM todos
+WHERE (list_id IS NULL AND user_id = $1)
+	OR list_id IN (SELECT list_id FROM list_members WHERE user_id = $1)
+ORDER BY id`
+
+// calendarTodos returns the todos owner can see, with their timestamps.
+func (s *Server) calendarTodos(r *http.Request, owner string) ([]calendarTodo, error) {
+	ctx := r.Context()
+	var todos []calendarTodo
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "calendar_todos", calendarTodosQuery, owner)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		todos = todos[:0] // Reset on retry
+		for rows.Next() {
+			var t calendarTodo
+			if err := rows.Scan(&t.ID, &t.Task, &t.Completed, &t.ListID, &t.DueAt, &t.CreatedAt, &t.CompletedAt); err != nil {
+				return err
+			}
+			todos = append(todos, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range todos {
+		if todos[i].Task, err = s.decryptTask(ctx, todos[i].Task); err != nil {
+			slog.Error("Failed to decrypt task", "id", todos[i].ID, "error", err)
+			return nil, fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+	}
+	return todos, nil
+}
+
+// HandleCalendar serves GET /calendar/{token}.ics: the todos of the token's owner as
+// an iCalendar feed. Todos are VTODOs, for task apps such as Apple Reminders; with
+// ?events=true open todos with a due date are instead VEVENTs at their due time, for
+// calendar apps such as Google Calendar that ignore VTODOs.
+func (s *Server) HandleCalendar(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ok {
+		token = ""
+	}
+	owner, err := s.calendarOwner(r, token)
+	if err != nil {
+		CalendarRequests.WithLabelValues("ics", "error").Inc()
+		writeDBError(w, err)
+		return
+	}
+	if owner == "" {
+		CalendarRequests.WithLabelValues("ics", "not_found").Inc()
+		http.NotFound(w, r)
+		return
+	}
+	todos, err := s.calendarTodos(r, owner)
+	if err != nil {
+		CalendarRequests.WithLabelValues("ics", "error").Inc()
+		writeTodoError(w, err)
+		return
+	}
+	events := r.URL.Query().Get("events") == "true"
+	var b strings.Builder
+	writeICSHeader(&b, "Todos")
+	for _, t := range todos {
+		if events {
+			if !t.Completed && t.DueAt != nil {
+				writeVEVENT(&b, t)
+			}
+			continue
+		}
+		writeVTODO(&b, t)
+	}
+	icsLine(&b, "END:VCALENDAR")
+	CalendarRequests.WithLabelValues("ics", "ok").Inc()
+	// The URL is a bearer credential; keep it and the feed out of shared caches.
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func writeICSHeader(b *strings.Builder, name string) {
+	icsLine(b, "BEGIN:VCALENDAR")
+	icsLine(b, "VERSION:2.0")
+	icsLine(b, "PRODID:"+calendarProdID)
+	icsLine(b, "CALSCALE:GREGORIAN")
+	icsLine(b, "X-WR-CALNAME:"+icsEscape(name))
+	icsLine(b, "REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+}
+
+func writeVTODO(b *strings.Builder, t calendarTodo) {
+	icsLine(b, "BEGIN:VTODO")
+	icsLine(b, fmt.Sprintf("UID:todo-%d@go-to-production", t.ID))
+	icsLine(b, "DTSTAMP:"+icsTime(t.CreatedAt))
+	icsLine(b, "CREATED:"+icsTime(t.CreatedAt))
+	icsLine(b, "SUMMARY:"+icsEscape(t.Task))
+	if t.DueAt != nil {
+		icsLine(b, "DUE:"+icsTime(*t.DueAt))
+	}
+	if t.Completed {
+		icsLine(b, "STATUS:COMPLETED")
+		if t.CompletedAt != nil {
+			icsLine(b, "COMPLETED:"+icsTime(*t.CompletedAt))
+		}
+	} else {
+		icsLine(b, "STATUS:NEEDS-ACTION")
+	}
+	icsLine(b, "END:VTODO")
+}
+
+func writeVEVENT(b *strings.Builder, t calendarTodo) {
+	icsLine(b, "BEGIN:VEVENT")
+	icsLine(b, fmt.Sprintf("UID:todo-%d@go-to-production", t.ID))
+	icsLine(b, "DTSTAMP:"+icsTime(t.CreatedAt))
+	icsLine(b, "SUMMARY:"+icsEscape(t.Task))
+	icsLine(b, "DTSTART:"+icsTime(*t.DueAt))
+	icsLine(b, "DURATION:PT30M")
+	icsLine(b, "TRANSP:TRANSPARENT")
+	icsLine(b, "END:VEVENT")
+}
+
+func icsTime(t time.Time) string { return t.UTC().Format("20060102T150405Z") }
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// icsEscape escapes s for a TEXT value (RFC 5545 3.3.11).
+func icsEscape(s string) string { return icsEscaper.Replace(s) }
+
+// icsLine writes a content line, folded at 75 octets without splitting a UTF-8 sequence.
+func icsLine(b *strings.Builder, line string) {
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// HandleCalDAV serves a read-only CalDAV calendar at /caldav/{token}/, with one
+// resource per todo at /caldav/{token}/{id}.ics. It answers what clients need to
+// subscribe: OPTIONS, PROPFIND on the calendar and its resources, calendar-query and
+// calendar-multiget REPORTs, and GET. Changes made in the client are rejected.
+func (s *Server) HandleCalDAV(w http.ResponseWriter, r *http.Request) {
+	if !CalDAVEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	token, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/caldav/"), "/")
+	owner, err := s.calendarOwner(r, token)
+	if err != nil {
+		CalendarRequests.WithLabelValues("caldav", "error").Inc()
+		writeDBError(w, err)
+		return
+	}
+	if owner == "" {
+		CalendarRequests.WithLabelValues("caldav", "not_found").Inc()
+		http.NotFound(w, r)
+		return
+	}
+	base := "/caldav/" + token + "/"
+	w.Header().Set("DAV", "1, calendar-access")
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND, REPORT")
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet, http.MethodHead, "PROPFIND", "REPORT":
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND, REPORT")
+		http.Error(w, "This calendar is read-only", http.StatusForbidden)
+		return
+	}
+
+	todos, err := s.calendarTodos(r, owner)
+	if err != nil {
+		CalendarRequests.WithLabelValues("caldav", "error").Inc()
+		writeTodoError(w, err)
+		return
+	}
+	items := make(map[string]calendarTodo, len(todos))
+	for _, t := range todos {
+		items[fmt.Sprintf("%s%d.ics", base, t.ID)] = t
+	}
+	CalendarRequests.WithLabelValues("caldav", "ok").Inc()
+
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		t, ok := items[base+resource]
+		if resource == "" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body := caldavObject(t)
+		w.Header().Set("ETag", caldavETag(body))
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write([]byte(body))
+	case r.Method == "PROPFIND":
+		var responses []davResponse
+		if resource == "" {
+			responses = append(responses, davResponse{Href: base, Props: davProps{
+				ResourceType:         &davResourceType{Collection: &struct{}{}, Calendar: &struct{}{}},
+				DisplayName:          "Todos",
+				CurrentUserPrincipal: &davHref{Href: base},
+				CalendarHomeSet:      &davHref{Href: base},
+				SupportedComponents:  &davComponents{Comp: []davComp{{Name: "VTODO"}}},
+				CTag:                 caldavCTag(todos),
+			}})
+			if r.Header.Get("Depth") != "1" {
+				break
+			}
+			for _, t := range todos {
+				responses = append(responses, caldavResource(fmt.Sprintf("%s%d.ics", base, t.ID), t, false))
+			}
+		} else if t, ok := items[base+resource]; ok {
+			responses = append(responses, caldavResource(base+resource, t, false))
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+		writeMultistatus(w, responses)
+	case r.Method == "REPORT":
+		// calendar-multiget names the resources it wants; calendar-query filters are not
+		// applied, as a client asking for VTODOs gets every todo either way.
+		var report struct {
+			XMLName xml.Name
+			Hrefs   []string `xml:"DAV: href"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, "Invalid REPORT body", http.StatusBadRequest)
+			return
+		}
+		var responses []davResponse
+		if report.XMLName.Local == "calendar-multiget" {
+			for _, href := range report.Hrefs {
+				if t, ok := items[href]; ok {
+					responses = append(responses, caldavResource(href, t, true))
+				} else {
+					responses = append(responses, davResponse{Href: href, Status: "HTTP/1.1 404 Not Found"})
+				}
+			}
+		} else {
+			for _, t := range todos {
+				responses = append(responses, caldavResource(fmt.Sprintf("%s%d.ics", base, t.ID), t, true))
+			}
+		}
+		writeMultistatus(w, responses)
+	}
+}
+
+// caldavObject is the calendar resource of one todo.
+func caldavObject(t calendarTodo) string {
+	var b strings.Builder
+	writeICSHeader(&b, "Todos")
+	writeVTODO(&b, t)
+	icsLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+func caldavETag(body string) string {
+	h := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(h[:8]) + `"`
+}
+
+// caldavCTag changes whenever any todo in the calendar does.
+func caldavCTag(todos []calendarTodo) string {
+	h := sha256.New()
+	for _, t := range todos {
+		h.Write([]byte(caldavObject(t)))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func caldavResource(href string, t calendarTodo, withData bool) davResponse {
+	body := caldavObject(t)
+	props := davProps{ETag: caldavETag(body), ContentType: "text/calendar; charset=utf-8; component=VTODO"}
+	if withData {
+		props.CalendarData = body
+	}
+	return davResponse{Href: href, Props: props}
+}
+
+// WebDAV multistatus responses (RFC 4918), with the CalDAV (RFC 4791) and
+// CalendarServer properties clients ask for.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"d:multistatus"`
+	DAV       string        `xml:"xmlns:d,attr"`
+	CalDAV    string        `xml:"xmlns:c,attr"`
+	CS        string        `xml:"xmlns:cs,attr"`
+	Responses []davResponse `xml:"d:response"`
+}
+
+type davResponse struct {
+	Href   string   `xml:"d:href"`
+	Props  davProps `xml:"d:propstat>d:prop"`
+	Status string   `xml:"d:propstat>d:status"`
+}
+
+type davProps struct {
+	ResourceType         *davResourceType `xml:"d:resourcetype,omitempty"`
+	DisplayName          string           `xml:"d:displayname,omitempty"`
+	CurrentUserPrincipal *davHref         `xml:"d:current-user-principal,omitempty"`
+	CalendarHomeSet      *davHref         `xml:"c:calendar-home-set,omitempty"`
+	SupportedComponents  *davComponents   `xml:"c:supported-calendar-component-set,omitempty"`
+	CTag                 string           `xml:"cs:getctag,omitempty"`
+	ETag                 string           `xml:"d:getetag,omitempty"`
+	ContentType          string           `xml:"d:getcontenttype,omitempty"`
+	CalendarData         string           `xml:"c:calendar-data,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"d:collection,omitempty"`
+	Calendar   *struct{} `xml:"c:calendar,omitempty"`
+}
+
+type davHref struct {
+	Href string `xml:"d:href"`
+}
+
+type davComponents struct {
+	Comp []davComp `xml:"c:comp"`
+}
+
+type davComp struct {
+	Name string `xml:"name,attr"`
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	for i := range responses {
+		if responses[i].Status == "" {
+			responses[i].Status = "HTTP/1.1 200 OK"
+		}
+	}
+	body, err := xml.Marshal(davMultistatus{
+		DAV: "DAV:", CalDAV: "urn:ietf:params:xml:ns:caldav", CS: "http://calendarserver.org/ns/",
+		Responses: responses,
+	})
+	if err != nil {
+		slog.Error("Failed to encode CalDAV response", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// calendarMetricsPath hides the token in calendar paths.
+func calendarMetricsPath(path string) string {
+	if strings.HasPrefix(path, "/calendar/") {
+		return "/calendar/:token"
+	}
+	if _, resource, _ := strings.Cut(strings.TrimPrefix(path, "/caldav/"), "/"); resource != "" {
+		return "/caldav/:token/:id"
+	}
+	return "/caldav/:token/"
+}
@@ -0,0 +1,61 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import "sync"
+
+// ChaosResilience is a Resilience for tests that fails attempts of database operations
+// by script, before they reach the database. The retries and the breaker of the
+// Resilience it wraps, normally a Server's Robustness, see the faults as they would see the
+// database's errors, so a test can assert what they do with, say, two failures and a
+// success:
+//
+//	chaos := app.NewChaosResilience(s.Robustness, errDown, errDown)
+//	s.Robustness = chaos
+//	err := s.ExecuteWithRobustness(op) // nil; op ran once, on the third attempt
+//
+// Attempt n, counted across every operation run through it, fails with the nth fault;
+// a nil fault, or an attempt after the last, runs the operation.
+type ChaosResilience struct {
+	inner Resilience
+
+	mu       sync.Mutex
+	faults   []error
+	attempts int
+}
+
+// NewChaosResilience returns a ChaosResilience failing the attempts of the operations
+// run through inner with faults, in order.
+func NewChaosResilience(inner Resilience, faults ...error) *ChaosResilience {
+	return &ChaosResilience{inner: inner, faults: faults}
+}
+
+func (c *ChaosResilience) Execute(op func() error) error {
+	return c.inner.Execute(func() error {
+		if err := c.next(); err != nil {
+			return err
+		}
+		return op()
+	})
+}
+
+// next counts an attempt and returns its fault.
+func (c *ChaosResilience) next() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	if c.attempts <= len(c.faults) {
+		return c.faults[c.attempts-1]
+	}
+	return nil
+}
+
+// Attempts returns how many attempts reached c, failed or not. Operations the breaker
+// rejected made none.
+func (c *ChaosResilience) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
@@ -0,0 +1,57 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// Clock tells the time the app goes by. It is the repository's clock, so a test can
+// hand the same one to a Server and a repository.Memory.
+type Clock = repository.Clock
+
+// IDGenerator makes the random identifiers that are not secrets: it returns n random
+// bytes, hex-encoded.
+type IDGenerator interface {
+	NewID(n int) string
+}
+
+// ServerOption configures a Server in NewServer.
+type ServerOption func(*Server)
+
+// WithClock makes the Server go by c instead of the system clock.
+func WithClock(c Clock) ServerOption {
+	return func(s *Server) { s.Clock = c }
+}
+
+// WithIDs makes the Server take its identifiers from ids instead of crypto/rand.
+func WithIDs(ids IDGenerator) ServerOption {
+	return func(s *Server) { s.IDs = ids }
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// orSystemClock returns c, or the system clock if c is nil, for the parts that are not
+// a Server's and have a Clock of their own.
+func orSystemClock(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+type randomIDs struct{}
+
+func (randomIDs) NewID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// A todo can be copied, to reuse its structure:
+//
+//	POST /todos/{id}:clone  {"list_id": 7, "subtasks": true, "tags": true}
+//
+// The copy is a new, open, top-level todo with the task and priority of the original,
+// on list_id: the original's list if left out, the caller's Inbox if null. With
+// subtasks, the whole subtree comes along; with tags, the tags do. Due dates,
+// reminders, recurrence, stars, comments, attachments and dependencies stay behind.
+// Cloning needs to see the todo and to be able to add todos to the list.
+
+// cloneTodoQuery copies todo $2, which $1 must see, with its subtasks if $5 and tags if
+// $6, onto the original's list if $3 or else list $4, which $1 must be able to add
+// todos to. The ids are drawn before the insert so the copies can point at their
+// copied parents. It says whether the todo and the list were found, and the new id.
+var cloneTodoQuery = `WITH RECURSIVE target AS (
+	SELECT CASE WHEN $3 THEN list_id ELSE $4::bigint END AS list_id
+	FROM todos WHERE id = $2 AND ` + todoVisibleTo + `
+), dest AS (
+	SELECT list_id FROM target
+	WHERE list_id IS NULL
+		OR EXISTS (SELECT 1 FROM list_members m JOIN todo_lists l ON l.id = m.list_id
+			WHERE m.list_id = target.list_id AND m.user_id = $1 AND m.role IN ('owner', 'editor') AND NOT l.archived)
+), tree AS (
+	SELECT $2::int AS id, NULL::int AS parent_id, 0 AS depth FROM dest
+	UNION ALL
+	SELECT c.id, c.parent_id, tree.depth + 1 FROM todos c JOIN tree ON c.parent_id = tree.id WHERE $5 AND tree.depth < $7
+), ids AS (
+	SELECT id AS old_id, parent_id AS old_parent_id, nextval(pg_get_serial_sequence('todos', 'id'))::int AS new_id FROM tree
+), copied AS (
+	INSERT INTO todos (id, task, user_id, list_id, priority, parent_id)
+	SELECT ids.new_id, t.task, $1, dest.list_id, t.priority, p.new_id
+	FROM ids JOIN todos t ON t.id = ids.old_id CROSS JOIN dest LEFT JOIN ids p ON p.old_id = ids.old_parent_id
+	RETURNING id
+), tagged AS (
+	INSERT INTO todo_tags (todo_id, tag_id)
+	SELECT ids.new_id, tt.tag_id FROM ids JOIN todo_tags tt ON tt.todo_id = ids.old_id WHERE $6
+)
+SELECT EXISTS (SELECT 1 FROM target), EXISTS (SELECT 1 FROM dest),
+	COALESCE((SELECT new_id FROM ids WHERE old_id = $2), 0), (SELECT count(*) FROM copied)`
+
+// cloneOptions are the body of POST /todos/{id}:clone.
+type cloneOptions struct {
+	ListID   json.RawMessage `json:"list_id"` // left out for the original's list, null for the Inbox
+	Subtasks bool            `json:"subtasks"`
+	Tags     bool            `json:"tags"`
+}
+
+// cloneTodo copies todo id as opts say and returns the id of the copy, or found false
+// if owner cannot see it. A list owner cannot add todos to is errTodoForbidden.
+func (s *Server) cloneTodo(ctx context.Context, owner string, id int, sameList bool, listID *int64, opts cloneOptions) (int, bool, error) {
+	var found, allowed bool
+	var overQuota *quotaError
+	var newID, copies int
+	err := s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "clone_todo", cloneTodoQuery,
+				owner, id, sameList, listID, opts.Subtasks, opts.Tags, MaxTodoDepth).Scan(&found, &allowed, &newID, &copies)
+		})
+		// As in createTodo, a full quota is an answer, not a database failure.
+		if overQuota = asQuotaError(err); overQuota != nil {
+			return nil
+		}
+		return err
+	})
+	switch {
+	case err != nil:
+		return 0, false, err
+	case overQuota != nil:
+		return 0, true, overQuota
+	case !found:
+		return 0, false, nil
+	case !allowed:
+		return 0, true, errTodoForbidden
+	}
+	for range copies {
+		recordTodoAdded()
+	}
+	slog.Info("Cloned todo", "id", id, "clone", newID, "todos", copies)
+	return newID, true, nil
+}
+
+// HandleTodoClone serves POST /todos/{id}:clone and answers with the copy and its
+// subtasks, nested as at /todos/{id}/subtree.
+func (s *Server) HandleTodoClone(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var opts cloneOptions
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sameList := len(opts.ListID) == 0
+	var listID *int64
+	if !sameList {
+		if err := json.Unmarshal(opts.ListID, &listID); err != nil {
+			http.Error(w, "list_id must be a list ID or null", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	newID, found, err := s.cloneTodo(ctx, owner, id, sameList, listID, opts)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	tree, err := s.getTodoSubtree(ctx, owner, newID, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(tree); err != nil {
+		slog.Error("Failed to encode cloned todo", "error", err)
+	}
+}
@@ -0,0 +1,217 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// Todos carry a discussion: comments in markdown, by anyone who can see the todo.
+//
+//	POST   /todos/{id}/comments  {"body": "Blocked on **the visa**"}
+//	GET    /todos/{id}/comments  oldest first; ?limit= (50) and ?after=<comment id> page on
+//	DELETE /todos/{id}/comments/{comment}
+//
+// The body is stored as written and rendered to sanitized HTML on the way out (see
+// renderMarkdown). Comments can be deleted by their author and by the owner of the
+// todo's list (or of the personal todo).
+
+const maxCommentLength = 10000
+
+// Comment is a comment on a todo.
+type Comment struct {
+	ID        int64     `json:"id"`
+	TodoID    int       `json:"todo_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"` // markdown, as written
+	HTML      string    `json:"html"` // Body rendered and sanitized
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HandleTodoComments serves GET and POST /todos/{id}/comments.
+func (s *Server) HandleTodoComments(w http.ResponseWriter, r *http.Request, id int) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listComments(w, r, id)
+	case http.MethodPost:
+		s.addComment(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) addComment(w http.ResponseWriter, r *http.Request, id int) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" || len(req.Body) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("body must be 1 to %d bytes", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	c := Comment{TodoID: id, Author: owner, Body: req.Body, HTML: renderMarkdown(req.Body)}
+	stored, err := s.encryptTask(ctx, req.Body)
+	if err != nil {
+		slog.Error("Failed to encrypt comment", "error", err)
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+	var found bool
+	err = s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			row, err := queries(q).InsertComment(ctx, store.InsertCommentParams{Owner: owner, Body: stored, TodoID: int64(id)})
+			c.ID, c.CreatedAt = int64(row.ID), row.CreatedAt
+			return err
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Added comment", "id", c.ID, "todo_id", id)
+	writeComments(w, http.StatusCreated, c)
+}
+
+// listComments answers with up to ?limit (default 50, at most 200) comments on todo
+// id, oldest first. ?after=<id> pages on from the last comment of the previous page.
+func (s *Server) listComments(w http.ResponseWriter, r *http.Request, id int) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid after comment ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var found bool
+	var comments []Comment
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		var err error
+		if found, err = queries(q).TodoExists(ctx, store.TodoExistsParams{Owner: owner, ID: int64(id)}); err != nil || !found {
+			return err
+		}
+		rows, err := queries(q).ListComments(ctx, store.ListCommentsParams{TodoID: int64(id), After: after, MaxComments: int32(limit)})
+		comments = make([]Comment, len(rows))
+		for i, row := range rows {
+			comments[i] = Comment{ID: int64(row.ID), TodoID: id, Author: row.Author, Body: row.Body, CreatedAt: row.CreatedAt}
+		}
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	if err := s.decryptComments(ctx, comments); err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeComments(w, http.StatusOK, comments)
+}
+
+// decryptComments decrypts and renders the bodies of comments in place.
+func (s *Server) decryptComments(ctx context.Context, comments []Comment) error {
+	for i := range comments {
+		var err error
+		if comments[i].Body, err = s.decryptTask(ctx, comments[i].Body); err != nil {
+			slog.Error("Failed to decrypt comment", "id", comments[i].ID, "error", err)
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+		comments[i].HTML = renderMarkdown(comments[i].Body)
+	}
+	return nil
+}
+
+// HandleTodoComment serves DELETE /todos/{id}/comments/{comment}.
+func (s *Server) HandleTodoComment(w http.ResponseWriter, r *http.Request, id int, comment string) {
+	commentID, err := strconv.ParseInt(comment, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var found, allowed bool
+	err = s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			var err error
+			allowed, err = queries(q).DeleteComment(ctx, store.DeleteCommentParams{Owner: owner, TodoID: int64(id), ID: commentID})
+			return err
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	switch {
+	case err != nil:
+		writeDBError(w, err)
+	case !found:
+		http.Error(w, "Comment not found", http.StatusNotFound)
+	case !allowed:
+		http.Error(w, "Only the author or the list owner can delete a comment", http.StatusForbidden)
+	default:
+		slog.Info("Deleted comment", "id", commentID, "todo_id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeComments(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode comments", "error", err)
+	}
+}
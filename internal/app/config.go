@@ -0,0 +1,134 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/stevemcghee/go-to-production/internal/config"
+)
+
+// The settings config.Validate cannot check by itself, since only this package can
+// parse them.
+func init() {
+	config.AddCheck(func(c *config.Config, fail func(path, format string, args ...any)) {
+		if c.Exports.SigningKeys != "" {
+			if _, err := ParseSigningKeys(c.Exports.SigningKeys); err != nil {
+				fail("exports.signing_keys", "%v", err)
+			}
+		}
+
+		if t := c.Events.PubSubTopic; t != "" {
+			if err := validatePubSubTopic(t); err != nil {
+				fail("events.pubsub_topic", "%v", err)
+			}
+		}
+		if len(c.Events.KafkaBrokers) > 0 && c.Events.KafkaTopic != "" {
+			if _, err := kafkaOptions(NewKafkaSinkConfig(c.Events)); err != nil {
+				fail("events", "%v", err)
+			}
+		}
+
+		for _, e := range c.Slack.Notify {
+			if !slices.Contains(SlackEvents, e) {
+				fail("slack.notify", "unknown event %q, want %s", e, strings.Join(SlackEvents, ", "))
+			}
+		}
+
+		if p := c.Notifications.EmailProvider; p != "" {
+			if !slices.Contains(EmailProviders, p) {
+				fail("notifications.email_provider", "unknown provider %q, want %s", p, strings.Join(EmailProviders, ", "))
+			} else if _, err := NewEmailSender(c.Notifications); err != nil {
+				fail("notifications", "%v", err)
+			}
+		}
+
+		if c.Jobs.Queue == "cloudtasks" {
+			if err := validateTasksQueue(c.Jobs.TasksQueue); err != nil {
+				fail("jobs.tasks_queue", "%v", err)
+			}
+		}
+
+		cron := func(path, spec string) {
+			if _, err := ParseCron(spec); spec != "off" && err != nil {
+				fail(path, "%v", err)
+			}
+		}
+		cron("scheduler.retention_purge", c.Scheduler.RetentionPurge)
+		cron("scheduler.usage_rollup", c.Scheduler.UsageRollup)
+		cron("scheduler.reminders", c.Scheduler.Reminders)
+	})
+}
+
+// NewHeartbeatConfig returns the heartbeat settings in the form StartHeartbeat takes.
+func NewHeartbeatConfig(h config.HeartbeatSettings) HeartbeatConfig {
+	return HeartbeatConfig{Interval: h.Interval, Window: h.Window, GrowthFactor: h.GrowthFactor, MinAbsolute: h.MinAbsolute}
+}
+
+// NewAbuseConfig returns the abuse thresholds in the form AbuseMiddleware uses.
+func NewAbuseConfig(a config.AbuseSettings) AbuseConfig {
+	return AbuseConfig{
+		AuthFailureLimit:  a.AuthFailureLimit,
+		AuthFailureWindow: a.AuthFailureWindow,
+		MalformedLimit:    a.MalformedLimit,
+		MalformedWindow:   a.MalformedWindow,
+		BanBase:           a.BanBase,
+		BanMax:            a.BanMax,
+		StrikeMemory:      a.StrikeMemory,
+	}
+}
+
+// NewSecretBackendConfig returns the settings for NewSecretAccessor.
+func NewSecretBackendConfig(s config.SecretSettings) SecretBackendConfig {
+	return SecretBackendConfig{
+		Backend:        s.Backend,
+		Dir:            s.Dir,
+		VaultAddr:      s.Vault.Addr,
+		VaultToken:     s.Vault.Token,
+		VaultTokenFile: s.Vault.TokenFile,
+		VaultNamespace: s.Vault.Namespace,
+		VaultMount:     s.Vault.Mount,
+		VaultPrefix:    s.Vault.Prefix,
+
+		BreakerFailures: s.BreakerFailures,
+		Fallback:        s.Fallback,
+		FallbackDir:     s.FallbackDir,
+	}
+}
+
+// NewKafkaSinkConfig returns the producer settings of the Kafka sink.
+func NewKafkaSinkConfig(e config.EventSettings) KafkaSinkConfig {
+	return KafkaSinkConfig{
+		Brokers:       e.KafkaBrokers,
+		Topic:         e.KafkaTopic,
+		ClientID:      e.KafkaClientID,
+		BatchMaxBytes: e.KafkaBatchMaxBytes,
+		Linger:        e.KafkaLinger,
+		Compression:   e.KafkaCompression,
+		Idempotent:    e.KafkaIdempotent,
+		Timeout:       e.KafkaTimeout,
+		TLS:           e.KafkaTLS,
+		SASLMechanism: e.KafkaSASLMechanism,
+		SASLUser:      e.KafkaSASLUser,
+		SASLPassword:  e.KafkaSASLPassword,
+	}
+}
+
+// WithSettings overrides the connection settings of the database secret with any set
+// in d.
+func (db DBConfig) WithSettings(d config.DatabaseSettings) DBConfig {
+	for _, o := range []struct {
+		dst *string
+		v   string
+	}{
+		{&db.DBHost, d.Host}, {&db.DBPort, d.Port}, {&db.DBReadHost, d.ReadHost}, {&db.DBReadPort, d.ReadPort}, {&db.DBName, d.Name},
+	} {
+		if o.v != "" {
+			*o.dst = o.v
+		}
+	}
+	return db
+}
@@ -0,0 +1,146 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stevemcghee/go-to-production/internal/config"
+)
+
+// CheckConfig goes one step further than Validate for -validate-config: it resolves
+// every secret cfg refers to, loads the TLS files and, with connectDB, opens a
+// connection to the primary and the read replica. Nothing is started or changed.
+// All problems are reported at once, each prefixed with the setting it concerns;
+// optional secrets that cannot be read (admin key, Google sign-in) are only logged.
+func CheckConfig(ctx context.Context, cfg *config.Config, connectDB bool) error {
+	var errs []error
+	fail := func(path string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+
+	if _, err := NewRedactor(cfg.Log.RedactKeys, cfg.Log.RedactPatterns); err != nil {
+		fail("log", err)
+	}
+	if s := cfg.Server; s.TLSCertFile != "" {
+		if _, err := NewServerTLSConfig(s.TLSCertFile, s.TLSKeyFile, s.MTLSClientCAFile); err != nil {
+			fail("server.tls_cert_file", err)
+		}
+		if s.MTLSClientCAFile != "" {
+			if _, err := NewMTLSAllowlist(s.MTLSAllowedIDs, s.MTLSScopes); err != nil {
+				fail("server.mtls_allowed_ids", err)
+			}
+		}
+	}
+	if cfg.ErrorReporting.Backend == "sentry" {
+		if err := checkSentryDSN(cfg.ErrorReporting.SentryDSN); err != nil {
+			fail("error_reporting.sentry_dsn", err)
+		}
+	}
+	if cfg.Abuse.Enabled && cfg.Abuse.RedisURL != "" {
+		if _, err := redis.ParseURL(cfg.Abuse.RedisURL); err != nil {
+			fail("abuse.redis_url", err)
+		}
+	}
+	if cfg.Cache.RedisURL != "" {
+		if _, err := redis.ParseURL(cfg.Cache.RedisURL); err != nil {
+			fail("cache.redis_url", err)
+		}
+	}
+
+	accessor, err := NewSecretAccessor(ctx, NewSecretBackendConfig(cfg.Secrets))
+	if err != nil {
+		fail("secrets.backend", err)
+		return errors.Join(errs...)
+	}
+	if c, ok := accessor.(io.Closer); ok {
+		defer c.Close()
+	}
+	secrets := NewSecretProvider(accessor, cfg.Secrets.CacheTTL)
+	secrets.Timeout = cfg.Secrets.FetchTimeout
+
+	var db DBConfig
+	if v, err := secrets.Get(ctx, cfg.Secrets.DatabaseSecret); err != nil {
+		fail("secrets.database_secret", err)
+	} else if err := json.Unmarshal([]byte(v), &db); err != nil {
+		fail("secrets.database_secret", fmt.Errorf("not a database config JSON object: %w", err))
+	} else {
+		db = db.WithSettings(cfg.Database)
+		var missing []string
+		for _, f := range []struct{ name, v string }{{"db_user", db.DBUser}, {"db_name", db.DBName}, {"db_host", db.DBHost}, {"db_port", db.DBPort}} {
+			if f.v == "" {
+				missing = append(missing, f.name)
+			}
+		}
+		if len(missing) > 0 {
+			fail("secrets.database_secret", fmt.Errorf("missing %s", strings.Join(missing, ", ")))
+		} else if connectDB {
+			if err := pingDatabase(ctx, db.dsn(db.DBHost, db.DBPort)); err != nil {
+				fail("database", fmt.Errorf("primary %s:%s: %w", db.DBHost, db.DBPort, err))
+			}
+			if db.DBReadHost != "" {
+				port := db.DBReadPort
+				if port == "" {
+					port = db.DBPort
+				}
+				if err := pingDatabase(ctx, db.dsn(db.DBReadHost, port)); err != nil {
+					fail("database", fmt.Errorf("read replica %s:%s: %w", db.DBReadHost, port, err))
+				}
+			}
+		}
+	}
+
+	if name := cfg.Exports.SigningKeysSecret; name != "" {
+		v, err := secrets.Get(ctx, name)
+		if err == nil {
+			_, err = ParseSigningKeys(v)
+		}
+		if err != nil {
+			fail("exports.signing_keys_secret", err)
+		}
+	}
+	if _, err := secrets.Get(ctx, cfg.Auth.AdminKeySecret); err != nil {
+		slog.Warn("Bootstrap admin key not available; admin endpoints will need a database API key", "secret", cfg.Auth.AdminKeySecret, "error", err)
+	}
+	if v, err := secrets.Get(ctx, cfg.Auth.GoogleOAuthSecret); err != nil {
+		slog.Warn("Google sign-in will be disabled", "secret", cfg.Auth.GoogleOAuthSecret, "error", err)
+	} else if _, _, err := parseGoogleClient(v); err != nil {
+		fail("auth.google_oauth_secret", err)
+	}
+	if key := cfg.Encryption.TaskKey; key != "" {
+		if _, err := NewKMSKeyWrapper(ctx, key); err != nil {
+			fail("encryption.task_key", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func pingDatabase(ctx context.Context, dsn string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	db := sql.OpenDB(newRotatingConnector(dsn))
+	defer db.Close()
+	return db.PingContext(ctx)
+}
+
+// checkSentryDSN parses dsn the way NewSentryReporter does, without starting a reporter.
+func checkSentryDSN(dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("want https://<public_key>@<host>/<project_id>")
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stevemcghee/go-to-production/internal/config"
+)
+
+var ConfigReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "Total number of configuration reloads",
+	},
+	[]string{"result"}, // "applied", "unchanged" or "invalid"
+)
+
+// ConfigInfo is 1 for the fingerprint of the configuration this replica is running with.
+// Replicas of one deployment should agree; count(count by (fingerprint) (config_info)) > 1
+// means some of them missed a reload or picked up a different file.
+var ConfigInfo = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "config_info",
+		Help: "Fingerprint of the running configuration (always 1)",
+	},
+	[]string{"fingerprint"},
+)
+
+var ConfigRestartPending = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "config_restart_pending",
+		Help: "1 when the loaded configuration has changes that only apply after a restart",
+	},
+)
+
+// LogLevel is the level of the default logger; main builds its handler with it.
+var LogLevel = new(slog.LevelVar)
+
+// runtimeMu guards the settings that ConfigReloader changes while requests are served:
+// Abuse.Config, ErrorSampleRate, the breaker thresholds and the feature flags.
+var (
+	runtimeMu           sync.RWMutex
+	breakerMinRequests  uint32 = 3
+	breakerFailureRatio        = 0.6
+	features            map[string]bool
+
+	configFingerprint     string
+	configRestartPending  bool
+	configFingerprintTime time.Time
+)
+
+// ApplyRuntimeConfig applies the reloadable settings of cfg to the running process.
+func ApplyRuntimeConfig(cfg *config.Config) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err == nil {
+		LogLevel.Set(level)
+	}
+
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	Abuse.Config = NewAbuseConfig(cfg.Abuse)
+	ErrorSampleRate = cfg.ErrorReporting.SampleRate
+	breakerMinRequests, breakerFailureRatio = cfg.Breaker.MinRequests, cfg.Breaker.FailureRatio
+	features = make(map[string]bool, len(cfg.Features))
+	for name, on := range cfg.Features {
+		features[name] = on
+	}
+	if fp := cfg.Fingerprint(); fp != configFingerprint {
+		configFingerprint, configFingerprintTime = fp, time.Now().UTC()
+		ConfigInfo.Reset()
+		ConfigInfo.WithLabelValues(fp).Set(1)
+	}
+}
+
+// ConfigStatus is the configuration part of GET /version.
+type ConfigStatus struct {
+	Fingerprint    string    `json:"fingerprint"`
+	Since          time.Time `json:"since"`           // when this replica switched to it
+	RestartPending bool      `json:"restart_pending"` // the file has changes only a restart applies
+}
+
+// GetConfigStatus reports the fingerprint of the running configuration.
+func GetConfigStatus() ConfigStatus {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return ConfigStatus{Fingerprint: configFingerprint, Since: configFingerprintTime, RestartPending: configRestartPending}
+}
+
+func setRestartPending(pending bool) {
+	runtimeMu.Lock()
+	configRestartPending = pending
+	runtimeMu.Unlock()
+	if pending {
+		ConfigRestartPending.Set(1)
+	} else {
+		ConfigRestartPending.Set(0)
+	}
+}
+
+// FeatureEnabled reports whether the feature flag name is switched on.
+func FeatureEnabled(name string) bool {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return features[name]
+}
+
+func abuseConfig() AbuseConfig {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return Abuse.Config
+}
+
+func errorSampleRate() float64 {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return ErrorSampleRate
+}
+
+func breakerThresholds() (uint32, float64) {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return breakerMinRequests, breakerFailureRatio
+}
+
+// ConfigReloader re-reads the configuration the process was started with (same flags
+// and environment, current file contents) and applies what changed and is safe to change.
+type ConfigReloader struct {
+	args      []string
+	lookupEnv func(string) (string, bool)
+
+	mu      sync.Mutex
+	current *config.Config
+}
+
+func NewConfigReloader(cfg *config.Config, args []string, lookupEnv func(string) (string, bool)) *ConfigReloader {
+	return &ConfigReloader{args: args, lookupEnv: lookupEnv, current: cfg}
+}
+
+// Reload loads and validates the configuration again. An invalid config is rejected
+// as a whole and the running one is kept. Every change is written to the audit log.
+func (r *ConfigReloader) Reload() ([]config.Change, error) {
+	next, err := config.Load(r.args, r.lookupEnv)
+	if err != nil {
+		ConfigReloads.WithLabelValues("invalid").Inc()
+		slog.Error("Configuration reload rejected, keeping the running configuration", "error", err)
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := r.current.Update(next)
+	// Settings that need a restart keep their old value, so the fingerprints differ.
+	setRestartPending(next.Fingerprint() != r.current.Fingerprint())
+	if len(changes) == 0 {
+		ConfigReloads.WithLabelValues("unchanged").Inc()
+		return nil, nil
+	}
+	ApplyRuntimeConfig(r.current)
+	ConfigReloads.WithLabelValues("applied").Inc()
+
+	for _, c := range changes {
+		if !c.Applied {
+			slog.Warn("Configuration change needs a restart to take effect", "setting", c.Path, "old", c.Old, "new", c.New)
+			continue
+		}
+		slog.Info("Configuration changed",
+			"audit", true,
+			"event", "config_reload",
+			"setting", c.Path,
+			"old", c.Old,
+			"new", c.New,
+			"file", r.current.File,
+		)
+	}
+	return changes, nil
+}
+
+// ServeHTTP serves GET /admin/config: the configuration this replica is running with,
+// secrets masked, and where each non-default setting came from.
+func (r *ConfigReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.Lock()
+	resp := map[string]any{
+		"profile":     r.current.Profile,
+		"file":        r.current.File,
+		"fingerprint": r.current.Fingerprint(),
+		"settings":    r.current.Effective(),
+		"sources":     r.current.Sources(),
+	}
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Watch reloads whenever the config file changes, until ctx is cancelled.
+// It watches the directory, so files that are replaced rather than written
+// (editors, Kubernetes ConfigMap volumes swapping their ..data symlink) are noticed too.
+func (r *ConfigReloader) Watch(ctx context.Context) error {
+	path := r.current.File
+	if path == "" {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		// Editors and kubelet produce bursts of events; reload once they settle.
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if name := filepath.Base(ev.Name); name == filepath.Base(path) || name == "..data" {
+					debounce = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Config file watch error", "error", err)
+			case <-debounce:
+				debounce = nil
+				r.Reload()
+			}
+		}
+	}()
+	return nil
+}
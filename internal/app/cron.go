@@ -0,0 +1,165 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSpec is a parsed cron expression: the five fields minute, hour, day of month,
+// month and day of week, each *, a value, a range (1-5) or a list of them (1,15), with
+// an optional step (*/15, 8-18/2). Months and weekdays may be named (JAN, MON); Sunday
+// is 0 or 7. As in cron, a day matches if either day field does when both are
+// restricted. @hourly, @daily (@midnight), @weekly, @monthly and @yearly (@annually)
+// stand for the usual expressions. Times are in UTC.
+type CronSpec struct {
+	minute, hour, dom, month, dow uint64 // bit n set if value n matches
+
+	domAny, dowAny bool // the field started with *, as in */2
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths   = []string{"", "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+// cronSearchYears bounds the search for the next run. The calendar repeats every 28
+// years, so a spec that matches at all, such as Feb 29, matches within it.
+const cronSearchYears = 30
+
+// ParseCron parses a cron expression such as "*/15 8-18 * * MON-FRI".
+func ParseCron(s string) (CronSpec, error) {
+	s = strings.TrimSpace(s)
+	if d, ok := cronDescriptors[strings.ToLower(s)]; ok {
+		s = d
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return CronSpec{}, fmt.Errorf("cron expression %q must have 5 fields: minute hour day-of-month month day-of-week", s)
+	}
+	var c CronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], "minute", 0, 59, nil); err != nil {
+		return CronSpec{}, err
+	}
+	if c.hour, err = parseCronField(fields[1], "hour", 0, 23, nil); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dom, err = parseCronField(fields[2], "day of month", 1, 31, nil); err != nil {
+		return CronSpec{}, err
+	}
+	if c.month, err = parseCronField(fields[3], "month", 1, 12, cronMonths); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dow, err = parseCronField(fields[4], "day of week", 0, 7, cronWeekdays); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if c.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return CronSpec{}, fmt.Errorf("cron expression %q never matches", s)
+	}
+	return c, nil
+}
+
+// parseCronField parses one field into a bit set of the values from lo to hi it
+// matches. names, if any, name the values from lo on.
+func parseCronField(field, name string, lo, hi int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("%s step %q must be a positive number", name, stepStr)
+			}
+		}
+		from, to := lo, hi
+		switch first, last, isRange := strings.Cut(expr, "-"); {
+		case expr == "*":
+		case isRange:
+			var err error
+			if from, err = cronValue(first, name, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if to, err = cronValue(last, name, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("%s range %q runs backwards", name, expr)
+			}
+		default:
+			var err error
+			if from, err = cronValue(expr, name, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if !hasStep {
+				to = from // 5/10 is 5-max/10, as in Vixie cron
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s, name string, lo, hi int, names []string) (int, error) {
+	if i := slices.Index(names, strings.ToUpper(s)); i >= 0 && s != "" {
+		return i, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s %q must be from %d to %d", name, s, lo, hi)
+	}
+	return n, nil
+}
+
+// Next returns the first time after t that c matches, to the minute, or the zero time
+// if there is none within cronSearchYears.
+func (c CronSpec) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c CronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
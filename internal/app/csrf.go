@@ -0,0 +1,129 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Double-submit-cookie CSRF protection for the browser UI. The index page sets a random
+// token in a SameSite=Strict cookie readable by app.js, which echoes it in a header on
+// every state-changing request. A cross-site page can make the browser send the cookie
+// but cannot read it, so it cannot produce the matching header.
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeader     = "X-CSRF-Token"
+)
+
+var CSRFRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "csrf_rejections_total",
+		Help: "Total number of state-changing requests rejected by CSRF protection",
+	},
+	[]string{"reason"}, // "cross_origin", "missing_token", "token_mismatch"
+)
+
+// EnsureCSRFCookie issues the CSRF cookie if the browser does not have one yet, and
+// returns the token, for pages that send it themselves.
+func EnsureCSRFCookie(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(CSRFCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := newToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   isHTTPS(r),
+		HttpOnly: false, // app.js must read it
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// newToken returns 16 random bytes, hex-encoded, for tokens that must not be guessed:
+// unlike a Server's IDs, they always come from crypto/rand.
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// CSRFMiddleware rejects state-changing requests that may have been forged by another site.
+//
+// Exempt: safe methods, and clients authenticating with an explicit X-API-Key or
+// Authorization header, since browsers never attach those automatically.
+// Rejected: requests the browser marks as cross-origin (Sec-Fetch-Site, Origin).
+// Requests carrying cookies must echo the CSRF cookie in X-CSRF-Token; cookie-less
+// requests carry no ambient credentials and are left to authentication.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get(APIKeyHeader) != "" || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if crossOrigin(r) {
+			rejectCSRF(w, "cross_origin")
+			return
+		}
+		if len(r.Cookies()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(CSRFCookieName)
+		token := r.Header.Get(CSRFHeader)
+		if err != nil || cookie.Value == "" || token == "" {
+			rejectCSRF(w, "missing_token")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+			rejectCSRF(w, "token_mismatch")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func rejectCSRF(w http.ResponseWriter, reason string) {
+	CSRFRejections.WithLabelValues(reason).Inc()
+	http.Error(w, "Forbidden (CSRF check failed)", http.StatusForbidden)
+}
+
+// crossOrigin reports whether the browser says the request came from another site.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "cross-site", "same-site":
+		return true
+	case "same-origin", "none":
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || !strings.EqualFold(u.Host, r.Host)
+	}
+	return false
+}
+
+// isHTTPS reports whether the client connected over TLS, directly or via the load balancer.
+func isHTTPS(r *http.Request) bool {
+	return RequireHTTPS || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,189 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+var DataloaderBatchSize = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "graphql_dataloader_batch_size",
+		Help:    "Number of keys fetched with one query by a GraphQL dataloader",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	},
+	[]string{"loader"},
+)
+
+// dataLoader batches the lookups GraphQL resolvers make for the same kind of object
+// into one query per batch, and caches the results for the rest of the request. A
+// batch is fetched when the first key has waited for wait, or once it holds max keys.
+// Resolvers that know the keys their children will load (a list of todos and their
+// lists) Prefetch them, so a whole level of the result costs one query.
+type dataLoader[K comparable, V any] struct {
+	name  string
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+	wait  time.Duration
+	max   int
+
+	mu      sync.Mutex
+	results map[K]*loaderResult[V]
+	pending []K
+}
+
+type loaderResult[V any] struct {
+	done  chan struct{} // closed once value, found and err are set
+	value V
+	found bool
+	err   error
+}
+
+func newDataLoader[K comparable, V any](name string, fetch func(ctx context.Context, keys []K) (map[K]V, error)) *dataLoader[K, V] {
+	return &dataLoader[K, V]{
+		name:    name,
+		fetch:   fetch,
+		wait:    2 * time.Millisecond,
+		max:     100,
+		results: make(map[K]*loaderResult[V]),
+	}
+}
+
+// Load returns the value for key, and whether it exists.
+func (l *dataLoader[K, V]) Load(ctx context.Context, key K) (V, bool, error) {
+	r := l.enqueue(ctx, key)
+	select {
+	case <-r.done:
+		return r.value, r.found, r.err
+	case <-ctx.Done():
+		var zero V
+		return zero, false, ctx.Err()
+	}
+}
+
+// Prefetch adds keys to the next batch without waiting for them.
+func (l *dataLoader[K, V]) Prefetch(ctx context.Context, keys ...K) {
+	for _, k := range keys {
+		l.enqueue(ctx, k)
+	}
+}
+
+func (l *dataLoader[K, V]) enqueue(ctx context.Context, key K) *loaderResult[V] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r, ok := l.results[key]; ok {
+		return r
+	}
+	r := &loaderResult[V]{done: make(chan struct{})}
+	l.results[key] = r
+	l.pending = append(l.pending, key)
+	switch len(l.pending) {
+	case l.max:
+		go l.dispatch(ctx)
+	case 1:
+		time.AfterFunc(l.wait, func() { l.dispatch(ctx) })
+	}
+	return r
+}
+
+// dispatch fetches the pending batch, if one is still pending.
+func (l *dataLoader[K, V]) dispatch(ctx context.Context) {
+	l.mu.Lock()
+	keys := l.pending
+	l.pending = nil
+	batch := make([]*loaderResult[V], len(keys))
+	for i, k := range keys {
+		batch[i] = l.results[k]
+	}
+	l.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	DataloaderBatchSize.WithLabelValues(l.name).Observe(float64(len(keys)))
+	values, err := l.fetch(ctx, keys)
+	for i, k := range keys {
+		r := batch[i]
+		r.value, r.found = values[k]
+		r.err = err
+		close(r.done)
+	}
+}
+
+// graphqlLoaders are the dataloaders of one GraphQL request, for one caller.
+type graphqlLoaders struct {
+	lists     *dataLoader[int64, TodoList]
+	listTodos *dataLoader[int64, []Todo]
+}
+
+func (s *Server) newGraphQLLoaders(owner string) *graphqlLoaders {
+	return &graphqlLoaders{
+		lists: newDataLoader("lists", func(ctx context.Context, ids []int64) (map[int64]TodoList, error) {
+			return s.listsByID(ctx, owner, ids)
+		}),
+		listTodos: newDataLoader("list_todos", func(ctx context.Context, ids []int64) (map[int64][]Todo, error) {
+			return s.todosByList(ctx, owner, ids)
+		}),
+	}
+}
+
+// listsByID returns the lists among ids that owner is a member of, read from the replica.
+func (s *Server) listsByID(ctx context.Context, owner string, ids []int64) (map[int64]TodoList, error) {
+	var lists map[int64]TodoList
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := queries(q).ListsByID(ctx, store.ListsByIDParams{UserID: owner, Ids: ids})
+		lists = make(map[int64]TodoList, len(ids)) // Reset on retry
+		for _, r := range rows {
+			lists[r.ID] = TodoList(r)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// todosByList returns the todos of the lists among ids that owner is a member of, read
+// from the replica.
+func (s *Server) todosByList(ctx context.Context, owner string, ids []int64) (map[int64][]Todo, error) {
+	var todos []Todo
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "todos_by_list",
+			`SELECT `+todoColumns+` FROM todos
+			WHERE list_id = ANY($2) AND list_id IN (SELECT list_id FROM list_members WHERE user_id = $1) AND NOT archived
+			ORDER BY id`, owner, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		todos = todos[:0] // Reset on retry
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			todos = append(todos, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		return nil, err
+	}
+	byList := make(map[int64][]Todo, len(ids))
+	for _, t := range todos {
+		byList[*t.ListID] = append(byList[*t.ListID], t)
+	}
+	return byList, nil
+}
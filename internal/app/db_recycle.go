@@ -0,0 +1,149 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// After a failover of the database, or when the proxy in front of it rotates its
+// certificates, the pools keep their connections to the old server until they break.
+// POST /admin/db/recycle replaces them without a restart: idle connections are closed
+// at once, and those in use when they are handed back to the pool, so that every
+// query after it runs on a new connection. With max_age only connections older than
+// that are replaced, and idle ones are closed when they are next taken from the pool.
+
+// pqConn is what database/sql uses of a lib/pq connection.
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// recyclableConn is a connection that its pool drops once it was opened before the
+// recycle cutoff of its connector.
+type recyclableConn struct {
+	pqConn
+	connector *rotatingConnector
+	opened    time.Time
+}
+
+func (c *recyclableConn) recycled() bool {
+	return c.opened.UnixNano() < c.connector.recycleBefore.Load()
+}
+
+// IsValid is asked as the connection is handed back to the pool.
+func (c *recyclableConn) IsValid() bool {
+	return !c.recycled() && c.pqConn.IsValid()
+}
+
+// ResetSession is called as the connection is taken from the pool again.
+func (c *recyclableConn) ResetSession(ctx context.Context) error {
+	if c.recycled() {
+		return driver.ErrBadConn
+	}
+	return c.pqConn.ResetSession(ctx)
+}
+
+// poolConnectors maps the pools opened with openPool to their connectors.
+var poolConnectors sync.Map // *sql.DB -> *rotatingConnector
+
+// openPool opens a pool dialing through c.
+func openPool(c *rotatingConnector) *sql.DB {
+	db := sql.OpenDB(c)
+	poolConnectors.Store(db, c)
+	return db
+}
+
+// OpenDB opens a pool on dsn as ConnectDB opens the primary, for tests that need connections
+// like the app's.
+func OpenDB(dsn string) *sql.DB {
+	return openPool(newRotatingConnector(dsn))
+}
+
+// PoolRecycle is what recycling did to one pool.
+type PoolRecycle struct {
+	Pool   string    `json:"pool"`   // "primary" or "replica"
+	Before time.Time `json:"before"` // connections opened before this are replaced
+	Open   int       `json:"open"`   // connections open at the time, idle or in use
+	Idle   int       `json:"idle"`   // of which idle; closed at once without max_age
+}
+
+// RecycleDBPools replaces the connections of DB and DBRead, if distinct, opened more
+// than maxAge ago, or all of them with maxAge 0. Pools not opened by openPool, as in
+// unit tests, only have their idle connections closed.
+func (s *Server) RecycleDBPools(maxAge time.Duration) ([]PoolRecycle, error) {
+	if s.DB == nil {
+		return nil, errors.New("database not initialized")
+	}
+	before := s.Clock.Now().Add(-maxAge)
+	names, pools := []string{"primary"}, []*sql.DB{s.DB}
+	if s.DBRead != nil && s.DBRead != s.DB {
+		names, pools = append(names, "replica"), append(pools, s.DBRead)
+	}
+	var recycled []PoolRecycle
+	for i, db := range pools {
+		stats := db.Stats()
+		if c, ok := poolConnectors.Load(db); ok {
+			c.(*rotatingConnector).recycleBefore.Store(before.UnixNano())
+		}
+		if maxAge == 0 {
+			db.SetMaxIdleConns(0) // closes idle connections
+			db.SetMaxIdleConns(maxIdleConns())
+		}
+		recycled = append(recycled, PoolRecycle{Pool: names[i], Before: before.UTC(), Open: stats.OpenConnections, Idle: stats.Idle})
+		slog.Info("Recycled database connections", "pool", names[i], "opened_before", before, "open", stats.OpenConnections, "idle", stats.Idle)
+	}
+	return recycled, nil
+}
+
+// HandleAdminDBRecycle serves POST /admin/db/recycle {"max_age": "30m"}: replace the
+// connections of the pools, all of them or those older than max_age.
+func (s *Server) HandleAdminDBRecycle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		MaxAge string `json:"max_age"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var maxAge time.Duration
+	if req.MaxAge != "" {
+		d, err := time.ParseDuration(req.MaxAge)
+		if err != nil || d <= 0 {
+			http.Error(w, "max_age must be a positive duration, such as 30m", http.StatusBadRequest)
+			return
+		}
+		maxAge = d
+	}
+	recycled, err := s.RecycleDBPools(maxAge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recycled); err != nil {
+		slog.Error("Failed to encode recycled pools", "error", err)
+	}
+}
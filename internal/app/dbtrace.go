@@ -0,0 +1,141 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/stevemcghee/go-to-production/internal/app")
+
+var DBQueryDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of individual database queries by query name",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"query"},
+)
+
+// Every query issued by the handlers goes through the helpers below, which:
+//  1. start a client span named after the query (e.g. "db list_todos"),
+//  2. append a sqlcommenter comment carrying the query name and W3C traceparent,
+//     so Cloud SQL Query Insights can link database load back to the API trace,
+//  3. record the query duration (with a trace exemplar).
+//
+// Hot queries run as prepared statements when PreparedStatements is on (prepared.go).
+
+// dbQuery runs a query that returns rows.
+func dbQuery(ctx context.Context, db dbtx, name, query string, args ...any) (*sql.Rows, error) {
+	ctx, span, done := startDBSpan(ctx, name, query)
+	var rows *sql.Rows
+	var err error
+	if stmt := preparedStmt(ctx, db, name, query); stmt != nil {
+		span.SetAttributes(attribute.Bool("db.prepared", true))
+		rows, err = stmt.QueryContext(ctx, args...)
+		checkPreparedStmt(db, name, query, err)
+	} else {
+		rows, err = db.QueryContext(ctx, sqlComment(ctx, name, query), args...)
+	}
+	done(err)
+	span.End()
+	return rows, err
+}
+
+// dbQueryRow runs a query that returns at most one row.
+// The query is executed before dbQueryRow returns; errors surface from Scan.
+func dbQueryRow(ctx context.Context, db dbtx, name, query string, args ...any) *sql.Row {
+	ctx, span, done := startDBSpan(ctx, name, query)
+	var row *sql.Row
+	if stmt := preparedStmt(ctx, db, name, query); stmt != nil {
+		span.SetAttributes(attribute.Bool("db.prepared", true))
+		row = stmt.QueryRowContext(ctx, args...)
+		checkPreparedStmt(db, name, query, row.Err())
+	} else {
+		row = db.QueryRowContext(ctx, sqlComment(ctx, name, query), args...)
+	}
+	done(row.Err())
+	span.End()
+	return row
+}
+
+// dbExec runs a statement that returns no rows.
+func dbExec(ctx context.Context, db dbtx, name, query string, args ...any) (sql.Result, error) {
+	ctx, span, done := startDBSpan(ctx, name, query)
+	var res sql.Result
+	var err error
+	if stmt := preparedStmt(ctx, db, name, query); stmt != nil {
+		span.SetAttributes(attribute.Bool("db.prepared", true))
+		res, err = stmt.ExecContext(ctx, args...)
+		checkPreparedStmt(db, name, query, err)
+	} else {
+		res, err = db.ExecContext(ctx, sqlComment(ctx, name, query), args...)
+	}
+	done(err)
+	span.End()
+	return res, err
+}
+
+func startDBSpan(ctx context.Context, name, query string) (context.Context, trace.Span, func(error)) {
+	ctx, span := tracer.Start(ctx, "db "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(name),
+			semconv.DBStatementKey.String(query),
+		),
+	)
+	start := time.Now()
+	return ctx, span, func(err error) {
+		elapsed := time.Since(start)
+		ObserveWithTraceExemplar(ctx, DBQueryDuration.WithLabelValues(name), elapsed.Seconds())
+		addDBTime(ctx, elapsed)
+		if err != nil && err != sql.ErrNoRows {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.SetAttributes(attribute.Int64("db.duration_ms", elapsed.Milliseconds()))
+	}
+}
+
+// sqlComment appends a sqlcommenter (https://google.github.io/sqlcommenter/) comment.
+// Keys are sorted and values URL-encoded and single-quoted per the specification.
+func sqlComment(ctx context.Context, action, query string) string {
+	tags := map[string]string{
+		"action":      action,
+		"application": "todo-app-go",
+		"db_driver":   "lib_pq",
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		tags["traceparent"] = fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.ReplaceAll(url.QueryEscape(tags[k]), "+", "%20")
+		parts = append(parts, fmt.Sprintf("%s='%s'", url.QueryEscape(k), strings.ReplaceAll(v, "'", `\'`)))
+	}
+	return query + " /*" + strings.Join(parts, ",") + "*/"
+}
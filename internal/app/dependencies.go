@@ -0,0 +1,264 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// Todos can depend on each other: a todo is blocked by the todos that must be done
+// first, and blocks those that wait for it.
+//
+//	GET    /todos/{id}/dependencies           the todos it is blocked by and blocks
+//	POST   /todos/{id}/dependencies           {"blocked_by": 3} or {"blocks": 3}
+//	DELETE /todos/{id}/dependencies/{other}   unlinks the two, either way round
+//
+// Both todos are on the same list, or both personal, like subtasks. A todo cannot be
+// completed while a todo blocking it is open (errTodoBlocked); a parent completed by
+// its subtasks (see subtasks.go) is the exception.
+
+var (
+	errBlockerNotFound = errors.New("todo not found or not on the same list")
+	errDependencyCycle = errors.New("a todo cannot be blocked by itself or by a todo it blocks")
+)
+
+// openBlockers is true for a row of todos with a blocker that is not completed.
+const openBlockers = `EXISTS (
+		SELECT 1 FROM todo_dependencies d JOIN todos b ON b.id = d.blocker_id
+		WHERE d.todo_id = todos.id AND NOT COALESCE(b.completed, FALSE))`
+
+// TodoDependencies are the todos a todo is blocked by and blocks, at
+// /todos/{id}/dependencies. Todos the caller cannot see are left out.
+type TodoDependencies struct {
+	TodoID    int    `json:"todo_id"`
+	BlockedBy []Todo `json:"blocked_by"`
+	Blocks    []Todo `json:"blocks"`
+	Blocked   bool   `json:"blocked"` // some todo in blocked_by is open
+}
+
+// addDependencyQuery makes todo $1 blocked by $2 and says why it did not. $1 must be
+// writable by $3 and $2 on the same list. The walk up from $2 through what blocks it
+// finds a cycle if it reaches $1; UNION ends it on the cycles it guards against.
+var addDependencyQuery = `WITH RECURSIVE chain AS (
+	SELECT blocker_id AS id FROM todo_dependencies WHERE todo_id = $2
+	UNION
+	SELECT d.blocker_id FROM todo_dependencies d JOIN chain ON d.todo_id = chain.id
+), checked AS (
+	SELECT
+		EXISTS (SELECT 1 FROM todos WHERE id = $1 AND ` + fmt.Sprintf(todoWritableBy, 3) + `) AS found,
+		EXISTS (
+			SELECT 1 FROM todos t, todos b WHERE t.id = $1 AND b.id = $2
+				AND b.list_id IS NOT DISTINCT FROM t.list_id
+				AND (b.list_id IS NOT NULL OR b.user_id = $3)) AS blocker_ok,
+		$1::int = $2::int OR EXISTS (SELECT 1 FROM chain WHERE id = $1) AS cycle
+), added AS (
+	INSERT INTO todo_dependencies (todo_id, blocker_id)
+	SELECT $1, $2 FROM checked WHERE found AND blocker_ok AND NOT cycle
+	ON CONFLICT DO NOTHING
+)
+SELECT found, blocker_ok, cycle FROM checked`
+
+// addDependency makes todo id blocked by blocker and reports whether owner could
+// change id. A blocker that cannot be used is errBlockerNotFound or errDependencyCycle.
+func (s *Server) addDependency(ctx context.Context, owner string, id, blocker int) (bool, error) {
+	var found, blockerOK, cycle bool
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "add_todo_dependency", addDependencyQuery, id, blocker, owner).
+				Scan(&found, &blockerOK, &cycle)
+		})
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case !found:
+		return false, nil
+	case !blockerOK:
+		return true, errBlockerNotFound
+	case cycle:
+		return true, errDependencyCycle
+	}
+	return true, nil
+}
+
+// removeDependencyQuery unlinks todos $1 and $2, whichever blocks the other, if $3 may
+// change $1, and says whether they could.
+var removeDependencyQuery = `WITH target AS (
+	SELECT id FROM todos WHERE id = $1 AND ` + fmt.Sprintf(todoWritableBy, 3) + `
+), removed AS (
+	DELETE FROM todo_dependencies
+	WHERE (todo_id = $1 AND blocker_id = $2 OR todo_id = $2 AND blocker_id = $1)
+		AND EXISTS (SELECT 1 FROM target)
+)
+SELECT EXISTS (SELECT 1 FROM target)`
+
+// dependencyQueries select the todos that block todo $2, and that it blocks, as $1
+// sees them.
+var dependencyQueries = [2]string{
+	`SELECT ` + todoColumns + ` FROM todos WHERE id IN (SELECT blocker_id FROM todo_dependencies WHERE todo_id = $2) AND ` + todoVisibleTo + ` ORDER BY id`,
+	`SELECT ` + todoColumns + ` FROM todos WHERE id IN (SELECT todo_id FROM todo_dependencies WHERE blocker_id = $2) AND ` + todoVisibleTo + ` ORDER BY id`,
+}
+
+// getTodoDependencies returns the dependencies of todo id, or found false if owner
+// cannot see it. fromPrimary skips the replica, as for getTodo.
+func (s *Server) getTodoDependencies(ctx context.Context, owner string, id int, fromPrimary bool) (TodoDependencies, bool, error) {
+	deps := TodoDependencies{TodoID: id}
+	var found bool
+	get := func(q dbtx) error {
+		var err error
+		if found, err = queries(q).TodoExists(ctx, store.TodoExistsParams{Owner: owner, ID: int64(id)}); err != nil || !found {
+			return err
+		}
+		for i, dst := range []*[]Todo{&deps.BlockedBy, &deps.Blocks} {
+			rows, err := dbQuery(ctx, q, "list_todo_dependencies", dependencyQueries[i], owner, id)
+			if err != nil {
+				return err
+			}
+			*dst = []Todo{} // Reset on retry
+			for rows.Next() {
+				var t Todo
+				if err := scanTodo(rows, &t); err != nil {
+					rows.Close()
+					return err
+				}
+				*dst = append(*dst, t)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := s.ExecuteWithRobustness(func() error {
+		if !fromPrimary {
+			err := withTenant(ctx, s.DBRead, owner, get)
+			if err == nil || s.DBRead == s.DB {
+				return err
+			}
+			slog.Warn("Read replica failed, falling back to primary", "error", err)
+		}
+		return withTenant(ctx, s.DB, owner, get)
+	})
+	if err != nil || !found {
+		return deps, found, err
+	}
+	for _, todos := range [][]Todo{deps.BlockedBy, deps.Blocks} {
+		if err := s.decryptTodos(ctx, todos); err != nil {
+			return deps, true, err
+		}
+	}
+	for _, t := range deps.BlockedBy {
+		deps.Blocked = deps.Blocked || !t.Completed
+	}
+	return deps, true, nil
+}
+
+// HandleTodoDependencies serves GET and POST /todos/{id}/dependencies and answers with
+// the todo's dependencies.
+func (s *Server) HandleTodoDependencies(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			BlockedBy *int `json:"blocked_by"`
+			Blocks    *int `json:"blocks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (req.BlockedBy == nil) == (req.Blocks == nil) {
+			http.Error(w, "Set one of blocked_by and blocks", http.StatusBadRequest)
+			return
+		}
+		todo, blocker := id, req.BlockedBy
+		if req.Blocks != nil {
+			todo, blocker = *req.Blocks, &id
+		}
+		found, err := s.addDependency(ctx, owner, todo, *blocker)
+		switch {
+		case errors.Is(err, errBlockerNotFound):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, errDependencyCycle):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			writeDBError(w, err)
+			return
+		case !found && todo == id:
+			http.Error(w, "Todo not found", http.StatusNotFound)
+			return
+		case !found:
+			http.Error(w, errBlockerNotFound.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		slog.Info("Linked todos", "todo", todo, "blocked_by", *blocker)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeTodoDependencies(w, r, id, r.Method != http.MethodGet)
+}
+
+// HandleTodoDependency serves DELETE /todos/{id}/dependencies/{other} and answers with
+// the todo's dependencies.
+func (s *Server) HandleTodoDependency(w http.ResponseWriter, r *http.Request, id int, other string) {
+	otherID, err := strconv.Atoi(other)
+	if err != nil {
+		http.Error(w, "Invalid todo ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var found bool
+	err = s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "remove_todo_dependency", removeDependencyQuery, id, otherID, owner).Scan(&found)
+		})
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	s.writeTodoDependencies(w, r, id, true)
+}
+
+func (s *Server) writeTodoDependencies(w http.ResponseWriter, r *http.Request, id int, fromPrimary bool) {
+	deps, found, err := s.getTodoDependencies(r.Context(), TodoOwner(r.Context()), id, fromPrimary)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deps); err != nil {
+		slog.Error("Failed to encode todo dependencies", "error", err)
+	}
+}
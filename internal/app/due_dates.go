@@ -0,0 +1,213 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // users' timezones, also in images without /usr/share/zoneinfo
+)
+
+// Due dates are instants (todos.due_at); whether a todo is due "today" depends on
+// whose today, so it is computed in the caller's timezone (user_settings.timezone,
+// UTC by default), never in the server's:
+//
+//	PUT    /todos/{id}/due  {"due_at": "2026-10-20T17:00:00+02:00"} or {"due_at": "2026-10-20"}
+//	DELETE /todos/{id}/due
+//	GET    /todos/overdue   open todos past their due date
+//	GET    /todos/today     open todos due today, in the caller's timezone
+//	PATCH  /me/settings     {"timezone": "Europe/Berlin"}
+
+// userLocation returns the timezone named name, or UTC if there is none by that name.
+func userLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return time.UTC
+	}
+	return loc
+}
+
+// userTimezone returns the timezone of subject, "UTC" if they have not set one.
+func (s *Server) userTimezone(ctx context.Context, subject string) (string, error) {
+	tz := "UTC"
+	err := s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(ctx, s.DBRead, "get_user_timezone", "SELECT timezone FROM user_settings WHERE subject = $1", subject).Scan(&tz)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return tz, err
+}
+
+// parseDueAt parses an RFC 3339 time, or a date, which means the end of that day in
+// loc, and returns it in UTC.
+func parseDueAt(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, s, loc)
+	if err != nil {
+		return time.Time{}, errors.New("due_at must be an RFC 3339 time or a date (YYYY-MM-DD)")
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Second).UTC(), nil
+}
+
+// today returns when the day of now in loc starts and ends. Days are not always 24
+// hours long: DST changes make them 23 or 25.
+func today(now time.Time, loc *time.Location) (start, end time.Time) {
+	y, m, d := now.In(loc).Date()
+	start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+var setTodoDueQuery = `UPDATE todos SET due_at = $1 WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 3) + ` RETURNING id`
+
+// setTodoDue sets or, with a nil dueAt, clears the due date of todo id and reports
+// whether owner could change it.
+func (s *Server) setTodoDue(ctx context.Context, owner string, id int, dueAt *time.Time) (bool, error) {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var updated int
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "set_todo_due", setTodoDueQuery, dueAt, id, owner).Scan(&updated)
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	return found, err
+}
+
+const dueTodosQuery = `SELECT ` + todoColumns + ` FROM todos
+WHERE ` + todoVisibleTo + `
+	AND NOT archived AND NOT completed AND due_at >= $2 AND due_at < $3
+ORDER BY due_at, id`
+
+// listDueTodos returns the open todos owner can see that are due in [from, until).
+func (s *Server) listDueTodos(ctx context.Context, owner string, from, until time.Time) ([]Todo, error) {
+	var todos []Todo
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "list_due_todos", dueTodosQuery, owner, from, until)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		todos = []Todo{} // Reset on retry
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			todos = append(todos, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+// HandleTodoDue serves PUT and DELETE /todos/{id}/due and answers with the todo. A date
+// without a time is due at the end of that day in the caller's timezone.
+func (s *Server) HandleTodoDue(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var dueAt *time.Time
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			DueAt string `json:"due_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tz, err := s.userTimezone(ctx, owner)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		t, err := parseDueAt(req.DueAt, userLocation(tz))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dueAt = &t
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	found, err := s.setTodoDue(ctx, owner, id, dueAt)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
+
+// HandleOverdueTodos serves GET /todos/overdue: the caller's open todos past their due
+// date, oldest due date first.
+func (s *Server) HandleOverdueTodos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	todos, err := s.listDueTodos(r.Context(), TodoOwner(r.Context()), time.Time{}, s.Clock.Now())
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, todos)
+}
+
+// HandleTodosDueToday serves GET /todos/today: the caller's open todos due between
+// midnight and midnight in their timezone, including those already past. The
+// timezone used is in the X-Timezone header.
+func (s *Server) HandleTodosDueToday(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := TodoOwner(r.Context())
+	tz, err := s.userTimezone(r.Context(), owner)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	loc := userLocation(tz)
+	start, end := today(s.Clock.Now(), loc)
+	todos, err := s.listDueTodos(r.Context(), owner, start, end)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	w.Header().Set("X-Timezone", loc.String())
+	writeTodoResponse(w, r, http.StatusOK, todos)
+}
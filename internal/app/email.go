@@ -0,0 +1,239 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/stevemcghee/go-to-production/internal/config"
+)
+
+// Email is one message to one recipient, with a plain text and an HTML body. Date and
+// MessageID (the part before the @) are for senders that write the headers themselves.
+type Email struct {
+	To        string
+	Subject   string
+	Text      string
+	HTML      string
+	Date      time.Time
+	MessageID string
+}
+
+// EmailSender delivers emails. Send returns once the provider accepted the message.
+type EmailSender interface {
+	Name() string
+	Send(ctx context.Context, msg Email) error
+}
+
+// EmailProviders are the values of notifications.email_provider; "" disables email.
+var EmailProviders = []string{"smtp", "sendgrid", "log"}
+
+// SMTPSender sends through an SMTP relay, with STARTTLS when the server offers it and
+// PLAIN auth when a user is set (net/smtp only sends the password over TLS or to
+// localhost).
+type SMTPSender struct {
+	Addr     string // host:port
+	From     *mail.Address
+	User     string
+	Password string
+}
+
+func (s *SMTPSender) Name() string { return "smtp" }
+
+func (s *SMTPSender) Send(ctx context.Context, msg Email) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp address: %w", err)
+	}
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if s.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.User, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if err := writeMIME(w, s.From, msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// writeMIME writes msg as a multipart/alternative message.
+func writeMIME(w io.Writer, from *mail.Address, msg Email) error {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s@%s>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		from.String(), msg.To, mime.QEncoding.Encode("utf-8", msg.Subject), msg.Date.Format(time.RFC1123Z),
+		msg.MessageID, domainOf(from.Address), mw.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return err
+		}
+		if err := qw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// SendGridSender sends through the SendGrid v3 mail API.
+type SendGridSender struct {
+	APIKey   string
+	From     *mail.Address
+	Endpoint string // default https://api.sendgrid.com/v3/mail/send
+	Client   *http.Client
+}
+
+func (s *SendGridSender) Name() string { return "sendgrid" }
+
+func (s *SendGridSender) Send(ctx context.Context, msg Email) error {
+	type address struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	body, err := json.Marshal(map[string]any{
+		"personalizations": []map[string]any{{"to": []address{{Email: msg.To}}}},
+		"from":             address{Email: s.From.Address, Name: s.From.Name},
+		"subject":          msg.Subject,
+		"content":          []content{{"text/plain", msg.Text}, {"text/html", msg.HTML}},
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.sendgrid.com/v3/mail/send"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("sendgrid: HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// LogSender only logs emails, for development. The recipient and subject are logged
+// under the email and task keys, so the redactor masks them like any personal data.
+type LogSender struct{}
+
+func (LogSender) Name() string { return "log" }
+
+func (LogSender) Send(ctx context.Context, msg Email) error {
+	slog.InfoContext(ctx, "Email not sent (log provider)", "email", msg.To, "task", msg.Subject, "text_length", len(msg.Text))
+	return nil
+}
+
+// NewEmailSender returns the sender of provider (see EmailProviders), or nil for "".
+func NewEmailSender(s config.NotificationSettings) (EmailSender, error) {
+	if s.EmailProvider == "" {
+		return nil, nil
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	switch s.EmailProvider {
+	case "smtp":
+		if _, _, err := net.SplitHostPort(s.SMTPAddr); err != nil {
+			return nil, fmt.Errorf("smtp_addr: %w", err)
+		}
+		return &SMTPSender{Addr: s.SMTPAddr, From: from, User: s.SMTPUser, Password: s.SMTPPassword}, nil
+	case "sendgrid":
+		if s.SendGridAPIKey == "" {
+			return nil, errors.New("sendgrid_api_key is required")
+		}
+		return &SendGridSender{APIKey: s.SendGridAPIKey, From: from}, nil
+	case "log":
+		return LogSender{}, nil
+	}
+	return nil, fmt.Errorf("unknown email provider %q", s.EmailProvider)
+}
+
+func domainOf(address string) string {
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		return address[at+1:]
+	}
+	return "localhost"
+}
@@ -0,0 +1,456 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// Envelope encryption of task text. Each todo's task is sealed with AES-256-GCM under a
+// data encryption key (DEK); DEKs are stored in data_keys wrapped by a Cloud KMS key, so
+// the plaintext DEK never touches the database and KMS is only called once per DEK.
+//
+// Encrypted values are stored in the task column as "enc:v1:<dek id>:<base64(nonce|ciphertext)>",
+// so plaintext rows from before encryption was enabled keep working and are migrated
+// by the rotation job.
+const encryptedPrefix = "enc:v1:"
+
+// dataKeyMaxAge is how long a DEK is used for new writes before a fresh one is generated.
+const dataKeyMaxAge = 30 * 24 * time.Hour
+
+var KMSOperations = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kms_operations_total",
+		Help: "Total number of Cloud KMS calls made for field encryption",
+	},
+	[]string{"op", "result"}, // op: "wrap", "unwrap", "primary"
+)
+
+// KeyWrapper wraps and unwraps data keys with a key encryption key.
+type KeyWrapper interface {
+	// Wrap encrypts a DEK, returning the ciphertext and the key version used.
+	Wrap(ctx context.Context, dek []byte) ([]byte, string, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+	// PrimaryVersion is the key version new wraps will use.
+	PrimaryVersion(ctx context.Context) (string, error)
+}
+
+// KMSKeyWrapper wraps keys with a Cloud KMS symmetric key
+// (projects/p/locations/l/keyRings/r/cryptoKeys/k).
+type KMSKeyWrapper struct {
+	svc *cloudkms.Service
+	key string
+}
+
+// NewKMSKeyWrapper creates a wrapper for the given CryptoKey resource name.
+func NewKMSKeyWrapper(ctx context.Context, key string) (*KMSKeyWrapper, error) {
+	svc, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloud kms client: %w", err)
+	}
+	return &KMSKeyWrapper{svc: svc, key: key}, nil
+}
+
+func (k *KMSKeyWrapper) Wrap(ctx context.Context, dek []byte) ([]byte, string, error) {
+	resp, err := k.svc.Projects.Locations.KeyRings.CryptoKeys.Encrypt(k.key, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dek),
+	}).Context(ctx).Do()
+	observeKMS("wrap", err)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	return wrapped, resp.Name, err
+}
+
+func (k *KMSKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := k.svc.Projects.Locations.KeyRings.CryptoKeys.Decrypt(k.key, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	observeKMS("unwrap", err)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+func (k *KMSKeyWrapper) PrimaryVersion(ctx context.Context) (string, error) {
+	key, err := k.svc.Projects.Locations.KeyRings.CryptoKeys.Get(k.key).Context(ctx).Do()
+	observeKMS("primary", err)
+	if err != nil {
+		return "", err
+	}
+	if key.Primary == nil {
+		return "", fmt.Errorf("crypto key %s has no primary version", k.key)
+	}
+	return key.Primary.Name, nil
+}
+
+func observeKMS(op string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	KMSOperations.WithLabelValues(op, result).Inc()
+}
+
+type dataKey struct {
+	id      int64
+	aead    cipher.AEAD
+	created time.Time
+}
+
+// FieldCipher seals and opens task text with envelope encryption. The wrapped data
+// keys are stored in the server's database.
+type FieldCipher struct {
+	server  *Server
+	wrapper KeyWrapper
+
+	mu      sync.Mutex
+	current *dataKey
+	keys    map[int64]*dataKey
+}
+
+// NewFieldCipher returns a cipher for s whose data keys are wrapped by wrapper.
+func NewFieldCipher(s *Server, wrapper KeyWrapper) *FieldCipher {
+	return &FieldCipher{server: s, wrapper: wrapper, keys: make(map[int64]*dataKey)}
+}
+
+// encryptTask seals text when field encryption is enabled.
+func (s *Server) encryptTask(ctx context.Context, text string) (string, error) {
+	if s.TaskCipher == nil {
+		return text, nil
+	}
+	return s.TaskCipher.Encrypt(ctx, text)
+}
+
+// decryptTask opens text if it is encrypted; plaintext values pass through unchanged.
+func (s *Server) decryptTask(ctx context.Context, text string) (string, error) {
+	if !strings.HasPrefix(text, encryptedPrefix) {
+		return text, nil
+	}
+	if s.TaskCipher == nil {
+		return "", fmt.Errorf("task is encrypted but field encryption is not configured")
+	}
+	return s.TaskCipher.Decrypt(ctx, text)
+}
+
+// Encrypt seals plaintext under the current data key.
+func (c *FieldCipher) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	dk, err := c.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, dk.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := dk.aead.Seal(nonce, nonce, []byte(plaintext), []byte(encryptedPrefix))
+	return encryptedPrefix + strconv.FormatInt(dk.id, 10) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt.
+func (c *FieldCipher) Decrypt(ctx context.Context, value string) (string, error) {
+	idStr, b64, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if !ok || err != nil {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	dk, err := c.key(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	n := dk.aead.NonceSize()
+	if len(sealed) < n {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plain, err := dk.aead.Open(nil, sealed[:n], sealed[n:], []byte(encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt task: %w", err)
+	}
+	return string(plain), nil
+}
+
+// currentKey returns the DEK for new writes: the newest stored key while it is younger
+// than dataKeyMaxAge, otherwise a freshly generated one.
+func (c *FieldCipher) currentKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil && c.server.Clock.Now().Sub(c.current.created) < dataKeyMaxAge {
+		return c.current, nil
+	}
+
+	var id int64
+	var wrapped []byte
+	var created time.Time
+	found := false
+	err := c.server.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(ctx, c.server.DB, "latest_data_key", "SELECT id, wrapped_key, created_at FROM data_keys WHERE created_at > $1 ORDER BY id DESC LIMIT 1",
+			c.server.Clock.Now().Add(-dataKeyMaxAge)).Scan(&id, &wrapped, &created)
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dek []byte
+	if found {
+		if dek, err = c.wrapper.Unwrap(ctx, wrapped); err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key %d: %w", id, err)
+		}
+	} else {
+		dek = make([]byte, 32)
+		if _, err := rand.Read(dek); err != nil {
+			return nil, err
+		}
+		wrapped, version, err := c.wrapper.Wrap(ctx, dek)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		err = c.server.ExecuteWithRobustness(func() error {
+			return dbQueryRow(ctx, c.server.DB, "insert_data_key", "INSERT INTO data_keys (wrapped_key, kms_key_version) VALUES ($1, $2) RETURNING id, created_at",
+				wrapped, version).Scan(&id, &created)
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Generated new data encryption key", "id", id, "kms_key_version", version)
+	}
+
+	dk, err := newDataKey(id, dek, created)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[id], c.current = dk, dk
+	return dk, nil
+}
+
+// key returns DEK id, unwrapping it with KMS on first use.
+func (c *FieldCipher) key(ctx context.Context, id int64) (*dataKey, error) {
+	c.mu.Lock()
+	dk, ok := c.keys[id]
+	c.mu.Unlock()
+	if ok {
+		return dk, nil
+	}
+
+	var wrapped []byte
+	var created time.Time
+	err := c.server.ExecuteWithRobustness(func() error {
+		return dbQueryRow(ctx, c.server.DBRead, "get_data_key", "SELECT wrapped_key, created_at FROM data_keys WHERE id = $1", id).Scan(&wrapped, &created)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data key %d: %w", id, err)
+	}
+	dek, err := c.wrapper.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key %d: %w", id, err)
+	}
+	if dk, err = newDataKey(id, dek, created); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.keys[id] = dk
+	c.mu.Unlock()
+	return dk, nil
+}
+
+func newDataKey(id int64, dek []byte, created time.Time) (*dataKey, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{id: id, aead: aead, created: created}, nil
+}
+
+// RotateDataKeys rewraps every data key that was wrapped with a KMS key version other
+// than the current primary, so old KMS versions can be disabled, and encrypts up to
+// batch plaintext tasks left over from before encryption was enabled.
+func (c *FieldCipher) RotateDataKeys(ctx context.Context, batch int) (rewrapped, encrypted int, err error) {
+	primary, err := c.wrapper.PrimaryVersion(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type staleKey struct {
+		id      int64
+		wrapped []byte
+	}
+	var stale []staleKey
+	err = c.server.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(ctx, c.server.DB, "stale_data_keys", "SELECT id, wrapped_key FROM data_keys WHERE kms_key_version <> $1", primary)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		stale = stale[:0]
+		for rows.Next() {
+			var k staleKey
+			if err := rows.Scan(&k.id, &k.wrapped); err != nil {
+				return err
+			}
+			stale = append(stale, k)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, k := range stale {
+		dek, err := c.wrapper.Unwrap(ctx, k.wrapped)
+		if err != nil {
+			return rewrapped, 0, fmt.Errorf("failed to unwrap data key %d: %w", k.id, err)
+		}
+		wrapped, version, err := c.wrapper.Wrap(ctx, dek)
+		if err != nil {
+			return rewrapped, 0, fmt.Errorf("failed to rewrap data key %d: %w", k.id, err)
+		}
+		err = c.server.ExecuteWithRobustness(func() error {
+			_, err := dbExec(ctx, c.server.DB, "rewrap_data_key", "UPDATE data_keys SET wrapped_key = $1, kms_key_version = $2, rewrapped_at = now() WHERE id = $3", wrapped, version, k.id)
+			return err
+		})
+		if err != nil {
+			return rewrapped, 0, err
+		}
+		rewrapped++
+	}
+
+	type plainTask struct {
+		id   int64
+		task string
+	}
+	var plain []plainTask
+	err = c.server.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, c.server.DB, systemTenant, func(q dbtx) error {
+			rows, err := dbQuery(ctx, q, "plaintext_tasks", "SELECT id, task FROM todos WHERE task NOT LIKE 'enc:v1:%' ORDER BY id LIMIT $1", batch)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			plain = plain[:0]
+			for rows.Next() {
+				var t plainTask
+				if err := rows.Scan(&t.id, &t.task); err != nil {
+					return err
+				}
+				plain = append(plain, t)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return rewrapped, 0, err
+	}
+	for _, t := range plain {
+		sealed, err := c.Encrypt(ctx, t.task)
+		if err != nil {
+			return rewrapped, encrypted, err
+		}
+		// The WHERE on the old value makes this a no-op if the task changed meanwhile.
+		err = c.server.ExecuteWithRobustness(func() error {
+			return withTenant(ctx, c.server.DB, systemTenant, func(q dbtx) error {
+				_, err := dbExec(ctx, q, "encrypt_task", "UPDATE todos SET task = $1 WHERE id = $2 AND task = $3", sealed, t.id, t.task)
+				return err
+			})
+		})
+		if err != nil {
+			return rewrapped, encrypted, err
+		}
+		encrypted++
+	}
+	return rewrapped, encrypted, nil
+}
+
+func init() {
+	registerJob("reencrypt", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute, Timeout: 10 * time.Minute},
+		run:    (*Server).runReencrypt,
+		admin:  true,
+	})
+}
+
+// runReencrypt rewraps stale data keys and encrypts every plaintext task, instead of
+// waiting for StartKeyRotation to get through them 500 an hour. Progress is saved
+// after each batch.
+func (s *Server) runReencrypt(ctx context.Context, job *Job) (any, error) {
+	if s.TaskCipher == nil {
+		return nil, permanentJobError(errors.New("encryption.task_key is not set"))
+	}
+	var progress struct {
+		Rewrapped int `json:"rewrapped_keys"`
+		Encrypted int `json:"encrypted_tasks"`
+	}
+	if len(job.Result) > 0 {
+		json.Unmarshal(job.Result, &progress)
+	}
+	const batch = 500
+	for {
+		rewrapped, encrypted, err := s.TaskCipher.RotateDataKeys(ctx, batch)
+		progress.Rewrapped += rewrapped
+		progress.Encrypted += encrypted
+		if err != nil {
+			s.saveJobProgress(ctx, job, progress)
+			return nil, err
+		}
+		if encrypted < batch {
+			return progress, nil
+		}
+		if err := s.saveJobProgress(ctx, job, progress); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// StartKeyRotation runs RotateDataKeys every interval until ctx is cancelled.
+func (s *Server) StartKeyRotation(ctx context.Context, c *FieldCipher, interval time.Duration) {
+	Workers.Go(ctx, "key_rotation", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			rewrapped, encrypted, err := c.RotateDataKeys(ctx, 500)
+			w.Checkpoint(err)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Data key rotation failed", "error", err)
+			} else if rewrapped > 0 || encrypted > 0 {
+				slog.Info("Data key rotation progressed", "rewrapped_keys", rewrapped, "encrypted_tasks", encrypted)
+			}
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
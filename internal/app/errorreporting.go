@@ -0,0 +1,360 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrorReportsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "error_reports_total",
+			Help: "Total number of errors sent to the error reporting backend",
+		},
+		[]string{"kind"}, // "panic" or "5xx"
+	)
+	ErrorReportsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "error_reports_dropped_total",
+			Help: "Total number of error reports dropped (sampling excluded) or lost (queue full, send failure)",
+		},
+	)
+)
+
+// ErrorEvent is a single unexpected error captured from a request.
+type ErrorEvent struct {
+	Kind      string // "panic" or "5xx"
+	Message   string
+	Stack     []byte    // Go-formatted stack trace (panics only)
+	Frames    []uintptr // Program counters for structured stack traces (panics only)
+	RequestID string
+	Method    string
+	URL       string
+	Status    int
+	UserAgent string
+	Release   string
+	Time      time.Time
+}
+
+// ErrorReporter delivers error events to an error grouping backend.
+// Implementations must not block the request path for long.
+type ErrorReporter interface {
+	Report(ctx context.Context, ev ErrorEvent)
+}
+
+// ErrorReporterFunc adapts a function to the ErrorReporter interface.
+type ErrorReporterFunc func(ctx context.Context, ev ErrorEvent)
+
+func (f ErrorReporterFunc) Report(ctx context.Context, ev ErrorEvent) { f(ctx, ev) }
+
+// Error reporting configuration. Panics are always reported; 5xx responses are
+// reported with probability ErrorSampleRate (0..1) to bound volume during incidents.
+var (
+	Reporter        ErrorReporter
+	ErrorSampleRate = 1.0
+	ErrorRelease    = "unknown"
+)
+
+// InitErrorReporting selects the error reporting backend:
+// - "cloud": structured log entries recognized by Cloud Error Reporting (default on GKE)
+// - "sentry": events POSTed to a Sentry-compatible store endpoint described by dsn
+// - "none" or "": disabled
+func InitErrorReporting(backend, dsn string, sampleRate float64, release string) error {
+	ErrorSampleRate = sampleRate
+	ErrorRelease = release
+
+	switch backend {
+	case "", "none":
+		Reporter = nil
+	case "cloud":
+		Reporter = &CloudErrorReporter{Service: "todo-app-go"}
+	case "sentry":
+		sr, err := NewSentryReporter(dsn)
+		if err != nil {
+			return err
+		}
+		Reporter = sr
+	default:
+		return fmt.Errorf("unknown error reporting backend %q", backend)
+	}
+	return nil
+}
+
+// ErrorReportingMiddleware recovers panics (responding 500) and reports both panics
+// and 5xx responses, tagged with the request id and release.
+// It should wrap the router, inside RequestIDMiddleware.
+func (s *Server) ErrorReportingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &errorCapturingWriter{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				pcs := make([]uintptr, 64)
+				n := runtime.Callers(3, pcs)
+				ev := s.newErrorEvent(r, "panic", http.StatusInternalServerError, fmt.Sprintf("panic: %v", p))
+				ev.Stack = debug.Stack()
+				ev.Frames = pcs[:n]
+				slog.Error("Recovered from panic in handler", "panic", p, "request_id", ev.RequestID, "path", r.URL.Path)
+				if !rw.wroteHeader {
+					http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+				}
+				reportError(r.Context(), ev)
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+
+		if rw.status >= 500 && shouldSample() {
+			msg := rw.detail
+			if msg == "" {
+				msg = strings.TrimSpace(rw.body.String())
+			}
+			if msg == "" {
+				msg = http.StatusText(rw.status)
+			}
+			reportError(r.Context(), s.newErrorEvent(r, "5xx", rw.status, msg))
+		}
+	})
+}
+
+func (s *Server) newErrorEvent(r *http.Request, kind string, status int, msg string) ErrorEvent {
+	return ErrorEvent{
+		Kind:      kind,
+		Message:   msg,
+		RequestID: RequestIDFromContext(r.Context()),
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Status:    status,
+		UserAgent: r.UserAgent(),
+		Release:   ErrorRelease,
+		Time:      s.Clock.Now(),
+	}
+}
+
+func reportError(ctx context.Context, ev ErrorEvent) {
+	if Reporter == nil {
+		return
+	}
+	ev.Message = Redaction.String(ev.Message)
+	ev.URL = Redaction.String(ev.URL)
+	ErrorReportsTotal.WithLabelValues(ev.Kind).Inc()
+	Reporter.Report(ctx, ev)
+}
+
+func shouldSample() bool {
+	if Reporter == nil {
+		return false
+	}
+	if rate := errorSampleRate(); rate >= 1 || rand.Float64() < rate {
+		return true
+	}
+	ErrorReportsDropped.Inc()
+	return false
+}
+
+// errorCapturingWriter records the status and the start of error bodies,
+// so the reported message matches what the client saw.
+type errorCapturingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	detail      string // server-side error detail, when richer than the client-facing body
+}
+
+func (w *errorCapturingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// setErrorDetail attaches an error description for error reporting that is not sent to
+// the client. It finds the errorCapturingWriter through any wrapping writers.
+func setErrorDetail(w http.ResponseWriter, detail string) {
+	for w != nil {
+		if ew, ok := w.(*errorCapturingWriter); ok {
+			ew.detail = detail
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+const maxCapturedErrorBody = 1024
+
+func (w *errorCapturingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorCapturingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if w.status >= 500 && w.body.Len() < maxCapturedErrorBody {
+		rest := maxCapturedErrorBody - w.body.Len()
+		if len(b) < rest {
+			rest = len(b)
+		}
+		w.body.Write(b[:rest])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// CloudErrorReporter writes log entries in the format Cloud Error Reporting ingests
+// from Cloud Logging (ReportedErrorEvent). No API client or extra IAM is needed on GKE.
+type CloudErrorReporter struct {
+	Service string
+}
+
+func (c *CloudErrorReporter) Report(ctx context.Context, ev ErrorEvent) {
+	msg := ev.Message
+	if len(ev.Stack) > 0 {
+		// Error Reporting groups Go errors by parsing the panic-formatted stack trace.
+		msg = ev.Message + "\n\n" + string(ev.Stack)
+	}
+	slog.Error("Reported error",
+		"@type", "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent",
+		"stack_trace", msg,
+		"serviceContext", map[string]string{"service": c.Service, "version": ev.Release},
+		"context", map[string]any{
+			"httpRequest": map[string]any{
+				"method":             ev.Method,
+				"url":                ev.URL,
+				"userAgent":          ev.UserAgent,
+				"responseStatusCode": ev.Status,
+			},
+		},
+		"request_id", ev.RequestID,
+	)
+}
+
+// SentryReporter sends events to a Sentry-compatible "store" endpoint.
+// Delivery is asynchronous through a bounded queue; when the queue is full events are dropped.
+type SentryReporter struct {
+	endpoint string
+	authHdr  string
+	client   *http.Client
+	queue    chan ErrorEvent
+}
+
+// NewSentryReporter parses a DSN of the form https://<public_key>@<host>/<project_id>.
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid sentry DSN")
+	}
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: missing project id")
+	}
+	s := &SentryReporter{
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		authHdr:  fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=todo-app-go/1.0", u.User.Username()),
+		client:   &http.Client{Timeout: 5 * time.Second},
+		queue:    make(chan ErrorEvent, 100),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *SentryReporter) Report(ctx context.Context, ev ErrorEvent) {
+	select {
+	case s.queue <- ev:
+	default:
+		ErrorReportsDropped.Inc()
+	}
+}
+
+func (s *SentryReporter) run() {
+	for ev := range s.queue {
+		if err := s.send(ev); err != nil {
+			ErrorReportsDropped.Inc()
+			slog.Warn("Failed to send error report to Sentry", "error", err)
+		}
+	}
+}
+
+func (s *SentryReporter) send(ev ErrorEvent) error {
+	payload := map[string]any{
+		"event_id":  newToken(),
+		"timestamp": ev.Time.UTC().Format(time.RFC3339),
+		"level":     "error",
+		"platform":  "go",
+		"release":   ev.Release,
+		"tags":      map[string]string{"request_id": ev.RequestID, "kind": ev.Kind},
+		"request":   map[string]any{"url": ev.URL, "method": ev.Method},
+		"exception": map[string]any{
+			"values": []map[string]any{{
+				"type":       ev.Kind,
+				"value":      ev.Message,
+				"stacktrace": map[string]any{"frames": sentryFrames(ev.Frames)},
+			}},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.authHdr)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sentryFrames converts program counters to Sentry frames (oldest call first).
+func sentryFrames(pcs []uintptr) []map[string]any {
+	if len(pcs) == 0 {
+		return nil
+	}
+	var frames []map[string]any
+	it := runtime.CallersFrames(pcs)
+	for {
+		f, more := it.Next()
+		frames = append(frames, map[string]any{
+			"function": f.Function,
+			"filename": f.File,
+			"lineno":   f.Line,
+			"in_app":   strings.Contains(f.Function, "go-to-production"),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
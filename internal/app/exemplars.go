@@ -0,0 +1,29 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ObserveWithTraceExemplar records v on the observer and, when ctx carries a sampled
+// span, attaches the trace and span ids as an exemplar. Grafana (and Cloud Monitoring
+// via Managed Prometheus) use the exemplar to jump from a slow bucket to the trace.
+//
+// Exemplars are only exposed when /metrics is served in OpenMetrics format.
+func ObserveWithTraceExemplar(ctx context.Context, o prometheus.Observer, v float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && sc.IsValid() && sc.IsSampled() {
+		eo.ObserveWithExemplar(v, prometheus.Labels{
+			"trace_id": sc.TraceID().String(),
+			"span_id":  sc.SpanID().String(),
+		})
+		return
+	}
+	o.Observe(v)
+}
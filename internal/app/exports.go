@@ -0,0 +1,547 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ExportsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "exports_total",
+			Help: "Total number of finished todo exports",
+		},
+		[]string{"format", "status"},
+	)
+	ExportDownloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "export_downloads_total",
+			Help: "Total number of export download attempts",
+		},
+		[]string{"result"}, // "ok", "invalid_signature", "expired", "not_found"
+	)
+)
+
+// Export is an asynchronous snapshot of the caller's todos.
+type Export struct {
+	ID          int64      `json:"id"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"` // "pending", "ready" or "failed"
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// Export settings. Exports are kept for ExportRetention; each download URL is
+// valid for ExportURLTTL from the moment it is handed out.
+var (
+	ExportRetention = 24 * time.Hour
+	ExportURLTTL    = 15 * time.Minute
+	ExportTimeout   = 5 * time.Minute
+	ExportSigner    = NewURLSigner(nil)
+)
+
+var (
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+)
+
+// URLSigner creates and checks time-limited HMAC-SHA256 signed URLs. The first
+// key signs; every key verifies, so keys can be rotated without breaking links
+// that are already out.
+type URLSigner struct {
+	mu   sync.RWMutex
+	keys [][]byte
+	now  func() time.Time
+}
+
+// NewURLSigner returns a signer for keys. With no keys it generates a random one,
+// which only works while a single replica serves both the link and the download.
+func NewURLSigner(keys [][]byte) *URLSigner {
+	if len(keys) == 0 {
+		k := make([]byte, 32)
+		if _, err := rand.Read(k); err != nil {
+			panic(fmt.Sprintf("failed to generate URL signing key: %v", err))
+		}
+		keys = [][]byte{k}
+	}
+	return &URLSigner{keys: keys, now: time.Now}
+}
+
+// ParseSigningKeys splits a comma- or newline-separated key list. Each key must be
+// at least 32 bytes.
+func ParseSigningKeys(v string) ([][]byte, error) {
+	var keys [][]byte
+	for _, k := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		k = strings.TrimSpace(k)
+		if len(k) < 32 {
+			return nil, fmt.Errorf("signing keys must be at least 32 bytes")
+		}
+		keys = append(keys, []byte(k))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+// SetKeys replaces the signing keys, e.g. after rotation. Put the new key first
+// and keep the previous one until links signed with it have expired.
+func (s *URLSigner) SetKeys(keys [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+// Sign returns path with expires and sig query parameters.
+func (s *URLSigner) Sign(path string, ttl time.Duration) string {
+	s.mu.RLock()
+	key := s.keys[0]
+	s.mu.RUnlock()
+	expires := strconv.FormatInt(s.now().Add(ttl).Unix(), 10)
+	return path + "?" + url.Values{"expires": {expires}, "sig": {s.mac(key, path, expires)}}.Encode()
+}
+
+// Verify checks the signature on a request for path.
+func (s *URLSigner) Verify(path string, query url.Values) error {
+	expires, sig := query.Get("expires"), query.Get("sig")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || sig == "" {
+		return errSignatureInvalid
+	}
+	s.mu.RLock()
+	keys := s.keys
+	s.mu.RUnlock()
+	valid := false
+	for _, k := range keys {
+		if hmac.Equal([]byte(sig), []byte(s.mac(k, path, expires))) {
+			valid = true
+		}
+	}
+	if !valid {
+		return errSignatureInvalid
+	}
+	if s.now().Unix() > exp {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+// mac covers the method, path and expiry, so a URL can't be replayed against
+// another export or have its lifetime extended.
+func (s *URLSigner) mac(key []byte, path, expires string) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "GET\n%s\n%s", path, expires)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// HandleExports serves /exports: POST starts an export, GET lists the caller's exports.
+func (s *Server) HandleExports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+		s.createExport(w, r, format)
+	case http.MethodGet:
+		s.listExports(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleExport serves a single export:
+//
+//	GET /exports/{id}            status, with a fresh download_url once ready
+//	GET /exports/{id}/download   the file; authorized by the signature alone
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/exports/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		s.getExport(w, r, id)
+	case len(parts) == 2 && parts[1] == "download":
+		s.downloadExport(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// isExportDownload reports whether path is a signed download, which bypasses authentication.
+func isExportDownload(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/exports/")
+	if !ok {
+		return false
+	}
+	id, ok := strings.CutSuffix(rest, "/download")
+	if !ok || id == "" {
+		return false
+	}
+	_, err := strconv.ParseInt(id, 10, 64)
+	return err == nil
+}
+
+// createExport starts an export in format: json, csv, or zip for the archive of
+// POST /me/export.
+func (s *Server) createExport(w http.ResponseWriter, r *http.Request, format string) {
+	owner := TodoOwner(r.Context())
+
+	e := Export{Format: format, Status: "pending"}
+	err := s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(r.Context(), s.DB, "insert_export",
+			"INSERT INTO exports (owner_id, format, expires_at) VALUES ($1, $2, now() + $3 * interval '1 second') RETURNING id, created_at, expires_at",
+			owner, format, ExportRetention.Seconds()).Scan(&e.ID, &e.CreatedAt, &e.ExpiresAt)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	// The export outlives the request and runs as a job, with retries.
+	if _, err := s.EnqueueJob(r.Context(), "export", owner, exportJob{ExportID: e.ID, Format: format}); err != nil {
+		s.failExport(r.Context(), e.ID, format)
+		writeDBError(w, err)
+		return
+	}
+
+	slog.Info("Started export", "id", e.ID, "format", format)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/exports/%d", e.ID))
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		slog.Error("Failed to encode export", "error", err)
+	}
+}
+
+func init() {
+	registerJob("export", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: 10 * time.Second, MaxBackoff: time.Minute, Timeout: 10 * time.Minute},
+		run:    (*Server).runExport,
+		failed: func(s *Server, ctx context.Context, job *Job, err error) { s.failExportJob(ctx, job) },
+	})
+}
+
+// exportJob is the payload of an export job.
+type exportJob struct {
+	ExportID int64  `json:"export_id"`
+	Format   string `json:"format"`
+}
+
+// runExport renders the owner's todos and stores the result. Each attempt is bounded
+// by ExportTimeout.
+func (s *Server) runExport(ctx context.Context, job *Job) (any, error) {
+	var p exportJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return nil, permanentJobError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ExportTimeout)
+	defer cancel()
+	content, err := s.renderExport(ctx, job.Owner, p.Format)
+	if err != nil {
+		return nil, err
+	}
+	// Exports hold task text, so they get the same at-rest encryption as todos.
+	sealed, err := s.encryptTask(ctx, string(content))
+	if err != nil {
+		return nil, err
+	}
+	err = s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "complete_export",
+			"UPDATE exports SET status = 'ready', content = $1, error = '', completed_at = now() WHERE id = $2",
+			[]byte(sealed), p.ExportID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ExportsTotal.WithLabelValues(p.Format, "ready").Inc()
+	return p, nil
+}
+
+// failExportJob marks the export of a job that ran out of attempts as failed.
+func (s *Server) failExportJob(ctx context.Context, job *Job) {
+	var p exportJob
+	if err := json.Unmarshal(job.Payload, &p); err == nil {
+		s.failExport(ctx, p.ExportID, p.Format)
+	}
+}
+
+func (s *Server) failExport(ctx context.Context, id int64, format string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err := s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "fail_export",
+			"UPDATE exports SET status = 'failed', content = NULL, error = 'Export failed', completed_at = now() WHERE id = $1", id)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to store export", "id", id, "error", err)
+	}
+	ExportsTotal.WithLabelValues(format, "failed").Inc()
+}
+
+func (s *Server) renderExport(ctx context.Context, owner, format string) ([]byte, error) {
+	var todos []Todo
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DBRead, owner, func(q dbtx) error {
+			rows, err := dbQuery(ctx, q, "export_todos", listTodosQuery, owner)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			todos = []Todo{}
+			for rows.Next() {
+				var t Todo
+				if err := scanTodo(rows, &t); err != nil {
+					return err
+				}
+				todos = append(todos, t)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range todos {
+		if todos[i].Task, err = s.decryptTask(ctx, todos[i].Task); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "zip":
+		err = s.writeUserArchive(ctx, &buf, owner, todos)
+	case "csv":
+		cw := csv.NewWriter(&buf)
+		cw.Write([]string{"id", "task", "completed", "list_id", "due_at"})
+		for _, t := range todos {
+			list, due := "", ""
+			if t.ListID != nil {
+				list = strconv.FormatInt(*t.ListID, 10)
+			}
+			if t.DueAt != nil {
+				due = t.DueAt.UTC().Format(time.RFC3339)
+			}
+			cw.Write([]string{strconv.Itoa(t.ID), t.Task, strconv.FormatBool(t.Completed), list, due})
+		}
+		cw.Flush()
+		err = cw.Error()
+	default:
+		err = json.NewEncoder(&buf).Encode(todos)
+	}
+	return buf.Bytes(), err
+}
+
+const selectExportColumns = "SELECT id, format, status, error, created_at, completed_at, expires_at FROM exports"
+
+func scanExport(row interface{ Scan(...any) error }) (Export, error) {
+	var e Export
+	var completed sql.NullTime
+	err := row.Scan(&e.ID, &e.Format, &e.Status, &e.Error, &e.CreatedAt, &completed, &e.ExpiresAt)
+	if completed.Valid {
+		e.CompletedAt = &completed.Time
+	}
+	return e, err
+}
+
+// withDownloadURL signs a download link for ready exports at now. The link never
+// outlives the export.
+func withDownloadURL(e Export, now time.Time) Export {
+	if e.Status != "ready" {
+		return e
+	}
+	ttl := ExportURLTTL
+	if left := e.ExpiresAt.Sub(now); left < ttl {
+		ttl = left
+	}
+	e.DownloadURL = ExportSigner.Sign(fmt.Sprintf("/exports/%d/download", e.ID), ttl)
+	return e
+}
+
+func (s *Server) listExports(w http.ResponseWriter, r *http.Request) {
+	exports := []Export{}
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(r.Context(), s.DBRead, "list_exports",
+			selectExportColumns+" WHERE owner_id = $1 AND expires_at > now() ORDER BY id DESC", TodoOwner(r.Context()))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		exports = exports[:0]
+		for rows.Next() {
+			e, err := scanExport(rows)
+			if err != nil {
+				return err
+			}
+			exports = append(exports, withDownloadURL(e, s.Clock.Now()))
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(exports); err != nil {
+		slog.Error("Failed to encode exports", "error", err)
+	}
+}
+
+func (s *Server) getExport(w http.ResponseWriter, r *http.Request, id int64) {
+	var e Export
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		e, err = scanExport(dbQueryRow(r.Context(), s.DB, "get_export",
+			selectExportColumns+" WHERE id = $1 AND owner_id = $2 AND expires_at > now()", id, TodoOwner(r.Context())))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(withDownloadURL(e, s.Clock.Now())); err != nil {
+		slog.Error("Failed to encode export", "error", err)
+	}
+}
+
+// downloadExport streams a finished export. The signature is the only credential,
+// so the check happens before touching the database.
+func (s *Server) downloadExport(w http.ResponseWriter, r *http.Request, id int64) {
+	switch err := ExportSigner.Verify(r.URL.Path, r.URL.Query()); err {
+	case nil:
+	case errSignatureExpired:
+		ExportDownloads.WithLabelValues("expired").Inc()
+		http.Error(w, "Download link expired", http.StatusForbidden)
+		return
+	default:
+		ExportDownloads.WithLabelValues("invalid_signature").Inc()
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+
+	var format string
+	var content []byte
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(r.Context(), s.DB, "download_export",
+			"SELECT format, content FROM exports WHERE id = $1 AND status = 'ready' AND expires_at > now()", id).Scan(&format, &content)
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		ExportDownloads.WithLabelValues("not_found").Inc()
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	plain, err := s.decryptTask(r.Context(), string(content))
+	if err != nil {
+		slog.Error("Failed to decrypt export", "id", id, "error", err)
+		http.Error(w, "Encryption service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	content = []byte(plain)
+
+	ExportDownloads.WithLabelValues("ok").Inc()
+	contentType := "application/json"
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "zip":
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="todos-%d.%s"`, id, format))
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	// The URL is a bearer credential; keep it and the file out of shared caches.
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Write(content)
+}
+
+// StartExportJanitor deletes expired exports every interval until ctx is cancelled.
+func (s *Server) StartExportJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "export_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			res, err := dbExec(ctx, s.DB, "purge_exports", "DELETE FROM exports WHERE expires_at < now()")
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge expired exports", "error", err)
+				}
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				slog.Debug("Purged expired exports", "count", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,33 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	todov1 "github.com/stevemcghee/go-to-production/proto/todo/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// NewGatewayHandler serves the /v1 REST API generated from the google.api.http options
+// of todo.v1.TodoService, so that REST and gRPC are one definition. Requests call
+// TodoGRPCServer in-process: they pass through the HTTP middleware (auth, CSRF, abuse
+// protection) and carry its principal, but not the gRPC interceptors.
+//
+// Bodies use the proto3 JSON mapping with the proto field names (list_id), so 64-bit
+// ids are encoded as strings; numbers are accepted on input. WatchTodos has no REST
+// mapping, since in-process calls cannot stream.
+func (s *Server) NewGatewayHandler() http.Handler {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+	)
+	_ = todov1.RegisterTodoServiceHandlerServer(context.Background(), mux, &TodoGRPCServer{server: s, Changes: TodoChanges})
+	return mux
+}
@@ -0,0 +1,158 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+const gcsHost = "storage.googleapis.com"
+
+// GCSStore keeps attachments in a Cloud Storage bucket. URLs are V4-signed by a
+// service account through the IAM Credentials signBlob API, so no private key is
+// needed: the service's identity must have roles/iam.serviceAccountTokenCreator on
+// the signing account, and the signing account access to the bucket.
+type GCSStore struct {
+	bucket         string
+	serviceAccount string
+	objects        *storage.Service
+	iam            *iamcredentials.Service
+}
+
+// NewGCSStore returns a store for bucket whose URLs are signed by serviceAccount (an
+// email address).
+func NewGCSStore(ctx context.Context, bucket, serviceAccount string, opts ...option.ClientOption) (*GCSStore, error) {
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	if !strings.Contains(serviceAccount, "@") {
+		return nil, fmt.Errorf("service account %q must be an email address", serviceAccount)
+	}
+	objects, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	iam, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM credentials client: %w", err)
+	}
+	return &GCSStore{bucket: bucket, serviceAccount: serviceAccount, objects: objects, iam: iam}, nil
+}
+
+// SignURL returns a V4 signed URL; see
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually.
+func (s *GCSStore) SignURL(ctx context.Context, req SignedRequest) (string, error) {
+	now := time.Now().UTC()
+	datetime, scope := now.Format("20060102T150405Z"), now.Format("20060102")+"/auto/storage/goog4_request"
+
+	headers := map[string]string{"host": gcsHost}
+	for k, v := range req.Headers {
+		headers[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := url.Values{}
+	for k, v := range req.Query {
+		query[k] = v
+	}
+	query.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	query.Set("X-Goog-Credential", s.serviceAccount+"/"+scope)
+	query.Set("X-Goog-Date", datetime)
+	query.Set("X-Goog-Expires", strconv.Itoa(int(req.TTL.Seconds())))
+	query.Set("X-Goog-SignedHeaders", signedHeaders)
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, gcsEscape(k)+"="+gcsEscape(query.Get(k)))
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	segments := strings.Split(req.Object, "/")
+	for i, seg := range segments {
+		segments[i] = gcsEscape(seg)
+	}
+	path := "/" + s.bucket + "/" + strings.Join(segments, "/")
+
+	canonicalRequest := strings.Join([]string{req.Method, path, canonicalQuery, canonicalHeaders.String(), signedHeaders, "UNSIGNED-PAYLOAD"}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", datetime, scope, hex.EncodeToString(hash[:])}, "\n")
+	resp, err := s.iam.Projects.ServiceAccounts.SignBlob("projects/-/serviceAccounts/"+s.serviceAccount,
+		&iamcredentials.SignBlobRequest{Payload: base64.StdEncoding.EncodeToString([]byte(stringToSign))}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(resp.SignedBlob)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode signature: %w", err)
+	}
+	return "https://" + gcsHost + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// gcsEscape percent-encodes everything but the unreserved characters of RFC 3986, as
+// V4 signing requires.
+func gcsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *GCSStore) Stat(ctx context.Context, object string) (ObjectInfo, error) {
+	obj, err := s.objects.Objects.Get(s.bucket, object).Context(ctx).Do()
+	if isNotFound(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: int64(obj.Size), ContentType: obj.ContentType}, nil
+}
+
+func (s *GCSStore) Delete(ctx context.Context, object string) error {
+	err := s.objects.Objects.Delete(s.bucket, object).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
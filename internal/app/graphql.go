@@ -0,0 +1,376 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	graphqlotel "github.com/graph-gophers/graphql-go/trace/otel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+var GraphQLOperations = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphql_operations_total",
+		Help: "Total number of GraphQL operations executed, by transport and result",
+	},
+	[]string{"transport", "result"}, // transport: "http", "ws"; result: "ok", "error"
+)
+
+//go:embed schema.graphql
+var graphqlSchemaSDL string
+
+// graphqlSchema returns the /graphql API of s. It reads and writes through the todo
+// store like REST and gRPC; nested lists and their todos are batched per request with
+// dataloaders against the read replica. It is parsed once per server.
+func (s *Server) graphqlSchema() *graphql.Schema {
+	s.graphqlOnce.Do(func() {
+		s.graphql = graphql.MustParseSchema(graphqlSchemaSDL, &graphqlResolver{s},
+			graphql.UseStringDescriptions(),
+			graphql.MaxDepth(8),
+			graphql.MaxQueryLength(16<<10),
+			graphql.Tracer(graphqlotel.DefaultTracer()),
+		)
+	})
+	return s.graphql
+}
+
+// HandleGraphQL serves /graphql: POST executes a query or mutation, and a WebSocket
+// upgrade starts a graphql-transport-ws connection for subscriptions.
+func (s *Server) HandleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveGraphQLWS(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := s.withGraphQLLoaders(r.Context())
+	resp := s.graphqlSchema().Exec(ctx, params.Query, params.OperationName, params.Variables)
+	observeGraphQL("http", resp)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Failed to encode GraphQL response", "error", err)
+	}
+}
+
+func observeGraphQL(transport string, resp *graphql.Response) {
+	result := "ok"
+	if len(resp.Errors) > 0 {
+		result = "error"
+	}
+	GraphQLOperations.WithLabelValues(transport, result).Inc()
+}
+
+type graphqlLoadersKey struct{}
+
+// withGraphQLLoaders returns ctx with fresh dataloaders for one operation.
+func (s *Server) withGraphQLLoaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, graphqlLoadersKey{}, s.newGraphQLLoaders(TodoOwner(ctx)))
+}
+
+func (s *Server) loadersFrom(ctx context.Context) *graphqlLoaders {
+	if l, ok := ctx.Value(graphqlLoadersKey{}).(*graphqlLoaders); ok {
+		return l
+	}
+	return s.newGraphQLLoaders(TodoOwner(ctx))
+}
+
+// graphqlError is a resolver error with a machine-readable extensions.code.
+type graphqlError struct {
+	message string
+	code    string // NOT_FOUND, FORBIDDEN, BAD_USER_INPUT, UNAVAILABLE, INTERNAL
+}
+
+func (e *graphqlError) Error() string { return e.message }
+
+func (e *graphqlError) Extensions() map[string]any { return map[string]any{"code": e.code} }
+
+// graphqlTodoError maps a todo store error to a GraphQL error, as writeTodoError does
+// for HTTP. Database details are logged, not returned.
+func graphqlTodoError(err error) error {
+	switch {
+	case errors.Is(err, errTodoForbidden):
+		return &graphqlError{"you cannot add todos to this list", "FORBIDDEN"}
+	case errors.Is(err, errTodoQuota):
+		return &graphqlError{"todo quota exceeded", "QUOTA_EXCEEDED"}
+	case errors.Is(err, errTodoBlocked):
+		return &graphqlError{"todo is blocked by open todos", "BLOCKED"}
+	case errors.Is(err, errInvalidTask):
+		return &graphqlError{err.Error(), "BAD_USER_INPUT"}
+	case errors.Is(err, errTaskCipher):
+		return &graphqlError{"encryption service unavailable", "UNAVAILABLE"}
+	case errors.Is(err, gobreaker.ErrOpenState):
+		return &graphqlError{"service unavailable (circuit breaker open)", "UNAVAILABLE"}
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	slog.Error("Database operation failed", "error", err)
+	return &graphqlError{"internal error", "INTERNAL"}
+}
+
+// graphqlRequireWrite rejects mutations from callers without the write scope. Queries
+// need only read, which AuthMiddleware (or the WebSocket handshake) already checked.
+func graphqlRequireWrite(ctx context.Context) error {
+	if p, ok := PrincipalFromContext(ctx); ok && !p.HasScope(ScopeWrite) {
+		AuthFailures.WithLabelValues("forbidden").Inc()
+		return &graphqlError{"missing scope " + ScopeWrite, "FORBIDDEN"}
+	}
+	return nil
+}
+
+func parseGraphQLID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, &graphqlError{"invalid id " + strconv.Quote(string(id)), "BAD_USER_INPUT"}
+	}
+	return n, nil
+}
+
+func graphqlID(id int64) graphql.ID { return graphql.ID(strconv.FormatInt(id, 10)) }
+
+// graphqlResolver resolves the Query, Mutation and Subscription fields.
+type graphqlResolver struct{ server *Server }
+
+func (r *graphqlResolver) Todos(ctx context.Context) ([]*todoResolver, error) {
+	todos, err := r.server.listTodos(ctx, TodoOwner(ctx))
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	return r.server.todoResolvers(ctx, todos), nil
+}
+
+func (r *graphqlResolver) Todo(ctx context.Context, args struct{ ID graphql.ID }) (*todoResolver, error) {
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.server.Todos.Get(ctx, TodoOwner(ctx), int(id), false)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	return r.server.todoResolvers(ctx, []Todo{t})[0], nil
+}
+
+func (r *graphqlResolver) Lists(ctx context.Context) ([]*listResolver, error) {
+	lists, err := r.server.userLists(ctx, TodoOwner(ctx))
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	ids := make([]int64, len(lists))
+	res := make([]*listResolver, len(lists))
+	for i, l := range lists {
+		ids[i] = l.ID
+		res[i] = &listResolver{r.server, l}
+	}
+	r.server.loadersFrom(ctx).listTodos.Prefetch(ctx, ids...)
+	return res, nil
+}
+
+func (r *graphqlResolver) CreateTodo(ctx context.Context, args struct {
+	Task   string
+	ListID *graphql.ID
+}) (*todoResolver, error) {
+	if err := graphqlRequireWrite(ctx); err != nil {
+		return nil, err
+	}
+	var listID *int64
+	if args.ListID != nil {
+		id, err := parseGraphQLID(*args.ListID)
+		if err != nil {
+			return nil, err
+		}
+		listID = &id
+	}
+	t, err := r.server.Todos.Create(ctx, TodoOwner(ctx), args.Task, listID)
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	return r.server.todoResolvers(ctx, []Todo{t})[0], nil
+}
+
+func (r *graphqlResolver) UpdateTodo(ctx context.Context, args struct {
+	ID        graphql.ID
+	Completed bool
+}) (*todoResolver, error) {
+	if err := graphqlRequireWrite(ctx); err != nil {
+		return nil, err
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	owner := TodoOwner(ctx)
+	found, err := r.server.Todos.SetCompleted(ctx, owner, int(id), args.Completed)
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	if !found {
+		return nil, nil
+	}
+	t, err := r.server.Todos.Get(ctx, owner, int(id), true)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	return r.server.todoResolvers(ctx, []Todo{t})[0], nil
+}
+
+func (r *graphqlResolver) DeleteTodo(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if err := graphqlRequireWrite(ctx); err != nil {
+		return false, err
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return false, err
+	}
+	found, err := r.server.Todos.Delete(ctx, TodoOwner(ctx), int(id))
+	if err != nil {
+		return false, graphqlTodoError(err)
+	}
+	return found, nil
+}
+
+// TodoChanged streams the changes the caller can see, checked like WatchTodos. The
+// channel is closed, completing the subscription, when the change feed is interrupted.
+func (r *graphqlResolver) TodoChanged(ctx context.Context) (<-chan *todoEventResolver, error) {
+	owner := TodoOwner(ctx)
+	sub := TodoChanges.Subscribe()
+	events := make(chan *todoEventResolver)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		for {
+			var c TodoChange
+			select {
+			case <-ctx.Done():
+				return
+			case change, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				c = change
+			}
+			t, ok, err := r.server.visibleChange(ctx, owner, c)
+			if err != nil {
+				slog.Warn("Ending todo subscription", "error", err)
+				return
+			}
+			if !ok {
+				continue
+			}
+			ev := &todoEventResolver{typ: "UPDATED", id: int64(t.ID)}
+			switch c.Op {
+			case "insert":
+				ev.typ = "CREATED"
+			case "delete":
+				ev.typ = "DELETED"
+			}
+			if c.Op != "delete" {
+				ev.todo = r.server.todoResolvers(r.server.withGraphQLLoaders(ctx), []Todo{t})[0]
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// todoResolvers wraps todos, prefetching their lists in one batch.
+func (s *Server) todoResolvers(ctx context.Context, todos []Todo) []*todoResolver {
+	var listIDs []int64
+	res := make([]*todoResolver, len(todos))
+	for i, t := range todos {
+		if t.ListID != nil {
+			listIDs = append(listIDs, *t.ListID)
+		}
+		res[i] = &todoResolver{s, t}
+	}
+	if len(listIDs) > 0 {
+		s.loadersFrom(ctx).lists.Prefetch(ctx, listIDs...)
+	}
+	return res
+}
+
+type todoResolver struct {
+	server *Server
+	t      Todo
+}
+
+func (r *todoResolver) ID() graphql.ID  { return graphqlID(int64(r.t.ID)) }
+func (r *todoResolver) Task() string    { return r.t.Task }
+func (r *todoResolver) Completed() bool { return r.t.Completed }
+
+func (r *todoResolver) List(ctx context.Context) (*listResolver, error) {
+	if r.t.ListID == nil {
+		return nil, nil
+	}
+	l, found, err := r.server.loadersFrom(ctx).lists.Load(ctx, *r.t.ListID)
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	if !found { // the caller left the list since the todo was read
+		return nil, nil
+	}
+	return &listResolver{r.server, l}, nil
+}
+
+type listResolver struct {
+	server *Server
+	l      TodoList
+}
+
+func (r *listResolver) ID() graphql.ID { return graphqlID(r.l.ID) }
+func (r *listResolver) Name() string   { return r.l.Name }
+func (r *listResolver) Role() string   { return r.l.Role }
+
+func (r *listResolver) Todos(ctx context.Context) ([]*todoResolver, error) {
+	todos, _, err := r.server.loadersFrom(ctx).listTodos.Load(ctx, r.l.ID)
+	if err != nil {
+		return nil, graphqlTodoError(err)
+	}
+	return r.server.todoResolvers(ctx, todos), nil
+}
+
+type todoEventResolver struct {
+	typ  string
+	id   int64
+	todo *todoResolver
+}
+
+func (r *todoEventResolver) Type() string        { return r.typ }
+func (r *todoEventResolver) ID() graphql.ID      { return graphqlID(r.id) }
+func (r *todoEventResolver) Todo() *todoResolver { return r.todo }
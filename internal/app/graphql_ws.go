@@ -0,0 +1,308 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var GraphQLSubscriptions = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "graphql_ws_operations",
+		Help: "Number of operations running on GraphQL WebSocket connections",
+	},
+)
+
+// GraphQL over WebSocket, following the graphql-transport-ws protocol of the
+// graphql-ws library (https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md).
+const (
+	graphqlWSProtocol     = "graphql-transport-ws"
+	graphqlWSInitTimeout  = 10 * time.Second
+	graphqlWSPingInterval = 25 * time.Second
+	graphqlWSPongWait     = 60 * time.Second
+	graphqlWSWriteWait    = 10 * time.Second
+	graphqlWSMaxOps       = 20
+)
+
+// Close codes of graphql-transport-ws.
+const (
+	wsCloseBadRequest      = 4400
+	wsCloseUnauthorized    = 4401
+	wsCloseForbidden       = 4403
+	wsCloseInitTimeout     = 4408
+	wsCloseDuplicateID     = 4409
+	wsCloseTooManyInits    = 4429
+	wsCloseTooManyRequests = 4430 // our own: more than graphqlWSMaxOps operations at once
+)
+
+// The default CheckOrigin rejects cross-origin upgrades, so other sites cannot open a
+// connection with the user's session cookie.
+var graphqlUpgrader = websocket.Upgrader{Subprotocols: []string{graphqlWSProtocol}}
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// hijackableWriter gives the upgrader http.Hijacker through any middleware wrappers.
+type hijackableWriter struct{ http.ResponseWriter }
+
+func (w hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// graphqlWSConn is one WebSocket connection. Messages are written by a single writer
+// goroutine from out; when the client reads too slowly out fills up, which blocks the
+// subscriptions until the change feed drops them.
+type graphqlWSConn struct {
+	server *Server
+	conn   *websocket.Conn
+	req    *http.Request
+	out    chan wsMessage
+
+	mu  sync.Mutex
+	ctx context.Context // carries the principal once connection_init succeeded
+	ops map[string]context.CancelFunc
+}
+
+// serveGraphQLWS upgrades r and serves graphql-transport-ws on it. The connection is
+// authenticated once, by connection_init: credentials in its payload ("x-api-key" or
+// "authorization") take precedence over those of the upgrade request (session cookie,
+// mTLS). AuthMiddleware lets the upgrade through for that reason.
+func (s *Server) serveGraphQLWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := graphqlUpgrader.Upgrade(hijackableWriter{w}, r, nil)
+	if err != nil {
+		return // the upgrader replied with an error
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != graphqlWSProtocol {
+		wsClose(conn, websocket.CloseProtocolError, "unsupported subprotocol, use "+graphqlWSProtocol)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	c := &graphqlWSConn{server: s, conn: conn, req: r, out: make(chan wsMessage, 16), ops: make(map[string]context.CancelFunc)}
+	go c.writeLoop(ctx)
+	c.readLoop(ctx)
+}
+
+func (c *graphqlWSConn) readLoop(ctx context.Context) {
+	c.conn.SetReadLimit(1 << 20)
+	c.conn.SetReadDeadline(time.Now().Add(graphqlWSInitTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(graphqlWSPongWait))
+	})
+
+	for {
+		var msg wsMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.mu.Lock()
+			initialized := c.ctx != nil
+			c.mu.Unlock()
+			var netErr net.Error
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			switch {
+			case !initialized && errors.As(err, &netErr) && netErr.Timeout():
+				wsClose(c.conn, wsCloseInitTimeout, "Connection initialisation timeout")
+			case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+				wsClose(c.conn, wsCloseBadRequest, "Invalid message")
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			if !c.init(ctx, msg.Payload) {
+				return
+			}
+			c.conn.SetReadDeadline(time.Now().Add(graphqlWSPongWait))
+		case "ping":
+			c.send(ctx, wsMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !c.subscribe(msg) {
+				return
+			}
+		case "complete":
+			c.mu.Lock()
+			if cancel, ok := c.ops[msg.ID]; ok {
+				cancel()
+			}
+			c.mu.Unlock()
+		default:
+			wsClose(c.conn, wsCloseBadRequest, "Invalid message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// init authenticates the connection, and reports whether it may continue.
+func (c *graphqlWSConn) init(ctx context.Context, payload json.RawMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx != nil {
+		wsClose(c.conn, wsCloseTooManyInits, "Too many initialisation requests")
+		return false
+	}
+
+	r := c.req
+	var params map[string]any
+	_ = json.Unmarshal(payload, &params)
+	for k, v := range params {
+		s, _ := v.(string)
+		switch {
+		case s == "":
+		case strings.EqualFold(k, APIKeyHeader), strings.EqualFold(k, "Authorization"):
+			if r == c.req {
+				r = c.req.Clone(c.req.Context())
+				r.Header.Del(APIKeyHeader)
+				r.Header.Del("Authorization")
+			}
+			r.Header.Set(k, s)
+		}
+	}
+
+	p, reason, err := c.server.authorizeRequest(r, ScopeRead)
+	switch reason {
+	case "":
+	case "unavailable":
+		slog.Error("Authentication backend unavailable", "error", err)
+		wsClose(c.conn, websocket.CloseTryAgainLater, "Authentication temporarily unavailable")
+		return false
+	case "forbidden":
+		wsClose(c.conn, wsCloseForbidden, "Forbidden")
+		return false
+	default:
+		wsClose(c.conn, wsCloseUnauthorized, "Unauthorized")
+		return false
+	}
+	c.ctx = ctx
+	if p != nil {
+		c.ctx = WithPrincipal(ctx, p)
+	}
+	c.send(ctx, wsMessage{Type: "connection_ack"})
+	return true
+}
+
+// subscribe starts an operation, and reports whether the connection may continue.
+func (c *graphqlWSConn) subscribe(msg wsMessage) bool {
+	var params struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if msg.ID == "" || json.Unmarshal(msg.Payload, &params) != nil {
+		wsClose(c.conn, wsCloseBadRequest, "Invalid subscribe message")
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.ctx == nil:
+		wsClose(c.conn, wsCloseUnauthorized, "Unauthorized")
+		return false
+	case c.ops[msg.ID] != nil:
+		wsClose(c.conn, wsCloseDuplicateID, "Subscriber for "+msg.ID+" already exists")
+		return false
+	case len(c.ops) >= graphqlWSMaxOps:
+		wsClose(c.conn, wsCloseTooManyRequests, "Too many operations")
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(c.server.withGraphQLLoaders(c.ctx))
+	c.ops[msg.ID] = cancel
+	GraphQLSubscriptions.Inc()
+	go c.run(ctx, msg.ID, params.Query, params.OperationName, params.Variables)
+	return true
+}
+
+// run executes one operation and sends its results, then completes it.
+func (c *graphqlWSConn) run(ctx context.Context, id, query, operation string, vars map[string]any) {
+	defer func() {
+		c.mu.Lock()
+		if cancel, ok := c.ops[id]; ok {
+			cancel()
+			delete(c.ops, id)
+		}
+		c.mu.Unlock()
+		GraphQLSubscriptions.Dec()
+	}()
+
+	results, err := c.server.graphqlSchema().Subscribe(ctx, query, operation, vars)
+	if err != nil {
+		payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+		c.send(ctx, wsMessage{ID: id, Type: "error", Payload: payload})
+		return
+	}
+	for res := range results {
+		resp := res.(*graphql.Response)
+		observeGraphQL("ws", resp)
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			slog.Error("Failed to encode GraphQL response", "error", err)
+			continue
+		}
+		if !c.send(ctx, wsMessage{ID: id, Type: "next", Payload: payload}) {
+			return
+		}
+	}
+	if ctx.Err() == nil { // not completed by the client
+		c.send(ctx, wsMessage{ID: id, Type: "complete"})
+	}
+}
+
+// send queues msg for the writer, and reports false if ctx ended first.
+func (c *graphqlWSConn) send(ctx context.Context, msg wsMessage) bool {
+	select {
+	case c.out <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *graphqlWSConn) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(graphqlWSPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(graphqlWSWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(graphqlWSWriteWait)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func wsClose(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
@@ -0,0 +1,373 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+	todov1 "github.com/stevemcghee/go-to-production/proto/todo/v1"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+var (
+	GRPCRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "Total number of gRPC calls completed, by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+	GRPCDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Duration of gRPC calls (for streams, until the stream ends)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+)
+
+// GRPCHealth is the standard gRPC health service of the gRPC listener. StartGRPCHealth
+// keeps it in line with the database, like /healthz.
+var GRPCHealth = health.NewServer()
+
+// grpcScopes maps each TodoService method to the scope it needs, as requiredScope does for REST.
+var grpcScopes = map[string]string{
+	todov1.TodoService_ListTodos_FullMethodName:  ScopeRead,
+	todov1.TodoService_GetTodo_FullMethodName:    ScopeRead,
+	todov1.TodoService_WatchTodos_FullMethodName: ScopeRead,
+	todov1.TodoService_CreateTodo_FullMethodName: ScopeWrite,
+	todov1.TodoService_UpdateTodo_FullMethodName: ScopeWrite,
+	todov1.TodoService_DeleteTodo_FullMethodName: ScopeWrite,
+}
+
+// NewGRPCServer returns the gRPC server with TodoService, health and reflection registered.
+// With tlsConfig (server.tls_cert_file) it serves TLS and, with mTLS, authenticates
+// callers by SPIFFE ID exactly like the HTTP listener.
+func (s *Server) NewGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(s.grpcObserveUnary, s.grpcAuthUnary),
+		grpc.ChainStreamInterceptor(s.grpcObserveStream, s.grpcAuthStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs := grpc.NewServer(opts...)
+	todov1.RegisterTodoServiceServer(gs, &TodoGRPCServer{server: s, Changes: TodoChanges})
+	healthpb.RegisterHealthServer(gs, GRPCHealth)
+	reflection.Register(gs)
+	return gs
+}
+
+// StartGRPCHealth pings the primary every interval and reports the result through
+// GRPCHealth, for the server as a whole ("") and for todo.v1.TodoService.
+func (s *Server) StartGRPCHealth(ctx context.Context, interval time.Duration) {
+	set := func(st healthpb.HealthCheckResponse_ServingStatus) {
+		GRPCHealth.SetServingStatus("", st)
+		GRPCHealth.SetServingStatus(todov1.TodoService_ServiceDesc.ServiceName, st)
+	}
+	check := func() {
+		st := healthpb.HealthCheckResponse_SERVING
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		if s.DB == nil || s.DB.PingContext(pingCtx) != nil {
+			st = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		set(st)
+	}
+	check()
+	Workers.Go(ctx, "grpc_health", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				GRPCHealth.Shutdown()
+				return
+			case <-ticker.C:
+				check()
+				w.Checkpoint(nil)
+			}
+		}
+	})
+}
+
+// TodoGRPCServer implements todo.v1.TodoService on the same todo store as the REST API.
+type TodoGRPCServer struct {
+	todov1.UnimplementedTodoServiceServer
+	server  *Server
+	Changes *TodoChangeHub
+}
+
+func (s *TodoGRPCServer) ListTodos(ctx context.Context, _ *todov1.ListTodosRequest) (*todov1.ListTodosResponse, error) {
+	todos, err := s.server.listTodos(ctx, TodoOwner(ctx))
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	resp := &todov1.ListTodosResponse{Todos: make([]*todov1.Todo, len(todos))}
+	for i, t := range todos {
+		resp.Todos[i] = todoProto(t)
+	}
+	return resp, nil
+}
+
+func (s *TodoGRPCServer) GetTodo(ctx context.Context, req *todov1.GetTodoRequest) (*todov1.Todo, error) {
+	t, err := s.server.Todos.Get(ctx, TodoOwner(ctx), int(req.GetId()), false)
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	return todoProto(t), nil
+}
+
+func (s *TodoGRPCServer) CreateTodo(ctx context.Context, req *todov1.CreateTodoRequest) (*todov1.Todo, error) {
+	t, err := s.server.Todos.Create(ctx, TodoOwner(ctx), req.GetTask(), req.ListId)
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	return todoProto(t), nil
+}
+
+func (s *TodoGRPCServer) UpdateTodo(ctx context.Context, req *todov1.UpdateTodoRequest) (*todov1.Todo, error) {
+	owner := TodoOwner(ctx)
+	found, err := s.server.Todos.SetCompleted(ctx, owner, int(req.GetId()), req.GetCompleted())
+	if err == nil && !found {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	t, err := s.server.Todos.Get(ctx, owner, int(req.GetId()), true)
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	return todoProto(t), nil
+}
+
+func (s *TodoGRPCServer) DeleteTodo(ctx context.Context, req *todov1.DeleteTodoRequest) (*emptypb.Empty, error) {
+	found, err := s.server.Todos.Delete(ctx, TodoOwner(ctx), int(req.GetId()))
+	if err == nil && !found {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, grpcTodoError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// WatchTodos streams the changes the caller can see. Each change is checked against
+// the caller's visibility (visibleChange) before it is sent.
+func (s *TodoGRPCServer) WatchTodos(_ *todov1.WatchTodosRequest, stream todov1.TodoService_WatchTodosServer) error {
+	ctx := stream.Context()
+	owner := TodoOwner(ctx)
+	sub := s.Changes.Subscribe()
+	defer sub.Close()
+	// Tell the client the subscription is in place, so it can ListTodos without a gap.
+	if err := stream.SendHeader(metadata.Pairs("x-watch-started", "true")); err != nil {
+		return err
+	}
+
+	for {
+		var c TodoChange
+		select {
+		case <-ctx.Done():
+			return nil
+		case change, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					return status.Error(codes.Unavailable, "change feed interrupted; call ListTodos and watch again")
+				}
+				return nil
+			}
+			c = change
+		}
+		t, ok, err := s.server.visibleChange(ctx, owner, c)
+		if err != nil {
+			return grpcTodoError(err)
+		}
+		if !ok {
+			continue
+		}
+		ev := &todov1.TodoEvent{Type: todov1.TodoEvent_TYPE_UPDATED, Todo: todoProto(t)}
+		switch c.Op {
+		case "insert":
+			ev.Type = todov1.TodoEvent_TYPE_CREATED
+		case "delete":
+			ev.Type = todov1.TodoEvent_TYPE_DELETED
+		}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func todoProto(t Todo) *todov1.Todo {
+	return &todov1.Todo{Id: int64(t.ID), Task: t.Task, Completed: t.Completed, ListId: t.ListID}
+}
+
+// grpcTodoError maps a todo store error to a gRPC status, as writeTodoError does for HTTP.
+func grpcTodoError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, "todo not found")
+	case errors.Is(err, errTodoForbidden):
+		return status.Error(codes.PermissionDenied, "you cannot add todos to this list")
+	case errors.Is(err, errTodoQuota):
+		return status.Error(codes.ResourceExhausted, "todo quota exceeded")
+	case errors.Is(err, errTodoBlocked):
+		return status.Error(codes.FailedPrecondition, "todo is blocked by open todos")
+	case errors.Is(err, errInvalidTask):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errTaskCipher):
+		return status.Error(codes.Unavailable, "encryption service unavailable")
+	case errors.Is(err, gobreaker.ErrOpenState):
+		return status.Error(codes.Unavailable, "service unavailable (circuit breaker open)")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	slog.Error("Database operation failed", "error", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// grpcAuthorize applies the auth mode and scopes of AuthMiddleware to a call and
+// returns the context to run it with. Calls authenticate with the same credentials as
+// HTTP requests: API key and bearer token from metadata, client certificate from the
+// TLS connection. Session cookies do not apply.
+func (s *Server) grpcAuthorize(ctx context.Context, method string) (context.Context, error) {
+	scope, ok := grpcScopes[method]
+	if !ok { // health checks and reflection
+		return ctx, nil
+	}
+	r := (&http.Request{Header: http.Header{}}).WithContext(ctx)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, h := range []string{APIKeyHeader, "Authorization"} {
+			if v := md.Get(h); len(v) > 0 {
+				r.Header.Set(h, v[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+
+	p, reason, err := s.authorizeRequest(r, scope)
+	switch reason {
+	case "":
+	case "invalid":
+		slog.Warn("Rejected invalid credentials", "method", method)
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	case "unavailable":
+		slog.Error("Authentication backend unavailable", "error", err)
+		return nil, status.Error(codes.Unavailable, "authentication temporarily unavailable")
+	case "missing":
+		return nil, status.Error(codes.Unauthenticated, "credentials required")
+	default:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if p == nil {
+		return ctx, nil
+	}
+	return WithPrincipal(ctx, p), nil
+}
+
+func (s *Server) grpcAuthUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.grpcAuthorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	if err == nil && grpcScopes[info.FullMethod] == ScopeWrite {
+		// Like TodoCacheMiddleware: callers read their own writes at once.
+		invalidateTodoCache(ctx, "write", TodoOwner(ctx))
+	}
+	return resp, err
+}
+
+func (s *Server) grpcAuthStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+func (s *Server) grpcObserveUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	start := s.Clock.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			err = s.grpcRecovered(ctx, info.FullMethod, p)
+		}
+		s.grpcObserve(info.FullMethod, start, err)
+	}()
+	return handler(ctx, req)
+}
+
+func (s *Server) grpcObserveStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	start := s.Clock.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			err = s.grpcRecovered(ss.Context(), info.FullMethod, p)
+		}
+		s.grpcObserve(info.FullMethod, start, err)
+	}()
+	return handler(srv, ss)
+}
+
+func (s *Server) grpcObserve(method string, start time.Time, err error) {
+	GRPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	GRPCDuration.WithLabelValues(method).Observe(s.Clock.Now().Sub(start).Seconds())
+}
+
+// grpcRecovered reports a panic in a gRPC handler like ErrorReportingMiddleware does
+// for HTTP, and turns it into an INTERNAL status.
+func (s *Server) grpcRecovered(ctx context.Context, method string, p any) error {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(4, pcs)
+	slog.Error("Recovered from panic in gRPC handler", "panic", p, "method", method)
+	reportError(ctx, ErrorEvent{
+		Kind:    "panic",
+		Message: fmt.Sprintf("panic: %v", p),
+		Stack:   debug.Stack(),
+		Frames:  pcs[:n],
+		Method:  "gRPC",
+		URL:     method,
+		Status:  http.StatusInternalServerError,
+		Release: ErrorRelease,
+		Time:    s.Clock.Now(),
+	})
+	return status.Error(codes.Internal, "internal error")
+}
@@ -0,0 +1,156 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ProcessStartTime is when the application started, used for uptime reporting.
+var ProcessStartTime = time.Now()
+
+var (
+	UptimeSeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "app_uptime_seconds",
+			Help: "Seconds since the application started (updated by the heartbeat)",
+		},
+	)
+	HeartbeatTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "app_heartbeat_timestamp_seconds",
+			Help: "Unix time of the last heartbeat; a stale value means the process is wedged",
+		},
+	)
+	HeartbeatAnomalies = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_heartbeat_anomalies_total",
+			Help: "Total number of resource growth anomalies flagged by the heartbeat",
+		},
+		[]string{"kind"}, // "goroutines", "fds"
+	)
+)
+
+// HeartbeatConfig controls the heartbeat and its leak heuristics.
+type HeartbeatConfig struct {
+	Interval time.Duration
+	// A resource is flagged when it has grown for Window consecutive heartbeats
+	// and is above GrowthFactor times its baseline (the lowest value seen).
+	Window       int
+	GrowthFactor float64
+	// MinAbsolute avoids flagging tiny numbers (e.g. 10 -> 25 goroutines).
+	MinAbsolute int
+}
+
+// DefaultHeartbeatConfig returns conservative defaults suitable for production.
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		Interval:     time.Minute,
+		Window:       5,
+		GrowthFactor: 2,
+		MinAbsolute:  100,
+	}
+}
+
+// LeakDetector flags sustained growth of a resource counter relative to its baseline.
+// It is deliberately simple: a leak looks like a value that keeps rising and never
+// returns to where it started, while normal load fluctuates up and down.
+type LeakDetector struct {
+	cfg      HeartbeatConfig
+	baseline int
+	last     int
+	rising   int
+	seen     bool
+}
+
+// NewLeakDetector returns a detector using the window and thresholds in cfg.
+func NewLeakDetector(cfg HeartbeatConfig) *LeakDetector {
+	return &LeakDetector{cfg: cfg}
+}
+
+// Observe records a sample and reports whether it looks like a leak.
+func (d *LeakDetector) Observe(v int) bool {
+	if !d.seen {
+		d.seen, d.baseline, d.last = true, v, v
+		return false
+	}
+	if v < d.baseline {
+		d.baseline = v
+	}
+	if v > d.last {
+		d.rising++
+	} else {
+		d.rising = 0
+	}
+	d.last = v
+	return d.rising >= d.cfg.Window &&
+		v >= d.cfg.MinAbsolute &&
+		float64(v) > float64(d.baseline)*d.cfg.GrowthFactor
+}
+
+// StartHeartbeat periodically logs and exports process health until ctx is cancelled,
+// warning when goroutine or file descriptor counts grow like a leak.
+// Goroutine, FD and memory gauges themselves are exported by the default Prometheus
+// Go and process collectors; the heartbeat adds uptime, liveness and anomaly detection.
+func StartHeartbeat(ctx context.Context, cfg HeartbeatConfig) {
+	goroutines := NewLeakDetector(cfg)
+	fds := NewLeakDetector(cfg)
+
+	Workers.Go(ctx, "heartbeat", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			uptime := time.Since(ProcessStartTime)
+			numGoroutines := runtime.NumGoroutine()
+			numFDs := openFDCount()
+
+			UptimeSeconds.Set(uptime.Seconds())
+			HeartbeatTimestamp.SetToCurrentTime()
+
+			slog.Info("Heartbeat",
+				"uptime", uptime.Round(time.Second).String(),
+				"goroutines", numGoroutines,
+				"open_fds", numFDs,
+				"heap_alloc_bytes", mem.HeapAlloc,
+				"sys_bytes", mem.Sys,
+				"num_gc", mem.NumGC,
+			)
+
+			if goroutines.Observe(numGoroutines) {
+				HeartbeatAnomalies.WithLabelValues("goroutines").Inc()
+				slog.Warn("Possible goroutine leak: goroutine count keeps growing", "goroutines", numGoroutines, "baseline", goroutines.baseline)
+			}
+			if numFDs >= 0 && fds.Observe(numFDs) {
+				HeartbeatAnomalies.WithLabelValues("fds").Inc()
+				slog.Warn("Possible file descriptor leak: open FD count keeps growing", "open_fds", numFDs, "baseline", fds.baseline)
+			}
+			w.Checkpoint(nil)
+		}
+	})
+}
+
+// openFDCount returns the number of open file descriptors, or -1 where /proc is unavailable.
+func openFDCount() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
@@ -0,0 +1,95 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"log/slog"
+	"net/http"
+)
+
+// ServerRenderedUI serves a UI rendered on the server (templates/htmx.html) at / instead
+// of the static/app.js client (server.ui: htmx). Its page loads HTMX from unpkg.com and
+// talks to the same todo handlers, which answer HTMX requests with HTML fragments
+// (templates/todos.html) instead of JSON.
+var ServerRenderedUI = false
+
+// htmxVersion pins the htmx.org release the server-rendered UI loads.
+const htmxVersion = "2.0.3"
+
+// isHTMX reports requests made by HTMX. HX-Request is spelled in its canonical form,
+// which Get looks up without allocating.
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("Hx-Request") == "true"
+}
+
+// serveRenderedUI renders the page of a with the caller's todos. / is a public path,
+// so the page authenticates the caller itself and shows no todos to callers who may
+// not read them.
+func (s *Server) serveRenderedUI(a *Assets, w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		HTMXVersion string
+		CSRFToken   string
+		SignedInAs  string
+		Todos       []Todo
+	}{HTMXVersion: htmxVersion, CSRFToken: EnsureCSRFCookie(w, r)}
+
+	if p, reason, _ := s.authorizeRequest(r, ScopeRead); reason == "" {
+		ctx := r.Context()
+		if p != nil {
+			ctx = WithPrincipal(ctx, p)
+			if p.UserID != "" {
+				page.SignedInAs = cmp.Or(p.Email, p.Subject)
+			}
+		}
+		todos, err := s.listTodos(ctx, TodoOwner(ctx))
+		if err != nil {
+			writeTodoError(w, err)
+			return
+		}
+		page.Todos = todos
+	}
+
+	var b bytes.Buffer
+	if err := a.ui.ExecuteTemplate(&b, "htmx.html", page); err != nil {
+		slog.Error("Failed to render the UI", "error", err)
+		http.Error(w, "Failed to render the page", http.StatusInternalServerError)
+		return
+	}
+	// The security headers allow scripts from this origin only.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' https://unpkg.com; style-src 'self' 'unsafe-inline'; img-src 'self' data: https:")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// writeTodoFragment answers an HTMX request with the HTML of a Todo or []Todo. A
+// created todo comes with an empty form, swapped in out of band.
+func writeTodoFragment(w http.ResponseWriter, status int, v any) {
+	name := "todo"
+	switch v.(type) {
+	case []Todo:
+		name = "todos"
+	case Todo:
+		if status == http.StatusCreated {
+			name = "created"
+		}
+	}
+	if WebAssets == nil {
+		http.Error(w, "The UI is not available", http.StatusNotFound)
+		return
+	}
+	b := getBuffer()
+	defer putBuffer(b)
+	if err := WebAssets.ui.ExecuteTemplate(b, name, v); err != nil {
+		slog.Error("Failed to render todos", "error", err)
+		http.Error(w, "Failed to render todos", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,235 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var IdempotencyRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "idempotency_requests_total",
+		Help: "Total number of POST requests with an Idempotency-Key, by outcome",
+	},
+	[]string{"result"}, // "new", "replayed", "in_progress", "mismatch"
+)
+
+// IdempotencyKeyHeader makes a POST safe to retry: a request repeating the key of an
+// earlier one by the same caller gets the stored response of the first instead of
+// being run again (marked by IdempotentReplayedHeader).
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotencyKeyTTL is how long a response is kept for replays.
+var IdempotencyKeyTTL = 24 * time.Hour
+
+const (
+	idempotencyMaxBody = 1 << 20
+	// An unfinished request older than this is taken to have died with its replica,
+	// and a retry runs it again.
+	idempotencyLease = time.Minute
+)
+
+// claimIdempotencyKeyQuery creates the row for a new key, or takes over one that
+// expired or was abandoned. It returns no row when the key is taken.
+const claimIdempotencyKeyQuery = `INSERT INTO idempotency_keys (owner_id, key, request_hash, expires_at)
+VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+ON CONFLICT (owner_id, key) DO UPDATE
+SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = '', location = '', body = '',
+	created_at = now(), completed_at = NULL, expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at < now()
+	OR (idempotency_keys.completed_at IS NULL AND idempotency_keys.created_at < now() - $5 * interval '1 second')
+RETURNING true`
+
+// IdempotencyMiddleware serves POST requests that carry an Idempotency-Key at most
+// once per caller and key. Reusing a key for a different request (method, path,
+// query or body) is rejected with 422, and repeating it while the first request is
+// still running gets 409. Responses with a 5xx status are not stored, so those can
+// be retried. Sign-in endpoints are left alone, as their cookies are not stored.
+func (s *Server) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" || strings.HasPrefix(r.URL.Path, "/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBody))
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+		h.Write(body)
+		hash := hex.EncodeToString(h.Sum(nil))
+
+		ctx := r.Context()
+		owner := TodoOwner(ctx)
+		var claimed bool
+		var prev struct {
+			hash, contentType, location, body string
+			status                            sql.NullInt64
+		}
+		err = s.ExecuteWithRobustness(func() error {
+			err := dbQueryRow(ctx, s.DB, "claim_idempotency_key", claimIdempotencyKeyQuery,
+				owner, key, hash, IdempotencyKeyTTL.Seconds(), idempotencyLease.Seconds()).Scan(&claimed)
+			if err != sql.ErrNoRows {
+				return err
+			}
+			claimed = false
+			return dbQueryRow(ctx, s.DB, "get_idempotency_key",
+				"SELECT request_hash, status_code, content_type, location, body FROM idempotency_keys WHERE owner_id = $1 AND key = $2",
+				owner, key).Scan(&prev.hash, &prev.status, &prev.contentType, &prev.location, &prev.body)
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		if !claimed {
+			switch {
+			case prev.hash != hash:
+				IdempotencyRequests.WithLabelValues("mismatch").Inc()
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+			case !prev.status.Valid:
+				IdempotencyRequests.WithLabelValues("in_progress").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+			default:
+				s.replayIdempotentResponse(w, r, int(prev.status.Int64), prev.contentType, prev.location, prev.body)
+			}
+			return
+		}
+
+		IdempotencyRequests.WithLabelValues("new").Inc()
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// Store even if the client is gone: that is when it retries.
+		s.storeIdempotentResponse(context.WithoutCancel(ctx), owner, key, rec)
+	})
+}
+
+func (s *Server) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, status int, contentType, location, sealed string) {
+	body, err := s.decryptTask(r.Context(), sealed)
+	if err != nil {
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+	if contentType == ProtobufContentType {
+		raw, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		body = string(raw)
+	}
+	IdempotencyRequests.WithLabelValues("replayed").Inc()
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+// storeIdempotentResponse saves the response for replays, or releases the key when
+// the response should not be replayed.
+func (s *Server) storeIdempotentResponse(ctx context.Context, owner, key string, rec *idempotencyRecorder) {
+	var err error
+	if rec.status >= 500 || rec.overflow {
+		_, err = dbExec(ctx, s.DB, "release_idempotency_key", "DELETE FROM idempotency_keys WHERE owner_id = $1 AND key = $2", owner, key)
+	} else {
+		body := rec.body.String()
+		if rec.Header().Get("Content-Type") == ProtobufContentType {
+			// body is TEXT, which cannot hold the binary wire format.
+			body = base64.StdEncoding.EncodeToString(rec.body.Bytes())
+		}
+		var sealed string
+		if sealed, err = s.encryptTask(ctx, body); err == nil {
+			_, err = dbExec(ctx, s.DB, "store_idempotency_key",
+				"UPDATE idempotency_keys SET status_code = $3, content_type = $4, location = $5, body = $6, completed_at = now() WHERE owner_id = $1 AND key = $2",
+				owner, key, rec.status, rec.Header().Get("Content-Type"), rec.Header().Get("Location"), sealed)
+		}
+	}
+	if err != nil {
+		// A retry runs the request again once the lease is over.
+		slog.Warn("Failed to store the response for an Idempotency-Key", "error", err)
+	}
+}
+
+// idempotencyRecorder passes the response through and keeps a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.body.Len()+len(b) > idempotencyMaxBody {
+		rec.overflow = true
+	} else {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+// StartIdempotencyJanitor deletes expired idempotency keys every interval until ctx
+// is cancelled.
+func (s *Server) StartIdempotencyJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "idempotency_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			res, err := dbExec(ctx, s.DB, "purge_idempotency_keys", "DELETE FROM idempotency_keys WHERE expires_at < now()")
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge expired idempotency keys", "error", err)
+				}
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				slog.Debug("Purged expired idempotency keys", "count", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import limits: a body holds at most maxImportTodos todos in maxImportBytes.
+const (
+	maxImportTodos = 10000
+	maxImportBytes = 5 << 20
+)
+
+func init() {
+	registerJob("import", jobKind{
+		policy: RetryPolicy{MaxAttempts: 5, MinBackoff: 10 * time.Second, MaxBackoff: 5 * time.Minute, Timeout: 10 * time.Minute},
+		run:    (*Server).runImport,
+	})
+}
+
+// importProgress is the result of an import job, saved as it goes.
+type importProgress struct {
+	Total   int `json:"total"`
+	Done    int `json:"done"` // todos processed, created or skipped
+	Created int `json:"created"`
+	Skipped int `json:"skipped"` // into lists the caller may not edit, or with task text that cannot be stored
+}
+
+// HandleImports serves POST /imports: creates the todos of a JSON array (as in GET
+// /todos) or a CSV file (as in a CSV export, with a task column) as a job, and
+// returns the job, 202 with Location /jobs/{id}. The body's ids are ignored.
+func (s *Server) HandleImports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := TodoOwner(r.Context())
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		http.Error(w, "Import too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var todos []Todo
+	if mediaType == "text/csv" {
+		todos, err = parseImportCSV(body)
+	} else {
+		err = json.Unmarshal(body, &todos)
+	}
+	if err != nil {
+		http.Error(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(todos) == 0 || len(todos) > maxImportTodos {
+		http.Error(w, fmt.Sprintf("An import has 1 to %d todos", maxImportTodos), http.StatusBadRequest)
+		return
+	}
+
+	// The payload waits in the jobs table, so it gets the same at-rest encryption as todos.
+	data, _ := json.Marshal(todos)
+	sealed, err := s.encryptTask(r.Context(), string(data))
+	if err != nil {
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+	job, err := s.EnqueueJob(r.Context(), "import", owner, sealed)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Started import", "job", job.ID, "todos", len(todos))
+	writeJob(w, http.StatusAccepted, job)
+}
+
+// parseImportCSV reads the todos of a CSV file with a header row. Only the task
+// column is required; completed and list_id are optional.
+func parseImportCSV(body []byte) ([]Todo, error) {
+	records, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty file")
+	}
+	col := map[string]int{}
+	for i, name := range records[0] {
+		col[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	taskCol, ok := col["task"]
+	if !ok {
+		return nil, errors.New("no task column")
+	}
+	var todos []Todo
+	for n, rec := range records[1:] {
+		t := Todo{Task: rec[taskCol]}
+		if i, ok := col["completed"]; ok && rec[i] != "" {
+			if t.Completed, err = strconv.ParseBool(rec[i]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid completed %q", n+2, rec[i])
+			}
+		}
+		if i, ok := col["list_id"]; ok && rec[i] != "" {
+			id, err := strconv.ParseInt(rec[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid list_id %q", n+2, rec[i])
+			}
+			t.ListID = &id
+		}
+		todos = append(todos, t)
+	}
+	return todos, nil
+}
+
+// runImport creates the todos of an import job in order. Progress is saved every 100
+// todos, so a retry resumes close to where the failed attempt stopped: at most the
+// todos since the last save are created twice.
+func (s *Server) runImport(ctx context.Context, job *Job) (any, error) {
+	var sealed string
+	if err := json.Unmarshal(job.Payload, &sealed); err != nil {
+		return nil, permanentJobError(err)
+	}
+	data, err := s.decryptTask(ctx, sealed)
+	if err != nil {
+		return nil, err
+	}
+	var todos []Todo
+	if err := json.Unmarshal([]byte(data), &todos); err != nil {
+		return nil, permanentJobError(err)
+	}
+	var p importProgress
+	if len(job.Result) > 0 {
+		json.Unmarshal(job.Result, &p)
+	}
+	p.Total = len(todos)
+	for p.Done < len(todos) {
+		t := todos[p.Done]
+		created, err := s.Todos.Create(ctx, job.Owner, t.Task, t.ListID)
+		if errors.Is(err, errTodoForbidden) || errors.Is(err, errInvalidTask) {
+			p.Skipped++
+		} else if errors.Is(err, errTodoQuota) {
+			// Retrying cannot help; the todos created so far stay.
+			s.saveJobProgress(ctx, job, p)
+			return nil, permanentJobError(err)
+		} else if err != nil {
+			s.saveJobProgress(ctx, job, p)
+			return nil, err
+		} else {
+			p.Created++
+		}
+		p.Done++
+		if err == nil && t.Completed {
+			if _, err := s.Todos.SetCompleted(ctx, job.Owner, created.ID, true); err != nil {
+				s.saveJobProgress(ctx, job, p)
+				return nil, err
+			}
+		}
+		if p.Done%100 == 0 {
+			if err := s.saveJobProgress(ctx, job, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,602 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/option"
+)
+
+var (
+	JobRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "job_runs_total",
+			Help: "Total number of background job attempts, by kind and result",
+		},
+		[]string{"kind", "result"}, // "succeeded", "retry", "failed"
+	)
+	JobDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "job_duration_seconds",
+			Help:    "Duration of background job attempts in seconds",
+			Buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900},
+		},
+		[]string{"kind"},
+	)
+)
+
+// Job is a unit of slow work run outside the request that started it. The jobs table
+// is the source of truth for its status, whichever JobQueue runs it.
+type Job struct {
+	ID            int64           `json:"id"`
+	Kind          string          `json:"kind"`
+	Status        string          `json:"status"` // queued, running, succeeded, failed
+	Attempts      int             `json:"attempts"`
+	MaxAttempts   int             `json:"max_attempts"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	FinishedAt    *time.Time      `json:"finished_at,omitempty"`
+
+	Owner   string          `json:"-"`
+	Payload json.RawMessage `json:"-"`
+}
+
+// RetryPolicy bounds the attempts of a job kind. Failed attempts are retried after
+// MinBackoff, doubling up to MaxBackoff; each attempt may run for Timeout.
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Timeout     time.Duration
+}
+
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	return min(p.MinBackoff<<min(attempts-1, 16), p.MaxBackoff)
+}
+
+// JobHandler runs one attempt of a job on s and returns its result, stored as JSON.
+// An error wrapped by permanentJobError is not retried. Handlers are usually method
+// expressions, such as (*Server).runExport.
+type JobHandler func(s *Server, ctx context.Context, job *Job) (any, error)
+
+type jobKind struct {
+	policy RetryPolicy
+	run    JobHandler
+	failed func(s *Server, ctx context.Context, job *Job, err error) // after the last attempt, optional
+	admin  bool                                           // started by admins at /admin/jobs
+}
+
+var jobKinds = map[string]jobKind{}
+
+// registerJob makes kind runnable. It is called from init functions only.
+func registerJob(kind string, k jobKind) {
+	if _, ok := jobKinds[kind]; ok {
+		panic("job kind registered twice: " + kind)
+	}
+	jobKinds[kind] = k
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanentJobError marks err as not worth retrying, e.g. an invalid payload.
+func permanentJobError(err error) error { return permanentError{err} }
+
+// JobQueue hands stored jobs to workers, which run them with RunJob.
+type JobQueue interface {
+	Name() string
+	// Dispatch asks for job to be run at job.NextAttemptAt.
+	Dispatch(ctx context.Context, job Job) error
+}
+
+const jobLease = 15 * time.Minute // longer than any RetryPolicy.Timeout
+
+// EnqueueJob stores a job of kind for owner and dispatches it. If dispatching fails
+// the job is marked failed, so callers never see a job that will not run.
+func (s *Server) EnqueueJob(ctx context.Context, kind, owner string, payload any) (Job, error) {
+	var job Job
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		job, err = insertJob(ctx, s.DB, kind, owner, payload)
+		return err
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	err = s.dispatchJob(ctx, &job)
+	return job, err
+}
+
+// insertJob stores a job of kind for owner with q, for dispatchJob to dispatch once
+// it is committed.
+func insertJob(ctx context.Context, q dbtx, kind, owner string, payload any) (Job, error) {
+	k, ok := jobKinds[kind]
+	if !ok {
+		return Job{}, fmt.Errorf("unknown job kind %q", kind)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{Kind: kind, Owner: owner, Payload: data, Status: "queued", MaxAttempts: k.policy.MaxAttempts}
+	err = dbQueryRow(ctx, q, "insert_job",
+		"INSERT INTO jobs (kind, owner_id, payload, max_attempts) VALUES ($1, $2, $3, $4) RETURNING id, created_at, next_attempt_at",
+		kind, owner, []byte(data), k.policy.MaxAttempts).Scan(&job.ID, &job.CreatedAt, &job.NextAttemptAt)
+	return job, err
+}
+
+// dispatchJob hands a stored job to Jobs, and marks it failed if that fails.
+func (s *Server) dispatchJob(ctx context.Context, job *Job) error {
+	if err := s.Jobs.Dispatch(ctx, *job); err != nil {
+		slog.Error("Failed to dispatch job", "id", job.ID, "kind", job.Kind, "queue", s.Jobs.Name(), "error", err)
+		s.finishJob(ctx, job, "failed", nil, "could not be queued")
+		return err
+	}
+	slog.Info("Queued job", "id", job.ID, "kind", job.Kind, "queue", s.Jobs.Name())
+	return nil
+}
+
+const selectJobColumns = "SELECT id, kind, owner_id, payload, status, attempts, max_attempts, result, error, created_at, next_attempt_at, finished_at FROM jobs"
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var j Job
+	var payload, result []byte
+	err := row.Scan(&j.ID, &j.Kind, &j.Owner, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &result, &j.Error, &j.CreatedAt, &j.NextAttemptAt, &j.FinishedAt)
+	j.Payload, j.Result = payload, result
+	return j, err
+}
+
+// RunJob claims job id and runs one attempt of it. It does nothing for a job that is
+// finished or already running elsewhere, so duplicate dispatches are harmless. The
+// error is only about the job's bookkeeping: the outcome of the attempt is recorded
+// on the job.
+func (s *Server) RunJob(ctx context.Context, id int64) error {
+	var job Job
+	var claimed bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		job, err = scanJob(dbQueryRow(ctx, s.DB, "claim_job",
+			`UPDATE jobs SET status = 'running', attempts = attempts + 1, lease_until = now() + $2 * interval '1 second', updated_at = now()
+			WHERE id = $1 AND (status = 'queued' OR (status = 'running' AND lease_until < now()))
+			RETURNING id, kind, owner_id, payload, status, attempts, max_attempts, result, error, created_at, next_attempt_at, finished_at`,
+			id, jobLease.Seconds()))
+		if err == sql.ErrNoRows {
+			claimed = false
+			return nil
+		}
+		claimed = err == nil
+		return err
+	})
+	if err != nil || !claimed {
+		return err
+	}
+	s.runClaimedJob(ctx, &job)
+	return nil
+}
+
+func (s *Server) runClaimedJob(ctx context.Context, job *Job) {
+	k, ok := jobKinds[job.Kind]
+	if !ok {
+		s.finishJob(ctx, job, "failed", nil, "unknown job kind")
+		return
+	}
+	start := s.Clock.Now()
+	attemptCtx, cancel := context.WithTimeout(ctx, k.policy.Timeout)
+	result, err := k.run(s, attemptCtx, job)
+	cancel()
+	JobDuration.WithLabelValues(job.Kind).Observe(s.Clock.Now().Sub(start).Seconds())
+
+	var permanent permanentError
+	switch {
+	case err == nil:
+		JobRuns.WithLabelValues(job.Kind, "succeeded").Inc()
+		s.finishJob(ctx, job, "succeeded", result, "")
+	case !errors.As(err, &permanent) && (job.Attempts < job.MaxAttempts || ctx.Err() != nil):
+		// An attempt cut short by shutdown is retried even if it was the last, and at
+		// once, by another replica, from the progress it saved.
+		JobRuns.WithLabelValues(job.Kind, "retry").Inc()
+		slog.Warn("Job attempt failed, retrying", "id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err)
+		job.NextAttemptAt = s.Clock.Now().Add(k.policy.backoff(job.Attempts))
+		if ctx.Err() != nil {
+			job.NextAttemptAt = s.Clock.Now()
+		}
+		s.retryJob(ctx, job, err)
+	default:
+		JobRuns.WithLabelValues(job.Kind, "failed").Inc()
+		slog.Error("Job failed", "id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err)
+		if k.failed != nil {
+			k.failed(s, context.WithoutCancel(ctx), job, err)
+		}
+		s.finishJob(ctx, job, "failed", nil, truncate(err.Error(), 500))
+	}
+}
+
+// finishJob records the final status of job. It is stored even if ctx ended during
+// the attempt; otherwise the lease runs out and the job runs again.
+func (s *Server) finishJob(ctx context.Context, job *Job, status string, result any, msg string) {
+	var data []byte
+	if result != nil {
+		var err error
+		if data, err = json.Marshal(result); err != nil {
+			status, msg, data = "failed", "invalid result", nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err := s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "finish_job",
+			"UPDATE jobs SET status = $2, result = COALESCE($3, result), error = $4, finished_at = now(), lease_until = NULL, updated_at = now() WHERE id = $1",
+			job.ID, status, data, msg)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to record job result", "id", job.ID, "status", status, "error", err)
+	}
+}
+
+// retryJob queues job again for job.NextAttemptAt and dispatches it.
+func (s *Server) retryJob(ctx context.Context, job *Job, cause error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err := s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "retry_job",
+			"UPDATE jobs SET status = 'queued', error = $2, next_attempt_at = $3, lease_until = NULL, updated_at = now() WHERE id = $1",
+			job.ID, truncate(cause.Error(), 500), job.NextAttemptAt)
+		return err
+	})
+	if err == nil {
+		err = s.Jobs.Dispatch(ctx, *job)
+	}
+	if err != nil {
+		slog.Error("Failed to queue job retry", "id", job.ID, "error", err)
+	}
+}
+
+// saveJobProgress stores progress as the job's result while it runs, so a retry can
+// resume where the failed attempt stopped.
+func (s *Server) saveJobProgress(ctx context.Context, job *Job, progress any) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	job.Result = data
+	return s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "save_job_progress", "UPDATE jobs SET result = $2, updated_at = now() WHERE id = $1", job.ID, data)
+		return err
+	})
+}
+
+// InProcessQueue runs jobs on worker goroutines of every replica. Workers poll the
+// jobs table, so a job queued or retried on one replica may run on another, and jobs
+// of a replica that died are picked up once their lease runs out.
+type InProcessQueue struct {
+	server  *Server
+	workers int
+	wake    chan struct{}
+}
+
+// NewInProcessQueue returns a queue whose workers run the jobs stored in s.
+func NewInProcessQueue(s *Server, workers int) *InProcessQueue {
+	return &InProcessQueue{server: s, workers: max(workers, 1), wake: make(chan struct{}, 1)}
+}
+
+func (q *InProcessQueue) Name() string { return "inprocess" }
+
+// Dispatch wakes a local worker; jobs due later are found by polling.
+func (q *InProcessQueue) Dispatch(ctx context.Context, job Job) error {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start runs the workers until ctx is cancelled or Workers shuts down. Idle workers
+// poll every interval. On shutdown a worker finishes the job it is running, if it can
+// before the deadline, and claims no more.
+func (q *InProcessQueue) Start(ctx context.Context, interval time.Duration) {
+	for i := range q.workers {
+		Workers.Go(ctx, fmt.Sprintf("job_worker_%d", i+1), func(ctx context.Context, w *Worker) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				var err error
+				for !w.Stopping() {
+					var ran bool
+					ran, err = q.runNext(ctx)
+					if err != nil && ctx.Err() == nil {
+						slog.Warn("Failed to claim a job", "error", err)
+					}
+					if !ran || err != nil {
+						break
+					}
+				}
+				w.Checkpoint(err)
+				select {
+				case <-w.Stop():
+					return
+				case <-q.wake:
+				case <-ticker.C:
+				}
+			}
+		})
+	}
+}
+
+// runNext claims the next due job and runs it, and reports whether there was one.
+func (q *InProcessQueue) runNext(ctx context.Context) (bool, error) {
+	var job Job
+	var claimed bool
+	err := q.server.ExecuteWithRobustness(func() error {
+		var err error
+		job, err = scanJob(dbQueryRow(ctx, q.server.DB, "claim_next_job",
+			`UPDATE jobs SET status = 'running', attempts = attempts + 1, lease_until = now() + $1 * interval '1 second', updated_at = now()
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE (status = 'queued' AND next_attempt_at <= now()) OR (status = 'running' AND lease_until < now())
+				ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+			RETURNING id, kind, owner_id, payload, status, attempts, max_attempts, result, error, created_at, next_attempt_at, finished_at`,
+			jobLease.Seconds()))
+		if err == sql.ErrNoRows {
+			claimed = false
+			return nil
+		}
+		claimed = err == nil
+		return err
+	})
+	if err != nil || !claimed {
+		return false, err
+	}
+	q.server.runClaimedJob(ctx, &job)
+	return true, nil
+}
+
+// CloudTasksQueue dispatches each job as a Cloud Tasks HTTP task that POSTs its id to
+// /internal/jobs/run on TargetURL, signed with Secret. Cloud Tasks rate-limits the
+// queue and redelivers tasks the service fails to answer; the retries of failed
+// attempts follow the job's RetryPolicy, as new tasks.
+type CloudTasksQueue struct {
+	svc            *cloudtasks.Service
+	queue          string // projects/<p>/locations/<l>/queues/<q>
+	targetURL      string
+	secret         []byte
+	serviceAccount string
+}
+
+// NewCloudTasksQueue creates tasks in queue that call targetURL (the service's base
+// URL). With serviceAccount, tasks carry an OIDC token of it too, for an ingress that
+// requires one.
+func NewCloudTasksQueue(ctx context.Context, queue, targetURL, secret, serviceAccount string, opts ...option.ClientOption) (*CloudTasksQueue, error) {
+	if err := validateTasksQueue(queue); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(targetURL, "https://") {
+		return nil, fmt.Errorf("target URL %q must be https", targetURL)
+	}
+	if secret == "" {
+		return nil, errors.New("a signing secret is required")
+	}
+	svc, err := cloudtasks.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloud tasks client: %w", err)
+	}
+	return &CloudTasksQueue{svc: svc, queue: queue, targetURL: strings.TrimSuffix(targetURL, "/"), secret: []byte(secret), serviceAccount: serviceAccount}, nil
+}
+
+func validateTasksQueue(queue string) error {
+	parts := strings.Split(queue, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "queues" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return fmt.Errorf("invalid queue %q, want projects/<project>/locations/<location>/queues/<queue>", queue)
+	}
+	return nil
+}
+
+func (q *CloudTasksQueue) Name() string { return "cloudtasks" }
+
+func (q *CloudTasksQueue) Dispatch(ctx context.Context, job Job) error {
+	body, _ := json.Marshal(map[string]int64{"id": job.ID})
+	req := &cloudtasks.HttpRequest{
+		Url:        q.targetURL + "/internal/jobs/run",
+		HttpMethod: http.MethodPost,
+		Headers: map[string]string{
+			"Content-Type":     "application/json",
+			jobSignatureHeader: signJob(q.secret, body),
+		},
+		Body: base64.StdEncoding.EncodeToString(body),
+	}
+	if q.serviceAccount != "" {
+		req.OidcToken = &cloudtasks.OidcToken{ServiceAccountEmail: q.serviceAccount, Audience: q.targetURL}
+	}
+	task := &cloudtasks.Task{HttpRequest: req}
+	if !job.NextAttemptAt.IsZero() { // a time that has passed runs the task at once
+		task.ScheduleTime = job.NextAttemptAt.UTC().Format(time.RFC3339Nano)
+	}
+	_, err := q.svc.Projects.Locations.Queues.Tasks.Create(q.queue, &cloudtasks.CreateTaskRequest{Task: task}).Context(ctx).Do()
+	return err
+}
+
+const jobSignatureHeader = "X-Job-Signature"
+
+// JobSigningSecret verifies the tasks of a CloudTasksQueue; empty disables /internal/jobs/run.
+var JobSigningSecret []byte
+
+func signJob(secret, body []byte) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// HandleRunJob serves POST /internal/jobs/run for Cloud Tasks: {"id": 1} runs an
+// attempt of job 1. It is authorized by the X-Job-Signature header alone. Failed
+// attempts are still 200, as their retry is queued separately; only bookkeeping
+// failures are 5xx, so Cloud Tasks redelivers the task.
+func (s *Server) HandleRunJob(w http.ResponseWriter, r *http.Request) {
+	if len(JobSigningSecret) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<10))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	want, _ := hex.DecodeString(r.Header.Get(jobSignatureHeader))
+	got, _ := hex.DecodeString(signJob(JobSigningSecret, body))
+	if !hmac.Equal(want, got) {
+		AuthFailures.WithLabelValues("invalid").Inc()
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.ID <= 0 {
+		http.Error(w, "Invalid job", http.StatusBadRequest)
+		return
+	}
+	// The attempt outlives a client disconnect; Cloud Tasks' dispatch deadline is 10m.
+	if err := s.RunJob(context.WithoutCancel(r.Context()), req.ID); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleJob serves GET /jobs/{id}: the status of one of the caller's jobs.
+func (s *Server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/jobs/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var job Job
+	var found bool
+	err = s.ExecuteWithRobustness(func() error {
+		var err error
+		job, err = scanJob(dbQueryRow(r.Context(), s.DB, "get_job", selectJobColumns+" WHERE id = $1 AND owner_id = $2", id, TodoOwner(r.Context())))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJob(w, http.StatusOK, job)
+}
+
+func writeJob(w http.ResponseWriter, status int, job Job) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusAccepted {
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		slog.Error("Failed to encode job", "error", err)
+	}
+}
+
+// HandleAdminJobs serves /admin/jobs:
+//
+//	GET  /admin/jobs?status=failed  the newest 100 jobs of every user
+//	POST /admin/jobs {"kind": "reencrypt"}  start a maintenance job
+func (s *Server) HandleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+		jobs := []Job{}
+		err := s.ExecuteWithRobustness(func() error {
+			rows, err := dbQuery(r.Context(), s.DBRead, "list_jobs",
+				selectJobColumns+" WHERE $1 = '' OR status = $1 ORDER BY id DESC LIMIT 100", status)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			jobs = jobs[:0] // Reset on retry
+			for rows.Next() {
+				j, err := scanJob(rows)
+				if err != nil {
+					return err
+				}
+				jobs = append(jobs, j)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(jobs); err != nil {
+			slog.Error("Failed to encode jobs", "error", err)
+		}
+	case http.MethodPost:
+		var req struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if k, ok := jobKinds[req.Kind]; !ok || !k.admin {
+			var kinds []string
+			for name, k := range jobKinds {
+				if k.admin {
+					kinds = append(kinds, name)
+				}
+			}
+			slices.Sort(kinds)
+			http.Error(w, fmt.Sprintf("kind must be one of %s", strings.Join(kinds, ", ")), http.StatusBadRequest)
+			return
+		}
+		job, err := s.EnqueueJob(r.Context(), req.Kind, TodoOwner(r.Context()), struct{}{})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		slog.Info("Started admin job", "id", job.ID, "kind", req.Kind, "by", principalSubject(r.Context()))
+		writeJob(w, http.StatusAccepted, job)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
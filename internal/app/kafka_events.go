@@ -0,0 +1,194 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+var (
+	KafkaEventsPublished = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_events_published_total",
+			Help: "Total number of todo events acknowledged by the Kafka topic",
+		},
+	)
+	KafkaEventsFailed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_events_failed_total",
+			Help: "Total number of todo events the Kafka topic did not acknowledge",
+		},
+	)
+	KafkaProduceDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "kafka_produce_duration_seconds",
+			Help:    "Duration of producing a batch of todo events until every record is acknowledged",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+// KafkaSinkConfig configures the Kafka producer of a KafkaSink.
+type KafkaSinkConfig struct {
+	Brokers  []string
+	Topic    string
+	ClientID string
+	// BatchMaxBytes caps a record batch per partition and Linger is how long the
+	// producer waits for a batch to fill; Compression is none, gzip, snappy, lz4 or zstd.
+	BatchMaxBytes int32
+	Linger        time.Duration
+	Compression   string
+	// Idempotent has the brokers drop the duplicates of producer retries and keep
+	// the order of the records of a partition. It needs acks from all in-sync replicas,
+	// which are required either way.
+	Idempotent bool
+	// Timeout bounds how long a batch may take to be acknowledged, so an unreachable
+	// cluster fails the batch (to be retried by the dispatcher) instead of stalling it.
+	Timeout time.Duration
+	TLS     bool
+	// SASLMechanism is plain, scram-sha-256 or scram-sha-512; empty disables SASL.
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+}
+
+// KafkaSink publishes outbox events to a Kafka topic, the alternative to Pub/Sub for
+// deployments without Google Cloud. Each record is the OutboxEvent as JSON keyed by the
+// todo id, so the events of one todo land on one partition in order; the type and seq
+// headers allow filtering and deduplication, as publishing is at least once.
+type KafkaSink struct {
+	client *kgo.Client
+}
+
+// NewKafkaSink creates the producer. It does not connect until the first batch.
+func NewKafkaSink(cfg KafkaSinkConfig) (*KafkaSink, error) {
+	opts, err := kafkaOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	return &KafkaSink{client: client}, nil
+}
+
+func kafkaOptions(cfg KafkaSinkConfig) ([]kgo.Opt, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("no brokers")
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("no topic")
+	}
+	var codec kgo.CompressionCodec
+	switch cfg.Compression {
+	case "", "none":
+		codec = kgo.NoCompression()
+	case "gzip":
+		codec = kgo.GzipCompression()
+	case "snappy":
+		codec = kgo.SnappyCompression()
+	case "lz4":
+		codec = kgo.Lz4Compression()
+	case "zstd":
+		codec = kgo.ZstdCompression()
+	default:
+		return nil, fmt.Errorf("unknown compression %q, want none, gzip, snappy, lz4 or zstd", cfg.Compression)
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.ProducerBatchCompression(codec),
+		kgo.ProducerLinger(cfg.Linger),
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	if cfg.BatchMaxBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(cfg.BatchMaxBytes))
+	}
+	if !cfg.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, kgo.RecordDeliveryTimeout(cfg.Timeout))
+	}
+	if cfg.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	switch cfg.SASLMechanism {
+	case "":
+	case "plain":
+		opts = append(opts, kgo.SASL(plain.Auth{User: cfg.SASLUser, Pass: cfg.SASLPassword}.AsMechanism()))
+	case "scram-sha-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: cfg.SASLUser, Pass: cfg.SASLPassword}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: cfg.SASLUser, Pass: cfg.SASLPassword}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %q, want plain, scram-sha-256 or scram-sha-512", cfg.SASLMechanism)
+	}
+	return opts, nil
+}
+
+func (s *KafkaSink) Name() string { return "kafka" }
+
+// Publish produces events and waits until all of them are acknowledged. The producer
+// batches them per partition, up to BatchMaxBytes.
+func (s *KafkaSink) Publish(ctx context.Context, events []OutboxEvent) error {
+	records := make([]*kgo.Record, len(events))
+	for i, ev := range events {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		records[i] = &kgo.Record{
+			Key:   []byte(strconv.Itoa(ev.TodoID)),
+			Value: value,
+			Headers: []kgo.RecordHeader{
+				{Key: "type", Value: []byte(ev.Type)},
+				{Key: "seq", Value: []byte(strconv.FormatInt(ev.Seq, 10))},
+			},
+			Timestamp: ev.OccurredAt,
+		}
+	}
+
+	start := time.Now()
+	results := s.client.ProduceSync(ctx, records...)
+	KafkaProduceDuration.Observe(time.Since(start).Seconds())
+	var failed int
+	var firstErr error
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = r.Err
+			}
+		}
+	}
+	KafkaEventsPublished.Add(float64(len(results) - failed))
+	if failed > 0 {
+		KafkaEventsFailed.Add(float64(failed))
+		return fmt.Errorf("%d of %d events not acknowledged: %w", failed, len(results), firstErr)
+	}
+	return nil
+}
+
+// Close closes the connections to the brokers.
+func (s *KafkaSink) Close() {
+	s.client.Close()
+}
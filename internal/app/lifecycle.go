@@ -0,0 +1,201 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The background workers (the outbox dispatcher, the janitors and the retention purger,
+// the schedulers of reminders, webhooks and Slack notices, the job workers) register
+// with Workers as they start. On SIGTERM main stops them together with the HTTP server:
+// each finishes the pass it is on, whose work is committed batch by batch, and returns
+// instead of starting another. One still busy at the deadline has its context
+// cancelled; the batch it was on is rolled back and done again by the next pass, on
+// this replica or another, and a job cut short is queued again at once. GET
+// /admin/workers shows each worker's state and last pass.
+
+// WorkerLastRun is when each worker last completed a pass, to alert on one that stalls.
+var WorkerLastRun = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "background_worker_last_run_timestamp_seconds",
+		Help: "When each background worker last completed a pass",
+	},
+	[]string{"worker"},
+)
+
+// workerStopGrace is how long Shutdown waits for workers to return once their context
+// is cancelled, for them to record what they were doing.
+const workerStopGrace = 5 * time.Second
+
+// Lifecycle tracks the background workers of the process and stops them.
+type Lifecycle struct {
+	Clock Clock // the time of the worker statuses; the system clock if nil
+
+	mu       sync.Mutex
+	workers  []*Worker
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+func NewLifecycle() *Lifecycle { return &Lifecycle{} }
+
+// Workers is the lifecycle of the app's background workers.
+var Workers = NewLifecycle()
+
+// Worker is a background worker registered with a Lifecycle.
+type Worker struct {
+	stop   context.Context // ends when the worker is asked to stop
+	halt   context.CancelFunc
+	cancel context.CancelFunc // ends its work
+	clock  Clock
+
+	mu     sync.Mutex
+	status WorkerStatus
+}
+
+// WorkerStatus is what GET /admin/workers shows of a worker.
+type WorkerStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"` // "running", "stopping" or "stopped"
+	Started   time.Time `json:"started"`
+	Runs      int       `json:"runs"`                 // passes completed
+	LastRun   time.Time `json:"last_run,omitzero"`    // end of the last pass
+	LastError string    `json:"last_error,omitempty"` // of the last pass, if it failed
+	Stopped   time.Time `json:"stopped,omitzero"`
+}
+
+// Go runs run as the background worker name until it returns. run does its work with
+// ctx, which ends with the ctx given to Go or when Shutdown gives up waiting, and
+// returns once w.Stop() is closed, between passes, so that a pass is not cut short.
+// Workers started after Shutdown do not run.
+func (l *Lifecycle) Go(ctx context.Context, name string, run func(ctx context.Context, w *Worker)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		slog.Warn("Not starting background worker during shutdown", "worker", name)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop, halt := context.WithCancel(ctx)
+	clock := orSystemClock(l.Clock)
+	w := &Worker{stop: stop, halt: halt, cancel: cancel, clock: clock,
+		status: WorkerStatus{Name: name, State: "running", Started: clock.Now()}}
+	l.workers = append(l.workers, w)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer cancel()
+		run(ctx, w)
+		w.mu.Lock()
+		w.status.State, w.status.Stopped = "stopped", clock.Now()
+		w.mu.Unlock()
+	}()
+}
+
+// Stop is closed when the worker is to return.
+func (w *Worker) Stop() <-chan struct{} { return w.stop.Done() }
+
+// Stopping reports whether the worker is to return, for loops that go on while there
+// is more to do.
+func (w *Worker) Stopping() bool { return w.stop.Err() != nil }
+
+// Checkpoint records a completed pass and its error, if it failed.
+func (w *Worker) Checkpoint(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Runs++
+	w.status.LastRun, w.status.LastError = w.clock.Now(), ""
+	if err != nil {
+		w.status.LastError = err.Error()
+	}
+	WorkerLastRun.WithLabelValues(w.status.Name).Set(float64(w.status.LastRun.Unix()))
+}
+
+// Status returns the status of the workers, in the order they started.
+func (l *Lifecycle) Status() []WorkerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statuses := make([]WorkerStatus, 0, len(l.workers))
+	for _, w := range l.workers {
+		w.mu.Lock()
+		statuses = append(statuses, w.status)
+		w.mu.Unlock()
+	}
+	return statuses
+}
+
+// Shutdown asks every worker to stop and waits for them until ctx ends. Then it
+// cancels the work of those still running and waits up to workerStopGrace more. It
+// returns an error naming the workers that did not stop.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.stopping = true
+	workers := l.workers
+	for _, w := range workers {
+		w.mu.Lock()
+		if w.status.State == "running" {
+			w.status.State = "stopping"
+		}
+		w.mu.Unlock()
+		w.halt()
+	}
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	var busy []string
+	for _, w := range workers {
+		w.mu.Lock()
+		if w.status.State != "stopped" {
+			busy = append(busy, w.status.Name)
+		}
+		w.mu.Unlock()
+		w.cancel()
+	}
+	slog.Warn("Cancelling background workers still busy at the shutdown deadline", "workers", busy)
+	select {
+	case <-done:
+		return nil
+	case <-time.After(workerStopGrace):
+	}
+	var stuck []string
+	for _, s := range l.Status() {
+		if s.State != "stopped" {
+			stuck = append(stuck, s.Name)
+		}
+	}
+	return fmt.Errorf("background workers did not stop: %v", stuck)
+}
+
+// HandleAdminWorkers serves GET /admin/workers: the status of the background workers.
+func HandleAdminWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Workers.Status()); err != nil {
+		slog.Error("Failed to encode worker status", "error", err)
+	}
+}
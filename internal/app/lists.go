@@ -0,0 +1,483 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// List member roles. Owners manage membership, editors add and change todos,
+// viewers only read.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// TodoList is a named collection of todos shared between its members: a project.
+type TodoList struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Role      string    `json:"role"`            // the caller's role
+	Color     string    `json:"color,omitempty"` // "#rrggbb"
+	Archived  bool      `json:"archived"`        // archived lists take no new todos
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// inboxList is the path segment of the Inbox, the caller's personal todos, which is
+// served like a list at /lists/inbox/todos.
+const inboxList = "inbox"
+
+var listColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// validateListColor accepts "" (no color) and "#rrggbb" colors, which it lowercases.
+func validateListColor(color string) (string, error) {
+	color = strings.ToLower(color)
+	if color != "" && !listColorPattern.MatchString(color) {
+		return "", errors.New("color must look like #1a2b3c")
+	}
+	return color, nil
+}
+
+// ListMember is one collaborator on a list.
+type ListMember struct {
+	UserID  string    `json:"user_id"`
+	Role    string    `json:"role"`
+	AddedBy string    `json:"added_by"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// HandleLists serves /lists: GET lists the caller's lists, without archived ones
+// unless ?archived=true, which lists only those; POST creates one.
+func (s *Server) HandleLists(w http.ResponseWriter, r *http.Request) {
+	if TodoOwner(r.Context()) == anonymousOwner {
+		http.Error(w, "Sign in to use shared lists", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.listLists(w, r)
+	case http.MethodPost:
+		s.createList(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleList serves a single list, its todos and its membership:
+//
+//	GET    /lists/{id}                  the list (any member)
+//	PUT    /lists/{id}                  rename, color or (un)archive it (owner)
+//	DELETE /lists/{id}                  delete the list and its todos (owner)
+//	GET    /lists/{id}/todos            the list's todos, filtered like GET /todos (any member)
+//	POST   /lists/{id}/todos            add a todo to the list (owner, editor)
+//	GET    /lists/{id}/members          list members (any member)
+//	POST   /lists/{id}/members          invite or change a member's role (owner)
+//	DELETE /lists/{id}/members/{user}   remove a member (owner), or leave the list (self)
+//
+// Lists the caller is not a member of are reported as not found.
+func (s *Server) HandleList(w http.ResponseWriter, r *http.Request) {
+	user := TodoOwner(r.Context())
+	if user == anonymousOwner {
+		http.Error(w, "Sign in to use shared lists", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/lists/"), "/", 3)
+	if parts[0] == inboxList {
+		if len(parts) != 2 || parts[1] != "todos" {
+			http.NotFound(w, r)
+			return
+		}
+		s.handleListTodos(w, r, nil)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid list ID", http.StatusBadRequest)
+		return
+	}
+
+	l, err := s.getList(r.Context(), id, user)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	role := l.Role
+	if role == "" {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeList(w, http.StatusOK, l)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		if role != RoleOwner {
+			http.Error(w, "Only the list owner can change it", http.StatusForbidden)
+			return
+		}
+		s.updateList(w, r, l)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if role != RoleOwner {
+			http.Error(w, "Only the list owner can delete it", http.StatusForbidden)
+			return
+		}
+		s.deleteList(w, r, id)
+	case len(parts) == 2 && parts[1] == "todos":
+		if r.Method == http.MethodPost && l.Archived {
+			http.Error(w, "The list is archived", http.StatusConflict)
+			return
+		}
+		s.handleListTodos(w, r, &id)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodGet:
+		s.listMembers(w, r, id)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodPost:
+		if role != RoleOwner {
+			http.Error(w, "Only the list owner can invite members", http.StatusForbidden)
+			return
+		}
+		s.addMember(w, r, id)
+	case len(parts) == 3 && parts[1] == "members" && r.Method == http.MethodDelete:
+		member := parts[2]
+		if Tenancy.Enabled {
+			member = qualifySubject(subjectTenant(user), member)
+		}
+		if role != RoleOwner && member != user {
+			http.Error(w, "Only the list owner can remove other members", http.StatusForbidden)
+			return
+		}
+		s.removeMember(w, r, id, member)
+	case len(parts) <= 3:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listRole returns user's role on list id, or "" when they are not a member.
+func (s *Server) listRole(ctx context.Context, id int64, user string) (string, error) {
+	var role string
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		role, err = queries(s.DB).GetListRole(ctx, store.GetListRoleParams{ListID: id, UserID: user})
+		if err == sql.ErrNoRows {
+			role = ""
+			return nil
+		}
+		return err
+	})
+	return role, err
+}
+
+// getList returns list id with user's role on it; the role is "" when they are not a
+// member.
+func (s *Server) getList(ctx context.Context, id int64, user string) (TodoList, error) {
+	var l TodoList
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, user, func(q dbtx) error {
+			row, err := queries(q).GetList(ctx, store.GetListParams{ID: id, UserID: user})
+			l = TodoList(row)
+			if err == sql.ErrNoRows {
+				l = TodoList{}
+				return nil
+			}
+			return err
+		})
+	})
+	return l, err
+}
+
+func writeList(w http.ResponseWriter, status int, l TodoList) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		slog.Error("Failed to encode list", "error", err)
+	}
+}
+
+// updateList applies the fields set in a PUT /lists/{id} body to l; fields left out
+// keep their value, and a color of "" removes it.
+func (s *Server) updateList(w http.ResponseWriter, r *http.Request, l TodoList) {
+	var req struct {
+		Name     *string `json:"name"`
+		Color    *string `json:"color"`
+		Archived *bool   `json:"archived"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			http.Error(w, "name must not be empty", http.StatusBadRequest)
+			return
+		}
+		l.Name = *req.Name
+	}
+	if req.Color != nil {
+		color, err := validateListColor(*req.Color)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l.Color = color
+	}
+	if req.Archived != nil {
+		l.Archived = *req.Archived
+	}
+
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(r.Context(), s.DB, l.Owner, func(q dbtx) error {
+			return queries(q).UpdateList(r.Context(), store.UpdateListParams{ID: l.ID, Name: l.Name, Color: l.Color, Archived: l.Archived})
+		})
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Updated list", "id", l.ID, "archived", l.Archived, "by", principalSubject(r.Context()))
+	writeList(w, http.StatusOK, l)
+}
+
+// handleListTodos serves the todos of list id, or of the caller's Inbox with a nil id:
+// GET lists them, filtered and sorted like GET /todos; POST adds one.
+func (s *Server) handleListTodos(w http.ResponseWriter, r *http.Request, id *int64) {
+	switch r.Method {
+	case http.MethodGet:
+		f, err := parseTodoFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.ListID, f.Inbox = id, id == nil
+		todos, err := s.Todos.List(r.Context(), TodoOwner(r.Context()), f)
+		if err != nil {
+			writeTodoError(w, err)
+			return
+		}
+		writeTodoResponse(w, r, http.StatusOK, page(f, w, r, todos))
+		putTodoSlice(todos)
+	case http.MethodPost:
+		t, err := decodeTodo(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err = s.Todos.Create(r.Context(), TodoOwner(r.Context()), t.Task, id)
+		if err != nil {
+			writeTodoError(w, err)
+			return
+		}
+		writeTodoResponse(w, r, http.StatusCreated, t)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listLists(w http.ResponseWriter, r *http.Request) {
+	all, err := s.userLists(r.Context(), TodoOwner(r.Context()))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	archived := r.URL.Query().Get("archived") == "true"
+	lists := []TodoList{}
+	for _, l := range all {
+		if l.Archived == archived {
+			lists = append(lists, l)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lists); err != nil {
+		slog.Error("Failed to encode lists", "error", err)
+	}
+}
+
+// userLists returns the lists user is a member of, with their role on each.
+func (s *Server) userLists(ctx context.Context, user string) ([]TodoList, error) {
+	lists := []TodoList{}
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DBRead, user, func(q dbtx) error {
+			rows, err := queries(q).ListLists(ctx, user)
+			lists = lists[:0]
+			for _, r := range rows {
+				lists = append(lists, TodoList(r))
+			}
+			return err
+		})
+	})
+	return lists, err
+}
+
+func (s *Server) createList(w http.ResponseWriter, r *http.Request) {
+	var l TodoList
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(l.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if l.Color, err = validateListColor(l.Color); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.Owner, l.Role, l.Archived = TodoOwner(r.Context()), RoleOwner, false
+
+	var overQuota *quotaError
+	err = s.ExecuteWithRobustness(func() error {
+		err := withTenant(r.Context(), s.DB, l.Owner, func(q dbtx) error {
+			row, err := queries(q).InsertList(r.Context(), store.InsertListParams{Name: l.Name, Owner: l.Owner, Color: l.Color})
+			l.ID, l.CreatedAt = row.ID, row.CreatedAt
+			return err
+		})
+		if overQuota = asQuotaError(err); overQuota != nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if overQuota != nil {
+		writeQuotaError(w, overQuota, 0)
+		return
+	}
+
+	slog.Info("Created list", "id", l.ID, "owner", l.Owner)
+	writeList(w, http.StatusCreated, l)
+}
+
+func (s *Server) deleteList(w http.ResponseWriter, r *http.Request, id int64) {
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(r.Context(), s.DB, TodoOwner(r.Context()), func(q dbtx) error {
+			return queries(q).DeleteList(r.Context(), id)
+		})
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Deleted list", "id", id, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listMembers(w http.ResponseWriter, r *http.Request, id int64) {
+	members := []ListMember{}
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := queries(s.DB).ListMembers(r.Context(), id)
+		members = members[:0]
+		for _, m := range rows {
+			members = append(members, ListMember(m))
+		}
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(members); err != nil {
+		slog.Error("Failed to encode list members", "error", err)
+	}
+}
+
+func (s *Server) addMember(w http.ResponseWriter, r *http.Request, id int64) {
+	var m ListMember
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(m.UserID) == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	if m.Role == "" {
+		m.Role = RoleEditor
+	}
+	if m.Role != RoleEditor && m.Role != RoleViewer {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+	m.AddedBy = TodoOwner(r.Context())
+	if Tenancy.Enabled {
+		// Lists are shared within a tenant, whose members are named as in it.
+		tenant := subjectTenant(m.AddedBy)
+		if t := subjectTenant(m.UserID); t != DefaultTenant && t != tenant {
+			http.Error(w, "user_id is in another tenant", http.StatusBadRequest)
+			return
+		}
+		m.UserID = qualifySubject(tenant, m.UserID)
+	}
+
+	// Re-inviting an existing member changes their role; the owner's role is fixed.
+	var changed bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		m.AddedAt, err = queries(s.DB).UpsertListMember(r.Context(), store.UpsertListMemberParams{ListID: id, UserID: m.UserID, Role: m.Role, AddedBy: m.AddedBy})
+		if err == sql.ErrNoRows {
+			changed = false
+			return nil
+		}
+		changed = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !changed {
+		http.Error(w, "The list owner's role cannot be changed", http.StatusConflict)
+		return
+	}
+
+	// The list's todos appear in the member's reads; TodoCacheMiddleware only drops the caller's.
+	invalidateTodoCache(r.Context(), "membership", m.UserID)
+	slog.Info("Added list member", "list_id", id, "member", m.UserID, "role", m.Role, "by", m.AddedBy)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		slog.Error("Failed to encode list member", "error", err)
+	}
+}
+
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request, id int64, member string) {
+	var removed bool
+	err := s.ExecuteWithRobustness(func() error {
+		n, err := queries(s.DB).DeleteListMember(r.Context(), store.DeleteListMemberParams{ListID: id, UserID: member})
+		removed = n > 0
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !removed {
+		http.Error(w, "Member not found (the owner cannot be removed)", http.StatusNotFound)
+		return
+	}
+
+	invalidateTodoCache(r.Context(), "membership", member)
+	slog.Info("Removed list member", "list_id", id, "member", member, "by", principalSubject(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
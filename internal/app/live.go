@@ -0,0 +1,313 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	LiveConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "todo_live_connections",
+			Help: "Number of open live update connections of the web UI",
+		},
+		[]string{"transport"}, // "ws", "sse"
+	)
+	LiveResyncs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_live_resyncs_total",
+			Help: "Total number of resync messages sent because a live connection may have missed changes",
+		},
+		[]string{"transport"},
+	)
+)
+
+const (
+	livePingInterval   = 25 * time.Second
+	livePongWait       = 60 * time.Second
+	liveWriteWait      = 10 * time.Second
+	liveReauthInterval = time.Minute
+	liveHeartbeat      = 15 * time.Second
+)
+
+// liveEvent is one message of the live update stream. Type is "created", "updated" or
+// "deleted", with the todo after the change (not for deletes); or "resync" when changes
+// may have been missed, after which the client should reload the todos. After is the
+// position in todo_events to resume from once the event is handled (SSE event ids);
+// zero when there is none.
+type liveEvent struct {
+	Type  string   `json:"type"`
+	ID    int      `json:"id,omitempty"`
+	Todo  *Todo    `json:"todo,omitempty"`
+	After eventPos `json:"-"`
+}
+
+// liveReplayLimit is the most changes a resumed stream replays; a client further
+// behind reloads instead.
+const liveReplayLimit = 1000
+
+// liveFeed turns the change feed into the events one caller may see. Nothing is
+// buffered beyond the hub's subscription: while the connection cannot keep up, the
+// hub drops the subscription and the feed resubscribes with a resync event instead of
+// queuing changes without bound.
+type liveFeed struct {
+	C <-chan liveEvent
+}
+
+// newLiveFeed starts a feed for owner until ctx is cancelled. With after set it first
+// replays the changes after that position from todo_events, or sends resync if they
+// are no longer all there.
+func (s *Server) newLiveFeed(ctx context.Context, hub *TodoChangeHub, owner string, after *eventPos) *liveFeed {
+	c := make(chan liveEvent)
+	go func() {
+		sub := hub.Subscribe() // before reading the replay, so no change falls in between
+		defer func() { sub.Close() }()
+		send := func(ev liveEvent) bool {
+			select {
+			case c <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		emit := func(change TodoChange, resume eventPos) bool {
+			t, ok, err := s.visibleChange(ctx, owner, change)
+			if err != nil {
+				// The change cannot be checked (database trouble): let the client reload once it is back.
+				slog.Warn("Failed to read todo change for live update", "id", change.ID, "error", err)
+				return send(liveEvent{Type: "resync"})
+			}
+			if !ok {
+				return true
+			}
+			ev := liveEvent{Type: "updated", ID: t.ID, Todo: &t, After: resume}
+			switch change.Op {
+			case "insert":
+				ev.Type = "created"
+			case "delete":
+				ev.Type, ev.Todo = "deleted", nil
+			}
+			return send(ev)
+		}
+
+		// Replayed changes are skipped on the feed, which may bring them again. A
+		// replayed change is resumed after by its own position, since the replay is in
+		// position order; a live one, which comes in commit order, by the oldest
+		// transaction running when it was made, which every later commit is after.
+		replayed := map[int64]bool{}
+		if after != nil {
+			changes, _, ok, err := s.todoChangesSince(ctx, *after, liveReplayLimit+1)
+			switch {
+			case err != nil || !ok || len(changes) > liveReplayLimit:
+				if err != nil {
+					slog.Warn("Failed to read todo changes to resume live updates", "after", after.String(), "error", err)
+				}
+				if !send(liveEvent{Type: "resync"}) {
+					return
+				}
+			default:
+				for _, change := range changes {
+					if !emit(change, eventPos{Xid: change.Xid, Seq: change.Seq}) {
+						return
+					}
+					replayed[change.Seq] = true
+				}
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case change, ok := <-sub.C:
+				if !ok {
+					if sub.Err() == nil || ctx.Err() != nil {
+						return
+					}
+					sub = hub.Subscribe()
+					if !send(liveEvent{Type: "resync"}) {
+						return
+					}
+					continue
+				}
+				if replayed[change.Seq] {
+					continue
+				}
+				if !emit(change, eventPos{Xid: change.Xmin}) {
+					return
+				}
+			}
+		}
+	}()
+	return &liveFeed{C: c}
+}
+
+// As for /graphql, the default CheckOrigin rejects cross-origin upgrades.
+var liveUpgrader = websocket.Upgrader{}
+
+// HandleLiveWS serves /ws: a WebSocket that pushes the caller's todo changes as JSON
+// liveEvents, so the UI does not have to poll. The upgrade request is authenticated by
+// AuthMiddleware like any other (session cookie, API key, bearer token) and checked
+// again every minute, so a logged-out session or revoked key ends the connection.
+// Messages from the client are ignored.
+func (s *Server) HandleLiveWS(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+	conn, err := liveUpgrader.Upgrade(hijackableWriter{w}, r, nil)
+	if err != nil {
+		return // the upgrader replied with an error
+	}
+	defer conn.Close()
+	LiveConnections.WithLabelValues("ws").Inc()
+	defer LiveConnections.WithLabelValues("ws").Dec()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// The read loop only processes control frames (pong, close) and notices when the
+	// client goes away.
+	go func() {
+		defer cancel()
+		conn.SetReadLimit(4 << 10)
+		conn.SetReadDeadline(time.Now().Add(livePongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	feed := s.newLiveFeed(ctx, TodoChanges, TodoOwner(ctx), nil)
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	reauth := time.NewTicker(liveReauthInterval)
+	defer reauth.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-feed.C:
+			if ev.Type == "resync" {
+				LiveResyncs.WithLabelValues("ws").Inc()
+			}
+			conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				return
+			}
+		case <-reauth.C:
+			if _, reason, _ := s.authorizeRequest(r, ScopeRead); reason != "" && reason != "unavailable" {
+				wsClose(conn, websocket.ClosePolicyViolation, "credentials no longer valid")
+				return
+			}
+		}
+	}
+}
+
+// HandleTodoEvents serves GET /todos/events: the same stream as /ws as Server-Sent
+// Events, for clients that cannot use WebSockets. Each event is named after its type
+// and carries the /ws message as data; changes have a position in todo_events as event
+// id, so an EventSource that reconnects resumes after Last-Event-ID (the header, or the
+// last_event_id query parameter for clients that cannot set it). Comments every 15
+// seconds keep proxies from closing the idle stream. The credentials are checked again
+// every minute, as for /ws; the stream then ends, and the reconnect is refused.
+func (s *Server) HandleTodoEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var after *eventPos
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		pos, err := parseEventPos(lastID)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		after = &pos
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // tell proxies not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+	LiveConnections.WithLabelValues("sse").Inc()
+	defer LiveConnections.WithLabelValues("sse").Dec()
+
+	// Every write gets its own deadline, replacing the server's WriteTimeout, which
+	// would otherwise end the stream.
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...any) bool {
+		rc.SetWriteDeadline(time.Now().Add(liveWriteWait))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !write("retry: 3000\n\n") {
+		return
+	}
+
+	ctx := r.Context()
+	feed := s.newLiveFeed(ctx, TodoChanges, TodoOwner(ctx), after)
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	reauth := time.NewTicker(liveReauthInterval)
+	defer reauth.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-feed.C:
+			if ev.Type == "resync" {
+				LiveResyncs.WithLabelValues("sse").Inc()
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("Failed to encode live update", "error", err)
+				continue
+			}
+			ok := false
+			if ev.After != (eventPos{}) {
+				ok = write("id: %s\nevent: %s\ndata: %s\n\n", ev.After, ev.Type, data)
+			} else {
+				ok = write("event: %s\ndata: %s\n\n", ev.Type, data)
+			}
+			if !ok {
+				return
+			}
+		case <-heartbeat.C:
+			if !write(": heartbeat\n\n") {
+				return
+			}
+		case <-reauth.C:
+			if _, reason, _ := s.authorizeRequest(r, ScopeRead); reason != "" && reason != "unavailable" {
+				return
+			}
+		}
+	}
+}
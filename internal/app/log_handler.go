@@ -0,0 +1,39 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"io"
+	"log/slog"
+)
+
+// NewLogHandler returns the handler for log.format: "json", "text", or "cloud", which
+// is JSON with the field names Cloud Logging maps to severity and message.
+func NewLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts)
+	case "cloud":
+		opts.ReplaceAttr = cloudLoggingAttr
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.MessageKey:
+		a.Key = "message"
+	case slog.LevelKey:
+		a.Key = "severity"
+		if l, ok := a.Value.Any().(slog.Level); ok && l == slog.LevelWarn {
+			a.Value = slog.StringValue("WARNING")
+		}
+	}
+	return a
+}
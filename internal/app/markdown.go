@@ -0,0 +1,142 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// renderMarkdown renders the markdown of comments to HTML that is safe to insert in a
+// page. It supports a small subset: paragraphs, line breaks, fenced code blocks,
+// bullet and numbered lists, block quotes, `code`, **strong**, *emphasis* and
+// [links](https://example.com). Everything is HTML-escaped first, so the only markup
+// in the output is the markup this function writes; links must be http, https or
+// mailto.
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	var para []string
+	list := "" // "ul" or "ol" while in a list
+	closeBlocks := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + strings.Join(para, "<br>\n") + "</p>\n")
+			para = nil
+		}
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	item := func(kind, text string) {
+		if list != kind {
+			closeBlocks()
+			b.WriteString("<" + kind + ">\n")
+			list = kind
+		}
+		b.WriteString("<li>" + renderInline(text) + "</li>\n")
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case strings.HasPrefix(line, "```"):
+			closeBlocks()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case line == "":
+			closeBlocks()
+		case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "), strings.HasPrefix(line, "+ "):
+			item("ul", line[2:])
+		case markdownNumbered.MatchString(line):
+			item("ol", markdownNumbered.ReplaceAllString(line, ""))
+		case strings.HasPrefix(line, ">"):
+			closeBlocks()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, renderInline(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"))))
+			}
+			i--
+			b.WriteString("<blockquote><p>" + strings.Join(quote, "<br>\n") + "</p></blockquote>\n")
+		default:
+			if list != "" {
+				closeBlocks()
+			}
+			para = append(para, renderInline(line))
+		}
+	}
+	closeBlocks()
+	return b.String()
+}
+
+var (
+	markdownNumbered = regexp.MustCompile(`^\d{1,9}[.)] `)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^()\s]+)\)`)
+	markdownStrong   = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*`)
+	markdownEm       = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*|\b_(\S(?:.*?\S)?)_\b`)
+)
+
+// renderInline renders the spans of one line: code spans first, so nothing inside
+// them is markup, then links, then emphasis.
+func renderInline(s string) string {
+	var b strings.Builder
+	parts := strings.Split(s, "`")
+	for i, part := range parts {
+		switch {
+		case i%2 == 0:
+			b.WriteString(renderLinks(part))
+		case i == len(parts)-1: // an unclosed backtick is text
+			b.WriteString("`" + renderLinks(part))
+		default:
+			b.WriteString("<code>" + html.EscapeString(part) + "</code>")
+		}
+	}
+	return b.String()
+}
+
+func renderLinks(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range markdownLink.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(renderEmphasis(s[last:m[0]]))
+		text, target := s[m[2]:m[3]], s[m[4]:m[5]]
+		if safeLink(target) {
+			fmt.Fprintf(&b, `<a href="%s" rel="nofollow noopener noreferrer">%s</a>`, html.EscapeString(target), renderEmphasis(text))
+		} else {
+			b.WriteString(renderEmphasis(s[m[0]:m[1]]))
+		}
+		last = m[1]
+	}
+	b.WriteString(renderEmphasis(s[last:]))
+	return b.String()
+}
+
+func renderEmphasis(s string) string {
+	s = html.EscapeString(s)
+	s = markdownStrong.ReplaceAllString(s, "<strong>$1</strong>")
+	return markdownEm.ReplaceAllString(s, "<em>$1$2</em>")
+}
+
+// safeLink accepts absolute http, https and mailto URLs, and not javascript: and the
+// like.
+func safeLink(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+var MCPToolCalls = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mcp_tool_calls_total",
+		Help: "Total number of MCP tool calls, by tool and result",
+	},
+	[]string{"tool", "result"}, // "ok", "error"
+)
+
+// MCP tools: the todo store behind a Model Context Protocol server, so AI
+// assistants can list, create and complete the caller's todos. The same server
+// runs over Streamable HTTP at /mcp, authenticated like every other endpoint, and
+// over stdin/stdout with -mcp-stdio.
+
+type mcpListTodosInput struct {
+	Status string `json:"status,omitempty" jsonschema:"all (default), pending or completed"`
+	ListID *int64 `json:"list_id,omitempty" jsonschema:"only todos on this shared list"`
+}
+
+type mcpListTodosOutput struct {
+	Todos []Todo `json:"todos"`
+}
+
+type mcpCreateTodoInput struct {
+	Task   string `json:"task" jsonschema:"the text of the todo"`
+	ListID *int64 `json:"list_id,omitempty" jsonschema:"add it to this shared list instead of the caller's own todos"`
+}
+
+type mcpCompleteTodoInput struct {
+	ID        int   `json:"id" jsonschema:"the todo id"`
+	Completed *bool `json:"completed,omitempty" jsonschema:"false marks the todo open again; true by default"`
+}
+
+// NewMCPServer returns an MCP server whose tools act as p: its todos, its lists
+// and its scopes. A nil p is the anonymous caller, as with auth.mode=optional.
+func (s *Server) NewMCPServer(p *Principal) *mcp.Server {
+	owner := anonymousOwner
+	if p != nil {
+		owner = p.Subject
+	}
+	ms := mcp.NewServer(&mcp.Implementation{Name: "todo-app", Version: GetBuildInfo().Version}, &mcp.ServerOptions{
+		Instructions: "Manage the user's todo list. Todos have an id, a task and a completed flag, and are either personal or on a shared list (list_id).",
+	})
+
+	mcp.AddTool(ms, &mcp.Tool{
+		Name:        "list_todos",
+		Description: "List the user's todos, including those on shared lists they belong to.",
+		Annotations: &mcp.ToolAnnotations{ReadOnlyHint: true},
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, in mcpListTodosInput) (*mcp.CallToolResult, mcpListTodosOutput, error) {
+		if in.Status != "" && in.Status != "all" && in.Status != "pending" && in.Status != "completed" {
+			return nil, mcpListTodosOutput{}, mcpResult("list_todos", fmt.Errorf("unknown status %q, want all, pending or completed", in.Status))
+		}
+		todos, err := s.listTodos(ctx, owner)
+		if err != nil {
+			return nil, mcpListTodosOutput{}, mcpResult("list_todos", mcpTodoError(err))
+		}
+		out := mcpListTodosOutput{Todos: []Todo{}}
+		for _, t := range todos {
+			if in.Status == "pending" && t.Completed || in.Status == "completed" && !t.Completed ||
+				in.ListID != nil && (t.ListID == nil || *t.ListID != *in.ListID) {
+				continue
+			}
+			out.Todos = append(out.Todos, t)
+		}
+		return nil, out, mcpResult("list_todos", nil)
+	})
+
+	mcp.AddTool(ms, &mcp.Tool{
+		Name:        "create_todo",
+		Description: "Create a todo for the user, or on a shared list they may edit. Returns the new todo.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, in mcpCreateTodoInput) (*mcp.CallToolResult, Todo, error) {
+		if err := mcpRequireWrite(p); err != nil {
+			return nil, Todo{}, mcpResult("create_todo", err)
+		}
+		t, err := s.Todos.Create(ctx, owner, in.Task, in.ListID)
+		if err != nil {
+			return nil, Todo{}, mcpResult("create_todo", mcpTodoError(err))
+		}
+		return nil, t, mcpResult("create_todo", nil)
+	})
+
+	mcp.AddTool(ms, &mcp.Tool{
+		Name:        "complete_todo",
+		Description: "Mark a todo completed, or open again with completed=false. Returns the updated todo.",
+		Annotations: &mcp.ToolAnnotations{IdempotentHint: true},
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, in mcpCompleteTodoInput) (*mcp.CallToolResult, Todo, error) {
+		if err := mcpRequireWrite(p); err != nil {
+			return nil, Todo{}, mcpResult("complete_todo", err)
+		}
+		completed := in.Completed == nil || *in.Completed
+		found, err := s.Todos.SetCompleted(ctx, owner, in.ID, completed)
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		var t Todo
+		if err == nil {
+			t, err = s.Todos.Get(ctx, owner, in.ID, true)
+		}
+		if err != nil {
+			return nil, Todo{}, mcpResult("complete_todo", mcpTodoError(err))
+		}
+		return nil, t, mcpResult("complete_todo", nil)
+	})
+	return ms
+}
+
+// NewMCPHandler serves MCP over Streamable HTTP. It runs stateless: every request
+// gets a fresh server for the principal AuthMiddleware put on it, so a session can
+// never outlive or change its credentials. Responses stream as Server-Sent Events.
+func (s *Server) NewMCPHandler() http.Handler {
+	return mcp.NewStreamableHTTPHandler(func(r *http.Request) *mcp.Server {
+		p, _ := PrincipalFromContext(r.Context())
+		return s.NewMCPServer(p)
+	}, &mcp.StreamableHTTPOptions{Stateless: true})
+}
+
+// ServeMCPStdio serves MCP on stdin and stdout until the client disconnects or ctx
+// is cancelled, acting as the owner of apiKey. Without a key it acts as the
+// anonymous caller, which auth.mode=required does not allow.
+func (s *Server) ServeMCPStdio(ctx context.Context, apiKey string) error {
+	var p *Principal
+	if apiKey != "" {
+		var err error
+		if p, err = s.APIKeys.Validate(ctx, apiKey); err != nil {
+			return fmt.Errorf("API key: %w", err)
+		}
+	} else if AuthMode == "required" {
+		return errors.New("auth.mode=required: set TODO_API_KEY to the API key to act as")
+	}
+	subject := anonymousOwner
+	if p != nil {
+		subject = p.Subject
+		ctx = WithPrincipal(ctx, p)
+	}
+	slog.Info("Serving MCP on stdio", "subject", subject)
+	start := s.Clock.Now()
+	err := s.NewMCPServer(p).Run(ctx, &mcp.StdioTransport{})
+	slog.Info("MCP client disconnected", "subject", subject, "duration", s.Clock.Now().Sub(start))
+	return err
+}
+
+// mcpRequireWrite checks the write scope, as graphqlRequireWrite does for mutations.
+func mcpRequireWrite(p *Principal) error {
+	if p != nil && !p.HasScope(ScopeWrite) {
+		AuthFailures.WithLabelValues("forbidden").Inc()
+		return errors.New("forbidden: missing scope " + ScopeWrite)
+	}
+	return nil
+}
+
+// mcpResult counts a tool call and passes err through. Errors become results with
+// isError set, so the assistant sees the message and can correct itself.
+func mcpResult(tool string, err error) error {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	MCPToolCalls.WithLabelValues(tool, result).Inc()
+	return err
+}
+
+// mcpTodoError maps a todo store error to a message for the assistant, as
+// grpcTodoError does for gRPC.
+func mcpTodoError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return errors.New("todo not found")
+	case errors.Is(err, errTodoForbidden):
+		return errors.New("you cannot add todos to this list")
+	case errors.Is(err, errTodoQuota):
+		return errors.New("todo quota exceeded")
+	case errors.Is(err, errTodoBlocked):
+		return errors.New("todo is blocked by open todos; complete those first")
+	case errors.Is(err, errInvalidTask):
+		return err
+	case errors.Is(err, errTaskCipher), errors.Is(err, gobreaker.ErrOpenState):
+		return errors.New("service temporarily unavailable, try again later")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	slog.Error("Database operation failed", "error", err)
+	return errors.New("internal error")
+}
@@ -0,0 +1,324 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Usage metering tracks requests, bytes and database time per client (API key or tenant)
+// as groundwork for quotas and billing. Each replica aggregates in memory and periodically
+// flushes per-minute buckets to usage_minutely; a rollup job folds them into usage_daily.
+
+const (
+	// maxMeteredSubjects bounds memory between flushes; extra subjects are folded into "other".
+	maxMeteredSubjects = 10000
+	// usageMinutelyRetention is how long raw buckets are kept after being rolled up.
+	usageMinutelyRetention = 7 * 24 * time.Hour
+)
+
+// Usage is the metered consumption of one subject.
+type Usage struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	DBTimeMS int64 `json:"db_time_ms"`
+}
+
+type usageKey struct {
+	subject string
+	bucket  time.Time
+}
+
+// Meter accumulates usage in memory until flushed.
+type Meter struct {
+	mu      sync.Mutex
+	pending map[usageKey]*Usage
+}
+
+// NewMeter returns an empty meter.
+func NewMeter() *Meter {
+	return &Meter{pending: make(map[usageKey]*Usage)}
+}
+
+// UsageMeter is the process-wide meter used by MeteringMiddleware.
+var UsageMeter = NewMeter()
+
+// Record adds one request's usage for subject in the current minute bucket.
+func (m *Meter) Record(subject string, at time.Time, u Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := usageKey{subject: subject, bucket: at.UTC().Truncate(time.Minute)}
+	acc, ok := m.pending[key]
+	if !ok {
+		if len(m.pending) >= maxMeteredSubjects {
+			key.subject = "other"
+			acc = m.pending[key]
+		}
+		if acc == nil {
+			acc = &Usage{}
+			m.pending[key] = acc
+		}
+	}
+	acc.Requests += u.Requests
+	acc.BytesIn += u.BytesIn
+	acc.BytesOut += u.BytesOut
+	acc.DBTimeMS += u.DBTimeMS
+}
+
+// Totals returns the not-yet-flushed usage summed per subject.
+func (m *Meter) Totals() map[string]Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := make(map[string]Usage)
+	for k, u := range m.pending {
+		t := totals[k.subject]
+		t.Requests += u.Requests
+		t.BytesIn += u.BytesIn
+		t.BytesOut += u.BytesOut
+		t.DBTimeMS += u.DBTimeMS
+		totals[k.subject] = t
+	}
+	return totals
+}
+
+// Flush writes pending buckets to db. Buckets that fail to write are merged back so
+// they are retried on the next flush.
+func (m *Meter) Flush(ctx context.Context, db *sql.DB) error {
+	m.mu.Lock()
+	batch := m.pending
+	m.pending = make(map[usageKey]*Usage)
+	m.mu.Unlock()
+
+	for key, u := range batch {
+		_, err := dbExec(ctx, db, "flush_usage", `INSERT INTO usage_minutely (subject, bucket_start, requests, bytes_in, bytes_out, db_time_ms)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (subject, bucket_start) DO UPDATE SET
+	requests = usage_minutely.requests + EXCLUDED.requests,
+	bytes_in = usage_minutely.bytes_in + EXCLUDED.bytes_in,
+	bytes_out = usage_minutely.bytes_out + EXCLUDED.bytes_out,
+	db_time_ms = usage_minutely.db_time_ms + EXCLUDED.db_time_ms`,
+			key.subject, key.bucket, u.Requests, u.BytesIn, u.BytesOut, u.DBTimeMS)
+		if err != nil {
+			for k, v := range batch {
+				m.Record(k.subject, k.bucket, *v)
+			}
+			return err
+		}
+		delete(batch, key)
+	}
+	return nil
+}
+
+// RollupUsage recomputes daily totals for today and yesterday from the minutely
+// buckets and prunes raw buckets past retention. Recomputing (rather than adding)
+// keeps the rollup idempotent when it runs on several replicas.
+func (s *Server) RollupUsage(ctx context.Context) error {
+	if _, err := dbExec(ctx, s.DB, "rollup_usage", `INSERT INTO usage_daily (subject, day, requests, bytes_in, bytes_out, db_time_ms)
+SELECT subject, (bucket_start AT TIME ZONE 'UTC')::date, SUM(requests), SUM(bytes_in), SUM(bytes_out), SUM(db_time_ms)
+FROM usage_minutely
+WHERE bucket_start >= date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' - interval '1 day'
+GROUP BY 1, 2
+ON CONFLICT (subject, day) DO UPDATE SET
+	requests = EXCLUDED.requests,
+	bytes_in = EXCLUDED.bytes_in,
+	bytes_out = EXCLUDED.bytes_out,
+	db_time_ms = EXCLUDED.db_time_ms`); err != nil {
+		return err
+	}
+	_, err := dbExec(ctx, s.DB, "prune_usage", "DELETE FROM usage_minutely WHERE bucket_start < $1", s.Clock.Now().Add(-usageMinutelyRetention))
+	return err
+}
+
+func init() {
+	registerJob("usage_rollup", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute, Timeout: 5 * time.Minute},
+		run:    func(s *Server, ctx context.Context, job *Job) (any, error) { return nil, s.RollupUsage(ctx) },
+		admin:  true,
+	})
+}
+
+// StartUsageMeter flushes the meter every flushInterval and rolls up every rollupInterval
+// until ctx is cancelled, with a final flush on the way out. With rollupInterval 0 it
+// does not roll up, for the scheduler to.
+func (s *Server) StartUsageMeter(ctx context.Context, flushInterval, rollupInterval time.Duration) {
+	Workers.Go(ctx, "usage_meter", func(ctx context.Context, w *Worker) {
+		flush := time.NewTicker(flushInterval)
+		defer flush.Stop()
+		var rollup <-chan time.Time
+		if rollupInterval > 0 {
+			ticker := time.NewTicker(rollupInterval)
+			defer ticker.Stop()
+			rollup = ticker.C
+		}
+		for {
+			select {
+			case <-w.Stop():
+				final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err := UsageMeter.Flush(final, s.DB)
+				w.Checkpoint(err)
+				if err != nil {
+					slog.Warn("Failed final usage flush", "error", err)
+				}
+				cancel()
+				return
+			case <-flush.C:
+				err := UsageMeter.Flush(ctx, s.DB)
+				w.Checkpoint(err)
+				if err != nil {
+					slog.Warn("Failed to flush usage metering", "error", err)
+				}
+			case <-rollup:
+				if err := s.RollupUsage(ctx); err != nil {
+					slog.Warn("Failed to roll up usage metering", "error", err)
+				}
+			}
+		}
+	})
+}
+
+// TenantHeader lets trusted callers attribute usage to a tenant.
+const TenantHeader = "X-Tenant-ID"
+
+// MeteringSubject identifies who a request is billed to.
+func MeteringSubject(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return p.Subject
+	}
+	if tenant := r.Header.Get(TenantHeader); tenant != "" && len(tenant) <= 64 {
+		return "tenant:" + tenant
+	}
+	return "anonymous"
+}
+
+type dbTimeKey struct{}
+
+// addDBTime accumulates database time into the request's metering context, if any.
+func addDBTime(ctx context.Context, d time.Duration) {
+	if acc, ok := ctx.Value(dbTimeKey{}).(*atomic.Int64); ok {
+		acc.Add(int64(d))
+	}
+}
+
+// MeteringMiddleware records usage for every request except probes and metrics scrapes.
+func (s *Server) MeteringMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dbTime := &atomic.Int64{}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingWriter{ResponseWriter: w}
+
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), dbTimeKey{}, dbTime)))
+
+		UsageMeter.Record(MeteringSubject(r), s.Clock.Now(), Usage{
+			Requests: 1,
+			BytesIn:  body.n,
+			BytesOut: cw.n,
+			DBTimeMS: time.Duration(dbTime.Load()).Milliseconds(),
+		})
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// UsageReportRow is one subject-day in the usage report.
+type UsageReportRow struct {
+	Subject string `json:"subject"`
+	Day     string `json:"day"`
+	Usage
+}
+
+// UsageReportHandler serves GET /admin/usage?from=YYYY-MM-DD&to=YYYY-MM-DD[&subject=...].
+// Defaults to the last 30 days.
+func (s *Server) UsageReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	to := s.Clock.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "Invalid 'from' date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "Invalid 'to' date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report := []UsageReportRow{}
+	err = s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(r.Context(), s.DBRead, "usage_report", `SELECT subject, day, requests, bytes_in, bytes_out, db_time_ms
+FROM usage_daily
+WHERE day BETWEEN $1 AND $2 AND ($3 = '' OR subject = $3)
+ORDER BY day, subject`, from.Format(time.DateOnly), to.Format(time.DateOnly), q.Get("subject"))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		report = report[:0]
+		for rows.Next() {
+			var row UsageReportRow
+			var day time.Time
+			if err := rows.Scan(&row.Subject, &day, &row.Requests, &row.BytesIn, &row.BytesOut, &row.DBTimeMS); err != nil {
+				return err
+			}
+			row.Day = day.Format(time.DateOnly)
+			report = append(report, row)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Failed to encode usage report", "error", err)
+	}
+}
@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Lifecycle timestamps used by the business metrics (time-to-completion).
+-- Existing rows get the migration time as created_at; completed rows get it as completed_at.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+UPDATE todos SET completed_at = created_at WHERE completed AND completed_at IS NULL;
@@ -0,0 +1,27 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Per-client usage metering. Raw per-minute buckets are flushed by each replica
+-- and rolled up into daily totals, which back GET /admin/usage.
+CREATE TABLE IF NOT EXISTS usage_minutely (
+    subject TEXT NOT NULL,
+    bucket_start TIMESTAMPTZ NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    bytes_in BIGINT NOT NULL DEFAULT 0,
+    bytes_out BIGINT NOT NULL DEFAULT 0,
+    db_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (subject, bucket_start)
+);
+
+CREATE INDEX IF NOT EXISTS usage_minutely_bucket_idx ON usage_minutely (bucket_start);
+
+CREATE TABLE IF NOT EXISTS usage_daily (
+    subject TEXT NOT NULL,
+    day DATE NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    bytes_in BIGINT NOT NULL DEFAULT 0,
+    bytes_out BIGINT NOT NULL DEFAULT 0,
+    db_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (subject, day)
+);
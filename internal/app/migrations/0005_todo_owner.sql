@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Every todo belongs to exactly one owner (the authenticated principal's subject).
+-- Rows created before ownership existed get the empty owner, which is what
+-- unauthenticated callers see; AssignUnownedTodos (TODO_LEGACY_OWNER) hands them to a real user.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS user_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS todos_user_id_idx ON todos (user_id, id);
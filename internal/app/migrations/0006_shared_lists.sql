@@ -0,0 +1,25 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Shared lists: a todo either belongs to a list (visible to its members) or has no
+-- list (personal, visible only to its owner).
+CREATE TABLE IF NOT EXISTS todo_lists (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    owner_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS list_members (
+    list_id BIGINT NOT NULL REFERENCES todo_lists (id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    added_by TEXT NOT NULL,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (list_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS list_members_user_id_idx ON list_members (user_id);
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS list_id BIGINT REFERENCES todo_lists (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS todos_list_id_idx ON todos (list_id, id);
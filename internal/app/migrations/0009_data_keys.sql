@@ -0,0 +1,14 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Data encryption keys for field-level (envelope) encryption. Each key is stored
+-- wrapped by Cloud KMS; kms_key_version records which KMS key version wrapped it,
+-- so rotation can find keys that still need rewrapping.
+CREATE TABLE IF NOT EXISTS data_keys (
+    id BIGSERIAL PRIMARY KEY,
+    wrapped_key BYTEA NOT NULL,
+    kms_key_version TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    rewrapped_at TIMESTAMPTZ
+);
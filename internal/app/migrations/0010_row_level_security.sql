@@ -0,0 +1,71 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Row-level security policies for RLS mode (RLS_MODE=true). The app sets
+-- app.current_tenant with SET LOCAL semantics in every transaction; background
+-- jobs use the '*' tenant. Policies bind the table owner only while
+-- FORCE ROW LEVEL SECURITY is set, which the app switches on or off at startup to
+-- match RLS_MODE, so this migration is a no-op for deployments running without it.
+--
+-- list_members is the source of truth the policies consult and is not itself
+-- row-protected (a policy on it could not consult it without infinite recursion).
+CREATE OR REPLACE FUNCTION app_current_tenant() RETURNS TEXT
+    LANGUAGE sql STABLE
+    AS $$ SELECT current_setting('app.current_tenant', true) $$;
+
+ALTER TABLE todos ENABLE ROW LEVEL SECURITY;
+ALTER TABLE todo_lists ENABLE ROW LEVEL SECURITY;
+
+-- Todos: members of a todo's list may read it, owners and editors may change it;
+-- personal todos (no list) are visible only to their owner.
+DROP POLICY IF EXISTS todos_select ON todos;
+CREATE POLICY todos_select ON todos FOR SELECT USING (
+    app_current_tenant() = '*'
+    OR (list_id IS NULL AND user_id = app_current_tenant())
+    OR list_id IN (SELECT list_id FROM list_members WHERE user_id = app_current_tenant())
+);
+
+DROP POLICY IF EXISTS todos_insert ON todos;
+CREATE POLICY todos_insert ON todos FOR INSERT WITH CHECK (
+    app_current_tenant() = '*'
+    OR (list_id IS NULL AND user_id = app_current_tenant())
+    OR list_id IN (SELECT list_id FROM list_members WHERE user_id = app_current_tenant() AND role IN ('owner', 'editor'))
+);
+
+DROP POLICY IF EXISTS todos_update ON todos;
+CREATE POLICY todos_update ON todos FOR UPDATE USING (
+    app_current_tenant() = '*'
+    OR (list_id IS NULL AND user_id = app_current_tenant())
+    OR list_id IN (SELECT list_id FROM list_members WHERE user_id = app_current_tenant() AND role IN ('owner', 'editor'))
+);
+
+DROP POLICY IF EXISTS todos_delete ON todos;
+CREATE POLICY todos_delete ON todos FOR DELETE USING (
+    app_current_tenant() = '*'
+    OR (list_id IS NULL AND user_id = app_current_tenant())
+    OR list_id IN (SELECT list_id FROM list_members WHERE user_id = app_current_tenant() AND role IN ('owner', 'editor'))
+);
+
+-- Lists: visible to members, created, renamed and deleted only by their owner.
+DROP POLICY IF EXISTS todo_lists_select ON todo_lists;
+CREATE POLICY todo_lists_select ON todo_lists FOR SELECT USING (
+    app_current_tenant() = '*'
+    OR owner_id = app_current_tenant()
+    OR id IN (SELECT list_id FROM list_members WHERE user_id = app_current_tenant())
+);
+
+DROP POLICY IF EXISTS todo_lists_insert ON todo_lists;
+CREATE POLICY todo_lists_insert ON todo_lists FOR INSERT WITH CHECK (
+    app_current_tenant() = '*' OR owner_id = app_current_tenant()
+);
+
+DROP POLICY IF EXISTS todo_lists_update ON todo_lists;
+CREATE POLICY todo_lists_update ON todo_lists FOR UPDATE USING (
+    app_current_tenant() = '*' OR owner_id = app_current_tenant()
+);
+
+DROP POLICY IF EXISTS todo_lists_delete ON todo_lists;
+CREATE POLICY todo_lists_delete ON todo_lists FOR DELETE USING (
+    app_current_tenant() = '*' OR owner_id = app_current_tenant()
+);
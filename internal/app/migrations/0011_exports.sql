@@ -0,0 +1,19 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Asynchronous todo exports. The finished file is kept until expires_at and is
+-- downloaded through a signed URL, so the download needs no credentials.
+CREATE TABLE IF NOT EXISTS exports (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    format TEXT NOT NULL CHECK (format IN ('json', 'csv')),
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'ready', 'failed')),
+    content BYTEA,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS exports_owner_id_idx ON exports (owner_id, id);
+CREATE INDEX IF NOT EXISTS exports_expires_at_idx ON exports (expires_at);
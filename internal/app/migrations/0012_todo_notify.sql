@@ -0,0 +1,33 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Change notifications for live updates (gRPC WatchTodos). Every insert, update and
+-- delete on todos is announced on the todo_changes channel, whichever replica made
+-- it. The payload only says which row changed and whose it is; listeners read the
+-- row themselves, with the watcher's own visibility rules. Notifications are sent
+-- at commit and dropped when nobody is listening.
+CREATE OR REPLACE FUNCTION notify_todo_change() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    r RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        r := OLD;
+    ELSE
+        r := NEW;
+    END IF;
+    PERFORM pg_notify('todo_changes', json_build_object(
+        'op', lower(TG_OP),
+        'id', r.id,
+        'user_id', r.user_id,
+        'list_id', r.list_id
+    )::text);
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_notify ON todos;
+CREATE TRIGGER todos_notify AFTER INSERT OR UPDATE OR DELETE ON todos
+    FOR EACH ROW EXECUTE FUNCTION notify_todo_change();
@@ -0,0 +1,45 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Change log for resumable live updates (SSE Last-Event-ID). Every change to todos is
+-- also recorded in todo_events, in the same transaction, and the notification carries
+-- the event's id as "seq". A stream that reconnects reads the events after the last id
+-- it saw from this table, so it does not matter which replica it reconnects to. Events
+-- are pruned after a day (StartTodoEventJanitor).
+CREATE TABLE IF NOT EXISTS todo_events (
+    id BIGSERIAL PRIMARY KEY,
+    op TEXT NOT NULL,
+    todo_id INTEGER NOT NULL,
+    user_id TEXT,
+    list_id BIGINT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS todo_events_created_at ON todo_events (created_at);
+
+CREATE OR REPLACE FUNCTION notify_todo_change() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    r RECORD;
+    seq BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        r := OLD;
+    ELSE
+        r := NEW;
+    END IF;
+    INSERT INTO todo_events (op, todo_id, user_id, list_id)
+        VALUES (lower(TG_OP), r.id, r.user_id, r.list_id)
+        RETURNING id INTO seq;
+    PERFORM pg_notify('todo_changes', json_build_object(
+        'seq', seq,
+        'op', lower(TG_OP),
+        'id', r.id,
+        'user_id', r.user_id,
+        'list_id', r.list_id
+    )::text);
+    RETURN NULL;
+END
+$$;
@@ -0,0 +1,43 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Outbox dispatch and webhooks. todo_events doubles as the outbox: the dispatcher
+-- hands every event to the configured sinks (webhooks, message buses) once and then
+-- sets dispatched_at. Events are only pruned once dispatched.
+ALTER TABLE todo_events ADD COLUMN IF NOT EXISTS dispatched_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS todo_events_undispatched ON todo_events (id) WHERE dispatched_at IS NULL;
+
+-- Callback URLs registered by users for the events of the todos they can see. The
+-- signing secret is stored like task text (envelope-encrypted when enabled).
+CREATE TABLE IF NOT EXISTS webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhooks_owner_id_idx ON webhooks (owner_id, id);
+
+-- One row per event and webhook, doubling as the delivery log. Pending deliveries
+-- are retried at next_attempt_at; after the last attempt they are dead (the dead
+-- letters), until retried by hand. The payload is stored like task text.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_seq BIGINT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_status_code INTEGER,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    UNIQUE (webhook_id, event_seq)
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
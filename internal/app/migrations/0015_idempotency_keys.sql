@@ -0,0 +1,23 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Responses to POST requests sent with an Idempotency-Key header, so a client that
+-- retries after a timeout gets the first response instead of creating a duplicate.
+-- Keys are scoped to the caller. A row without completed_at is a request still in
+-- progress. The response body is stored like task text (envelope-encrypted when
+-- enabled). Rows are pruned at expires_at (StartIdempotencyJanitor).
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    owner_id TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER,
+    content_type TEXT NOT NULL DEFAULT '',
+    location TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (owner_id, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
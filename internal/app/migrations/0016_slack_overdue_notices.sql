@@ -0,0 +1,11 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Todos the Slack integration has reported as overdue, so each is posted once. A
+-- replica claims a todo by inserting its row; when the post fails the row is deleted
+-- again and the next run retries.
+CREATE TABLE IF NOT EXISTS slack_overdue_notices (
+    todo_id INTEGER PRIMARY KEY REFERENCES todos (id) ON DELETE CASCADE,
+    notified_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
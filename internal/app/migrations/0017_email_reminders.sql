@@ -0,0 +1,31 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Email reminders. Users without a row get the defaults: every reminder on.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    subject TEXT PRIMARY KEY,
+    email_reminders BOOLEAN NOT NULL DEFAULT TRUE,
+    due_reminders BOOLEAN NOT NULL DEFAULT TRUE,
+    overdue_reminders BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The reminders to send, queued by the scheduler and sent by the email dispatcher:
+-- one row per todo and kind, so a todo is reminded of once per kind. Rows stay
+-- until their todo is deleted, for that reason. The email itself is rendered at send
+-- time, so it has the current task text and skips todos completed in the meantime.
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL CHECK (kind IN ('due', 'overdue')),
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'skipped', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at TIMESTAMPTZ,
+    UNIQUE (kind, todo_id)
+);
+CREATE INDEX IF NOT EXISTS email_outbox_pending ON email_outbox (next_attempt_at) WHERE status = 'pending';
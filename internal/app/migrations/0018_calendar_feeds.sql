@@ -0,0 +1,11 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Secret calendar URLs: one per user, identified by the SHA-256 of its token like API
+-- keys. Creating a new one replaces the row, so the old URL stops working.
+CREATE TABLE IF NOT EXISTS calendar_feeds (
+    subject TEXT PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
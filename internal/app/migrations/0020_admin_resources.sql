@@ -0,0 +1,42 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Named admin resources for declarative tools (Terraform): an API key or webhook
+-- created through /admin/resources carries the name it is managed by. A name is
+-- unique among active keys, so it can be reused once its key is revoked.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS resource_name TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_resource_name ON api_keys (resource_name)
+    WHERE resource_name IS NOT NULL AND revoked_at IS NULL;
+
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS resource_name TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_resource_name ON webhooks (resource_name)
+    WHERE resource_name IS NOT NULL;
+
+-- Per-subject limits. A subject without a row has none.
+CREATE TABLE IF NOT EXISTS quotas (
+    subject TEXT PRIMARY KEY,
+    max_todos INTEGER NOT NULL CHECK (max_todos >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- max_todos is checked by a trigger, so every way of creating todos (REST, gRPC,
+-- GraphQL, MCP, imports) is covered. Concurrent inserts may overshoot it slightly.
+CREATE OR REPLACE FUNCTION enforce_todo_quota() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    max_todos INTEGER;
+BEGIN
+    SELECT q.max_todos INTO max_todos FROM quotas q WHERE q.subject = NEW.user_id;
+    IF max_todos IS NOT NULL AND (SELECT count(*) FROM todos WHERE user_id = NEW.user_id) >= max_todos THEN
+        RAISE EXCEPTION 'todo quota of % exceeded', max_todos
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'todo_quota';
+    END IF;
+    RETURN NEW;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_quota ON todos;
+CREATE TRIGGER todos_quota BEFORE INSERT ON todos FOR EACH ROW EXECUTE FUNCTION enforce_todo_quota();
@@ -0,0 +1,33 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Due dates. A todo without due_at has no due date; existing todos start without one.
+-- Reminders, Slack overdue notices and the calendar feeds go by due_at.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS todos_open_due_at ON todos (due_at) WHERE due_at IS NOT NULL AND NOT completed;
+
+-- The timezone "today" is computed in for a subject, as an IANA name. A subject
+-- without a row uses UTC.
+CREATE TABLE IF NOT EXISTS user_settings (
+    subject TEXT PRIMARY KEY,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- A todo is reminded of and reported overdue once per due date: moving the due date
+-- forgets the reminders and notices sent for the old one.
+CREATE OR REPLACE FUNCTION reset_todo_due_notices() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    DELETE FROM email_outbox WHERE todo_id = NEW.id;
+    DELETE FROM slack_overdue_notices WHERE todo_id = NEW.id;
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_due_changed ON todos;
+CREATE TRIGGER todos_due_changed AFTER UPDATE OF due_at ON todos
+    FOR EACH ROW WHEN (OLD.due_at IS DISTINCT FROM NEW.due_at)
+    EXECUTE FUNCTION reset_todo_due_notices();
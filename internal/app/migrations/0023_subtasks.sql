@@ -0,0 +1,43 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Subtasks. A todo with a parent_id is a subtask of that todo, on the same list (or
+-- personal, like it). Deleting a todo deletes its subtasks. The app keeps the tree
+-- acyclic and shallow (see setTodoParentQuery).
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES todos (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS todos_parent ON todos (parent_id) WHERE parent_id IS NOT NULL;
+
+-- Completion rolls up: a todo with subtasks is completed exactly when all of them
+-- are. Updating the parent fires the trigger again, so the change climbs the tree
+-- until a todo's state no longer changes. Completing a todo with open subtasks
+-- directly is allowed and stays until a subtask changes.
+CREATE OR REPLACE FUNCTION roll_up_todo_completion() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    parents INTEGER[];
+    p INTEGER;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        parents := ARRAY[NEW.parent_id];
+    ELSIF TG_OP = 'DELETE' THEN
+        parents := ARRAY[OLD.parent_id];
+    ELSE
+        parents := ARRAY[NEW.parent_id, OLD.parent_id];
+    END IF;
+    FOREACH p IN ARRAY parents LOOP
+        CONTINUE WHEN p IS NULL;
+        UPDATE todos t
+        SET completed = s.all_done,
+            completed_at = CASE WHEN s.all_done THEN COALESCE(t.completed_at, now()) ELSE NULL END
+        FROM (SELECT bool_and(COALESCE(completed, FALSE)) AS all_done FROM todos WHERE parent_id = p) s
+        WHERE t.id = p AND s.all_done IS NOT NULL AND t.completed IS DISTINCT FROM s.all_done;
+    END LOOP;
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_roll_up ON todos;
+CREATE TRIGGER todos_roll_up AFTER INSERT OR DELETE OR UPDATE OF completed, parent_id ON todos
+    FOR EACH ROW EXECUTE FUNCTION roll_up_todo_completion();
@@ -0,0 +1,9 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Lists as projects: an optional color ("#rrggbb") and an archived flag. Archived
+-- lists keep their todos readable but take no new ones. Personal todos (no list)
+-- make up each user's Inbox, so existing todos need no migration.
+ALTER TABLE todo_lists ADD COLUMN IF NOT EXISTS color TEXT CHECK (color ~ '^#[0-9a-f]{6}$');
+ALTER TABLE todo_lists ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,11 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Recurring todos. rrule is an iCalendar RRULE (the subset ParseRRule accepts) and
+-- recurrence_start the series' DTSTART, the due date of its first todo. Every
+-- occurrence carries both; completing one spawns the next (the "recurrence" job),
+-- which next_todo_id records so it happens only once.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS rrule TEXT;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS recurrence_start TIMESTAMPTZ;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS next_todo_id INTEGER REFERENCES todos (id) ON DELETE SET NULL;
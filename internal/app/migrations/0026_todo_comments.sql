@@ -0,0 +1,15 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Comments on todos. body is the markdown as written (envelope-encrypted like task
+-- text when encryption is enabled); it is sanitized when rendered, not when stored.
+-- Comments go with their todo.
+CREATE TABLE IF NOT EXISTS todo_comments (
+    id SERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    author TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS todo_comments_todo ON todo_comments (todo_id, id);
@@ -0,0 +1,40 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Files attached to todos. The files live in a GCS bucket (attachments.bucket); a
+-- row is pending from the moment an upload URL is handed out until the upload is
+-- checked, then ready. name is envelope-encrypted like task text.
+CREATE TABLE IF NOT EXISTS todo_attachments (
+    id SERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    uploader TEXT NOT NULL,
+    object TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'ready')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS todo_attachments_todo ON todo_attachments (todo_id, id);
+
+-- Objects whose row is gone, however it went (deleting the attachment, its todo or
+-- its list), wait here for the attachment cleanup to delete them from the bucket.
+CREATE TABLE IF NOT EXISTS attachment_orphans (
+    id BIGSERIAL PRIMARY KEY,
+    object TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION record_attachment_orphan() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    INSERT INTO attachment_orphans (object) VALUES (OLD.object);
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todo_attachments_orphan ON todo_attachments;
+CREATE TRIGGER todo_attachments_orphan AFTER DELETE ON todo_attachments
+    FOR EACH ROW EXECUTE FUNCTION record_attachment_orphan();
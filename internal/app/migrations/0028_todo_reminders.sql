@@ -0,0 +1,39 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Reminders at a time of the user's choosing. The scheduler queues a 'reminder' email
+-- for every open todo whose remind_at has passed; a todo without remind_at has none.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS remind_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS todos_open_remind_at ON todos (remind_at) WHERE remind_at IS NOT NULL AND NOT completed;
+
+ALTER TABLE email_outbox DROP CONSTRAINT IF EXISTS email_outbox_kind_check;
+ALTER TABLE email_outbox ADD CONSTRAINT email_outbox_kind_check CHECK (kind IN ('due', 'overdue', 'reminder'));
+
+-- Moving the due date forgets the due and overdue reminders sent for the old one, but
+-- not the reminder at remind_at.
+CREATE OR REPLACE FUNCTION reset_todo_due_notices() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    DELETE FROM email_outbox WHERE todo_id = NEW.id AND kind IN ('due', 'overdue');
+    DELETE FROM slack_overdue_notices WHERE todo_id = NEW.id;
+    RETURN NULL;
+END
+$$;
+
+-- A todo is reminded of once per remind_at: setting or snoozing it forgets the
+-- reminder queued or sent for the old time.
+CREATE OR REPLACE FUNCTION reset_todo_reminder() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    DELETE FROM email_outbox WHERE todo_id = NEW.id AND kind = 'reminder';
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_remind_at_changed ON todos;
+CREATE TRIGGER todos_remind_at_changed AFTER UPDATE OF remind_at ON todos
+    FOR EACH ROW WHEN (OLD.remind_at IS DISTINCT FROM NEW.remind_at)
+    EXECUTE FUNCTION reset_todo_reminder();
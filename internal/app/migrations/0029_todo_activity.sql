@@ -0,0 +1,60 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The activity log behind GET /activity: what happened to a todo, recorded by
+-- triggers in the same transaction as the change, so every API is covered. Unlike
+-- todo_events it is kept, and says what kind of change it was. actor is who made
+-- the change where the database knows it: the creator, the comment's author, and
+-- otherwise the tenant of RLS mode (NULL without it). Activity goes with its todo.
+CREATE TABLE IF NOT EXISTS todo_activity (
+    id BIGSERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('created', 'completed', 'commented', 'due_changed')),
+    actor TEXT,
+    detail JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS todo_activity_todo ON todo_activity (todo_id, id);
+
+-- Existing todos start with their creation and completion, in the order they happened.
+INSERT INTO todo_activity (todo_id, kind, actor, created_at)
+SELECT todo_id, kind, actor, at FROM (
+    SELECT id AS todo_id, 'created' AS kind, user_id AS actor, created_at AS at FROM todos
+    UNION ALL
+    SELECT id, 'completed', NULL, completed_at FROM todos WHERE completed AND completed_at IS NOT NULL
+) a
+WHERE NOT EXISTS (SELECT 1 FROM todo_activity)
+ORDER BY at, todo_id, kind DESC;
+
+CREATE OR REPLACE FUNCTION record_todo_activity() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    tenant TEXT := NULLIF(NULLIF(app_current_tenant(), ''), '*');
+BEGIN
+    IF TG_TABLE_NAME = 'todo_comments' THEN
+        INSERT INTO todo_activity (todo_id, kind, actor, detail)
+            VALUES (NEW.todo_id, 'commented', NEW.author, json_build_object('comment_id', NEW.id));
+    ELSIF TG_OP = 'INSERT' THEN
+        INSERT INTO todo_activity (todo_id, kind, actor) VALUES (NEW.id, 'created', NEW.user_id);
+    ELSE
+        IF NEW.completed AND NOT OLD.completed THEN
+            INSERT INTO todo_activity (todo_id, kind, actor) VALUES (NEW.id, 'completed', tenant);
+        END IF;
+        IF NEW.due_at IS DISTINCT FROM OLD.due_at THEN
+            INSERT INTO todo_activity (todo_id, kind, actor, detail)
+                VALUES (NEW.id, 'due_changed', tenant, json_build_object('from', OLD.due_at, 'to', NEW.due_at));
+        END IF;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_activity ON todos;
+CREATE TRIGGER todos_activity AFTER INSERT OR UPDATE OF completed, due_at ON todos
+    FOR EACH ROW EXECUTE FUNCTION record_todo_activity();
+
+DROP TRIGGER IF EXISTS todo_comments_activity ON todo_comments;
+CREATE TRIGGER todo_comments_activity AFTER INSERT ON todo_comments
+    FOR EACH ROW EXECUTE FUNCTION record_todo_activity();
@@ -0,0 +1,48 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Lifecycle timestamps, kept by the database so every write path keeps them alike:
+-- updated_at is the last change to the row, and completed_at is when it was last
+-- completed (NULL while open), whether the app, an import or the subtask roll-up
+-- completed it. created_at and completed_at come from migration 0002.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+
+-- The backfill must not announce every todo as changed to the live feeds, webhooks
+-- and event buses.
+ALTER TABLE todos DISABLE TRIGGER todos_notify;
+UPDATE todos SET completed_at = created_at WHERE completed AND completed_at IS NULL;
+UPDATE todos SET completed_at = NULL WHERE NOT completed AND completed_at IS NOT NULL;
+UPDATE todos SET updated_at = GREATEST(created_at, completed_at) WHERE updated_at IS NULL;
+ALTER TABLE todos ENABLE TRIGGER todos_notify;
+
+ALTER TABLE todos ALTER COLUMN updated_at SET DEFAULT now();
+ALTER TABLE todos ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS todos_created_at ON todos (created_at);
+CREATE INDEX IF NOT EXISTS todos_updated_at ON todos (updated_at);
+CREATE INDEX IF NOT EXISTS todos_completed_at ON todos (completed_at) WHERE completed_at IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION stamp_todo_times() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW IS NOT DISTINCT FROM OLD THEN
+            RETURN NEW;
+        END IF;
+        NEW.created_at := OLD.created_at;
+        NEW.updated_at := now();
+    END IF;
+    IF NOT NEW.completed THEN
+        NEW.completed_at := NULL;
+    ELSE
+        NEW.completed_at := COALESCE(NEW.completed_at, now());
+    END IF;
+    RETURN NEW;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todos_timestamps ON todos;
+CREATE TRIGGER todos_timestamps BEFORE INSERT OR UPDATE ON todos
+    FOR EACH ROW EXECUTE FUNCTION stamp_todo_times();
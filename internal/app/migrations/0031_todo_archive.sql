@@ -0,0 +1,8 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Archived todos are kept, with their comments and activity, but left out of the todo
+-- lists and the due date views unless asked for (?include=archived). Archiving is
+-- separate from completing: a todo can be completed and archived, or either.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE;
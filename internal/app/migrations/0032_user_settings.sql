@@ -0,0 +1,10 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The rest of the settings at /me/settings. The default list is forgotten with its
+-- list. ui holds only the UI preferences a user has chosen, validated by the app;
+-- the others take their defaults when read, so changing a default reaches everyone
+-- who never chose.
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS default_list_id BIGINT REFERENCES todo_lists (id) ON DELETE SET NULL;
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS ui JSONB NOT NULL DEFAULT '{}' CHECK (jsonb_typeof(ui) = 'object');
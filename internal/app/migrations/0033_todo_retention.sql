@@ -0,0 +1,42 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- When a todo was archived, for the retention policy that purges archived todos:
+-- kept by stamp_todo_times like completed_at, NULL while not archived.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ;
+
+-- Todos archived before now count from their last change. The backfill changes
+-- nothing anyone needs to hear about, nor the todos' updated_at.
+ALTER TABLE todos DISABLE TRIGGER todos_notify;
+ALTER TABLE todos DISABLE TRIGGER todos_timestamps;
+UPDATE todos SET archived_at = updated_at WHERE archived AND archived_at IS NULL;
+ALTER TABLE todos ENABLE TRIGGER todos_timestamps;
+ALTER TABLE todos ENABLE TRIGGER todos_notify;
+
+CREATE INDEX IF NOT EXISTS todos_archived_at ON todos (archived_at) WHERE archived_at IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION stamp_todo_times() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW IS NOT DISTINCT FROM OLD THEN
+            RETURN NEW;
+        END IF;
+        NEW.created_at := OLD.created_at;
+        NEW.updated_at := now();
+    END IF;
+    IF NOT NEW.completed THEN
+        NEW.completed_at := NULL;
+    ELSE
+        NEW.completed_at := COALESCE(NEW.completed_at, now());
+    END IF;
+    IF NOT NEW.archived THEN
+        NEW.archived_at := NULL;
+    ELSE
+        NEW.archived_at := COALESCE(NEW.archived_at, now());
+    END IF;
+    RETURN NEW;
+END
+$$;
@@ -0,0 +1,22 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Exports can be the zip archive of all of a user's data (POST /me/export).
+ALTER TABLE exports DROP CONSTRAINT IF EXISTS exports_format_check;
+ALTER TABLE exports ADD CONSTRAINT exports_format_check CHECK (format IN ('json', 'csv', 'zip'));
+
+-- The audit record of each erasure of a user's data (POST /me/delete). The subject
+-- is kept only as its SHA-256, which answers whether someone's data was erased
+-- without saying whose; pseudonym is who the rows kept for other users now belong to.
+CREATE TABLE IF NOT EXISTS erasures (
+    id BIGSERIAL PRIMARY KEY,
+    subject_hash TEXT NOT NULL,
+    pseudonym TEXT NOT NULL,
+    erased JSONB NOT NULL,
+    anonymized JSONB NOT NULL,
+    lists_handed_over BIGINT NOT NULL DEFAULT 0,
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS erasures_subject_hash ON erasures (subject_hash);
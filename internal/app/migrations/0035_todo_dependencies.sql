@@ -0,0 +1,15 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Dependencies between todos: todo_id is blocked by blocker_id, and cannot be
+-- completed while it is open. The app keeps them on one list and acyclic (see
+-- addDependencyQuery); they go with either todo.
+CREATE TABLE IF NOT EXISTS todo_dependencies (
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    blocker_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (todo_id, blocker_id),
+    CHECK (todo_id <> blocker_id)
+);
+CREATE INDEX IF NOT EXISTS todo_dependencies_blocker ON todo_dependencies (blocker_id);
@@ -0,0 +1,8 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Starred todos are pinned for everyone who can see them: ?starred=true lists only
+-- them and ?sort=starred puts them first. Few todos are starred, so the index is too.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS starred BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE INDEX IF NOT EXISTS todos_starred ON todos (id) WHERE starred;
@@ -0,0 +1,47 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Tenants partition the service between organisations. Subjects outside the default
+-- tenant are qualified by it ("acme/user:123"), so data, quotas and row-level
+-- security follow from the subject; this table only holds per-tenant overrides.
+-- NULL limits fall back to the configuration.
+CREATE TABLE IF NOT EXISTS tenants (
+    id TEXT PRIMARY KEY CHECK (id ~ '^[a-z0-9][a-z0-9-]{0,62}$'),
+    name TEXT NOT NULL DEFAULT '',
+    max_todos INTEGER CHECK (max_todos >= 0),
+    requests_per_minute INTEGER CHECK (requests_per_minute >= 0),
+    features JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+INSERT INTO tenants (id, name) VALUES ('default', 'Default') ON CONFLICT DO NOTHING;
+
+-- An API key may be bound to a tenant; unbound keys belong to the default tenant.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant_id TEXT REFERENCES tenants (id);
+
+-- subject_tenant is the tenant a subject belongs to, as subjectTenant in tenants.go.
+CREATE OR REPLACE FUNCTION subject_tenant(subject TEXT) RETURNS TEXT
+    LANGUAGE sql IMMUTABLE
+    AS $$
+    SELECT COALESCE(substring(subject FROM '^([a-z0-9][a-z0-9-]*)/'), 'default')
+$$;
+
+-- A subject without a quota of its own gets its tenant's max_todos.
+CREATE OR REPLACE FUNCTION enforce_todo_quota() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    max_todos INTEGER;
+BEGIN
+    SELECT q.max_todos INTO max_todos FROM quotas q WHERE q.subject = NEW.user_id;
+    IF max_todos IS NULL THEN
+        SELECT t.max_todos INTO max_todos FROM tenants t WHERE t.id = subject_tenant(NEW.user_id);
+    END IF;
+    IF max_todos IS NOT NULL AND (SELECT count(*) FROM todos WHERE user_id = NEW.user_id) >= max_todos THEN
+        RAISE EXCEPTION 'todo quota of % exceeded', max_todos
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'todo_quota';
+    END IF;
+    RETURN NEW;
+END
+$$;
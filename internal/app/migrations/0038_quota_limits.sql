@@ -0,0 +1,93 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- More quotas beside max_todos: open todos, owned lists and the bytes of uploaded
+-- attachments. Each is set per subject in quotas or per tenant in tenants; a subject's
+-- own limit wins, limit by limit, and NULL in both means no limit.
+ALTER TABLE quotas ALTER COLUMN max_todos DROP NOT NULL;
+ALTER TABLE quotas
+    ADD COLUMN IF NOT EXISTS max_open_todos INTEGER CHECK (max_open_todos >= 0),
+    ADD COLUMN IF NOT EXISTS max_lists INTEGER CHECK (max_lists >= 0),
+    ADD COLUMN IF NOT EXISTS max_attachment_bytes BIGINT CHECK (max_attachment_bytes >= 0);
+ALTER TABLE tenants
+    ADD COLUMN IF NOT EXISTS max_open_todos INTEGER CHECK (max_open_todos >= 0),
+    ADD COLUMN IF NOT EXISTS max_lists INTEGER CHECK (max_lists >= 0),
+    ADD COLUMN IF NOT EXISTS max_attachment_bytes BIGINT CHECK (max_attachment_bytes >= 0);
+
+-- quota_limit is the limit named by column (max_todos, max_open_todos, ...) of subject:
+-- its own, else its tenant's.
+CREATE OR REPLACE FUNCTION quota_limit(subject TEXT, col TEXT) RETURNS BIGINT
+    LANGUAGE sql STABLE
+    AS $$
+    SELECT COALESCE(
+        (SELECT (to_jsonb(q) ->> col)::bigint FROM quotas q WHERE q.subject = quota_limit.subject),
+        (SELECT (to_jsonb(t) ->> col)::bigint FROM tenants t WHERE t.id = subject_tenant(quota_limit.subject)))
+$$;
+
+-- Like max_todos, the quotas are checked by triggers, so every way of writing is
+-- covered; concurrent writes may overshoot them slightly. The limit goes in DETAIL
+-- for the error message.
+CREATE OR REPLACE FUNCTION enforce_todo_quota() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    max_todos BIGINT := quota_limit(NEW.user_id, 'max_todos');
+    max_open BIGINT := quota_limit(NEW.user_id, 'max_open_todos');
+BEGIN
+    IF TG_OP = 'INSERT' AND max_todos IS NOT NULL
+        AND (SELECT count(*) FROM todos WHERE user_id = NEW.user_id) >= max_todos THEN
+        RAISE EXCEPTION 'todo quota of % exceeded', max_todos
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'todo_quota', DETAIL = max_todos::text;
+    END IF;
+    IF max_open IS NOT NULL AND NOT COALESCE(NEW.completed, FALSE)
+        AND (SELECT count(*) FROM todos WHERE user_id = NEW.user_id AND NOT COALESCE(completed, FALSE)) >= max_open THEN
+        RAISE EXCEPTION 'open todo quota of % exceeded', max_open
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'open_todo_quota', DETAIL = max_open::text;
+    END IF;
+    RETURN NEW;
+END
+$$;
+
+-- Reopening a completed todo counts against max_open_todos like a new one.
+DROP TRIGGER IF EXISTS todos_reopen_quota ON todos;
+CREATE TRIGGER todos_reopen_quota BEFORE UPDATE OF completed ON todos FOR EACH ROW
+    WHEN (COALESCE(OLD.completed, FALSE) AND NOT COALESCE(NEW.completed, FALSE))
+    EXECUTE FUNCTION enforce_todo_quota();
+
+CREATE OR REPLACE FUNCTION enforce_list_quota() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    max_lists BIGINT := quota_limit(NEW.owner_id, 'max_lists');
+BEGIN
+    IF max_lists IS NOT NULL AND (SELECT count(*) FROM todo_lists WHERE owner_id = NEW.owner_id) >= max_lists THEN
+        RAISE EXCEPTION 'list quota of % exceeded', max_lists
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'list_quota', DETAIL = max_lists::text;
+    END IF;
+    RETURN NEW;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todo_lists_quota ON todo_lists;
+CREATE TRIGGER todo_lists_quota BEFORE INSERT ON todo_lists FOR EACH ROW EXECUTE FUNCTION enforce_list_quota();
+
+-- Attachments count with the size declared when the upload starts, pending or not, so
+-- parallel uploads cannot get past the quota.
+CREATE OR REPLACE FUNCTION enforce_attachment_quota() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    max_bytes BIGINT := quota_limit(NEW.uploader, 'max_attachment_bytes');
+BEGIN
+    IF max_bytes IS NOT NULL
+        AND (SELECT COALESCE(sum(size), 0) FROM todo_attachments WHERE uploader = NEW.uploader) + NEW.size > max_bytes THEN
+        RAISE EXCEPTION 'attachment quota of % bytes exceeded', max_bytes
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'attachment_quota', DETAIL = max_bytes::text;
+    END IF;
+    RETURN NEW;
+END
+$$;
+
+DROP TRIGGER IF EXISTS todo_attachments_quota ON todo_attachments;
+CREATE TRIGGER todo_attachments_quota BEFORE INSERT ON todo_attachments FOR EACH ROW EXECUTE FUNCTION enforce_attachment_quota();
@@ -0,0 +1,36 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- A todo's version counts its changes, for offline clients to detect conflicting
+-- writes (POST /sync). Like updated_at it is kept by the database, so every write
+-- path bumps it.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+CREATE OR REPLACE FUNCTION stamp_todo_times() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW IS NOT DISTINCT FROM OLD THEN
+            RETURN NEW;
+        END IF;
+        NEW.created_at := OLD.created_at;
+        NEW.updated_at := now();
+        NEW.version := OLD.version + 1;
+    ELSE
+        NEW.version := 1;
+    END IF;
+    IF NOT NEW.completed THEN
+        NEW.completed_at := NULL;
+    ELSE
+        NEW.completed_at := COALESCE(NEW.completed_at, now());
+    END IF;
+    IF NOT NEW.archived THEN
+        NEW.archived_at := NULL;
+    ELSE
+        NEW.archived_at := COALESCE(NEW.archived_at, now());
+    END IF;
+    RETURN NEW;
+END
+$$;
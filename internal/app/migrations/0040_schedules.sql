@@ -0,0 +1,15 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- The cron schedules of the periodic jobs (scheduler.go). Every replica runs the
+-- scheduler; the one that moves next_run_at on from a time that has passed starts the
+-- run, so each run is started once. last_job_id is the job of the last run, whose
+-- status tells whether it is still going.
+CREATE TABLE IF NOT EXISTS schedules (
+    name TEXT PRIMARY KEY,
+    spec TEXT NOT NULL,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    last_run_at TIMESTAMPTZ,
+    last_job_id BIGINT REFERENCES jobs (id) ON DELETE SET NULL
+);
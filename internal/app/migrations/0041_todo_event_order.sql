@@ -0,0 +1,54 @@
+-- Written by Gemini CLI
+-- This file is licensed under the MIT License.
+-- See the LICENSE file for details.
+
+-- Commit-safe positions in todo_events for sync tokens and SSE resumes. Event ids come
+-- from a sequence before commit, so a transaction can commit an event below an id a
+-- reader already passed, and that reader never sees it. Each event now records its
+-- transaction, and readers order by (xid, id) and only read events whose transaction
+-- is older than every one still running (pg_snapshot_xmin): nothing can then commit
+-- before a position once handed out. Existing events all get the xid of this
+-- migration, which is committed before anyone reads them.
+ALTER TABLE todo_events ADD COLUMN IF NOT EXISTS xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+CREATE INDEX IF NOT EXISTS todo_events_xid ON todo_events (xid, id);
+
+-- The highest position the janitor has purged. A position below it may have lost the
+-- changes after it, so it cannot be resumed from; one at or above it can, even when
+-- todo_events is empty.
+CREATE TABLE IF NOT EXISTS todo_event_horizon (
+    one BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (one),
+    xid xid8 NOT NULL,
+    id BIGINT NOT NULL
+);
+INSERT INTO todo_event_horizon (xid, id) VALUES ('0', 0) ON CONFLICT DO NOTHING;
+
+-- The notification also carries the position: xid, and xmin, the oldest transaction
+-- still running when the change was made. Every change committed after this one has an
+-- xid of at least xmin, so a live reader can resume from (xmin, 0).
+CREATE OR REPLACE FUNCTION notify_todo_change() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    r RECORD;
+    seq BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        r := OLD;
+    ELSE
+        r := NEW;
+    END IF;
+    INSERT INTO todo_events (op, todo_id, user_id, list_id)
+        VALUES (lower(TG_OP), r.id, r.user_id, r.list_id)
+        RETURNING id INTO seq;
+    PERFORM pg_notify('todo_changes', json_build_object(
+        'seq', seq,
+        'xid', pg_current_xact_id()::text::bigint,
+        'xmin', pg_snapshot_xmin(pg_current_snapshot())::text::bigint,
+        'op', lower(TG_OP),
+        'id', r.id,
+        'user_id', r.user_id,
+        'list_id', r.list_id
+    )::text);
+    RETURN NULL;
+END
+$$;
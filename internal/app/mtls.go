@@ -0,0 +1,176 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mTLS for service-to-service callers. When enabled, the main listener serves TLS and
+// verifies client certificates if presented (browsers and API-key clients are unaffected).
+// A verified certificate authenticates the caller by its SPIFFE ID (URI SAN
+// spiffe://<trust domain>/<path>), which must match the allowlist.
+
+// MTLSAllowlist authorizes SPIFFE IDs. Entries are exact IDs, or prefixes ending in
+// "/*" (e.g. "spiffe://example.org/ns/batch/*").
+type MTLSAllowlist struct {
+	entries []string
+	Scopes  []string // granted to every allowed caller
+}
+
+// NewMTLSAllowlist parses allowlist entries and the scopes granted to allowed callers.
+func NewMTLSAllowlist(entries, scopes []string) (*MTLSAllowlist, error) {
+	a := &MTLSAllowlist{Scopes: scopes}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, "spiffe://") {
+			return nil, fmt.Errorf("invalid SPIFFE ID %q: must start with spiffe://", e)
+		}
+		a.entries = append(a.entries, e)
+	}
+	if len(a.entries) == 0 {
+		return nil, errors.New("mTLS allowlist is empty")
+	}
+	if err := validScopes(scopes); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allows reports whether id is on the allowlist.
+func (a *MTLSAllowlist) Allows(id string) bool {
+	for _, e := range a.entries {
+		if prefix, ok := strings.CutSuffix(e, "/*"); ok {
+			if strings.HasPrefix(id, prefix+"/") {
+				return true
+			}
+		} else if id == e {
+			return true
+		}
+	}
+	return false
+}
+
+// MTLS is the allowlist for client certificates, or nil when mTLS is disabled.
+var MTLS *MTLSAllowlist
+
+// mtlsPrincipal authenticates a verified client certificate. It returns (nil, nil)
+// when the connection carries no verified client certificate.
+func mtlsPrincipal(r *http.Request) (*Principal, error) {
+	if MTLS == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, uri := range leaf.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		id := uri.String()
+		if !MTLS.Allows(id) {
+			return nil, fmt.Errorf("%w: SPIFFE ID %s is not allowed", ErrInvalidCredentials, id)
+		}
+		return &Principal{Subject: "spiffe:" + strings.TrimPrefix(id, "spiffe://"), Scopes: MTLS.Scopes, Method: "mtls"}, nil
+	}
+	return nil, fmt.Errorf("%w: client certificate has no SPIFFE ID", ErrInvalidCredentials)
+}
+
+// NewServerTLSConfig returns a TLS config for the main listener. clientCAFile, when set,
+// enables optional client certificate verification. Certificates and the CA bundle are
+// re-read when the files change, so short-lived (e.g. SPIRE or cert-manager) certificates
+// rotate without restarts.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	l := &tlsFiles{certFile: certFile, keyFile: keyFile, caFile: clientCAFile}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.config(), nil
+		},
+	}, nil
+}
+
+// tlsFilesCheckInterval bounds how often the certificate files are stat'ed.
+const tlsFilesCheckInterval = 30 * time.Second
+
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.Mutex
+	cfg       *tls.Config
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (l *tlsFiles) config() *tls.Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checkedAt) > tlsFilesCheckInterval {
+		l.checkedAt = time.Now()
+		if l.latestModTime().After(l.modTime) {
+			if err := l.loadLocked(); err != nil {
+				slog.Error("Failed to reload TLS certificates, keeping the previous ones", "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificates")
+			}
+		}
+	}
+	return l.cfg
+}
+
+func (l *tlsFiles) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadLocked()
+}
+
+func (l *tlsFiles) loadLocked() error {
+	modTime := l.latestModTime()
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if l.caFile != "" {
+		pem, err := os.ReadFile(l.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", l.caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	l.cfg, l.modTime = cfg, modTime
+	return nil
+}
+
+func (l *tlsFiles) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{l.certFile, l.keyFile, l.caFile} {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
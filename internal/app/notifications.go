@@ -0,0 +1,512 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	RemindersQueued = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "email_reminders_queued_total",
+			Help: "Total number of todo reminders queued for email, by kind",
+		},
+		[]string{"kind"}, // "due", "overdue", "reminder"
+	)
+	ReminderEmails = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "email_reminders_sent_total",
+			Help: "Total number of reminder emails, by kind and result",
+		},
+		[]string{"kind", "result"}, // "sent", "retry", "dead", "skipped"
+	)
+)
+
+const (
+	reminderBatchSize = 100
+	reminderLease     = 5 * time.Minute
+	reminderMaxTodos  = 20 // listed per email
+)
+
+var (
+	//go:embed emails/reminder.txt
+	reminderText string
+	//go:embed emails/reminder.html
+	reminderHTML string
+
+	reminderTextTemplate = texttemplate.Must(texttemplate.New("reminder").Parse(reminderText))
+	reminderHTMLTemplate = htmltemplate.Must(htmltemplate.New("reminder").Parse(reminderHTML))
+)
+
+// reminderData is what the reminder templates render.
+type reminderData struct {
+	Kind  string // "due", "overdue" or "reminder"
+	Name  string
+	Todos []reminderTodo
+	More  int // open todos not listed
+	Count int // all open todos
+}
+
+type reminderTodo struct {
+	ID   int
+	Task string
+	Due  time.Time // zero without a due date
+}
+
+// Reminders emails users about their open todos with a due date: once when one is due
+// soon and once when it is overdue. The first reminder is sent RemindBefore the due
+// date. Todos with a reminder time (remind_at, see HandleTodoReminder) also get a
+// reminder then, whether they have a due date or not. Queue finds the todos to
+// remind of and queues them in email_outbox; Send groups the queued reminders per
+// user into one email and sends it, retrying failures up to MaxAttempts. All of it is
+// in the database, so a restart loses no reminders.
+type Reminders struct {
+	Server       *Server // whose todos and email outbox the reminders are of
+	Sender       EmailSender
+	RemindBefore time.Duration
+	MaxAttempts  int
+}
+
+// Start queues and sends reminders every interval until ctx is cancelled. Every
+// replica may run it.
+func (rm *Reminders) Start(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "reminders", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, queueErr := rm.Queue(ctx)
+			if queueErr != nil && ctx.Err() == nil {
+				slog.Warn("Failed to queue reminders", "error", queueErr)
+			}
+			var err error
+			for !w.Stopping() {
+				var n int
+				n, err = rm.Send(ctx)
+				if err != nil && ctx.Err() == nil {
+					slog.Warn("Failed to send reminders", "error", err)
+				}
+				if err != nil || n < reminderBatchSize {
+					break
+				}
+			}
+			w.Checkpoint(errors.Join(queueErr, err))
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// EmailReminders are the reminders the "reminders" job queues and sends, when the
+// scheduler runs them instead of Start; nil without an email provider.
+var EmailReminders *Reminders
+
+func init() {
+	registerJob("reminders", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: 10 * time.Second, MaxBackoff: time.Minute, Timeout: 5 * time.Minute},
+		run:    (*Server).runReminders,
+		admin:  true,
+	})
+}
+
+// runReminders queues the reminders that are due and sends them, batch by batch. Its
+// result counts the reminders queued and those claimed to be sent.
+func (s *Server) runReminders(ctx context.Context, job *Job) (any, error) {
+	rm := EmailReminders
+	if rm == nil {
+		return nil, permanentJobError(errors.New("notifications.email_provider is not set"))
+	}
+	queued, err := rm.Queue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claimed := 0
+	for {
+		n, err := rm.Send(ctx)
+		claimed += n
+		if err != nil {
+			return nil, err
+		}
+		if n < reminderBatchSize {
+			return map[string]int{"queued": queued, "claimed": claimed}, nil
+		}
+	}
+}
+
+// Queue adds a reminder for every open todo that became due soon or overdue or whose
+// remind_at passed, and whose owner has an email address and wants the reminder, and
+// returns how many it added. A todo first seen overdue only gets the overdue reminder.
+func (rm *Reminders) Queue(ctx context.Context) (int, error) {
+	counts := map[string]int{}
+	err := rm.Server.ExecuteWithRobustness(func() error {
+		clear(counts) // Reset on retry
+		return withTenant(ctx, rm.Server.DB, systemTenant, func(q dbtx) error {
+			rows, err := dbQuery(ctx, q, "queue_reminders",
+				`INSERT INTO email_outbox (kind, todo_id, user_id)
+				SELECT r.kind, r.id, r.user_id FROM (
+					SELECT id, user_id, CASE WHEN due_at < now() THEN 'overdue' ELSE 'due' END AS kind
+					FROM todos WHERE NOT completed AND due_at < now() + $1 * interval '1 second'
+					UNION ALL
+					SELECT id, user_id, 'reminder' FROM todos WHERE NOT completed AND remind_at <= now()
+				) r
+				JOIN users u ON u.subject = r.user_id AND u.email <> ''
+				LEFT JOIN notification_preferences p ON p.subject = r.user_id
+				WHERE COALESCE(p.email_reminders, TRUE)
+					AND CASE r.kind
+						WHEN 'due' THEN COALESCE(p.due_reminders, TRUE)
+						WHEN 'overdue' THEN COALESCE(p.overdue_reminders, TRUE)
+						ELSE TRUE END
+				ON CONFLICT (kind, todo_id) DO NOTHING
+				RETURNING kind`,
+				rm.RemindBefore.Seconds())
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var kind string
+				if err := rows.Scan(&kind); err != nil {
+					return err
+				}
+				counts[kind]++
+			}
+			return rows.Err()
+		})
+	})
+	total := 0
+	for kind, n := range counts {
+		RemindersQueued.WithLabelValues(kind).Add(float64(n))
+		total += n
+	}
+	return total, err
+}
+
+type claimedReminder struct {
+	id       int64
+	kind     string
+	todoID   int
+	userID   string
+	attempts int
+}
+
+// Send claims up to one batch of queued reminders that are due to be sent, with a
+// lease so every replica can run it, and sends one email per user and kind. It
+// returns how many reminders it claimed.
+func (rm *Reminders) Send(ctx context.Context) (int, error) {
+	var claimed []claimedReminder
+	err := rm.Server.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(ctx, rm.Server.DB, "claim_reminders",
+			`UPDATE email_outbox SET next_attempt_at = now() + $2 * interval '1 second'
+			WHERE id IN (
+				SELECT id FROM email_outbox WHERE status = 'pending' AND next_attempt_at <= now()
+				ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+			RETURNING id, kind, todo_id, user_id, attempts`,
+			reminderBatchSize, reminderLease.Seconds())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		claimed = claimed[:0] // Reset on retry
+		for rows.Next() {
+			var c claimedReminder
+			if err := rows.Scan(&c.id, &c.kind, &c.todoID, &c.userID, &c.attempts); err != nil {
+				return err
+			}
+			claimed = append(claimed, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	type groupKey struct{ userID, kind string }
+	groups := map[groupKey][]claimedReminder{}
+	var order []groupKey
+	for _, c := range claimed {
+		k := groupKey{c.userID, c.kind}
+		if groups[k] == nil {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], c)
+	}
+	for _, k := range order {
+		rm.sendGroup(ctx, groups[k])
+	}
+	return len(claimed), nil
+}
+
+// sendGroup sends the reminders of one user and kind as one email and records the
+// outcome. Reminders of completed or deleted todos, of todos without a due date (or,
+// for kind "reminder", whose reminder was cleared or snoozed in the meantime) and of
+// users who opted out or have no address are skipped. Due dates are shown in the
+// user's timezone.
+func (rm *Reminders) sendGroup(ctx context.Context, group []claimedReminder) {
+	kind, userID := group[0].kind, group[0].userID
+	ids := make([]int64, len(group))
+	attempts := 0
+	for i, c := range group {
+		ids[i] = int64(c.todoID)
+		attempts = max(attempts, c.attempts+1)
+	}
+
+	to, name, loc, wanted, err := rm.Server.loadReminderRecipient(ctx, userID, kind)
+	var todos []Todo
+	if err == nil && wanted {
+		todos, err = rm.Server.loadReminderTodos(ctx, ids)
+	}
+	var sent []int64
+	var data reminderData
+	if err == nil {
+		data = reminderData{Kind: kind, Name: name}
+		now := rm.Server.Clock.Now()
+		for _, t := range todos {
+			if t.Completed || kind != "reminder" && t.DueAt == nil || kind == "reminder" && (t.RemindAt == nil || t.RemindAt.After(now)) {
+				continue
+			}
+			sent = append(sent, int64(t.ID))
+			if len(data.Todos) < reminderMaxTodos {
+				rt := reminderTodo{ID: t.ID, Task: t.Task}
+				if t.DueAt != nil {
+					rt.Due = t.DueAt.In(loc)
+				}
+				data.Todos = append(data.Todos, rt)
+			} else {
+				data.More++
+			}
+		}
+		data.Count = len(sent)
+	}
+	if err == nil && len(sent) > 0 {
+		err = rm.send(ctx, to, data)
+	}
+
+	status, result, errText := "sent", "sent", ""
+	var next time.Time
+	switch {
+	case err == nil && len(sent) == 0:
+		status, result = "skipped", "skipped"
+	case err == nil:
+	case attempts >= rm.MaxAttempts:
+		status, result, errText = "dead", "dead", truncate(err.Error(), 500)
+		slog.Warn("Giving up on a reminder email", "user", userID, "kind", kind, "attempts", attempts, "error", err)
+	default:
+		status, result, errText = "pending", "retry", truncate(err.Error(), 500)
+		next = rm.Server.Clock.Now().Add(reminderBackoff(attempts))
+	}
+	ReminderEmails.WithLabelValues(kind, result).Inc()
+
+	// Stored even if ctx ended during the attempt; otherwise the lease runs out and it is retried.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err = rm.Server.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, rm.Server.DB, "record_reminders",
+			`UPDATE email_outbox SET
+				status = CASE WHEN $2 = 'sent' AND NOT todo_id = ANY($3) THEN 'skipped' ELSE $2 END,
+				attempts = CASE WHEN $2 = 'skipped' THEN attempts ELSE $4 END,
+				last_error = $5,
+				next_attempt_at = CASE WHEN $2 = 'pending' THEN $6 ELSE next_attempt_at END,
+				sent_at = CASE WHEN $2 = 'sent' AND todo_id = ANY($3) THEN now() END
+			WHERE id = ANY($1)`,
+			pq.Array(claimedIDs(group)), status, pq.Array(sent), attempts, errText, next)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to record reminder emails", "user", userID, "kind", kind, "error", err)
+	}
+}
+
+// send renders data and sends it to the address to.
+func (rm *Reminders) send(ctx context.Context, to string, data reminderData) error {
+	var subject, text, html bytes.Buffer
+	if err := reminderTextTemplate.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := reminderTextTemplate.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := reminderHTMLTemplate.Execute(&html, data); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return rm.Sender.Send(ctx, Email{
+		To: to, Subject: subject.String(), Text: text.String(), HTML: html.String(),
+		Date: rm.Server.Clock.Now(), MessageID: rm.Server.IDs.NewID(16),
+	})
+}
+
+// loadReminderRecipient returns the address, name and timezone of userID, and whether
+// they want reminders of kind. Reminders they set themselves are only turned off with
+// all the others.
+func (s *Server) loadReminderRecipient(ctx context.Context, userID, kind string) (to, name string, loc *time.Location, wanted bool, err error) {
+	var email, timezone string
+	var all, due, overdue bool
+	err = s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(ctx, s.DBRead, "reminder_recipient",
+			`SELECT u.email, u.name, COALESCE(s.timezone, 'UTC'),
+				COALESCE(p.email_reminders, TRUE), COALESCE(p.due_reminders, TRUE), COALESCE(p.overdue_reminders, TRUE)
+			FROM users u
+			LEFT JOIN notification_preferences p ON p.subject = u.subject
+			LEFT JOIN user_settings s ON s.subject = u.subject
+			WHERE u.subject = $1`, userID).Scan(&email, &name, &timezone, &all, &due, &overdue)
+	})
+	if err == sql.ErrNoRows {
+		return "", "", nil, false, nil
+	}
+	if err != nil {
+		return "", "", nil, false, err
+	}
+	addr, perr := mail.ParseAddress(email)
+	if perr != nil {
+		return "", "", nil, false, nil
+	}
+	return addr.Address, name, userLocation(timezone), all && (kind == "due" && due || kind == "overdue" && overdue || kind == "reminder"), nil
+}
+
+// loadReminderTodos returns the todos with the given ids that still exist.
+func (s *Server) loadReminderTodos(ctx context.Context, ids []int64) ([]Todo, error) {
+	var todos []Todo
+	err := s.ExecuteWithRobustness(func() error {
+		todos = todos[:0] // Reset on retry
+		return withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+			rows, err := dbQuery(ctx, q, "reminder_todos", "SELECT id, task, completed, list_id, due_at, remind_at FROM todos WHERE id = ANY($1) ORDER BY due_at, id", pq.Array(ids))
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var t Todo
+				if err := rows.Scan(&t.ID, &t.Task, &t.Completed, &t.ListID, &t.DueAt, &t.RemindAt); err != nil {
+					return err
+				}
+				todos = append(todos, t)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+func claimedIDs(group []claimedReminder) []int64 {
+	ids := make([]int64, len(group))
+	for i, c := range group {
+		ids[i] = c.id
+	}
+	return ids
+}
+
+// reminderBackoff is the delay before the attempt after attempts failed ones:
+// doubling from a minute, up to an hour.
+func reminderBackoff(attempts int) time.Duration {
+	return min(time.Minute<<min(attempts-1, 6), time.Hour)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// NotificationPreferences are a user's reminder settings, at /me/notifications.
+type NotificationPreferences struct {
+	// Email is where reminders go: the address of the user's sign-in, if any. It
+	// cannot be set here.
+	Email            string `json:"email"`
+	EmailReminders   bool   `json:"email_reminders"`
+	DueReminders     bool   `json:"due_reminders"`
+	OverdueReminders bool   `json:"overdue_reminders"`
+}
+
+// putNotificationPreferencesQuery changes the preferences of subject $1 given as
+// $2-$4, email_reminders, due_reminders and overdue_reminders; NULLs keep their value.
+const putNotificationPreferencesQuery = `INSERT INTO notification_preferences (subject, email_reminders, due_reminders, overdue_reminders)
+VALUES ($1, COALESCE($2, TRUE), COALESCE($3, TRUE), COALESCE($4, TRUE))
+ON CONFLICT (subject) DO UPDATE SET
+	email_reminders = COALESCE($2, notification_preferences.email_reminders),
+	due_reminders = COALESCE($3, notification_preferences.due_reminders),
+	overdue_reminders = COALESCE($4, notification_preferences.overdue_reminders),
+	updated_at = now()`
+
+// HandleNotificationPreferences serves the caller's reminder settings:
+//
+//	GET /me/notifications
+//	PUT /me/notifications  {"email_reminders": false}; settings left out keep their value
+func (s *Server) HandleNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	owner := TodoOwner(r.Context())
+	if owner == anonymousOwner {
+		http.Error(w, "Sign in to manage notifications", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			EmailReminders   *bool `json:"email_reminders"`
+			DueReminders     *bool `json:"due_reminders"`
+			OverdueReminders *bool `json:"overdue_reminders"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := s.ExecuteWithRobustness(func() error {
+			_, err := dbExec(r.Context(), s.DB, "put_notification_preferences", putNotificationPreferencesQuery,
+				owner, req.EmailReminders, req.DueReminders, req.OverdueReminders)
+			return err
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		slog.Info("Updated notification preferences", "owner", owner)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var prefs NotificationPreferences
+	err := s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(r.Context(), s.DB, "get_notification_preferences",
+			`SELECT COALESCE((SELECT email FROM users WHERE subject = $1), ''),
+				COALESCE(p.email_reminders, TRUE), COALESCE(p.due_reminders, TRUE), COALESCE(p.overdue_reminders, TRUE)
+			FROM (SELECT 1) one LEFT JOIN notification_preferences p ON p.subject = $1`,
+			owner).Scan(&prefs.Email, &prefs.EmailReminders, &prefs.DueReminders, &prefs.OverdueReminders)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		slog.Error("Failed to encode notification preferences", "error", err)
+	}
+}
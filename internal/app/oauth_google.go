@@ -0,0 +1,200 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Google's OAuth 2.0 / OpenID Connect endpoints.
+const (
+	googleIssuer   = "https://accounts.google.com"
+	googleAuthURL  = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// oauthStateCookie carries the state, nonce and PKCE verifier between the redirect
+// to Google and the callback. It is HttpOnly and short-lived.
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateMaxAge = 10 * time.Minute
+)
+
+// GoogleLogin signs users in with their Google account (authorization code flow with PKCE).
+type GoogleLogin struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // optional; derived from the request host when empty
+
+	// Endpoints and ID token verification, overridable for tests.
+	AuthURL  string
+	TokenURL string
+	Verifier *OIDCVerifier
+}
+
+// Google is the configured Google login, or nil when it is disabled.
+var Google *GoogleLogin
+
+// NewGoogleLogin configures Google sign-in for an OAuth client.
+func NewGoogleLogin(clientID, clientSecret, redirectURL string) *GoogleLogin {
+	return &GoogleLogin{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		AuthURL:      googleAuthURL,
+		TokenURL:     googleTokenURL,
+		Verifier:     NewOIDCVerifier(googleIssuer, clientID, ""),
+	}
+}
+
+// LoadGoogleClient reads the OAuth client from a Secret Manager secret containing
+// {"client_id": "...", "client_secret": "..."}.
+func LoadGoogleClient(ctx context.Context, secretName string) (clientID, clientSecret string, err error) {
+	payload, err := AccessSecretVersion(ctx, secretName)
+	if err != nil {
+		return "", "", err
+	}
+	return parseGoogleClient(payload)
+}
+
+func parseGoogleClient(payload string) (clientID, clientSecret string, err error) {
+	var c struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := json.Unmarshal([]byte(payload), &c); err != nil {
+		return "", "", fmt.Errorf("failed to parse OAuth client secret: %w", err)
+	}
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return "", "", errors.New("OAuth client secret must contain client_id and client_secret")
+	}
+	return c.ClientID, c.ClientSecret, nil
+}
+
+func (g *GoogleLogin) config(r *http.Request) *oauth2.Config {
+	redirect := g.RedirectURL
+	if redirect == "" {
+		scheme := "http"
+		if isHTTPS(r) {
+			scheme = "https"
+		}
+		redirect = scheme + "://" + r.Host + "/auth/google/callback"
+	}
+	return &oauth2.Config{
+		ClientID:     g.ClientID,
+		ClientSecret: g.ClientSecret,
+		RedirectURL:  redirect,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint:     oauth2.Endpoint{AuthURL: g.AuthURL, TokenURL: g.TokenURL},
+	}
+}
+
+// HandleGoogleLogin serves GET /auth/google: it redirects the browser to Google.
+func HandleGoogleLogin(w http.ResponseWriter, r *http.Request) {
+	g := Google
+	if g == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state, nonce, verifier := newToken(), newToken(), oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/auth/google",
+		MaxAge:   int(oauthStateMaxAge.Seconds()),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	url := g.config(r).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("prompt", "select_account"))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// HandleGoogleCallback serves GET /auth/google/callback: it exchanges the code for an
+// ID token, records the user and starts a session.
+func (s *Server) HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+	g := Google
+	if g == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	c, err := r.Cookie(oauthStateCookie)
+	parts := []string{}
+	if err == nil {
+		parts = strings.SplitN(c.Value, ".", 3)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/google", MaxAge: -1})
+	if len(parts) != 3 || r.URL.Query().Get("state") != parts[0] {
+		AuthFailures.WithLabelValues("oauth_state").Inc()
+		http.Error(w, "Invalid OAuth state, please sign in again", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Sign-in was cancelled: "+e, http.StatusUnauthorized)
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	tok, err := g.config(r).Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		AuthFailures.WithLabelValues("oauth_exchange").Inc()
+		slog.Warn("Google token exchange failed", "error", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	rawID, _ := tok.Extra("id_token").(string)
+	claims, err := g.Verifier.Verify(ctx, rawID)
+	if err != nil || claims.Nonce != nonce {
+		AuthFailures.WithLabelValues("oauth_id_token").Inc()
+		slog.Warn("Rejected Google ID token", "error", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	p := &Principal{
+		Subject: "user:" + claims.Subject,
+		UserID:  claims.Subject,
+		Email:   claims.Email,
+		Scopes:  []string{ScopeRead, ScopeWrite},
+		Method:  "google",
+	}
+	if err := s.upsertUser(ctx, "google", claims, p.Subject); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := s.CreateSession(ctx, w, r, p); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("User signed in with Google", "subject", p.Subject)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// upsertUser creates or refreshes the local user record for an identity provider account.
+func (s *Server) upsertUser(ctx context.Context, provider string, claims *Claims, subject string) error {
+	return s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "upsert_user",
+			`INSERT INTO users (provider, provider_subject, subject, email, name) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (provider, provider_subject) DO UPDATE
+			SET email = EXCLUDED.email, name = EXCLUDED.name, last_login_at = now()`,
+			provider, claims.Subject, subject, claims.Email, claims.Name)
+		return err
+	})
+}
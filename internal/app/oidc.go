@@ -0,0 +1,347 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are trusted before refetching.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefetch rate-limits refetches triggered by unknown key ids (rotation),
+	// so tokens with random kids can't turn us into a JWKS-endpoint amplifier.
+	jwksMinRefetch = time.Minute
+	// jwtLeeway tolerates small clock differences with the issuer.
+	jwtLeeway = time.Minute
+)
+
+// Claims are the JWT claims used by the application.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+	Nonce     string   `json:"nonce"`
+	Tenant    string   `json:"-"` // the TenantClaim claim, if configured
+}
+
+// audience accepts both the string and array forms of "aud".
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// OIDCVerifier validates bearer JWTs issued by a single OpenID Connect issuer.
+// Signing keys are discovered from the issuer's JWKS endpoint, cached, and refetched
+// periodically and whenever a token references an unknown key id (key rotation).
+type OIDCVerifier struct {
+	Issuer   string
+	Audience string
+	JWKSURL  string // optional; discovered from the issuer when empty
+	// TenantClaim names the claim that carries the caller's tenant; empty for none.
+	TenantClaim string
+
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	missAt    time.Time // last refetch triggered by an unknown kid
+}
+
+// NewOIDCVerifier returns a verifier for issuer, accepting tokens whose audience
+// contains audience. jwksURL may be empty to use OIDC discovery.
+func NewOIDCVerifier(issuer, audience, jwksURL string) *OIDCVerifier {
+	return &OIDCVerifier{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		Audience: audience,
+		JWKSURL:  jwksURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// OIDC is the configured verifier, or nil when bearer tokens are not accepted.
+var OIDC *OIDCVerifier
+
+// Verify checks the token's signature and standard claims.
+// Malformed, forged, expired or misaddressed tokens yield ErrInvalidCredentials;
+// other errors mean the issuer's keys could not be fetched.
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidCredentials)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidCredentials)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims", ErrInvalidCredentials)
+	}
+	if v.TenantClaim != "" {
+		var extra map[string]any
+		if err := decodeSegment(parts[1], &extra); err != nil {
+			return nil, fmt.Errorf("%w: bad claims", ErrInvalidCredentials)
+		}
+		claims.Tenant, _ = extra[v.TenantClaim].(string)
+	}
+	if err := v.validateClaims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return &claims, nil
+}
+
+func (v *OIDCVerifier) validateClaims(c *Claims) error {
+	now := v.now()
+	// Google (and some others) also issue tokens with the scheme-less form of the issuer.
+	if iss := strings.TrimSuffix(c.Issuer, "/"); iss != v.Issuer && "https://"+iss != v.Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if c.Subject == "" {
+		return errors.New("missing subject")
+	}
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token not yet valid")
+	}
+	if v.Audience != "" {
+		for _, a := range c.Audience {
+			if a == v.Audience {
+				return nil
+			}
+		}
+		return errors.New("audience mismatch")
+	}
+	return nil
+}
+
+// key returns the public key for kid, refreshing the JWKS when it is stale or
+// the kid is unknown.
+func (v *OIDCVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stale := time.Since(v.fetchedAt) > jwksRefreshInterval
+	k, ok := v.keys[kid]
+	if ok && !stale {
+		return k, nil
+	}
+	if stale || time.Since(v.missAt) > jwksMinRefetch {
+		if !stale {
+			v.missAt = time.Now()
+		}
+		if err := v.refreshLocked(ctx); err != nil {
+			if ok {
+				return k, nil // stale-on-error: keep using the cached key
+			}
+			return nil, err
+		}
+		if k, ok = v.keys[kid]; ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidCredentials, kid)
+}
+
+func (v *OIDCVerifier) refreshLocked(ctx context.Context) error {
+	jwksURL := v.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("oidc discovery failed: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("oidc discovery returned no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return fmt.Errorf("jwks fetch failed: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if pk, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = pk
+		}
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+func (v *OIDCVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks a JWS signature. Only asymmetric algorithms are accepted,
+// which rules out "none" and HMAC key-confusion attacks.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch pk := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("algorithm does not match key type")
+		}
+		return rsa.VerifyPKCS1v15(pk, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New("algorithm does not match key type")
+		}
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pk, digest, r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
+
+func decodeSegment(seg string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,770 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SwaggerUI serves Swagger UI at /docs. The page loads its script from unpkg.com, so
+// it is off unless enabled (server.swagger_ui).
+var SwaggerUI = false
+
+// swaggerUIVersion pins the swagger-ui-dist release /docs loads.
+const swaggerUIVersion = "5.17.14"
+
+// apiOperation documents one method of the HTTP API. Request and response bodies are
+// Go values whose types are turned into JSON schemas, so the document follows the
+// structs the handlers encode; a map[string]any is used as a schema as it is.
+type apiOperation struct {
+	method, path string
+	tag, summary string
+	scope        string // needed with credentials (see AuthMiddleware); "" for public endpoints
+	params       []map[string]any
+	body         any
+	bodyType     string // of the request body, when not JSON
+	example      any    // a request body, shown in the document and sent by the contract tests
+	status       int
+	response     any
+	contentType  string // of the response, when not JSON
+
+	// protoBody and protoResponse name the todo.v1 messages that can stand in for
+	// the JSON bodies (see ProtobufContentType).
+	protoBody, protoResponse string
+}
+
+// protoSchema describes a body in the protobuf wire format.
+func protoSchema(message string) map[string]any {
+	return map[string]any{"schema": map[string]any{"type": "string", "format": "binary", "description": "a todo.v1." + message + " message"}}
+}
+
+func pathParam(name, description string) map[string]any {
+	return map[string]any{"name": name, "in": "path", "required": true, "description": description, "schema": map[string]any{"type": "integer", "format": "int64"}}
+}
+
+func namePathParam(name, description string) map[string]any {
+	return map[string]any{"name": name, "in": "path", "required": true, "description": description, "schema": map[string]any{"type": "string"}}
+}
+
+func queryParam(name, description string, schema map[string]any) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+var (
+	stringSchema   = map[string]any{"type": "string"}
+	dateSchema     = map[string]any{"type": "string", "format": "date"}
+	dateTimeSchema = map[string]any{"type": "string", "format": "date-time"}
+	prioritySchema = map[string]any{"type": "string", "enum": Priorities}
+	objectSchema   = map[string]any{"type": "object"}
+
+	// todoFilterParams narrow and order the todo collections (see todoFilter).
+	todoFilterParams = []map[string]any{
+		queryParam("tag", "only todos with this tag; repeat for todos with all of them", stringSchema),
+		queryParam("priority", "only todos with this priority", prioritySchema),
+		queryParam("starred", "true for only starred todos, false for only the others", map[string]any{"type": "boolean"}),
+		queryParam("sort", "order by id (default), priority (most urgent first), due_at (soonest first) or starred (starred first)",
+			map[string]any{"type": "string", "enum": []string{"id", "priority", "due_at", "starred"}}),
+		queryParam("include", "archived: also list archived todos", map[string]any{"type": "string", "enum": []string{"archived"}}),
+		queryParam("created_after", "only todos created after this time", dateTimeSchema),
+		queryParam("created_before", "only todos created before this time", dateTimeSchema),
+		queryParam("updated_after", "only todos changed after this time", dateTimeSchema),
+		queryParam("updated_before", "only todos last changed before this time", dateTimeSchema),
+		queryParam("completed_after", "only todos completed after this time", dateTimeSchema),
+		queryParam("completed_before", "only todos completed before this time", dateTimeSchema),
+		queryParam("limit", "at most this many, all by default; the Link header has the next page if there are more", map[string]any{"type": "integer", "minimum": 1, "maximum": maxTodoPage}),
+		queryParam("cursor", "where the page starts, from the Link header of the one before", stringSchema),
+	}
+
+	// The /v1 gateway uses the proto3 JSON mapping: proto field names, 64-bit ids as strings.
+	v1TodoSchema = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"id":        map[string]any{"type": "string", "format": "int64"},
+			"task":      stringSchema,
+			"completed": map[string]any{"type": "boolean"},
+			"list_id":   map[string]any{"type": "string", "format": "int64", "description": "unset for personal todos"},
+		},
+	}
+)
+
+// apiOperations is every endpoint of the HTTP listener, in the order of main.go.
+var apiOperations = []apiOperation{
+	{method: "get", path: "/todos", tag: "todos", summary: "List the todos the caller can see", scope: ScopeRead,
+		params: todoFilterParams, response: []Todo{}, protoResponse: "ListTodosResponse"},
+	{method: "post", path: "/todos", tag: "todos", summary: "Create a personal todo, or one on a list the caller may edit", scope: ScopeWrite,
+		body: struct {
+			Task     string   `json:"task"`
+			ListID   *int64   `json:"list_id,omitempty"`
+			Priority string   `json:"priority,omitempty"`
+			Tags     []string `json:"tags,omitempty"`
+		}{}, example: map[string]any{"task": "Buy milk", "priority": "high", "tags": []string{"errands"}},
+		status: http.StatusCreated, response: Todo{}, protoBody: "Todo", protoResponse: "Todo"},
+	{method: "get", path: "/todos/{id}", tag: "todos", summary: "Get a todo the caller can see", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "put", path: "/todos/{id}", tag: "todos", summary: "Mark a todo completed or not, and change its priority or tags", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			Completed bool     `json:"completed"`
+			Priority  string   `json:"priority,omitempty"`
+			Tags      []string `json:"tags,omitempty"` // replaces the tags; left out, they are kept
+		}{}, example: map[string]any{"completed": false, "priority": "urgent", "tags": []string{"errands", "home"}},
+		protoBody: "Todo"},
+	{method: "delete", path: "/todos/{id}", tag: "todos", summary: "Delete a todo", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, status: http.StatusNoContent},
+	{method: "put", path: "/todos/{id}/due", tag: "todos", summary: "Set the due date of a todo; a date alone means the end of that day in the caller's timezone", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			DueAt string `json:"due_at"`
+		}{}, example: map[string]any{"due_at": "2030-01-31"}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/due", tag: "todos", summary: "Clear the due date of a todo", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "put", path: "/todos/{id}/parent", tag: "todos", summary: "Nest a todo, with its subtasks, under another on the same list", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			ParentID int `json:"parent_id"`
+		}{}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/parent", tag: "todos", summary: "Make a subtask a top-level todo again", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "get", path: "/todos/{id}/subtree", tag: "todos", summary: "A todo with its subtasks, nested", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id")}, response: TodoTree{}},
+	{method: "get", path: "/todos/{id}/dependencies", tag: "todos", summary: "The todos a todo is blocked by and blocks", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id")}, response: TodoDependencies{}},
+	{method: "post", path: "/todos/{id}/dependencies", tag: "todos", summary: "Make a todo blocked by, or block, another on the same list; a link that would close a cycle is 409", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			BlockedBy int `json:"blocked_by,omitempty"`
+			Blocks    int `json:"blocks,omitempty"`
+		}{}, response: TodoDependencies{}},
+	{method: "delete", path: "/todos/{id}/dependencies/{other}", tag: "todos", summary: "Unlink two todos, whichever blocks the other", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id"), pathParam("other", "the linked todo's id")}, response: TodoDependencies{}},
+	{method: "put", path: "/todos/{id}/recurrence", tag: "todos", summary: "Make a todo recur on an iCalendar RRULE, from its due date", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			RRule string `json:"rrule"`
+		}{}, example: map[string]any{"rrule": "FREQ=WEEKLY"}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/recurrence", tag: "todos", summary: "Stop a todo from recurring", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "get", path: "/todos/{id}/recurrence", tag: "todos", summary: "The upcoming occurrences of a recurring todo", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id"),
+			queryParam("count", "how many occurrences, 1 to 50 (5)", map[string]any{"type": "integer"}),
+			queryParam("rrule", "preview this rule instead of the todo's", map[string]any{"type": "string"})},
+		response: RecurrencePreview{}},
+	{method: "put", path: "/todos/{id}/reminder", tag: "todos", summary: "Email a reminder of a todo at a time", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			RemindAt string `json:"remind_at"`
+		}{}, example: map[string]any{"remind_at": "2030-01-31T09:00:00Z"}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/reminder", tag: "todos", summary: "Clear the reminder of a todo", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "post", path: "/todos/{id}/snooze", tag: "todos", summary: "Remind of a todo later: in an hour, tomorrow or next week at 9:00 in the caller's timezone, or until a time", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			Preset string `json:"preset,omitempty"` // see SnoozePresets
+			Until  string `json:"until,omitempty"`
+		}{}, example: map[string]any{"preset": "tomorrow"}, response: Todo{}, protoResponse: "Todo"},
+	{method: "put", path: "/todos/{id}/archive", tag: "todos", summary: "Archive a todo and its subtasks: hide them from lists without deleting them", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/archive", tag: "todos", summary: "Unarchive a todo and its subtasks", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "post", path: "/todos/{id}:clone", tag: "todos", summary: "Copy a todo, optionally with its subtasks and tags, onto its list or another one", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			ListID   *int64 `json:"list_id,omitempty"` // left out for the todo's list, null for the Inbox
+			Subtasks bool   `json:"subtasks,omitempty"`
+			Tags     bool   `json:"tags,omitempty"`
+		}{}, example: map[string]any{"subtasks": true, "tags": true}, status: http.StatusCreated, response: TodoTree{}},
+	{method: "put", path: "/todos/{id}/star", tag: "todos", summary: "Star a todo, for everyone who can see it", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "delete", path: "/todos/{id}/star", tag: "todos", summary: "Unstar a todo", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: Todo{}, protoResponse: "Todo"},
+	{method: "post", path: "/todos/{id}/suggest-subtasks", tag: "todos", summary: "Have a model propose subtasks and tags for a todo, without changing it; behind the suggest_subtasks feature flag", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: SubtaskSuggestions{}},
+	{method: "get", path: "/todos/{id}/comments", tag: "todos", summary: "The comments on a todo, oldest first", scope: ScopeRead,
+		params: []map[string]any{
+			pathParam("id", "todo id"),
+			queryParam("limit", "at most this many, 50 by default", map[string]any{"type": "integer", "minimum": 1, "maximum": 200}),
+			queryParam("after", "only comments newer than this one, to page on", map[string]any{"type": "integer", "format": "int64"}),
+		}, response: []Comment{}},
+	{method: "post", path: "/todos/{id}/comments", tag: "todos", summary: "Comment on a todo, in markdown", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			Body string `json:"body"`
+		}{}, example: map[string]any{"body": "Whole milk, **not** skimmed"}, status: http.StatusCreated, response: Comment{}},
+	{method: "delete", path: "/todos/{id}/comments/{comment}", tag: "todos", summary: "Delete a comment; its author or the list owner can", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id"), pathParam("comment", "comment id")}, status: http.StatusNoContent},
+	{method: "get", path: "/todos/{id}/attachments", tag: "todos", summary: "The ready attachments of a todo, with download URLs", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id")}, response: []Attachment{}},
+	{method: "post", path: "/todos/{id}/attachments", tag: "todos", summary: "Start an attachment: PUT the file to upload_url, with upload_headers, then complete it", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")},
+		body: struct {
+			Name        string `json:"name"`
+			ContentType string `json:"content_type"`
+			Size        int64  `json:"size"`
+		}{}, status: http.StatusCreated, response: Attachment{}},
+	{method: "get", path: "/todos/{id}/attachments/{attachment}", tag: "todos", summary: "An attachment, with a download URL once it is ready", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id"), pathParam("attachment", "attachment id")}, response: Attachment{}},
+	{method: "post", path: "/todos/{id}/attachments/{attachment}/complete", tag: "todos", summary: "Check an uploaded attachment and make it ready", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id"), pathParam("attachment", "attachment id")}, response: Attachment{}},
+	{method: "delete", path: "/todos/{id}/attachments/{attachment}", tag: "todos", summary: "Delete an attachment; its file is removed from the bucket later", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id"), pathParam("attachment", "attachment id")}, status: http.StatusNoContent},
+	{method: "get", path: "/todos/overdue", tag: "todos", summary: "Open todos past their due date", scope: ScopeRead,
+		response: []Todo{}, protoResponse: "ListTodosResponse"},
+	{method: "get", path: "/todos/today", tag: "todos", summary: "Open todos due today in the caller's timezone", scope: ScopeRead,
+		response: []Todo{}, protoResponse: "ListTodosResponse"},
+	{method: "get", path: "/tags", tag: "todos", summary: "The tags on the caller's todos, most used first; the Age header says how old the counts are", scope: ScopeRead,
+		response: []TagCount{}},
+	{method: "get", path: "/stats", tag: "todos", summary: "How many todos the caller has, open, completed and overdue; the Age header says how old the numbers are", scope: ScopeRead,
+		response: TodoStats{}},
+	{method: "get", path: "/activity", tag: "todos", summary: "What happened to the caller's todos, newest first", scope: ScopeRead,
+		params: []map[string]any{
+			queryParam("limit", "at most this many, 50 by default", map[string]any{"type": "integer", "minimum": 1, "maximum": 200}),
+			queryParam("before", "only entries older than this one, to page on", map[string]any{"type": "integer", "format": "int64"}),
+		}, response: []Activity{}},
+	{method: "get", path: "/sync", tag: "sync", summary: "Every todo the caller can see and a token, or with since, what changed after that token; an expired token is 410", scope: ScopeRead,
+		params: []map[string]any{queryParam("since", "the token of the previous sync", stringSchema)}, response: SyncChanges{}},
+	{method: "post", path: "/sync", tag: "sync", summary: "Apply changes made offline, each on its own; an update or delete made on an older version is a conflict", scope: ScopeWrite,
+		body: struct {
+			Changes []SyncChange `json:"changes"`
+		}{}, example: map[string]any{"changes": []map[string]any{{"op": "create", "client_id": "c1", "task": "Written offline"}}},
+		response: struct {
+			Results []SyncResult `json:"results"`
+		}{}},
+	{method: "get", path: "/todos/events", tag: "live", summary: "Stream todo changes as Server-Sent Events", scope: ScopeRead,
+		params: []map[string]any{
+			queryParam("last_event_id", "resume after this event id, for clients that cannot set the Last-Event-ID header", stringSchema),
+			{"name": "Last-Event-ID", "in": "header", "description": "resume after this event id", "schema": stringSchema},
+		},
+		response: stringSchema, contentType: "text/event-stream"},
+
+	{method: "get", path: "/v1/todos", tag: "v1", summary: "List todos (gateway to the gRPC ListTodos)", scope: ScopeRead,
+		response: map[string]any{"type": "array", "items": v1TodoSchema}},
+	{method: "post", path: "/v1/todos", tag: "v1", summary: "Create a todo (gateway to the gRPC CreateTodo)", scope: ScopeWrite,
+		body: map[string]any{"type": "object", "properties": map[string]any{
+			"task":    stringSchema,
+			"list_id": map[string]any{"type": "string", "format": "int64"},
+		}}, example: map[string]any{"task": "Buy milk"}, response: v1TodoSchema},
+	{method: "get", path: "/v1/todos/{id}", tag: "v1", summary: "Get a todo (gateway to the gRPC GetTodo)", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "todo id")}, response: v1TodoSchema},
+	{method: "put", path: "/v1/todos/{id}", tag: "v1", summary: "Update a todo (gateway to the gRPC UpdateTodo)", scope: ScopeWrite,
+		params:   []map[string]any{pathParam("id", "todo id")},
+		body:     map[string]any{"type": "object", "properties": map[string]any{"completed": map[string]any{"type": "boolean"}}},
+		example:  map[string]any{"completed": true},
+		response: v1TodoSchema},
+	{method: "delete", path: "/v1/todos/{id}", tag: "v1", summary: "Delete a todo (gateway to the gRPC DeleteTodo)", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "todo id")}, response: objectSchema},
+
+	{method: "post", path: "/graphql", tag: "graphql", summary: "Run a GraphQL query or mutation (schema: internal/app/schema.graphql)", scope: ScopeRead,
+		body: struct {
+			Query         string         `json:"query"`
+			OperationName string         `json:"operationName,omitempty"`
+			Variables     map[string]any `json:"variables,omitempty"`
+		}{},
+		example: map[string]any{"query": "{ todos { id task completed } }"},
+		response: struct {
+			Data   map[string]any   `json:"data,omitempty"`
+			Errors []map[string]any `json:"errors,omitempty"`
+		}{}},
+	{method: "post", path: "/mcp", tag: "mcp", summary: "Model Context Protocol (Streamable HTTP, stateless) with the list_todos, create_todo and complete_todo tools", scope: ScopeRead,
+		body: map[string]any{"type": "object", "description": "a JSON-RPC 2.0 message; Accept must allow application/json and text/event-stream"},
+		example: map[string]any{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": map[string]any{
+			"protocolVersion": "2025-06-18", "capabilities": map[string]any{}, "clientInfo": map[string]any{"name": "example", "version": "1.0"}}},
+		response: stringSchema, contentType: "text/event-stream"},
+	{method: "get", path: "/ws", tag: "live", summary: "Upgrade to a WebSocket that pushes todo changes", scope: ScopeRead,
+		status: http.StatusSwitchingProtocols},
+
+	{method: "get", path: "/lists", tag: "lists", summary: "List the caller's active lists, or only the archived ones", scope: ScopeRead,
+		params:   []map[string]any{queryParam("archived", "true lists the archived lists instead", map[string]any{"type": "boolean"})},
+		response: []TodoList{}},
+	{method: "post", path: "/lists", tag: "lists", summary: "Create a shared list owned by the caller", scope: ScopeWrite,
+		body: struct {
+			Name  string `json:"name"`
+			Color string `json:"color,omitempty"` // "#rrggbb"
+		}{}, example: map[string]any{"name": "Groceries", "color": "#2e7d32"}, status: http.StatusCreated, response: TodoList{}},
+	{method: "get", path: "/lists/{id}", tag: "lists", summary: "Get a list", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "list id")}, response: TodoList{}},
+	{method: "put", path: "/lists/{id}", tag: "lists", summary: "Rename, color, archive or unarchive a list; fields left out are kept (owner)", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "list id")},
+		body: struct {
+			Name     string `json:"name,omitempty"`
+			Color    string `json:"color,omitempty"` // "#rrggbb", or "" for none
+			Archived bool   `json:"archived,omitempty"`
+		}{}, example: map[string]any{"name": "Weekly groceries"}, response: TodoList{}},
+	{method: "delete", path: "/lists/{id}", tag: "lists", summary: "Delete a list and its todos (owner)", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "list id")}, status: http.StatusNoContent},
+	{method: "get", path: "/lists/{id}/todos", tag: "lists", summary: "List the todos on a list", scope: ScopeRead,
+		params: append([]map[string]any{pathParam("id", "list id")}, todoFilterParams...), response: []Todo{}, protoResponse: "ListTodosResponse"},
+	{method: "post", path: "/lists/{id}/todos", tag: "lists", summary: "Add a todo to a list that is not archived (owner, editor)", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "list id")},
+		body: struct {
+			Task string `json:"task"`
+		}{}, example: map[string]any{"task": "Eggs"}, status: http.StatusCreated, response: Todo{}, protoBody: "Todo", protoResponse: "Todo"},
+	{method: "get", path: "/lists/inbox/todos", tag: "lists", summary: "List the caller's Inbox: their personal todos", scope: ScopeRead,
+		params: todoFilterParams, response: []Todo{}, protoResponse: "ListTodosResponse"},
+	{method: "post", path: "/lists/inbox/todos", tag: "lists", summary: "Add a personal todo to the caller's Inbox", scope: ScopeWrite,
+		body: struct {
+			Task string `json:"task"`
+		}{}, example: map[string]any{"task": "Call the plumber"}, status: http.StatusCreated, response: Todo{}, protoBody: "Todo", protoResponse: "Todo"},
+	{method: "get", path: "/lists/{id}/members", tag: "lists", summary: "List the members of a list", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "list id")}, response: []ListMember{}},
+	{method: "post", path: "/lists/{id}/members", tag: "lists", summary: "Invite a member or change their role (owner)", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "list id")},
+		body: struct {
+			UserID string `json:"user_id"`
+			Role   string `json:"role,omitempty"` // editor (default) or viewer
+		}{}, example: map[string]any{"user_id": "user:carol", "role": "viewer"}, status: http.StatusCreated, response: ListMember{}},
+	{method: "delete", path: "/lists/{id}/members/{user}", tag: "lists", summary: "Remove a member (owner), or leave the list", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "list id"), {"name": "user", "in": "path", "required": true, "schema": stringSchema}},
+		status: http.StatusNoContent},
+
+	{method: "get", path: "/exports", tag: "exports", summary: "List the caller's exports", scope: ScopeRead, response: []Export{}},
+	{method: "post", path: "/exports", tag: "exports", summary: "Start an export of the caller's todos", scope: ScopeRead,
+		params: []map[string]any{queryParam("format", "json (default) or csv", map[string]any{"type": "string", "enum": []string{"json", "csv"}})},
+		status: http.StatusAccepted, response: Export{}},
+	{method: "get", path: "/exports/{id}", tag: "exports", summary: "Get an export, with a fresh download_url once ready", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "export id")}, response: Export{}},
+	{method: "get", path: "/exports/{id}/download", tag: "exports", summary: "Download an export, authorized by the signature of its download_url",
+		params: []map[string]any{
+			pathParam("id", "export id"),
+			queryParam("expires", "from download_url", stringSchema),
+			queryParam("sig", "from download_url", stringSchema),
+		}, response: stringSchema, contentType: "application/octet-stream"},
+
+	{method: "get", path: "/webhooks", tag: "webhooks", summary: "List the caller's webhooks", scope: ScopeRead, response: []Webhook{}},
+	{method: "post", path: "/webhooks", tag: "webhooks", summary: "Register a webhook; the response holds its signing secret", scope: ScopeWrite,
+		body: webhookRequest{}, example: map[string]any{"url": "https://example.com/hooks/todo", "events": []string{"todo.created", "todo.updated"}},
+		status: http.StatusCreated, response: Webhook{}},
+	{method: "get", path: "/webhooks/{id}", tag: "webhooks", summary: "Get a webhook", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "webhook id")}, response: Webhook{}},
+	{method: "put", path: "/webhooks/{id}", tag: "webhooks", summary: "Replace a webhook; an empty secret keeps the current one", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "webhook id")}, body: webhookRequest{},
+		example:  map[string]any{"url": "https://example.com/hooks/todo", "events": []string{"todo.deleted"}, "active": false},
+		response: Webhook{}},
+	{method: "delete", path: "/webhooks/{id}", tag: "webhooks", summary: "Delete a webhook and its delivery log", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "webhook id")}, status: http.StatusNoContent},
+	{method: "get", path: "/webhooks/{id}/deliveries", tag: "webhooks", summary: "The delivery log of a webhook, newest first", scope: ScopeRead,
+		params: []map[string]any{
+			pathParam("id", "webhook id"),
+			queryParam("status", "only deliveries with this status", map[string]any{"type": "string", "enum": []string{"pending", "delivered", "dead"}}),
+			queryParam("limit", "at most this many, 50 by default", map[string]any{"type": "integer", "minimum": 1, "maximum": 200}),
+			queryParam("before", "only deliveries older than this one, to page back", map[string]any{"type": "integer", "format": "int64"}),
+		}, response: []WebhookDelivery{}},
+	{method: "post", path: "/webhooks/{id}/deliveries/{delivery}/retry", tag: "webhooks", summary: "Send a finished delivery again", scope: ScopeWrite,
+		params: []map[string]any{pathParam("id", "webhook id"), pathParam("delivery", "delivery id")},
+		status: http.StatusAccepted, response: WebhookDelivery{}},
+	{method: "get", path: "/me/settings", tag: "me", summary: "The caller's settings", scope: ScopeRead, response: UserSettings{}},
+	{method: "patch", path: "/me/settings", tag: "me", summary: "Change the caller's settings; settings left out keep their value and a null UI preference resets it", scope: ScopeWrite,
+		body: UserSettings{}, example: map[string]any{"timezone": "Europe/Berlin", "ui": map[string]any{"theme": "dark"}}, response: UserSettings{}},
+	{method: "put", path: "/me/settings", tag: "me", summary: "Same as PATCH, for older clients", scope: ScopeWrite,
+		body: UserSettings{}, example: map[string]any{"timezone": "UTC"}, response: UserSettings{}},
+	{method: "post", path: "/me/export", tag: "me", summary: "Start an export of all of the caller's data, a zip archive downloaded like other exports", scope: ScopeRead,
+		status: http.StatusAccepted, response: Export{}},
+	{method: "post", path: "/me/delete", tag: "me", summary: "Erase the caller's data; what other users still need is kept under a pseudonym", scope: ScopeWrite,
+		body: struct {
+			Confirm bool `json:"confirm"`
+		}{}, example: map[string]any{"confirm": true}, response: Erasure{}},
+	{method: "get", path: "/me/quota", tag: "me", summary: "The caller's usage against each of their quotas; a null limit is none", scope: ScopeRead, response: QuotaReport{}},
+	{method: "get", path: "/me/notifications", tag: "me", summary: "The caller's email reminder settings", scope: ScopeRead, response: NotificationPreferences{}},
+	{method: "put", path: "/me/notifications", tag: "me", summary: "Change email reminder settings; settings left out keep their value", scope: ScopeWrite,
+		body: struct {
+			EmailReminders   bool `json:"email_reminders"`
+			DueReminders     bool `json:"due_reminders"`
+			OverdueReminders bool `json:"overdue_reminders"`
+		}{}, example: map[string]any{"email_reminders": true, "due_reminders": true, "overdue_reminders": false},
+		response: NotificationPreferences{}},
+	{method: "get", path: "/me/calendar", tag: "me", summary: "Whether the caller has a calendar feed", scope: ScopeRead, response: CalendarFeed{}},
+	{method: "post", path: "/me/calendar", tag: "me", summary: "Create the caller's secret calendar feed URL, replacing any previous one", scope: ScopeWrite,
+		status: http.StatusCreated, response: CalendarFeed{}},
+	{method: "delete", path: "/me/calendar", tag: "me", summary: "Turn off the caller's calendar feed", scope: ScopeWrite, status: http.StatusNoContent},
+	{method: "get", path: "/calendar/{feed}", tag: "me", summary: "The iCalendar feed of a user's todos, authorized by the token in its URL",
+		params: []map[string]any{
+			{"name": "feed", "in": "path", "required": true, "description": "<token>.ics, from feed_path", "schema": stringSchema},
+			queryParam("events", "true for open todos as events instead of tasks", map[string]any{"type": "boolean"}),
+		}, response: stringSchema, contentType: "text/calendar"},
+	{method: "post", path: "/imports", tag: "jobs", summary: "Create todos from a JSON array or a CSV file (Content-Type: text/csv) in a background job", scope: ScopeWrite,
+		body: []Todo{}, example: []map[string]any{{"task": "Renew passport", "priority": "high"}, {"task": "Book flights"}},
+		status: http.StatusAccepted, response: Job{}},
+	{method: "get", path: "/jobs/{id}", tag: "jobs", summary: "The status and result of one of the caller's jobs", scope: ScopeRead,
+		params: []map[string]any{pathParam("id", "job id")}, response: Job{}},
+	{method: "post", path: "/internal/jobs/run", tag: "jobs", summary: "Run a job attempt, for Cloud Tasks; authorized by the X-Job-Signature header",
+		params: []map[string]any{{"name": "X-Job-Signature", "in": "header", "required": true, "description": "hex HMAC-SHA256 of the body under jobs.signing_secret", "schema": stringSchema}},
+		body: struct {
+			ID int64 `json:"id"`
+		}{}, status: http.StatusNoContent},
+	{method: "post", path: "/integrations/slack/command", tag: "integrations", summary: "The /todo Slack slash command, authorized by the X-Slack-Signature header",
+		params: []map[string]any{
+			{"name": "X-Slack-Request-Timestamp", "in": "header", "required": true, "schema": stringSchema},
+			{"name": "X-Slack-Signature", "in": "header", "required": true, "description": "v0= and the hex HMAC-SHA256 of v0:<timestamp>:<body> under the signing secret", "schema": stringSchema},
+		},
+		body: map[string]any{"type": "object", "properties": map[string]any{
+			"team_id": stringSchema,
+			"user_id": stringSchema,
+			"text":    map[string]any{"type": "string", "description": "<task>, add <task>, list, done <id> or help"},
+		}}, bodyType: "application/x-www-form-urlencoded",
+		response: struct {
+			ResponseType string `json:"response_type"`
+			Text         string `json:"text"`
+		}{}},
+
+	{method: "post", path: "/auth/login", tag: "auth", summary: "Exchange the presented credentials for a session cookie", scope: ScopeWrite, response: sessionSchema},
+	{method: "post", path: "/auth/logout", tag: "auth", summary: "End the current session", status: http.StatusNoContent},
+	{method: "get", path: "/auth/session", tag: "auth", summary: "Who the caller is", scope: ScopeRead, response: sessionSchema},
+	{method: "get", path: "/auth/google", tag: "auth", summary: "Start signing in with Google", status: http.StatusFound},
+	{method: "get", path: "/auth/google/callback", tag: "auth", summary: "OAuth redirect target of Google sign-in", status: http.StatusFound},
+
+	{method: "get", path: "/healthz", tag: "system", summary: "Liveness and database connectivity", response: stringSchema, contentType: "text/plain"},
+	{method: "get", path: "/readyz", tag: "system", summary: "Readiness: database connectivity and the warm-up of the connection pools (503 until both are fine)", response: readiness{}},
+	{method: "get", path: "/version", tag: "system", summary: "Build metadata and the fingerprint of the running configuration",
+		response: struct {
+			BuildInfo
+			Config ConfigStatus `json:"config"`
+		}{}},
+	{method: "get", path: "/admin/usage", tag: "admin", summary: "Usage per subject and day, the last 30 days by default", scope: ScopeAdmin,
+		params: []map[string]any{
+			queryParam("from", "first day", dateSchema),
+			queryParam("to", "last day", dateSchema),
+			queryParam("subject", "only this subject", stringSchema),
+		}, response: []UsageReportRow{}},
+	{method: "get", path: "/admin/apikeys", tag: "admin", summary: "List API keys", scope: ScopeAdmin, response: []APIKey{}},
+	{method: "post", path: "/admin/apikeys", tag: "admin", summary: "Create an API key; the response holds the key, shown only once", scope: ScopeAdmin,
+		body: struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+			Tenant string   `json:"tenant,omitempty"`
+		}{}, example: map[string]any{"name": "ci", "scopes": []string{"read", "write"}}, status: http.StatusCreated, response: APIKey{}},
+	{method: "delete", path: "/admin/apikeys/{id}", tag: "admin", summary: "Revoke an API key", scope: ScopeAdmin,
+		params: []map[string]any{pathParam("id", "API key id")}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/jobs", tag: "admin", summary: "The newest 100 jobs of every user", scope: ScopeAdmin,
+		params:   []map[string]any{queryParam("status", "only jobs with this status", map[string]any{"type": "string", "enum": []string{"queued", "running", "succeeded", "failed"}})},
+		response: []Job{}},
+	{method: "post", path: "/admin/jobs", tag: "admin", summary: "Start a maintenance job", scope: ScopeAdmin,
+		body: map[string]any{"type": "object", "required": []string{"kind"}, "properties": map[string]any{
+			"kind": map[string]any{"type": "string", "enum": []string{"reencrypt", "webhook_deliveries"}},
+		}}, example: map[string]any{"kind": "webhook_deliveries"}, status: http.StatusAccepted, response: Job{}},
+	{method: "get", path: "/admin/jobs/schedules", tag: "admin", summary: "The cron schedules of the periodic jobs, with their next run and the job of their last", scope: ScopeAdmin,
+		response: []ScheduleStatus{}},
+	{method: "post", path: "/admin/jobs/schedules/{name}", tag: "admin", summary: "Start a run of a schedule now; 409 while the job of its last run is queued or running", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "schedule name, the job kind it starts")}, status: http.StatusAccepted, response: Job{}},
+	{method: "post", path: "/admin/db/recycle", tag: "admin", summary: "Replace the database connections of this replica, all of them or those older than max_age, e.g. after a failover",
+		scope: ScopeAdmin, body: map[string]any{"type": "object", "properties": map[string]any{
+			"max_age": map[string]any{"type": "string", "description": "a duration such as 30m; without it every connection is replaced"},
+		}}, example: map[string]any{"max_age": "30m"}, response: []PoolRecycle{}},
+	{method: "get", path: "/admin/workers", tag: "admin", summary: "The background workers of this replica: whether they run and when they last completed a pass",
+		scope: ScopeAdmin, response: []WorkerStatus{}},
+	{method: "get", path: "/admin/resources", tag: "admin", summary: "Every named API key, webhook, quota and tenant, without secrets", scope: ScopeAdmin,
+		response: AdminResources{}},
+	{method: "get", path: "/admin/resources/apikeys/{name}", tag: "admin", summary: "A named API key", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "API key name")}, response: APIKey{}},
+	{method: "put", path: "/admin/resources/apikeys/{name}", tag: "admin", summary: "Create a named API key (201, with the key) or set its scopes and tenant", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "API key name")},
+		body: struct {
+			Scopes []string `json:"scopes"`
+			Tenant string   `json:"tenant,omitempty"`
+		}{}, example: map[string]any{"scopes": []string{"read"}}, response: APIKey{}},
+	{method: "delete", path: "/admin/resources/apikeys/{name}", tag: "admin", summary: "Revoke a named API key", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "API key name")}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/resources/webhooks/{name}", tag: "admin", summary: "A named webhook", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "webhook name")}, response: ManagedWebhook{}},
+	{method: "put", path: "/admin/resources/webhooks/{name}", tag: "admin", summary: "Register a named webhook (201, with a generated secret if none is given) or update it", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "webhook name")},
+		body: struct {
+			Owner string `json:"owner"`
+			webhookRequest
+		}{}, example: map[string]any{"owner": "user:alice", "url": "https://example.com/hooks/managed", "events": []string{"todo.created"}},
+		response: ManagedWebhook{}},
+	{method: "delete", path: "/admin/resources/webhooks/{name}", tag: "admin", summary: "Delete a named webhook", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("name", "webhook name")}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/resources/quotas/{subject}", tag: "admin", summary: "The quota of a subject", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("subject", "owner of todos, such as user:alice")}, response: Quota{}},
+	{method: "put", path: "/admin/resources/quotas/{subject}", tag: "admin", summary: "Set the quota of a subject (201 when it had none)", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("subject", "owner of todos, such as user:alice")}, body: QuotaLimits{},
+		example: map[string]any{"max_todos": 1000, "max_lists": 20}, response: Quota{}},
+	{method: "delete", path: "/admin/resources/quotas/{subject}", tag: "admin", summary: "Remove the quota of a subject", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("subject", "owner of todos, such as user:alice")}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/resources/tenants/{id}", tag: "admin", summary: "A tenant and its overrides", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("id", "tenant id, such as acme")}, response: Tenant{}},
+	{method: "put", path: "/admin/resources/tenants/{id}", tag: "admin", summary: "Create a tenant (201) or set its name and overrides", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("id", "tenant id, such as acme")},
+		body: struct {
+			Name string `json:"name"`
+			QuotaLimits
+			RequestsPerMinute *int            `json:"requests_per_minute"`
+			Features          map[string]bool `json:"features"`
+		}{}, example: map[string]any{"name": "Acme", "requests_per_minute": 600}, response: Tenant{}},
+	{method: "delete", path: "/admin/resources/tenants/{id}", tag: "admin", summary: "Delete a tenant that no API key is bound to", scope: ScopeAdmin,
+		params: []map[string]any{namePathParam("id", "tenant id, such as acme")}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/config", tag: "admin", summary: "The running configuration, secrets masked, and where each setting came from", scope: ScopeAdmin,
+		response: objectSchema},
+	{method: "get", path: "/metrics", tag: "system", summary: "Prometheus metrics", response: stringSchema, contentType: "text/plain"},
+	{method: "get", path: "/openapi.json", tag: "system", summary: "This document", response: objectSchema},
+	{method: "get", path: "/docs", tag: "system", summary: "Swagger UI for this document, when enabled", response: stringSchema, contentType: "text/html"},
+}
+
+var sessionSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"subject": stringSchema,
+		"email":   stringSchema,
+		"scopes":  map[string]any{"type": "array", "items": stringSchema},
+		"method":  map[string]any{"type": "string", "description": "apikey, jwt, mtls, session, ..."},
+		"tenant":  map[string]any{"type": "string", "description": "the tenant of an API key bound to one"},
+	},
+}
+
+// OpenAPISpec returns the OpenAPI 3.1 document of the HTTP API.
+func OpenAPISpec() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	for _, op := range apiOperations {
+		o := map[string]any{
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"operationId": operationID(op),
+		}
+		params := op.params
+		if op.method == "post" && !strings.HasPrefix(op.path, "/auth/") && !strings.HasPrefix(op.path, "/integrations/") {
+			params = append(params[:len(params):len(params)], map[string]any{"$ref": "#/components/parameters/IdempotencyKey"})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.body != nil {
+			bt := op.bodyType
+			if bt == "" {
+				bt = "application/json"
+			}
+			media := map[string]any{"schema": apiSchema(op.body, schemas)}
+			if op.example != nil {
+				media["example"] = op.example
+			}
+			content := map[string]any{bt: media}
+			if op.protoBody != "" {
+				content[ProtobufContentType] = protoSchema(op.protoBody)
+			}
+			o["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]any{"description": http.StatusText(status)}
+		if op.response != nil {
+			ct := op.contentType
+			if ct == "" {
+				ct = "application/json"
+			}
+			content := map[string]any{ct: map[string]any{"schema": apiSchema(op.response, schemas)}}
+			if op.protoResponse != "" {
+				content[ProtobufContentType] = protoSchema(op.protoResponse)
+			}
+			resp["content"] = content
+		}
+		o["responses"] = map[string]any{fmt.Sprint(status): resp, "default": map[string]any{"$ref": "#/components/responses/Error"}}
+		if op.scope != "" {
+			o["description"] = "Needs the " + op.scope + " scope when credentials are presented."
+			o["security"] = []map[string][]string{{"apiKey": {}}, {"bearer": {}}, {"session": {}}}
+		}
+
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.path] = item
+		}
+		item[op.method] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Todo API",
+			"version": "1.0.0",
+			"description": "The HTTP API of the todo app. With auth.mode disabled or optional, endpoints that need a scope " +
+				"also accept callers without credentials; /admin always needs the admin scope. " +
+				"Errors are plain text. gRPC is described by proto/todo/v1/todo.proto.",
+		},
+		"servers": []map[string]string{{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKey":  map[string]any{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer":  map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "OIDC ID token"},
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": SessionCookieName, "description": "state-changing requests also need the " + CSRFHeader + " header"},
+			},
+			"parameters": map[string]any{
+				"IdempotencyKey": map[string]any{
+					"name": IdempotencyKeyHeader, "in": "header",
+					"description": "makes the request safe to retry: a repeat gets the first response, marked " + IdempotentReplayedHeader,
+					"schema":      map[string]any{"type": "string", "maxLength": 255},
+				},
+			},
+			"responses": map[string]any{
+				"Error": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"text/plain": map[string]any{"schema": stringSchema}},
+				},
+			},
+		},
+	}
+}
+
+// operationID derives a stable id from the method and path, e.g. get_lists_id_members.
+func operationID(op apiOperation) string {
+	var b strings.Builder
+	b.WriteString(op.method)
+	for _, seg := range strings.Split(strings.Trim(op.path, "/"), "/") {
+		seg = strings.Trim(seg, "{}")
+		seg = strings.NewReplacer(".", "_", "-", "_", "}:", "_").Replace(seg)
+		if seg != "" {
+			b.WriteString("_" + seg)
+		}
+	}
+	return b.String()
+}
+
+// apiSchema returns the schema of v, adding the named struct types it uses to schemas.
+func apiSchema(v any, schemas map[string]any) map[string]any {
+	if m, ok := v.(map[string]any); ok {
+		return m
+	}
+	return typeSchema(reflect.TypeOf(v), schemas)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func typeSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		// Named structs are components; unexported ones get an exported name.
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // recursion guard
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, schemas)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() == reflect.Int64 || t.Kind() == reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{} // any value
+}
+
+// structSchema describes t as encoding/json writes it: tag names, and the fields of
+// embedded structs inlined.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := map[string]any{}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = typeSchema(f.Type, schemas)
+		}
+	}
+	addFields(t)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// MarshalOpenAPISpec returns the document as indented JSON, as served and dumped.
+func MarshalOpenAPISpec() ([]byte, error) {
+	b, err := json.MarshalIndent(OpenAPISpec(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// HandleOpenAPI serves GET /openapi.json.
+func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	openAPIOnce.Do(func() {
+		var err error
+		if openAPIJSON, err = MarshalOpenAPISpec(); err != nil {
+			slog.Error("Failed to encode the OpenAPI document", "error", err)
+		}
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(openAPIJSON)
+}
+
+// HandleAPIDocs serves Swagger UI at /docs when SwaggerUI is set. "Try it out" sends
+// the browser's session cookie and echoes the CSRF cookie, like the web UI.
+func HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if !SwaggerUI {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	EnsureCSRFCookie(w, r)
+	// The security headers allow scripts from this origin only.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' https://unpkg.com; style-src 'self' 'unsafe-inline' https://unpkg.com; img-src 'self' data: https:")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Todo API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@%[1]s/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@%[1]s/swagger-ui-bundle.js" crossorigin="anonymous"></script>
+  <script src="%[2]s"></script>
+</body>
+</html>
+`, swaggerUIVersion, assetPath("swagger-init.js"))
+}
@@ -0,0 +1,227 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	OutboxDispatched = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "outbox_events_dispatched_total",
+			Help: "Total number of todo events handed to every outbox sink",
+		},
+	)
+	OutboxSinkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbox_sink_errors_total",
+			Help: "Total number of outbox batches a sink failed to publish",
+		},
+		[]string{"sink"},
+	)
+	OutboxLag = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_lag_seconds",
+			Help: "Age of the oldest undispatched todo event at the last dispatch, 0 when none are waiting",
+		},
+	)
+)
+
+// outboxLockID is the Postgres advisory lock key that lets one replica at a time
+// dispatch, so sinks see the events in order.
+const outboxLockID = 7243002
+
+const outboxBatchSize = 100
+
+// OutboxEvent is a todo change as published to outbox sinks.
+type OutboxEvent struct {
+	Seq        int64     `json:"seq"`
+	Type       string    `json:"type"` // "todo.created", "todo.updated" or "todo.deleted"
+	TodoID     int       `json:"todo_id"`
+	UserID     string    `json:"user_id,omitempty"`
+	ListID     *int64    `json:"list_id,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// Todo is the todo when the event is dispatched, which may be later than the
+	// change; nil for deletes and for todos deleted in the meantime.
+	Todo *Todo `json:"todo,omitempty"`
+}
+
+var outboxEventTypes = map[string]string{
+	"insert": "todo.created",
+	"update": "todo.updated",
+	"delete": "todo.deleted",
+}
+
+// OutboxSink receives the todo events from the dispatcher.
+type OutboxSink interface {
+	Name() string
+	// Publish delivers events, oldest first. When any sink fails, the whole batch is
+	// offered to every sink again later, so sinks must tolerate duplicates.
+	Publish(ctx context.Context, events []OutboxEvent) error
+}
+
+// DispatchOutbox hands the next batch of undispatched events in todo_events to sinks
+// and marks them dispatched, returning how many there were. It returns 0 without
+// doing anything while another replica is dispatching.
+func (s *Server) DispatchOutbox(ctx context.Context, sinks []OutboxSink) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := dbQueryRow(ctx, tx, "outbox_lock", "SELECT pg_try_advisory_xact_lock($1)", outboxLockID).Scan(&locked); err != nil || !locked {
+		return 0, err
+	}
+	rows, err := dbQuery(ctx, tx, "outbox_batch",
+		"SELECT id, op, todo_id, user_id, list_id, created_at FROM todo_events WHERE dispatched_at IS NULL ORDER BY id LIMIT $1", outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var events []OutboxEvent
+	for rows.Next() {
+		var ev OutboxEvent
+		var op string
+		var userID sql.NullString
+		if err := rows.Scan(&ev.Seq, &op, &ev.TodoID, &userID, &ev.ListID, &ev.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ev.Type, ev.UserID = outboxEventTypes[op], userID.String
+		events = append(events, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		OutboxLag.Set(0)
+		return 0, tx.Commit()
+	}
+	OutboxLag.Set(s.Clock.Now().Sub(events[0].OccurredAt).Seconds())
+
+	if err := s.loadOutboxTodos(ctx, events); err != nil {
+		return 0, err
+	}
+	for _, sink := range sinks {
+		if err := sink.Publish(ctx, events); err != nil {
+			OutboxSinkErrors.WithLabelValues(sink.Name()).Inc()
+			return 0, fmt.Errorf("outbox sink %s: %w", sink.Name(), err)
+		}
+	}
+
+	seqs := make([]int64, len(events))
+	for i, ev := range events {
+		seqs[i] = ev.Seq
+	}
+	if _, err := dbExec(ctx, tx, "outbox_mark", "UPDATE todo_events SET dispatched_at = now() WHERE id = ANY($1)", pq.Array(seqs)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	OutboxDispatched.Add(float64(len(events)))
+	return len(events), nil
+}
+
+// loadOutboxTodos attaches the current todo to the create and update events.
+func (s *Server) loadOutboxTodos(ctx context.Context, events []OutboxEvent) error {
+	var ids []int64
+	for _, ev := range events {
+		if ev.Type != "todo.deleted" {
+			ids = append(ids, int64(ev.TodoID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var todos []Todo
+	err := withTenant(ctx, s.DB, "*", func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "outbox_todos", "SELECT "+todoColumns+" FROM todos WHERE id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			todos = append(todos, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		return err
+	}
+	byID := make(map[int]Todo, len(todos))
+	for _, t := range todos {
+		byID[t.ID] = t
+	}
+	for i, ev := range events {
+		if t, ok := byID[ev.TodoID]; ok && ev.Type != "todo.deleted" {
+			events[i].Todo = &t
+		}
+	}
+	return nil
+}
+
+// StartOutboxDispatcher dispatches todo events to sinks until ctx is cancelled or
+// Workers shuts down: right after every change notification, and every interval to
+// catch up on missed ones and retry failed batches. After a failure it waits for the
+// interval. On shutdown it stops after the batch it is on; the events of that batch
+// are marked dispatched with it, and the rest are left to the replicas still running.
+func (s *Server) StartOutboxDispatcher(ctx context.Context, interval time.Duration, sinks ...OutboxSink) {
+	Workers.Go(ctx, "outbox_dispatcher", func(ctx context.Context, w *Worker) {
+		sub := TodoChanges.Subscribe()
+		defer func() { sub.Close() }()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var err error
+			for !w.Stopping() {
+				var n int
+				n, err = s.DispatchOutbox(ctx, sinks)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Warn("Failed to dispatch todo events", "error", err)
+					}
+					break
+				}
+				if n < outboxBatchSize {
+					break
+				}
+			}
+			w.Checkpoint(err)
+
+			changes := sub.C
+			if err != nil {
+				changes = nil
+			}
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			case _, ok := <-changes:
+				if !ok {
+					sub = TodoChanges.Subscribe()
+				}
+			}
+		}
+	})
+}
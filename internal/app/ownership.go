@@ -0,0 +1,45 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"log/slog"
+)
+
+// anonymousOwner owns todos created without authentication (AUTH_MODE=disabled/optional)
+// and all rows that predate per-user ownership.
+const anonymousOwner = ""
+
+// TodoOwner returns the owner id used to scope todo queries for the caller.
+// It is the principal's subject, which is namespaced by authentication method
+// ("user:<sub>", "apikey:<id>") so ids from different sources can never collide.
+func TodoOwner(ctx context.Context) string {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return p.Subject
+	}
+	return anonymousOwner
+}
+
+// AssignUnownedTodos transfers todos that have no owner to owner. It is the
+// migration path for data created before ownership existed, and is safe to run
+// repeatedly: once every row has an owner it is a no-op.
+func (s *Server) AssignUnownedTodos(ctx context.Context, owner string) (int64, error) {
+	var n int64
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+			res, err := dbExec(ctx, q, "assign_unowned_todos", "UPDATE todos SET user_id = $1 WHERE user_id = ''", owner)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		})
+	})
+	if err == nil && n > 0 {
+		slog.Info("Assigned legacy todos to owner", "owner", owner, "count", n)
+	}
+	return n, err
+}
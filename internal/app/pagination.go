@@ -0,0 +1,77 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// The todo collections page by keyset rather than OFFSET: ?limit=n returns the first n
+// todos in the order of ?sort= and, if there are more, a Link header to the next page:
+//
+//	Link: </todos?limit=100&cursor=eyJzIjoiaWQiLCJpZCI6MTAwfQ>; rel="next"
+//
+// The cursor holds the sort key of the last todo returned, and the next page starts
+// after it (WHERE (key, id) > (cursor) ORDER BY key, id LIMIT n), so that todos added
+// or deleted meanwhile do not shift the pages. It does not make deep pages cheap:
+// ListTodos is one prepared statement for every sort, ordered by CASE on the sort, so
+// each page still sorts the visible todos after the cursor. Cursors are opaque to
+// clients. Without ?limit every todo is returned, as before.
+
+// maxTodoPage is the largest ?limit of the todo collections.
+const maxTodoPage = 1000
+
+// todoCursor is the position after which a page of todos starts: the sort key and id of
+// the last todo of the page before. Rank orders todos most urgent first, from 1, like
+// the array_position of ListTodos.
+type todoCursor = repository.Cursor
+
+// cursorAfter returns the cursor after t in the order of sort.
+func cursorAfter(sort string, t Todo) string {
+	c := todoCursor{Sort: cmp.Or(sort, "id"), ID: t.ID}
+	switch sort {
+	case "priority":
+		c.Rank = len(Priorities) - slices.Index(Priorities, t.Priority)
+	case "due_at":
+		c.DueAt = t.DueAt
+	case "starred":
+		c.Starred = t.Starred
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor decodes a cursor made by cursorAfter for the same sort.
+func parseCursor(s, sort string) (*todoCursor, error) {
+	var c todoCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil || c.Sort != cmp.Or(sort, "id") {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// page trims todos, read with f, to f.Limit and sets the Link header to the next page
+// if there is one. The repository reads one todo more than the limit to tell.
+func page(f todoFilter, w http.ResponseWriter, r *http.Request, todos []Todo) []Todo {
+	if f.Limit == 0 || len(todos) <= f.Limit {
+		return todos
+	}
+	todos = todos[:f.Limit]
+	q := r.URL.Query()
+	q.Set("cursor", cursorAfter(f.Sort, todos[len(todos)-1]))
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode()))
+	return todos
+}
@@ -0,0 +1,58 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"sync"
+)
+
+// The list endpoints are the busiest in the API, and most of what they allocate is the
+// slice of todos read and the buffer the response is encoded into. Both are reused
+// across requests from the pools below. Oversized ones are left to the garbage
+// collector rather than pinned in a pool by one large request.
+const (
+	todoSliceCap     = 64      // capacity of new todo slices, a typical page of todos
+	maxPooledTodos   = 4096    // larger slices are not pooled
+	maxPooledBufSize = 1 << 20 // larger buffers are not pooled
+)
+
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// getBuffer returns an empty buffer, to be handed back with putBuffer once its bytes
+// have been written out.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+var todoSlicePool = sync.Pool{New: func() any {
+	s := make([]Todo, 0, todoSliceCap)
+	return &s
+}}
+
+// getTodoSlice returns an empty slice with room for at least a page of todos.
+func getTodoSlice() []Todo {
+	return (*todoSlicePool.Get().(*[]Todo))[:0]
+}
+
+// putTodoSlice hands back a slice from getTodoSlice once nothing refers to it any more,
+// typically after the response listing it has been written. Other slices are ignored.
+func putTodoSlice(todos []Todo) {
+	if cap(todos) < todoSliceCap || cap(todos) > maxPooledTodos {
+		return // not from the pool, or too large to keep
+	}
+	// Drop what the todos point to, so that a pooled slice keeps no tags or times alive.
+	clear(todos[:cap(todos)])
+	todos = todos[:0]
+	todoSlicePool.Put(&todos)
+}
@@ -0,0 +1,139 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var PreflightCheckOK = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "preflight_check_ok",
+		Help: "Result of the startup pre-flight checks (1 passed, 0 failed)",
+	},
+	[]string{"check"},
+)
+
+// PreflightCheck is one dependency verified at startup, before the listener is bound.
+type PreflightCheck struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// PreflightResult is the outcome of one check, as logged in the startup banner.
+type PreflightResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// RunPreflight runs the checks one after another, each bounded by timeout, and logs the
+// startup banner with their results. It reports whether all of them passed; main
+// exits on failure only in strict mode (preflight.strict).
+func RunPreflight(ctx context.Context, checks []PreflightCheck, timeout time.Duration) ([]PreflightResult, bool) {
+	results := make([]PreflightResult, 0, len(checks))
+	allOK := true
+	for _, c := range checks {
+		start := time.Now()
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := c.Run(checkCtx)
+		cancel()
+		res := PreflightResult{Name: c.Name, OK: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			res.Error = err.Error()
+			allOK = false
+			PreflightCheckOK.WithLabelValues(c.Name).Set(0)
+			slog.Warn("Pre-flight check failed", "check", c.Name, "error", err)
+		} else {
+			PreflightCheckOK.WithLabelValues(c.Name).Set(1)
+		}
+		results = append(results, res)
+	}
+
+	info := GetBuildInfo()
+	slog.Info("Startup pre-flight checks",
+		"version", info.Version,
+		"git_commit", info.GitCommit,
+		"ok", allOK,
+		"checks", results,
+	)
+	return results, allOK
+}
+
+// DatabaseCheck pings db.
+func DatabaseCheck(name string, db *sql.DB) PreflightCheck {
+	return PreflightCheck{Name: name, Run: db.PingContext}
+}
+
+// MigrationsCheck fails while embedded migrations have not been applied to db.
+func MigrationsCheck(db *sql.DB) PreflightCheck {
+	return PreflightCheck{Name: "migrations", Run: func(ctx context.Context) error {
+		pending, err := PendingMigrations(ctx, db)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d pending: %s", len(pending), strings.Join(pending, ", "))
+		}
+		return nil
+	}}
+}
+
+// SecretsCheck reads secret name straight from the backend, bypassing the cache,
+// to show that the secret store is reachable right now.
+func SecretsCheck(accessor SecretAccessor, name string) PreflightCheck {
+	return PreflightCheck{Name: "secrets", Run: func(ctx context.Context) error {
+		_, err := accessor.AccessSecret(ctx, name)
+		return err
+	}}
+}
+
+// ClockCheck fails when the local clock is before the build time or, when url is set,
+// differs from the Date header of an HTTPS response from url by more than maxSkew.
+// Token validation, signed URLs and session expiry all depend on a sane clock.
+func ClockCheck(url string, maxSkew time.Duration) PreflightCheck {
+	return PreflightCheck{Name: "clock", Run: func(ctx context.Context) error {
+		if built, err := time.Parse(time.RFC3339, GetBuildInfo().BuildTime); err == nil && time.Now().Before(built.Add(-time.Hour)) {
+			return fmt.Errorf("local time %s is before the build time %s", time.Now().UTC().Format(time.RFC3339), built.Format(time.RFC3339))
+		}
+		if url == "" {
+			return nil
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		sent := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("no reference time: %w", err)
+		}
+		resp.Body.Close()
+		remote, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return fmt.Errorf("no reference time: %s sent no valid Date header", url)
+		}
+		// Date has one-second precision; compare against the middle of the round trip.
+		local := sent.Add(time.Since(sent) / 2)
+		skew := local.Sub(remote)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > maxSkew+time.Second {
+			return fmt.Errorf("local clock is %s off from %s", skew.Round(time.Second), url)
+		}
+		return nil
+	}}
+}
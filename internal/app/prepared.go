@@ -0,0 +1,147 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PreparedStatements runs the hot todo queries as statements prepared once per pool
+// (database.prepared_statements) instead of having Postgres parse and plan them on
+// every call. database/sql prepares a statement on each connection the first time it
+// runs there, and again on the connections that replace closed ones, so reconnects and
+// credential rotation need nothing more. A statement that Postgres no longer accepts
+// (a migration changed its tables, or a pooler dropped it) is closed and prepared
+// afresh on the retry.
+//
+// The sqlcommenter comment of a prepared statement is fixed when it is prepared, so it
+// names the query but carries no traceparent; the client span still links the call to
+// its trace.
+var PreparedStatements bool
+
+// preparedQueries are the queries, by name, run often enough to be worth preparing.
+var preparedQueries = map[string]bool{
+	"list_todos":   true,
+	"get_todo":     true,
+	"insert_todo":  true,
+	"insert_todos": true,
+	"update_todo":  true,
+	"delete_todo":  true,
+}
+
+var PreparedStatementEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "db_prepared_statements_total",
+		Help: "Total number of statements prepared for a pool, or dropped after Postgres rejected them",
+	},
+	[]string{"query", "event"}, // event: "prepared", "failed" or "invalidated"
+)
+
+// tenantTx is the transaction withTenant hands its fn, remembering the pool it came
+// from so that prepared statements of the pool can be used in it.
+type tenantTx struct {
+	*sql.Tx
+	pool *sql.DB
+}
+
+type stmtKey struct {
+	pool  *sql.DB
+	query string
+}
+
+var preparedStmts = struct {
+	mu    sync.Mutex
+	stmts map[stmtKey]*sql.Stmt
+}{stmts: make(map[stmtKey]*sql.Stmt)}
+
+// preparedStmt returns the prepared statement for query on q, or nil to run the query
+// as text: when PreparedStatements is off, the query is not a hot one, or it could
+// not be prepared.
+func preparedStmt(ctx context.Context, q dbtx, name, query string) *sql.Stmt {
+	if !PreparedStatements || !preparedQueries[name] {
+		return nil
+	}
+	pool := stmtPool(q)
+	if pool == nil {
+		return nil
+	}
+
+	key := stmtKey{pool, query}
+	preparedStmts.mu.Lock()
+	stmt, ok := preparedStmts.stmts[key]
+	preparedStmts.mu.Unlock()
+	if !ok {
+		var err error
+		// Prepared for the pool, not the request: the comment carries no traceparent.
+		stmt, err = pool.PrepareContext(context.WithoutCancel(ctx), sqlComment(context.Background(), name, query))
+		if err != nil {
+			slog.Warn("Failed to prepare statement, running it unprepared", "query", name, "error", err)
+			PreparedStatementEvents.WithLabelValues(name, "failed").Inc()
+			return nil
+		}
+		preparedStmts.mu.Lock()
+		if prev, ok := preparedStmts.stmts[key]; ok {
+			// Another request prepared it meanwhile.
+			stmt.Close()
+			stmt = prev
+		} else {
+			preparedStmts.stmts[key] = stmt
+			PreparedStatementEvents.WithLabelValues(name, "prepared").Inc()
+		}
+		preparedStmts.mu.Unlock()
+	}
+	if tx, ok := q.(tenantTx); ok {
+		// Closed with the transaction.
+		return tx.StmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
+// checkPreparedStmt drops the statement for query on q's pool if err says Postgres no
+// longer accepts it, so that the next call prepares it again.
+func checkPreparedStmt(q dbtx, name, query string, err error) {
+	var pqErr *pq.Error
+	if err == nil || !errors.As(err, &pqErr) {
+		return
+	}
+	// 0A000: "cached plan must not change result type", after a migration;
+	// 26000: the statement is gone from the connection, e.g. after DISCARD ALL.
+	if pqErr.Code != "0A000" && pqErr.Code != "26000" {
+		return
+	}
+	pool := stmtPool(q)
+	if pool == nil {
+		return
+	}
+	key := stmtKey{pool, query}
+	preparedStmts.mu.Lock()
+	stmt, found := preparedStmts.stmts[key]
+	delete(preparedStmts.stmts, key)
+	preparedStmts.mu.Unlock()
+	if found {
+		stmt.Close()
+		slog.Warn("Dropped prepared statement rejected by Postgres", "query", name, "error", err)
+		PreparedStatementEvents.WithLabelValues(name, "invalidated").Inc()
+	}
+}
+
+// stmtPool returns the pool q runs on, if it is known.
+func stmtPool(q dbtx) *sql.DB {
+	switch q := q.(type) {
+	case *sql.DB:
+		return q
+	case tenantTx:
+		return q.pool
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"cloud.google.com/go/profiler"
+)
+
+// ProfilerConfig controls continuous profiling.
+// Backend is one of:
+// - "cloud": the Cloud Profiler agent, which uploads CPU/heap/goroutine/mutex profiles
+// - "pprof": net/http/pprof on a separate listener, for pull-based collectors such as Pyroscope
+// - "none" or "": disabled
+type ProfilerConfig struct {
+	Backend   string
+	ProjectID string
+	Service   string
+	Version   string
+	Addr      string // listen address for the "pprof" backend
+	Mutex     bool   // enable mutex contention profiling
+}
+
+// StartCloudProfiler starts the Cloud Profiler agent (profiler.Start); tests replace it.
+var StartCloudProfiler = profiler.Start
+
+// StartProfiler starts the configured profiling backend in the background.
+// Profiling is best-effort: failures are logged and never affect request serving.
+func StartProfiler(ctx context.Context, cfg ProfilerConfig) error {
+	if cfg.Mutex {
+		runtime.SetMutexProfileFraction(5)
+	}
+
+	switch cfg.Backend {
+	case "", "none":
+		return nil
+	case "cloud":
+		// CPU, heap, allocation and goroutine profiles are on by default; contention
+		// only with Mutex, as it needs the sampling above.
+		err := StartCloudProfiler(profiler.Config{
+			Service:        cfg.Service,
+			ServiceVersion: cfg.Version,
+			ProjectID:      cfg.ProjectID,
+			MutexProfiling: cfg.Mutex,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start cloud profiler: %w", err)
+		}
+		return nil
+	case "pprof":
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		srv := &http.Server{Addr: cfg.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("pprof server stopped", "error", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		return nil
+	default:
+		return fmt.Errorf("unknown profiler backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,157 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	todov1 "github.com/stevemcghee/go-to-production/proto/todo/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufContentType is the protobuf wire format of the REST todo API, for internal
+// callers that would rather not pay for JSON. The messages are those of the gRPC API:
+// todo.v1.Todo for a todo and todo.v1.ListTodosResponse for GET /todos.
+const ProtobufContentType = "application/x-protobuf"
+
+// maxProtobufBody bounds protobuf request bodies, which are read at once.
+const maxProtobufBody = 1 << 20
+
+// isProtobuf reports whether a media type names the protobuf wire format.
+func isProtobuf(mediaType string) bool {
+	return mediaType == ProtobufContentType || mediaType == "application/protobuf"
+}
+
+// acceptsProtobuf reports whether the Accept header prefers protobuf to JSON. The
+// first of the two listed wins, */* counts as JSON and q-values are not ranked.
+func acceptsProtobuf(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	// Few callers ask for protobuf: answer the others without parsing the header.
+	if !strings.Contains(strings.ToLower(accept), "protobuf") {
+		return false
+	}
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch {
+		case isProtobuf(mediaType):
+			return true
+		case mediaType == "application/json", mediaType == "application/*", mediaType == "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// decodeTodo reads a todo from a JSON body or, with a protobuf Content-Type, a
+// todo.v1.Todo message. Forms (task, list_id, completed) are read for the
+// server-rendered UI. A task Postgres cannot store is an error.
+func decodeTodo(w http.ResponseWriter, r *http.Request) (Todo, error) {
+	t, err := readTodo(w, r)
+	if err == nil {
+		err = checkText("task", t.Task)
+	}
+	return t, err
+}
+
+func readTodo(w http.ResponseWriter, r *http.Request) (Todo, error) {
+	var t Todo
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		r.Body = http.MaxBytesReader(w, r.Body, maxProtobufBody)
+		if err := r.ParseForm(); err != nil {
+			return t, err
+		}
+		t.Task = r.PostForm.Get("task")
+		t.Completed = r.PostForm.Get("completed") == "true"
+		t.Priority = r.PostForm.Get("priority")
+		if s, ok := r.PostForm["tags"]; ok {
+			// One comma-separated field, as typed into a form.
+			t.Tags = []string{}
+			for _, tag := range strings.Split(strings.Join(s, ","), ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					t.Tags = append(t.Tags, tag)
+				}
+			}
+		}
+		if s := r.PostForm.Get("list_id"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return t, fmt.Errorf("invalid list_id %q", s)
+			}
+			t.ListID = &id
+		}
+		return t, nil
+	case !isProtobuf(mediaType):
+		err := json.NewDecoder(r.Body).Decode(&t)
+		return t, err
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProtobufBody))
+	if err != nil {
+		return t, err
+	}
+	var m todov1.Todo
+	if err := proto.Unmarshal(body, &m); err != nil {
+		return t, fmt.Errorf("invalid todo.v1.Todo: %w", err)
+	}
+	return Todo{ID: int(m.GetId()), Task: m.GetTask(), Completed: m.GetCompleted(), ListID: m.ListId}, nil
+}
+
+// writeTodoResponse writes a Todo or []Todo as JSON or, if the caller prefers it, as
+// todo.v1.Todo or todo.v1.ListTodosResponse. HTMX requests get HTML.
+func writeTodoResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Add("Vary", "Accept, HX-Request")
+	if isHTMX(r) {
+		writeTodoFragment(w, status, v)
+		return
+	}
+	if !acceptsProtobuf(r) {
+		// Encoded in full before anything is written, so that a failure is still a 500.
+		b := getBuffer()
+		defer putBuffer(b)
+		if err := json.NewEncoder(b).Encode(v); err != nil {
+			slog.Error("Failed to encode todos", "error", err)
+			http.Error(w, "Failed to encode todos", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(b.Bytes())
+		return
+	}
+
+	var m proto.Message
+	switch v := v.(type) {
+	case Todo:
+		m = todoProto(v)
+	case []Todo:
+		resp := &todov1.ListTodosResponse{Todos: make([]*todov1.Todo, len(v))}
+		for i, t := range v {
+			resp.Todos[i] = todoProto(t)
+		}
+		m = resp
+	default:
+		panic(fmt.Sprintf("writeTodoResponse: no protobuf message for %T", v))
+	}
+	body, err := proto.Marshal(m)
+	if err != nil {
+		slog.Error("Failed to encode todos", "error", err)
+		http.Error(w, "Failed to encode todos", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ProtobufContentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
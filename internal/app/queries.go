@@ -0,0 +1,73 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// Static queries live in queries/*.sql, from which sqlc generates typed methods and
+// row structs in the store package, checked against the schema of the migrations
+// (see sqlc.yaml). Optional filters are sqlc.narg arguments the query ignores when
+// NULL, so that a filtered list is one static query too.
+
+// queries returns the generated queries run on q. They go through the helpers of
+// dbtrace.go under the snake_case name of the query ("get_todo" for GetTodo), so they
+// are traced, commented and prepared like any other.
+func queries(q dbtx) *store.Queries {
+	return store.New(storeDB{q})
+}
+
+// storeDB adapts a dbtx to the interface of the generated code.
+type storeDB struct{ q dbtx }
+
+func (s storeDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return dbQuery(ctx, s.q, queryName(query), query, args...)
+}
+
+func (s storeDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return dbQueryRow(ctx, s.q, queryName(query), query, args...)
+}
+
+func (s storeDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return dbExec(ctx, s.q, queryName(query), query, args...)
+}
+
+// PrepareContext is only called by the prepared variant of the generated code, which
+// the app does not use: preparedStmt prepares the hot queries.
+func (s storeDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errors.New("store: queries are prepared by preparedStmt")
+}
+
+var queryNames sync.Map // query: name
+
+// queryName returns the snake_case name of a generated query, which starts with a
+// "-- name: GetTodo :one" line.
+func queryName(query string) string {
+	if name, ok := queryNames.Load(query); ok {
+		return name.(string)
+	}
+	line, _, _ := strings.Cut(strings.TrimPrefix(query, "-- name: "), "\n")
+	method, _, _ := strings.Cut(line, " ")
+	var b strings.Builder
+	for i, r := range method {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	queryNames.Store(query, b.String())
+	return b.String()
+}
@@ -0,0 +1,36 @@
+-- name: InsertComment :one
+-- InsertComment adds a comment by @owner to todo @todo_id if they can see it.
+INSERT INTO todo_comments (todo_id, author, body)
+SELECT id, sqlc.arg(owner)::text, sqlc.arg(body)::text
+FROM todos
+WHERE id = sqlc.arg(todo_id)::bigint AND ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+    OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+RETURNING id, created_at;
+
+-- name: TodoExists :one
+-- TodoExists says whether @owner can see todo @id.
+SELECT EXISTS (
+    SELECT 1 FROM todos
+    WHERE ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+        OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+        AND id = sqlc.arg(id)::bigint
+)::boolean AS found;
+
+-- name: ListComments :many
+-- ListComments returns up to @max_comments comments on todo @todo_id after comment
+-- @after, oldest first.
+SELECT id, author, body, created_at FROM todo_comments WHERE todo_id = sqlc.arg(todo_id)::bigint AND id > sqlc.arg(after)::bigint ORDER BY id LIMIT sqlc.arg(max_comments)::integer;
+
+-- name: DeleteComment :one
+-- DeleteComment deletes comment @id of todo @todo_id if @owner may, and says whether
+-- the comment was there for them to see and whether they could delete it.
+WITH c AS (
+    SELECT c.id, c.author = sqlc.arg(owner)::text OR (todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+        OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner) AND m.role = 'owner') AS allowed
+    FROM todo_comments c JOIN todos ON todos.id = c.todo_id
+    WHERE c.todo_id = sqlc.arg(todo_id)::bigint AND c.id = sqlc.arg(id)::bigint AND ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+        OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+), deleted AS (
+    DELETE FROM todo_comments WHERE id IN (SELECT id FROM c WHERE allowed)
+)
+SELECT allowed::boolean AS allowed FROM c;
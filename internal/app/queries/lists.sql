@@ -0,0 +1,65 @@
+-- name: GetListRole :one
+-- GetListRole returns @user_id's role on list @list_id.
+SELECT role FROM list_members WHERE list_id = sqlc.arg(list_id) AND user_id = sqlc.arg(user_id);
+
+-- name: GetList :one
+-- GetList returns list @id with @user_id's role on it, if they are a member. The
+-- columns are in the order of the fields of TodoList, which the row converts to.
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE l.id = sqlc.arg(id) AND m.user_id = sqlc.arg(user_id);
+
+-- name: ListLists :many
+-- ListLists returns the lists @user_id is a member of, with their role on each, like
+-- GetList.
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE m.user_id = sqlc.arg(user_id)
+ORDER BY l.id;
+
+-- name: ListsByID :many
+-- ListsByID returns those of lists @ids that @user_id is a member of, like GetList.
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE m.user_id = sqlc.arg(user_id) AND l.id = ANY(sqlc.arg(ids)::bigint[]);
+
+-- name: InsertList :one
+-- InsertList creates a list and the membership of its owner in one statement, so a
+-- list can never exist without someone able to manage it. A @color of '' is none.
+WITH l AS (
+    INSERT INTO todo_lists (name, owner_id, color) VALUES (sqlc.arg(name)::text, sqlc.arg(owner)::text, NULLIF(sqlc.arg(color)::text, ''))
+    RETURNING id, created_at
+), m AS (
+    INSERT INTO list_members (list_id, user_id, role, added_by) SELECT id, sqlc.arg(owner)::text, 'owner', sqlc.arg(owner)::text FROM l
+)
+SELECT id, created_at FROM l;
+
+-- name: UpdateList :exec
+-- UpdateList sets the name, color ('' for none) and archived flag of list @id.
+UPDATE todo_lists SET name = sqlc.arg(name), color = NULLIF(sqlc.arg(color)::text, ''), archived = sqlc.arg(archived)
+WHERE id = sqlc.arg(id);
+
+-- name: DeleteList :exec
+-- DeleteList deletes list @id, and with it its todos and members.
+DELETE FROM todo_lists WHERE id = sqlc.arg(id);
+
+-- name: ListMembers :many
+-- ListMembers returns the members of list @list_id, by when they were added. The
+-- columns are in the order of the fields of ListMember, which the rows convert to.
+SELECT user_id, role, added_by, added_at FROM list_members WHERE list_id = sqlc.arg(list_id) ORDER BY added_at;
+
+-- name: UpsertListMember :one
+-- UpsertListMember adds @user_id to list @list_id, or changes their role if they are
+-- a member already; the owner's role is fixed, and changing it returns no row.
+INSERT INTO list_members (list_id, user_id, role, added_by) VALUES (sqlc.arg(list_id), sqlc.arg(user_id), sqlc.arg(role), sqlc.arg(added_by))
+ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role
+WHERE list_members.role <> 'owner'
+RETURNING added_at;
+
+-- name: DeleteListMember :execrows
+-- DeleteListMember removes @user_id from list @list_id unless they own it.
+DELETE FROM list_members WHERE list_id = sqlc.arg(list_id) AND user_id = sqlc.arg(user_id) AND role <> 'owner';
+
+-- name: MemberLists :many
+-- MemberLists returns those of @list_ids that @user_id is a member of.
+SELECT list_id FROM list_members WHERE user_id = sqlc.arg(user_id) AND list_id = ANY(sqlc.arg(list_ids)::bigint[]);
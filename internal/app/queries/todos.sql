@@ -0,0 +1,126 @@
+-- name: GetTodo :one
+-- GetTodo returns todo @id if @owner can see it.
+SELECT id, task, completed, list_id, due_at, priority,
+    ARRAY(SELECT g.name FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE tt.todo_id = todos.id ORDER BY g.name)::text[] AS tags,
+    parent_id, rrule, remind_at, created_at, updated_at, completed_at, archived, starred
+FROM todos
+WHERE ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+    OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+    AND id = sqlc.arg(id)::bigint;
+
+-- name: InsertTodo :one
+-- InsertTodo only inserts into lists the caller may edit that are not archived.
+INSERT INTO todos (task, user_id, list_id)
+SELECT sqlc.arg(task)::text, sqlc.arg(owner)::text, sqlc.narg(list_id)::bigint
+WHERE sqlc.narg(list_id)::bigint IS NULL
+    OR EXISTS (SELECT 1 FROM list_members m JOIN todo_lists l ON l.id = m.list_id
+        WHERE m.list_id = sqlc.narg(list_id) AND m.user_id = sqlc.arg(owner) AND m.role IN ('owner', 'editor') AND NOT l.archived)
+RETURNING id, completed, created_at, updated_at;
+
+-- name: InsertTodos :many
+-- InsertTodos inserts a batch of todos, tasks[i] for owners[i] into lists[i] (0 for
+-- none), checking each like InsertTodo. n is the position in the batch, from 1, of
+-- each todo inserted; those that may not be are left out.
+WITH input AS (
+    SELECT sqlc.arg(tasks)::text[] AS tasks, sqlc.arg(owners)::text[] AS owners, sqlc.arg(lists)::bigint[] AS lists
+), batch AS (
+    SELECT b.n, b.task, b.owner, NULLIF(b.list_id, 0) AS list_id, nextval(pg_get_serial_sequence('todos', 'id')) AS id
+    FROM (SELECT n, input.tasks[n] AS task, input.owners[n] AS owner, input.lists[n] AS list_id
+        FROM input, generate_subscripts(input.tasks, 1) AS n) b
+    WHERE b.list_id = 0
+        OR EXISTS (SELECT 1 FROM list_members m JOIN todo_lists l ON l.id = m.list_id
+            WHERE m.list_id = b.list_id AND m.user_id = b.owner AND m.role IN ('owner', 'editor') AND NOT l.archived)
+), inserted AS (
+    INSERT INTO todos (id, task, user_id, list_id)
+    SELECT id, task, owner, list_id FROM batch ORDER BY n
+    RETURNING id, completed, created_at, updated_at
+)
+SELECT batch.n::integer AS n, inserted.id::integer AS id, COALESCE(inserted.completed, FALSE)::boolean AS completed,
+    inserted.created_at::timestamptz AS created_at, inserted.updated_at::timestamptz AS updated_at
+FROM batch JOIN inserted ON inserted.id = batch.id
+ORDER BY batch.n;
+
+-- name: UpdateTodo :one
+-- UpdateTodo locks the row to learn its previous state, so business metrics can tell
+-- real completions apart from no-op updates, and stamps completed_at. Rows the caller
+-- may not change are invisible, exactly as if they did not exist. Completing a todo
+-- with open blockers changes nothing and says so in blocked.
+WITH prev AS (
+    SELECT id, completed, sqlc.arg(completed)::boolean AND NOT COALESCE(completed, FALSE) AND EXISTS (
+            SELECT 1 FROM todo_dependencies d JOIN todos b ON b.id = d.blocker_id
+            WHERE d.todo_id = todos.id AND NOT COALESCE(b.completed, FALSE)) AS blocked
+    FROM todos
+    WHERE id = sqlc.arg(id)::bigint AND ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+        OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner) AND m.role IN ('owner', 'editor')))
+    FOR UPDATE
+), updated AS (
+    UPDATE todos t
+    SET completed = sqlc.arg(completed)::boolean,
+        completed_at = CASE WHEN sqlc.arg(completed)::boolean THEN COALESCE(t.completed_at, now()) ELSE NULL END
+    FROM prev
+    WHERE t.id = prev.id AND NOT prev.blocked
+    RETURNING EXTRACT(EPOCH FROM t.completed_at - t.created_at) AS seconds_open, t.rrule IS NOT NULL AS recurring
+)
+SELECT COALESCE(prev.completed, FALSE)::boolean AS was_completed,
+    COALESCE(updated.seconds_open, 0)::float8 AS seconds_open,
+    COALESCE(updated.recurring, FALSE)::boolean AS recurring,
+    prev.blocked::boolean AS blocked
+FROM prev LEFT JOIN updated ON TRUE;
+
+-- name: DeleteTodo :one
+-- DeleteTodo deletes todo @id if @owner may change it, and says whether it was completed.
+DELETE FROM todos WHERE id = sqlc.arg(id)::bigint AND ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+    OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner) AND m.role IN ('owner', 'editor')))
+RETURNING COALESCE(completed, FALSE)::boolean AS was_completed;
+
+-- name: ListTodos :many
+-- ListTodos returns the todos @owner can see that pass the filter, in the order of
+-- @sort: "id", "priority", "due_at" with undated todos last, or "starred" with starred
+-- todos first, each ending with the id. A filter left NULL does not apply; a todo
+-- passes @tags when it carries all of them, which are distinct. Paging starts after
+-- todo @after_id, whose sort key is in @after_rank, @after_due_at or @after_starred,
+-- and returns at most @max_todos todos.
+SELECT id, task, completed, list_id, due_at, priority,
+    ARRAY(SELECT g.name FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE tt.todo_id = todos.id ORDER BY g.name)::text[] AS tags,
+    parent_id, rrule, remind_at, created_at, updated_at, completed_at, archived, starred
+FROM todos
+WHERE ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+    OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+    AND (sqlc.arg(include_archived)::boolean OR NOT archived)
+    AND (sqlc.narg(list_id)::bigint IS NULL OR list_id = sqlc.narg(list_id)::bigint)
+    AND (NOT sqlc.arg(inbox)::boolean OR list_id IS NULL)
+    AND (sqlc.narg(priority)::text IS NULL OR priority = sqlc.narg(priority)::text)
+    AND (sqlc.narg(starred)::boolean IS NULL OR starred = sqlc.narg(starred)::boolean)
+    AND (sqlc.narg(tags)::text[] IS NULL OR id IN (SELECT tt.todo_id FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id
+        WHERE g.name = ANY(sqlc.narg(tags)::text[]) GROUP BY tt.todo_id HAVING count(*) = cardinality(sqlc.narg(tags)::text[])))
+    AND (sqlc.narg(created_after)::timestamptz IS NULL OR created_at > sqlc.narg(created_after)::timestamptz)
+    AND (sqlc.narg(created_before)::timestamptz IS NULL OR created_at < sqlc.narg(created_before)::timestamptz)
+    AND (sqlc.narg(updated_after)::timestamptz IS NULL OR updated_at > sqlc.narg(updated_after)::timestamptz)
+    AND (sqlc.narg(updated_before)::timestamptz IS NULL OR updated_at < sqlc.narg(updated_before)::timestamptz)
+    AND (sqlc.narg(completed_after)::timestamptz IS NULL OR completed_at > sqlc.narg(completed_after)::timestamptz)
+    AND (sqlc.narg(completed_before)::timestamptz IS NULL OR completed_at < sqlc.narg(completed_before)::timestamptz)
+    AND (sqlc.narg(after_id)::bigint IS NULL OR CASE sqlc.arg(sort)::text
+        WHEN 'priority' THEN (array_position(ARRAY['urgent', 'high', 'normal', 'low'], priority), id) > (sqlc.narg(after_rank)::integer, sqlc.narg(after_id)::bigint)
+        WHEN 'due_at' THEN CASE WHEN sqlc.narg(after_due_at)::timestamptz IS NULL THEN due_at IS NULL AND id > sqlc.narg(after_id)::bigint
+            ELSE due_at > sqlc.narg(after_due_at)::timestamptz OR due_at = sqlc.narg(after_due_at)::timestamptz AND id > sqlc.narg(after_id)::bigint OR due_at IS NULL END
+        WHEN 'starred' THEN starred < sqlc.arg(after_starred)::boolean OR starred = sqlc.arg(after_starred)::boolean AND id > sqlc.narg(after_id)::bigint
+        ELSE id > sqlc.narg(after_id)::bigint END)
+ORDER BY CASE WHEN sqlc.arg(sort)::text = 'priority' THEN array_position(ARRAY['urgent', 'high', 'normal', 'low'], priority) END,
+    CASE WHEN sqlc.arg(sort)::text = 'due_at' THEN due_at END NULLS LAST,
+    CASE WHEN sqlc.arg(sort)::text = 'starred' THEN starred END DESC,
+    id
+LIMIT sqlc.narg(max_todos)::integer;
+
+-- name: SyncTodos :many
+-- SyncTodos returns the todos @owner can see, only those in @ids if set, with their
+-- version and whether @owner may change them, by id.
+SELECT id, task, completed, list_id, due_at, priority,
+    ARRAY(SELECT g.name FROM todo_tags tt JOIN tags g ON g.id = tt.tag_id WHERE tt.todo_id = todos.id ORDER BY g.name)::text[] AS tags,
+    parent_id, rrule, remind_at, created_at, updated_at, completed_at, archived, starred, version,
+    ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+        OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner) AND m.role IN ('owner', 'editor')))::boolean AS writable
+FROM todos
+WHERE ((todos.list_id IS NULL AND todos.user_id = sqlc.arg(owner))
+    OR todos.list_id IN (SELECT m.list_id FROM list_members m WHERE m.user_id = sqlc.arg(owner)))
+    AND (sqlc.narg(ids)::bigint[] IS NULL OR id = ANY(sqlc.narg(ids)::bigint[]))
+ORDER BY id;
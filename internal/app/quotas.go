@@ -0,0 +1,175 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Quotas limit what each subject may keep: todos, open todos, lists they own and the
+// bytes of the attachments they uploaded. A limit is set per subject
+// (/admin/resources/quotas) or per tenant (/admin/resources/tenants); the subject's
+// own wins, and with neither there is no limit. The database enforces them with
+// triggers (migration 0038), so every way of writing is covered; a refused write
+// raises a check violation naming the quota's constraint, which asQuotaError turns
+// into a quotaError.
+
+// QuotaLimits are the limits of a quota or a tenant. Nil means no limit of its own.
+type QuotaLimits struct {
+	MaxTodos           *int   `json:"max_todos"`
+	MaxOpenTodos       *int   `json:"max_open_todos"`
+	MaxLists           *int   `json:"max_lists"`
+	MaxAttachmentBytes *int64 `json:"max_attachment_bytes"`
+}
+
+// validate reports the first negative limit.
+func (l QuotaLimits) validate() error {
+	switch {
+	case l.MaxTodos != nil && *l.MaxTodos < 0:
+		return errors.New("max_todos must not be negative")
+	case l.MaxOpenTodos != nil && *l.MaxOpenTodos < 0:
+		return errors.New("max_open_todos must not be negative")
+	case l.MaxLists != nil && *l.MaxLists < 0:
+		return errors.New("max_lists must not be negative")
+	case l.MaxAttachmentBytes != nil && *l.MaxAttachmentBytes < 0:
+		return errors.New("max_attachment_bytes must not be negative")
+	}
+	return nil
+}
+
+// empty reports whether no limit is set.
+func (l QuotaLimits) empty() bool {
+	return l.MaxTodos == nil && l.MaxOpenTodos == nil && l.MaxLists == nil && l.MaxAttachmentBytes == nil
+}
+
+// Quota kinds, as in quotaError and QuotaReport.
+const (
+	quotaTodos           = "todos"
+	quotaOpenTodos       = "open_todos"
+	quotaLists           = "lists"
+	quotaAttachmentBytes = "attachment_bytes"
+)
+
+// quotaConstraints maps the constraint named by each quota trigger to its kind.
+var quotaConstraints = map[string]string{
+	"todo_quota":       quotaTodos,
+	"open_todo_quota":  quotaOpenTodos,
+	"list_quota":       quotaLists,
+	"attachment_quota": quotaAttachmentBytes,
+}
+
+// quotaError is a write refused because it would go over a quota. It is errTodoQuota
+// for the todo quotas, so callers that only tell todos apart keep working.
+type quotaError struct {
+	Kind  string
+	Limit int64
+}
+
+func (e *quotaError) Error() string {
+	switch e.Kind {
+	case quotaTodos:
+		return fmt.Sprintf("todo quota exceeded: at most %d todos", e.Limit)
+	case quotaOpenTodos:
+		return fmt.Sprintf("open todo quota exceeded: at most %d open todos; complete or delete some first", e.Limit)
+	case quotaLists:
+		return fmt.Sprintf("list quota exceeded: at most %d lists", e.Limit)
+	default:
+		return fmt.Sprintf("attachment quota exceeded: at most %d bytes of attachments", e.Limit)
+	}
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errTodoQuota && (e.Kind == quotaTodos || e.Kind == quotaOpenTodos)
+}
+
+// asQuotaError returns the quotaError err is, or nil if it is not one.
+func asQuotaError(err error) *quotaError {
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		return qe
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+	kind, ok := quotaConstraints[pqErr.Constraint]
+	if !ok {
+		return nil
+	}
+	limit, _ := strconv.ParseInt(pqErr.Detail, 10, 64)
+	return &quotaError{Kind: kind, Limit: limit}
+}
+
+// writeQuotaError answers a write refused by quota: 403, as the caller may not have
+// more, or 422 for an attachment larger than the whole quota, which could never fit.
+func writeQuotaError(w http.ResponseWriter, qe *quotaError, size int64) {
+	status := http.StatusForbidden
+	if qe.Kind == quotaAttachmentBytes && size > qe.Limit {
+		status = http.StatusUnprocessableEntity
+	}
+	msg := qe.Error()
+	http.Error(w, strings.ToUpper(msg[:1])+msg[1:], status)
+}
+
+// QuotaUsage is how much of a quota is used. Limit is nil when there is none.
+type QuotaUsage struct {
+	Used  int64  `json:"used"`
+	Limit *int64 `json:"limit"`
+}
+
+// QuotaReport is the answer to GET /me/quota.
+type QuotaReport struct {
+	Subject         string     `json:"subject"`
+	Todos           QuotaUsage `json:"todos"`
+	OpenTodos       QuotaUsage `json:"open_todos"`
+	Lists           QuotaUsage `json:"lists"`
+	AttachmentBytes QuotaUsage `json:"attachment_bytes"`
+}
+
+// HandleMyQuota serves GET /me/quota: the caller's usage against each of their limits,
+// counted as the quota triggers count it.
+func (s *Server) HandleMyQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	if owner == anonymousOwner {
+		http.Error(w, "Sign in to see your quota", http.StatusUnauthorized)
+		return
+	}
+
+	report := QuotaReport{Subject: owner}
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		return dbQueryRow(ctx, q, "get_quota_usage",
+			`SELECT
+				(SELECT count(*) FROM todos WHERE user_id = $1),
+				(SELECT count(*) FROM todos WHERE user_id = $1 AND NOT COALESCE(completed, FALSE)),
+				(SELECT count(*) FROM todo_lists WHERE owner_id = $1),
+				(SELECT COALESCE(sum(size), 0) FROM todo_attachments WHERE uploader = $1),
+				quota_limit($1, 'max_todos'), quota_limit($1, 'max_open_todos'),
+				quota_limit($1, 'max_lists'), quota_limit($1, 'max_attachment_bytes')`,
+			owner).Scan(&report.Todos.Used, &report.OpenTodos.Used, &report.Lists.Used, &report.AttachmentBytes.Used,
+			&report.Todos.Limit, &report.OpenTodos.Limit, &report.Lists.Limit, &report.AttachmentBytes.Limit)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Failed to encode quota report", "error", err)
+	}
+}
@@ -0,0 +1,534 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurring todos repeat on an iCalendar RRULE, counted from the due date of the
+// first todo of the series (its DTSTART) in the timezone of the todo's creator:
+//
+//	PUT    /todos/{id}/recurrence  {"rrule": "FREQ=WEEKLY;BYDAY=MO,TH"}
+//	DELETE /todos/{id}/recurrence  ends the series
+//	GET    /todos/{id}/recurrence  the next occurrences; ?rrule= previews another rule
+//
+// Completing an occurrence queues a recurrence job, which creates the next one: the
+// same task, list, priority and tags, due at the next occurrence after this one's due
+// date. Moving an occurrence's due date moves the rest of the series along.
+
+const (
+	recurrenceJob = "recurrence"
+
+	maxRecurrencePreview = 50
+	// maxRecurrencePeriods bounds the search for the next occurrence of rules that
+	// rarely or never match, such as FREQ=YEARLY starting on February 29.
+	maxRecurrencePeriods = 10000
+)
+
+func init() {
+	registerJob(recurrenceJob, jobKind{
+		policy: RetryPolicy{MaxAttempts: 5, MinBackoff: 10 * time.Second, MaxBackoff: 5 * time.Minute, Timeout: time.Minute},
+		run:    (*Server).runRecurrence,
+	})
+}
+
+// RRule is a recurrence rule: the subset of RFC 5545 RRULEs with FREQ, INTERVAL,
+// BYDAY (weekdays, without ordinals), BYMONTHDAY, COUNT and UNTIL.
+type RRule struct {
+	Freq       string         // DAILY, WEEKLY, MONTHLY or YEARLY
+	Interval   int            // every Interval periods
+	ByDay      []time.Weekday // DAILY and WEEKLY: only on these weekdays, Monday first
+	ByMonthDay []int          // MONTHLY: on these days of the month; -1 is the last
+	Count      int            // occurrences in the series, 0 for no limit
+	Until      time.Time      // no occurrences after Until, zero for no limit
+
+	untilDate bool // UNTIL is a date: through the end of that day, in the series' timezone
+}
+
+var rruleWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"} // by time.Weekday
+
+// mondayFirst orders weekdays as the weeks of RRULEs (WKST=MO) do.
+func mondayFirst(d time.Weekday) int { return (int(d) + 6) % 7 }
+
+// ParseRRule parses a rule such as "FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=12", with or
+// without an "RRULE:" prefix.
+func ParseRRule(s string) (RRule, error) {
+	r := RRule{Interval: 1}
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	if s == "" {
+		return RRule{}, errors.New("rrule is required, e.g. FREQ=WEEKLY;BYDAY=MO")
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return RRule{}, fmt.Errorf("rrule part %q is not KEY=VALUE", part)
+		}
+		if seen[key] {
+			return RRule{}, fmt.Errorf("rrule has %s twice", key)
+		}
+		seen[key] = true
+		var err error
+		switch key {
+		case "FREQ":
+			if !slices.Contains([]string{"DAILY", "WEEKLY", "MONTHLY", "YEARLY"}, value) {
+				return RRule{}, errors.New("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+			r.Freq = value
+		case "INTERVAL":
+			r.Interval, err = rruleNumber(key, value, 1, 1000)
+		case "COUNT":
+			r.Count, err = rruleNumber(key, value, 1, 10000)
+		case "UNTIL":
+			if r.Until, err = time.Parse("20060102T150405Z", value); err != nil {
+				r.Until, err = time.Parse("20060102", value)
+				r.untilDate = true
+			}
+			if err != nil {
+				return RRule{}, errors.New("UNTIL must be a date (20261231) or a UTC time (20261231T170000Z)")
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				d := slices.Index(rruleWeekdays, day)
+				if d < 0 {
+					return RRule{}, fmt.Errorf("BYDAY %q is not one of MO, TU, WE, TH, FR, SA, SU", day)
+				}
+				if !slices.Contains(r.ByDay, time.Weekday(d)) {
+					r.ByDay = append(r.ByDay, time.Weekday(d))
+				}
+			}
+			slices.SortFunc(r.ByDay, func(a, b time.Weekday) int { return mondayFirst(a) - mondayFirst(b) })
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := rruleNumber(key, day, -31, 31)
+				if err != nil || n == 0 {
+					return RRule{}, errors.New("BYMONTHDAY must be days from 1 to 31, or -1 to -31 from the end")
+				}
+				if !slices.Contains(r.ByMonthDay, n) {
+					r.ByMonthDay = append(r.ByMonthDay, n)
+				}
+			}
+		case "WKST":
+			if value != "MO" {
+				return RRule{}, errors.New("only WKST=MO is supported")
+			}
+		default:
+			return RRule{}, fmt.Errorf("rrule part %s is not supported", key)
+		}
+		if err != nil {
+			return RRule{}, err
+		}
+	}
+
+	switch {
+	case r.Freq == "":
+		return RRule{}, errors.New("rrule needs a FREQ")
+	case r.Count > 0 && !r.Until.IsZero():
+		return RRule{}, errors.New("rrule can have COUNT or UNTIL, not both")
+	case len(r.ByDay) > 0 && r.Freq != "DAILY" && r.Freq != "WEEKLY":
+		return RRule{}, errors.New("BYDAY is only supported with FREQ=DAILY or WEEKLY")
+	case len(r.ByMonthDay) > 0 && r.Freq != "MONTHLY":
+		return RRule{}, errors.New("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	return r, nil
+}
+
+func rruleNumber(key, value string, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be a number from %d to %d", key, lo, hi)
+	}
+	return n, nil
+}
+
+// String returns r in the canonical form stored with todos.
+func (r RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			days[i] = rruleWeekdays[d]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			days[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	switch {
+	case r.untilDate:
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	case !r.Until.IsZero():
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// occurrences returns up to n occurrences after after of the series that starts at
+// start, with the wall clock time of start in loc, so a todo due at 9:00 stays due at
+// 9:00 across DST changes.
+func (r RRule) occurrences(start time.Time, loc *time.Location, after time.Time, n int) []time.Time {
+	start = start.In(loc)
+	limit := r.Until
+	if r.untilDate {
+		y, m, d := r.Until.Date()
+		limit = time.Date(y, m, d+1, 0, 0, 0, 0, loc).Add(-time.Nanosecond)
+	}
+	var out []time.Time
+	counted := 0
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, t := range r.period(start, period, loc) {
+			if t.Before(start) {
+				continue
+			}
+			if !limit.IsZero() && t.After(limit) {
+				return out
+			}
+			if counted++; r.Count > 0 && counted > r.Count {
+				return out
+			}
+			if t.After(after) {
+				if out = append(out, t); len(out) == n {
+					return out
+				}
+			}
+		}
+	}
+	return out
+}
+
+// period returns the candidate occurrences of the period'th period of the series, in
+// order.
+func (r RRule) period(start time.Time, period int, loc *time.Location) []time.Time {
+	y, m, d := start.Date()
+	hour, min, sec := start.Clock()
+	at := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, hour, min, sec, 0, loc) }
+	step := period * r.Interval
+	switch r.Freq {
+	case "DAILY":
+		t := at(y, m, d+step)
+		if len(r.ByDay) > 0 && !slices.Contains(r.ByDay, t.Weekday()) {
+			return nil
+		}
+		return []time.Time{t}
+	case "WEEKLY":
+		if len(r.ByDay) == 0 {
+			return []time.Time{at(y, m, d+7*step)}
+		}
+		monday := d - mondayFirst(start.Weekday()) + 7*step
+		out := make([]time.Time, len(r.ByDay))
+		for i, day := range r.ByDay {
+			out[i] = at(y, m, monday+mondayFirst(day))
+		}
+		return out
+	case "MONTHLY":
+		first := time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, loc)
+		last := first.AddDate(0, 1, -1).Day()
+		days := r.ByMonthDay
+		if len(days) == 0 {
+			days = []int{d}
+		}
+		var out []time.Time
+		for _, day := range days {
+			if day < 0 {
+				day = last + 1 + day
+			}
+			// Like RFC 5545, months without the day are skipped, not clamped.
+			if day >= 1 && day <= last {
+				out = append(out, at(first.Year(), first.Month(), day))
+			}
+		}
+		slices.SortFunc(out, func(a, b time.Time) int { return a.Compare(b) })
+		return slices.CompactFunc(out, time.Time.Equal)
+	case "YEARLY":
+		if t := at(y+step, m, d); t.Day() == d {
+			return []time.Time{t}
+		}
+	}
+	return nil // February 29 outside leap years
+}
+
+// RecurrencePreview is the answer of GET /todos/{id}/recurrence.
+type RecurrencePreview struct {
+	RRule       string      `json:"rrule"`
+	Timezone    string      `json:"timezone"`
+	Occurrences []time.Time `json:"occurrences"` // from the todo's due date on
+}
+
+type recurrencePayload struct {
+	TodoID int `json:"todo_id"`
+}
+
+type recurrenceResult struct {
+	NextTodoID int        `json:"next_todo_id,omitempty"`
+	DueAt      *time.Time `json:"due_at,omitempty"`
+	Ended      bool       `json:"ended,omitempty"` // COUNT or UNTIL reached
+}
+
+// todoRecurrence is what recurrence needs to know about a todo, in the timezone of
+// its creator.
+type todoRecurrence struct {
+	RRule     string
+	Start     *time.Time
+	DueAt     *time.Time
+	Completed bool
+	Spawned   bool // the next occurrence exists
+	Timezone  string
+}
+
+const todoRecurrenceColumns = `COALESCE(rrule, ''), recurrence_start, due_at, COALESCE(completed, FALSE), next_todo_id IS NOT NULL,
+	COALESCE((SELECT timezone FROM user_settings WHERE subject = todos.user_id), 'UTC')`
+
+func scanTodoRecurrence(row interface{ Scan(...any) error }, rec *todoRecurrence) error {
+	return row.Scan(&rec.RRule, &rec.Start, &rec.DueAt, &rec.Completed, &rec.Spawned, &rec.Timezone)
+}
+
+// spawnOccurrenceQuery creates the occurrence after todo $1, due at $2, unless it
+// exists. The row lock makes concurrent jobs for the same todo create it once.
+const spawnOccurrenceQuery = `WITH prev AS (
+	SELECT id, task, user_id, list_id, priority, rrule, recurrence_start FROM todos
+	WHERE id = $1 AND next_todo_id IS NULL FOR UPDATE
+), next AS (
+	INSERT INTO todos (task, user_id, list_id, priority, due_at, rrule, recurrence_start)
+	SELECT task, user_id, list_id, priority, $2, rrule, recurrence_start FROM prev
+	RETURNING id
+), tagged AS (
+	INSERT INTO todo_tags (todo_id, tag_id) SELECT next.id, tt.tag_id FROM next, todo_tags tt WHERE tt.todo_id = $1
+), linked AS (
+	UPDATE todos SET next_todo_id = next.id FROM next WHERE todos.id = $1
+)
+SELECT id FROM next`
+
+// runRecurrence creates the next occurrence of a completed recurring todo. It does
+// nothing if the todo was deleted, reopened or stopped recurring in the meantime.
+func (s *Server) runRecurrence(ctx context.Context, job *Job) (any, error) {
+	var p recurrencePayload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return nil, permanentJobError(err)
+	}
+	var res recurrenceResult
+	// The series belongs to the todo's creator, whoever completed it.
+	err := withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+		var rec todoRecurrence
+		err := scanTodoRecurrence(dbQueryRow(ctx, q, "get_todo_recurrence",
+			`SELECT `+todoRecurrenceColumns+` FROM todos WHERE id = $1`, p.TodoID), &rec)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.RRule == "" || !rec.Completed || rec.Spawned || rec.DueAt == nil {
+			return nil
+		}
+		rule, err := ParseRRule(rec.RRule)
+		if err != nil {
+			return permanentJobError(err)
+		}
+		start := rec.DueAt
+		if rec.Start != nil {
+			start = rec.Start
+		}
+		next := rule.occurrences(*start, userLocation(rec.Timezone), *rec.DueAt, 1)
+		if len(next) == 0 {
+			res.Ended = true
+			return nil
+		}
+		due := next[0].UTC()
+		err = dbQueryRow(ctx, q, "spawn_occurrence", spawnOccurrenceQuery, p.TodoID, due).Scan(&res.NextTodoID)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		res.DueAt = &due
+		return err
+	})
+	if qe := asQuotaError(err); qe != nil {
+		return nil, permanentJobError(qe)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.NextTodoID != 0 {
+		slog.Info("Created the next occurrence", "id", p.TodoID, "next_id", res.NextTodoID, "due_at", res.DueAt)
+	}
+	return res, nil
+}
+
+// getTodoRecurrence returns the recurrence of todo id if owner can see it, or
+// sql.ErrNoRows.
+func (s *Server) getTodoRecurrence(ctx context.Context, owner string, id int) (todoRecurrence, error) {
+	var rec todoRecurrence
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		return scanTodoRecurrence(dbQueryRow(ctx, q, "get_todo_recurrence",
+			`SELECT `+todoRecurrenceColumns+` FROM todos WHERE id = $2 AND `+todoVisibleTo,
+			owner, id), &rec)
+	})
+	return rec, err
+}
+
+var (
+	setRecurrenceQuery = `UPDATE todos SET rrule = $1, recurrence_start = due_at
+WHERE id = $2 AND due_at IS NOT NULL AND ` + fmt.Sprintf(todoWritableBy, 3) + ` RETURNING id`
+	clearRecurrenceQuery = `UPDATE todos SET rrule = NULL, recurrence_start = NULL
+WHERE id = $1 AND ` + fmt.Sprintf(todoWritableBy, 2) + ` RETURNING id`
+)
+
+// HandleTodoRecurrence serves /todos/{id}/recurrence. PUT and DELETE answer with the
+// todo, GET with a RecurrencePreview of ?count= (5) occurrences.
+func (s *Server) HandleTodoRecurrence(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	switch r.Method {
+	case http.MethodGet:
+		s.previewRecurrence(w, r, owner, id)
+		return
+	case http.MethodPut:
+		var req struct {
+			RRule string `json:"rrule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule, err := ParseRRule(req.RRule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := s.Todos.Get(ctx, owner, id, true)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Todo not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeTodoError(w, err)
+			return
+		}
+		if t.DueAt == nil {
+			http.Error(w, "Set a due date first: it starts the series", http.StatusConflict)
+			return
+		}
+		if !s.updateRecurrence(w, ctx, owner, "set_todo_recurrence", setRecurrenceQuery, rule.String(), id, owner) {
+			return
+		}
+	case http.MethodDelete:
+		if !s.updateRecurrence(w, ctx, owner, "clear_todo_recurrence", clearRecurrenceQuery, id, owner) {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
+
+// updateRecurrence runs one of the recurrence UPDATEs and reports whether it changed
+// the todo, answering the request if not.
+func (s *Server) updateRecurrence(w http.ResponseWriter, ctx context.Context, owner, name, query string, args ...any) bool {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var updated int
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, name, query, args...).Scan(&updated)
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return false
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+	}
+	return found
+}
+
+func (s *Server) previewRecurrence(w http.ResponseWriter, r *http.Request, owner string, id int) {
+	count := 5
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecurrencePreview {
+			http.Error(w, fmt.Sprintf("count must be a number from 1 to %d", maxRecurrencePreview), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	rec, err := s.getTodoRecurrence(r.Context(), owner, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	start := rec.Start
+	if v := r.URL.Query().Get("rrule"); v != "" {
+		// A rule being tried out would start the series at this todo.
+		rec.RRule, start = v, nil
+	}
+	if rec.RRule == "" {
+		http.Error(w, "The todo does not recur; pass ?rrule= to preview a rule", http.StatusNotFound)
+		return
+	}
+	if rec.DueAt == nil {
+		http.Error(w, "Set a due date first: it starts the series", http.StatusConflict)
+		return
+	}
+	rule, err := ParseRRule(rec.RRule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start == nil {
+		start = rec.DueAt
+	}
+	loc := userLocation(rec.Timezone)
+	preview := RecurrencePreview{
+		RRule:       rule.String(),
+		Timezone:    loc.String(),
+		Occurrences: rule.occurrences(*start, loc, rec.DueAt.Add(-time.Nanosecond), count),
+	}
+	if preview.Occurrences == nil {
+		preview.Occurrences = []time.Time{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preview); err != nil {
+		slog.Error("Failed to encode recurrence preview", "error", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// RedactedValue replaces anything the redactor removes.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactKeys are log attribute keys whose values are always removed.
+var DefaultRedactKeys = []string{
+	"task", "email", "password", "secret", "token", "api_key", "authorization", "cookie", "dsn", "client_secret",
+}
+
+// DefaultRedactPatterns match sensitive substrings anywhere in log messages and values.
+var DefaultRedactPatterns = []string{
+	`(?i)\b[a-z][a-z0-9+.-]*://[^:/@\s]+:[^@\s]+@`,            // URL credentials (DSNs)
+	`projects/[^/\s"]+/secrets/[^/\s"]+(/versions/[^/\s"]+)?`, // Secret Manager names
+	`(?i)\bbearer\s+[a-z0-9._~+/-]+=*`,                        // bearer tokens
+	`\btdk_[A-Za-z0-9_-]{20,}`,                                // API keys
+	`\btdc_[A-Za-z0-9_-]{20,}`,                                // calendar feed tokens
+	`(?i)\b(password|passwd|pwd)=[^\s&]+`,                     // key=value passwords
+	`\bsig=[0-9a-f]{64}`,                                      // signed URL signatures
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,          // email addresses
+}
+
+// Redactor scrubs sensitive data from strings and log records.
+type Redactor struct {
+	keys     map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor builds a redactor from the defaults plus extra keys and patterns.
+func NewRedactor(extraKeys, extraPatterns []string) (*Redactor, error) {
+	r := &Redactor{keys: make(map[string]bool)}
+	for _, k := range append(append([]string{}, DefaultRedactKeys...), extraKeys...) {
+		if k = strings.TrimSpace(k); k != "" {
+			r.keys[strings.ToLower(k)] = true
+		}
+	}
+	for _, p := range append(append([]string{}, DefaultRedactPatterns...), extraPatterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redaction is the process-wide redactor used for logs and client-facing errors.
+var Redaction, _ = NewRedactor(nil, nil)
+
+// String removes every pattern match from s.
+func (r *Redactor) String(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, RedactedValue)
+	}
+	return s
+}
+
+func (r *Redactor) attr(a slog.Attr) slog.Attr {
+	if r.keys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, RedactedValue)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.String(a.Value.String()))
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		out := make([]any, len(attrs))
+		for i, ga := range attrs {
+			out[i] = r.attr(ga)
+		}
+		return slog.Group(a.Key, out...)
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, r.String(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, r.String(v.String()))
+		}
+	}
+	return a
+}
+
+// RedactingHandler applies a Redactor to every record before passing it on.
+type RedactingHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+// NewRedactingHandler wraps next so that nothing it writes contains redacted data.
+func NewRedactingHandler(next slog.Handler, r *Redactor) *RedactingHandler {
+	return &RedactingHandler{next: next, redactor: r}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.redactor.String(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactor.attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	red := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		red[i] = h.redactor.attr(a)
+	}
+	return &RedactingHandler{next: h.next.WithAttrs(red), redactor: h.redactor}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
@@ -0,0 +1,157 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Besides the reminders of due dates, a todo can have a reminder at a time of the
+// user's choosing (todos.remind_at), emailed by Reminders as kind "reminder":
+//
+//	PUT    /todos/{id}/reminder  {"remind_at": "2026-10-20T09:00:00+02:00"}
+//	DELETE /todos/{id}/reminder
+//	POST   /todos/{id}/snooze    {"preset": "1h"}, "tomorrow" or "next_week"; or {"until": "<RFC 3339>"}
+//
+// Snoozing moves remind_at, whether or not the todo had one: "tomorrow" is 9:00
+// tomorrow and "next_week" 9:00 next Monday, in the caller's timezone. Every new
+// remind_at fires once, so a reminder that went out fires again at its snoozed time.
+
+// snoozeHour is the hour of the day that the "tomorrow" and "next_week" presets snooze to.
+const snoozeHour = 9
+
+// SnoozePresets are the presets of POST /todos/{id}/snooze.
+var SnoozePresets = []string{"1h", "tomorrow", "next_week"}
+
+// snoozeUntil returns when preset, snoozed at now, ends in loc.
+func snoozeUntil(preset string, now time.Time, loc *time.Location) (time.Time, error) {
+	now = now.In(loc)
+	y, m, d := now.Date()
+	switch preset {
+	case "1h":
+		return now.Add(time.Hour).UTC(), nil
+	case "tomorrow":
+		return time.Date(y, m, d+1, snoozeHour, 0, 0, 0, loc).UTC(), nil
+	case "next_week":
+		return time.Date(y, m, d+7-mondayFirst(now.Weekday()), snoozeHour, 0, 0, 0, loc).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("preset must be one of %v", SnoozePresets)
+}
+
+var setTodoRemindAtQuery = `UPDATE todos SET remind_at = $1 WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 3) + ` RETURNING id`
+
+// setTodoRemindAt sets or, with a nil remindAt, clears the reminder of todo id and
+// reports whether owner could change it.
+func (s *Server) setTodoRemindAt(ctx context.Context, owner string, id int, remindAt *time.Time) (bool, error) {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var updated int
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "set_todo_remind_at", setTodoRemindAtQuery, remindAt, id, owner).Scan(&updated)
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	return found, err
+}
+
+// HandleTodoReminder serves PUT and DELETE /todos/{id}/reminder and answers with the
+// todo.
+func (s *Server) HandleTodoReminder(w http.ResponseWriter, r *http.Request, id int) {
+	var remindAt *time.Time
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			RemindAt string `json:"remind_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := time.Parse(time.RFC3339, req.RemindAt)
+		if err != nil {
+			http.Error(w, "remind_at must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		t = t.UTC()
+		remindAt = &t
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.updateRemindAt(w, r, id, remindAt)
+}
+
+// HandleTodoSnooze serves POST /todos/{id}/snooze and answers with the todo.
+func (s *Server) HandleTodoSnooze(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Preset string `json:"preset"`
+		Until  string `json:"until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var until time.Time
+	switch {
+	case (req.Preset == "") == (req.Until == ""):
+		http.Error(w, "Give either a preset or until", http.StatusBadRequest)
+		return
+	case req.Until != "":
+		t, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil || !t.After(s.Clock.Now()) {
+			http.Error(w, "until must be an RFC 3339 time in the future", http.StatusBadRequest)
+			return
+		}
+		until = t.UTC()
+	default:
+		tz, err := s.userTimezone(r.Context(), TodoOwner(r.Context()))
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if until, err = snoozeUntil(req.Preset, s.Clock.Now(), userLocation(tz)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.updateRemindAt(w, r, id, &until)
+}
+
+func (s *Server) updateRemindAt(w http.ResponseWriter, r *http.Request, id int, remindAt *time.Time) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	found, err := s.setTodoRemindAt(ctx, owner, id, remindAt)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
@@ -0,0 +1,116 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"errors"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+// Resilience metrics make the behavior of the retry and circuit breaker layers
+// observable, so an open breaker or a retry storm shows up on dashboards and alerts
+// rather than only in logs.
+var (
+	CircuitBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "Current circuit breaker state (0 = closed, 1 = half-open, 2 = open)",
+		},
+		[]string{"name"},
+	)
+	CircuitBreakerTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_state_transitions_total",
+			Help: "Total number of circuit breaker state transitions",
+		},
+		[]string{"name", "from", "to"},
+	)
+	CircuitBreakerConsecutiveFailures = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_consecutive_failures",
+			Help: "Consecutive failures counted by the circuit breaker in its current generation",
+		},
+		[]string{"name"},
+	)
+	CircuitBreakerRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_rejected_total",
+			Help: "Total number of requests rejected without being attempted (open state or half-open limit)",
+		},
+		[]string{"name", "reason"},
+	)
+	DBRetryAttempts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "db_retry_attempts_total",
+			Help: "Total number of database operation retries (not counting first attempts)",
+		},
+	)
+	DBRetryExhausted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "db_retry_exhausted_total",
+			Help: "Total number of database operations that failed after exhausting all retries",
+		},
+	)
+	DBOperations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_operations_total",
+			Help: "Total number of database operations executed through the retry layer",
+		},
+		[]string{"result"}, // "success", "failure"
+	)
+)
+
+// observeBreakerStateChange is wired into the breaker's OnStateChange hook.
+func observeBreakerStateChange(name string, from, to gobreaker.State) {
+	CircuitBreakerTransitions.WithLabelValues(name, from.String(), to.String()).Inc()
+	CircuitBreakerState.WithLabelValues(name).Set(breakerStateValue(to))
+}
+
+// observeBreakerResult records the outcome of a breaker-wrapped call.
+func observeBreakerResult(cb *gobreaker.CircuitBreaker, err error) {
+	name := cb.Name()
+	switch {
+	case errors.Is(err, gobreaker.ErrOpenState):
+		CircuitBreakerRejected.WithLabelValues(name, "open").Inc()
+	case errors.Is(err, gobreaker.ErrTooManyRequests):
+		CircuitBreakerRejected.WithLabelValues(name, "half_open_limit").Inc()
+	}
+	CircuitBreakerState.WithLabelValues(name).Set(breakerStateValue(cb.State()))
+	CircuitBreakerConsecutiveFailures.WithLabelValues(name).Set(float64(cb.Counts().ConsecutiveFailures))
+}
+
+// observeRetryResult records the outcome of a retried operation.
+// Permanent errors are failures but not retry exhaustion.
+func observeRetryResult(err error, permanent bool) {
+	if err == nil {
+		DBOperations.WithLabelValues("success").Inc()
+		return
+	}
+	DBOperations.WithLabelValues("failure").Inc()
+	if !permanent {
+		DBRetryExhausted.Inc()
+	}
+}
+
+func breakerStateValue(s gobreaker.State) float64 {
+	switch s {
+	case gobreaker.StateHalfOpen:
+		return 1
+	case gobreaker.StateOpen:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// isPermanent reports whether err was marked as non-retryable with backoff.Permanent.
+func isPermanent(err error) bool {
+	var perr *backoff.PermanentError
+	return errors.As(err, &perr)
+}
@@ -0,0 +1,194 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Retention policies delete todos that are done with: those completed longer than
+// CompletedAfter ago, and archived todos, the closest thing to a trash, archived
+// longer than ArchivedAfter ago. A subtask that does not qualify keeps its parents
+// from being purged. Purges delete in batches of BatchSize, each its own statement,
+// so they never hold many locks for long; the deletions reach live feeds, webhooks
+// and event buses like any other.
+
+var (
+	RetentionPurged = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retention_purged_todos_total",
+			Help: "Total number of todos deleted by the retention policies",
+		},
+		[]string{"policy"}, // "completed", "archived"
+	)
+	RetentionPurgeable = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "retention_purgeable_todos",
+			Help: "Todos the retention policies would delete, as of the last dry run",
+		},
+		[]string{"policy"},
+	)
+)
+
+// RetentionPolicy is how long todos are kept (retention.*); a zero age keeps them.
+type RetentionPolicy struct {
+	CompletedAfter time.Duration
+	ArchivedAfter  time.Duration
+	BatchSize      int
+	DryRun         bool // count what would be purged instead
+}
+
+// Retention is the process-wide policy, set up in main.
+var Retention = RetentionPolicy{BatchSize: 500}
+
+// Enabled reports whether p purges anything.
+func (p RetentionPolicy) Enabled() bool {
+	return p.CompletedAfter > 0 || p.ArchivedAfter > 0
+}
+
+// RetentionResult counts the todos a purge deleted, or would have in a dry run, by
+// policy.
+type RetentionResult struct {
+	Completed int  `json:"completed"`
+	Archived  int  `json:"archived"`
+	DryRun    bool `json:"dry_run"`
+}
+
+// Conditions of the policies on a todo, with the cutoff time as $1.
+const (
+	completedExpired = `completed AND completed_at < $1`
+	archivedExpired  = `archived AND archived_at < $1`
+)
+
+// purgeableTodos selects the ids of the todos that pass expired and whose subtasks
+// all do too, for counting them.
+func purgeableTodos(expired string) string {
+	return `WITH RECURSIVE kept AS (
+	SELECT parent_id AS id FROM todos WHERE parent_id IS NOT NULL AND NOT (` + expired + `)
+	UNION
+	SELECT t.parent_id FROM todos t JOIN kept ON t.id = kept.id WHERE t.parent_id IS NOT NULL
+)
+SELECT id FROM todos WHERE ` + expired + ` AND id NOT IN (SELECT id FROM kept)`
+}
+
+// purgeTodosQuery deletes up to $2 todos that pass expired and have no subtasks left,
+// so that nothing goes by cascade: parents go in a later batch, after their subtasks.
+func purgeTodosQuery(expired string) string {
+	return `DELETE FROM todos WHERE id IN (
+	SELECT id FROM todos t WHERE ` + expired + ` AND NOT EXISTS (SELECT 1 FROM todos c WHERE c.parent_id = t.id)
+	ORDER BY id LIMIT $2
+)`
+}
+
+// PurgeExpiredTodos applies Retention once and returns how many todos it purged. On
+// an error it stops, returning what it had purged; the next run picks up the rest.
+func (s *Server) PurgeExpiredTodos(ctx context.Context) (RetentionResult, error) {
+	p := Retention
+	res := RetentionResult{DryRun: p.DryRun}
+	now := s.Clock.Now()
+	for _, policy := range []struct {
+		name   string
+		after  time.Duration
+		cond   string
+		purged *int
+	}{
+		{"completed", p.CompletedAfter, completedExpired, &res.Completed},
+		{"archived", p.ArchivedAfter, archivedExpired, &res.Archived},
+	} {
+		if policy.after <= 0 {
+			continue
+		}
+		cutoff := now.Add(-policy.after)
+		if p.DryRun {
+			var n int
+			err := s.ExecuteWithRobustness(func() error {
+				return withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+					return dbQueryRow(ctx, q, "count_purgeable_todos",
+						`SELECT count(*) FROM (`+purgeableTodos(policy.cond)+`) purgeable`, cutoff).Scan(&n)
+				})
+			})
+			if err != nil {
+				return res, err
+			}
+			*policy.purged = n
+			RetentionPurgeable.WithLabelValues(policy.name).Set(float64(n))
+			continue
+		}
+		for {
+			var n int64
+			err := s.ExecuteWithRobustness(func() error {
+				return withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+					r, err := dbExec(ctx, q, "purge_todos", purgeTodosQuery(policy.cond), cutoff, p.BatchSize)
+					if err != nil {
+						return err
+					}
+					n, err = r.RowsAffected()
+					return err
+				})
+			})
+			if err != nil {
+				return res, err
+			}
+			*policy.purged += int(n)
+			RetentionPurged.WithLabelValues(policy.name).Add(float64(n))
+			// Parents become leaves as their subtasks go, so a short batch can still
+			// leave some: only an empty one means done.
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func init() {
+	registerJob("retention_purge", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute, Timeout: 30 * time.Minute},
+		run:    (*Server).runRetentionPurge,
+		admin:  true,
+	})
+}
+
+func (s *Server) runRetentionPurge(ctx context.Context, job *Job) (any, error) {
+	if !Retention.Enabled() {
+		return nil, permanentJobError(errors.New("retention.completed_after and retention.archived_after are not set"))
+	}
+	return s.PurgeExpiredTodos(ctx)
+}
+
+// StartRetentionJanitor runs PurgeExpiredTodos every interval until ctx is cancelled.
+func (s *Server) StartRetentionJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "retention_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			res, err := s.PurgeExpiredTodos(ctx)
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge expired todos", "error", err)
+				}
+				continue
+			}
+			switch {
+			case res.DryRun:
+				slog.Info("Retention dry run: todos that would be purged", "completed", res.Completed, "archived", res.Archived)
+			case res.Completed > 0 || res.Archived > 0:
+				slog.Info("Purged expired todos", "completed", res.Completed, "archived", res.Archived)
+			}
+		}
+	})
+}
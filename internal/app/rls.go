@@ -0,0 +1,90 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// RLSMode makes Postgres enforce tenant isolation in addition to the app's own
+// WHERE clauses. Tenant-scoped statements run in a transaction that first sets
+// app.current_tenant, and the policies from migration 0010 hide every other
+// tenant's rows, so a query that forgets its owner filter still can't leak data.
+var RLSMode bool
+
+// systemTenant is the tenant used by background jobs that operate on all rows.
+const systemTenant = "*"
+
+// rlsTables are the tables with row-level security policies.
+var rlsTables = []string{"todos", "todo_lists"}
+
+// dbtx is the subset of *sql.DB and *sql.Tx used by the query helpers.
+type dbtx interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// withTenant runs fn against db on behalf of tenant. Without RLSMode fn gets db
+// itself; with it, fn runs in a transaction scoped to tenant, which commits when
+// fn returns nil. fn must be done with any rows before it returns.
+func withTenant(ctx context.Context, db *sql.DB, tenant string, fn func(q dbtx) error) error {
+	if !RLSMode {
+		return fn(db)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// set_config(..., true) is SET LOCAL: the tenant is cleared at commit or rollback,
+	// so a pooled connection never carries it into the next request.
+	if _, err := dbExec(ctx, tx, "set_tenant", "SELECT set_config('app.current_tenant', $1, true)", tenant); err != nil {
+		return err
+	}
+	if err := fn(tenantTx{tx, db}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// withTenantTx is withTenant with fn in a transaction in either mode, for writes of
+// several statements that must commit together.
+func withTenantTx(ctx context.Context, db *sql.DB, tenant string, fn func(q dbtx) error) error {
+	if RLSMode {
+		return withTenant(ctx, db, tenant, fn)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tenantTx{tx, db}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConfigureRowLevelSecurity makes the policies bind the table owner (the role the
+// app connects as) when enabled, and releases them otherwise. The setting is
+// per table, so every replica must run the same mode: during a rollout that
+// switches modes, old replicas see no rows (enabling) or bypass the policies
+// (disabling) until they are replaced.
+func ConfigureRowLevelSecurity(ctx context.Context, db *sql.DB, enabled bool) error {
+	mode := "NO FORCE"
+	if enabled {
+		mode = "FORCE"
+	}
+	for _, table := range rlsTables {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s %s ROW LEVEL SECURITY", table, mode)); err != nil {
+			return fmt.Errorf("failed to set %s row level security on %s: %w", mode, table, err)
+		}
+	}
+	slog.Info("Configured row level security", "enabled", enabled, "tables", rlsTables)
+	return nil
+}
@@ -0,0 +1,181 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"math"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The Go runtime sizes itself to the node, not the container: on an 8-core node a pod
+// limited to 250m of CPU runs 8 Ps, burns its CFS quota in a fraction of each period
+// and is throttled for the rest, and the GC lets the heap grow until the kernel kills
+// the pod rather than working harder near its memory limit. ApplyContainerLimits fits
+// GOMAXPROCS and GOMEMLIMIT to the limits of the cgroup at startup.
+
+var (
+	ContainerCPULimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "container_cpu_limit_cores",
+			Help: "CPU limit of the container from its cgroup, 0 if unlimited",
+		},
+	)
+	ContainerMemoryLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "container_memory_limit_bytes",
+			Help: "Memory limit of the container from its cgroup, 0 if unlimited",
+		},
+	)
+	RuntimeGOMAXPROCS = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runtime_gomaxprocs",
+			Help: "GOMAXPROCS the process runs with, by where it came from (cgroup, env or default)",
+		},
+		[]string{"source"},
+	)
+	RuntimeMemoryLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runtime_memory_limit_bytes",
+			Help: "GOMEMLIMIT the process runs with, by where it came from (cgroup, env or default)",
+		},
+		[]string{"source"},
+	)
+)
+
+// ContainerLimits are the limits of the cgroup the process runs in, zero where there
+// is none.
+type ContainerLimits struct {
+	CPUs        float64 // CPU quota per period, e.g. 0.25 for a limit of 250m
+	MemoryBytes int64
+}
+
+// ReadContainerLimits reads the limits of the process's cgroup from fsys, normally
+// os.DirFS("/"): cpu.max and memory.max with cgroup v2, the lowest along the path
+// from the process's cgroup up to the root, or the cpu and memory controllers of
+// cgroup v1. Outside a container both are zero.
+func ReadContainerLimits(fsys fs.FS) (ContainerLimits, error) {
+	var l ContainerLimits
+	if _, err := fs.Stat(fsys, "sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return readCgroupV1Limits(fsys)
+	}
+	// Within a cgroup namespace, as in most pods, the process's cgroup is the root of
+	// the mount and /proc/self/cgroup says "0::/".
+	dir := "/"
+	if b, err := fs.ReadFile(fsys, "proc/self/cgroup"); err == nil {
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			if p, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+				dir = p
+			}
+		}
+	}
+	for ; ; dir = path.Dir(dir) {
+		base := path.Join("sys/fs/cgroup", dir)
+		if b, err := fs.ReadFile(fsys, base+"/cpu.max"); err == nil {
+			// "max 100000" or "<quota> <period>", in microseconds
+			quota, period, _ := strings.Cut(strings.TrimSpace(string(b)), " ")
+			q, qerr := strconv.ParseFloat(quota, 64)
+			p, perr := strconv.ParseFloat(period, 64)
+			if qerr == nil && perr == nil && p > 0 && (l.CPUs == 0 || q/p < l.CPUs) {
+				l.CPUs = q / p
+			}
+		}
+		if b, err := fs.ReadFile(fsys, base+"/memory.max"); err == nil {
+			if m, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && (l.MemoryBytes == 0 || m < l.MemoryBytes) {
+				l.MemoryBytes = m
+			}
+		}
+		if dir == "/" || dir == "." {
+			return l, nil
+		}
+	}
+}
+
+// readCgroupV1Limits reads the limits of cgroup v1, where the container's cgroups are
+// mounted at the root of each controller.
+func readCgroupV1Limits(fsys fs.FS) (ContainerLimits, error) {
+	var l ContainerLimits
+	quota, qerr := readCgroupInt(fsys, "sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, perr := readCgroupInt(fsys, "sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if qerr == nil && perr == nil && quota > 0 && period > 0 {
+		l.CPUs = float64(quota) / float64(period)
+	}
+	mem, merr := readCgroupInt(fsys, "sys/fs/cgroup/memory/memory.limit_in_bytes")
+	// Unlimited is the largest multiple of the page size.
+	if merr == nil && mem > 0 && mem < math.MaxInt64/2 {
+		l.MemoryBytes = mem
+	}
+	if errors.Is(qerr, fs.ErrNotExist) && errors.Is(merr, fs.ErrNotExist) {
+		return l, nil // not in a cgroup we can read: no limits
+	}
+	return l, errors.Join(ignoreNotExist(qerr), ignoreNotExist(perr), ignoreNotExist(merr))
+}
+
+func readCgroupInt(fsys fs.FS, name string) (int64, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RuntimeLimits are the GOMAXPROCS and GOMEMLIMIT in effect, and where each came from:
+// "cgroup", "env" (the GOMAXPROCS or GOMEMLIMIT variable) or "default".
+type RuntimeLimits struct {
+	GOMAXPROCS        int
+	GOMAXPROCSSource  string
+	MemoryLimit       int64 // math.MaxInt64 when there is none
+	MemoryLimitSource string
+}
+
+// ApplyContainerLimits sets GOMAXPROCS to the CPU limit of l, rounded down but at least
+// 1, and GOMEMLIMIT to memoryRatio of its memory limit, leaving the headroom to what
+// the GC does not account for (stacks in flight, cgo, the page cache of the pod). A
+// GOMAXPROCS or GOMEMLIMIT variable, which the runtime has already applied, wins.
+// The values in effect are exported as metrics and returned for the startup log.
+func ApplyContainerLimits(l ContainerLimits, memoryRatio float64, lookupEnv func(string) (string, bool)) RuntimeLimits {
+	r := RuntimeLimits{GOMAXPROCSSource: "default", MemoryLimitSource: "default"}
+	if _, ok := lookupEnv("GOMAXPROCS"); ok {
+		r.GOMAXPROCSSource = "env"
+	} else if l.CPUs > 0 {
+		runtime.GOMAXPROCS(max(1, min(int(l.CPUs), runtime.NumCPU())))
+		r.GOMAXPROCSSource = "cgroup"
+	}
+	r.GOMAXPROCS = runtime.GOMAXPROCS(0)
+
+	if _, ok := lookupEnv("GOMEMLIMIT"); ok {
+		r.MemoryLimitSource = "env"
+	} else if l.MemoryBytes > 0 {
+		debug.SetMemoryLimit(int64(float64(l.MemoryBytes) * memoryRatio))
+		r.MemoryLimitSource = "cgroup"
+	}
+	r.MemoryLimit = debug.SetMemoryLimit(-1)
+
+	ContainerCPULimit.Set(l.CPUs)
+	ContainerMemoryLimit.Set(float64(l.MemoryBytes))
+	RuntimeGOMAXPROCS.Reset()
+	RuntimeGOMAXPROCS.WithLabelValues(r.GOMAXPROCSSource).Set(float64(r.GOMAXPROCS))
+	RuntimeMemoryLimit.Reset()
+	RuntimeMemoryLimit.WithLabelValues(r.MemoryLimitSource).Set(float64(r.MemoryLimit))
+	return r
+}
@@ -0,0 +1,370 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The scheduler starts jobs on cron schedules: by default the retention purge, the
+// stats rollup (the usage_rollup job, which rolls the metered usage up into daily
+// totals) and the email reminders (scheduler.* settings). Every replica runs it, and
+// the schedules table makes sure that one of them starts each run: the replica that
+// moves a schedule's next_run_at on from a time that has passed enqueues the job,
+// which the workers of any replica then run with the retries of its kind. A run is
+// skipped while the job of the previous one is still queued or running; the row of
+// the schedule is locked from that check until the new job is recorded, so runs
+// started by hand do not overlap either. Each run starts up to Scheduler.Jitter late,
+// at random, so that schedules due at the same minute do not all hit the database at
+// once.
+//
+// The schedules are shown next to the jobs they start, under GET /admin/jobs:
+//
+//	GET  /admin/jobs/schedules         every schedule, its next run and the job of its last
+//	POST /admin/jobs/schedules/{name}  start a run now
+
+var ScheduledRuns = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "scheduled_runs_total",
+		Help: "Total number of runs of the job schedules, by schedule and result",
+	},
+	[]string{"schedule", "result"}, // "started", "skipped", "failed"
+)
+
+// Schedule starts the job kind it is named after whenever its cron expression matches.
+type Schedule struct {
+	Name string // the job kind
+	Expr string // the cron expression, in UTC
+	spec CronSpec
+}
+
+// NewSchedule returns the schedule of job kind name on the cron expression expr.
+func NewSchedule(name, expr string) (Schedule, error) {
+	if _, ok := jobKinds[name]; !ok {
+		return Schedule{}, fmt.Errorf("unknown job kind %q", name)
+	}
+	spec, err := ParseCron(expr)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return Schedule{Name: name, Expr: expr, spec: spec}, nil
+}
+
+// Scheduler holds the schedules StartScheduler runs, set up by main.
+var Scheduler = struct {
+	Schedules []Schedule
+	Jitter    time.Duration // runs start up to this late
+}{Jitter: 10 * time.Second}
+
+// schedulerOwner owns the jobs the scheduler starts.
+const schedulerOwner = "system:scheduler"
+
+// scheduledJobRetention is how long the finished jobs of the schedules are kept.
+const scheduledJobRetention = 7 * 24 * time.Hour
+
+var (
+	errNoSchedule     = errors.New("schedule not found")
+	errScheduleNotDue = errors.New("schedule not due or not set up yet")
+	errScheduleBusy   = errors.New("the job of the last run is still queued or running")
+)
+
+// nextRun returns when s runs next after t, jitter included.
+func nextRun(s Schedule, t time.Time) time.Time {
+	next := s.spec.Next(t)
+	if Scheduler.Jitter > 0 {
+		next = next.Add(rand.N(Scheduler.Jitter))
+	}
+	return next
+}
+
+// StartScheduler starts the runs of Scheduler.Schedules that are due, checking every
+// interval, until ctx is cancelled or Workers shuts down. Once an hour it deletes the
+// finished jobs of the schedules older than scheduledJobRetention.
+func (s *Server) StartScheduler(ctx context.Context, interval time.Duration) {
+	if len(Scheduler.Schedules) == 0 {
+		return
+	}
+	Workers.Go(ctx, "scheduler", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		synced := false
+		var lastPrune time.Time
+		for {
+			var err error
+			if !synced {
+				synced = s.syncSchedules(ctx) == nil
+			}
+			if synced {
+				_, err = s.RunDueSchedules(ctx)
+				if err != nil && ctx.Err() == nil {
+					slog.Warn("Failed to start scheduled jobs", "error", err)
+				}
+			}
+			if s.Clock.Now().Sub(lastPrune) > time.Hour {
+				lastPrune = s.Clock.Now()
+				res, err := dbExec(ctx, s.DB, "purge_scheduled_jobs",
+					"DELETE FROM jobs WHERE owner_id = $1 AND finished_at < now() - $2 * interval '1 second'",
+					schedulerOwner, scheduledJobRetention.Seconds())
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Warn("Failed to purge old scheduled jobs", "error", err)
+					}
+				} else if n, _ := res.RowsAffected(); n > 0 {
+					slog.Debug("Purged old scheduled jobs", "count", n)
+				}
+			}
+			w.Checkpoint(err)
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	slog.Info("Scheduler started", "schedules", len(Scheduler.Schedules), "jitter", Scheduler.Jitter.String())
+}
+
+// syncSchedules adds the schedules that are not in the table yet, and moves the next
+// run of those whose expression changed.
+func (s *Server) syncSchedules(ctx context.Context) error {
+	now := s.Clock.Now()
+	for _, sched := range Scheduler.Schedules {
+		err := s.ExecuteWithRobustness(func() error {
+			_, err := dbExec(ctx, s.DB, "sync_schedule",
+				`INSERT INTO schedules (name, spec, next_run_at) VALUES ($1, $2, $3)
+				ON CONFLICT (name) DO UPDATE SET spec = EXCLUDED.spec, next_run_at = EXCLUDED.next_run_at
+				WHERE schedules.spec <> EXCLUDED.spec`,
+				sched.Name, sched.Expr, nextRun(sched, now))
+			return err
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Failed to set up job schedule", "schedule", sched.Name, "error", err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDueSchedules starts the runs of Scheduler.Schedules that are due and not started
+// by another replica, and returns how many it started.
+func (s *Server) RunDueSchedules(ctx context.Context) (int, error) {
+	started := 0
+	var errs []error
+	for _, sched := range Scheduler.Schedules {
+		now := s.Clock.Now()
+		_, err := s.startScheduledRun(ctx, sched,
+			"UPDATE schedules SET next_run_at = $2 WHERE name = $1 AND next_run_at <= $3 RETURNING last_job_id",
+			sched.Name, nextRun(sched, now), now)
+		switch {
+		case errors.Is(err, errScheduleNotDue):
+		case errors.Is(err, errScheduleBusy):
+			slog.Warn("Skipping scheduled run", "schedule", sched.Name, "reason", err)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", sched.Name, err))
+		default:
+			started++
+		}
+	}
+	return started, errors.Join(errs...)
+}
+
+// RunSchedule starts a run of the schedule name now, outside of its expression,
+// unless the job of its last run is still queued or running.
+func (s *Server) RunSchedule(ctx context.Context, name string) (Job, error) {
+	for _, sched := range Scheduler.Schedules {
+		if sched.Name == name {
+			return s.startScheduledRun(ctx, sched, "SELECT last_job_id FROM schedules WHERE name = $1 FOR UPDATE", name)
+		}
+	}
+	return Job{}, errNoSchedule
+}
+
+// startScheduledRun starts a run of s once claim, which locks the row of s and
+// returns its last_job_id, has, unless the job of the last run is still queued or
+// running. The row stays locked until the new job is recorded as the last run, so
+// two replicas or requests claiming the same schedule start one run between them:
+// the second waits for the first to commit. The status of the last job is read by
+// a statement of its own after the lock is taken: a subquery of claim would see the
+// jobs as they were when claim started waiting. It returns errScheduleNotDue if
+// claim returns no row.
+func (s *Server) startScheduledRun(ctx context.Context, sched Schedule, claim string, args ...any) (Job, error) {
+	var job Job
+	var outcome error
+	err := s.ExecuteWithRobustness(func() error {
+		job, outcome = Job{}, nil // Reset on retry
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var lastJob sql.NullInt64
+		err = dbQueryRow(ctx, tx, "claim_schedule", claim, args...).Scan(&lastJob)
+		if err == sql.ErrNoRows {
+			outcome = errScheduleNotDue
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var last string
+		if lastJob.Valid {
+			err := dbQueryRow(ctx, tx, "schedule_last_job", "SELECT status FROM jobs WHERE id = $1", lastJob.Int64).Scan(&last)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		if last == "queued" || last == "running" {
+			// Commit what claim did, such as moving the next run on.
+			outcome = errScheduleBusy
+			return tx.Commit()
+		}
+		if job, err = insertJob(ctx, tx, sched.Name, schedulerOwner, struct{}{}); err != nil {
+			return err
+		}
+		if _, err := dbExec(ctx, tx, "record_schedule_run",
+			"UPDATE schedules SET last_run_at = now(), last_job_id = $2 WHERE name = $1", sched.Name, job.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	switch {
+	case err != nil:
+		ScheduledRuns.WithLabelValues(sched.Name, "failed").Inc()
+		return Job{}, err
+	case errors.Is(outcome, errScheduleBusy):
+		ScheduledRuns.WithLabelValues(sched.Name, "skipped").Inc()
+		return Job{}, outcome
+	case outcome != nil:
+		return Job{}, outcome
+	}
+	ScheduledRuns.WithLabelValues(sched.Name, "started").Inc()
+	err = s.dispatchJob(ctx, &job)
+	return job, err
+}
+
+// ScheduleStatus is a schedule as GET /admin/jobs/schedules shows it.
+type ScheduleStatus struct {
+	Name      string     `json:"name"` // the job kind
+	Spec      string     `json:"spec"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastJob   *Job       `json:"last_job,omitempty"` // the job of the last run, with its status
+}
+
+// ListSchedules returns the schedules of Scheduler.Schedules that the scheduler set up,
+// with the job each started last.
+func (s *Server) ListSchedules(ctx context.Context) ([]ScheduleStatus, error) {
+	names := make([]string, len(Scheduler.Schedules))
+	for i, sched := range Scheduler.Schedules {
+		names[i] = sched.Name
+	}
+	var schedules []ScheduleStatus
+	err := s.ExecuteWithRobustness(func() error {
+		schedules = []ScheduleStatus{} // Reset on retry
+		rows, err := dbQuery(ctx, s.DBRead, "list_schedules",
+			"SELECT name, spec, next_run_at, last_run_at, last_job_id FROM schedules WHERE name = ANY($1) ORDER BY name", pq.Array(names))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var jobIDs []int64
+		lastJobs := map[int64]int{} // job id -> index in schedules
+		for rows.Next() {
+			var status ScheduleStatus
+			var jobID sql.NullInt64
+			if err := rows.Scan(&status.Name, &status.Spec, &status.NextRunAt, &status.LastRunAt, &jobID); err != nil {
+				return err
+			}
+			if jobID.Valid {
+				jobIDs = append(jobIDs, jobID.Int64)
+				lastJobs[jobID.Int64] = len(schedules)
+			}
+			schedules = append(schedules, status)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(jobIDs) == 0 {
+			return nil
+		}
+		rows, err = dbQuery(ctx, s.DBRead, "schedule_jobs", selectJobColumns+" WHERE id = ANY($1)", pq.Array(jobIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			job, err := scanJob(rows)
+			if err != nil {
+				return err
+			}
+			schedules[lastJobs[job.ID]].LastJob = &job
+		}
+		return rows.Err()
+	})
+	return schedules, err
+}
+
+// HandleAdminSchedules serves GET /admin/jobs/schedules.
+func (s *Server) HandleAdminSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	schedules, err := s.ListSchedules(r.Context())
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(schedules); err != nil {
+		slog.Error("Failed to encode schedules", "error", err)
+	}
+}
+
+// HandleAdminSchedule serves POST /admin/jobs/schedules/{name}: start a run of the
+// schedule now. It answers 409 while the job of the last run is queued or running.
+func (s *Server) HandleAdminSchedule(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/jobs/schedules/")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := s.RunSchedule(r.Context(), name)
+	switch {
+	case errors.Is(err, errNoSchedule):
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errScheduleBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errScheduleNotDue):
+		// The scheduler has not set the schedule up in the database yet.
+		w.Header().Set("Retry-After", "15")
+		http.Error(w, "Schedule not set up yet", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Started scheduled job by hand", "schedule", name, "id", job.ID, "by", principalSubject(r.Context()))
+	writeJob(w, http.StatusAccepted, job)
+}
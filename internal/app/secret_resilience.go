@@ -0,0 +1,236 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var SecretBackendErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secret_backend_errors_total",
+		Help: "Total number of failed Secret Manager reads by kind",
+	},
+	[]string{"kind"}, // "token_refresh", "transient", "permanent"
+)
+
+var SecretFallbackReads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secret_fallback_reads_total",
+		Help: "Total number of secret reads served by the fallback source because Secret Manager failed",
+	},
+	[]string{"result"}, // "success", "error"
+)
+
+// ResilientSecretAccessor protects Secret Manager reads against the blips GKE pods see
+// while the metadata server restarts or Workload Identity tokens are refreshed:
+//   - failed reads are retried with exponential backoff until ctx expires
+//   - consecutive failures open a circuit breaker, so a Secret Manager outage does not
+//     hold every caller for the whole backoff
+//   - while Secret Manager cannot be reached, secrets are read from an optional fallback
+//     (a mounted Kubernetes Secret or the environment), so a pod can still start
+//
+// Errors that retrying cannot fix (not found, permission denied) are returned at once
+// and never served from the fallback, so a missing IAM grant is not masked.
+type ResilientSecretAccessor struct {
+	primary  SecretAccessor
+	fallback SecretAccessor // nil without secrets.fallback
+	cb       *gobreaker.CircuitBreaker
+
+	// NewBackOff returns the retry schedule of one read; replaced in tests.
+	NewBackOff func() backoff.BackOff
+	// AttemptTimeout bounds each attempt, so one hung RPC does not use up the whole read.
+	AttemptTimeout time.Duration
+}
+
+// NewResilientSecretAccessor wraps primary. breakerFailures consecutive failed reads
+// open the breaker for 30 seconds.
+func NewResilientSecretAccessor(primary, fallback SecretAccessor, breakerFailures uint32) *ResilientSecretAccessor {
+	a := &ResilientSecretAccessor{
+		primary:  primary,
+		fallback: fallback,
+		NewBackOff: func() backoff.BackOff {
+			b := backoff.NewExponentialBackOff()
+			b.InitialInterval = 200 * time.Millisecond
+			b.MaxInterval = 5 * time.Second
+			b.MaxElapsedTime = 0 // bounded by the caller's context (secrets.fetch_timeout)
+			return b
+		},
+		AttemptTimeout: 10 * time.Second,
+	}
+	a.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        "SecretManagerCB",
+		MaxRequests: 1,
+		Timeout:     30 * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= breakerFailures
+		},
+		// A secret that does not exist says nothing about the health of Secret Manager.
+		IsSuccessful: func(err error) bool {
+			return err == nil || secretErrorKind(err) == "permanent"
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			slog.Warn("Circuit Breaker state changed", "name", name, "from", from, "to", to)
+			observeBreakerStateChange(name, from, to)
+		},
+	})
+	CircuitBreakerState.WithLabelValues(a.cb.Name()).Set(breakerStateValue(gobreaker.StateClosed))
+	return a
+}
+
+func (a *ResilientSecretAccessor) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	data, err := a.access(ctx, name)
+	if err == nil || a.fallback == nil || secretErrorKind(err) == "permanent" {
+		return data, err
+	}
+
+	id, _ := parseSecretName(name)
+	data, ferr := a.fallback.AccessSecret(ctx, name)
+	if ferr != nil {
+		SecretFallbackReads.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("%w (fallback: %v)", err, ferr)
+	}
+	SecretFallbackReads.WithLabelValues("success").Inc()
+	slog.Warn("Secret Manager unavailable, read secret from fallback", "secret", id, "error", err)
+	return data, nil
+}
+
+// access reads name from the primary through the breaker and the retry loop.
+func (a *ResilientSecretAccessor) access(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	var lastErr error
+	_, err := a.cb.Execute(func() (interface{}, error) {
+		err := backoff.RetryNotify(func() error {
+			attemptCtx, cancel := context.WithTimeout(ctx, a.AttemptTimeout)
+			defer cancel()
+			d, err := a.primary.AccessSecret(attemptCtx, name)
+			if err == nil {
+				data = d
+				return nil
+			}
+			lastErr = err
+			kind := secretErrorKind(err)
+			SecretBackendErrors.WithLabelValues(kind).Inc()
+			switch kind {
+			case "permanent":
+				return backoff.Permanent(err)
+			case "token_refresh":
+				// The client library refreshes the access token on demand; on GKE it comes from
+				// the metadata server. An error here is almost always that server being
+				// briefly unavailable (node upgrade, pod just scheduled), so keep retrying.
+				slog.Warn("Failed to refresh Google credentials for Secret Manager; check Workload Identity and the GKE metadata server",
+					"error", err)
+			}
+			return err
+		}, backoff.WithContext(a.NewBackOff(), ctx), func(err error, d time.Duration) {
+			slog.Warn("Secret Manager read failed, retrying...", "error", err, "duration", d)
+		})
+		if err != nil && ctx.Err() != nil && lastErr != nil {
+			// Report why the reads failed rather than just the expired deadline.
+			err = fmt.Errorf("%w (last attempt: %v)", ctx.Err(), lastErr)
+		}
+		return nil, err
+	})
+	observeBreakerResult(a.cb, err)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the primary and the fallback, when they hold resources.
+func (a *ResilientSecretAccessor) Close() error {
+	var errs []error
+	for _, s := range []SecretAccessor{a.primary, a.fallback} {
+		if c, ok := s.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// secretErrorKind classifies a failed Secret Manager read as "permanent" (retrying
+// cannot help), "token_refresh" (no access token could be obtained) or "transient".
+func secretErrorKind(err error) string {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return "token_refresh"
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.NotFound, codes.PermissionDenied, codes.InvalidArgument, codes.FailedPrecondition:
+			return "permanent"
+		case codes.Unauthenticated:
+			return "token_refresh"
+		}
+	}
+	// gRPC reports credential errors as "per-RPC creds failed"; the metadata client
+	// and the auth library name the token endpoint.
+	msg := err.Error()
+	for _, s := range []string{"per-RPC creds failed", "compute: Received", "oauth2: cannot fetch token", "auth: cannot fetch token"} {
+		if strings.Contains(msg, s) {
+			return "token_refresh"
+		}
+	}
+	return "transient"
+}
+
+// newResilientSecretManagerAccessor creates the Secret Manager client behind the
+// resilience layer. Creating the client looks up Application Default Credentials, which
+// on GKE probes the metadata server, so it is retried too. If it still fails, the
+// fallback alone serves secrets until the next restart; without one, startup fails.
+func newResilientSecretManagerAccessor(ctx context.Context, cfg SecretBackendConfig) (SecretAccessor, error) {
+	var fallback SecretAccessor
+	switch cfg.Fallback {
+	case "":
+	case "env":
+		fallback = EnvSecretAccessor{}
+	case "file":
+		if cfg.FallbackDir == "" {
+			cfg.FallbackDir = "/var/run/secrets/todo-app"
+		}
+		fallback = FileSecretAccessor{Dir: cfg.FallbackDir}
+	default:
+		return nil, fmt.Errorf("unknown secret fallback %q", cfg.Fallback)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Second
+	b.MaxElapsedTime = 30 * time.Second
+	var sm *SecretManagerAccessor
+	err := backoff.RetryNotify(func() (err error) {
+		sm, err = NewSecretManagerAccessor(ctx)
+		return err
+	}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+		slog.Warn("Failed to create Secret Manager client, retrying...", "error", err, "duration", d)
+	})
+	if err != nil {
+		if fallback == nil {
+			return nil, err
+		}
+		slog.Error("Secret Manager unavailable, reading secrets only from the fallback until restart", "fallback", cfg.Fallback, "error", err)
+		return fallback, nil
+	}
+
+	failures := cfg.BreakerFailures
+	if failures == 0 {
+		failures = 5
+	}
+	return NewResilientSecretAccessor(sm, fallback, failures), nil
+}
@@ -0,0 +1,220 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/lib/pq"
+	"google.golang.org/api/pubsub/v1"
+)
+
+// rotatingConnector dials with whatever DSN is current, so new connections pick up
+// rotated credentials while connections already open keep working. Connections opened
+// before recycleBefore (unix nanoseconds) are dropped by the pool; see RecycleDBPools.
+type rotatingConnector struct {
+	dsn           atomic.Pointer[string]
+	recycleBefore atomic.Int64
+}
+
+func newRotatingConnector(dsn string) *rotatingConnector {
+	c := &rotatingConnector{}
+	c.dsn.Store(&dsn)
+	return c
+}
+
+func (c *rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	pc, err := pq.NewConnector(*c.dsn.Load())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pconn, ok := conn.(pqConn); ok {
+		return &recyclableConn{pqConn: pconn, connector: c, opened: time.Now()}, nil
+	}
+	return conn, nil
+}
+
+func (c *rotatingConnector) Driver() driver.Driver { return &pq.Driver{} }
+
+// Connectors behind the pools of ConnectDB; nil until it runs.
+var primaryConnector, readConnector *rotatingConnector
+
+// RotateDBCredentials switches both pools to config. The new credentials are
+// checked on a fresh connection first; if that fails nothing changes. Idle
+// connections are then closed so the old credentials age out quickly.
+func (s *Server) RotateDBCredentials(ctx context.Context, config DBConfig) error {
+	if primaryConnector == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	swap := func(db *sql.DB, c *rotatingConnector, host, port string) error {
+		dsn := config.dsn(host, port)
+		probe := sql.OpenDB(newRotatingConnector(dsn))
+		defer probe.Close()
+		if err := probe.PingContext(ctx); err != nil {
+			return err
+		}
+		c.dsn.Store(&dsn)
+		db.SetMaxIdleConns(0) // closes idle connections
+		db.SetMaxIdleConns(maxIdleConns())
+		return nil
+	}
+
+	if err := swap(s.DB, primaryConnector, config.DBHost, config.DBPort); err != nil {
+		return fmt.Errorf("new primary credentials rejected: %w", err)
+	}
+	if readConnector != nil && s.DBRead != s.DB {
+		port := config.DBReadPort
+		if port == "" {
+			port = config.DBPort
+		}
+		if err := swap(s.DBRead, readConnector, config.DBReadHost, port); err != nil {
+			return fmt.Errorf("new read replica credentials rejected: %w", err)
+		}
+	}
+	slog.Info("Rotated database credentials", "user", config.DBUser)
+	return nil
+}
+
+// WatchDBSecret applies changes to the database config secret at runtime.
+func (s *Server) WatchDBSecret(p *SecretProvider, name string) {
+	p.OnChange(name, func(value string) {
+		var config DBConfig
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			slog.Error("Rotated database secret is not valid JSON, keeping current credentials", "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.RotateDBCredentials(ctx, config); err != nil {
+			slog.Error("Failed to rotate database credentials, keeping current ones", "error", err)
+		}
+	})
+}
+
+// secretEventTypes are the Secret Manager notifications that can change a payload.
+var secretEventTypes = map[string]bool{
+	"SECRET_ROTATE":          true, // rotation reminder; a rotator adds a version next
+	"SECRET_VERSION_ADD":     true,
+	"SECRET_VERSION_ENABLE":  true,
+	"SECRET_VERSION_DISABLE": true,
+	"SECRET_VERSION_DESTROY": true,
+	"SECRET_UPDATE":          true,
+}
+
+// StartSecretRotationListener refreshes secrets when Secret Manager publishes an
+// event for them on topic (projects/<p>/topics/<t>). Every replica must see every
+// event, so each creates its own subscription, deleted on shutdown and expiring
+// after a day if the replica dies without cleaning up.
+func StartSecretRotationListener(ctx context.Context, p *SecretProvider, topic string) error {
+	svc, err := pubsub.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+		return fmt.Errorf("invalid rotation topic %q, want projects/<project>/topics/<topic>", topic)
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	host, _ := os.Hostname()
+	sub := fmt.Sprintf("projects/%s/subscriptions/todo-app-rotation-%s-%s", parts[1], subscriptionSafe(host), hex.EncodeToString(suffix))
+
+	_, err = svc.Projects.Subscriptions.Create(sub, &pubsub.Subscription{
+		Topic:                    topic,
+		AckDeadlineSeconds:       30,
+		MessageRetentionDuration: "600s",
+		ExpirationPolicy:         &pubsub.ExpirationPolicy{Ttl: "86400s"},
+		Labels:                   map[string]string{"app": "todo-app-go", "purpose": "secret-rotation"},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to create rotation subscription: %w", err)
+	}
+	slog.Info("Listening for secret rotation events", "topic", topic, "subscription", sub)
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := svc.Projects.Subscriptions.Delete(sub).Context(dctx).Do(); err != nil {
+				slog.Warn("Failed to delete rotation subscription", "subscription", sub, "error", err)
+			}
+		})
+	}
+
+	go func() {
+		defer cleanup()
+		b := backoff.NewExponentialBackOff()
+		b.MaxInterval = 5 * time.Minute
+		b.MaxElapsedTime = 0
+		for ctx.Err() == nil {
+			resp, err := svc.Projects.Subscriptions.Pull(sub, &pubsub.PullRequest{MaxMessages: 10}).Context(ctx).Do()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				d := b.NextBackOff()
+				slog.Warn("Secret rotation pull failed, backing off", "error", err, "duration", d)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(d):
+				}
+				continue
+			}
+			b.Reset()
+
+			var ackIDs []string
+			for _, m := range resp.ReceivedMessages {
+				ackIDs = append(ackIDs, m.AckId)
+				if m.Message == nil {
+					continue
+				}
+				event, secret := m.Message.Attributes["eventType"], m.Message.Attributes["secretId"]
+				if secretEventTypes[event] && secret != "" {
+					slog.Info("Secret event received, refreshing", "event", event, "secret", secret)
+					p.RefreshSecret(ctx, secret)
+				}
+			}
+			if len(ackIDs) > 0 {
+				if _, err := svc.Projects.Subscriptions.Acknowledge(sub, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do(); err != nil {
+					slog.Warn("Failed to acknowledge secret events", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// subscriptionSafe keeps the characters allowed in subscription ids.
+func subscriptionSafe(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 40 {
+		return b.String()[:40]
+	}
+	return b.String()
+}
@@ -0,0 +1,402 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+var SecretFetches = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secret_fetches_total",
+		Help: "Total number of secret lookups by result",
+	},
+	[]string{"result"}, // "hit", "fetched", "stale" (served cached value after an error), "error"
+)
+
+var SecretRotations = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "secret_rotations_total",
+		Help: "Total number of secret value changes picked up at runtime",
+	},
+)
+
+// SecretAccessor reads the payload of a secret version.
+type SecretAccessor interface {
+	AccessSecret(ctx context.Context, name string) ([]byte, error)
+}
+
+// SecretBackendConfig selects and configures the secret backend:
+// - "gcp" (default): Google Secret Manager
+// - "env": environment variables, SECRET_<ID> (e.g. SECRET_TODO_APP_SECRET)
+// - "file": one file per secret in Dir, as mounted from a Kubernetes Secret
+// - "vault": HashiCorp Vault KV v2
+//
+// Callers always use Secret Manager resource names; the other backends map
+// projects/<p>/secrets/<id>/versions/<v> to <id> (and <v> for Vault).
+type SecretBackendConfig struct {
+	Backend string
+	Dir     string // file backend
+
+	VaultAddr      string
+	VaultToken     string
+	VaultTokenFile string // read when VaultToken is empty, e.g. from the Vault agent
+	VaultNamespace string
+	VaultMount     string // KV v2 mount, default "secret"
+	VaultPrefix    string // path under the mount, default "todo-app"
+
+	// gcp backend: breaker threshold and the source read while Secret Manager is unavailable
+	BreakerFailures uint32
+	Fallback        string // "", "env" or "file"
+	FallbackDir     string
+}
+
+// NewSecretAccessor creates the configured backend.
+func NewSecretAccessor(ctx context.Context, cfg SecretBackendConfig) (SecretAccessor, error) {
+	switch cfg.Backend {
+	case "", "gcp":
+		return newResilientSecretManagerAccessor(ctx, cfg)
+	case "env":
+		return EnvSecretAccessor{}, nil
+	case "file":
+		if cfg.Dir == "" {
+			cfg.Dir = "/var/run/secrets/todo-app"
+		}
+		return FileSecretAccessor{Dir: cfg.Dir}, nil
+	case "vault":
+		return NewVaultSecretAccessor(cfg)
+	default:
+		return nil, fmt.Errorf("unknown secret backend %q", cfg.Backend)
+	}
+}
+
+// parseSecretName splits a Secret Manager resource name into secret id and version.
+// Names in any other form are returned unchanged with version "latest".
+func parseSecretName(name string) (id, version string) {
+	parts := strings.Split(name, "/")
+	if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "secrets" {
+		id, version = parts[3], "latest"
+		if len(parts) == 6 && parts[4] == "versions" {
+			version = parts[5]
+		}
+		return id, version
+	}
+	return name, "latest"
+}
+
+// EnvSecretAccessor reads secret <id> from the environment variable SECRET_<ID>,
+// upper-cased with dashes and dots turned into underscores. Meant for local development.
+type EnvSecretAccessor struct{}
+
+func (EnvSecretAccessor) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	id, _ := parseSecretName(name)
+	key := "SECRET_" + strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(id))
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found: %s is not set", id, key)
+	}
+	return []byte(v), nil
+}
+
+// FileSecretAccessor reads secret <id> from the file Dir/<id>. Kubernetes updates
+// mounted Secrets in place, so rotated values are picked up on the next refresh.
+type FileSecretAccessor struct {
+	Dir string
+}
+
+func (a FileSecretAccessor) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	id, _ := parseSecretName(name)
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid secret id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(a.Dir, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", id, err)
+	}
+	return data, nil
+}
+
+// VaultSecretAccessor reads secrets from a Vault KV v2 engine. Secret <id> is the
+// "value" field at <mount>/data/<prefix>/<id>; a version other than "latest" selects
+// that KV version.
+type VaultSecretAccessor struct {
+	addr, namespace, mount, prefix string
+	token, tokenFile               string
+	client                         *http.Client
+}
+
+// NewVaultSecretAccessor validates cfg and returns a Vault accessor.
+func NewVaultSecretAccessor(cfg SecretBackendConfig) (*VaultSecretAccessor, error) {
+	if cfg.VaultAddr == "" {
+		return nil, fmt.Errorf("vault secret backend requires a Vault address")
+	}
+	if cfg.VaultToken == "" && cfg.VaultTokenFile == "" {
+		return nil, fmt.Errorf("vault secret backend requires a token or token file")
+	}
+	a := &VaultSecretAccessor{
+		addr:      strings.TrimRight(cfg.VaultAddr, "/"),
+		namespace: cfg.VaultNamespace,
+		mount:     cfg.VaultMount,
+		prefix:    strings.Trim(cfg.VaultPrefix, "/"),
+		token:     cfg.VaultToken,
+		tokenFile: cfg.VaultTokenFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if a.mount == "" {
+		a.mount = "secret"
+	}
+	if a.prefix == "" {
+		a.prefix = "todo-app"
+	}
+	return a, nil
+}
+
+func (a *VaultSecretAccessor) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	id, version := parseSecretName(name)
+	u := fmt.Sprintf("%s/v1/%s/data/%s/%s", a.addr, a.mount, a.prefix, url.PathEscape(id))
+	if version != "latest" {
+		u += "?version=" + url.QueryEscape(version)
+	}
+	token := a.token
+	if token == "" {
+		// Re-read on every call: the Vault agent renews the token file in place.
+		b, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if a.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", a.namespace)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s from vault: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read secret %s from vault: status %d", id, resp.StatusCode)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response for %s: %w", id, err)
+	}
+	v, ok := body.Data.Data["value"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no string field \"value\"", id)
+	}
+	return []byte(v), nil
+}
+
+// SecretManagerAccessor reads secrets from Google Secret Manager with one long-lived client.
+type SecretManagerAccessor struct {
+	client *secretmanager.Client
+}
+
+// NewSecretManagerAccessor creates the Secret Manager client. Close it on shutdown.
+func NewSecretManagerAccessor(ctx context.Context) (*SecretManagerAccessor, error) {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secretmanager client: %w", err)
+	}
+	return &SecretManagerAccessor{client: client}, nil
+}
+
+func (a *SecretManagerAccessor) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	result, err := a.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version: %w", err)
+	}
+	return result.Payload.Data, nil
+}
+
+func (a *SecretManagerAccessor) Close() error { return a.client.Close() }
+
+// SecretProvider caches secrets for TTL. Expired entries are fetched again on
+// demand (concurrent callers share one RPC) and refreshed in the background by
+// StartRefresh; if a fetch fails, the last known value is served instead, so a
+// Secret Manager outage never breaks a replica that has already started.
+type SecretProvider struct {
+	accessor SecretAccessor
+	TTL      time.Duration
+	Timeout  time.Duration // per fetch
+
+	mu       sync.Mutex
+	entries  map[string]*secretEntry
+	watchers map[string][]func(value string)
+	group    singleflight.Group
+	now      func() time.Time
+}
+
+type secretEntry struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// NewSecretProvider returns a provider reading through accessor.
+func NewSecretProvider(accessor SecretAccessor, ttl time.Duration) *SecretProvider {
+	return &SecretProvider{
+		accessor: accessor,
+		TTL:      ttl,
+		Timeout:  10 * time.Second,
+		entries:  make(map[string]*secretEntry),
+		watchers: make(map[string][]func(string)),
+		now:      time.Now,
+	}
+}
+
+// Secrets is the process-wide secret provider, set up in main.
+var Secrets *SecretProvider
+
+// Get returns the payload of secret version name, e.g. projects/p/secrets/s/versions/latest.
+func (p *SecretProvider) Get(ctx context.Context, name string) (string, error) {
+	p.mu.Lock()
+	e, ok := p.entries[name]
+	p.mu.Unlock()
+	if ok && p.now().Sub(e.fetchedAt) < p.TTL {
+		SecretFetches.WithLabelValues("hit").Inc()
+		return e.value, nil
+	}
+
+	v, err, _ := p.group.Do(name, func() (any, error) { return p.fetch(ctx, name) })
+	if err != nil {
+		if ok {
+			SecretFetches.WithLabelValues("stale").Inc()
+			slog.Warn("Failed to refresh secret, serving cached value", "secret", name, "age", p.now().Sub(e.fetchedAt).String(), "error", err)
+			return e.value, nil
+		}
+		SecretFetches.WithLabelValues("error").Inc()
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// fetch reads name from the accessor and caches it.
+func (p *SecretProvider) fetch(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	data, err := p.accessor.AccessSecret(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	SecretFetches.WithLabelValues("fetched").Inc()
+	value := string(data)
+	p.mu.Lock()
+	prev, known := p.entries[name]
+	p.entries[name] = &secretEntry{value: value, fetchedAt: p.now()}
+	watchers := p.watchers[name]
+	p.mu.Unlock()
+
+	if known && prev.value != value {
+		SecretRotations.Inc()
+		id, _ := parseSecretName(name)
+		slog.Info("Secret changed, applying new value", "secret", id, "watchers", len(watchers))
+		for _, fn := range watchers {
+			fn(value)
+		}
+	}
+	return value, nil
+}
+
+// OnChange registers fn to be called with the new payload whenever a refresh finds
+// that secret name changed. Callbacks run on the refreshing goroutine and must
+// swap their state atomically, since requests keep running meanwhile.
+func (p *SecretProvider) OnChange(name string, fn func(value string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watchers[name] = append(p.watchers[name], fn)
+}
+
+// RefreshAll re-fetches every cached secret now, e.g. on SIGHUP.
+func (p *SecretProvider) RefreshAll(ctx context.Context) {
+	p.refresh(ctx, func(string, *secretEntry) bool { return true })
+}
+
+// RefreshSecret re-fetches the cached versions of secret, given as
+// projects/<project>/secrets/<id>. Only the secret id is compared, because
+// Secret Manager notifications name the project by number.
+func (p *SecretProvider) RefreshSecret(ctx context.Context, secret string) {
+	want, _ := parseSecretName(secret)
+	p.refresh(ctx, func(name string, _ *secretEntry) bool {
+		id, _ := parseSecretName(name)
+		return id == want
+	})
+}
+
+// Refresh re-fetches every cached secret that is older than half its TTL,
+// keeping the cached value when a fetch fails.
+func (p *SecretProvider) Refresh(ctx context.Context) {
+	p.refresh(ctx, func(_ string, e *secretEntry) bool { return p.now().Sub(e.fetchedAt) >= p.TTL/2 })
+}
+
+func (p *SecretProvider) refresh(ctx context.Context, due func(name string, e *secretEntry) bool) {
+	p.mu.Lock()
+	var names []string
+	for name, e := range p.entries {
+		if due(name, e) {
+			names = append(names, name)
+		}
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		if _, err, _ := p.group.Do(name, func() (any, error) { return p.fetch(ctx, name) }); err != nil && ctx.Err() == nil {
+			SecretFetches.WithLabelValues("stale").Inc()
+			slog.Warn("Background secret refresh failed", "secret", name, "error", err)
+		}
+	}
+}
+
+// StartRefresh refreshes cached secrets every interval until ctx is cancelled,
+// so request paths rarely wait on Secret Manager.
+func (p *SecretProvider) StartRefresh(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "secret_refresh", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			p.Refresh(ctx)
+			w.Checkpoint(nil)
+		}
+	})
+}
+
+// AccessSecretVersion returns the payload of a secret, named like a Secret Manager
+// version, from the configured backend through the shared provider.
+func AccessSecretVersion(ctx context.Context, name string) (string, error) {
+	if Secrets == nil {
+		return "", fmt.Errorf("secret provider not initialized")
+	}
+	return Secrets.Get(ctx, name)
+}
@@ -0,0 +1,203 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SessionCookieName is the cookie carrying the browser session token.
+const SessionCookieName = "session"
+
+// Session lifetimes. A session ends after SessionIdleTimeout without requests, and
+// in any case SessionMaxAge after sign-in.
+var (
+	SessionIdleTimeout = 30 * time.Minute
+	SessionMaxAge      = 12 * time.Hour
+)
+
+// sessionTouchInterval limits last_seen_at writes to one per session per interval,
+// so an active browser doesn't turn every read into a write.
+const sessionTouchInterval = time.Minute
+
+// CreateSession starts a session for p and sets the session cookie.
+func (s *Server) CreateSession(ctx context.Context, w http.ResponseWriter, r *http.Request, p *Principal) error {
+	token, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	expires := s.Clock.Now().Add(SessionMaxAge)
+	err = s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "insert_session",
+			"INSERT INTO sessions (token_hash, subject, user_id, email, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			hashAPIKey(token), p.Subject, p.UserID, p.Email, pq.Array(p.Scopes), expires)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		// Lax (not Strict) so the session survives the redirect back from an identity
+		// provider; CSRFMiddleware covers state-changing requests.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionPrincipal resolves a session token. Unknown and expired sessions yield
+// (nil, nil): the cookie is ambient, so a stale one is treated like no credentials.
+func (s *Server) sessionPrincipal(ctx context.Context, token string) (*Principal, error) {
+	hash := hashAPIKey(token)
+	p := &Principal{Method: "session"}
+	var lastSeen time.Time
+	found := false
+	err := s.ExecuteWithRobustness(func() error {
+		err := dbQueryRow(ctx, s.DB, "validate_session",
+			"SELECT subject, user_id, email, scopes, last_seen_at FROM sessions WHERE token_hash = $1 AND expires_at > now() AND last_seen_at > now() - $2 * interval '1 second'",
+			hash, SessionIdleTimeout.Seconds()).Scan(&p.Subject, &p.UserID, &p.Email, pq.Array(&p.Scopes), &lastSeen)
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	if Tenancy.Enabled {
+		// A session stays in the tenant it was opened in, which qualifies its subject.
+		p.Tenant = subjectTenant(p.Subject)
+	}
+
+	if s.Clock.Now().Sub(lastSeen) > sessionTouchInterval {
+		if _, err := dbExec(ctx, s.DB, "touch_session", "UPDATE sessions SET last_seen_at = now() WHERE token_hash = $1", hash); err != nil {
+			slog.Warn("Failed to refresh session activity", "error", err)
+		}
+	}
+	return p, nil
+}
+
+// HandleLogin serves POST /auth/login: it exchanges the credentials on the request
+// (a bearer token or API key) for a browser session.
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok || p.Method == "session" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := s.CreateSession(r.Context(), w, r, p); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	slog.Info("Session started", "subject", p.Subject, "method", p.Method)
+	writeSession(w, p)
+}
+
+// HandleLogout serves POST /auth/logout: it ends the current session and clears the cookie.
+func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(SessionCookieName); err == nil && c.Value != "" {
+		err := s.ExecuteWithRobustness(func() error {
+			_, err := dbExec(r.Context(), s.DB, "delete_session", "DELETE FROM sessions WHERE token_hash = $1", hashAPIKey(c.Value))
+			return err
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if isHTMX(r) {
+		w.Header().Set("HX-Refresh", "true") // the server-rendered UI reloads signed out
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSession serves GET /auth/session: who the caller is, for the web UI.
+func HandleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeSession(w, p)
+}
+
+func writeSession(w http.ResponseWriter, p *Principal) {
+	w.Header().Set("Content-Type", "application/json")
+	session := map[string]any{
+		"subject": p.Subject,
+		"email":   p.Email,
+		"scopes":  p.Scopes,
+		"method":  p.Method,
+	}
+	if p.Tenant != "" {
+		session["tenant"] = p.Tenant
+	}
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		slog.Error("Failed to encode session", "error", err)
+	}
+}
+
+// StartSessionJanitor deletes expired sessions every interval until ctx is cancelled.
+func (s *Server) StartSessionJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "session_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			res, err := dbExec(ctx, s.DB, "purge_sessions",
+				"DELETE FROM sessions WHERE expires_at < now() OR last_seen_at < now() - $1 * interval '1 second'", SessionIdleTimeout.Seconds())
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge expired sessions", "error", err)
+				}
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				slog.Debug("Purged expired sessions", "count", n)
+			}
+		}
+	})
+}
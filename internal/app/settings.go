@@ -0,0 +1,257 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A user's settings are one document at /me/settings: the timezone of due dates, the
+// email reminders (also at /me/notifications), the default list and the UI
+// preferences. A user who never changed a setting gets the defaults.
+//
+//	GET   /me/settings
+//	PATCH /me/settings  {"ui": {"theme": "dark"}, "default_list_id": 3}; settings left out keep their value
+//
+// Unknown settings and values are rejected, so the document stays valid as it grows.
+
+// UserSettings are a user's settings, at /me/settings.
+type UserSettings struct {
+	// Timezone is an IANA name such as "Europe/Berlin"; "today" starts at midnight there.
+	Timezone      string                  `json:"timezone"`
+	Notifications NotificationPreferences `json:"notifications"`
+	// DefaultListID is the list clients offer for new todos; nil is the Inbox.
+	DefaultListID *int64        `json:"default_list_id"`
+	UI            UIPreferences `json:"ui"`
+}
+
+// UIPreferences are how the user wants the web UI.
+type UIPreferences struct {
+	Theme         string `json:"theme"`      // "system", "light" or "dark"
+	Density       string `json:"density"`    // "comfortable" or "compact"
+	WeekStart     string `json:"week_start"` // "monday" or "sunday"
+	Sort          string `json:"sort"`       // how todos are ordered: "id", "priority", "due_at" or "starred", as ?sort=
+	ShowCompleted bool   `json:"show_completed"`
+}
+
+// uiChoices are the values of the string UIPreferences, the default first.
+var uiChoices = map[string][]string{
+	"theme":      {"system", "light", "dark"},
+	"density":    {"comfortable", "compact"},
+	"week_start": {"monday", "sunday"},
+	"sort":       {"id", "priority", "due_at", "starred"},
+}
+
+// defaultUIPreferences are the UIPreferences of a user who has chosen none.
+func defaultUIPreferences() UIPreferences {
+	return UIPreferences{
+		Theme:         uiChoices["theme"][0],
+		Density:       uiChoices["density"][0],
+		WeekStart:     uiChoices["week_start"][0],
+		Sort:          uiChoices["sort"][0],
+		ShowCompleted: true,
+	}
+}
+
+// userSettingsPatch is the body of PATCH /me/settings.
+type userSettingsPatch struct {
+	Timezone      *string `json:"timezone"`
+	Notifications *struct {
+		Email            *string `json:"email"` // read-only, accepted so a GET can be sent back
+		EmailReminders   *bool   `json:"email_reminders"`
+		DueReminders     *bool   `json:"due_reminders"`
+		OverdueReminders *bool   `json:"overdue_reminders"`
+	} `json:"notifications"`
+	DefaultListID json.RawMessage `json:"default_list_id"` // null for the Inbox
+	// UI are the preferences to change; null resets one to its default.
+	UI map[string]json.RawMessage `json:"ui"`
+}
+
+// validateTimezone accepts IANA timezone names.
+func validateTimezone(name string) error {
+	if _, err := time.LoadLocation(name); err != nil || name == "" || name == "Local" {
+		return fmt.Errorf("unknown timezone %q: use an IANA name such as Europe/Berlin", name)
+	}
+	return nil
+}
+
+// uiPatch validates the UI preferences of a PATCH and returns the chosen ones as a
+// JSON object, and the ones to reset.
+func uiPatch(prefs map[string]json.RawMessage) (string, []string, error) {
+	set := map[string]any{}
+	reset := []string{} // not NULL, which would clear them all
+	for name, raw := range prefs {
+		if string(raw) == "null" {
+			if _, ok := uiChoices[name]; !ok && name != "show_completed" {
+				return "", nil, fmt.Errorf("unknown UI preference %q", name)
+			}
+			reset = append(reset, name)
+			continue
+		}
+		if name == "show_completed" {
+			var v bool
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return "", nil, errors.New("show_completed must be true or false")
+			}
+			set[name] = v
+			continue
+		}
+		choices, ok := uiChoices[name]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown UI preference %q", name)
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil || !slices.Contains(choices, v) {
+			return "", nil, fmt.Errorf("%s must be one of %s", name, strings.Join(choices, ", "))
+		}
+		set[name] = v
+	}
+	b, err := json.Marshal(set)
+	return string(b), reset, err
+}
+
+// patchUserSettingsQuery changes the settings of subject $1: the timezone $2 unless
+// NULL, the default list $4 if $3, and the UI preferences merged with $5 less the
+// names in $6.
+const patchUserSettingsQuery = `INSERT INTO user_settings (subject, timezone, default_list_id, ui)
+VALUES ($1, COALESCE($2, 'UTC'), $4::bigint, $5::jsonb - $6::text[])
+ON CONFLICT (subject) DO UPDATE SET
+	timezone = COALESCE($2, user_settings.timezone),
+	default_list_id = CASE WHEN $3 THEN $4::bigint ELSE user_settings.default_list_id END,
+	ui = (user_settings.ui || $5::jsonb) - $6::text[],
+	updated_at = now()`
+
+// getUserSettings returns the settings of subject, with the defaults for those they
+// have not set. A default list they are no longer a member of is left out.
+func (s *Server) getUserSettings(ctx context.Context, subject string) (UserSettings, error) {
+	var settings UserSettings
+	err := s.ExecuteWithRobustness(func() error {
+		var ui []byte
+		err := dbQueryRow(ctx, s.DB, "get_user_settings",
+			`SELECT COALESCE(s.timezone, 'UTC'),
+				(SELECT m.list_id FROM list_members m WHERE m.list_id = s.default_list_id AND m.user_id = $1),
+				COALESCE(s.ui, '{}'), COALESCE((SELECT email FROM users WHERE subject = $1), ''),
+				COALESCE(p.email_reminders, TRUE), COALESCE(p.due_reminders, TRUE), COALESCE(p.overdue_reminders, TRUE)
+			FROM (SELECT 1) one
+				LEFT JOIN user_settings s ON s.subject = $1
+				LEFT JOIN notification_preferences p ON p.subject = $1`,
+			subject).Scan(&settings.Timezone, &settings.DefaultListID, &ui, &settings.Notifications.Email,
+			&settings.Notifications.EmailReminders, &settings.Notifications.DueReminders, &settings.Notifications.OverdueReminders)
+		if err != nil {
+			return err
+		}
+		settings.UI = defaultUIPreferences()
+		return json.Unmarshal(ui, &settings.UI)
+	})
+	return settings, err
+}
+
+// HandleUserSettings serves GET and PATCH /me/settings. PUT is PATCH, for the clients
+// that set the timezone before the other settings were here.
+func (s *Server) HandleUserSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	if owner == anonymousOwner {
+		http.Error(w, "Sign in to manage settings", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch, http.MethodPut:
+		if !s.patchUserSettings(w, r, owner) {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := s.getUserSettings(ctx, owner)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		slog.Error("Failed to encode user settings", "error", err)
+	}
+}
+
+// patchUserSettings applies the PATCH in r's body to owner's settings, all or none
+// of it, and reports whether it did; if not, it has answered.
+func (s *Server) patchUserSettings(w http.ResponseWriter, r *http.Request, owner string) bool {
+	ctx := r.Context()
+	var p userSettingsPatch
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if p.Timezone != nil {
+		if err := validateTimezone(*p.Timezone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+	setList := len(p.DefaultListID) > 0
+	var listID *int64
+	if setList && string(p.DefaultListID) != "null" {
+		if err := json.Unmarshal(p.DefaultListID, &listID); err != nil {
+			http.Error(w, "default_list_id must be a list ID or null", http.StatusBadRequest)
+			return false
+		}
+		l, err := s.getList(ctx, *listID, owner)
+		if err != nil {
+			writeDBError(w, err)
+			return false
+		}
+		if (l.Role != RoleOwner && l.Role != RoleEditor) || l.Archived {
+			http.Error(w, "default_list_id must be a list you can add todos to", http.StatusBadRequest)
+			return false
+		}
+	}
+	uiSet, uiReset, err := uiPatch(p.UI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	err = s.ExecuteWithRobustness(func() error {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := dbExec(ctx, tx, "patch_user_settings", patchUserSettingsQuery,
+			owner, p.Timezone, setList, listID, uiSet, pq.Array(uiReset)); err != nil {
+			return err
+		}
+		if n := p.Notifications; n != nil {
+			if _, err := dbExec(ctx, tx, "put_notification_preferences", putNotificationPreferencesQuery,
+				owner, n.EmailReminders, n.DueReminders, n.OverdueReminders); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return false
+	}
+	slog.Info("Updated user settings", "owner", owner)
+	return true
+}
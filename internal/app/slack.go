@@ -0,0 +1,422 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	SlackNotifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "slack_notifications_total",
+			Help: "Total number of todos reported to Slack, by event and result",
+		},
+		[]string{"event", "result"}, // "created", "completed", "overdue"; "ok", "error"
+	)
+	SlackCommands = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "slack_commands_total",
+			Help: "Total number of /todo slash commands, by command and result",
+		},
+		[]string{"command", "result"}, // "add", "list", "done", "help"; "ok", "error", "rejected"
+	)
+)
+
+// SlackEvents are the events slack.notify may name.
+var SlackEvents = []string{"created", "completed", "overdue"}
+
+// SlackSigningSecret verifies slash command requests (slack.signing_secret). Empty
+// disables /integrations/slack/command.
+var SlackSigningSecret string
+
+const (
+	slackSignatureMaxAge = 5 * time.Minute
+	slackOverdueBatch    = 50
+	slackListLimit       = 20
+	slackTaskMaxLen      = 200
+)
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+// SlackNotifier posts todo events to a Slack incoming webhook: created and completed
+// todos as an outbox sink, overdue ones from StartOverdueNotifier.
+type SlackNotifier struct {
+	server     *Server
+	webhookURL string
+	events     map[string]bool
+}
+
+// NewSlackNotifier posts the named events (see SlackEvents) of the todos of s to
+// webhookURL.
+func NewSlackNotifier(s *Server, webhookURL string, events []string) *SlackNotifier {
+	n := &SlackNotifier{server: s, webhookURL: webhookURL, events: map[string]bool{}}
+	for _, e := range events {
+		n.events[e] = true
+	}
+	return n
+}
+
+func (n *SlackNotifier) Name() string { return "slack" }
+
+// Publish posts the created and completed todos in events as one message. An update
+// counts as completing a todo when it set completed_at, so editing a completed todo
+// or marking it completed again posts nothing. Posting is best effort: a failed post
+// is logged and counted, not returned, so a Slack outage never holds up webhooks and
+// event publishing.
+func (n *SlackNotifier) Publish(ctx context.Context, events []OutboxEvent) error {
+	var updated []int64
+	for _, ev := range events {
+		if ev.Type == "todo.updated" && n.events["completed"] && ev.Todo != nil && ev.Todo.Completed {
+			updated = append(updated, int64(ev.TodoID))
+		}
+	}
+	completedAt, err := n.server.loadCompletedAt(ctx, updated)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	counts := map[string]int{}
+	for _, ev := range events {
+		switch {
+		case ev.Type == "todo.created" && n.events["created"] && ev.Todo != nil:
+			lines = append(lines, slackLine(":new: New", *ev.Todo, ev.UserID))
+			counts["created"]++
+		case ev.Type == "todo.updated" && n.events["completed"] && ev.Todo != nil && completedAt[ev.TodoID].Equal(ev.OccurredAt):
+			lines = append(lines, slackLine(":white_check_mark: Completed", *ev.Todo, ev.UserID))
+			counts["completed"]++
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	result := "ok"
+	if err := n.post(ctx, strings.Join(lines, "\n")); err != nil {
+		slog.Warn("Failed to post todo events to Slack", "events", len(lines), "error", err)
+		result = "error"
+	}
+	for event, count := range counts {
+		SlackNotifications.WithLabelValues(event, result).Add(float64(count))
+	}
+	return nil
+}
+
+// loadCompletedAt returns when each of the given todos was completed, if it is.
+func (s *Server) loadCompletedAt(ctx context.Context, ids []int64) (map[int]time.Time, error) {
+	out := make(map[int]time.Time, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	err := withTenant(ctx, s.DB, systemTenant, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "slack_completed_at", "SELECT id, completed_at FROM todos WHERE id = ANY($1) AND completed_at IS NOT NULL", pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var at time.Time
+			if err := rows.Scan(&id, &at); err != nil {
+				return err
+			}
+			out[id] = at
+		}
+		return rows.Err()
+	})
+	return out, err
+}
+
+// StartOverdueNotifier reports the todos past their due date, every interval until ctx
+// is cancelled.
+func (n *SlackNotifier) StartOverdueNotifier(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "slack_overdue_notifier", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var err error
+			for !w.Stopping() {
+				var count int
+				count, err = n.NotifyOverdue(ctx)
+				if err != nil && ctx.Err() == nil {
+					slog.Warn("Failed to report overdue todos to Slack", "error", err)
+				}
+				if err != nil || count < slackOverdueBatch {
+					break
+				}
+			}
+			w.Checkpoint(err)
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// NotifyOverdue posts up to one batch of the todos past their due date that were not
+// reported yet, and returns how many it posted. Every replica may run it: a
+// todo is claimed by its row in slack_overdue_notices, which is removed again when
+// the post fails, so the next run retries.
+func (n *SlackNotifier) NotifyOverdue(ctx context.Context) (int, error) {
+	var todos []Todo
+	var owners []string
+	err := n.server.ExecuteWithRobustness(func() error {
+		todos, owners = todos[:0], owners[:0] // Reset on retry
+		return withTenant(ctx, n.server.DB, systemTenant, func(q dbtx) error {
+			rows, err := dbQuery(ctx, q, "claim_overdue_todos",
+				`WITH claimed AS (
+					INSERT INTO slack_overdue_notices (todo_id)
+					SELECT t.id FROM todos t
+					WHERE NOT t.completed AND t.due_at < now()
+						AND NOT EXISTS (SELECT 1 FROM slack_overdue_notices n WHERE n.todo_id = t.id)
+					ORDER BY t.id LIMIT $1
+					ON CONFLICT DO NOTHING
+					RETURNING todo_id
+				)
+				SELECT t.id, t.task, t.completed, t.list_id, t.due_at, t.user_id
+				FROM todos t JOIN claimed c ON c.todo_id = t.id ORDER BY t.id`,
+				slackOverdueBatch)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var t Todo
+				var owner sql.NullString
+				if err := rows.Scan(&t.ID, &t.Task, &t.Completed, &t.ListID, &t.DueAt, &owner); err != nil {
+					return err
+				}
+				todos, owners = append(todos, t), append(owners, owner.String)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil || len(todos) == 0 {
+		return 0, err
+	}
+
+	if err = n.server.decryptTodos(ctx, todos); err == nil {
+		lines := make([]string, len(todos))
+		for i, t := range todos {
+			lines[i] = slackLine(":alarm_clock: Overdue", t, owners[i]) + ", due " + t.DueAt.UTC().Format("2006-01-02 15:04 MST")
+		}
+		err = n.post(ctx, strings.Join(lines, "\n"))
+	}
+	if err != nil {
+		SlackNotifications.WithLabelValues("overdue", "error").Add(float64(len(todos)))
+		ids := make([]int64, len(todos))
+		for i, t := range todos {
+			ids[i] = int64(t.ID)
+		}
+		if _, relErr := dbExec(context.WithoutCancel(ctx), n.server.DB, "release_overdue_todos", "DELETE FROM slack_overdue_notices WHERE todo_id = ANY($1)", pq.Array(ids)); relErr != nil {
+			slog.Error("Failed to release overdue todos, they will not be reported", "todos", len(ids), "error", relErr)
+		}
+		return 0, err
+	}
+	SlackNotifications.WithLabelValues("overdue", "ok").Add(float64(len(todos)))
+	return len(todos), nil
+}
+
+// post sends text to the incoming webhook.
+func (n *SlackNotifier) post(ctx context.Context, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// slackLine describes a todo in one line of mrkdwn.
+func slackLine(prefix string, t Todo, owner string) string {
+	where := owner
+	if t.ListID != nil {
+		where = "list " + strconv.FormatInt(*t.ListID, 10)
+	}
+	return fmt.Sprintf("%s #%d: %s (%s)", prefix, t.ID, slackEscape(t.Task), slackEscape(where))
+}
+
+// slackEscape escapes the characters Slack treats as markup and shortens long tasks.
+func slackEscape(s string) string {
+	if r := []rune(s); len(r) > slackTaskMaxLen {
+		s = string(r[:slackTaskMaxLen]) + "…"
+	}
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// HandleSlackCommand serves the /todo slash command at /integrations/slack/command.
+// Requests are authenticated by their Slack signature instead of credentials and act
+// as the Slack user, subject slack:<team_id>:<user_id>; share a list with that subject
+// to see the todos elsewhere. Replies are only shown to the user who typed the command.
+func (s *Server) HandleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	if SlackSigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !verifySlackSignature(SlackSigningSecret, r.Header, body, s.Clock.Now()) {
+		SlackCommands.WithLabelValues("none", "rejected").Inc()
+		slog.Warn("Rejected Slack command with an invalid signature", "request_id", RequestIDFromContext(r.Context()))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("team_id") == "" || form.Get("user_id") == "" {
+		http.Error(w, "Invalid slash command payload", http.StatusBadRequest)
+		return
+	}
+
+	owner := "slack:" + form.Get("team_id") + ":" + form.Get("user_id")
+	command, reply, err := s.runSlackCommand(r.Context(), owner, form.Get("text"))
+	result := "ok"
+	if err != nil {
+		result, reply = "error", err.Error()
+	}
+	SlackCommands.WithLabelValues(command, result).Inc()
+	// Slack shows anything but a 200 as a failed command, so errors are replies too.
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"response_type": "ephemeral", "text": reply})
+}
+
+const slackHelp = "Usage: `/todo <task>` or `/todo add <task>` adds a todo, `/todo list` shows your open todos, `/todo done <id>` completes one."
+
+// runSlackCommand runs the command in text as owner and returns its name and reply.
+func (s *Server) runSlackCommand(ctx context.Context, owner, text string) (string, string, error) {
+	word, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(word) {
+	case "", "help":
+		return "help", slackHelp, nil
+	case "list":
+		todos, err := s.listTodos(ctx, owner)
+		if err != nil {
+			return "list", "", slackTodoError(err)
+		}
+		var lines []string
+		open := 0
+		for _, t := range todos {
+			if t.Completed {
+				continue
+			}
+			if open++; open <= slackListLimit {
+				lines = append(lines, fmt.Sprintf("#%d %s", t.ID, slackEscape(t.Task)))
+			}
+		}
+		switch {
+		case open == 0:
+			return "list", "No open todos.", nil
+		case open > slackListLimit:
+			lines = append(lines, fmt.Sprintf("…and %d more", open-slackListLimit))
+		}
+		return "list", strings.Join(lines, "\n"), nil
+	case "done":
+		id, err := strconv.Atoi(strings.TrimPrefix(rest, "#"))
+		if err != nil {
+			return "done", "", errors.New("Usage: `/todo done <id>`")
+		}
+		found, err := s.Todos.SetCompleted(ctx, owner, id, true)
+		switch {
+		case errors.Is(err, errTodoBlocked):
+			return "done", "", fmt.Errorf("Todo #%d is blocked by open todos.", id)
+		case err != nil:
+			return "done", "", slackTodoError(err)
+		case !found:
+			return "done", "", fmt.Errorf("Todo #%d not found.", id)
+		}
+		return "done", fmt.Sprintf("Completed #%d.", id), nil
+	case "add":
+		text = rest
+	}
+	task := strings.TrimSpace(text)
+	if task == "" {
+		return "add", "", errors.New("Usage: `/todo add <task>`")
+	}
+	if err := checkText("task", task); err != nil {
+		return "add", "", errors.New("The task must be plain text.")
+	}
+	t, err := s.Todos.Create(ctx, owner, task, nil)
+	if err != nil {
+		return "add", "", slackTodoError(err)
+	}
+	return "add", fmt.Sprintf("Added #%d: %s", t.ID, slackEscape(t.Task)), nil
+}
+
+// slackTodoError maps a todo store error to a reply, without internal details.
+func slackTodoError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("Timed out, please try again.")
+	}
+	slog.Error("Slack command failed", "error", err)
+	return errors.New("The todo service is unavailable, please try again later.")
+}
+
+// verifySlackSignature checks the X-Slack-Signature of a request: v0= and the hex
+// HMAC-SHA256 of "v0:<timestamp>:<body>" under the signing secret, with a timestamp
+// at most five minutes from now so captured requests cannot be replayed later.
+func verifySlackSignature(secret string, h http.Header, body []byte, now time.Time) bool {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > slackSignatureMaxAge || d < -slackSignatureMaxAge {
+		return false
+	}
+	sig, ok := strings.CutPrefix(h.Get("X-Slack-Signature"), "v0=")
+	if !ok {
+		return false
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte("v0:" + ts + ":"))
+	m.Write(body)
+	return hmac.Equal(m.Sum(nil), want)
+}
@@ -0,0 +1,74 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Starring pins a todo:
+//
+//	PUT    /todos/{id}/star  stars the todo
+//	DELETE /todos/{id}/star  unstars it
+//
+// A star is on the todo, so everyone who can see it sees it starred. The todo lists
+// take ?starred=true for only the starred todos, and ?sort=starred to put them first;
+// users keep that order in their ui.sort setting.
+
+// setTodoStarredQuery stars ($1) or unstars todo $2 if $3 may change it, and says
+// whether they could.
+var setTodoStarredQuery = `WITH target AS (
+	SELECT id FROM todos WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 3) + `
+), starred AS (
+	UPDATE todos SET starred = $1 WHERE id IN (SELECT id FROM target)
+)
+SELECT EXISTS (SELECT 1 FROM target)`
+
+// setTodoStarred stars or unstars todo id and reports whether owner could change it.
+func (s *Server) setTodoStarred(ctx context.Context, owner string, id int, starred bool) (bool, error) {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "set_todo_starred", setTodoStarredQuery, starred, id, owner).Scan(&found)
+		})
+	})
+	return found, err
+}
+
+// HandleTodoStar serves PUT and DELETE /todos/{id}/star and answers with the todo.
+func (s *Server) HandleTodoStar(w http.ResponseWriter, r *http.Request, id int) {
+	var starred bool
+	switch r.Method {
+	case http.MethodPut:
+		starred = true
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	found, err := s.setTodoStarred(ctx, owner, id, starred)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Set todo starred", "id", id, "starred", starred)
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
@@ -0,0 +1,273 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// Aggregates over the todos a user can see (GET /stats, GET /tags) scan all of them,
+// however many there are. With Aggregates.Refresh set (cache.aggregate_refresh) they
+// are answered from snapshots in each replica's memory instead, which a background
+// refresher recomputes every Refresh for the users who read them lately. A snapshot
+// older than MaxStaleness, because the refresher is failing or behind, is not served:
+// the request computes it afresh, as the first request of a user does.
+//
+// Snapshots are not dropped on writes, so a user can wait up to Refresh to see their
+// own write in them; responses carry an Age header saying how old they are.
+var Aggregates = struct {
+	Refresh      time.Duration
+	MaxStaleness time.Duration
+}{MaxStaleness: 2 * time.Minute}
+
+var (
+	AggregateSnapshotRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aggregate_snapshot_requests_total",
+			Help: "Total number of aggregate reads looked up in the snapshots",
+		},
+		[]string{"kind", "result"}, // kind: "stats" or "tags"; result: "hit", "miss" or "stale"
+	)
+	AggregateSnapshotRefreshes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aggregate_snapshot_refreshes_total",
+			Help: "Total number of snapshots recomputed by the background refresher",
+		},
+		[]string{"kind", "result"}, // result: "ok" or "error"
+	)
+	AggregateSnapshots = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "aggregate_snapshots",
+			Help: "Number of aggregate snapshots held in memory",
+		},
+	)
+)
+
+const (
+	// aggregateIdleRefreshes is how many refreshes a snapshot nobody reads is kept for.
+	aggregateIdleRefreshes = 10
+	// aggregateRefreshers is how many snapshots are recomputed at once.
+	aggregateRefreshers = 4
+)
+
+type aggregateSnapshot struct {
+	kind, owner string
+	compute     func(ctx context.Context) (any, error)
+	value       any
+	at          time.Time // when value was computed
+	readAt      time.Time
+}
+
+var aggregates = struct {
+	group singleflight.Group
+	mu    sync.Mutex
+	m     map[string]*aggregateSnapshot // by kind and owner
+}{m: make(map[string]*aggregateSnapshot)}
+
+// aggregate returns the snapshot of kind for owner, or computes it and keeps it for
+// the refresher, with the time it was computed at by clock.
+func aggregate[T any](ctx context.Context, clock Clock, kind, owner string, compute func(ctx context.Context) (T, error)) (T, time.Time, error) {
+	if Aggregates.Refresh <= 0 {
+		v, err := compute(ctx)
+		return v, clock.Now(), err
+	}
+	key := kind + "\x00" + owner
+	now := clock.Now()
+	result := "miss"
+	aggregates.mu.Lock()
+	if s := aggregates.m[key]; s != nil {
+		s.readAt = now
+		if now.Sub(s.at) <= Aggregates.MaxStaleness {
+			v, at := s.value.(T), s.at
+			aggregates.mu.Unlock()
+			AggregateSnapshotRequests.WithLabelValues(kind, "hit").Inc()
+			return v, at, nil
+		}
+		result = "stale"
+	}
+	aggregates.mu.Unlock()
+	AggregateSnapshotRequests.WithLabelValues(kind, result).Inc()
+
+	// The refresher may update the snapshot as soon as it is in the map, so the waiters
+	// get the value and time as computed here rather than reading the snapshot.
+	type computed struct {
+		value T
+		at    time.Time
+	}
+	v, err, _ := aggregates.group.Do(key, func() (any, error) {
+		at := clock.Now()
+		// Waiters share the computation, so it must not end with the request that started it.
+		v, err := compute(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, err
+		}
+		s := &aggregateSnapshot{kind: kind, owner: owner, value: v, at: at, readAt: now,
+			compute: func(ctx context.Context) (any, error) { return compute(ctx) }}
+		aggregates.mu.Lock()
+		aggregates.m[key] = s
+		AggregateSnapshots.Set(float64(len(aggregates.m)))
+		aggregates.mu.Unlock()
+		return computed{v, at}, nil
+	})
+	if err != nil {
+		var zero T
+		return zero, time.Time{}, err
+	}
+	c := v.(computed)
+	return c.value, c.at, nil
+}
+
+// refreshAggregates recomputes the snapshots read in the last aggregateIdleRefreshes
+// refreshes and drops the others. A snapshot that fails to refresh keeps its value.
+func refreshAggregates(ctx context.Context, clock Clock) {
+	idle := clock.Now().Add(-aggregateIdleRefreshes * Aggregates.Refresh)
+	var live []*aggregateSnapshot
+	aggregates.mu.Lock()
+	for key, s := range aggregates.m {
+		if s.readAt.Before(idle) {
+			delete(aggregates.m, key)
+		} else {
+			live = append(live, s)
+		}
+	}
+	AggregateSnapshots.Set(float64(len(aggregates.m)))
+	aggregates.mu.Unlock()
+
+	var g errgroup.Group
+	g.SetLimit(aggregateRefreshers)
+	for _, s := range live {
+		g.Go(func() error {
+			rctx, cancel := context.WithTimeout(ctx, Aggregates.Refresh)
+			defer cancel()
+			at := clock.Now()
+			v, err := s.compute(rctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to refresh aggregate snapshot", "kind", s.kind, "owner", s.owner, "error", err)
+				}
+				AggregateSnapshotRefreshes.WithLabelValues(s.kind, "error").Inc()
+				return nil
+			}
+			aggregates.mu.Lock()
+			s.value, s.at = v, at
+			aggregates.mu.Unlock()
+			AggregateSnapshotRefreshes.WithLabelValues(s.kind, "ok").Inc()
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+// StartAggregateRefresher refreshes the aggregate snapshots every Aggregates.Refresh
+// until ctx is cancelled. Without Aggregates.Refresh it does nothing.
+func (s *Server) StartAggregateRefresher(ctx context.Context) {
+	if Aggregates.Refresh <= 0 {
+		return
+	}
+	Workers.Go(ctx, "aggregate_refresher", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(Aggregates.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+				refreshAggregates(ctx, s.Clock)
+				w.Checkpoint(nil)
+			}
+		}
+	})
+}
+
+// setAge sets the Age header, as of now, of an aggregate computed at at.
+func setAge(w http.ResponseWriter, at, now time.Time) {
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(at).Seconds())))
+}
+
+// TodoStats sums up the todos the caller can see, at /stats. Archived todos are left
+// out.
+type TodoStats struct {
+	Total              int            `json:"total"`
+	Open               int            `json:"open"`
+	Completed          int            `json:"completed"`
+	Overdue            int            `json:"overdue"`               // open and past their due date
+	CompletedLast7Days int            `json:"completed_last_7_days"` // by completed_at
+	OpenByPriority     map[string]int `json:"open_by_priority"`
+	AsOf               time.Time      `json:"as_of"` // when the numbers were computed
+}
+
+const todoStatsQuery = `SELECT priority,
+	count(*),
+	count(*) FILTER (WHERE NOT COALESCE(completed, FALSE)),
+	count(*) FILTER (WHERE NOT COALESCE(completed, FALSE) AND due_at < now()),
+	count(*) FILTER (WHERE completed AND completed_at > now() - interval '7 days')
+FROM todos
+WHERE ` + todoVisibleTo + ` AND NOT archived
+GROUP BY priority`
+
+// todoStats computes the stats of the todos owner can see, on the replica.
+func (s *Server) todoStats(ctx context.Context, owner string) (TodoStats, error) {
+	var stats TodoStats
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "todo_stats", todoStatsQuery, owner)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		stats = TodoStats{OpenByPriority: make(map[string]int, len(Priorities))} // Reset on retry
+		for _, p := range Priorities {
+			stats.OpenByPriority[p] = 0
+		}
+		for rows.Next() {
+			var priority string
+			var total, open, overdue, completedRecently int
+			if err := rows.Scan(&priority, &total, &open, &overdue, &completedRecently); err != nil {
+				return err
+			}
+			stats.Total += total
+			stats.Open += open
+			stats.Completed += total - open
+			stats.Overdue += overdue
+			stats.CompletedLast7Days += completedRecently
+			stats.OpenByPriority[priority] = open
+		}
+		return rows.Err()
+	})
+	return stats, err
+}
+
+// HandleStats serves GET /stats: how many todos the caller has, open, completed and
+// overdue.
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := TodoOwner(r.Context())
+	stats, at, err := aggregate(r.Context(), s.Clock, "stats", owner, func(ctx context.Context) (TodoStats, error) {
+		return s.todoStats(ctx, owner)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	stats.AsOf = at.UTC()
+	setAge(w, at, s.Clock.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.Error("Failed to encode stats", "error", err)
+	}
+}
@@ -0,0 +1,354 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.30.0
+// source: lists.sql
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const deleteList = `-- name: DeleteList :exec
+DELETE FROM todo_lists WHERE id = $1
+`
+
+// DeleteList deletes list @id, and with it its todos and members.
+func (q *Queries) DeleteList(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, deleteList, id)
+	return err
+}
+
+const deleteListMember = `-- name: DeleteListMember :execrows
+DELETE FROM list_members WHERE list_id = $1 AND user_id = $2 AND role <> 'owner'
+`
+
+type DeleteListMemberParams struct {
+	ListID int64
+	UserID string
+}
+
+// DeleteListMember removes @user_id from list @list_id unless they own it.
+func (q *Queries) DeleteListMember(ctx context.Context, arg DeleteListMemberParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteListMember, arg.ListID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getList = `-- name: GetList :one
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE l.id = $1 AND m.user_id = $2
+`
+
+type GetListParams struct {
+	ID     int64
+	UserID string
+}
+
+type GetListRow struct {
+	ID        int64
+	Name      string
+	Owner     string
+	Role      string
+	Color     string
+	Archived  bool
+	CreatedAt time.Time
+}
+
+// GetList returns list @id with @user_id's role on it, if they are a member. The
+// columns are in the order of the fields of TodoList, which the row converts to.
+func (q *Queries) GetList(ctx context.Context, arg GetListParams) (GetListRow, error) {
+	row := q.db.QueryRowContext(ctx, getList, arg.ID, arg.UserID)
+	var i GetListRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Owner,
+		&i.Role,
+		&i.Color,
+		&i.Archived,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getListRole = `-- name: GetListRole :one
+SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2
+`
+
+type GetListRoleParams struct {
+	ListID int64
+	UserID string
+}
+
+// GetListRole returns @user_id's role on list @list_id.
+func (q *Queries) GetListRole(ctx context.Context, arg GetListRoleParams) (string, error) {
+	row := q.db.QueryRowContext(ctx, getListRole, arg.ListID, arg.UserID)
+	var role string
+	err := row.Scan(&role)
+	return role, err
+}
+
+const insertList = `-- name: InsertList :one
+WITH l AS (
+    INSERT INTO todo_lists (name, owner_id, color) VALUES ($1::text, $2::text, NULLIF($3::text, ''))
+    RETURNING id, created_at
+), m AS (
+    INSERT INTO list_members (list_id, user_id, role, added_by) SELECT id, $2::text, 'owner', $2::text FROM l
+)
+SELECT id, created_at FROM l
+`
+
+type InsertListParams struct {
+	Name  string
+	Owner string
+	Color string
+}
+
+type InsertListRow struct {
+	ID        int64
+	CreatedAt time.Time
+}
+
+// InsertList creates a list and the membership of its owner in one statement, so a
+// list can never exist without someone able to manage it. A @color of ” is none.
+func (q *Queries) InsertList(ctx context.Context, arg InsertListParams) (InsertListRow, error) {
+	row := q.db.QueryRowContext(ctx, insertList, arg.Name, arg.Owner, arg.Color)
+	var i InsertListRow
+	err := row.Scan(&i.ID, &i.CreatedAt)
+	return i, err
+}
+
+const listLists = `-- name: ListLists :many
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE m.user_id = $1
+ORDER BY l.id
+`
+
+type ListListsRow struct {
+	ID        int64
+	Name      string
+	Owner     string
+	Role      string
+	Color     string
+	Archived  bool
+	CreatedAt time.Time
+}
+
+// ListLists returns the lists @user_id is a member of, with their role on each, like
+// GetList.
+func (q *Queries) ListLists(ctx context.Context, userID string) ([]ListListsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listLists, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListListsRow
+	for rows.Next() {
+		var i ListListsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Owner,
+			&i.Role,
+			&i.Color,
+			&i.Archived,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMembers = `-- name: ListMembers :many
+SELECT user_id, role, added_by, added_at FROM list_members WHERE list_id = $1 ORDER BY added_at
+`
+
+type ListMembersRow struct {
+	UserID  string
+	Role    string
+	AddedBy string
+	AddedAt time.Time
+}
+
+// ListMembers returns the members of list @list_id, by when they were added. The
+// columns are in the order of the fields of ListMember, which the rows convert to.
+func (q *Queries) ListMembers(ctx context.Context, listID int64) ([]ListMembersRow, error) {
+	rows, err := q.db.QueryContext(ctx, listMembers, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMembersRow
+	for rows.Next() {
+		var i ListMembersRow
+		if err := rows.Scan(
+			&i.UserID,
+			&i.Role,
+			&i.AddedBy,
+			&i.AddedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listsByID = `-- name: ListsByID :many
+SELECT l.id, l.name, l.owner_id AS owner, m.role, COALESCE(l.color, '')::text AS color, l.archived, l.created_at
+FROM todo_lists l JOIN list_members m ON m.list_id = l.id
+WHERE m.user_id = $1 AND l.id = ANY($2::bigint[])
+`
+
+type ListsByIDParams struct {
+	UserID string
+	Ids    []int64
+}
+
+type ListsByIDRow struct {
+	ID        int64
+	Name      string
+	Owner     string
+	Role      string
+	Color     string
+	Archived  bool
+	CreatedAt time.Time
+}
+
+// ListsByID returns those of lists @ids that @user_id is a member of, like GetList.
+func (q *Queries) ListsByID(ctx context.Context, arg ListsByIDParams) ([]ListsByIDRow, error) {
+	rows, err := q.db.QueryContext(ctx, listsByID, arg.UserID, pq.Array(arg.Ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListsByIDRow
+	for rows.Next() {
+		var i ListsByIDRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Owner,
+			&i.Role,
+			&i.Color,
+			&i.Archived,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const memberLists = `-- name: MemberLists :many
+SELECT list_id FROM list_members WHERE user_id = $1 AND list_id = ANY($2::bigint[])
+`
+
+type MemberListsParams struct {
+	UserID  string
+	ListIds []int64
+}
+
+// MemberLists returns those of @list_ids that @user_id is a member of.
+func (q *Queries) MemberLists(ctx context.Context, arg MemberListsParams) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, memberLists, arg.UserID, pq.Array(arg.ListIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var list_id int64
+		if err := rows.Scan(&list_id); err != nil {
+			return nil, err
+		}
+		items = append(items, list_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const updateList = `-- name: UpdateList :exec
+UPDATE todo_lists SET name = $1, color = NULLIF($2::text, ''), archived = $3
+WHERE id = $4
+`
+
+type UpdateListParams struct {
+	Name     string
+	Color    string
+	Archived bool
+	ID       int64
+}
+
+// UpdateList sets the name, color (” for none) and archived flag of list @id.
+func (q *Queries) UpdateList(ctx context.Context, arg UpdateListParams) error {
+	_, err := q.db.ExecContext(ctx, updateList,
+		arg.Name,
+		arg.Color,
+		arg.Archived,
+		arg.ID,
+	)
+	return err
+}
+
+const upsertListMember = `-- name: UpsertListMember :one
+INSERT INTO list_members (list_id, user_id, role, added_by) VALUES ($1, $2, $3, $4)
+ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role
+WHERE list_members.role <> 'owner'
+RETURNING added_at
+`
+
+type UpsertListMemberParams struct {
+	ListID  int64
+	UserID  string
+	Role    string
+	AddedBy string
+}
+
+// UpsertListMember adds @user_id to list @list_id, or changes their role if they are
+// a member already; the owner's role is fixed, and changing it returns no row.
+func (q *Queries) UpsertListMember(ctx context.Context, arg UpsertListMemberParams) (time.Time, error) {
+	row := q.db.QueryRowContext(ctx, upsertListMember,
+		arg.ListID,
+		arg.UserID,
+		arg.Role,
+		arg.AddedBy,
+	)
+	var added_at time.Time
+	err := row.Scan(&added_at)
+	return added_at, err
+}
@@ -0,0 +1,223 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Todos nest: a todo with a parent_id is a subtask, on the same list as its parent.
+//
+//	PUT    /todos/{id}/parent  {"parent_id": 3}  nests or re-parents the todo, with its subtasks
+//	DELETE /todos/{id}/parent                    makes it a top-level todo again
+//	GET    /todos/{id}/subtree                   the todo with its subtasks, nested
+//
+// A parent is completed exactly when all its subtasks are; the database rolls the
+// state up the tree (migration 0023).
+
+// MaxTodoDepth is how many levels of subtasks a top-level todo can have.
+const MaxTodoDepth = 4
+
+var (
+	errParentNotFound = errors.New("parent todo not found or not on the same list")
+	errParentCycle    = errors.New("a todo cannot be nested under itself or its subtasks")
+	errTooDeep        = fmt.Errorf("subtasks can only be nested %d levels deep", MaxTodoDepth)
+)
+
+// TodoTree is a todo with its subtasks, at /todos/{id}/subtree.
+type TodoTree struct {
+	Todo
+	Subtasks []*TodoTree `json:"subtasks"`
+}
+
+// setTodoParentQuery moves todo $1 under $2 (or to the top level, if NULL) and says
+// why it did not. Walks are bounded by the depth limit so they end even if the tree
+// were ever corrupted. The parent must be writable by the caller and on the same
+// list; $2 being in the moved subtree would be a cycle; the deepest moved subtask
+// ends up len(up) + height levels down.
+var setTodoParentQuery = `WITH RECURSIVE sub AS (
+	SELECT id, 0 AS depth FROM todos WHERE id = $1
+	UNION ALL
+	SELECT c.id, sub.depth + 1 FROM todos c JOIN sub ON c.parent_id = sub.id WHERE sub.depth <= $4
+), up AS (
+	SELECT id, parent_id, 1 AS depth FROM todos WHERE id = $2
+	UNION ALL
+	SELECT p.id, p.parent_id, up.depth + 1 FROM todos p JOIN up ON p.id = up.parent_id WHERE up.depth <= $4
+), checked AS (
+	SELECT
+		EXISTS (SELECT 1 FROM todos WHERE id = $1 AND ` + fmt.Sprintf(todoWritableBy, 3) + `) AS found,
+		$2::int IS NULL OR EXISTS (
+			SELECT 1 FROM todos c, todos p WHERE c.id = $1 AND p.id = $2
+				AND p.list_id IS NOT DISTINCT FROM c.list_id
+				AND (p.list_id IS NOT NULL OR p.user_id = $3)) AS parent_ok,
+		EXISTS (SELECT 1 FROM sub WHERE id = $2) AS cycle,
+		COALESCE((SELECT max(depth) FROM up), 0) + (SELECT COALESCE(max(depth), 0) FROM sub) AS depth
+), moved AS (
+	UPDATE todos SET parent_id = $2
+	FROM checked
+	WHERE todos.id = $1 AND checked.found AND checked.parent_ok AND NOT checked.cycle AND checked.depth <= $4
+	RETURNING todos.id
+)
+SELECT found, parent_ok, cycle, depth FROM checked`
+
+// setTodoParent nests todo id under parent, or makes it top-level with a nil parent,
+// and reports whether owner could change it. A parent that cannot be used is one of
+// the errParent errors or errTooDeep.
+func (s *Server) setTodoParent(ctx context.Context, owner string, id int, parent *int) (bool, error) {
+	var found, parentOK, cycle bool
+	var depth int
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "set_todo_parent", setTodoParentQuery, id, parent, owner, MaxTodoDepth).
+				Scan(&found, &parentOK, &cycle, &depth)
+		})
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case !found:
+		return false, nil
+	case !parentOK:
+		return true, errParentNotFound
+	case cycle:
+		return true, errParentCycle
+	case depth > MaxTodoDepth:
+		return true, errTooDeep
+	}
+	return true, nil
+}
+
+// subtreeQuery collects todo $2 and its subtasks with one recursive walk, bounded by
+// the depth limit.
+const subtreeQuery = `WITH RECURSIVE tree AS (
+	SELECT id, 0 AS depth FROM todos WHERE id = $2
+	UNION ALL
+	SELECT c.id, tree.depth + 1 FROM todos c JOIN tree ON c.parent_id = tree.id WHERE tree.depth < $3
+)
+SELECT ` + todoColumns + ` FROM todos WHERE id IN (SELECT id FROM tree) AND ` + todoVisibleTo + ` ORDER BY id`
+
+// getTodoSubtree returns todo id with its subtasks if owner can see it, or
+// sql.ErrNoRows. fromPrimary skips the replica, as for getTodo.
+func (s *Server) getTodoSubtree(ctx context.Context, owner string, id int, fromPrimary bool) (*TodoTree, error) {
+	var todos []Todo
+	get := func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "get_todo_subtree", subtreeQuery, owner, id, MaxTodoDepth)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		todos = []Todo{} // Reset on retry
+		for rows.Next() {
+			var t Todo
+			if err := scanTodo(rows, &t); err != nil {
+				return err
+			}
+			todos = append(todos, t)
+		}
+		return rows.Err()
+	}
+	var err error
+	if fromPrimary {
+		err = s.ExecuteWithRobustness(func() error { return withTenant(ctx, s.DB, owner, get) })
+	} else {
+		err = s.withReplica(ctx, owner, get)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[int]*TodoTree, len(todos))
+	for _, t := range todos {
+		nodes[t.ID] = &TodoTree{Todo: t, Subtasks: []*TodoTree{}}
+	}
+	for _, t := range todos { // by id, so subtasks are in creation order
+		if t.ParentID == nil || t.ID == id {
+			continue
+		}
+		if parent, ok := nodes[*t.ParentID]; ok {
+			parent.Subtasks = append(parent.Subtasks, nodes[t.ID])
+		}
+	}
+	root, ok := nodes[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return root, nil
+}
+
+// HandleTodoParent serves PUT and DELETE /todos/{id}/parent and answers with the todo.
+func (s *Server) HandleTodoParent(w http.ResponseWriter, r *http.Request, id int) {
+	var parent *int
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			ParentID *int `json:"parent_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parent = req.ParentID
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	found, err := s.setTodoParent(ctx, owner, id, parent)
+	switch {
+	case errors.Is(err, errParentNotFound):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errParentCycle), errors.Is(err, errTooDeep):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		writeDBError(w, err)
+		return
+	case !found:
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	t, err := s.Todos.Get(ctx, owner, id, true)
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	writeTodoResponse(w, r, http.StatusOK, t)
+}
+
+// HandleTodoSubtree serves GET /todos/{id}/subtree.
+func (s *Server) HandleTodoSubtree(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tree, err := s.getTodoSubtree(r.Context(), TodoOwner(r.Context()), id, false)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tree); err != nil {
+		slog.Error("Failed to encode todo subtree", "error", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+// A model can propose how to break a todo down, behind the suggest_subtasks feature
+// flag:
+//
+//	POST /todos/{id}/suggest-subtasks  answers with proposed subtasks and tags
+//
+// Nothing is changed: the client creates the subtasks it keeps with POST /todos and
+// PUT /todos/{id}/parent. Suggestions for the same task text and tags are reused for
+// SuggestionCacheTTL, so asking again costs no model call.
+
+// SuggestSubtasksFeature is the feature flag that turns POST /todos/{id}/suggest-subtasks on.
+const SuggestSubtasksFeature = "suggest_subtasks"
+
+var SuggestionRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "subtask_suggestions_total",
+		Help: "Total number of subtask suggestion requests by result",
+	},
+	[]string{"result"}, // "hit", "generated", "timeout", "error"
+)
+
+// SubtaskSuggester proposes how to break a todo down.
+type SubtaskSuggester interface {
+	// SuggestSubtasks proposes subtasks and tags for task, which already has tags.
+	SuggestSubtasks(ctx context.Context, task string, tags []string) (Suggestion, error)
+}
+
+// Suggestion is what a SubtaskSuggester proposes.
+type Suggestion struct {
+	Subtasks []string `json:"subtasks"`
+	Tags     []string `json:"tags"`
+}
+
+// NoSuggestions is the SubtaskSuggester of environments without a model: it proposes
+// nothing.
+type NoSuggestions struct{}
+
+func (NoSuggestions) SuggestSubtasks(context.Context, string, []string) (Suggestion, error) {
+	return Suggestion{Subtasks: []string{}, Tags: []string{}}, nil
+}
+
+// Suggestion settings (suggestions.*).
+var (
+	Suggester          SubtaskSuggester = NoSuggestions{}
+	SuggestionTimeout                   = 15 * time.Second
+	SuggestionCacheTTL                  = time.Hour
+)
+
+const (
+	maxSuggestedSubtasks = 10
+	maxSuggestedTask     = 200 // runes
+	maxCachedSuggestions = 1000
+)
+
+// SubtaskSuggestions is the answer of POST /todos/{id}/suggest-subtasks.
+type SubtaskSuggestions struct {
+	TodoID int `json:"todo_id"`
+	Suggestion
+	Cached bool `json:"cached"` // reused from an earlier request
+}
+
+type cachedSuggestion struct {
+	Suggestion
+	at time.Time
+}
+
+var (
+	suggestionMu    sync.Mutex
+	suggestionCache = map[string]cachedSuggestion{}
+	suggestionGroup singleflight.Group
+)
+
+// suggest returns the suggestion for task with tags, from the cache if it is there
+// and fresh at now, and whether it was.
+func suggest(ctx context.Context, now time.Time, task string, tags []string) (Suggestion, bool, error) {
+	sum := sha256.Sum256([]byte(task + "\x00" + strings.Join(tags, ",")))
+	key := hex.EncodeToString(sum[:])
+	suggestionMu.Lock()
+	c, ok := suggestionCache[key]
+	suggestionMu.Unlock()
+	if ok && now.Sub(c.at) < SuggestionCacheTTL {
+		return c.Suggestion, true, nil
+	}
+
+	// Concurrent requests for the same todo share one call.
+	v, err, _ := suggestionGroup.Do(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), SuggestionTimeout)
+		defer cancel()
+		s, err := Suggester.SuggestSubtasks(ctx, task, tags)
+		if err != nil {
+			return nil, err
+		}
+		s = cleanSuggestion(s, tags)
+		suggestionMu.Lock()
+		defer suggestionMu.Unlock()
+		if len(suggestionCache) >= maxCachedSuggestions {
+			for k, c := range suggestionCache {
+				if now.Sub(c.at) >= SuggestionCacheTTL {
+					delete(suggestionCache, k)
+				}
+			}
+		}
+		if len(suggestionCache) >= maxCachedSuggestions {
+			clear(suggestionCache) // all fresh: start over rather than track their use
+		}
+		if SuggestionCacheTTL > 0 {
+			suggestionCache[key] = cachedSuggestion{s, now}
+		}
+		return s, nil
+	})
+	if err != nil {
+		return Suggestion{}, false, err
+	}
+	return v.(Suggestion), false, nil
+}
+
+// cleanSuggestion makes what a model proposed fit for todos: subtasks trimmed,
+// deduplicated and shortened, and only valid tags the todo does not have yet.
+func cleanSuggestion(s Suggestion, tags []string) Suggestion {
+	out := Suggestion{Subtasks: []string{}, Tags: []string{}}
+	seen := map[string]bool{}
+	for _, task := range s.Subtasks {
+		task = strings.TrimSpace(task)
+		if utf8.RuneCountInString(task) > maxSuggestedTask {
+			task = string([]rune(task)[:maxSuggestedTask])
+		}
+		if task == "" || seen[strings.ToLower(task)] || len(out.Subtasks) == maxSuggestedSubtasks {
+			continue
+		}
+		seen[strings.ToLower(task)] = true
+		out.Subtasks = append(out.Subtasks, task)
+	}
+	for _, tag := range s.Tags {
+		norm, err := normalizeTags([]string{tag})
+		if err != nil || slices.Contains(tags, norm[0]) || slices.Contains(out.Tags, norm[0]) || len(tags)+len(out.Tags) >= maxTodoTags {
+			continue
+		}
+		out.Tags = append(out.Tags, norm[0])
+	}
+	return out
+}
+
+// HandleTodoSuggestSubtasks serves POST /todos/{id}/suggest-subtasks. It is not found
+// while the suggest_subtasks feature flag is off for the caller's tenant.
+func (s *Server) HandleTodoSuggestSubtasks(w http.ResponseWriter, r *http.Request, id int) {
+	if !s.TenantFeatureEnabled(r.Context(), SuggestSubtasksFeature) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	t, err := s.Todos.Get(ctx, TodoOwner(ctx), id, false)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+
+	sug, cached, err := suggest(ctx, s.Clock.Now(), t.Task, t.Tags)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		SuggestionRequests.WithLabelValues("timeout").Inc()
+		slog.Warn("Subtask suggestion timed out", "id", id, "timeout", SuggestionTimeout.String())
+		http.Error(w, "The model took too long to answer", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		SuggestionRequests.WithLabelValues("error").Inc()
+		slog.Error("Failed to suggest subtasks", "id", id, "error", err)
+		setErrorDetail(w, Redaction.String(err.Error()))
+		http.Error(w, "Suggestions unavailable", http.StatusBadGateway)
+		return
+	case cached:
+		SuggestionRequests.WithLabelValues("hit").Inc()
+	default:
+		SuggestionRequests.WithLabelValues("generated").Inc()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(SubtaskSuggestions{TodoID: id, Suggestion: sug, Cached: cached}); err != nil {
+		slog.Error("Failed to encode subtask suggestions", "error", err)
+	}
+}
@@ -0,0 +1,510 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// Offline sync for mobile clients, at /sync:
+//
+//	GET /sync             every todo the caller can see, and a token
+//	GET /sync?since=TOKEN what changed since the token, and a new token
+//	POST /sync            a batch of changes made offline, each checked against the
+//	                      version it was made on
+//
+// Tokens are positions in todo_events (eventPos), the change log behind resumable live
+// updates, so a token is good for as long as the changes after it are kept
+// (TodoEventRetention); an older one is 410 Gone and the client starts over without since. Every todo carries its
+// version (migration 0039), which the database bumps on each change; a pushed update
+// or delete made on an older version is not applied but answered as a conflict with
+// the todo as it is now, for the client to merge and push again.
+
+const (
+	// syncPageLimit is the most changes one GET /sync?since= reads; with more, it
+	// answers more: true and the client asks again with the new token.
+	syncPageLimit = 500
+	// syncPushLimit is the most changes one POST /sync takes.
+	syncPushLimit = 100
+)
+
+// SyncTodo is a todo with its version.
+type SyncTodo struct {
+	Todo
+	Version int64 `json:"version"`
+
+	writable bool // the caller may change it
+}
+
+// SyncChanges is the answer to GET /sync.
+type SyncChanges struct {
+	Todos   []SyncTodo `json:"todos"`   // created or changed, as they are now
+	Deleted []int      `json:"deleted"` // ids to forget: deleted, or no longer visible
+	Token   string     `json:"token"`   // for the next GET /sync?since=
+	More    bool       `json:"more"`    // more changes after Token; ask again now
+}
+
+// SyncChange is one change pushed with POST /sync. Op is "create", "update" or
+// "delete". Fields left out are not changed; Tags, when set, replaces the tags.
+type SyncChange struct {
+	Op       string   `json:"op"`
+	ClientID string   `json:"client_id,omitempty"` // the client's id for a created todo, echoed back
+	ID       int      `json:"id,omitempty"`        // update and delete
+	Version  int64    `json:"version,omitempty"`   // update and delete: the version it was made on
+	Task     *string  `json:"task,omitempty"`
+	ListID   *int64   `json:"list_id,omitempty"` // create
+	Complete *bool    `json:"completed,omitempty"`
+	Priority string   `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// SyncResult is the outcome of one pushed change, in the order they were pushed.
+// Status is "applied"; "conflict", with the todo as it is now; "not_found", for a
+// todo that is gone or not visible, which the client should forget; "rejected", with
+// the reason in Error, for a change that cannot be applied as it is; or "failed", for
+// a change that may succeed if pushed again.
+type SyncResult struct {
+	ClientID string    `json:"client_id,omitempty"`
+	ID       int       `json:"id,omitempty"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Todo     *SyncTodo `json:"todo,omitempty"` // after the change, or for a conflict, now
+}
+
+// querySyncTodos returns the todos owner can see, only those in ids if not nil, with
+// their versions.
+func querySyncTodos(ctx context.Context, q dbtx, owner string, ids []int64) ([]SyncTodo, error) {
+	rows, err := queries(q).SyncTodos(ctx, store.SyncTodosParams{Owner: owner, Ids: ids})
+	if err != nil {
+		return nil, err
+	}
+	todos := make([]SyncTodo, len(rows))
+	for i, r := range rows {
+		todos[i] = SyncTodo{Todo: todoFromRow(store.GetTodoRow{
+			ID: r.ID, Task: r.Task, Completed: r.Completed, ListID: r.ListID, DueAt: r.DueAt,
+			Priority: r.Priority, Tags: r.Tags, ParentID: r.ParentID, Rrule: r.Rrule, RemindAt: r.RemindAt,
+			CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt, CompletedAt: r.CompletedAt,
+			Archived: r.Archived, Starred: r.Starred,
+		}), Version: r.Version, writable: r.Writable}
+	}
+	return todos, nil
+}
+
+func (s *Server) decryptSyncTodos(ctx context.Context, todos []SyncTodo) error {
+	for i := range todos {
+		var err error
+		if todos[i].Task, err = s.decryptTask(ctx, todos[i].Task); err != nil {
+			slog.Error("Failed to decrypt task", "id", todos[i].ID, "error", err)
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+	}
+	return nil
+}
+
+// HandleSync serves /sync.
+func (s *Server) HandleSync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.pullChanges(w, r)
+	case http.MethodPost:
+		s.pushChanges(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) pullChanges(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	var res SyncChanges
+	var err error
+	if since := r.URL.Query().Get("since"); since != "" {
+		pos, perr := parseEventPos(since)
+		if perr != nil {
+			http.Error(w, "Invalid sync token", http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if res, ok, err = s.syncChangesSince(ctx, owner, pos); err == nil && !ok {
+			http.Error(w, "Sync token expired: sync again without since", http.StatusGone)
+			return
+		}
+	} else {
+		res, err = s.syncSnapshot(ctx, owner)
+	}
+	if err == nil {
+		err = s.decryptSyncTodos(ctx, res.Todos)
+	}
+	if err != nil {
+		writeTodoError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		slog.Error("Failed to encode sync changes", "error", err)
+	}
+}
+
+// syncSnapshot returns every todo owner can see, with the watermark taken before they
+// were read as the token: each change below it is in what is read. Changes made
+// meanwhile come again with the next pull, which does no harm.
+func (s *Server) syncSnapshot(ctx context.Context, owner string) (SyncChanges, error) {
+	var res SyncChanges
+	var xmin int64
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			if err := dbQueryRow(ctx, q, "sync_token", todoEventWatermark).Scan(&xmin); err != nil {
+				return err
+			}
+			var err error
+			res.Todos, err = querySyncTodos(ctx, q, owner, nil)
+			return err
+		})
+	})
+	res.Deleted = []int{}
+	res.Token = eventPos{Xid: xmin}.String()
+	return res, err
+}
+
+// syncChangesSince returns what changed for owner after pos, up to syncPageLimit
+// changes; ok is false when they are no longer all known. Each todo comes once, as it
+// is now. Like the live feeds, it reads the primary, which has every change it lists.
+func (s *Server) syncChangesSince(ctx context.Context, owner string, pos eventPos) (res SyncChanges, ok bool, err error) {
+	changes, next, ok, err := s.todoChangesSince(ctx, pos, syncPageLimit+1)
+	if err != nil || !ok {
+		return res, ok, err
+	}
+	if res.More = len(changes) > syncPageLimit; res.More {
+		changes = changes[:syncPageLimit]
+		last := changes[len(changes)-1]
+		next = eventPos{Xid: last.Xid, Seq: last.Seq}
+	}
+	res.Token = next.String()
+
+	// Personal todos of others are skipped, as in visibleChange; what is left is read
+	// as it is now, and what cannot be read any more is deleted for the caller if it
+	// was theirs or on a list they are on.
+	var ids, listIDs []int64
+	touched := map[int]TodoChange{}
+	for _, c := range changes {
+		if c.ListID == nil && c.UserID != owner {
+			continue
+		}
+		if _, seen := touched[c.ID]; !seen {
+			ids = append(ids, int64(c.ID))
+		}
+		touched[c.ID] = c
+		if c.ListID != nil {
+			listIDs = append(listIDs, *c.ListID)
+		}
+	}
+	res.Todos, res.Deleted = []SyncTodo{}, []int{}
+	if len(ids) == 0 {
+		return res, true, nil
+	}
+	member := map[int64]bool{}
+	err = s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			var err error
+			if res.Todos, err = querySyncTodos(ctx, q, owner, ids); err != nil || len(listIDs) == 0 {
+				return err
+			}
+			lists, err := queries(q).MemberLists(ctx, store.MemberListsParams{UserID: owner, ListIds: listIDs})
+			for _, id := range lists {
+				member[id] = true
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return res, true, err
+	}
+	visible := map[int]bool{}
+	for _, t := range res.Todos {
+		visible[t.ID] = true
+	}
+	for _, id := range ids {
+		if c := touched[int(id)]; !visible[int(id)] && (c.ListID == nil || member[*c.ListID]) {
+			res.Deleted = append(res.Deleted, int(id))
+		}
+	}
+	return res, true, nil
+}
+
+// getSyncTodo returns todo id as owner sees it now, or nil if they cannot.
+func (s *Server) getSyncTodo(ctx context.Context, owner string, id int) (*SyncTodo, error) {
+	var todos []SyncTodo
+	err := s.ExecuteWithRobustness(func() error {
+		return withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			var err error
+			todos, err = querySyncTodos(ctx, q, owner, []int64{int64(id)})
+			return err
+		})
+	})
+	if err != nil || len(todos) == 0 {
+		return nil, err
+	}
+	if err := s.decryptSyncTodos(ctx, todos); err != nil {
+		return nil, err
+	}
+	return &todos[0], nil
+}
+
+func (s *Server) pushChanges(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Changes []SyncChange `json:"changes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Changes) == 0 || len(req.Changes) > syncPushLimit {
+		http.Error(w, fmt.Sprintf("changes must hold 1 to %d changes", syncPushLimit), http.StatusBadRequest)
+		return
+	}
+	for i, c := range req.Changes {
+		var err error
+		switch {
+		case c.Op != "create" && c.Op != "update" && c.Op != "delete":
+			err = errors.New("op must be create, update or delete")
+		case c.Op == "create" && (c.Task == nil || *c.Task == ""):
+			err = errors.New("task is required to create a todo")
+		case c.Op != "create" && (c.ID < 1 || c.Version < 1):
+			err = fmt.Errorf("id and version are required to %s a todo", c.Op)
+		}
+		if err == nil {
+			req.Changes[i].Tags, err = checkLabels(c.Priority, c.Tags)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("changes[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	owner := TodoOwner(ctx)
+	results := make([]SyncResult, len(req.Changes))
+	for i, c := range req.Changes {
+		results[i] = s.applySyncChange(ctx, owner, c)
+	}
+	slog.Info("Applied sync push", "changes", len(results), "owner", owner)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Results []SyncResult `json:"results"`
+	}{results}); err != nil {
+		slog.Error("Failed to encode sync results", "error", err)
+	}
+}
+
+// applySyncChange applies one pushed change, on its own: a change that fails leaves
+// the others alone.
+func (s *Server) applySyncChange(ctx context.Context, owner string, c SyncChange) SyncResult {
+	res := SyncResult{ClientID: c.ClientID, ID: c.ID, Status: "applied"}
+	var err error
+	switch c.Op {
+	case "create":
+		res.ID, err = s.syncCreate(ctx, owner, c)
+	case "update":
+		err = s.syncUpdate(ctx, owner, c)
+	case "delete":
+		err = s.syncDelete(ctx, owner, c)
+	}
+	var conflict *syncConflict
+	switch {
+	case c.Op == "create" && res.ID != 0 && err != nil:
+		// The todo exists, so the client must not push it again; the todo returned
+		// shows what was left undone.
+		slog.Warn("Created synced todo only in part", "id", res.ID, "error", err)
+		res.Error = syncErrorMessage(err)
+	case errors.As(err, &conflict):
+		res.Status, res.Todo = "conflict", conflict.current
+		return res
+	case errors.Is(err, sql.ErrNoRows):
+		res.Status = "not_found"
+		return res
+	case err != nil:
+		res.Status, res.Error = "rejected", syncErrorMessage(err)
+		if res.Error == "" {
+			slog.Error("Failed to apply sync change", "op", c.Op, "id", c.ID, "error", err)
+			res.Status, res.Error = "failed", "temporarily unavailable; push it again later"
+		}
+		return res
+	}
+	if c.Op != "delete" {
+		if res.Todo, err = s.getSyncTodo(ctx, owner, res.ID); err != nil {
+			slog.Warn("Failed to read synced todo", "id", res.ID, "error", err)
+		}
+	}
+	return res
+}
+
+// syncErrorMessage is what a client is told about a change refused for err, or "" if
+// err is not the change's fault.
+func syncErrorMessage(err error) string {
+	var qe *quotaError
+	switch {
+	case errors.As(err, &qe):
+		return qe.Error()
+	case errors.Is(err, errTodoForbidden):
+		return "you cannot change todos on this list"
+	case errors.Is(err, errTodoBlocked):
+		return "todo is blocked by open todos"
+	case errors.Is(err, errInvalidTask):
+		return err.Error()
+	}
+	return ""
+}
+
+// syncConflict is a change made on an older version than the todo's.
+type syncConflict struct {
+	current *SyncTodo
+}
+
+func (e *syncConflict) Error() string {
+	return fmt.Sprintf("todo %d has changed: now version %d", e.current.ID, e.current.Version)
+}
+
+// checkSyncVersion explains why a versioned write to todo id changed nothing: it is
+// gone (sql.ErrNoRows), owner cannot change it (errTodoForbidden), or it has changed
+// since the version the client had (a syncConflict).
+func (s *Server) checkSyncVersion(ctx context.Context, owner string, id int) error {
+	t, err := s.getSyncTodo(ctx, owner, id)
+	switch {
+	case err != nil:
+		return err
+	case t == nil:
+		return sql.ErrNoRows
+	case !t.writable:
+		return errTodoForbidden
+	}
+	return &syncConflict{current: t}
+}
+
+func (s *Server) syncCreate(ctx context.Context, owner string, c SyncChange) (int, error) {
+	t, err := s.Todos.Create(ctx, owner, *c.Task, c.ListID)
+	if err != nil {
+		return 0, err
+	}
+	if c.Complete != nil && *c.Complete {
+		if _, err := s.Todos.SetCompleted(ctx, owner, t.ID, true); err != nil {
+			return t.ID, err
+		}
+	}
+	if c.Priority != "" || c.Tags != nil {
+		if _, err := s.setTodoLabels(ctx, owner, t.ID, c.Priority, c.Tags); err != nil {
+			return t.ID, err
+		}
+	}
+	return t.ID, nil
+}
+
+// syncUpdateQuery changes the task and completion of todo $2 if it is still at
+// version $3, like the UpdateTodo query otherwise: the caller ($1) must be able to change
+// it, and completing it with open blockers changes nothing. NULL leaves a field as it is.
+var syncUpdateQuery = `WITH prev AS (
+	SELECT id, version, COALESCE(completed, FALSE) AS completed,
+		COALESCE($4, completed) AND NOT COALESCE(completed, FALSE) AND ` + openBlockers + ` AS blocked
+	FROM todos WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 1) + ` FOR UPDATE
+), updated AS (
+	UPDATE todos t SET task = COALESCE($5, t.task), completed = COALESCE($4, t.completed)
+	FROM prev
+	WHERE t.id = prev.id AND prev.version = $3 AND NOT prev.blocked
+	RETURNING t.completed, EXTRACT(EPOCH FROM t.completed_at - t.created_at) AS seconds_open, t.rrule IS NOT NULL AS recurring
+)
+SELECT prev.completed, prev.blocked, updated.completed IS NOT NULL, COALESCE(updated.completed, FALSE),
+	COALESCE(updated.seconds_open, 0), COALESCE(updated.recurring, FALSE)
+FROM prev LEFT JOIN updated ON TRUE`
+
+func (s *Server) syncUpdate(ctx context.Context, owner string, c SyncChange) error {
+	var task sql.NullString
+	if c.Task != nil {
+		if err := repository.CheckTask(*c.Task); err != nil {
+			return err
+		}
+		stored, err := s.encryptTask(ctx, *c.Task)
+		if err != nil {
+			slog.Error("Failed to encrypt task", "error", err)
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+		task = sql.NullString{String: stored, Valid: true}
+	}
+	var found, wasCompleted, blocked, applied, completed, recurring bool
+	var overQuota *quotaError
+	var secondsOpen float64
+	err := s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "sync_update_todo", syncUpdateQuery, owner, c.ID, c.Version, c.Complete, task).
+				Scan(&wasCompleted, &blocked, &applied, &completed, &secondsOpen, &recurring)
+		})
+		if overQuota = asQuotaError(err); overQuota != nil {
+			return nil
+		}
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	switch {
+	case err != nil:
+		return err
+	case overQuota != nil:
+		return overQuota
+	case blocked:
+		return errTodoBlocked
+	case !found || !applied:
+		return s.checkSyncVersion(ctx, owner, c.ID)
+	}
+	recordTodoUpdated(wasCompleted, completed, secondsOpen)
+	if completed && !wasCompleted && recurring {
+		if _, err := s.EnqueueJob(ctx, recurrenceJob, owner, recurrencePayload{TodoID: c.ID}); err != nil {
+			slog.Error("Failed to queue the next occurrence", "id", c.ID, "error", err)
+		}
+	}
+	if c.Priority != "" || c.Tags != nil {
+		if _, err := s.setTodoLabels(ctx, owner, c.ID, c.Priority, c.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDeleteQuery deletes todo $1 if it is still at version $3, like the DeleteTodo query.
+var syncDeleteQuery = `DELETE FROM todos WHERE id = $1 AND version = $3 AND ` + fmt.Sprintf(todoWritableBy, 2) + `
+RETURNING COALESCE(completed, FALSE)`
+
+func (s *Server) syncDelete(ctx context.Context, owner string, c SyncChange) error {
+	var found, wasCompleted bool
+	err := s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			return dbQueryRow(ctx, q, "sync_delete_todo", syncDeleteQuery, c.ID, owner, c.Version).Scan(&wasCompleted)
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return s.checkSyncVersion(ctx, owner, c.ID)
+	}
+	recordTodoDeleted(wasCompleted)
+	return nil
+}
@@ -0,0 +1,332 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// Todos have a priority and any number of tags, set with the todo (POST /todos, PUT
+// /todos/{id}) and used to narrow and order the list:
+//
+//	GET /todos?tag=work&tag=home&priority=high&sort=priority
+//	GET /tags   the caller's tags and how many of their todos carry each
+//
+// Several tags select the todos carrying all of them. Tags left out of a PUT are
+// kept; an empty list removes them all.
+
+// Todo priorities, most urgent last. Todos are PriorityNormal unless set.
+const (
+	PriorityLow    = repository.PriorityLow
+	PriorityNormal = repository.PriorityNormal
+	PriorityHigh   = repository.PriorityHigh
+	PriorityUrgent = repository.PriorityUrgent
+)
+
+// Priorities are the valid priorities, least urgent first.
+var Priorities = repository.Priorities
+
+const (
+	maxTodoTags  = 20
+	maxTagLength = 50
+)
+
+// TagCount is a tag and how many of the caller's todos carry it, at /tags.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// validatePriority accepts "" (unchanged or default) and the Priorities.
+func validatePriority(p string) error {
+	if p != "" && !slices.Contains(Priorities, p) {
+		return fmt.Errorf("priority must be one of %s", strings.Join(Priorities, ", "))
+	}
+	return nil
+}
+
+// checkText rejects text Postgres refuses to store, invalid UTF-8 or a NUL byte, so
+// that it is a 400 rather than a failed query.
+func checkText(name, s string) error {
+	if !utf8.ValidString(s) || strings.ContainsRune(s, 0) {
+		return fmt.Errorf("%s must be UTF-8 text without NUL bytes", name)
+	}
+	return nil
+}
+
+// normalizeTags trims and lowercases tags, drops duplicates and sorts them. nil stays
+// nil, meaning "unchanged"; an empty list stays empty, meaning "none".
+func normalizeTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	out := []string{}
+	for _, tag := range tags {
+		if err := checkText("tags", tag); err != nil {
+			return nil, err
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "":
+			return nil, fmt.Errorf("tags must not be empty")
+		case len(tag) > maxTagLength:
+			return nil, fmt.Errorf("tag %q is longer than %d bytes", tag, maxTagLength)
+		case strings.Contains(tag, ","):
+			return nil, fmt.Errorf("tag %q contains a comma", tag)
+		}
+		if !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	if len(out) > maxTodoTags {
+		return nil, fmt.Errorf("a todo can have at most %d tags", maxTodoTags)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// checkLabels validates the priority and returns the normalized tags of a todo in a
+// request.
+func checkLabels(priority string, tags []string) ([]string, error) {
+	if err := validatePriority(priority); err != nil {
+		return nil, err
+	}
+	return normalizeTags(tags)
+}
+
+// todoSorts are the orders of ?sort=, which ListTodos implements. Every order ends
+// with the id so pages of equal keys are stable.
+var todoSorts = []string{"", "id", "priority", "due_at", "starred"}
+
+// todoFilter narrows and orders a list of todos; the zero value lists all that are not
+// archived, by id. Sort is one of todoSorts.
+type todoFilter = repository.Filter
+
+// todoTimeColumns are the columns ?created_after= and the like filter on: the
+// parameter names drop the "_at".
+var todoTimeColumns = []string{"created_at", "updated_at", "completed_at"}
+
+// parseTodoFilter reads a todoFilter from the ?tag=, ?priority=, ?starred=, ?sort=,
+// ?include=, time range (?completed_after= and the like) and ?limit= and ?cursor=
+// parameters.
+func parseTodoFilter(q url.Values) (todoFilter, error) {
+	f := todoFilter{Priority: q.Get("priority"), Sort: q.Get("sort")}
+	for _, v := range q["include"] {
+		for _, include := range strings.Split(v, ",") {
+			if include != "archived" {
+				return todoFilter{}, fmt.Errorf("include must be archived")
+			}
+			f.IncludeArchived = true
+		}
+	}
+	for _, col := range todoTimeColumns {
+		for bound, times := range map[string]*map[string]time.Time{"after": &f.After, "before": &f.Before} {
+			name := strings.TrimSuffix(col, "_at") + "_" + bound
+			v := q.Get(name)
+			if v == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return todoFilter{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			if *times == nil {
+				*times = map[string]time.Time{}
+			}
+			(*times)[col] = t
+		}
+	}
+	if err := validatePriority(f.Priority); err != nil {
+		return todoFilter{}, err
+	}
+	if v := q.Get("starred"); v != "" {
+		starred, err := strconv.ParseBool(v)
+		if err != nil {
+			return todoFilter{}, fmt.Errorf("starred must be true or false")
+		}
+		f.Starred = &starred
+	}
+	if !slices.Contains(todoSorts, f.Sort) {
+		return todoFilter{}, fmt.Errorf("sort must be id, priority, due_at or starred")
+	}
+	if tags := q["tag"]; len(tags) > 0 {
+		var err error
+		if f.Tags, err = normalizeTags(tags); err != nil {
+			return todoFilter{}, err
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTodoPage {
+			return todoFilter{}, fmt.Errorf("limit must be between 1 and %d", maxTodoPage)
+		}
+		f.Limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		if f.Limit == 0 {
+			return todoFilter{}, fmt.Errorf("cursor needs a limit")
+		}
+		var err error
+		if f.Cursor, err = parseCursor(v, f.Sort); err != nil {
+			return todoFilter{}, err
+		}
+	}
+	return f, nil
+}
+
+// listTodosParams returns the arguments of ListTodos for the todos owner can see that
+// pass f.
+func listTodosParams(f todoFilter, owner string) store.ListTodosParams {
+	arg := store.ListTodosParams{
+		Owner:           owner,
+		IncludeArchived: f.IncludeArchived,
+		ListID:          f.ListID,
+		Inbox:           f.Inbox,
+		Priority:        sql.NullString{String: f.Priority, Valid: f.Priority != ""},
+		Tags:            f.Tags,
+		Sort:            cmp.Or(f.Sort, "id"),
+	}
+	if f.Starred != nil {
+		arg.Starred = sql.NullBool{Bool: *f.Starred, Valid: true}
+	}
+	for col, bounds := range map[string][2]**time.Time{
+		"created_at":   {&arg.CreatedAfter, &arg.CreatedBefore},
+		"updated_at":   {&arg.UpdatedAfter, &arg.UpdatedBefore},
+		"completed_at": {&arg.CompletedAfter, &arg.CompletedBefore},
+	} {
+		if t, ok := f.After[col]; ok {
+			*bounds[0] = &t
+		}
+		if t, ok := f.Before[col]; ok {
+			*bounds[1] = &t
+		}
+	}
+	if c := f.Cursor; c != nil {
+		id, rank := int64(c.ID), int32(c.Rank)
+		arg.AfterID, arg.AfterRank, arg.AfterDueAt, arg.AfterStarred = &id, &rank, c.DueAt, c.Starred
+	}
+	if f.Limit > 0 {
+		limit := int32(f.Limit + 1)
+		arg.MaxTodos = &limit
+	}
+	return arg
+}
+
+// setTodoLabelsQuery changes the priority ($1, unless NULL) and the tags ($3, unless
+// NULL) of a todo in one statement, creating tags on first use. Tags are upserted
+// with DO UPDATE so RETURNING includes the ones that already existed.
+var setTodoLabelsQuery = `WITH t AS (
+	UPDATE todos SET priority = COALESCE($1, priority)
+	WHERE id = $2 AND ` + fmt.Sprintf(todoWritableBy, 4) + `
+	RETURNING id
+), named AS (
+	INSERT INTO tags (name) SELECT unnest($3::text[]) FROM t
+	ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+	RETURNING id
+), dropped AS (
+	DELETE FROM todo_tags
+	WHERE $3::text[] IS NOT NULL AND todo_id IN (SELECT id FROM t) AND tag_id NOT IN (SELECT id FROM named)
+), added AS (
+	INSERT INTO todo_tags (todo_id, tag_id) SELECT t.id, named.id FROM t, named
+	ON CONFLICT DO NOTHING
+)
+SELECT id FROM t`
+
+// lockTodoLabelsQuery locks todo $1 for setTodoLabelsQuery, if the caller ($2) can
+// change it.
+var lockTodoLabelsQuery = `SELECT id FROM todos WHERE id = $1 AND ` + fmt.Sprintf(todoWritableBy, 2) + ` FOR UPDATE`
+
+// setTodoLabels sets the priority, unless "", and the tags, unless nil, of todo id and
+// reports whether owner could change it. tags must be normalized.
+//
+// The todo is locked by a statement of its own first. setTodoLabelsQuery would wait for
+// the lock of a concurrent change as well, but go on reading todo_tags as they were
+// before that change committed, and so keep the tags it added: two requests setting
+// [a] and [b] at once would leave [a, b].
+func (s *Server) setTodoLabels(ctx context.Context, owner string, id int, priority string, tags []string) (bool, error) {
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var updated int
+		err := withTenantTx(ctx, s.DB, owner, func(q dbtx) error {
+			if err := dbQueryRow(ctx, q, "lock_todo_labels", lockTodoLabelsQuery, id, owner).Scan(&updated); err != nil {
+				return err
+			}
+			return dbQueryRow(ctx, q, "set_todo_labels", setTodoLabelsQuery,
+				sql.NullString{String: priority, Valid: priority != ""}, id, pq.Array(tags), owner).Scan(&updated)
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	return found, err
+}
+
+// tagCounts returns the tags on the todos owner can see, most used first.
+func (s *Server) tagCounts(ctx context.Context, owner string) ([]TagCount, error) {
+	var counts []TagCount
+	err := s.withReplica(ctx, owner, func(q dbtx) error {
+		rows, err := dbQuery(ctx, q, "list_tags",
+			`SELECT g.name, count(*) FROM todos
+			JOIN todo_tags tt ON tt.todo_id = todos.id
+			JOIN tags g ON g.id = tt.tag_id
+			WHERE `+todoVisibleTo+`
+			GROUP BY g.name ORDER BY count(*) DESC, g.name`, owner)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		counts = []TagCount{} // Reset on retry
+		for rows.Next() {
+			var c TagCount
+			if err := rows.Scan(&c.Name, &c.Count); err != nil {
+				return err
+			}
+			counts = append(counts, c)
+		}
+		return rows.Err()
+	})
+	return counts, err
+}
+
+// HandleTags serves GET /tags: the tags on the todos the caller can see, most used
+// first.
+func (s *Server) HandleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := TodoOwner(r.Context())
+	counts, at, err := aggregate(r.Context(), s.Clock, "tags", owner, func(ctx context.Context) ([]TagCount, error) {
+		return s.tagCounts(ctx, owner)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	setAge(w, at, s.Clock.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		slog.Error("Failed to encode tags", "error", err)
+	}
+}
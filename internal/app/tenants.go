@@ -0,0 +1,298 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Multi-tenancy (tenancy.enabled) partitions the service between organisations. A
+// request names its tenant by subdomain of tenancy.base_domain (acme.todo.example.com)
+// or by the X-Tenant-ID header; without either, its credentials decide. API keys can
+// be bound to a tenant, bearer tokens carry it in the tenancy.claim claim, and sessions
+// keep the tenant they were opened in. A credential bound to a tenant only works there;
+// one that is not, only in the default tenant.
+//
+// Subjects outside the default tenant are qualified by it, "acme/user:123". Todos,
+// lists, quotas, usage and row-level security all go by subject, so they are scoped
+// to the tenant with no change to the queries; subjects in the default tenant stay as
+// they were, so turning tenancy on moves no data. Administration (the admin scope)
+// stays with the default tenant.
+//
+// The tenants table holds the overrides of each tenant: quotas (see quotas.go) for its
+// subjects that have none of their own; requests_per_minute, its rate limit; and
+// features, flags that win over the features setting.
+
+// DefaultTenant is the tenant of unqualified subjects and unbound credentials.
+const DefaultTenant = "default"
+
+// ErrTenantDenied is returned for credentials used outside their tenant, or for a
+// tenant that does not exist.
+var ErrTenantDenied = errors.New("tenant not allowed for these credentials")
+
+// tenantIDPattern is what tenant ids look like: a DNS label, so they work as subdomains.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// subjectTenantPattern matches the tenant qualifying a subject. Unqualified subjects
+// have a ':' before any '/' ("spiffe:example.org/ns/app"), so they never match.
+var subjectTenantPattern = regexp.MustCompile(`^([a-z0-9][a-z0-9-]*)/`)
+
+// tenantCacheTTL bounds how long a tenant's overrides are used without a lookup.
+// Changes through /admin/resources/tenants clear the cache of the replica that made
+// them; other replicas pick them up within this window.
+const tenantCacheTTL = 30 * time.Second
+
+var TenantRateLimited = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tenant_rate_limited_requests_total",
+		Help: "Total number of requests rejected by a tenant's rate limit",
+	},
+	[]string{"tenant"},
+)
+
+// Tenant is a row of the tenants table. Nil limits fall back to the configuration, or
+// for quotas, to none.
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	QuotaLimits
+	RequestsPerMinute *int            `json:"requests_per_minute"`
+	Features          map[string]bool `json:"features"`
+	CreatedAt         time.Time       `json:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
+}
+
+// TenancyConfig is the tenancy.* configuration, set up in main.
+type TenancyConfig struct {
+	Enabled    bool
+	BaseDomain string // tenants are subdomains of it; empty to only take the header
+	Claim      string // bearer token claim naming the tenant; empty for none
+	// RequestsPerMinute limits each tenant without a limit of its own; 0 for none.
+	RequestsPerMinute int
+	Store             AbuseStore // counts requests per tenant
+}
+
+// Tenancy is the process-wide configuration.
+var Tenancy TenancyConfig
+
+// subjectTenant returns the tenant subject belongs to.
+func subjectTenant(subject string) string {
+	if m := subjectTenantPattern.FindStringSubmatch(subject); m != nil {
+		return m[1]
+	}
+	return DefaultTenant
+}
+
+// qualifySubject returns subject as seen in tenant: prefixed by it outside the default
+// tenant, unless it already is.
+func qualifySubject(tenant, subject string) string {
+	if tenant == DefaultTenant || tenant == "" || strings.HasPrefix(subject, tenant+"/") {
+		return subject
+	}
+	return tenant + "/" + subject
+}
+
+// requestedTenant returns the tenant r names, by header or subdomain, or "".
+func requestedTenant(r *http.Request) string {
+	if id := r.Header.Get(TenantHeader); id != "" {
+		return id
+	}
+	if Tenancy.BaseDomain == "" {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	sub, ok := strings.CutSuffix(strings.ToLower(host), "."+Tenancy.BaseDomain)
+	if !ok || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// bindTenant places the principal p, whose Tenant is the one its credentials are
+// bound to ("" for none), in the tenant r asks for. It returns a copy with the tenant
+// set and the subject qualified, ErrTenantDenied if the credentials do not belong
+// there, and ErrInvalidCredentials for anonymous callers outside the default tenant.
+func (s *Server) bindTenant(r *http.Request, p *Principal) (*Principal, error) {
+	requested := requestedTenant(r)
+	if p == nil {
+		if requested != "" && requested != DefaultTenant {
+			return nil, fmt.Errorf("%w: tenant %q needs credentials", ErrInvalidCredentials, requested)
+		}
+		return nil, nil
+	}
+	bound := p.Tenant
+	if bound == "" {
+		bound = DefaultTenant
+	}
+	if requested != "" && requested != bound {
+		return nil, ErrTenantDenied
+	}
+	if bound != DefaultTenant {
+		if !tenantIDPattern.MatchString(bound) {
+			return nil, ErrTenantDenied
+		}
+		t, err := s.lookupTenant(r.Context(), bound)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return nil, ErrTenantDenied
+		}
+	}
+
+	q := *p
+	q.Tenant = bound
+	q.Subject = qualifySubject(bound, p.Subject)
+	if bound != DefaultTenant && slices.Contains(p.Scopes, ScopeAdmin) {
+		q.Scopes = []string{ScopeRead, ScopeWrite}
+	}
+	return &q, nil
+}
+
+// isUnknownTenant reports whether err is a foreign key violation on a tenant: an API
+// key bound to a tenant that does not exist, or a tenant deleted with keys still bound.
+func isUnknownTenant(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+type cachedTenant struct {
+	tenant  *Tenant // nil for a tenant that does not exist
+	expires time.Time
+}
+
+var tenantCache = struct {
+	mu      sync.Mutex
+	entries map[string]cachedTenant
+}{entries: make(map[string]cachedTenant)}
+
+// invalidateTenants forgets every cached tenant, used after a change.
+func invalidateTenants() {
+	tenantCache.mu.Lock()
+	defer tenantCache.mu.Unlock()
+	tenantCache.entries = make(map[string]cachedTenant)
+}
+
+const selectTenantColumns = `SELECT id, name, max_todos, max_open_todos, max_lists, max_attachment_bytes,
+	requests_per_minute, features, created_at, updated_at FROM tenants`
+
+func scanTenant(row interface{ Scan(...any) error }) (Tenant, error) {
+	var t Tenant
+	var features []byte
+	if err := row.Scan(&t.ID, &t.Name, &t.MaxTodos, &t.MaxOpenTodos, &t.MaxLists, &t.MaxAttachmentBytes, &t.RequestsPerMinute, &features, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return t, err
+	}
+	t.Features = map[string]bool{}
+	err := json.Unmarshal(features, &t.Features)
+	return t, err
+}
+
+// lookupTenant returns tenant id, or nil if there is none.
+func (s *Server) lookupTenant(ctx context.Context, id string) (*Tenant, error) {
+	tenantCache.mu.Lock()
+	c, ok := tenantCache.entries[id]
+	tenantCache.mu.Unlock()
+	if ok && s.Clock.Now().Before(c.expires) {
+		return c.tenant, nil
+	}
+
+	var t *Tenant
+	err := s.ExecuteWithRobustness(func() error {
+		found, err := scanTenant(dbQueryRow(ctx, s.DBRead, "get_tenant", selectTenantColumns+" WHERE id = $1", id))
+		if err == sql.ErrNoRows {
+			t = nil
+			return nil
+		}
+		t = &found
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	tenantCache.mu.Lock()
+	tenantCache.entries[id] = cachedTenant{tenant: t, expires: s.Clock.Now().Add(tenantCacheTTL)}
+	tenantCache.mu.Unlock()
+	return t, nil
+}
+
+// TenantFeatureEnabled reports whether the feature flag name is on for the caller's
+// tenant: its override if it has one, else the features setting.
+func (s *Server) TenantFeatureEnabled(ctx context.Context, name string) bool {
+	if p, ok := PrincipalFromContext(ctx); ok && Tenancy.Enabled && p.Tenant != "" {
+		t, err := s.lookupTenant(ctx, p.Tenant)
+		if err != nil {
+			slog.Warn("Failed to look up tenant feature flags", "tenant", p.Tenant, "error", err)
+		} else if on, ok := t.featureOverride(name); ok {
+			return on
+		}
+	}
+	return FeatureEnabled(name)
+}
+
+func (t *Tenant) featureOverride(name string) (on, ok bool) {
+	if t == nil {
+		return false, false
+	}
+	on, ok = t.Features[name]
+	return on, ok
+}
+
+// TenantRateLimitMiddleware limits the requests of each tenant per minute, to the
+// tenant's requests_per_minute or else Tenancy.RequestsPerMinute. It goes after
+// AuthMiddleware; anonymous callers are left to abuse protection. Like it, it fails
+// open when the store or the database is unavailable.
+func (s *Server) TenantRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok || !Tenancy.Enabled || Tenancy.Store == nil || p.Tenant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		limit := Tenancy.RequestsPerMinute
+		t, err := s.lookupTenant(ctx, p.Tenant)
+		if err != nil {
+			slog.Warn("Failed to look up tenant rate limit", "tenant", p.Tenant, "error", err)
+		} else if t != nil && t.RequestsPerMinute != nil {
+			limit = *t.RequestsPerMinute
+		}
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n, err := Tenancy.Store.Hit(ctx, "tenant:"+p.Tenant, time.Minute)
+		if err != nil {
+			slog.Warn("Tenant rate limit store unavailable", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if n > int64(limit) {
+			TenantRateLimited.WithLabelValues(p.Tenant).Inc()
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too Many Requests: tenant rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
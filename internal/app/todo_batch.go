@@ -0,0 +1,125 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+)
+
+// WriteBatching coalesces concurrent todo inserts (database.write_batching). An insert
+// waits up to Wait for others to join it, and the batch, at most Max todos, is inserted
+// by one multi-row statement on one connection: a burst of creates costs a round trip
+// and a commit per batch instead of per todo, for a few milliseconds of latency.
+//
+// A batch that fails is not retried as a whole, since one todo over quota fails the
+// statement for all of them: each of its todos is inserted again on its own, with the
+// usual retries and errors. With RLSMode a batch only holds the todos of one owner, as
+// it runs in that tenant's transaction.
+var WriteBatching = struct {
+	Enabled bool
+	Wait    time.Duration
+	Max     int
+}{Wait: 2 * time.Millisecond, Max: 100}
+
+var (
+	TodoInsertBatchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "todo_insert_batch_size",
+			Help:    "Number of todos inserted with one statement by write batching",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		},
+	)
+	TodoInsertBatchFallbacks = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todo_insert_batch_fallbacks_total",
+			Help: "Total number of todos inserted on their own after their batch failed",
+		},
+	)
+)
+
+type todoInsert struct {
+	task, owner string
+	listID      *int64
+	done        chan struct{} // closed once row, inserted and err are set
+	row         store.InsertTodosRow
+	inserted    bool
+	err         error
+}
+
+var todoInserts = struct {
+	mu      sync.Mutex
+	pending map[string][]*todoInsert // by tenant: the owner with RLSMode, "" otherwise
+}{pending: make(map[string][]*todoInsert)}
+
+// batchInsertTodo inserts a todo with the next batch. inserted is false if owner may
+// not add todos to listID. The caller waits for the batch even if its request is
+// cancelled meanwhile, since the todo may be inserted all the same.
+func (s *Server) batchInsertTodo(ctx context.Context, task, owner string, listID *int64) (row store.InsertTodosRow, inserted bool, err error) {
+	tenant := ""
+	if RLSMode {
+		tenant = owner
+	}
+	ins := &todoInsert{task: task, owner: owner, listID: listID, done: make(chan struct{})}
+	todoInserts.mu.Lock()
+	todoInserts.pending[tenant] = append(todoInserts.pending[tenant], ins)
+	switch len(todoInserts.pending[tenant]) {
+	case WriteBatching.Max:
+		go s.flushTodoInserts(ctx, tenant)
+	case 1:
+		time.AfterFunc(WriteBatching.Wait, func() { s.flushTodoInserts(ctx, tenant) })
+	}
+	todoInserts.mu.Unlock()
+
+	<-ins.done
+	return ins.row, ins.inserted, ins.err
+}
+
+// flushTodoInserts inserts the pending batch of tenant, if one is still pending.
+func (s *Server) flushTodoInserts(ctx context.Context, tenant string) {
+	todoInserts.mu.Lock()
+	batch := todoInserts.pending[tenant]
+	delete(todoInserts.pending, tenant)
+	todoInserts.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	arg := store.InsertTodosParams{
+		Tasks:  make([]string, len(batch)),
+		Owners: make([]string, len(batch)),
+		Lists:  make([]int64, len(batch)),
+	}
+	for i, ins := range batch {
+		arg.Tasks[i], arg.Owners[i] = ins.task, ins.owner
+		if ins.listID != nil {
+			arg.Lists[i] = *ins.listID
+		}
+	}
+	// The batch is everyone's: it must not end with the request that started it.
+	ctx = context.WithoutCancel(ctx)
+	var rows []store.InsertTodosRow
+	err := withTenant(ctx, s.DB, tenant, func(q dbtx) error {
+		var err error
+		rows, err = queries(q).InsertTodos(ctx, arg)
+		return err
+	})
+	TodoInsertBatchSize.Observe(float64(len(batch)))
+	if err == nil {
+		for _, row := range rows {
+			ins := batch[row.N-1]
+			ins.row, ins.inserted = row, true
+		}
+	}
+	for _, ins := range batch {
+		ins.err = err
+		close(ins.done)
+	}
+}
@@ -0,0 +1,482 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	TodoCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_cache_requests_total",
+			Help: "Total number of todo reads looked up in the read cache",
+		},
+		[]string{"kind", "result"}, // kind: "list" or "todo"; result: "hit", "miss" or "error"
+	)
+	TodoCacheInvalidations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_cache_invalidations_total",
+			Help: "Total number of users whose cached todo reads were dropped",
+		},
+		[]string{"source"}, // "write", "membership", "notify" or "flush"
+	)
+	TodoCacheCoalesced = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_cache_coalesced_total",
+			Help: "Total number of cache misses answered by a database read already under way for the same entry",
+		},
+		[]string{"kind"},
+	)
+)
+
+// TodoCacheStore keeps cached todo reads, grouped by the user they were read for so
+// that a change drops everything that user could have seen in one go.
+type TodoCacheStore interface {
+	// Get returns the value cached for user under key, if any.
+	Get(ctx context.Context, user, key string) ([]byte, bool, error)
+	// Set caches value for user under key for ttl.
+	Set(ctx context.Context, user, key string, value []byte, ttl time.Duration) error
+	// Invalidate drops everything cached for users.
+	Invalidate(ctx context.Context, users ...string) error
+	// Flush drops everything cached for anyone.
+	Flush(ctx context.Context) error
+}
+
+// TodoCache caches todo reads (GET /todos and GET /todos/{id}, and the same reads over
+// gRPC and GraphQL) when Store is set: in Redis (cache.redis_url) or in the replica's
+// memory (cache.memory_entries). Entries hold the rows as
+// stored, task text still encrypted, and are dropped when the user they were read for
+// writes (TodoCacheMiddleware), joins or leaves a list, or any todo they can see
+// changes (InvalidateTodoCache). ListTTL and TodoTTL bound how stale an entry can be
+// if all of that is missed.
+var TodoCache = struct {
+	Store   TodoCacheStore
+	ListTTL time.Duration
+	TodoTTL time.Duration
+}{ListTTL: 30 * time.Second, TodoTTL: 5 * time.Minute}
+
+// todoCacheKey names a read by its query and arguments, which include the owner. It is
+// on the path of every cached read, so the usual argument types are formatted without
+// fmt, into the same bytes as fmt's %v of args.
+func todoCacheKey(kind, query string, args ...any) string {
+	var buf [256]byte
+	b := append(buf[:0], query...)
+	b = append(b, 0, '[')
+	for i, arg := range args {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		switch v := arg.(type) {
+		case string:
+			b = append(b, v...)
+		case int:
+			b = strconv.AppendInt(b, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(b, v, 10)
+		case bool:
+			b = strconv.AppendBool(b, v)
+		default:
+			b = append(b, fmt.Sprint(v)...)
+		}
+	}
+	h := sha256.Sum256(append(b, ']'))
+	var key [64]byte
+	return string(hex.AppendEncode(append(append(key[:0], kind...), ':'), h[:16]))
+}
+
+// cachedTodos looks up the todos cached for owner under key. Cache errors are misses:
+// the cache must never fail a read the database can answer.
+func cachedTodos(ctx context.Context, kind, owner, key string) ([]Todo, bool) {
+	store := TodoCache.Store
+	if store == nil {
+		return nil, false
+	}
+	b, ok, err := store.Get(ctx, owner, key)
+	if err == nil && ok {
+		todos := getTodoSlice()
+		if err = json.Unmarshal(b, &todos); err == nil {
+			TodoCacheRequests.WithLabelValues(kind, "hit").Inc()
+			return todos, true
+		}
+		putTodoSlice(todos)
+	}
+	if err != nil {
+		slog.Warn("Todo cache unavailable", "error", err)
+		TodoCacheRequests.WithLabelValues(kind, "error").Inc()
+	} else {
+		TodoCacheRequests.WithLabelValues(kind, "miss").Inc()
+	}
+	return nil, false
+}
+
+// todoLoads coalesces concurrent misses on the same entry into one database read, so
+// an entry expiring under load does not send every waiting request to the database.
+// Reads under way when their user's entries are invalidated are marked stale: they
+// are not cached, and later misses start a read of their own.
+var todoLoads = struct {
+	group    singleflight.Group
+	mu       sync.Mutex
+	inflight map[string]map[string]*bool // user, flight key: stale
+}{inflight: make(map[string]map[string]*bool)}
+
+// loadTodos returns the todos cached for owner under key, or reads them with load and
+// caches them for ttl. The todos are still encrypted and the caller's own copy.
+func loadTodos(ctx context.Context, kind, owner, key string, ttl time.Duration, load func(ctx context.Context) ([]Todo, error)) ([]Todo, error) {
+	if TodoCache.Store == nil {
+		return load(ctx)
+	}
+	if todos, ok := cachedTodos(ctx, kind, owner, key); ok {
+		return todos, nil
+	}
+	flight := owner + "\x00" + key
+	v, err, shared := todoLoads.group.Do(flight, func() (any, error) {
+		stale := new(bool)
+		todoLoads.mu.Lock()
+		if todoLoads.inflight[owner] == nil {
+			todoLoads.inflight[owner] = make(map[string]*bool)
+		}
+		todoLoads.inflight[owner][flight] = stale
+		todoLoads.mu.Unlock()
+		defer func() {
+			todoLoads.mu.Lock()
+			if todoLoads.inflight[owner][flight] == stale {
+				delete(todoLoads.inflight[owner], flight)
+				if len(todoLoads.inflight[owner]) == 0 {
+					delete(todoLoads.inflight, owner)
+				}
+			}
+			todoLoads.mu.Unlock()
+		}()
+
+		// Waiters share the read, so it must not end with the request that started it.
+		todos, err := load(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, err
+		}
+		todoLoads.mu.Lock()
+		fresh := !*stale
+		todoLoads.mu.Unlock()
+		if fresh {
+			cacheTodos(ctx, owner, key, todos, ttl)
+		}
+		return todos, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		TodoCacheCoalesced.WithLabelValues(kind).Inc()
+	}
+	// Callers decrypt in place; each gets its own copy.
+	return append(getTodoSlice(), v.([]Todo)...), nil
+}
+
+// forgetTodoLoads marks the reads under way for users stale.
+func forgetTodoLoads(users []string) {
+	todoLoads.mu.Lock()
+	defer todoLoads.mu.Unlock()
+	for _, u := range users {
+		for flight, stale := range todoLoads.inflight[u] {
+			*stale = true
+			todoLoads.group.Forget(flight)
+		}
+		delete(todoLoads.inflight, u)
+	}
+}
+
+// cacheTodos caches todos, still encrypted, for owner under key.
+func cacheTodos(ctx context.Context, owner, key string, todos []Todo, ttl time.Duration) {
+	store := TodoCache.Store
+	if store == nil || ttl <= 0 {
+		return
+	}
+	b, err := json.Marshal(todos)
+	if err != nil {
+		return
+	}
+	if err := store.Set(ctx, owner, key, b, ttl); err != nil {
+		slog.Warn("Failed to cache todos", "error", err)
+	}
+}
+
+// invalidateTodoCache drops what is cached for users; source labels the metric.
+func invalidateTodoCache(ctx context.Context, source string, users ...string) {
+	store := TodoCache.Store
+	if store == nil || len(users) == 0 {
+		return
+	}
+	forgetTodoLoads(users)
+	if err := store.Invalidate(context.WithoutCancel(ctx), users...); err != nil {
+		slog.Warn("Failed to invalidate todo cache", "source", source, "error", err)
+		return
+	}
+	TodoCacheInvalidations.WithLabelValues(source).Add(float64(len(users)))
+}
+
+// TodoCacheMiddleware drops the caller's cached reads after every successful write,
+// so that they read their own writes at once. Other users who can see the changed
+// todos are handled by InvalidateTodoCache, a moment later.
+func TodoCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if TodoCache.Store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status < 300 {
+			invalidateTodoCache(r.Context(), "write", TodoOwner(r.Context()))
+		}
+	})
+}
+
+// InvalidateTodoCache drops cached reads on every change to todos announced on hub,
+// whoever made it (another replica, a job, psql), until ctx is cancelled: those of the
+// owner of a personal todo, or of every member of the list of a list todo. When the
+// feed is interrupted, changes may have been missed and the whole cache is flushed.
+func (s *Server) InvalidateTodoCache(ctx context.Context, hub *TodoChangeHub) {
+	if TodoCache.Store == nil {
+		return
+	}
+	sub := hub.Subscribe()
+	go func() {
+		for {
+			for c := range sub.C {
+				users := []string{c.UserID}
+				if c.ListID != nil {
+					members, err := s.listMemberIDs(ctx, *c.ListID)
+					if err != nil {
+						slog.Warn("Failed to read list members for the todo cache", "list_id", *c.ListID, "error", err)
+					}
+					users = append(users, members...)
+				}
+				invalidateTodoCache(ctx, "notify", users...)
+			}
+			if sub.Err() == nil || ctx.Err() != nil {
+				return
+			}
+			// Subscribe before flushing, so no change falls between the two.
+			sub = hub.Subscribe()
+			if err := TodoCache.Store.Flush(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("Failed to flush todo cache", "error", err)
+			} else {
+				TodoCacheInvalidations.WithLabelValues("flush").Inc()
+			}
+		}
+	}()
+	slog.Info("Todo read cache enabled", "list_ttl", TodoCache.ListTTL.String(), "todo_ttl", TodoCache.TodoTTL.String())
+}
+
+// listMemberIDs returns the members of list id.
+func (s *Server) listMemberIDs(ctx context.Context, id int64) ([]string, error) {
+	var members []string
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(ctx, s.DB, "list_member_ids", "SELECT user_id FROM list_members WHERE list_id = $1", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		members = members[:0] // Reset on retry
+		for rows.Next() {
+			var m string
+			if err := rows.Scan(&m); err != nil {
+				return err
+			}
+			members = append(members, m)
+		}
+		return rows.Err()
+	})
+	return members, err
+}
+
+// RedisTodoCache keeps the todo cache in Redis, shared by all replicas. Each user's
+// entries are listed in a set, so they can be dropped together; the user's name is
+// a hash tag, keeping the set and its entries on one Redis Cluster node.
+type RedisTodoCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisTodoCache connects to Redis at url (redis://[:password@]host:port/db).
+func NewRedisTodoCache(url string) (*RedisTodoCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisTodoCache{client: redis.NewClient(opts), prefix: "todo-app:cache:"}, nil
+}
+
+func (c *RedisTodoCache) index(user string) string { return c.prefix + "{" + user + "}" }
+
+func (c *RedisTodoCache) entry(user, key string) string { return c.index(user) + ":" + key }
+
+func (c *RedisTodoCache) Get(ctx context.Context, user, key string) ([]byte, bool, error) {
+	b, err := c.client.Get(ctx, c.entry(user, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	return b, err == nil, err
+}
+
+func (c *RedisTodoCache) Set(ctx context.Context, user, key string, value []byte, ttl time.Duration) error {
+	idx, k := c.index(user), c.entry(user, key)
+	pipe := c.client.TxPipeline()
+	pipe.Set(ctx, k, value, ttl)
+	pipe.SAdd(ctx, idx, k)
+	// The set lives as long as its longest-lived entry.
+	pipe.ExpireNX(ctx, idx, ttl)
+	pipe.ExpireGT(ctx, idx, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// invalidateScript deletes a user's entries and their set atomically, so an entry
+// added meanwhile is not left behind without its set.
+var invalidateScript = redis.NewScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+for i = 1, #keys, 500 do
+	redis.call('DEL', unpack(keys, i, math.min(i + 499, #keys)))
+end
+redis.call('DEL', KEYS[1])
+return #keys`)
+
+func (c *RedisTodoCache) Invalidate(ctx context.Context, users ...string) error {
+	var errs []error
+	for _, u := range users {
+		if err := invalidateScript.Run(ctx, c.client, []string{c.index(u)}).Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *RedisTodoCache) Flush(ctx context.Context) error {
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		if keys = append(keys, iter.Val()); len(keys) == 1000 {
+			if err := c.client.Unlink(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return c.client.Unlink(ctx, keys...).Err()
+	}
+	return nil
+}
+
+// MemoryTodoCache keeps the todo cache in the replica's memory, for deployments
+// without Redis: the least recently used entries go once there are maxEntries. Each
+// replica has its own, kept current like the Redis cache by the change feed.
+type MemoryTodoCache struct {
+	Clock Clock // when entries expire; the system clock if nil
+
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List                          // of *memoryTodoEntry, most recently used first
+	users      map[string]map[string]*list.Element // user, key
+}
+
+type memoryTodoEntry struct {
+	user, key string
+	value     []byte
+	expires   time.Time
+}
+
+// NewMemoryTodoCache returns an empty cache of at most maxEntries entries.
+func NewMemoryTodoCache(maxEntries int) *MemoryTodoCache {
+	return &MemoryTodoCache{maxEntries: maxEntries, lru: list.New(), users: make(map[string]map[string]*list.Element)}
+}
+
+func (c *MemoryTodoCache) Get(ctx context.Context, user, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.users[user][key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*memoryTodoEntry)
+	if orSystemClock(c.Clock).Now().After(e.expires) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true, nil
+}
+
+func (c *MemoryTodoCache) Set(ctx context.Context, user, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &memoryTodoEntry{user: user, key: key, value: value, expires: orSystemClock(c.Clock).Now().Add(ttl)}
+	if el, ok := c.users[user][key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return nil
+	}
+	if c.users[user] == nil {
+		c.users[user] = make(map[string]*list.Element)
+	}
+	c.users[user][key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *MemoryTodoCache) Invalidate(ctx context.Context, users ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		for _, el := range c.users[u] {
+			c.lru.Remove(el)
+		}
+		delete(c.users, u)
+	}
+	return nil
+}
+
+func (c *MemoryTodoCache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.users)
+	return nil
+}
+
+// remove drops el; c.mu must be held.
+func (c *MemoryTodoCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*memoryTodoEntry)
+	delete(c.users[e.user], e.key)
+	if len(c.users[e.user]) == 0 {
+		delete(c.users, e.user)
+	}
+}
@@ -0,0 +1,363 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	TodoChangeEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_change_events_total",
+			Help: "Total number of todo change notifications received from Postgres",
+		},
+		[]string{"op"}, // "insert", "update", "delete"
+	)
+	TodoWatchers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "todo_watchers",
+			Help: "Number of open todo change subscriptions (gRPC WatchTodos, GraphQL subscriptions, /ws connections)",
+		},
+	)
+	TodoWatchersDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "todo_watchers_dropped_total",
+			Help: "Total number of subscriptions ended because the watcher fell behind or the feed was interrupted",
+		},
+	)
+)
+
+// todoChangesChannel is the Postgres channel migration 0012 notifies on.
+const todoChangesChannel = "todo_changes"
+
+// TodoChange is one row change, as announced by Postgres. It only names the row;
+// subscribers read it themselves, so each sees it with its own visibility. Seq is the
+// id of the change in todo_events, Xid the transaction that made it, and Xmin the
+// oldest transaction still running then (migration 0041).
+type TodoChange struct {
+	Seq    int64  `json:"seq"`
+	Xid    int64  `json:"xid"`
+	Xmin   int64  `json:"xmin"`
+	Op     string `json:"op"` // "insert", "update" or "delete"
+	ID     int    `json:"id"`
+	UserID string `json:"user_id"`
+	ListID *int64 `json:"list_id"`
+}
+
+// ErrChangeFeedInterrupted ends a subscription whose events may have been lost: the
+// subscriber fell behind, or the connection to Postgres was re-established. The
+// subscriber should re-read the current state and subscribe again.
+var ErrChangeFeedInterrupted = errors.New("todo change feed interrupted")
+
+// TodoChangeHub fans out changes from the one Postgres listener of this replica to
+// every subscriber.
+type TodoChangeHub struct {
+	mu   sync.Mutex
+	subs map[*TodoSubscription]struct{}
+}
+
+// TodoSubscription receives changes on C until it is closed; Err then says why.
+type TodoSubscription struct {
+	C <-chan TodoChange
+
+	hub *TodoChangeHub
+	c   chan TodoChange
+	err error
+}
+
+func NewTodoChangeHub() *TodoChangeHub {
+	return &TodoChangeHub{subs: make(map[*TodoSubscription]struct{})}
+}
+
+// TodoChanges is the process-wide hub, fed by ListenTodoChanges.
+var TodoChanges = NewTodoChangeHub()
+
+// Subscribe returns a new subscription. Call Close when done with it.
+func (h *TodoChangeHub) Subscribe() *TodoSubscription {
+	c := make(chan TodoChange, 64)
+	s := &TodoSubscription{C: c, hub: h, c: c}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	TodoWatchers.Inc()
+	return s
+}
+
+// Close ends the subscription.
+func (s *TodoSubscription) Close() {
+	s.hub.drop(s, nil)
+}
+
+// Err reports why C was closed: nil after Close, ErrChangeFeedInterrupted otherwise.
+func (s *TodoSubscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Publish delivers c to every subscriber. A subscriber whose buffer is full is
+// dropped rather than blocking the others.
+func (h *TodoChangeHub) Publish(c TodoChange) {
+	h.mu.Lock()
+	var slow []*TodoSubscription
+	for s := range h.subs {
+		select {
+		case s.c <- c:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.Unlock()
+	for _, s := range slow {
+		h.drop(s, ErrChangeFeedInterrupted)
+	}
+}
+
+// Interrupt drops every subscriber, e.g. after changes may have been missed.
+func (h *TodoChangeHub) Interrupt() {
+	h.mu.Lock()
+	subs := make([]*TodoSubscription, 0, len(h.subs))
+	for s := range h.subs {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+	for _, s := range subs {
+		h.drop(s, ErrChangeFeedInterrupted)
+	}
+}
+
+func (h *TodoChangeHub) drop(s *TodoSubscription, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.err = err
+	close(s.c)
+	TodoWatchers.Dec()
+	if err != nil {
+		TodoWatchersDropped.Inc()
+	}
+}
+
+// visibleChange reports whether owner can see change c, and returns the todo after the
+// change: re-read with owner's visibility, or for a delete only its ID and ListID.
+// Personal todos of others are skipped without a query.
+func (s *Server) visibleChange(ctx context.Context, owner string, c TodoChange) (Todo, bool, error) {
+	if c.ListID == nil && c.UserID != owner {
+		return Todo{}, false, nil
+	}
+	switch c.Op {
+	case "delete":
+		if c.ListID != nil {
+			role, err := s.listRole(ctx, *c.ListID, owner)
+			if err != nil || role == "" {
+				return Todo{}, false, err
+			}
+		}
+		return Todo{ID: c.ID, ListID: c.ListID}, true, nil
+	case "insert", "update":
+		t, err := s.Todos.Get(ctx, owner, c.ID, true)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Todo{}, false, nil // not visible to owner, or already gone again
+		}
+		return t, err == nil, err
+	}
+	return Todo{}, false, nil
+}
+
+// TodoEventRetention is how long changes are kept in todo_events for resuming streams.
+var TodoEventRetention = 24 * time.Hour
+
+// eventPos is a position in todo_events that readers resume from: sync tokens and SSE
+// event ids. Event ids are taken before commit, so they do not follow commit order;
+// positions order events by their transaction and then id instead, and readers only
+// read up to the oldest transaction still running. Every change committed later comes
+// after any position handed out. As text it is "xid.seq"; a plain number, a token from
+// before migration 0041, is the start of the log.
+type eventPos struct {
+	Xid int64
+	Seq int64
+}
+
+func (p eventPos) String() string {
+	return strconv.FormatInt(p.Xid, 10) + "." + strconv.FormatInt(p.Seq, 10)
+}
+
+func (p eventPos) less(q eventPos) bool {
+	return p.Xid < q.Xid || p.Xid == q.Xid && p.Seq < q.Seq
+}
+
+func parseEventPos(s string) (eventPos, error) {
+	xid, seq, found := strings.Cut(s, ".")
+	if !found {
+		if n, err := strconv.ParseInt(s, 10, 64); err != nil || n < 0 {
+			return eventPos{}, fmt.Errorf("invalid position %q", s)
+		}
+		return eventPos{}, nil
+	}
+	var p eventPos
+	var err1, err2 error
+	p.Xid, err1 = strconv.ParseInt(xid, 10, 64)
+	p.Seq, err2 = strconv.ParseInt(seq, 10, 64)
+	if err1 != nil || err2 != nil || p.Xid < 0 || p.Seq < 0 {
+		return eventPos{}, fmt.Errorf("invalid position %q", s)
+	}
+	return p, nil
+}
+
+// todoEventWatermark selects the oldest transaction still running: every event below
+// it is committed or never will be, and none can be added.
+const todoEventWatermark = "SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint"
+
+// todoChangesSince returns up to limit changes after position after, in position
+// order, read from the primary since the replica may not have them yet. next is where
+// to resume after them: the last change once limit is reached, the watermark before.
+// ok is false when changes after the position were purged, so they are unknown.
+func (s *Server) todoChangesSince(ctx context.Context, after eventPos, limit int) (changes []TodoChange, next eventPos, ok bool, err error) {
+	err = s.ExecuteWithRobustness(func() error {
+		var xmin int64
+		if err := dbQueryRow(ctx, s.DB, "todo_event_watermark", todoEventWatermark).Scan(&xmin); err != nil {
+			return err
+		}
+		rows, err := dbQuery(ctx, s.DB, "todo_events_since",
+			"SELECT xid::text::bigint, id, op, todo_id, user_id, list_id FROM todo_events "+
+				"WHERE (xid, id) > ($1::xid8, $2) AND xid < $3::xid8 ORDER BY xid, id LIMIT $4", after.Xid, after.Seq, xmin, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		changes = changes[:0] // Reset on retry
+		for rows.Next() {
+			var c TodoChange
+			var userID sql.NullString
+			if err := rows.Scan(&c.Xid, &c.Seq, &c.Op, &c.ID, &userID, &c.ListID); err != nil {
+				return err
+			}
+			c.UserID = userID.String
+			changes = append(changes, c)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		// Read after the changes, so that a purge in between is noticed.
+		var horizon eventPos
+		if err := dbQueryRow(ctx, s.DB, "todo_event_horizon",
+			"SELECT xid::text::bigint, id FROM todo_event_horizon").Scan(&horizon.Xid, &horizon.Seq); err != nil {
+			return err
+		}
+		ok = !after.less(horizon)
+		next = after
+		if w := (eventPos{Xid: xmin}); after.less(w) {
+			next = w
+		}
+		if len(changes) == limit {
+			last := changes[len(changes)-1]
+			next = eventPos{Xid: last.Xid, Seq: last.Seq}
+		}
+		return nil
+	})
+	return changes, next, ok, err
+}
+
+// StartTodoEventJanitor deletes dispatched changes older than TodoEventRetention every
+// interval until ctx is cancelled. Undispatched ones stay until the outbox sinks have them.
+func (s *Server) StartTodoEventJanitor(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "todo_event_janitor", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			// The horizon moves up to the last change purged, in the same statement.
+			var n int64
+			err := dbQueryRow(ctx, s.DB, "purge_todo_events",
+				"WITH purged AS (DELETE FROM todo_events WHERE created_at < now() - $1 * interval '1 second' AND dispatched_at IS NOT NULL RETURNING xid, id), "+
+					"last AS (SELECT xid, id FROM purged ORDER BY xid DESC, id DESC LIMIT 1), "+
+					"moved AS (UPDATE todo_event_horizon h SET xid = last.xid, id = last.id FROM last WHERE (last.xid, last.id) > (h.xid, h.id)) "+
+					"SELECT count(*) FROM purged", TodoEventRetention.Seconds()).Scan(&n)
+			w.Checkpoint(err)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge old todo events", "error", err)
+				}
+				continue
+			}
+			if n > 0 {
+				slog.Debug("Purged old todo events", "count", n)
+			}
+		}
+	})
+}
+
+// ListenTodoChanges listens on the todo_changes channel of the primary and publishes
+// every notification to hub until ctx is cancelled. The listener reconnects on its
+// own; since notifications sent meanwhile are lost, subscribers are interrupted then.
+// It keeps the credentials it started with, which is fine for Cloud SQL IAM auth
+// (no password) but not across a password rotation.
+func ListenTodoChanges(ctx context.Context, hub *TodoChangeHub) error {
+	if primaryConnector == nil {
+		return errors.New("database not initialized")
+	}
+	l := pq.NewListener(*primaryConnector.dsn.Load(), time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			slog.Warn("Todo change listener disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			slog.Info("Todo change listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("Todo change listener failed to connect", "error", err)
+		}
+	})
+	if err := l.Listen(todoChangesChannel); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		defer l.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				hub.Interrupt()
+				return
+			case n := <-l.Notify:
+				if n == nil { // reconnected: anything sent while disconnected is gone
+					hub.Interrupt()
+					continue
+				}
+				var c TodoChange
+				if err := json.Unmarshal([]byte(n.Extra), &c); err != nil {
+					slog.Warn("Ignoring malformed todo change notification", "error", err)
+					continue
+				}
+				TodoChangeEvents.WithLabelValues(c.Op).Inc()
+				hub.Publish(c)
+			case <-time.After(90 * time.Second):
+				// Detect a dead connection even when nothing changes.
+				go l.Ping()
+			}
+		}
+	}()
+	slog.Info("Listening for todo changes", "channel", todoChangesChannel)
+	return nil
+}
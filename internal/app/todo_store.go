@@ -0,0 +1,344 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+	"github.com/sony/gobreaker"
+	"github.com/stevemcghee/go-to-production/internal/app/store"
+	"github.com/stevemcghee/go-to-production/internal/repository"
+)
+
+// The todo store is the Postgres TodoRepository, shared by the REST handlers and the
+// gRPC service through Server.Todos: every query is scoped to the owner, runs through
+// ExecuteWithRobustness and withTenant, and task text is encrypted and decrypted here,
+// outside the retry loop.
+
+var (
+	// errTodoForbidden is returned by createTodo for a list the owner may not edit.
+	errTodoForbidden = repository.ErrForbidden
+	// errTodoQuota is what todo writes refused by the todos or open todos quota are
+	// (see quotaError).
+	errTodoQuota = errors.New("todo quota exceeded")
+	// errTodoBlocked is returned by setTodoCompleted for a todo with open blockers.
+	errTodoBlocked = repository.ErrBlocked
+	// errInvalidTask is returned by every write of task text Postgres cannot store.
+	errInvalidTask = repository.ErrInvalidTask
+	// errTaskCipher wraps encryption failures: KMS trouble is not a database failure.
+	errTaskCipher = errors.New("encryption service unavailable")
+)
+
+// postgresTodos is the TodoRepository of NewServer, on the server's pools.
+type postgresTodos struct{ server *Server }
+
+func (p postgresTodos) List(ctx context.Context, owner string, f todoFilter) ([]Todo, error) {
+	return p.server.filterTodos(ctx, owner, f)
+}
+
+func (p postgresTodos) Get(ctx context.Context, owner string, id int, fromPrimary bool) (Todo, error) {
+	return p.server.getTodo(ctx, owner, id, fromPrimary)
+}
+
+func (p postgresTodos) Create(ctx context.Context, owner, task string, listID *int64) (Todo, error) {
+	return p.server.createTodo(ctx, owner, task, listID)
+}
+
+func (p postgresTodos) SetCompleted(ctx context.Context, owner string, id int, completed bool) (bool, error) {
+	return p.server.setTodoCompleted(ctx, owner, id, completed)
+}
+
+func (p postgresTodos) Delete(ctx context.Context, owner string, id int) (bool, error) {
+	return p.server.deleteTodo(ctx, owner, id)
+}
+
+// listTodos returns the todos owner can see, from s.Todos.
+func (s *Server) listTodos(ctx context.Context, owner string) ([]Todo, error) {
+	return s.Todos.List(ctx, owner, todoFilter{})
+}
+
+// filterTodos returns the todos owner can see that pass f. Reads go to the replica and
+// fall back to the primary if it fails.
+func (s *Server) filterTodos(ctx context.Context, owner string, f todoFilter) ([]Todo, error) {
+	arg := listTodosParams(f, owner)
+	todos, err := loadTodos(ctx, "list", owner, listTodosKey(arg), TodoCache.ListTTL, func(ctx context.Context) ([]Todo, error) {
+		todos := getTodoSlice()
+		err := s.withReplica(ctx, owner, func(q dbtx) error {
+			rows, err := queries(q).ListTodos(ctx, arg)
+			if err != nil {
+				return err
+			}
+			todos = todos[:0] // Reset slice on retry to avoid duplicates
+			for _, r := range rows {
+				todos = append(todos, todoFromRow(store.GetTodoRow(r)))
+			}
+			return nil
+		})
+		if err != nil {
+			putTodoSlice(todos)
+			return nil, err
+		}
+		return todos, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptTodos(ctx, todos); err != nil {
+		putTodoSlice(todos)
+		return nil, err
+	}
+	return todos, nil
+}
+
+// listTodosKey is the cache key of the ListTodos read of arg.
+func listTodosKey(arg store.ListTodosParams) string {
+	b, _ := json.Marshal(arg)
+	return todoCacheKey("list", "list_todos", string(b))
+}
+
+// scanTodo scans a row of todoColumns into t.
+func scanTodo(row interface{ Scan(...any) error }, t *Todo) error {
+	return row.Scan(&t.ID, &t.Task, &t.Completed, &t.ListID, &t.DueAt, &t.Priority, pq.Array(&t.Tags), &t.ParentID, &t.RRule, &t.RemindAt, &t.CreatedAt, &t.UpdatedAt, &t.CompletedAt, &t.Archived, &t.Starred)
+}
+
+// todoFromRow returns the todo of a row read by GetTodo, or by ListTodos, whose rows
+// convert to GetTodoRow.
+func todoFromRow(r store.GetTodoRow) Todo {
+	t := Todo{
+		ID: int(r.ID), Task: r.Task, Completed: r.Completed.Bool, ListID: r.ListID, DueAt: r.DueAt,
+		Priority: r.Priority, Tags: r.Tags, RRule: r.Rrule.String, RemindAt: r.RemindAt,
+		CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt, CompletedAt: r.CompletedAt,
+		Archived: r.Archived, Starred: r.Starred,
+	}
+	if r.ParentID != nil {
+		parentID := int(*r.ParentID)
+		t.ParentID = &parentID
+	}
+	return t
+}
+
+// decryptTodos decrypts the task text of todos in place.
+func (s *Server) decryptTodos(ctx context.Context, todos []Todo) error {
+	for i := range todos {
+		var err error
+		if todos[i].Task, err = s.decryptTask(ctx, todos[i].Task); err != nil {
+			slog.Error("Failed to decrypt task", "id", todos[i].ID, "error", err)
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+	}
+	return nil
+}
+
+// withReplica runs the read fn scoped to owner on the read replica, falling back to the
+// primary if it fails.
+func (s *Server) withReplica(ctx context.Context, owner string, fn func(q dbtx) error) error {
+	return s.ExecuteWithRobustness(func() error {
+		// Try read replica first
+		err := withTenant(ctx, s.DBRead, owner, fn)
+		if err != nil {
+			slog.Warn("Read replica failed, falling back to primary", "error", err)
+			// If read replica fails, fall back to primary
+			if s.DBRead != s.DB {
+				err = withTenant(ctx, s.DB, owner, fn)
+			}
+		}
+		return err
+	})
+}
+
+// getTodo returns todo id if owner can see it, or sql.ErrNoRows. fromPrimary skips the
+// replica and the cache, for reads right after a write that replication may not have
+// caught up with.
+func (s *Server) getTodo(ctx context.Context, owner string, id int, fromPrimary bool) (Todo, error) {
+	// Reads as a list of none or one, so that the cache also remembers misses.
+	read := func(ctx context.Context) ([]Todo, error) {
+		var row store.GetTodoRow
+		var found bool
+		get := func(q dbtx) error {
+			var err error
+			row, err = queries(q).GetTodo(ctx, store.GetTodoParams{Owner: owner, ID: int64(id)})
+			if err == sql.ErrNoRows {
+				found = false
+				return nil
+			}
+			found = err == nil
+			return err
+		}
+		err := s.ExecuteWithRobustness(func() error {
+			if !fromPrimary {
+				err := withTenant(ctx, s.DBRead, owner, get)
+				if err == nil || s.DBRead == s.DB {
+					return err
+				}
+				slog.Warn("Read replica failed, falling back to primary", "error", err)
+			}
+			return withTenant(ctx, s.DB, owner, get)
+		})
+		if err != nil || !found {
+			return nil, err
+		}
+		return []Todo{todoFromRow(row)}, nil
+	}
+	var todos []Todo
+	var err error
+	if fromPrimary {
+		todos, err = read(ctx)
+	} else {
+		todos, err = loadTodos(ctx, "todo", owner, todoCacheKey("todo", "get_todo", owner, id), TodoCache.TodoTTL, read)
+	}
+	if err != nil {
+		return Todo{}, err
+	}
+	if len(todos) == 0 {
+		return Todo{}, sql.ErrNoRows
+	}
+	t := todos[0]
+	putTodoSlice(todos)
+	return s.decryptedTodo(ctx, t)
+}
+
+// decryptedTodo returns t with its task text decrypted.
+func (s *Server) decryptedTodo(ctx context.Context, t Todo) (Todo, error) {
+	var err error
+	if t.Task, err = s.decryptTask(ctx, t.Task); err != nil {
+		slog.Error("Failed to decrypt task", "id", t.ID, "error", err)
+		return Todo{}, fmt.Errorf("%w: %v", errTaskCipher, err)
+	}
+	return t, nil
+}
+
+// createTodo inserts a todo for owner, into listID if set. Adding to a list requires an
+// owner or editor role; the check and the insert are one statement. Task text Postgres
+// cannot store is errInvalidTask, before it reaches the database.
+func (s *Server) createTodo(ctx context.Context, owner, task string, listID *int64) (Todo, error) {
+	if err := repository.CheckTask(task); err != nil {
+		return Todo{}, err
+	}
+	t := Todo{Task: task, ListID: listID, Priority: PriorityNormal}
+	stored, err := s.encryptTask(ctx, task)
+	if err != nil {
+		slog.Error("Failed to encrypt task", "error", err)
+		return Todo{}, fmt.Errorf("%w: %v", errTaskCipher, err)
+	}
+
+	var allowed, batched bool
+	var overQuota *quotaError
+	if WriteBatching.Enabled && s.CB.State() != gobreaker.StateOpen {
+		row, inserted, err := s.batchInsertTodo(ctx, stored, owner, listID)
+		if err == nil {
+			batched, allowed = true, inserted
+			t.ID, t.Completed, t.CreatedAt, t.UpdatedAt = int(row.ID), row.Completed, row.CreatedAt, row.UpdatedAt
+		} else {
+			slog.Warn("Batched insert failed, inserting the todo on its own", "error", err)
+			TodoInsertBatchFallbacks.Inc()
+		}
+	}
+	if !batched {
+		err = s.ExecuteWithRobustness(func() error {
+			err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+				row, err := queries(q).InsertTodo(ctx, store.InsertTodoParams{Task: stored, Owner: owner, ListID: listID})
+				t.ID, t.Completed, t.CreatedAt, t.UpdatedAt = int(row.ID), row.Completed.Bool, row.CreatedAt, row.UpdatedAt
+				return err
+			})
+			// Like a forbidden list, a full quota is an answer, not a database failure.
+			overQuota = asQuotaError(err)
+			if err == sql.ErrNoRows || overQuota != nil {
+				allowed = false
+				return nil
+			}
+			allowed = err == nil
+			return err
+		})
+	}
+	if err != nil {
+		slog.Error("Failed to insert todo", "error", err)
+		return Todo{}, err
+	}
+	if overQuota != nil {
+		return Todo{}, overQuota
+	}
+	if !allowed {
+		return Todo{}, errTodoForbidden
+	}
+	slog.Info("Successfully added todo", "id", t.ID)
+	recordTodoAdded()
+	return t, nil
+}
+
+// setTodoCompleted updates todo id and reports whether owner could change it. A todo
+// with open blockers is not completed: that is errTodoBlocked.
+func (s *Server) setTodoCompleted(ctx context.Context, owner string, id int, completed bool) (bool, error) {
+	var found bool
+	var row store.UpdateTodoRow
+	var overQuota *quotaError
+	err := s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			var err error
+			row, err = queries(q).UpdateTodo(ctx, store.UpdateTodoParams{Completed: completed, ID: int64(id), Owner: owner})
+			return err
+		})
+		// Reopening a todo counts against the open todos quota.
+		if overQuota = asQuotaError(err); overQuota != nil {
+			return nil
+		}
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if overQuota != nil {
+		return true, overQuota
+	}
+	if row.Blocked {
+		return true, errTodoBlocked
+	}
+	if found {
+		recordTodoUpdated(row.WasCompleted, completed, row.SecondsOpen)
+	}
+	if found && completed && !row.WasCompleted && row.Recurring {
+		// The todo is completed either way; a job that cannot be queued only ends
+		// the series, which the log says.
+		if _, err := s.EnqueueJob(ctx, recurrenceJob, owner, recurrencePayload{TodoID: id}); err != nil {
+			slog.Error("Failed to queue the next occurrence", "id", id, "error", err)
+		}
+	}
+	return found, nil
+}
+
+// deleteTodo deletes todo id and reports whether owner could delete it.
+func (s *Server) deleteTodo(ctx context.Context, owner string, id int) (bool, error) {
+	var found, wasCompleted bool
+	err := s.ExecuteWithRobustness(func() error {
+		err := withTenant(ctx, s.DB, owner, func(q dbtx) error {
+			var err error
+			wasCompleted, err = queries(q).DeleteTodo(ctx, store.DeleteTodoParams{ID: int64(id), Owner: owner})
+			return err
+		})
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if found {
+		recordTodoDeleted(wasCompleted)
+	}
+	return found, nil
+}
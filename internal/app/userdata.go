@@ -0,0 +1,322 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Users can take their data with them and have it erased:
+//
+//	POST /me/export  starts an export of everything stored about the caller, a zip
+//	                 archive that is downloaded like any export (see /exports)
+//	POST /me/delete  {"confirm": true} erases the caller's data
+//
+// An erasure deletes what only the user has: their personal todos, the lists they
+// own, their comments, settings, sessions, webhooks and so on. What they added to
+// lists that other people still use stays, attributed to a random pseudonym instead
+// of them, and lists they own that have other members are handed to the longest
+// standing of those. Each erasure is recorded in the erasures table, which keeps a
+// hash of the subject, never the subject itself.
+
+var UserErasures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "user_erasures_total",
+		Help: "Total number of erasures of a user's data",
+	},
+	[]string{"result"}, // "erased", "failed"
+)
+
+// HandleMyExport serves POST /me/export.
+func (s *Server) HandleMyExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if TodoOwner(r.Context()) == anonymousOwner {
+		http.Error(w, "Sign in to export your data", http.StatusUnauthorized)
+		return
+	}
+	s.createExport(w, r, "zip")
+}
+
+// userProfile is the account of a user who signed in with an identity provider.
+type userProfile struct {
+	Subject     string     `json:"subject"`
+	Provider    string     `json:"provider,omitempty"`
+	Email       string     `json:"email,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// writeUserArchive writes the zip archive of owner's data, with todos being the todos
+// they can see. Each file is a JSON document.
+func (s *Server) writeUserArchive(ctx context.Context, out io.Writer, owner string, todos []Todo) error {
+	profile := userProfile{Subject: owner}
+	var comments []Comment
+	var attachments []Attachment
+	err := s.ExecuteWithRobustness(func() error {
+		var provider, email, name string
+		var created, lastLogin time.Time
+		err := dbQueryRow(ctx, s.DBRead, "export_user",
+			"SELECT provider, email, name, created_at, last_login_at FROM users WHERE subject = $1", owner).
+			Scan(&provider, &email, &name, &created, &lastLogin)
+		switch {
+		case err == nil:
+			profile = userProfile{owner, provider, email, name, &created, &lastLogin}
+		case err != sql.ErrNoRows:
+			return err
+		}
+
+		rows, err := dbQuery(ctx, s.DBRead, "export_comments",
+			"SELECT id, todo_id, author, body, created_at FROM todo_comments WHERE author = $1 ORDER BY id", owner)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		comments = []Comment{} // Reset on retry
+		for rows.Next() {
+			var c Comment
+			if err := rows.Scan(&c.ID, &c.TodoID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+				return err
+			}
+			comments = append(comments, c)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = dbQuery(ctx, s.DBRead, "export_attachments",
+			"SELECT id, todo_id, name, content_type, size, status, uploader, created_at FROM todo_attachments WHERE uploader = $1 ORDER BY id", owner)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		attachments = []Attachment{}
+		for rows.Next() {
+			var a Attachment
+			if err := rows.Scan(&a.ID, &a.TodoID, &a.Name, &a.ContentType, &a.Size, &a.Status, &a.Uploader, &a.CreatedAt); err != nil {
+				return err
+			}
+			attachments = append(attachments, a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.decryptComments(ctx, comments); err != nil {
+		return err
+	}
+	for i := range attachments {
+		if attachments[i].Name, err = s.decryptTask(ctx, attachments[i].Name); err != nil {
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+	}
+	settings, err := s.getUserSettings(ctx, owner)
+	if err != nil {
+		return err
+	}
+	lists, err := s.userLists(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(out)
+	for _, f := range []struct {
+		name string
+		v    any
+	}{
+		{"profile.json", profile},
+		{"settings.json", settings},
+		{"lists.json", lists},
+		{"todos.json", todos},
+		{"comments.json", comments},
+		{"attachments.json", attachments}, // metadata; the files are downloaded from their todos
+	} {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.v); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Erasure is the record of an erasure of a user's data: how many rows of each table
+// were deleted, and how many were kept for other users under Pseudonym.
+type Erasure struct {
+	ID              int64            `json:"id"`
+	Pseudonym       string           `json:"pseudonym"`
+	Erased          map[string]int64 `json:"erased"`
+	Anonymized      map[string]int64 `json:"anonymized"`
+	ListsHandedOver int64            `json:"lists_handed_over"`
+	CreatedAt       time.Time        `json:"created_at"`
+}
+
+// handOverListsQuery gives the lists that $1 owns and others are members of to the
+// member who has been on each the longest, preferring owners and editors.
+const handOverListsQuery = `WITH heirs AS (
+	SELECT DISTINCT ON (m.list_id) m.list_id, m.user_id
+	FROM list_members m JOIN todo_lists l ON l.id = m.list_id
+	WHERE l.owner_id = $1 AND m.user_id <> $1
+	ORDER BY m.list_id, m.role = 'owner' DESC, m.role = 'editor' DESC, m.added_at, m.user_id
+), lists AS (
+	UPDATE todo_lists l SET owner_id = h.user_id FROM heirs h WHERE l.id = h.list_id RETURNING l.id, h.user_id
+)
+UPDATE list_members m SET role = 'owner' FROM lists WHERE m.list_id = lists.id AND m.user_id = lists.user_id`
+
+// erasureSteps erase the data of subject $1, in order. The steps that keep rows for
+// other users replace $1 in them with the pseudonym $2. Attachment files go with
+// their rows, through attachment_orphans.
+var erasureSteps = []struct {
+	table string
+	keep  bool
+	query string
+}{
+	{"todo_lists", false, `DELETE FROM todo_lists WHERE owner_id = $1`},
+	{"list_members", false, `DELETE FROM list_members WHERE user_id = $1`},
+	{"todos", false, `DELETE FROM todos WHERE user_id = $1 AND list_id IS NULL`},
+	{"todo_comments", false, `DELETE FROM todo_comments WHERE author = $1`},
+	{"todos", true, `UPDATE todos SET user_id = $2 WHERE user_id = $1`},
+	{"todo_attachments", true, `UPDATE todo_attachments SET uploader = $2 WHERE uploader = $1`},
+	{"todo_activity", true, `UPDATE todo_activity SET actor = $2 WHERE actor = $1`},
+	{"todo_events", true, `UPDATE todo_events SET user_id = $2 WHERE user_id = $1`},
+	{"list_members", true, `UPDATE list_members SET added_by = $2 WHERE added_by = $1`},
+	{"user_settings", false, `DELETE FROM user_settings WHERE subject = $1`},
+	{"notification_preferences", false, `DELETE FROM notification_preferences WHERE subject = $1`},
+	{"email_outbox", false, `DELETE FROM email_outbox WHERE user_id = $1`},
+	{"calendar_feeds", false, `DELETE FROM calendar_feeds WHERE subject = $1`},
+	{"webhooks", false, `DELETE FROM webhooks WHERE owner_id = $1`},
+	{"exports", false, `DELETE FROM exports WHERE owner_id = $1`},
+	{"jobs", false, `DELETE FROM jobs WHERE owner_id = $1 AND status <> 'running'`},
+	{"idempotency_keys", false, `DELETE FROM idempotency_keys WHERE owner_id = $1`},
+	{"quotas", false, `DELETE FROM quotas WHERE subject = $1`},
+	{"usage_minutely", false, `DELETE FROM usage_minutely WHERE subject = $1`},
+	{"usage_daily", false, `DELETE FROM usage_daily WHERE subject = $1`},
+	{"sessions", false, `DELETE FROM sessions WHERE subject = $1`},
+	{"users", false, `DELETE FROM users WHERE subject = $1`},
+}
+
+// subjectHash identifies subject in the erasure records without keeping it.
+func subjectHash(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
+
+// EraseUserData erases the data of subject, all of it or, on an error, none of it.
+func (s *Server) EraseUserData(ctx context.Context, subject string) (Erasure, error) {
+	pseudonym := "erased:" + s.IDs.NewID(8)
+	var e Erasure
+	err := s.ExecuteWithRobustness(func() error {
+		e = Erasure{Pseudonym: pseudonym, Erased: map[string]int64{}, Anonymized: map[string]int64{}}
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := dbExec(ctx, tx, "set_tenant", "SELECT set_config('app.current_tenant', $1, true)", systemTenant); err != nil {
+			return err
+		}
+		res, err := dbExec(ctx, tx, "hand_over_lists", handOverListsQuery, subject)
+		if err != nil {
+			return err
+		}
+		if e.ListsHandedOver, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for _, step := range erasureSteps {
+			args, counts := []any{subject}, e.Erased
+			if step.keep {
+				args, counts = append(args, e.Pseudonym), e.Anonymized
+			}
+			res, err := dbExec(ctx, tx, "erase_"+step.table, step.query, args...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			counts[step.table] += n
+		}
+		erased, _ := json.Marshal(e.Erased)
+		anonymized, _ := json.Marshal(e.Anonymized)
+		err = dbQueryRow(ctx, tx, "insert_erasure",
+			`INSERT INTO erasures (subject_hash, pseudonym, erased, anonymized, lists_handed_over, request_id)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+			subjectHash(subject), e.Pseudonym, erased, anonymized, e.ListsHandedOver, RequestIDFromContext(ctx)).Scan(&e.ID, &e.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return e, err
+}
+
+// HandleMyDelete serves POST /me/delete.
+func (s *Server) HandleMyDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	subject := TodoOwner(ctx)
+	if subject == anonymousOwner {
+		http.Error(w, "Sign in to delete your data", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Confirm bool `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Confirm {
+		http.Error(w, `Send {"confirm": true} to erase all of your data; this cannot be undone`, http.StatusBadRequest)
+		return
+	}
+
+	e, err := s.EraseUserData(ctx, subject)
+	if err != nil {
+		UserErasures.WithLabelValues("failed").Inc()
+		slog.Error("Failed to erase user data", "subject_hash", subjectHash(subject), "error", err)
+		writeDBError(w, err)
+		return
+	}
+	UserErasures.WithLabelValues("erased").Inc()
+	slog.Info("Erased user data",
+		"audit", true,
+		"event", "user_erasure",
+		"erasure_id", e.ID,
+		"subject_hash", subjectHash(subject),
+		"pseudonym", e.Pseudonym,
+		"erased", e.Erased,
+		"anonymized", e.Anonymized,
+		"lists_handed_over", e.ListsHandedOver,
+		"request_id", RequestIDFromContext(ctx),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		slog.Error("Failed to encode erasure", "error", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Build metadata, injected at build time with:
+//
+//	go build -ldflags "-X github.com/stevemcghee/go-to-production/internal/app.Version=v1.2.3 \
+//	  -X github.com/stevemcghee/go-to-production/internal/app.GitCommit=$(git rev-parse HEAD) \
+//	  -X github.com/stevemcghee/go-to-production/internal/app.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When not injected, values fall back to the VCS information Go embeds in the binary.
+var (
+	Version   = ""
+	GitCommit = ""
+	BuildTime = ""
+)
+
+var BuildInfoGauge = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Build information about the running binary (always 1)",
+	},
+	[]string{"version", "commit", "build_time", "go_version"},
+)
+
+// BuildInfo describes exactly what binary is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified"` // built from a dirty working tree
+}
+
+var (
+	buildInfoOnce sync.Once
+	buildInfo     BuildInfo
+)
+
+// GetBuildInfo returns the build metadata, resolved once.
+func GetBuildInfo() BuildInfo {
+	buildInfoOnce.Do(func() {
+		buildInfo = BuildInfo{
+			Version:   Version,
+			GitCommit: GitCommit,
+			BuildTime: BuildTime,
+			GoVersion: runtime.Version(),
+		}
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			if buildInfo.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+				buildInfo.Version = bi.Main.Version
+			}
+			for _, s := range bi.Settings {
+				switch s.Key {
+				case "vcs.revision":
+					if buildInfo.GitCommit == "" {
+						buildInfo.GitCommit = s.Value
+					}
+				case "vcs.time":
+					if buildInfo.BuildTime == "" {
+						buildInfo.BuildTime = s.Value
+					}
+				case "vcs.modified":
+					buildInfo.Modified = s.Value == "true"
+				}
+			}
+		}
+		if buildInfo.Version == "" {
+			buildInfo.Version = "dev"
+		}
+		if buildInfo.GitCommit == "" {
+			buildInfo.GitCommit = "unknown"
+		}
+		if buildInfo.BuildTime == "" {
+			buildInfo.BuildTime = "unknown"
+		}
+	})
+	return buildInfo
+}
+
+// RecordBuildInfo exports the build_info metric.
+func RecordBuildInfo() {
+	bi := GetBuildInfo()
+	BuildInfoGauge.WithLabelValues(bi.Version, bi.GitCommit, bi.BuildTime, bi.GoVersion).Set(1)
+}
+
+// VersionHandler serves GET /version: the build metadata and the fingerprint of the
+// running configuration, so replicas can be compared on both.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := struct {
+		BuildInfo
+		Config ConfigStatus `json:"config"`
+	}{GetBuildInfo(), GetConfigStatus()}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Failed to encode version", "error", err)
+	}
+}
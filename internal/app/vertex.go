@@ -0,0 +1,101 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/aiplatform/v1"
+	"google.golang.org/api/option"
+)
+
+// suggestionInstruction is the system instruction of the subtask suggestion model.
+const suggestionInstruction = `You help people break a todo item down into subtasks.
+Propose up to 10 short, concrete subtasks that together complete the todo, in the order
+they would be done, written in the language of the todo. Also propose up to 3 short
+lowercase tags that categorize it, such as "work", "home" or "errands", preferring its
+existing tags' style. Propose nothing for a todo that is already a single step.`
+
+// suggestionSchema is the JSON the model must answer with.
+var suggestionSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"subtasks": map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "maxItems": maxSuggestedSubtasks},
+		"tags":     map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "maxItems": 3},
+	},
+	"required": []string{"subtasks", "tags"},
+}
+
+// VertexSuggester proposes subtasks with a Gemini model on Vertex AI. The service's
+// identity needs roles/aiplatform.user in the project.
+type VertexSuggester struct {
+	model  string // projects/<p>/locations/<l>/publishers/google/models/<m>
+	models *aiplatform.ProjectsLocationsPublishersModelsService
+}
+
+// NewVertexSuggester returns a suggester calling model, e.g. gemini-2.5-flash, in
+// project and location, e.g. us-central1 or global.
+func NewVertexSuggester(ctx context.Context, project, location, model string, opts ...option.ClientOption) (*VertexSuggester, error) {
+	if project == "" || location == "" || model == "" || strings.Contains(model, "/") {
+		return nil, fmt.Errorf("invalid Vertex AI model %q in %q, %q", model, project, location)
+	}
+	if location != "global" {
+		opts = append([]option.ClientOption{option.WithEndpoint("https://" + location + "-aiplatform.googleapis.com/")}, opts...)
+	}
+	svc, err := aiplatform.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Vertex AI client: %w", err)
+	}
+	return &VertexSuggester{
+		model:  fmt.Sprintf("projects/%s/locations/%s/publishers/google/models/%s", project, location, model),
+		models: svc.Projects.Locations.Publishers.Models,
+	}, nil
+}
+
+func (v *VertexSuggester) SuggestSubtasks(ctx context.Context, task string, tags []string) (Suggestion, error) {
+	prompt := "Todo: " + task
+	if len(tags) > 0 {
+		prompt += "\nTags: " + strings.Join(tags, ", ")
+	}
+	resp, err := v.models.GenerateContent(v.model, &aiplatform.GoogleCloudAiplatformV1GenerateContentRequest{
+		SystemInstruction: &aiplatform.GoogleCloudAiplatformV1Content{
+			Parts: []*aiplatform.GoogleCloudAiplatformV1Part{{Text: suggestionInstruction}},
+		},
+		Contents: []*aiplatform.GoogleCloudAiplatformV1Content{{
+			Role:  "user",
+			Parts: []*aiplatform.GoogleCloudAiplatformV1Part{{Text: prompt}},
+		}},
+		GenerationConfig: &aiplatform.GoogleCloudAiplatformV1GenerationConfig{
+			ResponseMimeType:   "application/json",
+			ResponseJsonSchema: suggestionSchema,
+			Temperature:        0.2,
+			MaxOutputTokens:    1024,
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return Suggestion{}, err
+	}
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		if f := resp.PromptFeedback; f != nil && f.BlockReason != "" {
+			return Suggestion{}, fmt.Errorf("prompt blocked: %s", f.BlockReason)
+		}
+		return Suggestion{}, errors.New("model returned no candidates")
+	}
+	var text strings.Builder
+	for _, p := range resp.Candidates[0].Content.Parts {
+		if !p.Thought {
+			text.WriteString(p.Text)
+		}
+	}
+	var s Suggestion
+	if err := json.Unmarshal([]byte(text.String()), &s); err != nil {
+		return Suggestion{}, fmt.Errorf("model answered with invalid JSON (finish reason %s): %w", resp.Candidates[0].FinishReason, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,138 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Warmup fills the connection pools before the pod takes traffic (database.warmup_conns).
+// A new pod otherwise starts with one connection per pool, from its ping, and the first
+// burst after a deploy pays for TCP, TLS and IAM authentication through the Cloud SQL
+// Proxy on every request that finds no idle connection. Conns connections are opened
+// in each pool and each runs warmupQuery, which also loads the catalog of the hot
+// tables into its backend. The pools keep at least Conns idle connections afterwards.
+var Warmup = struct {
+	Conns   int
+	Timeout time.Duration
+}{Timeout: 30 * time.Second}
+
+// warmupQuery touches the todos table without reading from it.
+const warmupQuery = "SELECT 1 FROM todos WHERE false"
+
+// WarmupStatus is the progress of the warm-up, as GET /readyz shows it. State is
+// "off", "running", "done" or "failed"; a failed warm-up does not keep the pod unready,
+// as it only costs latency.
+type WarmupStatus struct {
+	State    string `json:"state"`
+	Conns    int    `json:"conns"` // opened per pool
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var warmupStatus atomic.Pointer[WarmupStatus]
+
+func init() {
+	warmupStatus.Store(&WarmupStatus{State: "off"})
+}
+
+// maxIdleConns is the most idle connections a pool keeps: database/sql's default of 2,
+// or Warmup.Conns if more, so that warm connections are not closed on their way back.
+func maxIdleConns() int {
+	return max(2, Warmup.Conns)
+}
+
+// StartDBWarmup warms up the primary pool and the replica pool, if distinct, in the
+// background. GET /readyz fails until it is done.
+func (s *Server) StartDBWarmup(ctx context.Context) {
+	if Warmup.Conns <= 0 {
+		return
+	}
+	warmupStatus.Store(&WarmupStatus{State: "running"})
+	go s.warmUpDB(ctx)
+}
+
+func (s *Server) warmUpDB(ctx context.Context) {
+	start := s.Clock.Now()
+	ctx, cancel := context.WithTimeout(ctx, Warmup.Timeout)
+	defer cancel()
+	err := warmPool(ctx, "primary", s.DB)
+	if s.DBRead != s.DB {
+		err = errors.Join(err, warmPool(ctx, "replica", s.DBRead))
+	}
+	status := &WarmupStatus{State: "done", Conns: Warmup.Conns, Duration: s.Clock.Now().Sub(start).Round(time.Millisecond).String()}
+	if err != nil {
+		status.State, status.Error = "failed", err.Error()
+		slog.Warn("Database warm-up failed, serving anyway", "error", err, "duration", status.Duration)
+	} else {
+		slog.Info("Database pools warmed up", "conns", Warmup.Conns, "duration", status.Duration)
+	}
+	warmupStatus.Store(status)
+}
+
+// warmPool opens Warmup.Conns connections in db at once, so that each is a new one,
+// runs warmupQuery on each and hands them back to the pool.
+func warmPool(ctx context.Context, name string, db *sql.DB) error {
+	db.SetMaxIdleConns(maxIdleConns())
+	conns := make([]*sql.Conn, 0, Warmup.Conns)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for range Warmup.Conns {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		rows, err := c.QueryContext(ctx, warmupQuery)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// readiness is the body of GET /readyz.
+type readiness struct {
+	Status string        `json:"status"`
+	Warmup *WarmupStatus `json:"warmup"`
+}
+
+// ReadyzHandler serves GET /readyz, the readiness probe: like /healthz, but it also
+// fails while the pools are warming up, so that the Service sends the pod no traffic
+// before they are.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := warmupStatus.Load()
+	resp := readiness{"ready", status}
+	code := http.StatusOK
+	switch {
+	case s.DB == nil:
+		resp.Status, code = "database connection not initialized", http.StatusServiceUnavailable
+	case status.State == "running":
+		resp.Status, code = "warming up", http.StatusServiceUnavailable
+	default:
+		if err := s.DB.PingContext(r.Context()); err != nil {
+			resp.Status, code = "database connection failed", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Failed to write readiness response", "error", err)
+	}
+}
@@ -0,0 +1,833 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	WebhookDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Total number of webhook delivery attempts, by outcome",
+		},
+		[]string{"result"}, // "delivered", "retry", "dead"
+	)
+	WebhookDeliveryDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "webhook_delivery_duration_seconds",
+			Help:    "Duration of webhook delivery attempts",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+// Webhook settings. A delivery is attempted WebhookMaxAttempts times, with exponential
+// backoff from one minute, before it is dead-lettered. Finished deliveries are kept
+// for WebhookDeliveryRetention. Callback URLs must be public HTTPS endpoints unless
+// WebhookAllowPrivateTargets is set (for development and tests).
+var (
+	WebhookTimeout             = 10 * time.Second
+	WebhookMaxAttempts         = 8
+	WebhookDeliveryRetention   = 7 * 24 * time.Hour
+	WebhookAllowPrivateTargets = false
+)
+
+const (
+	webhookBackoffBase  = time.Minute
+	webhookBackoffMax   = 6 * time.Hour
+	webhookLease        = 2 * time.Minute // a claimed delivery is retried after this if its replica dies
+	webhookBatchSize    = 20
+	webhookSignatureHdr = "X-Todo-Signature"
+)
+
+// WebhookEventTypes are the events a webhook can subscribe to.
+var WebhookEventTypes = []string{"todo.created", "todo.updated", "todo.deleted"}
+
+// Webhook is a registered callback URL. The secret is only returned when it is set.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	EventSeq       int64      `json:"event_seq"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"` // "pending", "delivered" or "dead"
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int       `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+var errWebhookTarget = errors.New("webhook target address is not public")
+
+// HandleWebhooks serves /webhooks: GET lists the caller's webhooks, POST registers one.
+func (s *Server) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if TodoOwner(r.Context()) == anonymousOwner {
+		http.Error(w, "Sign in to use webhooks", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.listWebhooks(w, r)
+	case http.MethodPost:
+		s.createWebhook(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleWebhook serves a single webhook of the caller:
+//
+//	GET, PUT, DELETE /webhooks/{id}
+//	GET  /webhooks/{id}/deliveries                   the delivery log, newest first (?status=dead&before=<id>)
+//	POST /webhooks/{id}/deliveries/{delivery}/retry  send a finished delivery again
+func (s *Server) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	owner := TodoOwner(r.Context())
+	if owner == anonymousOwner {
+		http.Error(w, "Sign in to use webhooks", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.getWebhook(w, r, owner, id)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		s.updateWebhook(w, r, owner, id)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteWebhook(w, r, owner, id)
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		s.listWebhookDeliveries(w, r, owner, id)
+	case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "retry" && r.Method == http.MethodPost:
+		delivery, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+			return
+		}
+		s.retryWebhookDelivery(w, r, owner, id, delivery)
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "deliveries") || (len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "retry"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// webhookRequest is the body of POST and PUT. On PUT an empty secret keeps the current one.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+	Secret string   `json:"secret"`
+}
+
+// validate checks the request and fills in the defaults: all events, active.
+func (req *webhookRequest) validate() error {
+	if err := validateWebhookURL(req.URL); err != nil {
+		return err
+	}
+	if len(req.Events) == 0 {
+		req.Events = WebhookEventTypes
+	}
+	for _, ev := range req.Events {
+		if !slices.Contains(WebhookEventTypes, ev) {
+			return fmt.Errorf("unknown event %q, use %s", ev, strings.Join(WebhookEventTypes, ", "))
+		}
+	}
+	if req.Active == nil {
+		active := true
+		req.Active = &active
+	}
+	if req.Secret != "" && len(req.Secret) < 16 {
+		return errors.New("secret must be at least 16 characters")
+	}
+	return nil
+}
+
+// validateWebhookURL accepts absolute https URLs (http too with
+// WebhookAllowPrivateTargets). Whether the host is public is checked when connecting,
+// since DNS can change after registration.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("url must be an absolute URL")
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || !WebhookAllowPrivateTargets) {
+		return errors.New("url must use https")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = newWebhookSecret()
+	}
+	sealed, err := s.encryptTask(r.Context(), req.Secret)
+	if err != nil {
+		writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+		return
+	}
+
+	owner := TodoOwner(r.Context())
+	wh := Webhook{URL: req.URL, Events: req.Events, Active: *req.Active, Secret: req.Secret}
+	err = s.ExecuteWithRobustness(func() error {
+		return dbQueryRow(r.Context(), s.DB, "insert_webhook",
+			"INSERT INTO webhooks (owner_id, url, secret, events, active) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+			owner, wh.URL, sealed, pq.Array(wh.Events), wh.Active).Scan(&wh.ID, &wh.CreatedAt)
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	slog.Info("Registered webhook", "id", wh.ID, "owner", owner)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/webhooks/%d", wh.ID))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(wh); err != nil {
+		slog.Error("Failed to encode webhook", "error", err)
+	}
+}
+
+const selectWebhookColumns = "SELECT id, url, events, active, created_at FROM webhooks"
+
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var wh Webhook
+	err := row.Scan(&wh.ID, &wh.URL, pq.Array(&wh.Events), &wh.Active, &wh.CreatedAt)
+	return wh, err
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks := []Webhook{}
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(r.Context(), s.DBRead, "list_webhooks",
+			selectWebhookColumns+" WHERE owner_id = $1 ORDER BY id", TodoOwner(r.Context()))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		webhooks = webhooks[:0]
+		for rows.Next() {
+			wh, err := scanWebhook(rows)
+			if err != nil {
+				return err
+			}
+			webhooks = append(webhooks, wh)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(webhooks); err != nil {
+		slog.Error("Failed to encode webhooks", "error", err)
+	}
+}
+
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request, owner string, id int64) {
+	var wh Webhook
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		wh, err = scanWebhook(dbQueryRow(r.Context(), s.DB, "get_webhook",
+			selectWebhookColumns+" WHERE id = $1 AND owner_id = $2", id, owner))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(wh); err != nil {
+		slog.Error("Failed to encode webhook", "error", err)
+	}
+}
+
+// updateWebhook replaces the URL, events and active flag, and rotates the secret if
+// one is given. Deliveries already queued are sent to the new URL.
+func (s *Server) updateWebhook(w http.ResponseWriter, r *http.Request, owner string, id int64) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var sealed string // empty keeps the secret
+	if req.Secret != "" {
+		var err error
+		if sealed, err = s.encryptTask(r.Context(), req.Secret); err != nil {
+			writeTodoError(w, fmt.Errorf("%w: %v", errTaskCipher, err))
+			return
+		}
+	}
+
+	var wh Webhook
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		wh, err = scanWebhook(dbQueryRow(r.Context(), s.DB, "update_webhook",
+			`UPDATE webhooks SET url = $3, events = $4, active = $5, secret = COALESCE(NULLIF($6, ''), secret)
+			WHERE id = $1 AND owner_id = $2 RETURNING id, url, events, active, created_at`,
+			id, owner, req.URL, pq.Array(req.Events), *req.Active, sealed))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	wh.Secret = req.Secret
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(wh); err != nil {
+		slog.Error("Failed to encode webhook", "error", err)
+	}
+}
+
+// deleteWebhook removes the webhook with its delivery log; pending deliveries are dropped.
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request, owner string, id int64) {
+	var n int64
+	err := s.ExecuteWithRobustness(func() error {
+		res, err := dbExec(r.Context(), s.DB, "delete_webhook", "DELETE FROM webhooks WHERE id = $1 AND owner_id = $2", id, owner)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Deleted webhook", "id", id, "owner", owner)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const selectDeliveryColumns = `SELECT d.id, d.event_seq, d.event_type, d.status, d.attempts, d.next_attempt_at,
+	d.last_status_code, d.last_error, d.created_at, d.completed_at
+	FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id`
+
+func scanDelivery(row interface{ Scan(...any) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var next time.Time
+	var code sql.NullInt64
+	var completed sql.NullTime
+	err := row.Scan(&d.ID, &d.EventSeq, &d.EventType, &d.Status, &d.Attempts, &next, &code, &d.LastError, &d.CreatedAt, &completed)
+	if d.Status == "pending" {
+		d.NextAttemptAt = &next
+	}
+	if code.Valid {
+		c := int(code.Int64)
+		d.LastStatusCode = &c
+	}
+	if completed.Valid {
+		d.CompletedAt = &completed.Time
+	}
+	return d, err
+}
+
+// listWebhookDeliveries returns the delivery log of a webhook: up to ?limit (default
+// 50, at most 200) deliveries, optionally only those with ?status. ?before=<id> pages
+// back from the last delivery of the previous page.
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, owner string, id int64) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "delivered" && status != "dead" {
+		http.Error(w, "status must be pending, delivered or dead", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query := selectDeliveryColumns + " WHERE d.webhook_id = $1 AND w.owner_id = $2 AND ($3 = '' OR d.status = $3)"
+	args := []any{id, owner, status, limit}
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before delivery ID", http.StatusBadRequest)
+			return
+		}
+		query += " AND d.id < $5"
+		args = append(args, before)
+	}
+	query += " ORDER BY d.id DESC LIMIT $4"
+
+	var found bool
+	deliveries := []WebhookDelivery{}
+	err := s.ExecuteWithRobustness(func() error {
+		if err := dbQueryRow(r.Context(), s.DB, "webhook_exists",
+			"SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND owner_id = $2)", id, owner).Scan(&found); err != nil || !found {
+			return err
+		}
+		rows, err := dbQuery(r.Context(), s.DB, "list_webhook_deliveries", query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		deliveries = deliveries[:0]
+		for rows.Next() {
+			d, err := scanDelivery(rows)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		slog.Error("Failed to encode webhook deliveries", "error", err)
+	}
+}
+
+// retryWebhookDelivery queues a dead (or delivered) delivery again, with a fresh
+// round of attempts.
+func (s *Server) retryWebhookDelivery(w http.ResponseWriter, r *http.Request, owner string, id, delivery int64) {
+	var d WebhookDelivery
+	var found bool
+	err := s.ExecuteWithRobustness(func() error {
+		var err error
+		d, err = scanDelivery(dbQueryRow(r.Context(), s.DB, "retry_webhook_delivery",
+			`WITH d AS (
+				UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now(), completed_at = NULL
+				WHERE id = $1 AND webhook_id = $2 AND status <> 'pending'
+					AND webhook_id IN (SELECT id FROM webhooks WHERE owner_id = $3)
+				RETURNING *
+			)
+			SELECT id, event_seq, event_type, status, attempts, next_attempt_at, last_status_code, last_error, created_at, completed_at FROM d`,
+			delivery, id, owner))
+		if err == sql.ErrNoRows {
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Finished delivery not found", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Retrying webhook delivery", "webhook", id, "delivery", delivery)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		slog.Error("Failed to encode webhook delivery", "error", err)
+	}
+}
+
+// webhookPayload is the JSON body POSTed to webhooks.
+type webhookPayload struct {
+	ID         int64     `json:"id"` // the event's seq, the same for every webhook and attempt
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       struct {
+		TodoID int   `json:"todo_id"`
+		Todo   *Todo `json:"todo,omitempty"`
+	} `json:"data"`
+}
+
+// WebhookSink queues a delivery of every outbox event to each active webhook that
+// subscribed to it and whose owner can see the todo: the owner of a personal todo, or
+// the members of its list. Queuing is idempotent per event and webhook.
+type WebhookSink struct{ server *Server }
+
+// NewWebhookSink returns the sink that queues the deliveries of the webhooks of s.
+func NewWebhookSink(s *Server) WebhookSink { return WebhookSink{s} }
+
+func (WebhookSink) Name() string { return "webhooks" }
+
+func (ws WebhookSink) Publish(ctx context.Context, events []OutboxEvent) error {
+	for _, ev := range events {
+		var p webhookPayload
+		p.ID, p.Type, p.OccurredAt = ev.Seq, ev.Type, ev.OccurredAt
+		p.Data.TodoID, p.Data.Todo = ev.TodoID, ev.Todo
+		body, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		sealed, err := ws.server.encryptTask(ctx, string(body))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errTaskCipher, err)
+		}
+		if _, err := dbExec(ctx, ws.server.DB, "queue_webhook_deliveries",
+			`INSERT INTO webhook_deliveries (webhook_id, event_seq, event_type, payload)
+			SELECT w.id, $1, $2, $3 FROM webhooks w
+			WHERE w.active AND $2 = ANY(w.events)
+				AND (($5::BIGINT IS NULL AND w.owner_id = $4)
+					OR w.owner_id IN (SELECT user_id FROM list_members WHERE list_id = $5))
+			ON CONFLICT (webhook_id, event_seq) DO NOTHING`,
+			ev.Seq, ev.Type, sealed, ev.UserID, ev.ListID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookClient refuses to connect to private, loopback and link-local addresses
+// (such as the metadata server) and does not follow redirects.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               nil,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	if WebhookAllowPrivateTargets {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return errWebhookTarget
+	}
+	return nil
+}
+
+// signWebhook returns the X-Todo-Signature value for body sent at t: the HMAC-SHA256
+// of "<unix seconds>.<body>" with the webhook's secret, so receivers can check both
+// the sender and the age of the request.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// webhookBackoff is the delay before the attempt after attempts failed ones:
+// exponential from webhookBackoffBase, capped, with ±20% jitter.
+func webhookBackoff(attempts int) time.Duration {
+	d := time.Duration(float64(webhookBackoffBase) * math.Pow(2, float64(attempts-1)))
+	if d > webhookBackoffMax || d <= 0 {
+		d = webhookBackoffMax
+	}
+	return time.Duration(float64(d) * (0.8 + 0.4*mathrand.Float64()))
+}
+
+type claimedDelivery struct {
+	id        int64
+	webhookID int64
+	eventSeq  int64
+	eventType string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+// DeliverWebhooks sends the pending deliveries that are due, up to one batch in
+// parallel, and returns how many it attempted. Deliveries are claimed with a lease,
+// so every replica can run it. Those of inactive webhooks wait until reactivated.
+func (s *Server) DeliverWebhooks(ctx context.Context) (int, error) {
+	var claimed []claimedDelivery
+	err := s.ExecuteWithRobustness(func() error {
+		rows, err := dbQuery(ctx, s.DB, "claim_webhook_deliveries",
+			`UPDATE webhook_deliveries d SET next_attempt_at = now() + $2 * interval '1 second'
+			FROM webhooks w
+			WHERE w.id = d.webhook_id AND d.id IN (
+				SELECT p.id FROM webhook_deliveries p JOIN webhooks pw ON pw.id = p.webhook_id
+				WHERE p.status = 'pending' AND p.next_attempt_at <= now() AND pw.active
+				ORDER BY p.next_attempt_at LIMIT $1 FOR UPDATE OF p SKIP LOCKED)
+			RETURNING d.id, d.webhook_id, d.event_seq, d.event_type, d.payload, d.attempts, w.url, w.secret`,
+			webhookBatchSize, webhookLease.Seconds())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		claimed = claimed[:0] // Reset on retry
+		for rows.Next() {
+			var d claimedDelivery
+			if err := rows.Scan(&d.id, &d.webhookID, &d.eventSeq, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+				return err
+			}
+			claimed = append(claimed, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range claimed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliverWebhook(ctx, d)
+		}()
+	}
+	wg.Wait()
+	return len(claimed), nil
+}
+
+// deliverWebhook makes one attempt and records its outcome.
+func (s *Server) deliverWebhook(ctx context.Context, d claimedDelivery) {
+	code, err := s.sendWebhook(ctx, d)
+	attempts := d.attempts + 1
+	status, result, errText := "delivered", "delivered", ""
+	var next time.Time
+	switch {
+	case err == nil && code >= 200 && code < 300:
+	case attempts >= WebhookMaxAttempts:
+		status, result = "dead", "dead"
+	default:
+		status, result = "pending", "retry"
+		next = s.Clock.Now().Add(webhookBackoff(attempts))
+	}
+	switch {
+	case err != nil:
+		errText = err.Error()
+		if len(errText) > 500 {
+			errText = errText[:500]
+		}
+	case result != "delivered":
+		errText = fmt.Sprintf("HTTP %d", code)
+	}
+	WebhookDeliveries.WithLabelValues(result).Inc()
+	if result == "dead" {
+		slog.Warn("Webhook delivery dead-lettered", "webhook", d.webhookID, "delivery", d.id, "event", d.eventSeq, "error", errText)
+	}
+
+	var lastCode *int
+	if err == nil {
+		lastCode = &code
+	}
+	// Stored even if ctx ended during the attempt; otherwise the lease runs out and it is retried.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err = s.ExecuteWithRobustness(func() error {
+		_, err := dbExec(ctx, s.DB, "record_webhook_delivery",
+			`UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = $5,
+				next_attempt_at = CASE WHEN $2 = 'pending' THEN $6 ELSE next_attempt_at END,
+				completed_at = CASE WHEN $2 = 'pending' THEN NULL ELSE now() END
+			WHERE id = $1`,
+			d.id, status, attempts, lastCode, errText, next)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery", d.id, "error", err)
+	}
+}
+
+// sendWebhook POSTs the signed payload and returns the response status.
+func (s *Server) sendWebhook(ctx context.Context, d claimedDelivery) (int, error) {
+	payload, err := s.decryptTask(ctx, d.payload)
+	if err != nil {
+		return 0, err
+	}
+	secret, err := s.decryptTask(ctx, d.secret)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, WebhookTimeout)
+	defer cancel()
+	body := []byte(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "todo-app-webhooks/1")
+	req.Header.Set("X-Todo-Event", d.eventType)
+	req.Header.Set("X-Todo-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set(webhookSignatureHdr, signWebhook(secret, s.Clock.Now(), body))
+
+	start := s.Clock.Now()
+	resp, err := webhookClient.Do(req)
+	WebhookDeliveryDuration.Observe(s.Clock.Now().Sub(start).Seconds())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+func init() {
+	registerJob("webhook_deliveries", jobKind{
+		policy: RetryPolicy{MaxAttempts: 3, MinBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute, Timeout: 10 * time.Minute},
+		run:    (*Server).runWebhookDeliveries,
+		admin:  true,
+	})
+}
+
+// runWebhookDeliveries sends every due webhook delivery, e.g. to work off a backlog
+// after an outage faster than the deliverers of the replicas do between requests.
+// Deliveries keep their own attempts and backoff in webhook_deliveries.
+func (s *Server) runWebhookDeliveries(ctx context.Context, job *Job) (any, error) {
+	total := 0
+	for {
+		n, err := s.DeliverWebhooks(ctx)
+		total += n
+		if err != nil {
+			return nil, err
+		}
+		if n < webhookBatchSize {
+			return map[string]int{"deliveries": total}, nil
+		}
+	}
+}
+
+// StartWebhookDeliverer sends due webhook deliveries every interval until ctx is
+// cancelled, and prunes finished deliveries older than WebhookDeliveryRetention.
+func (s *Server) StartWebhookDeliverer(ctx context.Context, interval time.Duration) {
+	Workers.Go(ctx, "webhook_deliverer", func(ctx context.Context, w *Worker) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastPrune := s.Clock.Now()
+		for {
+			select {
+			case <-w.Stop():
+				return
+			case <-ticker.C:
+			}
+			var err error
+			for !w.Stopping() {
+				var n int
+				n, err = s.DeliverWebhooks(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Warn("Failed to claim webhook deliveries", "error", err)
+					}
+					break
+				}
+				if n < webhookBatchSize {
+					break
+				}
+			}
+			w.Checkpoint(err)
+			if s.Clock.Now().Sub(lastPrune) < 10*time.Minute {
+				continue
+			}
+			lastPrune = s.Clock.Now()
+			res, err := dbExec(ctx, s.DB, "purge_webhook_deliveries",
+				"DELETE FROM webhook_deliveries WHERE status <> 'pending' AND completed_at < now() - $1 * interval '1 second'",
+				WebhookDeliveryRetention.Seconds())
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Failed to purge old webhook deliveries", "error", err)
+				}
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				slog.Debug("Purged old webhook deliveries", "count", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,1111 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Package config loads and validates the application configuration: defaults, the
+// environment profile, a YAML or JSON file, environment variables and flags.
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of every setting: the dotted path
+// in upper snake case, e.g. server.port is TODO_SERVER_PORT. Settings that existed
+// before the config file also keep their original variable (the env tag), e.g. PORT.
+const EnvPrefix = "TODO_"
+
+// Config is the complete application configuration. It is built by Load from,
+// in increasing precedence: defaults, the profile named by APP_ENV, a YAML or JSON file,
+// environment variables and command-line flags (one flag per setting, e.g. -server.port=9090).
+// Database credentials are not part of it; they stay in the Secret Manager secret.
+//
+// Settings tagged reload:"true" are applied at runtime by app.ConfigReloader; changes to the
+// others need a restart. Settings tagged secret:"true" are never logged.
+type Config struct {
+	ProjectID string `yaml:"project_id" env:"GOOGLE_CLOUD_PROJECT" help:"Google Cloud project"`
+
+	Server         ServerSettings         `yaml:"server"`
+	Log            LogSettings            `yaml:"log"`
+	Profiler       ProfilerSettings       `yaml:"profiler"`
+	Heartbeat      HeartbeatSettings      `yaml:"heartbeat"`
+	ErrorReporting ErrorReportingSettings `yaml:"error_reporting"`
+	Secrets        SecretSettings         `yaml:"secrets"`
+	Auth           AuthSettings           `yaml:"auth"`
+	Database       DatabaseSettings       `yaml:"database"`
+	Abuse          AbuseSettings          `yaml:"abuse"`
+	Cache          CacheSettings          `yaml:"cache"`
+	Exports        ExportSettings         `yaml:"exports"`
+	Webhooks       WebhookSettings        `yaml:"webhooks"`
+	Events         EventSettings          `yaml:"events"`
+	Slack          SlackSettings          `yaml:"slack"`
+	Notifications  NotificationSettings   `yaml:"notifications"`
+	Calendar       CalendarSettings       `yaml:"calendar"`
+	Jobs           JobSettings            `yaml:"jobs"`
+	Scheduler      SchedulerSettings      `yaml:"scheduler"`
+	Attachments    AttachmentSettings     `yaml:"attachments"`
+	Suggestions    SuggestionSettings     `yaml:"suggestions"`
+	Retention      RetentionSettings      `yaml:"retention"`
+	Tenancy        TenancySettings        `yaml:"tenancy"`
+	Encryption     EncryptionSettings     `yaml:"encryption"`
+	Breaker        BreakerSettings        `yaml:"breaker"`
+	Preflight      PreflightSettings      `yaml:"preflight"`
+	Runtime        RuntimeSettings        `yaml:"runtime"`
+	// Features switches optional behavior by name, e.g. TODO_FEATURES=a,b=false.
+	Features map[string]bool `yaml:"features" reload:"true"`
+
+	// How the process was started rather than settings: the profile and file the config
+	// was loaded from, -validate-config / -validate-db, which run CheckConfig instead of
+	// serving, -dump-openapi, which writes the OpenAPI document to a file, and -mcp-stdio,
+	// which serves MCP on stdin/stdout instead of listening.
+	Profile       string `yaml:"-"`
+	File          string `yaml:"-"`
+	CheckOnly     bool   `yaml:"-"`
+	CheckDatabase bool   `yaml:"-"`
+	DumpOpenAPI   string `yaml:"-"`
+	MCPStdio      bool   `yaml:"-"`
+
+	sources map[string]string // setting path -> where its value came from, unless a default
+}
+
+type ServerSettings struct {
+	Port         string        `yaml:"port" env:"PORT" help:"HTTP listen port"`
+	GRPCPort     string        `yaml:"grpc_port" env:"GRPC_PORT" help:"gRPC listen port (empty disables gRPC)"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout bounds how long SIGTERM waits for requests in flight and background
+	// workers, which then get 5s more to give up. Keep the sum below the pod's
+	// terminationGracePeriodSeconds (30 by default).
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// TLS on the main listener. With MTLSClientCAFile, client certificates are verified
+	// and callers whose SPIFFE ID is in MTLSAllowedIDs ("/*" suffix for prefixes)
+	// authenticate with MTLSScopes.
+	TLSCertFile      string   `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile       string   `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	MTLSClientCAFile string   `yaml:"mtls_client_ca_file" env:"MTLS_CLIENT_CA_FILE"`
+	MTLSAllowedIDs   []string `yaml:"mtls_allowed_ids" env:"MTLS_ALLOWED_IDS"`
+	MTLSScopes       []string `yaml:"mtls_scopes" env:"MTLS_SCOPES"`
+	// TrustedProxyHops selects the client IP from X-Forwarded-For (2 behind the GCLB).
+	TrustedProxyHops int `yaml:"trusted_proxy_hops" env:"TRUSTED_PROXY_HOPS"`
+	// RequireHTTPS redirects requests the load balancer received over plain HTTP,
+	// sends HSTS and marks every cookie Secure.
+	RequireHTTPS bool   `yaml:"require_https"`
+	SwaggerUI    bool   `yaml:"swagger_ui" help:"serve Swagger UI for /openapi.json at /docs (loads from unpkg.com)"`
+	UI           string `yaml:"ui" env:"UI_MODE" help:"spa (static/app.js) or htmx (rendered on the server, loads htmx from unpkg.com)"`
+}
+
+type LogSettings struct {
+	Level          string   `yaml:"level" reload:"true" help:"debug, info, warn or error"`
+	Format         string   `yaml:"format" help:"json, cloud (Cloud Logging field names) or text"`
+	RedactKeys     []string `yaml:"redact_keys" env:"LOG_REDACT_KEYS" help:"extra attribute keys to redact"`
+	RedactPatterns []string `yaml:"redact_patterns" env:"LOG_REDACT_PATTERNS" help:"extra regular expressions to redact (JSON array)"`
+}
+
+type ProfilerSettings struct {
+	Backend string `yaml:"backend" env:"PROFILER" help:"cloud, pprof or none"`
+	Addr    string `yaml:"addr" env:"PPROF_ADDR" help:"listen address of the pprof backend; its endpoints are unauthenticated, so it is loopback only by default"`
+	Mutex   bool   `yaml:"mutex" env:"PROFILER_MUTEX"`
+}
+
+type HeartbeatSettings struct {
+	Interval     time.Duration `yaml:"interval" env:"HEARTBEAT_INTERVAL"`
+	Window       int           `yaml:"window"`
+	GrowthFactor float64       `yaml:"growth_factor"`
+	MinAbsolute  int           `yaml:"min_absolute"`
+}
+
+type ErrorReportingSettings struct {
+	Backend    string  `yaml:"backend" env:"ERROR_REPORTING" help:"cloud, sentry or none"`
+	SentryDSN  string  `yaml:"sentry_dsn" env:"SENTRY_DSN" secret:"true"`
+	SampleRate float64 `yaml:"sample_rate" env:"ERROR_REPORTING_SAMPLE_RATE" reload:"true" help:"share of 5xx responses reported (0..1)"`
+}
+
+type SecretSettings struct {
+	Backend       string        `yaml:"backend" env:"SECRET_BACKEND" help:"gcp, env, file or vault"`
+	Dir           string        `yaml:"dir" env:"SECRETS_DIR" help:"directory of the file backend"`
+	CacheTTL      time.Duration `yaml:"cache_ttl" env:"SECRET_CACHE_TTL"`
+	RotationTopic string        `yaml:"rotation_topic" env:"SECRET_ROTATION_TOPIC" help:"Pub/Sub topic of Secret Manager events"`
+	// DatabaseSecret holds the DBConfig JSON; default todo-app-secret in ProjectID.
+	DatabaseSecret string        `yaml:"database_secret"`
+	Vault          VaultSettings `yaml:"vault"`
+	// Secret Manager (gcp backend) reads are retried for up to FetchTimeout; BreakerFailures
+	// consecutive failed reads open a breaker for 30s. Meanwhile secrets are read from
+	// Fallback: "" (none), "env" (SECRET_<ID>) or "file" (FallbackDir).
+	FetchTimeout    time.Duration `yaml:"fetch_timeout" help:"time one secret read may take, retries included"`
+	BreakerFailures uint32        `yaml:"breaker_failures"`
+	Fallback        string        `yaml:"fallback" help:"env or file; read when Secret Manager is unavailable"`
+	FallbackDir     string        `yaml:"fallback_dir"`
+}
+
+type VaultSettings struct {
+	Addr      string `yaml:"addr" env:"VAULT_ADDR"`
+	Token     string `yaml:"token" env:"VAULT_TOKEN" secret:"true"`
+	TokenFile string `yaml:"token_file" env:"VAULT_TOKEN_FILE"`
+	Namespace string `yaml:"namespace" env:"VAULT_NAMESPACE"`
+	Mount     string `yaml:"mount" env:"VAULT_MOUNT"`
+	Prefix    string `yaml:"prefix" env:"VAULT_PREFIX"`
+}
+
+type AuthSettings struct {
+	Mode           string `yaml:"mode" env:"AUTH_MODE" help:"disabled, optional or required"`
+	AdminKeySecret string `yaml:"admin_key_secret" env:"ADMIN_KEY_SECRET"`
+	// OIDC bearer tokens, e.g. issuer https://accounts.google.com.
+	OIDCIssuer   string `yaml:"oidc_issuer" env:"OIDC_ISSUER"`
+	OIDCAudience string `yaml:"oidc_audience" env:"OIDC_AUDIENCE"`
+	OIDCJWKSURL  string `yaml:"oidc_jwks_url" env:"OIDC_JWKS_URL"`
+	// Google sign-in for the web UI; the OAuth client lives in Secret Manager.
+	GoogleOAuthSecret      string        `yaml:"google_oauth_secret" env:"GOOGLE_OAUTH_SECRET"`
+	GoogleOAuthRedirectURL string        `yaml:"google_oauth_redirect_url" env:"GOOGLE_OAUTH_REDIRECT_URL"`
+	SessionIdleTimeout     time.Duration `yaml:"session_idle_timeout" env:"SESSION_IDLE_TIMEOUT"`
+	SessionMaxAge          time.Duration `yaml:"session_max_age" env:"SESSION_MAX_AGE"`
+}
+
+type DatabaseSettings struct {
+	// Connection overrides applied on top of the database secret.
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	ReadHost string `yaml:"read_host"`
+	ReadPort string `yaml:"read_port"`
+	Name     string `yaml:"name"`
+
+	MigrateOnStartup        bool          `yaml:"migrate_on_startup" env:"DB_MIGRATE_ON_STARTUP" help:"apply schema migrations before serving"`
+	RLSMode                 bool          `yaml:"rls_mode" env:"RLS_MODE" help:"enforce Postgres row-level security"`
+	PreparedStatements      bool          `yaml:"prepared_statements" env:"DB_PREPARED_STATEMENTS" help:"prepare the hot todo queries once per pool; turn off behind a transaction-pooling proxy"`
+	WriteBatching           bool          `yaml:"write_batching" env:"DB_WRITE_BATCHING" help:"insert concurrently created todos with one multi-row statement per batch"`
+	WriteBatchWait          time.Duration `yaml:"write_batch_wait" help:"longest a created todo waits for others to join its batch"`
+	WriteBatchMax           int           `yaml:"write_batch_max" help:"most todos inserted by one statement"`
+	WarmupConns             int           `yaml:"warmup_conns" env:"DB_WARMUP_CONNS" help:"connections opened in each pool at startup, before the pod reports ready (0 disables)"`
+	WarmupTimeout           time.Duration `yaml:"warmup_timeout" help:"longest the warm-up may take; the pod is ready after it either way"`
+	LegacyOwner             string        `yaml:"legacy_owner" env:"TODO_LEGACY_OWNER" help:"owner for todos created before per-user ownership"`
+	BusinessMetricsInterval time.Duration `yaml:"business_metrics_interval" env:"BUSINESS_METRICS_INTERVAL"`
+}
+
+type AbuseSettings struct {
+	Enabled           bool          `yaml:"enabled" env:"ABUSE_PROTECTION"`
+	RedisURL          string        `yaml:"redis_url" env:"ABUSE_REDIS_URL" secret:"true" help:"share bans across replicas"`
+	AuthFailureLimit  int64         `yaml:"auth_failure_limit" reload:"true"`
+	AuthFailureWindow time.Duration `yaml:"auth_failure_window" reload:"true"`
+	MalformedLimit    int64         `yaml:"malformed_limit" reload:"true"`
+	MalformedWindow   time.Duration `yaml:"malformed_window" reload:"true"`
+	BanBase           time.Duration `yaml:"ban_base" reload:"true"`
+	BanMax            time.Duration `yaml:"ban_max" reload:"true"`
+	StrikeMemory      time.Duration `yaml:"strike_memory" reload:"true"`
+}
+
+// CacheSettings turn on the cache of todo reads (see todo_cache.go), in Redis or, without
+// it, in each replica's memory.
+type CacheSettings struct {
+	RedisURL      string        `yaml:"redis_url" env:"CACHE_REDIS_URL" secret:"true" help:"cache todo reads in Redis"`
+	MemoryEntries int           `yaml:"memory_entries" env:"CACHE_MEMORY_ENTRIES" help:"without redis_url, cache up to this many todo reads in memory (0 disables the cache)"`
+	ListTTL       time.Duration `yaml:"list_ttl" help:"longest a cached GET /todos is served"`
+	TodoTTL       time.Duration `yaml:"todo_ttl" help:"longest a cached GET /todos/{id} is served"`
+	// Snapshots of GET /stats and GET /tags, in memory whether or not the reads above
+	// are cached.
+	AggregateRefresh      time.Duration `yaml:"aggregate_refresh" help:"how often the stats and tag count snapshots are recomputed (0 computes them on every request)"`
+	AggregateMaxStaleness time.Duration `yaml:"aggregate_max_staleness" help:"oldest snapshot served; older ones are recomputed by the request"`
+}
+
+type ExportSettings struct {
+	SigningKeys       string        `yaml:"signing_keys" env:"EXPORT_SIGNING_KEYS" secret:"true" help:"comma-separated, 32+ bytes each, first one signs"`
+	SigningKeysSecret string        `yaml:"signing_keys_secret" env:"EXPORT_SIGNING_KEYS_SECRET"`
+	Retention         time.Duration `yaml:"retention"`
+	URLTTL            time.Duration `yaml:"url_ttl"`
+	Timeout           time.Duration `yaml:"timeout" help:"per attempt of the export job, at most 10m"`
+}
+
+type WebhookSettings struct {
+	Timeout             time.Duration `yaml:"timeout" help:"per delivery attempt"`
+	MaxAttempts         int           `yaml:"max_attempts" help:"attempts before a delivery is dead-lettered"`
+	DeliveryRetention   time.Duration `yaml:"delivery_retention" help:"how long finished deliveries stay in the delivery log"`
+	AllowPrivateTargets bool          `yaml:"allow_private_targets" env:"WEBHOOK_ALLOW_PRIVATE_TARGETS" help:"allow http and private addresses (development only)"`
+}
+
+// EventSettings choose where todo change events are published besides webhooks.
+type EventSettings struct {
+	PubSubTopic    string `yaml:"pubsub_topic" env:"EVENTS_PUBSUB_TOPIC" help:"Pub/Sub topic for todo events (projects/<p>/topics/<t>); empty disables"`
+	PubSubEndpoint string `yaml:"pubsub_endpoint" env:"EVENTS_PUBSUB_ENDPOINT" help:"regional Pub/Sub endpoint, for ordered delivery"`
+
+	KafkaBrokers       []string      `yaml:"kafka_brokers" env:"EVENTS_KAFKA_BROKERS" help:"Kafka bootstrap brokers (host:port) for todo events; empty disables"`
+	KafkaTopic         string        `yaml:"kafka_topic" env:"EVENTS_KAFKA_TOPIC"`
+	KafkaClientID      string        `yaml:"kafka_client_id"`
+	KafkaBatchMaxBytes int32         `yaml:"kafka_batch_max_bytes" help:"largest record batch per partition"`
+	KafkaLinger        time.Duration `yaml:"kafka_linger" help:"how long the producer waits to fill a batch"`
+	KafkaCompression   string        `yaml:"kafka_compression" help:"none, gzip, snappy, lz4 or zstd"`
+	KafkaIdempotent    bool          `yaml:"kafka_idempotent" help:"idempotent producer (brokers drop duplicates of retries)"`
+	KafkaTimeout       time.Duration `yaml:"kafka_timeout" help:"until a batch must be acknowledged"`
+	KafkaTLS           bool          `yaml:"kafka_tls" env:"EVENTS_KAFKA_TLS"`
+	KafkaSASLMechanism string        `yaml:"kafka_sasl_mechanism" env:"EVENTS_KAFKA_SASL_MECHANISM" help:"plain, scram-sha-256 or scram-sha-512; empty disables"`
+	KafkaSASLUser      string        `yaml:"kafka_sasl_user" env:"EVENTS_KAFKA_SASL_USER"`
+	KafkaSASLPassword  string        `yaml:"kafka_sasl_password" env:"EVENTS_KAFKA_SASL_PASSWORD" secret:"true"`
+}
+
+// SlackSettings connect a Slack workspace: WebhookURL, an incoming webhook, receives
+// the Notify events, and SigningSecret enables the /todo slash command.
+type SlackSettings struct {
+	WebhookURL    string   `yaml:"webhook_url" env:"SLACK_WEBHOOK_URL" secret:"true" help:"incoming webhook for notifications; empty disables"`
+	Notify        []string `yaml:"notify" env:"SLACK_NOTIFY" help:"events posted to Slack: created, completed, overdue"`
+	SigningSecret string   `yaml:"signing_secret" env:"SLACK_SIGNING_SECRET" secret:"true" help:"verifies /todo slash commands; empty disables them"`
+}
+
+// NotificationSettings configure email reminders. The owner of a todo with a due date
+// is reminded RemindBefore it is due, and again once it is overdue.
+type NotificationSettings struct {
+	EmailProvider  string        `yaml:"email_provider" env:"EMAIL_PROVIDER" help:"smtp, sendgrid or log; empty disables email reminders"`
+	From           string        `yaml:"from" env:"EMAIL_FROM" help:"sender address, e.g. Todo App <todo@example.com>"`
+	SMTPAddr       string        `yaml:"smtp_addr" env:"SMTP_ADDR" help:"host:port of the SMTP relay"`
+	SMTPUser       string        `yaml:"smtp_user" env:"SMTP_USER" help:"SMTP user; empty sends without auth"`
+	SMTPPassword   string        `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	SendGridAPIKey string        `yaml:"sendgrid_api_key" env:"SENDGRID_API_KEY" secret:"true"`
+	RemindBefore   time.Duration `yaml:"remind_before" help:"how long before a todo is due to send the first reminder; 0 only reminds once overdue"`
+	MaxAttempts    int           `yaml:"max_attempts" help:"attempts before a reminder email is given up"`
+}
+
+// CalendarSettings configure the per-user calendar feeds.
+type CalendarSettings struct {
+	CalDAV bool `yaml:"caldav" env:"CALDAV_ENABLED" help:"serve the feeds over read-only CalDAV at /caldav/ too"`
+}
+
+// JobSettings choose where background jobs (exports, imports, maintenance) run: on
+// worker goroutines of every replica, or dispatched by a Cloud Tasks queue.
+type JobSettings struct {
+	Queue          string `yaml:"queue" env:"JOB_QUEUE" help:"inprocess or cloudtasks"`
+	Workers        int    `yaml:"workers" help:"worker goroutines per replica (inprocess)"`
+	TasksQueue     string `yaml:"tasks_queue" env:"JOB_TASKS_QUEUE" help:"projects/<p>/locations/<l>/queues/<q> (cloudtasks)"`
+	TargetURL      string `yaml:"target_url" env:"JOB_TARGET_URL" help:"https base URL Cloud Tasks calls (cloudtasks)"`
+	SigningSecret  string `yaml:"signing_secret" env:"JOB_SIGNING_SECRET" secret:"true" help:"signs the tasks (cloudtasks)"`
+	ServiceAccount string `yaml:"service_account" help:"adds an OIDC token of this service account to tasks (cloudtasks), optional"`
+}
+
+// SchedulerSettings set the cron schedules (see scheduler.go) that start the periodic
+// jobs, in UTC; "off" turns one off.
+type SchedulerSettings struct {
+	Enabled        bool          `yaml:"enabled" env:"SCHEDULER_ENABLED" help:"start the periodic jobs on these schedules, instead of on timers of every replica"`
+	Jitter         time.Duration `yaml:"jitter" help:"runs start up to this late, at random"`
+	RetentionPurge string        `yaml:"retention_purge" help:"cron schedule of the retention purge, if retention is on"`
+	UsageRollup    string        `yaml:"usage_rollup" help:"cron schedule of the daily usage totals"`
+	Reminders      string        `yaml:"reminders" help:"cron schedule of the email reminders, if notifications.email_provider is set"`
+}
+
+// AttachmentSettings configure files attached to todos, kept in a GCS bucket.
+type AttachmentSettings struct {
+	Bucket         string        `yaml:"bucket" env:"ATTACHMENT_BUCKET" help:"GCS bucket for todo attachments (empty disables attachments)"`
+	ServiceAccount string        `yaml:"service_account" env:"ATTACHMENT_SERVICE_ACCOUNT" help:"service account that signs upload and download URLs"`
+	MaxBytes       int64         `yaml:"max_bytes" help:"largest attachment"`
+	ContentTypes   []string      `yaml:"content_types" help:"allowed media types; type/* allows all of a type"`
+	URLTTL         time.Duration `yaml:"url_ttl" help:"how long upload and download URLs are valid, at most 7 days"`
+}
+
+// SuggestionSettings choose the model behind POST /todos/{id}/suggest-subtasks, which
+// the suggest_subtasks feature flag turns on.
+type SuggestionSettings struct {
+	Provider string        `yaml:"provider" env:"SUGGESTION_PROVIDER" help:"none (suggests nothing) or vertex"`
+	Location string        `yaml:"location" help:"Vertex AI location of the model, e.g. us-central1 or global (vertex)"`
+	Model    string        `yaml:"model" env:"SUGGESTION_MODEL" help:"Vertex AI model (vertex)"`
+	Timeout  time.Duration `yaml:"timeout" help:"how long to wait for the model"`
+	CacheTTL time.Duration `yaml:"cache_ttl" help:"how long suggestions for the same task are reused; 0 disables the cache"`
+}
+
+// RetentionSettings purge todos once they are done with; a zero age keeps them forever.
+type RetentionSettings struct {
+	CompletedAfter time.Duration `yaml:"completed_after" env:"RETENTION_COMPLETED_AFTER" help:"purge todos completed longer ago than this (0 keeps them)"`
+	ArchivedAfter  time.Duration `yaml:"archived_after" env:"RETENTION_ARCHIVED_AFTER" help:"purge todos archived longer ago than this (0 keeps them)"`
+	Interval       time.Duration `yaml:"interval" help:"how often each replica purges, with scheduler.enabled false"`
+	BatchSize      int           `yaml:"batch_size" help:"todos deleted per statement"`
+	DryRun         bool          `yaml:"dry_run" env:"RETENTION_DRY_RUN" help:"only count and log what would be purged"`
+}
+
+// TenancySettings turn on multi-tenancy (see tenants.go). Per-tenant overrides live in
+// the tenants table, managed at /admin/resources/tenants.
+type TenancySettings struct {
+	Enabled           bool   `yaml:"enabled" env:"TENANCY_ENABLED" help:"bind every request to a tenant"`
+	BaseDomain        string `yaml:"base_domain" env:"TENANCY_BASE_DOMAIN" help:"domain whose subdomains name tenants, e.g. todo.example.com"`
+	Claim             string `yaml:"claim" env:"TENANCY_CLAIM" help:"bearer token claim naming the tenant"`
+	RequestsPerMinute int    `yaml:"requests_per_minute" help:"per tenant without a limit of its own (0 for none)"`
+}
+
+type EncryptionSettings struct {
+	TaskKey string `yaml:"task_key" env:"TASK_ENCRYPTION_KEY" help:"Cloud KMS key for envelope encryption of task text"`
+}
+
+// PreflightSettings control the dependency checks run before the listener is bound.
+// In strict mode a failed check stops the process instead of only being logged.
+type PreflightSettings struct {
+	Strict       bool          `yaml:"strict" help:"exit when a pre-flight check fails"`
+	Timeout      time.Duration `yaml:"timeout" help:"per check"`
+	ClockURL     string        `yaml:"clock_url" help:"HTTPS endpoint whose Date header the clock is compared with; empty to skip"`
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+}
+
+// RuntimeSettings fit the Go runtime to the container at startup (ApplyContainerLimits).
+type RuntimeSettings struct {
+	ContainerAware   bool    `yaml:"container_aware" help:"set GOMAXPROCS and GOMEMLIMIT from the cgroup limits, unless those variables are set"`
+	MemoryLimitRatio float64 `yaml:"memory_limit_ratio" help:"share of the container memory limit GOMEMLIMIT is set to (0..1]"`
+}
+
+// BreakerSettings decide when the database circuit breaker opens: after MinRequests
+// calls with at least FailureRatio of them failed.
+type BreakerSettings struct {
+	MinRequests  uint32  `yaml:"min_requests" reload:"true"`
+	FailureRatio float64 `yaml:"failure_ratio" reload:"true"`
+}
+
+// Default returns the settings used when nothing is configured.
+func Default() Config {
+	return Config{
+		ProjectID: "smcghee-todo-p15n-38a6",
+		Server: ServerSettings{
+			Port:            "8080",
+			GRPCPort:        "9090",
+			ReadTimeout:     60 * time.Second,
+			WriteTimeout:    60 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+			MTLSScopes:      []string{"read", "write"},
+			UI:              "spa",
+		},
+		Log:      LogSettings{Level: "debug", Format: "json"},
+		Profiler: ProfilerSettings{Addr: "127.0.0.1:6060"},
+		Heartbeat: HeartbeatSettings{
+			Interval:     time.Minute,
+			Window:       5,
+			GrowthFactor: 2,
+			MinAbsolute:  100,
+		},
+		ErrorReporting: ErrorReportingSettings{Backend: "cloud", SampleRate: 1},
+		Secrets: SecretSettings{
+			CacheTTL:        5 * time.Minute,
+			FetchTimeout:    30 * time.Second,
+			BreakerFailures: 5,
+			FallbackDir:     "/var/run/secrets/todo-app",
+		},
+		Auth: AuthSettings{
+			Mode:               "disabled",
+			SessionIdleTimeout: 30 * time.Minute,
+			SessionMaxAge:      12 * time.Hour,
+		},
+		Database: DatabaseSettings{MigrateOnStartup: true, PreparedStatements: true, WriteBatchWait: 2 * time.Millisecond, WriteBatchMax: 100, WarmupConns: 4, WarmupTimeout: 30 * time.Second, BusinessMetricsInterval: time.Minute},
+		Abuse: AbuseSettings{
+			Enabled:           true,
+			AuthFailureLimit:  10,
+			AuthFailureWindow: 5 * time.Minute,
+			MalformedLimit:    50,
+			MalformedWindow:   time.Minute,
+			BanBase:           time.Minute,
+			BanMax:            24 * time.Hour,
+			StrikeMemory:      24 * time.Hour,
+		},
+		Cache:    CacheSettings{ListTTL: 30 * time.Second, TodoTTL: 5 * time.Minute, AggregateRefresh: 30 * time.Second, AggregateMaxStaleness: 2 * time.Minute},
+		Exports:  ExportSettings{Retention: 24 * time.Hour, URLTTL: 15 * time.Minute, Timeout: 5 * time.Minute},
+		Webhooks: WebhookSettings{Timeout: 10 * time.Second, MaxAttempts: 8, DeliveryRetention: 7 * 24 * time.Hour},
+		Events: EventSettings{
+			KafkaClientID:      "todo-app",
+			KafkaBatchMaxBytes: 1 << 20,
+			KafkaLinger:        10 * time.Millisecond,
+			KafkaCompression:   "snappy",
+			KafkaIdempotent:    true,
+			KafkaTimeout:       30 * time.Second,
+		},
+		Slack:         SlackSettings{Notify: []string{"completed", "overdue"}},
+		Notifications: NotificationSettings{RemindBefore: 24 * time.Hour, MaxAttempts: 5},
+		Jobs:          JobSettings{Queue: "inprocess", Workers: 4},
+		Scheduler: SchedulerSettings{
+			Enabled:        true,
+			Jitter:         10 * time.Second,
+			RetentionPurge: "17 * * * *",
+			UsageRollup:    "*/5 * * * *",
+			Reminders:      "* * * * *",
+		},
+		Attachments: AttachmentSettings{
+			MaxBytes:     25 << 20,
+			ContentTypes: []string{"image/*", "application/pdf", "text/plain", "text/csv"},
+			URLTTL:       15 * time.Minute,
+		},
+		Suggestions: SuggestionSettings{
+			Provider: "none",
+			Location: "us-central1",
+			Model:    "gemini-2.5-flash",
+			Timeout:  15 * time.Second,
+			CacheTTL: time.Hour,
+		},
+		Retention: RetentionSettings{Interval: time.Hour, BatchSize: 500},
+		Breaker:   BreakerSettings{MinRequests: 3, FailureRatio: 0.6},
+		Preflight: PreflightSettings{
+			Timeout:      5 * time.Second,
+			ClockURL:     "https://www.googleapis.com/",
+			MaxClockSkew: 30 * time.Second,
+		},
+		Runtime: RuntimeSettings{ContainerAware: true, MemoryLimitRatio: 0.9},
+	}
+}
+
+// Load builds the configuration from defaults, the profile named by APP_ENV,
+// the file named by -config (or TODO_CONFIG_FILE), the environment and the remaining
+// flags in args, and validates it. lookupEnv is normally os.LookupEnv.
+// It returns flag.ErrHelp when -h was given; usage has then been printed.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+	profile, _ := lookupEnv(ProfileEnvVar)
+	if err := applyProfile(&cfg, profile); err != nil {
+		return nil, err
+	}
+	fields := configFields(&cfg)
+
+	fs := flag.NewFlagSet("todo-app", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML or JSON config file (env "+EnvPrefix+"CONFIG_FILE)")
+	fs.BoolVar(&cfg.CheckOnly, "validate-config", false, "validate the configuration and the secrets it refers to, then exit")
+	fs.BoolVar(&cfg.CheckDatabase, "validate-db", false, "with -validate-config, also connect to the database")
+	fs.StringVar(&cfg.DumpOpenAPI, "dump-openapi", "", "write the OpenAPI document of the HTTP API to this file, then exit")
+	fs.BoolVar(&cfg.MCPStdio, "mcp-stdio", false, "serve the MCP tools on stdin/stdout as the owner of TODO_API_KEY instead of listening")
+	type flagValue struct {
+		field configField
+		value string
+	}
+	var set []flagValue
+	for _, f := range fields {
+		f := f
+		usage := f.help
+		if usage == "" {
+			usage = f.path
+		}
+		usage += " (env " + f.envName()
+		if f.legacyEnv != "" {
+			usage += " or " + f.legacyEnv
+		}
+		usage += ")"
+		fs.Func(f.path, usage, func(v string) error {
+			set = append(set, flagValue{f, v})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *path == "" {
+		*path, _ = lookupEnv(EnvPrefix + "CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+		cfg.File = *path
+	}
+	cfg.sources = make(map[string]string)
+	defaults, base := Default(), Default()
+	applyProfile(&base, profile)
+	baseFields := configFields(&base)
+	for i, f := range configFields(&defaults) {
+		switch {
+		case !reflect.DeepEqual(baseFields[i].value.Interface(), fields[i].value.Interface()):
+			cfg.sources[f.path] = "file"
+		case !reflect.DeepEqual(f.value.Interface(), fields[i].value.Interface()):
+			cfg.sources[f.path] = "profile " + profile
+		}
+	}
+
+	var errs []error
+	for _, f := range fields {
+		for _, name := range []string{f.legacyEnv, f.envName()} {
+			if name == "" {
+				continue
+			}
+			if v, ok := lookupEnv(name); ok {
+				if err := f.set(v); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid value %q from %s: %w", f.path, v, name, err))
+				}
+				cfg.sources[f.path] = "env " + name
+			}
+		}
+	}
+	for _, s := range set {
+		if err := s.field.set(s.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q from -%s: %w", s.field.path, s.value, s.field.path, err))
+		}
+		cfg.sources[s.field.path] = "flag -" + s.field.path
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	cfg.resolveDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadFile merges path into c. Unknown keys are errors, so typos do not go unnoticed.
+// JSON is a subset of YAML and goes through the same decoder.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// resolveDefaults fills in settings whose default depends on other settings.
+func (c *Config) resolveDefaults() {
+	secret := func(id string) string {
+		return fmt.Sprintf("projects/%s/secrets/%s/versions/latest", c.ProjectID, id)
+	}
+	if c.Secrets.DatabaseSecret == "" {
+		c.Secrets.DatabaseSecret = secret("todo-app-secret")
+	}
+	if c.Auth.AdminKeySecret == "" {
+		c.Auth.AdminKeySecret = secret("todo-app-admin-key")
+	}
+	if c.Auth.GoogleOAuthSecret == "" {
+		c.Auth.GoogleOAuthSecret = secret("todo-app-google-oauth")
+	}
+}
+
+// Validate checks every setting and reports all problems at once, each prefixed
+// with the setting's path.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	oneOf := func(path, v string, allowed ...string) {
+		for _, a := range allowed {
+			if v == a {
+				return
+			}
+		}
+		fail(path, "unknown value %q, want one of %s", v, strings.Join(allowed, ", "))
+	}
+	positive := func(path string, d time.Duration) {
+		if d <= 0 {
+			fail(path, "must be a positive duration such as 30s or 5m, got %v", d)
+		}
+	}
+
+	if c.ProjectID == "" {
+		fail("project_id", "must not be empty")
+	}
+	if p, err := strconv.Atoi(c.Server.Port); err != nil || p < 1 || p > 65535 {
+		fail("server.port", "must be a port number between 1 and 65535, got %q", c.Server.Port)
+	}
+	if g := c.Server.GRPCPort; g != "" {
+		if p, err := strconv.Atoi(g); err != nil || p < 1 || p > 65535 {
+			fail("server.grpc_port", "must be a port number between 1 and 65535, got %q", g)
+		} else if g == c.Server.Port {
+			fail("server.grpc_port", "must differ from server.port")
+		}
+	}
+	positive("server.read_timeout", c.Server.ReadTimeout)
+	positive("server.write_timeout", c.Server.WriteTimeout)
+	positive("server.idle_timeout", c.Server.IdleTimeout)
+	positive("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		fail("server.tls_key_file", "tls_cert_file and tls_key_file must be set together")
+	}
+	if c.Server.MTLSClientCAFile != "" {
+		if c.Server.TLSCertFile == "" {
+			fail("server.mtls_client_ca_file", "requires tls_cert_file and tls_key_file")
+		}
+		if len(c.Server.MTLSAllowedIDs) == 0 {
+			fail("server.mtls_allowed_ids", "must list at least one SPIFFE ID when mtls_client_ca_file is set")
+		}
+	}
+	for _, s := range c.Server.MTLSScopes {
+		oneOf("server.mtls_scopes", s, "read", "write", "admin")
+	}
+	if c.Server.TrustedProxyHops < 0 {
+		fail("server.trusted_proxy_hops", "must not be negative")
+	}
+	oneOf("server.ui", c.Server.UI, "spa", "htmx")
+
+	oneOf("log.level", c.Log.Level, "debug", "info", "warn", "error")
+	oneOf("log.format", c.Log.Format, "json", "cloud", "text")
+	for _, p := range c.Log.RedactPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			fail("log.redact_patterns", "invalid regular expression %q: %v", p, err)
+		}
+	}
+
+	oneOf("profiler.backend", c.Profiler.Backend, "", "none", "cloud", "pprof")
+	if c.Profiler.Backend == "pprof" && c.Profiler.Addr == "" {
+		fail("profiler.addr", "required for the pprof backend")
+	}
+
+	positive("heartbeat.interval", c.Heartbeat.Interval)
+	if c.Heartbeat.Window < 1 {
+		fail("heartbeat.window", "must be at least 1")
+	}
+	if c.Heartbeat.GrowthFactor <= 1 {
+		fail("heartbeat.growth_factor", "must be greater than 1")
+	}
+
+	oneOf("error_reporting.backend", c.ErrorReporting.Backend, "", "none", "cloud", "sentry")
+	if c.ErrorReporting.Backend == "sentry" && c.ErrorReporting.SentryDSN == "" {
+		fail("error_reporting.sentry_dsn", "required for the sentry backend")
+	}
+	if r := c.ErrorReporting.SampleRate; r < 0 || r > 1 {
+		fail("error_reporting.sample_rate", "must be between 0 and 1, got %v", r)
+	}
+
+	oneOf("secrets.backend", c.Secrets.Backend, "", "gcp", "env", "file", "vault")
+	positive("secrets.cache_ttl", c.Secrets.CacheTTL)
+	positive("secrets.fetch_timeout", c.Secrets.FetchTimeout)
+	if c.Secrets.BreakerFailures < 1 {
+		fail("secrets.breaker_failures", "must be at least 1")
+	}
+	oneOf("secrets.fallback", c.Secrets.Fallback, "", "env", "file")
+	if c.Secrets.Fallback != "" && c.Secrets.Backend != "" && c.Secrets.Backend != "gcp" {
+		fail("secrets.fallback", "only applies to the gcp backend, got backend %q", c.Secrets.Backend)
+	}
+	if c.Secrets.Backend == "vault" {
+		if u, err := url.Parse(c.Secrets.Vault.Addr); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("secrets.vault.addr", "must be a URL such as https://vault:8200 for the vault backend, got %q", c.Secrets.Vault.Addr)
+		}
+	}
+
+	oneOf("auth.mode", c.Auth.Mode, "disabled", "optional", "required")
+	if c.Auth.OIDCAudience != "" && c.Auth.OIDCIssuer == "" {
+		fail("auth.oidc_issuer", "required when oidc_audience is set")
+	}
+	positive("auth.session_idle_timeout", c.Auth.SessionIdleTimeout)
+	positive("auth.session_max_age", c.Auth.SessionMaxAge)
+	if c.Auth.SessionIdleTimeout > c.Auth.SessionMaxAge {
+		fail("auth.session_idle_timeout", "must not exceed session_max_age (%v)", c.Auth.SessionMaxAge)
+	}
+
+	positive("database.business_metrics_interval", c.Database.BusinessMetricsInterval)
+	if c.Database.WriteBatching {
+		positive("database.write_batch_wait", c.Database.WriteBatchWait)
+		if c.Database.WriteBatchMax < 1 {
+			fail("database.write_batch_max", "must be at least 1")
+		}
+	}
+	if c.Database.WarmupConns < 0 {
+		fail("database.warmup_conns", "must not be negative")
+	} else if c.Database.WarmupConns > 0 {
+		positive("database.warmup_timeout", c.Database.WarmupTimeout)
+	}
+
+	if c.Abuse.Enabled {
+		if c.Abuse.AuthFailureLimit < 1 {
+			fail("abuse.auth_failure_limit", "must be at least 1")
+		}
+		if c.Abuse.MalformedLimit < 1 {
+			fail("abuse.malformed_limit", "must be at least 1")
+		}
+		positive("abuse.auth_failure_window", c.Abuse.AuthFailureWindow)
+		positive("abuse.malformed_window", c.Abuse.MalformedWindow)
+		positive("abuse.ban_base", c.Abuse.BanBase)
+		positive("abuse.strike_memory", c.Abuse.StrikeMemory)
+		if c.Abuse.BanMax < c.Abuse.BanBase {
+			fail("abuse.ban_max", "must not be shorter than ban_base (%v)", c.Abuse.BanBase)
+		}
+		if c.Abuse.RedisURL != "" {
+			if _, err := url.Parse(c.Abuse.RedisURL); err != nil {
+				fail("abuse.redis_url", "%v", err)
+			}
+		}
+	}
+
+	if c.Cache.RedisURL != "" {
+		if _, err := url.Parse(c.Cache.RedisURL); err != nil {
+			fail("cache.redis_url", "%v", err)
+		}
+	}
+	if c.Cache.MemoryEntries < 0 {
+		fail("cache.memory_entries", "must not be negative")
+	}
+	if c.Cache.RedisURL != "" || c.Cache.MemoryEntries > 0 {
+		positive("cache.list_ttl", c.Cache.ListTTL)
+		positive("cache.todo_ttl", c.Cache.TodoTTL)
+	}
+	switch {
+	case c.Cache.AggregateRefresh < 0:
+		fail("cache.aggregate_refresh", "must not be negative")
+	case c.Cache.AggregateRefresh > 0 && c.Cache.AggregateMaxStaleness < c.Cache.AggregateRefresh:
+		// Every snapshot would be too old to serve before the refresher got to it.
+		fail("cache.aggregate_max_staleness", "must be at least cache.aggregate_refresh (%s)", c.Cache.AggregateRefresh)
+	}
+
+	if c.Exports.SigningKeys != "" {
+		if c.Exports.SigningKeysSecret != "" {
+			fail("exports.signing_keys", "set either signing_keys or signing_keys_secret, not both")
+		}
+	}
+	positive("exports.retention", c.Exports.Retention)
+	positive("exports.url_ttl", c.Exports.URLTTL)
+	positive("exports.timeout", c.Exports.Timeout)
+	if c.Exports.Timeout > 10*time.Minute {
+		fail("exports.timeout", "must be at most 10m, the timeout of an export job attempt")
+	}
+	if c.Exports.URLTTL > c.Exports.Retention {
+		fail("exports.url_ttl", "must not exceed retention (%v)", c.Exports.Retention)
+	}
+
+	positive("webhooks.timeout", c.Webhooks.Timeout)
+	positive("webhooks.delivery_retention", c.Webhooks.DeliveryRetention)
+	if c.Webhooks.MaxAttempts < 1 {
+		fail("webhooks.max_attempts", "must be at least 1")
+	}
+
+	if len(c.Events.KafkaBrokers) > 0 {
+		if c.Events.KafkaTopic == "" {
+			fail("events.kafka_topic", "required with kafka_brokers")
+		}
+		if c.Events.KafkaBatchMaxBytes < 1 {
+			fail("events.kafka_batch_max_bytes", "must be at least 1")
+		}
+		positive("events.kafka_timeout", c.Events.KafkaTimeout)
+		if c.Events.KafkaLinger < 0 {
+			fail("events.kafka_linger", "must not be negative")
+		}
+	}
+
+	if u := c.Slack.WebhookURL; u != "" && !strings.HasPrefix(u, "https://") {
+		fail("slack.webhook_url", "must be an https:// URL")
+	}
+	if c.Notifications.RemindBefore < 0 {
+		fail("notifications.remind_before", "must be at least 0")
+	}
+	if c.Notifications.MaxAttempts < 1 {
+		fail("notifications.max_attempts", "must be at least 1")
+	}
+
+	oneOf("jobs.queue", c.Jobs.Queue, "inprocess", "cloudtasks")
+	if c.Jobs.Workers < 1 {
+		fail("jobs.workers", "must be at least 1")
+	}
+	if c.Jobs.Queue == "cloudtasks" {
+		if !strings.HasPrefix(c.Jobs.TargetURL, "https://") {
+			fail("jobs.target_url", "must be an https:// URL, got %q", c.Jobs.TargetURL)
+		}
+		if len(c.Jobs.SigningSecret) < 32 {
+			fail("jobs.signing_secret", "must be at least 32 bytes")
+		}
+	}
+
+	if j := c.Scheduler.Jitter; j < 0 || j >= time.Minute {
+		fail("scheduler.jitter", "must be at least 0 and less than 1m, got %s", j)
+	}
+	if c.Attachments.Bucket != "" && c.Attachments.ServiceAccount == "" {
+		fail("attachments.service_account", "required when bucket is set")
+	}
+	if c.Attachments.MaxBytes < 1 {
+		fail("attachments.max_bytes", "must be at least 1")
+	}
+	positive("attachments.url_ttl", c.Attachments.URLTTL)
+	if c.Attachments.URLTTL > 7*24*time.Hour {
+		fail("attachments.url_ttl", "must be at most 7 days, the limit of signed URLs")
+	}
+
+	switch c.Suggestions.Provider {
+	case "none":
+	case "vertex":
+		if c.Suggestions.Location == "" || c.Suggestions.Model == "" {
+			fail("suggestions.model", "location and model are required with the vertex provider")
+		}
+	default:
+		fail("suggestions.provider", "must be none or vertex, got %q", c.Suggestions.Provider)
+	}
+	positive("suggestions.timeout", c.Suggestions.Timeout)
+	if c.Suggestions.CacheTTL < 0 {
+		fail("suggestions.cache_ttl", "must not be negative")
+	}
+
+	if c.Retention.CompletedAfter < 0 {
+		fail("retention.completed_after", "must not be negative")
+	}
+	if c.Retention.ArchivedAfter < 0 {
+		fail("retention.archived_after", "must not be negative")
+	}
+	positive("retention.interval", c.Retention.Interval)
+	if n := c.Retention.BatchSize; n < 1 || n > 10000 {
+		fail("retention.batch_size", "must be between 1 and 10000, got %d", n)
+	}
+	if c.Tenancy.RequestsPerMinute < 0 {
+		fail("tenancy.requests_per_minute", "must not be negative")
+	}
+	if d := c.Tenancy.BaseDomain; d != "" && (strings.Contains(d, "://") || strings.HasPrefix(d, ".") || strings.ContainsAny(d, "/: ")) {
+		fail("tenancy.base_domain", "must be a bare domain such as todo.example.com, got %q", d)
+	}
+	if c.Tenancy.Claim != "" && c.Auth.OIDCIssuer == "" {
+		fail("tenancy.claim", "needs auth.oidc_issuer")
+	}
+
+	if c.Breaker.MinRequests < 1 {
+		fail("breaker.min_requests", "must be at least 1")
+	}
+	if r := c.Breaker.FailureRatio; r <= 0 || r > 1 {
+		fail("breaker.failure_ratio", "must be above 0 and at most 1, got %v", r)
+	}
+	positive("preflight.timeout", c.Preflight.Timeout)
+	positive("preflight.max_clock_skew", c.Preflight.MaxClockSkew)
+	if u := c.Preflight.ClockURL; u != "" && !strings.HasPrefix(u, "https://") {
+		fail("preflight.clock_url", "must be an https:// URL, got %q", u)
+	}
+	if r := c.Runtime.MemoryLimitRatio; c.Runtime.ContainerAware && (r <= 0 || r > 1) {
+		fail("runtime.memory_limit_ratio", "must be above 0 and at most 1, got %v", r)
+	}
+	for name := range c.Features {
+		if name == "" || strings.ContainsAny(name, ",= ") {
+			fail("features", "invalid feature name %q", name)
+		}
+	}
+
+	for _, check := range checks {
+		check(c, fail)
+	}
+	return errors.Join(errs...)
+}
+
+// checks are the checks added by AddCheck.
+var checks []func(c *Config, fail func(path, format string, args ...any))
+
+// AddCheck adds check to those Validate runs, for settings only the package using them
+// can parse (cron specs, signing keys, queue names...). check reports each problem
+// through fail, with the setting's path. Packages call it from init.
+func AddCheck(check func(c *Config, fail func(path, format string, args ...any))) {
+	checks = append(checks, check)
+}
+
+// Effective returns the resolved settings as nested maps keyed like the config file,
+// with durations in Go syntax and secrets masked, for logs and GET /admin/config.
+func (c *Config) Effective() map[string]any {
+	out := make(map[string]any)
+	for _, f := range configFields(c) {
+		m := out
+		parts := strings.Split(f.path, ".")
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				m[p] = next
+			}
+			m = next
+		}
+		var v any = f.value.Interface()
+		switch {
+		case f.secret && !f.value.IsZero():
+			v = "[REDACTED]"
+		case f.value.Type() == durationType:
+			v = time.Duration(f.value.Int()).String()
+		}
+		m[parts[len(parts)-1]] = v
+	}
+	return out
+}
+
+// Sources reports where each setting that is not at its default came from:
+// "file", "env <NAME>" or "flag -<path>".
+func (c *Config) Sources() map[string]string {
+	out := make(map[string]string, len(c.sources))
+	for k, v := range c.sources {
+		out[k] = v
+	}
+	return out
+}
+
+// Fingerprint is a short hash of every setting, secrets included, so replicas can be
+// compared without revealing values: the same fingerprint means the same configuration,
+// however it was assembled (profile, file, environment, flags).
+func (c *Config) Fingerprint() string {
+	h := sha256.New()
+	for _, f := range configFields(c) {
+		fmt.Fprintf(h, "%s=%v\n", f.path, f.value.Interface())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Change is one setting that differs between two configurations.
+type Change struct {
+	Path    string
+	Old     string
+	New     string
+	Applied bool // false for settings that only take effect after a restart
+}
+
+// Update copies into c the settings of next tagged reload:"true", with where they came
+// from, and returns every setting in which the two differ; the others keep their value.
+func (c *Config) Update(next *Config) []Change {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	var changes []Change
+	nextFields := configFields(next)
+	for i, f := range configFields(c) {
+		nf := nextFields[i]
+		if reflect.DeepEqual(f.value.Interface(), nf.value.Interface()) {
+			continue
+		}
+		changes = append(changes, Change{Path: f.path, Old: f.display(), New: nf.display(), Applied: f.reload})
+		if f.reload {
+			f.value.Set(nf.value)
+			if src, ok := next.sources[f.path]; ok {
+				c.sources[f.path] = src
+			} else {
+				delete(c.sources, f.path)
+			}
+		}
+	}
+	return changes
+}
+
+// configField is one leaf setting of Config, addressed by its dotted yaml path.
+type configField struct {
+	path      string
+	legacyEnv string
+	help      string
+	reload    bool
+	secret    bool
+	value     reflect.Value
+}
+
+// envName is the prefixed environment variable, e.g. TODO_SERVER_PORT.
+func (f configField) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.path, ".", "_"))
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// display formats the value for logs, hiding secrets.
+func (f configField) display() string {
+	if f.secret {
+		if f.value.IsZero() {
+			return ""
+		}
+		return "[REDACTED]"
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// set parses v into the field. Lists are comma-separated or a JSON array.
+func (f configField) set(v string) error {
+	switch {
+	case f.value.Type() == durationType:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(v)
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("want true or false")
+		}
+		f.value.SetBool(b)
+	case f.value.Kind() == reflect.Int || f.value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("want an integer")
+		}
+		f.value.SetInt(n)
+	case f.value.Kind() == reflect.Uint32:
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return errors.New("want a non-negative integer")
+		}
+		f.value.SetUint(n)
+	case f.value.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.New("want a number")
+		}
+		f.value.SetFloat(n)
+	case f.value.Kind() == reflect.Slice && f.value.Type().Elem().Kind() == reflect.String:
+		var list []string
+		if strings.HasPrefix(strings.TrimSpace(v), "[") {
+			if err := json.Unmarshal([]byte(v), &list); err != nil {
+				return fmt.Errorf("invalid JSON array: %w", err)
+			}
+		} else {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	case f.value.Type() == reflect.TypeOf(map[string]bool(nil)):
+		// name or name=bool, comma-separated; merged into what the file set
+		m := make(map[string]bool)
+		for k, on := range f.value.Interface().(map[string]bool) {
+			m[k] = on
+		}
+		for _, s := range strings.Split(v, ",") {
+			name, val, hasVal := strings.Cut(strings.TrimSpace(s), "=")
+			if name == "" {
+				continue
+			}
+			on := true
+			if hasVal {
+				var err error
+				if on, err = strconv.ParseBool(val); err != nil {
+					return fmt.Errorf("%s: want true or false", name)
+				}
+			}
+			m[name] = on
+		}
+		f.value.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+// configFields lists the leaf settings of cfg in declaration order.
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			fv := v.Field(i)
+			if sf.Type.Kind() == reflect.Struct && sf.Type != durationType {
+				walk(prefix+name+".", fv)
+				continue
+			}
+			fields = append(fields, configField{
+				path:      prefix + name,
+				legacyEnv: sf.Tag.Get("env"),
+				help:      sf.Tag.Get("help"),
+				reload:    sf.Tag.Get("reload") == "true",
+				secret:    sf.Tag.Get("secret") == "true",
+				value:     fv,
+			})
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return fields
+}
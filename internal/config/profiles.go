@@ -0,0 +1,63 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProfileEnvVar names the environment profile. A profile replaces defaults in bulk;
+// the config file, environment and flags still override it setting by setting.
+const ProfileEnvVar = "APP_ENV"
+
+// Profiles are the environment profiles. Without APP_ENV the plain defaults apply,
+// which is what existing deployments run with.
+var Profiles = map[string]func(*Config){
+	// dev: a laptop or docker-compose. Secrets come from SECRET_<ID> variables, e.g.
+	// SECRET_TODO_APP_SECRET='{"db_user": ..., "db_password": ...}', nothing is sent to Google.
+	"dev": func(c *Config) {
+		c.Log.Level, c.Log.Format = "debug", "text"
+		c.Secrets.Backend = "env"
+		c.ErrorReporting.Backend = "none"
+		c.Profiler.Backend = "none"
+		c.Server.SwaggerUI = true
+	},
+	// staging: GKE behind the load balancer, with everything prod has except HTTPS enforcement,
+	// so test clients can still talk plain HTTP through port-forwards.
+	"staging": func(c *Config) {
+		c.Log.Level, c.Log.Format = "info", "cloud"
+		c.Server.TrustedProxyHops = 2
+		c.ErrorReporting.Backend = "cloud"
+		c.Abuse.Enabled = true
+	},
+	// prod: GKE behind the load balancer; HTTPS only, logs in Cloud Logging format.
+	"prod": func(c *Config) {
+		c.Log.Level, c.Log.Format = "info", "cloud"
+		c.Server.TrustedProxyHops = 2
+		c.Server.RequireHTTPS = true
+		c.ErrorReporting.Backend = "cloud"
+		c.Abuse.Enabled = true
+	},
+}
+
+func applyProfile(c *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	apply, ok := Profiles[name]
+	if !ok {
+		var names []string
+		for n := range Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("%s: unknown profile %q, want one of %s", ProfileEnvVar, name, strings.Join(names, ", "))
+	}
+	apply(c)
+	c.Profile = name
+	return nil
+}
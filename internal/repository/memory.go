@@ -0,0 +1,256 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+package repository
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Memory is a TodoRepository that keeps the todos in memory, for unit tests, the
+// offline mode of todoctl and demos without a database. It follows the ordering and
+// paging of the Postgres one, but not what the schema's triggers and policies add:
+// lists are not shared, so an owner sees the todos they created and may add to any
+// list, completion does not roll up to parents, and no todo is ever blocked.
+//
+// The zero value is not usable; create one with NewMemory. It is safe for concurrent use.
+type Memory struct {
+	// Err, if set, is called with the name of each operation ("List", "Get",
+	// "Create", "SetCompleted" or "Delete") before it runs; an error it returns is
+	// returned instead and nothing changes. Tests use it to inject failures.
+	Err func(op string) error
+	// Clock is the time of changes; the system clock if nil.
+	Clock Clock
+
+	mu     sync.Mutex
+	todos  map[int]memoryTodo
+	lastID int
+}
+
+type memoryTodo struct {
+	owner string
+	Todo
+}
+
+// NewMemory returns an empty in-memory repository.
+func NewMemory() *Memory {
+	return &Memory{todos: make(map[int]memoryTodo)}
+}
+
+// Add stores t for owner as it is, fields the repository sets included, for seeding
+// test data or a demo. A zero ID is replaced with the next free one. It returns the
+// todo stored.
+func (m *Memory) Add(owner string, t Todo) Todo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.ID == 0 {
+		t.ID = m.lastID + 1
+	}
+	m.lastID = max(m.lastID, t.ID)
+	m.todos[t.ID] = memoryTodo{owner, clone(t)}
+	return clone(t)
+}
+
+func (m *Memory) List(ctx context.Context, owner string, f Filter) ([]Todo, error) {
+	if err := m.fail("List"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var cursor Todo
+	if c := f.Cursor; c != nil {
+		cursor = Todo{ID: c.ID, DueAt: c.DueAt, Starred: c.Starred}
+		if c.Rank > 0 && c.Rank <= len(Priorities) {
+			cursor.Priority = Priorities[len(Priorities)-c.Rank]
+		}
+	}
+	todos := []Todo{}
+	for _, t := range m.todos {
+		if t.owner == owner && matches(t.Todo, f) && (f.Cursor == nil || compareTodos(f.Cursor.Sort, t.Todo, cursor) > 0) {
+			todos = append(todos, clone(t.Todo))
+		}
+	}
+	slices.SortFunc(todos, func(a, b Todo) int { return compareTodos(f.Sort, a, b) })
+	if f.Limit > 0 && len(todos) > f.Limit+1 {
+		todos = todos[:f.Limit+1]
+	}
+	return todos, nil
+}
+
+func (m *Memory) Get(ctx context.Context, owner string, id int, fromPrimary bool) (Todo, error) {
+	if err := m.fail("Get"); err != nil {
+		return Todo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.todos[id]
+	if !ok || t.owner != owner {
+		return Todo{}, ErrNotFound
+	}
+	return clone(t.Todo), nil
+}
+
+func (m *Memory) Create(ctx context.Context, owner, task string, listID *int64) (Todo, error) {
+	if err := m.fail("Create"); err != nil {
+		return Todo{}, err
+	}
+	if err := CheckTask(task); err != nil {
+		return Todo{}, err
+	}
+	now := m.now()
+	t := Todo{Task: task, Priority: PriorityNormal, CreatedAt: now, UpdatedAt: now}
+	if listID != nil {
+		id := *listID
+		t.ListID = &id
+	}
+	return m.Add(owner, t), nil
+}
+
+func (m *Memory) SetCompleted(ctx context.Context, owner string, id int, completed bool) (bool, error) {
+	if err := m.fail("SetCompleted"); err != nil {
+		return false, err
+	}
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.todos[id]
+	if !ok || t.owner != owner {
+		return false, nil
+	}
+	switch {
+	case !completed:
+		t.CompletedAt = nil
+	case t.CompletedAt == nil:
+		t.CompletedAt = &now
+	}
+	t.Completed, t.UpdatedAt = completed, now
+	m.todos[id] = t
+	return true, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, owner string, id int) (bool, error) {
+	if err := m.fail("Delete"); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.todos[id]
+	if !ok || t.owner != owner {
+		return false, nil
+	}
+	// Subtasks go with their parent, as with the foreign key.
+	deleted := []int{id}
+	for len(deleted) > 0 {
+		id, deleted = deleted[0], deleted[1:]
+		delete(m.todos, id)
+		for _, t := range m.todos {
+			if t.ParentID != nil && *t.ParentID == id {
+				deleted = append(deleted, t.ID)
+			}
+		}
+	}
+	return true, nil
+}
+
+func (m *Memory) fail(op string) error {
+	if m.Err == nil {
+		return nil
+	}
+	return m.Err(op)
+}
+
+func (m *Memory) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+// matches reports whether t passes f, its cursor aside.
+func matches(t Todo, f Filter) bool {
+	switch {
+	case t.Archived && !f.IncludeArchived,
+		f.ListID != nil && (t.ListID == nil || *t.ListID != *f.ListID),
+		f.Inbox && t.ListID != nil,
+		f.Priority != "" && t.Priority != f.Priority,
+		f.Starred != nil && t.Starred != *f.Starred:
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !slices.Contains(t.Tags, tag) {
+			return false
+		}
+	}
+	times := map[string]*time.Time{"created_at": &t.CreatedAt, "updated_at": &t.UpdatedAt, "completed_at": t.CompletedAt}
+	for col, after := range f.After {
+		if at := times[col]; at == nil || !at.After(after) {
+			return false
+		}
+	}
+	for col, before := range f.Before {
+		if at := times[col]; at == nil || !at.Before(before) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareTodos orders todos like the ORDER BY of sort: by priority most urgent
+// first, by due date undated last, or starred first, then by id.
+func compareTodos(sort string, a, b Todo) int {
+	var c int
+	switch sort {
+	case "priority":
+		c = cmp.Compare(priorityRank(a.Priority), priorityRank(b.Priority))
+	case "due_at":
+		switch {
+		case a.DueAt == nil && b.DueAt == nil:
+		case a.DueAt == nil:
+			c = 1
+		case b.DueAt == nil:
+			c = -1
+		default:
+			c = a.DueAt.Compare(*b.DueAt)
+		}
+	case "starred":
+		if a.Starred != b.Starred {
+			c = 1
+			if a.Starred {
+				c = -1
+			}
+		}
+	}
+	return cmp.Or(c, cmp.Compare(a.ID, b.ID))
+}
+
+// priorityRank is 1 for urgent to 4 for low, as in a Cursor, and 5 for anything else,
+// which sorts last like the NULL of array_position.
+func priorityRank(p string) int {
+	return len(Priorities) - slices.Index(Priorities, p)
+}
+
+// clone returns t with slices and pointers of its own, so that callers cannot change
+// the stored todo.
+func clone(t Todo) Todo {
+	t.Tags = slices.Clone(t.Tags)
+	for _, p := range []**time.Time{&t.DueAt, &t.RemindAt, &t.CompletedAt} {
+		if *p != nil {
+			v := **p
+			*p = &v
+		}
+	}
+	if t.ListID != nil {
+		v := *t.ListID
+		t.ListID = &v
+	}
+	if t.ParentID != nil {
+		v := *t.ParentID
+		t.ParentID = &v
+	}
+	return t
+}
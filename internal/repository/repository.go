@@ -0,0 +1,120 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Package repository holds the todo model and TodoRepository, the store of todos the
+// app's handlers, adapters and workers read and write them through. The app implements
+// it on Postgres, and NewMemory in memory; a test can hand an app.Server either, or a
+// fake of its own.
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Todo represents a single todo item.
+type Todo struct {
+	ID          int        `json:"id"`
+	Task        string     `json:"task"`
+	Completed   bool       `json:"completed"`
+	ListID      *int64     `json:"list_id,omitempty"`   // nil for personal todos
+	ParentID    *int       `json:"parent_id,omitempty"` // nil for top-level todos
+	DueAt       *time.Time `json:"due_at,omitempty"`    // nil without a due date
+	Priority    string     `json:"priority,omitempty"`  // one of Priorities
+	Tags        []string   `json:"tags,omitempty"`
+	RRule       string     `json:"rrule,omitempty"`     // recurrence rule, see app.ParseRRule
+	RemindAt    *time.Time `json:"remind_at,omitempty"` // nil without a reminder
+	CreatedAt   time.Time  `json:"created_at,omitzero"`
+	UpdatedAt   time.Time  `json:"updated_at,omitzero"`    // last change to the todo's own fields, not its tags
+	CompletedAt *time.Time `json:"completed_at,omitempty"` // nil while open
+	Archived    bool       `json:"archived,omitempty"`     // hidden from lists, see app.HandleTodoArchive
+	Starred     bool       `json:"starred,omitempty"`      // pinned, see app.HandleTodoStar
+}
+
+// Todo priorities, most urgent last. Todos are PriorityNormal unless set.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// Priorities are the valid priorities, least urgent first.
+var Priorities = []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityUrgent}
+
+// Filter narrows and orders a list of todos; the zero value lists all that are not
+// archived, by id.
+type Filter struct {
+	ListID          *int64   // todos on this list
+	Inbox           bool     // personal todos only
+	Tags            []string // todos carrying all of these
+	Priority        string
+	Starred         *bool  // todos starred, or not
+	Sort            string // "", "id", "priority", "due_at" or "starred"
+	IncludeArchived bool
+	Limit           int     // at most this many, plus one to tell whether there are more; 0 for all
+	Cursor          *Cursor // todos after this one in the order of Sort
+	// After and Before bound the created_at, updated_at and completed_at times, by
+	// column: todos with a time strictly inside the range. A bound on completed_at
+	// leaves out open todos.
+	After, Before map[string]time.Time
+}
+
+// Cursor is the position after which a page of todos starts: the sort key and id of
+// the last todo of the page before.
+type Cursor struct {
+	Sort    string     `json:"s"`
+	ID      int        `json:"id"`
+	Rank    int        `json:"r,omitempty"` // sort=priority: 1 for urgent to 4 for low
+	DueAt   *time.Time `json:"d,omitempty"` // sort=due_at
+	Starred bool       `json:"st,omitempty"`
+}
+
+var (
+	// ErrNotFound is what Get returns for a todo the owner cannot see. It is
+	// sql.ErrNoRows, so that callers test for one error whatever the implementation.
+	ErrNotFound = sql.ErrNoRows
+	// ErrForbidden is returned by Create for a list the owner may not edit.
+	ErrForbidden = errors.New("cannot add todos to this list")
+	// ErrBlocked is returned by SetCompleted for a todo with open blockers.
+	ErrBlocked = errors.New("todo is blocked by open todos")
+	// ErrInvalidTask is returned by Create for task text that cannot be stored.
+	ErrInvalidTask = errors.New("task must be UTF-8 text without NUL bytes")
+)
+
+// CheckTask returns ErrInvalidTask for task text Postgres refuses to store: invalid
+// UTF-8 or a NUL byte.
+func CheckTask(task string) error {
+	if !utf8.ValidString(task) || strings.ContainsRune(task, 0) {
+		return ErrInvalidTask
+	}
+	return nil
+}
+
+// TodoRepository stores the todos of every owner. Each method is scoped to owner:
+// todos owner cannot see are not found, and those owner cannot change are not
+// changed. Task text goes in and comes out in the clear.
+type TodoRepository interface {
+	// List returns the todos owner can see that pass f.
+	List(ctx context.Context, owner string, f Filter) ([]Todo, error)
+	// Get returns todo id, or ErrNotFound. fromPrimary asks for a read that sees the
+	// caller's own writes, for reads right after one.
+	Get(ctx context.Context, owner string, id int, fromPrimary bool) (Todo, error)
+	// Create adds a todo for owner, into listID if set.
+	Create(ctx context.Context, owner, task string, listID *int64) (Todo, error)
+	// SetCompleted completes or reopens todo id and reports whether owner could
+	// change it.
+	SetCompleted(ctx context.Context, owner string, id int, completed bool) (bool, error)
+	// Delete deletes todo id and reports whether owner could delete it.
+	Delete(ctx context.Context, owner string, id int) (bool, error)
+}
+
+// Clock tells a repository the time of changes, so tests can fix it.
+type Clock interface {
+	Now() time.Time
+}
@@ -0,0 +1,101 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Package server puts the app together for serving: the routes of an app.Server and
+// the middleware every request to them goes through. main serves New's handler; tests
+// build one around a Server on fakes.
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stevemcghee/go-to-production/internal/app"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// New returns the handler of s: its routes behind the middleware. adminConfig serves
+// /admin/config.
+func New(s *app.Server, adminConfig http.Handler) http.Handler {
+	return Handler(s, NewMux(s, adminConfig))
+}
+
+// Handler wraps mux in the middleware every request to the server goes through:
+// tracing, security headers, request id, error reporting, abuse protection, CSRF,
+// auth, the tenant rate limit, metering, idempotency and the read cache.
+func Handler(s *app.Server, mux http.Handler) http.Handler {
+	return otelhttp.NewHandler(
+		s.SecurityHeadersMiddleware(s.RequestIDMiddleware(s.ErrorReportingMiddleware(app.AbuseMiddleware(app.CSRFMiddleware(s.AuthMiddleware(s.TenantRateLimitMiddleware(s.MeteringMiddleware(s.IdempotencyMiddleware(app.TodoCacheMiddleware(mux)))))))))),
+		"go-to-production",
+	)
+}
+
+// NewMux returns the routes of s. adminConfig serves /admin/config.
+func NewMux(s *app.Server, adminConfig http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.ServeIndex)
+	mux.HandleFunc("/todos", s.HandleTodos)
+	mux.HandleFunc("/todos/", s.HandleTodo)
+	// The busiest route of all, also as a pattern that matches it exactly: the mux would
+	// otherwise look for a /todos/{id}/ to redirect to on every request.
+	mux.HandleFunc("/todos/{id}", s.HandleTodo)
+	mux.HandleFunc("/todos/events", s.HandleTodoEvents)
+	mux.HandleFunc("/todos/overdue", s.HandleOverdueTodos)
+	mux.HandleFunc("/todos/today", s.HandleTodosDueToday)
+	mux.HandleFunc("/tags", s.HandleTags)
+	mux.HandleFunc("/stats", s.HandleStats)
+	mux.HandleFunc("/activity", s.HandleActivity)
+	mux.HandleFunc("/sync", s.HandleSync)     // offline clients: changes since a token, and batched pushes
+	mux.Handle("/v1/", s.NewGatewayHandler()) // generated from proto/todo/v1/todo.proto
+	mux.HandleFunc("/graphql", s.HandleGraphQL)
+	mux.Handle("/mcp", s.NewMCPHandler()) // Model Context Protocol for AI assistants
+	mux.HandleFunc("/ws", s.HandleLiveWS)
+	mux.HandleFunc("/lists", s.HandleLists)
+	mux.HandleFunc("/lists/", s.HandleList)
+	mux.HandleFunc("/exports", s.HandleExports)
+	mux.HandleFunc("/exports/", s.HandleExport)
+	mux.HandleFunc("/webhooks", s.HandleWebhooks)
+	mux.HandleFunc("/webhooks/", s.HandleWebhook)
+	mux.HandleFunc("/integrations/slack/command", s.HandleSlackCommand) // /todo slash command, signed by Slack
+	mux.HandleFunc("/me/notifications", s.HandleNotificationPreferences)
+	mux.HandleFunc("/me/settings", s.HandleUserSettings)
+	mux.HandleFunc("/me/quota", s.HandleMyQuota)
+	mux.HandleFunc("/me/export", s.HandleMyExport)
+	mux.HandleFunc("/me/delete", s.HandleMyDelete)
+	mux.HandleFunc("/imports", s.HandleImports)
+	mux.HandleFunc("/jobs/", s.HandleJob)
+	mux.HandleFunc("/internal/jobs/run", s.HandleRunJob) // Cloud Tasks, signed with jobs.signing_secret
+	mux.HandleFunc("/me/calendar", s.HandleCalendarFeed)
+	mux.HandleFunc("/calendar/", s.HandleCalendar) // secret feed URLs, authorized by their token
+	mux.HandleFunc("/caldav/", s.HandleCalDAV)
+	mux.HandleFunc("/auth/login", s.HandleLogin)
+	mux.HandleFunc("/auth/logout", s.HandleLogout)
+	mux.HandleFunc("/auth/session", app.HandleSession)
+	mux.HandleFunc("/auth/google", app.HandleGoogleLogin)
+	mux.HandleFunc("/auth/google/callback", s.HandleGoogleCallback)
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/readyz", s.ReadyzHandler)
+	mux.HandleFunc("/version", app.VersionHandler)
+	mux.HandleFunc("/openapi.json", app.HandleOpenAPI)
+	mux.HandleFunc("/docs", app.HandleAPIDocs)
+	mux.HandleFunc("/admin/usage", s.UsageReportHandler)
+	mux.HandleFunc("/admin/apikeys", s.HandleAPIKeys)
+	mux.HandleFunc("/admin/apikeys/", s.HandleAPIKey)
+	mux.HandleFunc("/admin/jobs", s.HandleAdminJobs)
+	mux.HandleFunc("/admin/jobs/schedules", s.HandleAdminSchedules)
+	mux.HandleFunc("/admin/jobs/schedules/", s.HandleAdminSchedule)
+	mux.HandleFunc("/admin/db/recycle", s.HandleAdminDBRecycle)
+	mux.HandleFunc("/admin/workers", app.HandleAdminWorkers)
+	mux.HandleFunc("/admin/resources", s.HandleAdminResources)
+	mux.HandleFunc("/admin/resources/", s.HandleAdminResources)
+	mux.Handle("/admin/config", adminConfig)
+	// OpenMetrics format is required for histogram exemplars (trace ids on latency buckets)
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+
+	mux.HandleFunc("/static/", app.ServeStatic)
+	return mux
+}
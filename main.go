@@ -5,29 +5,94 @@
 package main
 
 import (
+	"context"
+	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/stevemcghee/go-to-production/internal/app"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stevemcghee/go-to-production/internal/config"
+	"github.com/stevemcghee/go-to-production/internal/server"
 )
 
+// webFiles is the browser UI, embedded so that the binary needs no files next to it.
+//
+//go:embed static templates
+var webFiles embed.FS
+
 func main() {
-	fmt.Println("Raw stdout: Application starting...")
+	// Configuration: defaults < -config file (YAML or JSON) < environment < flags.
+	// See docs/CONFIGURATION.md; -h lists every setting with its variables.
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	// With -mcp-stdio, stdout carries the MCP protocol, so logs go to stderr.
+	logOut := os.Stdout
+	if cfg.MCPStdio {
+		logOut = os.Stderr
+	} else {
+		fmt.Println("Raw stdout: Application starting...")
+	}
+
+	// Everything logged passes through the redactor (task text, DSNs, secret names, tokens).
+	// log.redact_keys and log.redact_patterns add rules.
+	redactor, err := app.NewRedactor(cfg.Log.RedactKeys, cfg.Log.RedactPatterns)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid redaction configuration: %v\n", err)
+		os.Exit(1)
+	}
+	app.Redaction = redactor
+	app.ApplyRuntimeConfig(cfg)
+	logHandler := app.NewLogHandler(logOut, cfg.Log.Format, app.LogLevel)
+	slog.SetDefault(slog.New(app.NewRedactingHandler(logHandler, redactor)))
 
-	jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
-	slog.SetDefault(slog.New(jsonHandler))
+	// -validate-config (CI, pre-deploy): also resolve the secrets the config refers to and,
+	// with -validate-db, connect to the database; then exit without serving.
+	if cfg.CheckOnly {
+		checkCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := app.CheckConfig(checkCtx, cfg, cfg.CheckDatabase)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
 
-	if _, err := os.Stat("templates/index.html"); os.IsNotExist(err) {
-		slog.Error("templates/index.html not found!")
-	} else {
-		slog.Info("templates/index.html found")
+	// -dump-openapi (CI, client generators): write the OpenAPI document and exit.
+	if path := cfg.DumpOpenAPI; path != "" {
+		spec, err := app.MarshalOpenAPISpec()
+		if err == nil {
+			err = os.WriteFile(path, spec, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the OpenAPI document: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if app.WebAssets, err = app.NewAssets(webFiles); err != nil {
+		slog.Error("Failed to load the web UI", "error", err)
+		os.Exit(1)
 	}
 
 	defer func() {
@@ -39,11 +104,27 @@ func main() {
 
 	slog.Info("Logger initialized")
 
-	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if projectID == "" {
-		projectID = "smcghee-todo-p15n-38a6"
+	// runtime.container_aware: GOMAXPROCS and GOMEMLIMIT from the pod's CPU and memory
+	// limits, so that it is neither throttled nor OOM-killed (GOMAXPROCS/GOMEMLIMIT win).
+	if cfg.Runtime.ContainerAware {
+		limits, err := app.ReadContainerLimits(os.DirFS("/"))
+		if err != nil {
+			slog.Warn("Failed to read the container limits", "error", err)
+		}
+		rl := app.ApplyContainerLimits(limits, cfg.Runtime.MemoryLimitRatio, os.LookupEnv)
+		slog.Info("Runtime limits", "gomaxprocs", rl.GOMAXPROCS, "gomaxprocs_source", rl.GOMAXPROCSSource,
+			"gomemlimit", rl.MemoryLimit, "gomemlimit_source", rl.MemoryLimitSource,
+			"cpu_limit", limits.CPUs, "memory_limit", limits.MemoryBytes)
 	}
 
+	buildInfo := app.GetBuildInfo()
+	app.RecordBuildInfo()
+	slog.Info("Build info", "version", buildInfo.Version, "git_commit", buildInfo.GitCommit, "build_time", buildInfo.BuildTime, "go_version", buildInfo.GoVersion)
+	// Same as GET /admin/config, so the settings of a pod can be found from its logs
+	slog.Info("Effective configuration", "profile", cfg.Profile, "file", cfg.File, "fingerprint", cfg.Fingerprint(), "settings", cfg.Effective(), "sources", cfg.Sources())
+
+	projectID := cfg.ProjectID
+
 	// Initialize Cloud Trace
 	shutdown, err := app.InitTracer(projectID)
 	if err != nil {
@@ -53,14 +134,60 @@ func main() {
 		defer shutdown()
 	}
 
-	secretName := fmt.Sprintf("projects/%s/secrets/todo-app-secret/versions/latest", projectID)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Continuous profiling (profiler.backend=cloud|pprof|none)
+	profilerCfg := app.ProfilerConfig{
+		Backend:   cfg.Profiler.Backend,
+		ProjectID: projectID,
+		Service:   "todo-app-go",
+		Version:   buildInfo.Version,
+		Addr:      cfg.Profiler.Addr,
+		Mutex:     cfg.Profiler.Mutex,
+	}
+	if err := app.StartProfiler(ctx, profilerCfg); err != nil {
+		slog.Warn("Failed to start profiler", "error", err)
+	} else if profilerCfg.Backend != "" && profilerCfg.Backend != "none" {
+		slog.Info("Continuous profiling enabled", "backend", profilerCfg.Backend)
+	}
+
+	// Heartbeat: periodic uptime/resource log line with leak warnings
+	app.StartHeartbeat(ctx, app.NewHeartbeatConfig(cfg.Heartbeat))
 
-	secretValue, err := app.AccessSecretVersion(secretName)
+	// Initialize error reporting (Cloud Error Reporting via structured logs by default)
+	errorCfg := cfg.ErrorReporting
+	if err := app.InitErrorReporting(errorCfg.Backend, errorCfg.SentryDSN, errorCfg.SampleRate, buildInfo.Version); err != nil {
+		slog.Warn("Failed to initialize error reporting", "error", err)
+	} else {
+		slog.Info("Error reporting initialized", "backend", errorCfg.Backend, "sample_rate", errorCfg.SampleRate)
+	}
+
+	// Secrets are cached for secrets.cache_ttl and refreshed in the background;
+	// when Secret Manager is unreachable the last fetched value keeps being served.
+	// secrets.backend=gcp|env|file|vault selects where secrets come from. Secret Manager
+	// reads are retried for secrets.fetch_timeout and fall back to secrets.fallback.
+	secretTTL := cfg.Secrets.CacheTTL
+	secretAccessor, err := app.NewSecretAccessor(ctx, app.NewSecretBackendConfig(cfg.Secrets))
 	if err != nil {
-		slog.Error("Failed to fetch secret from Secret Manager", "error", err)
+		slog.Error("Failed to create secret backend", "error", err)
+		os.Exit(1)
+	}
+	if c, ok := secretAccessor.(io.Closer); ok {
+		defer c.Close()
+	}
+	app.Secrets = app.NewSecretProvider(secretAccessor, secretTTL)
+	app.Secrets.Timeout = cfg.Secrets.FetchTimeout
+	app.Secrets.StartRefresh(ctx, secretTTL/2)
+
+	secretName := cfg.Secrets.DatabaseSecret
+
+	secretValue, err := app.AccessSecretVersion(ctx, secretName)
+	if err != nil {
+		slog.Error("Failed to fetch database secret", "error", err)
 		os.Exit(1)
 	} else {
-		slog.Info("Successfully fetched secret from Secret Manager")
+		slog.Info("Successfully fetched database secret")
 	}
 
 	var dbConfig app.DBConfig
@@ -68,51 +195,486 @@ func main() {
 		slog.Error("Failed to parse secret JSON", "error", err)
 		os.Exit(1)
 	}
+	dbConfig = dbConfig.WithSettings(cfg.Database)
+	// Handlers and workers are methods of srv, which holds the pools and what uses them.
+	srv := app.NewServer(app.ConnectDB(dbConfig))
 
-	app.InitDB(dbConfig)
-	defer app.DB.Close()
-	if app.DBRead != app.DB {
-		defer app.DBRead.Close()
+	// API key authentication: auth.mode=disabled|optional|required
+	app.AuthMode = cfg.Auth.Mode
+	adminKeySecret := cfg.Auth.AdminKeySecret
+	if adminKey, err := app.AccessSecretVersion(ctx, adminKeySecret); err != nil {
+		slog.Warn("Bootstrap admin key not available; admin endpoints need a database API key", "error", err)
+	} else {
+		srv.APIKeys.SetBootstrapKey(strings.TrimSpace(adminKey))
+		app.Secrets.OnChange(adminKeySecret, func(v string) { srv.APIKeys.SetBootstrapKey(strings.TrimSpace(v)) })
+		slog.Info("Bootstrap admin key loaded")
+	}
+	// OIDC bearer tokens: auth.oidc_issuer (e.g. https://accounts.google.com) and auth.oidc_audience
+	if issuer := cfg.Auth.OIDCIssuer; issuer != "" {
+		app.OIDC = app.NewOIDCVerifier(issuer, cfg.Auth.OIDCAudience, cfg.Auth.OIDCJWKSURL)
+		slog.Info("OIDC bearer token authentication enabled", "issuer", issuer)
+	}
+	// Google sign-in for the web UI; the OAuth client lives in Secret Manager
+	if clientID, clientSecret, err := app.LoadGoogleClient(ctx, cfg.Auth.GoogleOAuthSecret); err != nil {
+		slog.Info("Google sign-in disabled", "reason", err)
+	} else {
+		app.Google = app.NewGoogleLogin(clientID, clientSecret, cfg.Auth.GoogleOAuthRedirectURL)
+		slog.Info("Google sign-in enabled")
 	}
+	slog.Info("Authentication configured", "mode", app.AuthMode)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", app.ServeIndex)
-	mux.HandleFunc("/todos", app.HandleTodos)
-	mux.HandleFunc("/todos/", app.HandleTodo)
-	mux.HandleFunc("/healthz", app.HealthzHandler)
-	mux.Handle("/metrics", promhttp.Handler())
+	srv.WatchDBSecret(app.Secrets, secretName)
+	// database.warmup_conns: fill the pools while the rest starts up; /readyz fails until then.
+	app.Warmup.Conns, app.Warmup.Timeout = cfg.Database.WarmupConns, cfg.Database.WarmupTimeout
+	srv.StartDBWarmup(ctx)
+
+	// SIGHUP reloads the configuration and re-reads every secret now. Changes to the
+	// config file are picked up without it. secrets.rotation_topic (the Pub/Sub topic
+	// Secret Manager notifies) refreshes the secret that changed.
+	reloader := app.NewConfigReloader(cfg, os.Args[1:], os.LookupEnv)
+	if err := reloader.Watch(ctx); err != nil {
+		slog.Warn("Not watching the config file; reload with SIGHUP", "file", cfg.File, "error", err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("SIGHUP received, reloading configuration and secrets")
+				reloader.Reload()
+				app.Secrets.RefreshAll(ctx)
+			}
+		}
+	}()
+	if topic := cfg.Secrets.RotationTopic; topic != "" {
+		if err := app.StartSecretRotationListener(ctx, app.Secrets, topic); err != nil {
+			slog.Warn("Secret rotation events unavailable; relying on SIGHUP and periodic refresh", "error", err)
+		}
+	}
+	defer srv.DB.Close()
+	if srv.DBRead != srv.DB {
+		defer srv.DBRead.Close()
+	}
 
-	fs := http.FileServer(http.Dir("./static"))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+	// Apply pending schema migrations before serving traffic.
+	// Set database.migrate_on_startup=false when migrations are run out-of-band (e.g. by a Job).
+	if cfg.Database.MigrateOnStartup {
+		if err := app.Migrate(srv.DB); err != nil {
+			slog.Error("Failed to apply database migrations", "error", err)
+			os.Exit(1)
+		}
+	}
 
+	// database.rls_mode adds Postgres row-level security on top of the app's own owner
+	// filters. The table setting follows the flag, so switch it for all replicas at once.
+	app.RLSMode = cfg.Database.RLSMode
+	if err := app.ConfigureRowLevelSecurity(ctx, srv.DB, app.RLSMode); err != nil {
+		slog.Error("Failed to configure row level security", "error", err)
+		if app.RLSMode {
+			os.Exit(1)
+		}
+	}
 
+	// database.prepared_statements (default on) prepares the hot todo queries once per pool.
+	app.PreparedStatements = cfg.Database.PreparedStatements
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		slog.Info("PORT environment variable not set, defaulting to 8080")
+	// database.write_batching (default off) coalesces concurrent todo inserts into
+	// multi-row INSERTs of up to write_batch_max, waiting at most write_batch_wait.
+	app.WriteBatching.Enabled = cfg.Database.WriteBatching
+	app.WriteBatching.Wait, app.WriteBatching.Max = cfg.Database.WriteBatchWait, cfg.Database.WriteBatchMax
+
+	// One-time hand-over of todos created before per-user ownership, e.g. TODO_LEGACY_OWNER=user:<oidc sub>
+	if owner := cfg.Database.LegacyOwner; owner != "" {
+		if _, err := srv.AssignUnownedTodos(ctx, owner); err != nil {
+			slog.Warn("Failed to assign legacy todos", "owner", owner, "error", err)
+		}
+	}
+
+	// Periodically reconcile business metrics (open todos, median time-to-completion)
+	srv.StartBusinessMetricsReconciler(ctx, cfg.Database.BusinessMetricsInterval)
+
+	// Usage metering: flush per-minute buckets and roll up daily totals, on
+	// scheduler.usage_rollup when the scheduler is on
+	rollupInterval := 5 * time.Minute
+	if cfg.Scheduler.Enabled {
+		rollupInterval = 0
+	}
+	srv.StartUsageMeter(ctx, 30*time.Second, rollupInterval)
+
+	// Browser sessions: auth.session_idle_timeout (default 30m) and auth.session_max_age (default 12h)
+	app.SessionIdleTimeout, app.SessionMaxAge = cfg.Auth.SessionIdleTimeout, cfg.Auth.SessionMaxAge
+	srv.StartSessionJanitor(ctx, 10*time.Minute)
+
+	// Brute-force and abuse protection: temporary bans for repeated auth failures and
+	// malformed-request floods. State is per replica unless abuse.redis_url is set.
+	// server.trusted_proxy_hops selects the client IP from X-Forwarded-For (2 behind the GCLB).
+	app.TrustedProxyHops = cfg.Server.TrustedProxyHops
+	if cfg.Abuse.Enabled {
+		if url := cfg.Abuse.RedisURL; url != "" {
+			store, err := app.NewRedisAbuseStore(url)
+			if err != nil {
+				slog.Error("Invalid abuse.redis_url", "error", err)
+				os.Exit(1)
+			}
+			app.Abuse.Store = store
+		} else {
+			app.Abuse.Store = app.NewMemoryAbuseStore()
+		}
+	}
+
+	// Multi-tenancy: tenancy.enabled binds each request to a tenant (a subdomain of
+	// tenancy.base_domain, X-Tenant-ID or the tenancy.claim token claim) and limits each
+	// tenant's requests, counted with abuse protection's store when there is one.
+	if cfg.Tenancy.Enabled {
+		app.Tenancy = app.TenancyConfig{
+			Enabled:           true,
+			BaseDomain:        strings.ToLower(cfg.Tenancy.BaseDomain),
+			Claim:             cfg.Tenancy.Claim,
+			RequestsPerMinute: cfg.Tenancy.RequestsPerMinute,
+			Store:             app.Abuse.Store,
+		}
+		if app.Tenancy.Store == nil {
+			app.Tenancy.Store = app.NewMemoryAbuseStore()
+		}
+		if app.OIDC != nil {
+			app.OIDC.TenantClaim = cfg.Tenancy.Claim
+		}
+		slog.Info("Multi-tenancy enabled", "base_domain", app.Tenancy.BaseDomain, "claim", app.Tenancy.Claim)
+	}
+
+	// Exports: download links are signed with the first of exports.signing_keys
+	// (comma-separated, 32+ bytes each); the rest still verify during key rotation.
+	// exports.signing_keys_secret reads the list from a secret instead and follows its rotation.
+	// All replicas need the same keys, otherwise links only work on the replica that made them.
+	app.ExportRetention, app.ExportURLTTL, app.ExportTimeout = cfg.Exports.Retention, cfg.Exports.URLTTL, cfg.Exports.Timeout
+	if name := cfg.Exports.SigningKeysSecret; name != "" {
+		v, err := app.AccessSecretVersion(ctx, name)
+		if err == nil {
+			var keys [][]byte
+			if keys, err = app.ParseSigningKeys(v); err == nil {
+				app.ExportSigner = app.NewURLSigner(keys)
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to load export signing keys", "error", err)
+			os.Exit(1)
+		}
+		app.Secrets.OnChange(name, func(v string) {
+			keys, err := app.ParseSigningKeys(v)
+			if err != nil {
+				slog.Error("Rotated export signing keys are invalid, keeping current ones", "error", err)
+				return
+			}
+			app.ExportSigner.SetKeys(keys)
+			slog.Info("Rotated export signing keys", "keys", len(keys))
+		})
+	} else if v := cfg.Exports.SigningKeys; v != "" {
+		keys, _ := app.ParseSigningKeys(v) // checked by Validate
+		app.ExportSigner = app.NewURLSigner(keys)
 	} else {
-		slog.Info("PORT environment variable set", "port", port)
+		slog.Warn("exports.signing_keys not set, using a random per-replica key for export links")
+	}
+	srv.StartExportJanitor(ctx, 10*time.Minute)
+
+	// Todo attachments in a GCS bucket, uploaded and downloaded with signed URLs.
+	if bucket := cfg.Attachments.Bucket; bucket != "" {
+		store, err := app.NewGCSStore(ctx, bucket, cfg.Attachments.ServiceAccount)
+		if err != nil {
+			slog.Error("Failed to set up attachment storage", "bucket", bucket, "error", err)
+			os.Exit(1)
+		}
+		app.Attachments = store
+		app.AttachmentMaxBytes, app.AttachmentContentTypes, app.AttachmentURLTTL = cfg.Attachments.MaxBytes, cfg.Attachments.ContentTypes, cfg.Attachments.URLTTL
+		srv.StartAttachmentJanitor(ctx, time.Hour)
+		slog.Info("Attachments enabled", "bucket", bucket)
+	}
+
+	// Subtask suggestions, served while the suggest_subtasks feature flag is on.
+	app.SuggestionTimeout, app.SuggestionCacheTTL = cfg.Suggestions.Timeout, cfg.Suggestions.CacheTTL
+	if cfg.Suggestions.Provider == "vertex" {
+		suggester, err := app.NewVertexSuggester(ctx, cfg.ProjectID, cfg.Suggestions.Location, cfg.Suggestions.Model)
+		if err != nil {
+			slog.Error("Failed to set up subtask suggestions", "model", cfg.Suggestions.Model, "error", err)
+			os.Exit(1)
+		}
+		app.Suggester = suggester
+		slog.Info("Subtask suggestions from Vertex AI", "model", cfg.Suggestions.Model, "location", cfg.Suggestions.Location)
+	}
+	srv.StartIdempotencyJanitor(ctx, 10*time.Minute)
+
+	// Retention: purge todos completed or archived long ago, if configured.
+	app.Retention = app.RetentionPolicy{
+		CompletedAfter: cfg.Retention.CompletedAfter,
+		ArchivedAfter:  cfg.Retention.ArchivedAfter,
+		BatchSize:      cfg.Retention.BatchSize,
+		DryRun:         cfg.Retention.DryRun,
+	}
+	if app.Retention.Enabled() {
+		if !cfg.Scheduler.Enabled {
+			srv.StartRetentionJanitor(ctx, cfg.Retention.Interval)
+		}
+		slog.Info("Retention enabled", "completed_after", cfg.Retention.CompletedAfter.String(),
+			"archived_after", cfg.Retention.ArchivedAfter.String(), "dry_run", cfg.Retention.DryRun)
+	}
+
+	// Optional envelope encryption of task text, e.g.
+	// TASK_ENCRYPTION_KEY=projects/p/locations/us-central1/keyRings/todo-app/cryptoKeys/task-text
+	if kmsKey := cfg.Encryption.TaskKey; kmsKey != "" {
+		wrapper, err := app.NewKMSKeyWrapper(ctx, kmsKey)
+		if err != nil {
+			slog.Error("Failed to initialize task encryption", "error", err)
+			os.Exit(1)
+		}
+		srv.TaskCipher = app.NewFieldCipher(srv, wrapper)
+		srv.StartKeyRotation(ctx, srv.TaskCipher, time.Hour)
+		slog.Info("Task encryption enabled", "kms_key", kmsKey)
 	}
 
+	// -mcp-stdio: an AI assistant started this process as its MCP server; serve the todo
+	// tools to it as the owner of TODO_API_KEY until it disconnects, instead of listening.
+	if cfg.MCPStdio {
+		if err := srv.ServeMCPStdio(ctx, os.Getenv("TODO_API_KEY")); err != nil {
+			slog.Error("MCP stdio server failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	port := cfg.Server.Port
 	slog.Info("Server starting", "port", port)
 
-	// Wrap handler with tracing and security middleware
-	handler := otelhttp.NewHandler(
-		app.SecurityHeadersMiddleware(mux),
-		"go-to-production",
-	)
+	// Pre-flight checks and startup banner. With preflight.strict a failure stops the
+	// pod before it binds the listener, instead of surfacing as failing requests.
+	checks := []app.PreflightCheck{
+		{Name: "config", Run: func(context.Context) error { return cfg.Validate() }},
+		app.DatabaseCheck("database", srv.DB),
+		app.MigrationsCheck(srv.DB),
+		app.SecretsCheck(secretAccessor, secretName),
+		app.ClockCheck(cfg.Preflight.ClockURL, cfg.Preflight.MaxClockSkew),
+	}
+	if srv.DBRead != srv.DB {
+		checks = append(checks, app.DatabaseCheck("database_replica", srv.DBRead))
+	}
+	if _, ok := app.RunPreflight(ctx, checks, cfg.Preflight.Timeout); !ok && cfg.Preflight.Strict {
+		slog.Error("Pre-flight checks failed in strict mode, exiting")
+		os.Exit(1)
+	}
+
+	// server.require_https (prod profile): redirect plain HTTP from the load balancer, HSTS, Secure cookies
+	app.RequireHTTPS = cfg.Server.RequireHTTPS
+	app.SwaggerUI = cfg.Server.SwaggerUI
+	app.ServerRenderedUI = cfg.Server.UI == "htmx"
+	app.SlackSigningSecret = cfg.Slack.SigningSecret
+	app.CalDAVEnabled = cfg.Calendar.CalDAV
 
-	server := &http.Server{
+	httpServer := &http.Server{
 		Addr:         ":" + port,
-		Handler:      handler,
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Handler:      server.New(srv, reloader),
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
+	// Optional TLS on the main listener (server.tls_cert_file, server.tls_key_file). With
+	// server.mtls_client_ca_file, client certificates are verified and callers whose SPIFFE ID
+	// is in server.mtls_allowed_ids ("/*" suffix for prefixes) authenticate with server.mtls_scopes.
+	if tls := cfg.Server; tls.TLSCertFile != "" {
+		tlsConfig, err := app.NewServerTLSConfig(tls.TLSCertFile, tls.TLSKeyFile, tls.MTLSClientCAFile)
+		if err != nil {
+			slog.Error("Failed to load TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		if tls.MTLSClientCAFile != "" {
+			app.MTLS, err = app.NewMTLSAllowlist(tls.MTLSAllowedIDs, tls.MTLSScopes)
+			if err != nil {
+				slog.Error("Invalid mTLS configuration", "error", err)
+				os.Exit(1)
+			}
+			slog.Info("mTLS client authentication enabled")
+		}
+		httpServer.TLSConfig = tlsConfig
+	}
+
+	// Live todo changes from LISTEN/NOTIFY on the primary, for gRPC WatchTodos, GraphQL
+	// subscriptions, /ws and /todos/events; the change log behind resuming is pruned here.
+	if err := app.ListenTodoChanges(ctx, app.TodoChanges); err != nil {
+		slog.Warn("Todo change feed unavailable, watchers will not receive changes", "error", err)
+	}
+	srv.StartTodoEventJanitor(ctx, 10*time.Minute)
+
+	// Read cache: cache.redis_url caches todo reads in Redis, or cache.memory_entries in
+	// each replica's memory. The change feed above drops entries others' writes made
+	// stale; cache.list_ttl and cache.todo_ttl bound the rest.
+	app.TodoCache.ListTTL, app.TodoCache.TodoTTL = cfg.Cache.ListTTL, cfg.Cache.TodoTTL
+	if url := cfg.Cache.RedisURL; url != "" {
+		store, err := app.NewRedisTodoCache(url)
+		if err != nil {
+			slog.Error("Invalid cache.redis_url", "error", err)
+			os.Exit(1)
+		}
+		app.TodoCache.Store = store
+	} else if n := cfg.Cache.MemoryEntries; n > 0 {
+		app.TodoCache.Store = app.NewMemoryTodoCache(n)
+	}
+	srv.InvalidateTodoCache(ctx, app.TodoChanges)
+	// Stats and tag counts are served from snapshots refreshed in the background.
+	app.Aggregates.Refresh, app.Aggregates.MaxStaleness = cfg.Cache.AggregateRefresh, cfg.Cache.AggregateMaxStaleness
+	srv.StartAggregateRefresher(ctx)
+
+	// Outbox: every todo change is handed to the sinks below once, in order.
+	app.WebhookTimeout, app.WebhookMaxAttempts = cfg.Webhooks.Timeout, cfg.Webhooks.MaxAttempts
+	app.WebhookDeliveryRetention, app.WebhookAllowPrivateTargets = cfg.Webhooks.DeliveryRetention, cfg.Webhooks.AllowPrivateTargets
+	sinks := []app.OutboxSink{app.NewWebhookSink(srv)}
+	if topic := cfg.Events.PubSubTopic; topic != "" {
+		// Without the sink, events would be marked dispatched and never reach the topic.
+		sink, err := app.NewPubSubSink(ctx, topic, cfg.Events.PubSubEndpoint)
+		if err != nil {
+			slog.Error("Failed to set up Pub/Sub event publishing", "topic", topic, "error", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
+		slog.Info("Publishing todo events to Pub/Sub", "topic", topic)
+	}
+	if brokers := cfg.Events.KafkaBrokers; len(brokers) > 0 {
+		sink, err := app.NewKafkaSink(app.NewKafkaSinkConfig(cfg.Events))
+		if err != nil {
+			slog.Error("Failed to set up Kafka event publishing", "brokers", brokers, "error", err)
+			os.Exit(1)
+		}
+		defer sink.Close()
+		sinks = append(sinks, sink)
+		slog.Info("Publishing todo events to Kafka", "brokers", brokers, "topic", cfg.Events.KafkaTopic)
+	}
+	if webhookURL := cfg.Slack.WebhookURL; webhookURL != "" {
+		// slack.notify: created and completed todos via the outbox, overdue ones by a poller.
+		notifier := app.NewSlackNotifier(srv, webhookURL, cfg.Slack.Notify)
+		sinks = append(sinks, notifier)
+		if slices.Contains(cfg.Slack.Notify, "overdue") {
+			notifier.StartOverdueNotifier(ctx, time.Minute)
+		}
+		slog.Info("Posting todo events to Slack", "events", cfg.Slack.Notify)
+	}
+	srv.StartOutboxDispatcher(ctx, 5*time.Second, sinks...)
+	if cfg.Notifications.EmailProvider != "" {
+		sender, err := app.NewEmailSender(cfg.Notifications)
+		if err != nil {
+			slog.Error("Failed to set up email reminders", "error", err)
+			os.Exit(1)
+		}
+		reminders := &app.Reminders{
+			Server:       srv,
+			Sender:       sender,
+			RemindBefore: cfg.Notifications.RemindBefore,
+			MaxAttempts:  cfg.Notifications.MaxAttempts,
+		}
+		if cfg.Scheduler.Enabled {
+			app.EmailReminders = reminders
+		} else {
+			reminders.Start(ctx, time.Minute)
+		}
+		slog.Info("Sending email reminders", "provider", sender.Name())
+	}
+	srv.StartWebhookDeliverer(ctx, 2*time.Second)
+
+	// Background jobs: exports, imports and maintenance, with retries (jobs.queue).
+	switch cfg.Jobs.Queue {
+	case "cloudtasks":
+		queue, err := app.NewCloudTasksQueue(ctx, cfg.Jobs.TasksQueue, cfg.Jobs.TargetURL, cfg.Jobs.SigningSecret, cfg.Jobs.ServiceAccount)
+		if err != nil {
+			slog.Error("Failed to set up the Cloud Tasks job queue", "queue", cfg.Jobs.TasksQueue, "error", err)
+			os.Exit(1)
+		}
+		srv.Jobs, app.JobSigningSecret = queue, []byte(cfg.Jobs.SigningSecret)
+		slog.Info("Running jobs from Cloud Tasks", "queue", cfg.Jobs.TasksQueue)
+	default:
+		queue := app.NewInProcessQueue(srv, cfg.Jobs.Workers)
+		queue.Start(ctx, 5*time.Second)
+		srv.Jobs = queue
+	}
+
+	// Periodic jobs on cron schedules (scheduler.*), started once per run across replicas.
+	if cfg.Scheduler.Enabled {
+		specs := []struct{ kind, spec string }{{"usage_rollup", cfg.Scheduler.UsageRollup}}
+		if app.Retention.Enabled() {
+			specs = append(specs, struct{ kind, spec string }{"retention_purge", cfg.Scheduler.RetentionPurge})
+		}
+		if app.EmailReminders != nil {
+			specs = append(specs, struct{ kind, spec string }{"reminders", cfg.Scheduler.Reminders})
+		}
+		for _, s := range specs {
+			if s.spec == "off" {
+				continue
+			}
+			schedule, err := app.NewSchedule(s.kind, s.spec)
+			if err != nil {
+				slog.Error("Invalid job schedule", "schedule", s.kind, "error", err)
+				os.Exit(1)
+			}
+			app.Scheduler.Schedules = append(app.Scheduler.Schedules, schedule)
+		}
+		app.Scheduler.Jitter = cfg.Scheduler.Jitter
+		srv.StartScheduler(ctx, 15*time.Second)
+	}
+
+	// gRPC API for internal callers (server.grpc_port), with the same TLS and credentials
+	// as the HTTP listener.
+	var stopGRPC func()
+	if grpcPort := cfg.Server.GRPCPort; grpcPort != "" {
+		lis, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			slog.Error("Failed to listen for gRPC", "port", grpcPort, "error", err)
+			os.Exit(1)
+		}
+		srv.StartGRPCHealth(ctx, 10*time.Second)
+		grpcServer := srv.NewGRPCServer(httpServer.TLSConfig)
+		stopGRPC = func() { grpcServer.GracefulStop() }
+		go func() {
+			slog.Info("gRPC server starting", "port", grpcPort)
+			if err := grpcServer.Serve(lis); err != nil {
+				slog.Error("gRPC server stopped unexpectedly", "error", err)
+				os.Exit(1)
+			}
+		}()
+		defer grpcServer.Stop()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if httpServer.TLSConfig != nil {
+			serveErr <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- httpServer.ListenAndServe()
+		}
+	}()
+
+	// SIGTERM, sent when the pod is deleted, and SIGINT shut down gracefully within
+	// server.shutdown_timeout: the listeners close, requests in flight finish, and the
+	// background workers finish the pass they are on and start no other (GET
+	// /admin/workers). Whatever is still running at the deadline is cancelled.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
 		slog.Error("Server stopped unexpectedly", "error", err)
 		os.Exit(1)
+	case sig := <-term:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", cfg.Server.ShutdownTimeout.String())
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancelShutdown()
+	if stopGRPC != nil {
+		go stopGRPC() // the deferred Stop ends the streams still open
+	}
+	drained := make(chan error, 1)
+	go func() { drained <- httpServer.Shutdown(shutdownCtx) }()
+	if err := app.Workers.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Background workers did not stop in time", "error", err)
+	}
+	if err := <-drained; err != nil {
+		slog.Warn("Requests still in flight at the shutdown deadline were cut off", "error", err)
 	}
-}
\ No newline at end of file
+	slog.Info("Shutdown complete")
+}
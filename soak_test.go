@@ -0,0 +1,292 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stevemcghee/go-to-production/internal/app"
+	"github.com/stevemcghee/go-to-production/internal/server"
+)
+
+var soakDuration = flag.Duration("soak", 0, "run TestIntegrationSoak for this long, e.g. -soak 4h")
+
+const (
+	soakWorkers = 16
+	soakUsers   = 4
+	// How far the goroutines and open files may grow over the baseline taken after the
+	// warm-up. A leak of one per request passes them within minutes; noise from idle
+	// connections and the GC does not.
+	soakGoroutineSlack = 50
+	soakFDSlack        = 25
+	// The live heap may sit soakHeapNoise over the baseline and grow by soakHeapSlope
+	// an hour after it, whatever the length of the run; the slope of a line fitted to
+	// the samples must stay under soakHeapSlope as well.
+	soakHeapNoise = 16 << 20
+	soakHeapSlope = 4 << 20
+)
+
+// flakyResilience fails every nth attempt of the operations run through inner with a
+// transient error, so that the retries run all along.
+type flakyResilience struct {
+	inner    app.Resilience
+	n        int64
+	attempts atomic.Int64
+}
+
+func (f *flakyResilience) Execute(op func() error) error {
+	return f.inner.Execute(func() error {
+		if f.attempts.Add(1)%f.n == 0 {
+			return errors.New("injected transient fault")
+		}
+		return op()
+	})
+}
+
+// soakSample is the resource use of the process at one time, with no request in flight.
+type soakSample struct {
+	at         time.Duration
+	goroutines int
+	heap       uint64 // live heap after a GC
+	fds        int    // -1 where /proc/self/fd is not there
+	requests   int64
+}
+
+func (s soakSample) String() string {
+	return fmt.Sprintf("%8s  goroutines %4d  heap %6.1f MiB  fds %4d  requests %d",
+		s.at.Round(time.Second), s.goroutines, float64(s.heap)/(1<<20), s.fds, s.requests)
+}
+
+func takeSoakSample(start time.Time, requests int64) soakSample {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+	return soakSample{time.Since(start), runtime.NumGoroutine(), m.HeapAlloc, fds, requests}
+}
+
+// heapSlope is the least-squares slope of the live heap over samples, in bytes an hour.
+func heapSlope(samples []soakSample) float64 {
+	var n, sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x, y := s.at.Hours(), float64(s.heap)
+		n, sx, sy, sxx, sxy = n+1, sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	if d := n*sxx - sx*sx; d != 0 {
+		return (n*sxy - sx*sy) / d
+	}
+	return 0
+}
+
+// TestIntegrationSoak sends mixed traffic through the app for -soak (it is skipped
+// without) and fails if the goroutines, open files or live heap keep growing. The
+// traffic goes through a real HTTP server and the middleware chain main serves, as
+// users authenticated by API keys, with the read cache on, usage metered and flushed,
+// every tenth database attempt failing so that it is retried, the change hub
+// publishing every write and clients coming and going on /todos/events. The process
+// is sampled at regular intervals with the traffic paused, and every sample after the
+// warm-up is checked against the first one:
+//
+//	go test -tags integration -run Soak -soak 4h -timeout 5h -v .
+func TestIntegrationSoak(t *testing.T) {
+	if *soakDuration <= 0 {
+		t.Skip("run with -soak <duration>")
+	}
+	cleanupTodos(t)
+	originalBackoff := app.BackoffStrategy
+	srv := app.NewServer(testDB, testDB)
+	srv.Robustness = &flakyResilience{inner: srv.Robustness, n: 10}
+	app.BackoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 3)
+	app.TodoCache.Store = app.NewMemoryTodoCache(10000)
+	originalWorkers := app.Workers
+	workers := app.NewLifecycle()
+	app.Workers = workers
+	srv.APIKeys.SetBootstrapKey("soak-bootstrap")
+	defer func() {
+		app.BackoffStrategy, app.TodoCache.Store = originalBackoff, nil
+		app.Workers = originalWorkers
+		if _, err := srv.DB.Exec("DELETE FROM api_keys WHERE name LIKE 'soak-%'"); err != nil {
+			t.Errorf("failed to delete the soak API keys: %v", err)
+		}
+	}()
+
+	ts := httptest.NewServer(server.New(srv, http.NotFoundHandler()))
+	defer ts.Close()
+	client := ts.Client()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var requests, failures atomic.Int64
+	// do sends a request with key and returns the status and body, or -1 if it failed
+	// before a response, other than by ctx ending.
+	do := func(ctx context.Context, key, method, path, body string) (int, []byte) {
+		req, err := http.NewRequestWithContext(ctx, method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return -1, nil
+		}
+		req.Header.Set(app.APIKeyHeader, key)
+		req.Header.Set("Content-Type", "application/json")
+		requests.Add(1)
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				t.Errorf("%s %s: %v", method, path, err)
+				failures.Add(1)
+			}
+			return -1, nil
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode >= 500 {
+			if failures.Add(1) <= 10 {
+				t.Errorf("%s %s: %d %s", method, path, resp.StatusCode, b)
+			}
+		}
+		return resp.StatusCode, b
+	}
+	publish := func(op string, id int, owner string) {
+		app.TodoChanges.Publish(app.TodoChange{Op: op, ID: id, UserID: owner})
+	}
+
+	// One API key per user, created through the admin API; a key's todos are owned by
+	// its subject.
+	type soakUser struct{ key, owner string }
+	users := make([]soakUser, soakUsers)
+	for i := range users {
+		code, b := do(context.Background(), "soak-bootstrap", http.MethodPost, "/admin/apikeys",
+			fmt.Sprintf(`{"name": "soak-%d", "scopes": [%q, %q]}`, i, app.ScopeRead, app.ScopeWrite))
+		var key app.APIKey
+		if code != http.StatusCreated || json.Unmarshal(b, &key) != nil {
+			t.Fatalf("creating an API key: %d %s", code, b)
+		}
+		users[i] = soakUser{key: key.Key, owner: "apikey:" + strconv.FormatInt(key.ID, 10)}
+	}
+	srv.StartUsageMeter(ctx, 30*time.Second, 0)
+	before := runtime.NumGoroutine()
+
+	// Workers hold pause for reading while they send; the sampler takes it to write.
+	var pause sync.RWMutex
+	var wg sync.WaitGroup
+	for worker := range soakWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := users[worker%soakUsers]
+			var ids []int
+			for ctx.Err() == nil {
+				pause.RLock()
+				switch n := rand.IntN(100); {
+				case n < 30 || len(ids) == 0 && n < 80:
+					do(ctx, user.key, http.MethodGet, "/todos?limit=50", "")
+				case n < 50 || len(ids) == 0:
+					code, b := do(ctx, user.key, http.MethodPost, "/todos", `{"task": "soak", "tags": ["soak"]}`)
+					var todo app.Todo
+					if code == http.StatusCreated && json.Unmarshal(b, &todo) == nil {
+						ids = append(ids, todo.ID)
+						publish("insert", todo.ID, user.owner)
+					}
+				case n < 70:
+					do(ctx, user.key, http.MethodGet, "/todos/"+strconv.Itoa(ids[rand.IntN(len(ids))]), "")
+				case n < 85:
+					id := ids[rand.IntN(len(ids))]
+					if code, _ := do(ctx, user.key, http.MethodPut, "/todos/"+strconv.Itoa(id), fmt.Sprintf(`{"completed": %t}`, n%2 == 0)); code == http.StatusOK {
+						publish("update", id, user.owner)
+					}
+				case n < 95 || len(ids) > 50:
+					i := rand.IntN(len(ids))
+					id := ids[i]
+					ids = append(ids[:i], ids[i+1:]...)
+					if code, _ := do(ctx, user.key, http.MethodDelete, "/todos/"+strconv.Itoa(id), ""); code == http.StatusNoContent {
+						publish("delete", id, user.owner)
+					}
+				default:
+					// A client of the live stream that leaves after a while.
+					sctx, cancel := context.WithTimeout(ctx, time.Duration(100+rand.IntN(400))*time.Millisecond)
+					do(sctx, user.key, http.MethodGet, "/todos/events", "")
+					cancel()
+				}
+				pause.RUnlock()
+			}
+		}()
+	}
+
+	duration := *soakDuration
+	interval := max(duration/60, 10*time.Second)
+	warmup := max(duration/10, interval)
+	start := time.Now()
+	var baseline *soakSample
+	var samples []soakSample
+	for time.Since(start) < duration && !t.Failed() {
+		time.Sleep(min(interval, duration-time.Since(start)))
+		pause.Lock()
+		client.CloseIdleConnections()
+		s := takeSoakSample(start, requests.Load())
+		pause.Unlock()
+		t.Log(s)
+		switch {
+		case s.at < warmup:
+		case baseline == nil:
+			baseline = &s
+			samples = append(samples, s)
+		default:
+			samples = append(samples, s)
+			if s.goroutines > baseline.goroutines+soakGoroutineSlack {
+				t.Errorf("goroutines grew from %d to %d", baseline.goroutines, s.goroutines)
+			}
+			if s.fds > baseline.fds+soakFDSlack {
+				t.Errorf("open files grew from %d to %d", baseline.fds, s.fds)
+			}
+			if limit := baseline.heap + soakHeapNoise + uint64((s.at-baseline.at).Hours()*soakHeapSlope); s.heap > limit {
+				t.Errorf("live heap grew from %d to %d bytes, over %d", baseline.heap, s.heap, limit)
+			}
+		}
+	}
+	if slope := heapSlope(samples); len(samples) >= 10 && slope > soakHeapSlope {
+		t.Errorf("live heap grew %.1f MiB an hour over %d samples", slope/(1<<20), len(samples))
+	}
+	stop()
+	wg.Wait()
+	if err := workers.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// With the traffic gone, so are the goroutines it started.
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines left after the traffic stopped, %d before it started:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+	if n := failures.Load(); n > 0 {
+		t.Errorf("%d of %d requests failed", n, requests.Load())
+	}
+}
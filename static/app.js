@@ -7,6 +7,12 @@ document.addEventListener('DOMContentLoaded', () => {
     const input = document.getElementById('todo-input');
     const list = document.getElementById('todo-list');
 
+    // Echo the CSRF cookie on state-changing requests (double-submit cookie).
+    const csrfHeaders = () => {
+        const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]+)/);
+        return match ? { 'X-CSRF-Token': match[1] } : {};
+    };
+
     const fetchTodos = async () => {
         const response = await fetch('/todos');
         const todos = await response.json();
@@ -18,6 +24,8 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     };
 
+    // Adds todo to the list, or replaces the item already shown for it (our own
+    // changes also come back over the live connection).
     const renderTodo = (todo) => {
         const item = document.createElement('li');
         item.dataset.id = todo.id;
@@ -36,13 +44,25 @@ document.addEventListener('DOMContentLoaded', () => {
 
         item.appendChild(taskSpan);
         item.appendChild(deleteBtn);
-        list.appendChild(item);
+        const existing = list.querySelector(`[data-id='${todo.id}']`);
+        if (existing) {
+            existing.replaceWith(item);
+        } else {
+            list.appendChild(item);
+        }
+    };
+
+    const removeTodo = (id) => {
+        const li = list.querySelector(`[data-id='${id}']`);
+        if (li) {
+            li.remove();
+        }
     };
 
     const addTodo = async (task) => {
         const response = await fetch('/todos', {
             method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
+            headers: { 'Content-Type': 'application/json', ...csrfHeaders() },
             body: JSON.stringify({ task }),
         });
         const newTodo = await response.json();
@@ -52,23 +72,75 @@ document.addEventListener('DOMContentLoaded', () => {
     const toggleComplete = async (todo) => {
         const response = await fetch(`/todos/${todo.id}`, {
             method: 'PUT',
-            headers: { 'Content-Type': 'application/json' },
+            headers: { 'Content-Type': 'application/json', ...csrfHeaders() },
             body: JSON.stringify({ ...todo, completed: !todo.completed }),
         });
         if (response.ok) {
-            const li = document.querySelector(`[data-id='${todo.id}']`);
-            li.classList.toggle('completed');
+            renderTodo({ ...todo, completed: !todo.completed });
         }
     };
 
     const deleteTodo = async (id) => {
         const response = await fetch(`/todos/${id}`, {
             method: 'DELETE',
+            headers: csrfHeaders(),
         });
         if (response.ok) {
-            const li = document.querySelector(`[data-id='${id}']`);
-            li.remove();
+            removeTodo(id);
+        }
+    };
+
+    // Live updates: /ws pushes changes made anywhere, so the list stays current without
+    // polling. On "resync", or after reconnecting, changes may have been missed and the
+    // whole list is reloaded.
+    let retryDelay = 1000;
+    const connectLive = (reconnect) => {
+        const scheme = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        const ws = new WebSocket(`${scheme}//${window.location.host}/ws`);
+        ws.addEventListener('open', () => {
+            retryDelay = 1000;
+            if (reconnect) {
+                fetchTodos();
+            }
+        });
+        ws.addEventListener('message', (e) => {
+            const ev = JSON.parse(e.data);
+            switch (ev.type) {
+            case 'created':
+            case 'updated':
+                renderTodo(ev.todo);
+                break;
+            case 'deleted':
+                removeTodo(ev.id);
+                break;
+            case 'resync':
+                fetchTodos();
+                break;
+            }
+        });
+        ws.addEventListener('close', () => {
+            setTimeout(() => connectLive(true), retryDelay + Math.random() * 1000);
+            retryDelay = Math.min(retryDelay * 2, 30000);
+        });
+    };
+
+    const session = document.getElementById('session');
+
+    const fetchSession = async () => {
+        const response = await fetch('/auth/session');
+        if (!response.ok) {
+            return;
         }
+        const who = await response.json();
+        const label = document.createElement('span');
+        label.textContent = `Signed in as ${who.email || who.subject}`;
+        const logoutBtn = document.createElement('button');
+        logoutBtn.textContent = 'Sign out';
+        logoutBtn.addEventListener('click', async () => {
+            await fetch('/auth/logout', { method: 'POST', headers: csrfHeaders() });
+            window.location.reload();
+        });
+        session.replaceChildren(label, logoutBtn);
     };
 
     form.addEventListener('submit', (e) => {
@@ -80,5 +152,7 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    fetchSession();
     fetchTodos();
+    connectLive(false);
 });
@@ -0,0 +1,20 @@
+// Written by Gemini CLI
+// This file is licensed under the MIT License.
+// See the LICENSE file for details.
+
+// Swagger UI for /docs. It is loaded as a file because the CSP forbids inline scripts.
+window.addEventListener('load', () => {
+    window.ui = SwaggerUIBundle({
+        url: '/openapi.json',
+        dom_id: '#swagger-ui',
+        deepLinking: true,
+        // "Try it out" uses the browser's session; echo the CSRF cookie like the web UI.
+        requestInterceptor: (req) => {
+            const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]+)/);
+            if (match && req.method !== 'GET') {
+                req.headers['X-CSRF-Token'] = match[1];
+            }
+            return req;
+        },
+    });
+});
@@ -26,3 +26,24 @@ resource "google_monitoring_alert_policy" "high_error_rate" {
   }
   notification_channels = [google_monitoring_notification_channel.email.name]
 }
+
+resource "google_monitoring_alert_policy" "circuit_breaker_open" {
+  display_name = "Database Circuit Breaker Open"
+  combiner     = "OR"
+  conditions {
+    display_name = "circuit_breaker_state == open"
+    condition_threshold {
+      filter     = "resource.type=\"prometheus_target\" AND metric.type=\"prometheus.googleapis.com/circuit_breaker_state/gauge\""
+      duration   = "120s"
+      comparison = "COMPARISON_GT"
+      aggregations {
+        alignment_period     = "60s"
+        per_series_aligner   = "ALIGN_MAX"
+        cross_series_reducer = "REDUCE_MAX"
+        group_by_fields      = ["resource.cluster", "resource.namespace", "metric.labels.name"]
+      }
+      threshold_value = 1.5
+    }
+  }
+  notification_channels = [google_monitoring_notification_channel.email.name]
+}
@@ -121,6 +121,13 @@ resource "google_project_iam_member" "trace_agent" {
   member  = "serviceAccount:${google_service_account.todo_app_sa.email}"
 }
 
+# Grant Cloud Profiler Agent role for uploading profiles (PROFILER=cloud)
+resource "google_project_iam_member" "profiler_agent" {
+  project = var.project_id
+  role    = "roles/cloudprofiler.agent"
+  member  = "serviceAccount:${google_service_account.todo_app_sa.email}"
+}
+
 # Bind the Kubernetes Service Account to the Google Service Account
 resource "google_service_account_iam_member" "workload_identity_binding" {
   service_account_id = google_service_account.todo_app_sa.name
@@ -0,0 +1,45 @@
+# terraform/kms.tf
+
+# Key encryption key for field-level (envelope) encryption of task text.
+# The app wraps its data keys with it; set TASK_ENCRYPTION_KEY to its id to enable.
+# Rotation creates a new primary version; the app rewraps data keys in the background.
+resource "google_project_service" "cloudkms_api" {
+  project            = var.project_id
+  service            = "cloudkms.googleapis.com"
+  disable_on_destroy = false
+}
+
+resource "google_kms_key_ring" "todo_app" {
+  project    = var.project_id
+  name       = "todo-app"
+  location   = var.region
+  depends_on = [google_project_service.cloudkms_api]
+}
+
+resource "google_kms_crypto_key" "task_text" {
+  name            = "task-text"
+  key_ring        = google_kms_key_ring.todo_app.id
+  rotation_period = "7776000s" # 90 days
+
+  lifecycle {
+    prevent_destroy = true # destroying the key makes every encrypted task unreadable
+  }
+}
+
+resource "google_kms_crypto_key_iam_member" "task_text_encrypter" {
+  crypto_key_id = google_kms_crypto_key.task_text.id
+  role          = "roles/cloudkms.cryptoKeyEncrypterDecrypter"
+  member        = "serviceAccount:${google_service_account.todo_app_sa.email}"
+}
+
+# Needed to read the primary version, which drives data key rewrapping.
+resource "google_kms_crypto_key_iam_member" "task_text_viewer" {
+  crypto_key_id = google_kms_crypto_key.task_text.id
+  role          = "roles/cloudkms.viewer"
+  member        = "serviceAccount:${google_service_account.todo_app_sa.email}"
+}
+
+output "task_encryption_key" {
+  description = "Value for TASK_ENCRYPTION_KEY"
+  value       = google_kms_crypto_key.task_text.id
+}
@@ -0,0 +1,41 @@
+# terraform/secret_rotation.tf
+
+# Secret Manager publishes events (new versions, rotation reminders) for the app's
+# secrets to this topic. Each replica subscribes with its own short-lived
+# subscription; set SECRET_ROTATION_TOPIC to the topic id to enable.
+resource "google_project_service" "pubsub_api" {
+  project            = var.project_id
+  service            = "pubsub.googleapis.com"
+  disable_on_destroy = false
+}
+
+data "google_project" "current" {
+  project_id = var.project_id
+}
+
+resource "google_pubsub_topic" "secret_events" {
+  project    = var.project_id
+  name       = "todo-app-secret-events"
+  depends_on = [google_project_service.pubsub_api]
+}
+
+# The Secret Manager service agent must be able to publish before a secret can
+# reference the topic.
+resource "google_pubsub_topic_iam_member" "secret_manager_publisher" {
+  project = var.project_id
+  topic   = google_pubsub_topic.secret_events.name
+  role    = "roles/pubsub.publisher"
+  member  = "serviceAccount:service-${data.google_project.current.number}@gcp-sa-secretmanager.iam.gserviceaccount.com"
+}
+
+# Replicas create, consume and delete their own subscriptions.
+resource "google_project_iam_member" "secret_events_subscriber" {
+  project = var.project_id
+  role    = "roles/pubsub.editor"
+  member  = "serviceAccount:${google_service_account.todo_app_sa.email}"
+}
+
+output "secret_rotation_topic" {
+  description = "Value for SECRET_ROTATION_TOPIC"
+  value       = google_pubsub_topic.secret_events.id
+}
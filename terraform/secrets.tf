@@ -17,6 +17,12 @@ resource "google_secret_manager_secret" "app_secret" {
   replication {
     auto {}
   }
+
+  # Notify running replicas of new versions (see secret_rotation.tf)
+  topics {
+    name = google_pubsub_topic.secret_events.id
+  }
+  depends_on = [google_pubsub_topic_iam_member.secret_manager_publisher]
 }
 
 resource "google_secret_manager_secret_version" "app_secret_version" {
@@ -30,3 +36,42 @@ resource "google_secret_manager_secret_version" "app_secret_version" {
     db_read_port = "5433"
   })
 }
+
+# Bootstrap admin API key, used to mint the first database-backed API keys.
+resource "google_secret_manager_secret" "admin_api_key" {
+  secret_id = "todo-app-admin-key"
+  replication {
+    auto {}
+  }
+
+  # Notify running replicas of new versions (see secret_rotation.tf)
+  topics {
+    name = google_pubsub_topic.secret_events.id
+  }
+  depends_on = [google_pubsub_topic_iam_member.secret_manager_publisher]
+}
+
+resource "google_secret_manager_secret_version" "admin_api_key_version" {
+  secret      = google_secret_manager_secret.admin_api_key.id
+  secret_data = var.admin_api_key
+}
+
+# OAuth client for "Sign in with Google" (optional; sign-in is disabled without it).
+# Create the client under APIs & Services > Credentials, with redirect URI
+# https://<domain>/auth/google/callback.
+resource "google_secret_manager_secret" "google_oauth" {
+  count     = var.google_oauth_client_id != "" ? 1 : 0
+  secret_id = "todo-app-google-oauth"
+  replication {
+    auto {}
+  }
+}
+
+resource "google_secret_manager_secret_version" "google_oauth_version" {
+  count  = var.google_oauth_client_id != "" ? 1 : 0
+  secret = google_secret_manager_secret.google_oauth[0].id
+  secret_data = jsonencode({
+    client_id     = var.google_oauth_client_id
+    client_secret = var.google_oauth_client_secret
+  })
+}
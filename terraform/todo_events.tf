@@ -0,0 +1,31 @@
+# terraform/todo_events.tf
+
+# Todo change events for downstream consumers (analytics, notifications). The app
+# publishes every create, update and delete with the todo id as ordering key; set
+# EVENTS_PUBSUB_TOPIC to the topic id to enable. Consumers create their own
+# subscriptions, with message ordering enabled if they need per-todo order.
+resource "google_pubsub_topic" "todo_events" {
+  project = var.project_id
+  name    = "todo-app-todo-events"
+
+  # Lets a new subscription seek back to events published before it existed.
+  message_retention_duration = "604800s"
+
+  labels = {
+    app = "todo-app-go"
+  }
+
+  depends_on = [google_project_service.pubsub_api]
+}
+
+resource "google_pubsub_topic_iam_member" "todo_events_publisher" {
+  project = var.project_id
+  topic   = google_pubsub_topic.todo_events.name
+  role    = "roles/pubsub.publisher"
+  member  = "serviceAccount:${google_service_account.todo_app_sa.email}"
+}
+
+output "todo_events_topic" {
+  description = "Value for EVENTS_PUBSUB_TOPIC"
+  value       = google_pubsub_topic.todo_events.id
+}
@@ -47,6 +47,25 @@ variable "db_password" {
   sensitive   = true
 }
 
+variable "admin_api_key" {
+  description = "Bootstrap admin API key for the application's /admin endpoints (e.g. openssl rand -base64 36)"
+  type        = string
+  sensitive   = true
+}
+
+variable "google_oauth_client_id" {
+  description = "OAuth client ID for Sign in with Google (leave empty to disable)"
+  type        = string
+  default     = ""
+}
+
+variable "google_oauth_client_secret" {
+  description = "OAuth client secret for Sign in with Google"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
 variable "alert_email" {
   description = "Email address for monitoring alerts"
   type        = string
@@ -29,6 +29,16 @@ var (
 	mockdb  *sql.DB
 )
 
+// listTodosQuery matches the query of GET /todos.
+const listTodosQuery = "-- name: ListTodos :many SELECT id, task, completed, list_id, (.+) FROM todos WHERE (.+) ORDER BY (.+)"
+
+// todoRows returns the rows of a todo list query holding one todo.
+func todoRows(id int, task string, completed bool) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{"id", "task", "completed", "list_id", "due_at", "priority", "tags", "parent_id", "rrule", "remind_at", "created_at", "updated_at", "completed_at", "archived", "starred"}).
+		AddRow(id, task, completed, nil, nil, "", "{}", nil, "", nil, now, now, nil, false, false)
+}
+
 // TestMain sets up and tears down the test database using go-sqlmock.
 func TestMain(m *testing.M) {
 	var err error
@@ -40,26 +50,17 @@ func TestMain(m *testing.M) {
 	}
 	defer mockdb.Close() // Close mockdb at the end of TestMain
 
-	// Save original app.DB, app.DBRead, and app.backoffStrategy state
-	originalAppDB := app.DB
-	originalAppDBRead := app.DBRead
+	// Save original app.backoffStrategy state
 	originalBackoffStrategy := app.BackoffStrategy
 
 	// Use a fixed backoff for testing: 1 initial attempt + 2 retries = 3 attempts total
 	app.BackoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(1*time.Millisecond), 2) 
 
 	defer func() {
-		// Restore original app.DB, app.DBRead, and app.backoffStrategy state
-		app.DB = originalAppDB
-		app.DBRead = originalAppDBRead
+		// Restore original app.backoffStrategy state
 		app.BackoffStrategy = originalBackoffStrategy
 	}()
 
-	// Set app.DB variables for handlers to use mockdb
-	// These will be restored after all tests in this package run
-	app.DB = mockdb
-	app.DBRead = mockdb // Initially point both to mockdb
-
 	// Run tests
 	code := m.Run()
 
@@ -74,6 +75,7 @@ func TestMain(m *testing.M) {
 
 // TestChaosHealthzDBConnectionFailure tests /healthz when DB connection pings fail.
 func TestChaosHealthzDBConnectionFailure(t *testing.T) {
+	srv := app.NewServer(mockdb, mockdb)
 	t.Cleanup(func() { // Ensures expectations are met even if test fails mid-way
 		if err := mocksql.ExpectationsWereMet(); err != nil {
 			t.Errorf("there were unfulfilled expectations at the end of TestChaosHealthzDBConnectionFailure: %s", err)
@@ -85,7 +87,7 @@ func TestChaosHealthzDBConnectionFailure(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
-	app.HealthzHandler(w, req)
+	srv.HealthzHandler(w, req)
 
 	if w.Code != http.StatusInternalServerError {
 		t.Errorf("expected status %d on /healthz with db down, got %d", http.StatusInternalServerError, w.Code)
@@ -103,12 +105,6 @@ func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
 		}
 	})
 
-	// Save original app.CB state
-	originalAppCB := app.CB
-	defer func() {
-		app.CB = originalAppCB
-	}()
-
 	// Create a temporary CB that uses a very short retry timeout to speed up the test
 	tempCB := gobreaker.NewCircuitBreaker(gobreaker.Settings{
 		Name:    "TempGetTodosCB",
@@ -117,12 +113,13 @@ func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
 			return true // Trip immediately on first failure
 		},
 	})
-	app.CB = tempCB
+	srv := app.NewServer(mockdb, mockdb)
+	srv.CB = tempCB
 
 	// Simulate query failure multiple times (due to retry mechanism and fallback)
 	// app.RetryOperation retries up to MaxElapsedTime (5s). With InitialInterval=100ms, MaxInterval=2s.
 	// This means a maximum of about 7 attempts (initial + 6 retries) if each takes 100ms+. Plus fallback.
-	// Set enough expectations to cover both app.DBRead and app.DB attempts during a full retry cycle.
+	// Set enough expectations to cover both srv.DBRead and srv.DB attempts during a full retry cycle.
 	numExpectedFailures := 3
 	for i := 0; i < numExpectedFailures; i++ {
 		mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnError(fmt.Errorf("simulated db query error"))
@@ -130,14 +127,15 @@ func TestChaosGetTodosDBConnectionFailure(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w := httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 
 	// Due to retry mechanism, it should return 500
 	if w.Code != http.StatusInternalServerError {
 		t.Errorf("expected status %d on GetTodos with db down, got %d", http.StatusInternalServerError, w.Code)
 	}
-	if !bytes.Contains(w.Body.Bytes(), []byte("simulated db query error")) {
-		t.Errorf("expected body to contain 'simulated db query error', got %q", w.Body.String())
+	// Database errors are logged, never echoed to the client
+	if bytes.Contains(w.Body.Bytes(), []byte("simulated db query error")) {
+		t.Errorf("expected database error detail to be hidden from the client, got %q", w.Body.String())
 	}
 }
 
@@ -163,12 +161,8 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	}
 	testCB := gobreaker.NewCircuitBreaker(st)
 
-	// Save original app.CB state
-	originalAppCB := app.CB
-	defer func() {
-		app.CB = originalAppCB
-	}()
-	app.CB = testCB
+	srv := app.NewServer(mockdb, mockdb)
+	srv.CB = testCB
 
 	// --- Phase 1: DB is down, trip the circuit breaker ---
 	numExpectedFailuresPerLogicalCall := 3 // (initial + 2 retries)
@@ -190,11 +184,11 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w := httptest.NewRecorder()
-	app.GetTodos(w, req) // First logical failure from CB perspective
+	srv.GetTodos(w, req) // First logical failure from CB perspective
 
 		w = httptest.NewRecorder()
 
-		app.GetTodos(w, req) // Second logical failure from CB perspective
+		srv.GetTodos(w, req) // Second logical failure from CB perspective
 
 	
 
@@ -210,7 +204,7 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	// Expect no query from mock as circuit is open. The CB will return ErrOpenState
 	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w = httptest.NewRecorder()
-	app.GetTodos(w, req) // This call should be blocked by CB
+	srv.GetTodos(w, req) // This call should be blocked by CB
 
 	if w.Code != http.StatusServiceUnavailable {
 		t.Errorf("expected status 503 when circuit is open, got %d", w.Code)
@@ -227,12 +221,12 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	// --- Phase 4: DB comes back up, test recovery ---
 	t.Log("Restoring database connection (mocksql to return success)...")
 	// Configure mocksql to return a successful query for the single request in half-open state
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(1, "Test Task", false))
+	mocksql.ExpectQuery(listTodosQuery).WillReturnRows(todoRows(1, "Test Task", false))
 
 	// This request in half-open state should succeed and close the circuit
 	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d on recovery request, got %d. Body: %q", http.StatusOK, w.Code, w.Body.String())
@@ -244,10 +238,10 @@ func TestChaosCircuitBreakerOpensAndCloses(t *testing.T) {
 	}
 
 	// Subsequent requests should also succeed
-	mocksql.ExpectQuery("SELECT (.+) FROM todos").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Another Task", true))
+	mocksql.ExpectQuery(listTodosQuery).WillReturnRows(todoRows(2, "Another Task", true))
 	req = httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w = httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d on subsequent request, got %d", http.StatusOK, w.Code) // Changed %q to %d
 	}
@@ -277,34 +271,24 @@ func TestChaosReadReplicaFailover(t *testing.T) {
 		}
 	})
 
-	// Save original app.DB and app.DBRead state
-	originalAppDB := app.DB
-	originalAppDBRead := app.DBRead
-	defer func() {
-		app.DB = originalAppDB
-		app.DBRead = originalAppDBRead
-	}()
-
-	// Configure app.DB to use mockdbPrimary (primary success)
-	app.DB = mockdbPrimary
-	// Configure app.DBRead to use mockdbReplica (replica failure)
-	app.DBRead = mockdbReplica
+	// A server on mockdbPrimary (primary success) and mockdbReplica (replica failure)
+	srv := app.NewServer(mockdbPrimary, mockdbReplica)
 
 	// Expect the query to mockdbReplica to fail multiple times due to retries
 	// `RetryOperation` attempts 8 times
 	numReadReplicaFailures := 1
 	for i := 0; i < numReadReplicaFailures; i++ {
-		mocksqlReplica.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnError(fmt.Errorf("simulated read replica failure"))
+		mocksqlReplica.ExpectQuery(listTodosQuery).WillReturnError(fmt.Errorf("simulated read replica failure"))
 	}
 
 	// Expect the subsequent query to mockdbPrimary to succeed (after replica failures and fallback)
-	mocksqlPrimary.ExpectQuery("SELECT id, task, completed FROM todos ORDER BY id").WillReturnRows(sqlmock.NewRows([]string{"id", "task", "completed"}).AddRow(2, "Fallback Task", true))
+	mocksqlPrimary.ExpectQuery(listTodosQuery).WillReturnRows(todoRows(2, "Fallback Task", true))
 
 
 	// Make a GET request, which should use the read replica first, fail, and fall back to the primary
 	req := httptest.NewRequest(http.MethodGet, "/todos", nil)
 	w := httptest.NewRecorder()
-	app.GetTodos(w, req)
+	srv.GetTodos(w, req)
 
 	// The request should succeed by falling back to the primary
 	if w.Code != http.StatusOK {